@@ -231,6 +231,11 @@ func (c *Conn) Receive() {
 			c.fatal(err)
 			break
 		}
+		if packet == nil {
+			// Unrecognized message type (e.g., a server-initiated "reset"
+			// without a registered decoder).
+			continue
+		}
 		var (
 			reply   Reply
 			ok      bool
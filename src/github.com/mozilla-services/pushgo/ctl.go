@@ -0,0 +1,241 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+// Environment variables holding the defaults for the ctl admin flags.
+const (
+	ctlAdminURLEnv   = "PUSHGOCTL_ADMIN_URL"
+	ctlAdminTokenEnv = "PUSHGOCTL_ADMIN_TOKEN"
+)
+
+// ctlTimeout bounds each request sent by a ctl subcommand.
+const ctlTimeout = 30 * time.Second
+
+type ctlCommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+// ctlCommands is populated by init, as the commands refer to the table for
+// their usage.
+var ctlCommands map[string]*ctlCommand
+
+func init() {
+	ctlCommands = map[string]*ctlCommand{
+		"send": {
+			"send [-version n] [-data s] [-priority p] [-api-key k] <endpoint>\n" +
+				"\tSend a notification to a push endpoint.",
+			ctlSend,
+		},
+		"decode": {
+			"decode [-config file] [-overlay files] <endpoint|token>\n" +
+				"\tDecode an endpoint token with the configured token keys.",
+			ctlDecode,
+		},
+		"uaid": {
+			"uaid [-admin url] [-token t] <uaid>\n" +
+				"\tLook up a device's node, channels, and pending updates.",
+			ctlUAID,
+		},
+		"drain": {
+			"drain [-admin url] [-token t]\n" +
+				"\tDrain a node and shut it down, as on SIGTERM.",
+			ctlDrain,
+		},
+	}
+}
+
+// runCtl runs an operational subcommand: "pushgo ctl <command> [args]".
+// Returns the process exit status.
+func runCtl(args []string) int {
+	if len(args) == 0 || ctlCommands[args[0]] == nil {
+		ctlUsage()
+		return 2
+	}
+	if err := ctlCommands[args[0]].run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "pushgo ctl %s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func ctlUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: pushgo ctl <command> [arguments]\n\nCommands:")
+	for _, name := range []string{"send", "decode", "uaid", "drain"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", ctlCommands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nThe admin URL and token default to $%s and $%s.\n",
+		ctlAdminURLEnv, ctlAdminTokenEnv)
+}
+
+// ctlFlags returns a flag set for a subcommand, printing its usage on error.
+func ctlFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("pushgo ctl "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pushgo ctl %s\n", ctlCommands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseCtlFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return fmt.Errorf("expected %d argument(s), got %d", nargs, flags.NArg())
+	}
+	return nil
+}
+
+func ctlSend(args []string) error {
+	flags := ctlFlags("send")
+	version := flags.Int64("version", 0, "Update version; defaults to the current time")
+	data := flags.String("data", "", "Update payload")
+	priority := flags.String("priority", "", "Routing priority")
+	apiKey := flags.String("api-key", "", "App server API key")
+	if err := parseCtlFlags(flags, args, 1); err != nil {
+		return err
+	}
+	form := url.Values{}
+	if *version > 0 {
+		form.Set("version", strconv.FormatInt(*version, 10))
+	}
+	if len(*data) > 0 {
+		form.Set("data", *data)
+	}
+	if len(*priority) > 0 {
+		form.Set("priority", *priority)
+	}
+	req, err := http.NewRequest("PUT", flags.Arg(0), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(*apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+*apiKey)
+	}
+	return ctlDo(req)
+}
+
+func ctlDecode(args []string) error {
+	flags := ctlFlags("decode")
+	config := flags.String("config", "config.toml", "Configuration file")
+	overlays := flags.String("overlay", "", "Comma-separated config overlays")
+	if err := parseCtlFlags(flags, args, 1); err != nil {
+		return err
+	}
+	filenames := []string{*config}
+	for _, filename := range strings.Split(*overlays, ",") {
+		if filename = strings.TrimSpace(filename); len(filename) > 0 {
+			filenames = append(filenames, filename)
+		}
+	}
+	tokens, err := simplepush.LoadTokenKeyring(filenames...)
+	if err != nil {
+		return err
+	}
+	decoded, err := simplepush.DecodeEndpoint(tokens, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	return encoder.Encode(decoded)
+}
+
+// adminFlags adds the admin URL and token flags to a subcommand.
+func adminFlags(flags *flag.FlagSet) (adminURL, token *string) {
+	adminURL = flags.String("admin", os.Getenv(ctlAdminURLEnv),
+		"Admin listener URL; e.g., http://127.0.0.1:8083")
+	token = flags.String("token", os.Getenv(ctlAdminTokenEnv), "Admin token")
+	return
+}
+
+func adminRequest(method, adminURL, token, path string) (*http.Request, error) {
+	if len(adminURL) == 0 {
+		return nil, fmt.Errorf("missing admin URL; set -admin or $%s", ctlAdminURLEnv)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(adminURL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func ctlUAID(args []string) error {
+	flags := ctlFlags("uaid")
+	adminURL, token := adminFlags(flags)
+	if err := parseCtlFlags(flags, args, 1); err != nil {
+		return err
+	}
+	req, err := adminRequest("GET", *adminURL, *token,
+		"/admin/clients/"+url.QueryEscape(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+	return ctlDo(req)
+}
+
+func ctlDrain(args []string) error {
+	flags := ctlFlags("drain")
+	adminURL, token := adminFlags(flags)
+	if err := parseCtlFlags(flags, args, 0); err != nil {
+		return err
+	}
+	req, err := adminRequest("POST", *adminURL, *token, "/admin/drain")
+	if err != nil {
+		return err
+	}
+	return ctlDo(req)
+}
+
+// ctlDo sends a request, and copies the response body to stdout. JSON
+// bodies are indented. Returns an error for non-2xx responses.
+func ctlDo(req *http.Request) error {
+	client := &http.Client{Timeout: ctlTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, body, "", "  ") != nil {
+		out.Reset()
+		out.Write(body)
+	}
+	if out.Len() > 0 && out.Bytes()[out.Len()-1] != '\n' {
+		out.WriteByte('\n')
+	}
+	io.Copy(os.Stdout, &out)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -12,24 +12,69 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/kitcambridge/envconf"
 
 	"github.com/mozilla-services/pushgo/simplepush"
 )
 
 var (
 	configFile *string = flag.String("config", "config.toml", "Configuration File")
+	overlays   *string = flag.String("overlay", "",
+		"Comma-separated config files layered over the configuration file, "+
+			"in increasing precedence")
 	profile    *string = flag.String("profile", "", "Profile file output")
 	memProfile *string = flag.String("memProfile", "", "Profile file output")
 	logging    *int    = flag.Int("logging", 0,
 		"logging level (0=none,1=critical ... 10=verbose")
-	version *bool = flag.Bool("version", false, "Print the version and exit")
+	version  *bool   = flag.Bool("version", false, "Print the version and exit")
+	fixtures *string = flag.String("fixtures", "",
+		"Write client conformance fixtures to this directory and exit")
+	pidFile     *string = flag.String("pidfile", "", "Write the process ID to this file")
+	checkConfig checkMode
 )
 
-const SIGUSR1 = syscall.SIGUSR1
+func init() {
+	flag.Var(&checkConfig, "check-config",
+		"Validate the config file, print the effective settings, and exit "+
+			"(=deep also checks secrets, listeners, and storage)")
+}
+
+// checkMode is the value of the -check-config flag, which may be given
+// without a value for a shallow check.
+type checkMode string
+
+func (m *checkMode) String() string   { return string(*m) }
+func (m *checkMode) IsBoolFlag() bool { return true }
+
+func (m *checkMode) Set(value string) error {
+	switch value {
+	case "true":
+		value = simplepush.CheckShallow
+	case "false":
+		value = ""
+	}
+	*m = checkMode(value)
+	return nil
+}
+
+const (
+	SIGUSR1 = syscall.SIGUSR1
+	SIGUSR2 = syscall.SIGUSR2
+)
+
+// upgradeTimeout is how long to wait for the new process to start serving
+// during a binary upgrade before giving up.
+const upgradeTimeout = 30 * time.Second
 
 // -- main
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *version {
@@ -37,6 +82,19 @@ func main() {
 		return
 	}
 
+	if *fixtures != "" {
+		path, err := simplepush.WriteFixtures(*fixtures)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(path)
+		return
+	}
+
+	if len(checkConfig) > 0 {
+		os.Exit(runConfigCheck(configFiles(), string(checkConfig)))
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// Only create profiles if requested. To view the application profiles,
 	// see http://blog.golang.org/profiling-go-programs
@@ -64,7 +122,7 @@ func main() {
 	}
 
 	// Load the app from the config file
-	app, err := simplepush.LoadApplicationFromFileName(*configFile, *logging)
+	app, err := simplepush.LoadApplicationFromFileNames(configFiles(), *logging)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -72,17 +130,96 @@ func main() {
 	// Report what the app believes the current host to be, and what version.
 	log.Printf("CurrentHost: %s, Version: %s", app.Hostname(), simplepush.VERSION)
 
+	if *pidFile != "" {
+		if err = simplepush.WritePidFile(*pidFile); err != nil {
+			log.Fatal(err.Error())
+		}
+		defer simplepush.RemovePidFile(*pidFile)
+	}
+
 	// wait for sigint
 	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
+		SIGUSR1, SIGUSR2)
 
 	// And we're underway!
 	errChan := app.Run()
 
-	select {
-	case err = <-errChan:
-	case <-sigChan:
-		app.Logger().Info("main", "Recieved signal, shutting down.", nil)
+	// Tell the process that started this one during an upgrade to drain.
+	if err = simplepush.NotifyReady(); err != nil {
+		app.Logger().Error("main", "Could not notify the previous process",
+			simplepush.LogFields{"error": err.Error()})
+	}
+
+	// Drains run in the background, so that a second SIGTERM or SIGINT can
+	// cut a drain short.
+	var drained chan bool
+	drain := func() {
+		if drained != nil {
+			return
+		}
+		drained = make(chan bool)
+		go func() {
+			app.Drain()
+			close(drained)
+		}()
+	}
+	for running := true; running; {
+		select {
+		case err = <-errChan:
+			running = false
+		case <-drained:
+			running = false
+		case <-app.DrainRequests():
+			// An operator asked the node to drain via the admin API.
+			app.Logger().Info("main", "Drain requested, draining.", nil)
+			drain()
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				// Re-read the config file and audit the changes, which apply
+				// on restart, then pick up renewed TLS certificates.
+				// Certificate errors are logged by the server, which keeps
+				// serving the current certificates.
+				if _, rerr := app.ReloadConfig(configFiles()...); rerr != nil {
+					app.Logger().Error("main", "Could not reload config",
+						simplepush.LogFields{"error": rerr.Error()})
+				}
+				app.Server().ReloadCerts()
+				if rerr := app.Router().ReloadCerts(); rerr != nil {
+					app.Logger().Error("main", "Could not reload router certificates",
+						simplepush.LogFields{"error": rerr.Error()})
+				}
+				continue
+			}
+			if drained != nil {
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+					app.Logger().Info("main", "Received signal while draining, shutting down.", nil)
+					running = false
+				}
+				continue
+			}
+			if sig == SIGUSR2 {
+				// Start the new binary on the same listeners, then drain.
+				app.Logger().Info("main", "Received SIGUSR2, upgrading.", nil)
+				if _, uerr := simplepush.Upgrade(upgradeTimeout); uerr != nil {
+					app.Logger().Error("main", "Could not upgrade",
+						simplepush.LogFields{"error": uerr.Error()})
+					continue
+				}
+				// The new process serves the same address; keep it registered.
+				app.Server().Registration().Release()
+				drain()
+				continue
+			}
+			if sig == syscall.SIGTERM {
+				// Hand clients off to other nodes before exiting.
+				app.Logger().Info("main", "Received SIGTERM, draining.", nil)
+				drain()
+				continue
+			}
+			app.Logger().Info("main", "Recieved signal, shutting down.", nil)
+			running = false
+		}
 	}
 	app.Stop()
 	if err != nil {
@@ -90,5 +227,35 @@ func main() {
 	}
 }
 
+// configFiles returns the base config file, followed by its overlays.
+func configFiles() []string {
+	filenames := []string{*configFile}
+	for _, filename := range strings.Split(*overlays, ",") {
+		if filename = strings.TrimSpace(filename); len(filename) > 0 {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// runConfigCheck validates the layered config and prints the effective
+// settings. Returns the process exit code.
+func runConfigCheck(filenames []string, mode string) int {
+	layers, err := simplepush.LoadConfigLayers(filenames...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	check := simplepush.CheckConfig(layers.Config, envconf.Load(), mode)
+	check.WriteSettings(os.Stdout)
+	for _, err := range check.Errors {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if !check.OK() {
+		return 1
+	}
+	return 0
+}
+
 // 04fs
 // vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -128,8 +128,7 @@ func (r *Helper) RetryAttempt(attempt, multiplier int, err error) (
 	if !r.canRetry(err) {
 		return 0, false
 	}
-	retryDelay := r.Delay * time.Duration(pow(r.Backoff, attempt-1))
-	delay = r.withJitter(retryDelay)
+	delay = r.AttemptDelay(attempt)
 	select {
 	case <-r.closeNotify():
 		return delay, false
@@ -138,6 +137,15 @@ func (r *Helper) RetryAttempt(attempt, multiplier int, err error) (
 	return delay, true
 }
 
+// AttemptDelay returns the backoff delay, with jitter, before the given
+// retry attempt. Attempts start at 1.
+func (r *Helper) AttemptDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	return r.withJitter(r.Delay * time.Duration(pow(r.Backoff, attempt-1)))
+}
+
 func (r *Helper) withJitter(delay time.Duration) time.Duration {
 	if delay > r.MaxDelay {
 		delay = r.MaxDelay
@@ -0,0 +1,374 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client violations scored by the abuse tracker.
+const (
+	ViolationMalformed   = "malformed"
+	ViolationPings       = "pings"
+	ViolationRateLimited = "ratelimited"
+)
+
+// Ban kinds.
+const (
+	BanIP   = "ip"
+	BanUAID = "uaid"
+)
+
+type AbuseConfig struct {
+	// Threshold is the violation score at which a client is banned. A
+	// threshold of 0 (the default) disables banning.
+	Threshold float64 `env:"threshold"`
+
+	// HalfLife is the time it takes for a violation score to halve.
+	// Defaults to 5 minutes.
+	HalfLife string `toml:"half_life" env:"half_life"`
+
+	// BanDuration is the length of a first ban. Each later ban of the same
+	// client doubles, up to MaxBanDuration. Defaults to 1 minute.
+	BanDuration string `toml:"ban_duration" env:"ban_duration"`
+
+	// MaxBanDuration caps ban lengths. Clients that are not banned again
+	// within this period start over at BanDuration. Defaults to 24 hours.
+	MaxBanDuration string `toml:"max_ban_duration" env:"max_ban_duration"`
+
+	// Scores are the weights of each kind of violation.
+	Scores AbuseScores `toml:"scores" env:"scores"`
+
+	// MaxSize is the maximum number of clients tracked. Defaults to 100000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// Exempt lists addresses shared by many clients, such as carrier NAT
+	// gateways, as CIDR blocks or addresses. Exempt addresses and trusted
+	// proxies are never banned; their clients can still be banned by
+	// device ID.
+	Exempt []string `env:"exempt"`
+}
+
+type AbuseScores struct {
+	// Malformed scores unparsable frames and unknown commands.
+	// Defaults to 2.
+	Malformed float64 `env:"malformed"`
+
+	// Pings scores clients that ping more often than the minimum ping
+	// interval. Defaults to 5.
+	Pings float64 `env:"pings"`
+
+	// RateLimited scores commands rejected by the rate limiter, such as
+	// register floods. Defaults to 1.
+	RateLimited float64 `toml:"ratelimited" env:"ratelimited"`
+}
+
+// Ban describes a banned client.
+type Ban struct {
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	Until    time.Time `json:"until"`
+	Offenses int       `json:"offenses"`
+}
+
+type abuseEntry struct {
+	score    float64
+	updated  time.Time
+	offenses int
+	until    time.Time // Zero if not banned.
+}
+
+// AbuseTracker scores client violations per address and device ID, and
+// temporarily bans clients whose scores reach the threshold. Bans double in
+// length for repeat offenders.
+type AbuseTracker struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	proxies  TrustedProxies
+	exempt   TrustedProxies // Trusted proxies and shared addresses.
+	scores   map[string]float64
+	enabled  bool
+	halfLife time.Duration
+	banLen   time.Duration
+	maxBan   time.Duration
+	thresh   float64
+	maxSize  int
+	lock     sync.Mutex
+	entries  map[string]*abuseEntry // Keyed by kind and value.
+}
+
+func NewAbuseTracker(proxies TrustedProxies) *AbuseTracker {
+	return &AbuseTracker{
+		proxies: proxies,
+		entries: make(map[string]*abuseEntry),
+	}
+}
+
+func (*AbuseTracker) ConfigStruct() interface{} {
+	return &AbuseConfig{
+		HalfLife:       "5m",
+		BanDuration:    "1m",
+		MaxBanDuration: "24h",
+		Scores: AbuseScores{
+			Malformed:   2,
+			Pings:       5,
+			RateLimited: 1,
+		},
+		MaxSize: 100000,
+	}
+}
+
+func (a *AbuseTracker) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AbuseConfig)
+	a.logger = app.Logger()
+	a.metrics = app.Metrics()
+	if a.halfLife, err = time.ParseDuration(conf.HalfLife); err != nil {
+		a.logger.Panic("abuse", "Could not parse score half-life",
+			LogFields{"error": err.Error(), "halfLife": conf.HalfLife})
+		return err
+	}
+	if a.banLen, err = time.ParseDuration(conf.BanDuration); err != nil {
+		a.logger.Panic("abuse", "Could not parse ban duration",
+			LogFields{"error": err.Error(), "duration": conf.BanDuration})
+		return err
+	}
+	if a.maxBan, err = time.ParseDuration(conf.MaxBanDuration); err != nil {
+		a.logger.Panic("abuse", "Could not parse maximum ban duration",
+			LogFields{"error": err.Error(), "duration": conf.MaxBanDuration})
+		return err
+	}
+	exempt, err := ParseTrustedProxies(conf.Exempt)
+	if err != nil {
+		a.logger.Panic("abuse", "Could not parse exempt addresses",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	a.exempt = append(append(TrustedProxies{}, a.proxies...), exempt...)
+	a.thresh = conf.Threshold
+	a.enabled = a.thresh > 0
+	a.maxSize = conf.MaxSize
+	a.scores = map[string]float64{
+		ViolationMalformed:   conf.Scores.Malformed,
+		ViolationPings:       conf.Scores.Pings,
+		ViolationRateLimited: conf.Scores.RateLimited,
+	}
+	return nil
+}
+
+// Enabled indicates whether abusive clients are banned.
+func (a *AbuseTracker) Enabled() bool {
+	return a != nil && a.enabled
+}
+
+// Violation scores a violation by the client with the given address and
+// device ID, either of which may be empty, and bans the client if its score
+// reaches the threshold.
+func (a *AbuseTracker) Violation(kind, uaid, remoteAddr string) {
+	if !a.Enabled() {
+		return
+	}
+	a.metrics.Increment("abuse.violation." + kind)
+	weight := a.scores[kind]
+	if weight <= 0 {
+		return
+	}
+	now := time.Now()
+	if a.exempt.Trusts(remoteAddr) {
+		// Banning a shared address would ban every client behind it.
+		remoteAddr = ""
+	}
+	a.score(BanIP, remoteAddr, weight, now)
+	a.score(BanUAID, uaid, weight, now)
+}
+
+func (a *AbuseTracker) score(kind, value string, weight float64, now time.Time) {
+	if len(value) == 0 {
+		return
+	}
+	key := kind + ":" + value
+	a.lock.Lock()
+	entry, ok := a.entries[key]
+	if !ok {
+		if len(a.entries) >= a.maxSize {
+			a.pruneLocked(now)
+		}
+		entry = &abuseEntry{updated: now}
+		a.entries[key] = entry
+	}
+	if now.Before(entry.until) {
+		// Already banned.
+		a.lock.Unlock()
+		return
+	}
+	if !entry.until.IsZero() && now.Sub(entry.until) >= a.maxBan {
+		// Forget offenses after a clean period.
+		entry.offenses = 0
+	}
+	entry.score = a.decay(entry, now) + weight
+	entry.updated = now
+	if entry.score < a.thresh {
+		a.lock.Unlock()
+		return
+	}
+	duration := a.banLen << uint(entry.offenses)
+	if duration <= 0 || duration > a.maxBan {
+		duration = a.maxBan
+	}
+	entry.offenses++
+	entry.score = 0
+	entry.until = now.Add(duration)
+	offenses := entry.offenses
+	a.lock.Unlock()
+
+	a.metrics.Increment("abuse.banned." + kind)
+	if a.logger.ShouldLog(WARNING) {
+		a.logger.Warn("abuse", "Banned abusive client", LogFields{
+			"kind":     kind,
+			"value":    value,
+			"duration": duration.String(),
+			"offenses": strconv.Itoa(offenses)})
+	}
+}
+
+// decay returns the entry's score, decayed since it was last updated. Scores
+// decay in whole seconds, so that violations in quick succession add up to
+// exactly the threshold.
+func (a *AbuseTracker) decay(entry *abuseEntry, now time.Time) float64 {
+	elapsed := now.Sub(entry.updated) / time.Second * time.Second
+	if a.halfLife <= 0 || elapsed <= 0 {
+		return entry.score
+	}
+	halves := float64(elapsed) / float64(a.halfLife)
+	return entry.score * math.Pow(0.5, halves)
+}
+
+// pruneLocked removes entries that are not banned and have no offenses to
+// remember. If that is not enough, the least recently scored entries that
+// are not banned are removed, down to three quarters of the limit, so that
+// an attacker rotating addresses cannot exhaust memory, nor lift active bans
+// by flooding the tracker.
+func (a *AbuseTracker) pruneLocked(now time.Time) {
+	type candidate struct {
+		key     string
+		updated time.Time
+	}
+	var candidates []candidate
+	for key, entry := range a.entries {
+		if now.Before(entry.until) {
+			continue
+		}
+		if entry.offenses == 0 || now.Sub(entry.until) >= a.maxBan {
+			delete(a.entries, key)
+			continue
+		}
+		candidates = append(candidates, candidate{key, entry.updated})
+	}
+	excess := len(a.entries) - a.maxSize*3/4
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].updated.Before(candidates[j].updated)
+	})
+	if excess > len(candidates) {
+		// Only active bans remain; they expire on their own.
+		excess = len(candidates)
+	}
+	for _, c := range candidates[:excess] {
+		delete(a.entries, c.key)
+	}
+	a.metrics.IncrementBy("abuse.evicted", int64(excess))
+}
+
+// Banned indicates whether a client address or device ID is banned.
+func (a *AbuseTracker) Banned(kind, value string) bool {
+	if !a.Enabled() || len(value) == 0 {
+		return false
+	}
+	a.lock.Lock()
+	entry, ok := a.entries[kind+":"+value]
+	banned := ok && time.Now().Before(entry.until)
+	a.lock.Unlock()
+	return banned
+}
+
+// Bans returns all active bans, ordered by expiry.
+func (a *AbuseTracker) Bans() []Ban {
+	if a == nil {
+		return nil
+	}
+	now := time.Now()
+	bans := []Ban{}
+	a.lock.Lock()
+	for key, entry := range a.entries {
+		if !now.Before(entry.until) {
+			continue
+		}
+		kind, value := splitBanKey(key)
+		bans = append(bans, Ban{kind, value, entry.until, entry.offenses})
+	}
+	a.lock.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Unban lifts a ban and clears the client's score and offenses. It returns
+// false if the client was not banned.
+func (a *AbuseTracker) Unban(kind, value string) bool {
+	if a == nil {
+		return false
+	}
+	key := kind + ":" + value
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	entry, ok := a.entries[key]
+	if !ok || !time.Now().Before(entry.until) {
+		return false
+	}
+	delete(a.entries, key)
+	return true
+}
+
+func splitBanKey(key string) (kind, value string) {
+	i := strings.IndexByte(key, ':')
+	return key[:i], key[i+1:]
+}
+
+// BanListener closes connections from banned addresses as they are
+// accepted, before any TLS or WebSocket handshake. Connections from trusted
+// proxies are left to the handlers, which check the forwarded client
+// address.
+type BanListener struct {
+	net.Listener
+	abuse   *AbuseTracker
+	metrics Statistician
+}
+
+func NewBanListener(ln net.Listener, abuse *AbuseTracker,
+	metrics Statistician) *BanListener {
+
+	return &BanListener{ln, abuse, metrics}
+}
+
+// Accept implements net.Listener.Accept.
+func (l *BanListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.abuse.Banned(BanIP, hostOnly(conn.RemoteAddr().String())) {
+			return conn, nil
+		}
+		conn.Close()
+		l.metrics.Increment("abuse.rejected.accept")
+	}
+}
@@ -0,0 +1,146 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAbuseTracker(t *testing.T, app *Application) *AbuseTracker {
+	proxies, _ := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	abuse := NewAbuseTracker(proxies)
+	conf := abuse.ConfigStruct().(*AbuseConfig)
+	conf.Threshold = 4
+	conf.HalfLife = "1h"
+	conf.Exempt = []string{"198.51.100.0/24"}
+	if err := abuse.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing abuse tracker: %s", err)
+	}
+	return abuse
+}
+
+func TestAbuseTracker(t *testing.T) {
+	_, app := newTestHandler(t)
+	abuse := newTestAbuseTracker(t, app)
+	uaid := "deadbeef000000000000000000000000"
+
+	abuse.Violation(ViolationMalformed, uaid, "192.0.2.1")
+	if abuse.Banned(BanIP, "192.0.2.1") || abuse.Banned(BanUAID, uaid) {
+		t.Fatal("Client banned below the threshold")
+	}
+	abuse.Violation(ViolationMalformed, "", "192.0.2.1")
+	if !abuse.Banned(BanIP, "192.0.2.1") {
+		t.Error("Address not banned at the threshold")
+	}
+	if abuse.Banned(BanUAID, uaid) {
+		t.Error("Device banned below the threshold")
+	}
+	if abuse.Banned(BanIP, "192.0.2.2") {
+		t.Error("Unrelated address banned")
+	}
+
+	bans := abuse.Bans()
+	if len(bans) != 1 || bans[0].Kind != BanIP || bans[0].Value != "192.0.2.1" ||
+		bans[0].Offenses != 1 {
+		t.Fatalf("Wrong bans: %#v", bans)
+	}
+	if ttl := bans[0].Until.Sub(time.Now()); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Wrong first ban duration: %s", ttl)
+	}
+
+	// Repeat offenders are banned for twice as long.
+	entry := abuse.entries[BanIP+":192.0.2.1"]
+	entry.until = time.Now()
+	abuse.Violation(ViolationPings, "", "192.0.2.1")
+	if ttl := entry.until.Sub(time.Now()); ttl <= time.Minute || ttl > 2*time.Minute {
+		t.Errorf("Wrong second ban duration: %s", ttl)
+	}
+
+	if !abuse.Unban(BanIP, "192.0.2.1") || abuse.Banned(BanIP, "192.0.2.1") {
+		t.Error("Ban not lifted")
+	}
+	if abuse.Unban(BanIP, "192.0.2.1") {
+		t.Error("Lifted a ban twice")
+	}
+
+	// Disabled trackers never ban.
+	var disabled *AbuseTracker
+	disabled.Violation(ViolationMalformed, uaid, "192.0.2.1")
+	if disabled.Banned(BanIP, "192.0.2.1") {
+		t.Error("Disabled tracker banned a client")
+	}
+}
+
+func TestAbuseTrackerSharedAddresses(t *testing.T) {
+	_, app := newTestHandler(t)
+	abuse := newTestAbuseTracker(t, app)
+	uaid := "deadbeef000000000000000000000000"
+
+	// Proxies and NAT gateways are not banned, but their clients' devices
+	// are.
+	for _, addr := range []string{"10.0.0.1", "198.51.100.1"} {
+		abuse.Violation(ViolationPings, uaid, addr)
+		if abuse.Banned(BanIP, addr) {
+			t.Errorf("Shared address %s banned", addr)
+		}
+	}
+	if !abuse.Banned(BanUAID, uaid) {
+		t.Error("Device behind shared address not banned")
+	}
+}
+
+func TestAbuseTrackerPrune(t *testing.T) {
+	_, app := newTestHandler(t)
+	abuse := newTestAbuseTracker(t, app)
+	abuse.maxSize = 4
+	abuse.Violation(ViolationPings, "", "192.0.2.1")
+
+	// Flooding the tracker evicts other entries, not active bans.
+	for i := 2; i < 20; i++ {
+		abuse.Violation(ViolationMalformed, "", "192.0.2."+strconv.Itoa(i))
+	}
+	if !abuse.Banned(BanIP, "192.0.2.1") {
+		t.Error("Active ban lifted by pruning")
+	}
+	if size := len(abuse.entries); size > 4 {
+		t.Errorf("Wrong tracker size: got %d; want at most 4", size)
+	}
+}
+
+func TestBansHandler(t *testing.T) {
+	handler, app := newTestHandler(t)
+	abuse := newTestAbuseTracker(t, app)
+	app.Server().abuse = abuse
+	abuse.Violation(ViolationPings, "", "192.0.2.1")
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/bans", nil)
+	handler.BansHandler(resp, req)
+	var bans []Ban
+	if err := json.Unmarshal(resp.Body.Bytes(), &bans); err != nil {
+		t.Fatalf("Error decoding bans: %s", err)
+	}
+	if len(bans) != 1 || bans[0].Value != "192.0.2.1" {
+		t.Errorf("Wrong bans: %#v", bans)
+	}
+
+	form := url.Values{"kind": {BanIP}, "value": {"192.0.2.1"}}
+	for i, status := range []int{http.StatusOK, http.StatusNotFound} {
+		resp = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/admin/bans", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.BansHandler(resp, req)
+		if resp.Code != status {
+			t.Errorf("Wrong status for unban %d: got %d; want %d", i, resp.Code, status)
+		}
+	}
+}
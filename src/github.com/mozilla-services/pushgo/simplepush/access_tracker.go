@@ -0,0 +1,224 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessStore is implemented by storage adapters that can persist device
+// last-access times. Adapters that do not implement it will not receive
+// access updates.
+type AccessStore interface {
+	// PutAccessed records the last-access times for a batch of devices.
+	PutAccessed(accessed map[string]time.Time) error
+}
+
+type AccessTrackerConfig struct {
+	// FlushInterval is the amount of time to buffer last-access times before
+	// writing them to the store. Setting this to "0" writes each access
+	// through to the store immediately. Defaults to 1 minute.
+	FlushInterval string `toml:"flush_interval" env:"flush_interval"`
+
+	// MaxPending is the maximum number of buffered devices. The tracker will
+	// flush early if this limit is reached. Defaults to 10000.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// Debounce is the minimum time between recorded accesses for a device.
+	// Accesses within this window of the last recorded one are dropped, so
+	// that a pinging device is written at most once per window. Defaults to
+	// 10 minutes.
+	Debounce string `env:"debounce"`
+}
+
+// AccessTracker batches device last-access times in memory, so that idle
+// clients that only send pings don't generate a storage write per command.
+// Each device is recorded at most once per debounce window. Devices recorded
+// within the window are also considered known, allowing repeated handshakes
+// to skip the Store.Exists() lookup; devices whose records are dropped must
+// be forgotten.
+type AccessTracker struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	store       AccessStore
+	interval    time.Duration
+	debounce    time.Duration
+	maxPending  int
+	lock        sync.Mutex
+	pending     map[string]time.Time
+	recorded    map[string]time.Time // Last recorded access for each device.
+	flushSignal chan bool
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeLock   sync.Mutex
+	isClosed    bool
+}
+
+func NewAccessTracker() *AccessTracker {
+	return &AccessTracker{
+		pending:     make(map[string]time.Time),
+		recorded:    make(map[string]time.Time),
+		flushSignal: make(chan bool, 1),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*AccessTracker) ConfigStruct() interface{} {
+	return &AccessTrackerConfig{
+		FlushInterval: "1m",
+		MaxPending:    10000,
+		Debounce:      "10m",
+	}
+}
+
+func (t *AccessTracker) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AccessTrackerConfig)
+	t.logger = app.Logger()
+	t.metrics = app.Metrics()
+	t.store, _ = app.Store().(AccessStore)
+
+	if t.interval, err = time.ParseDuration(conf.FlushInterval); err != nil {
+		t.logger.Panic("access", "Could not parse flush interval",
+			LogFields{"error": err.Error(), "interval": conf.FlushInterval})
+		return err
+	}
+	if t.debounce, err = time.ParseDuration(conf.Debounce); err != nil {
+		t.logger.Panic("access", "Could not parse debounce window",
+			LogFields{"error": err.Error(), "debounce": conf.Debounce})
+		return err
+	}
+	t.maxPending = conf.MaxPending
+
+	app.Events().Subscribe(EventClientConnected, func(event *Event) {
+		t.Touch(event.UAID)
+	})
+
+	// Without buffering, the loop only discards old accesses.
+	period := t.interval
+	if period <= 0 {
+		period = t.debounce
+	}
+	if period > 0 {
+		t.closeWait.Add(1)
+		go t.flushLoop(period)
+	}
+	return nil
+}
+
+// Touch records an access for the given device, unless an access was
+// recorded within the debounce window. The access time is written to the
+// store on the next flush.
+func (t *AccessTracker) Touch(uaid string) {
+	if len(uaid) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	t.lock.Lock()
+	if t.debounce > 0 {
+		if last, ok := t.recorded[uaid]; ok && now.Sub(last) < t.debounce {
+			t.lock.Unlock()
+			t.metrics.Increment("access.debounced")
+			return
+		}
+		t.recorded[uaid] = now
+	}
+	if t.interval <= 0 {
+		t.lock.Unlock()
+		t.put(map[string]time.Time{uaid: now})
+		return
+	}
+	t.pending[uaid] = now
+	pending := len(t.pending)
+	t.lock.Unlock()
+	if t.maxPending > 0 && pending >= t.maxPending {
+		select {
+		case t.flushSignal <- true:
+		default:
+		}
+	}
+}
+
+// Known indicates whether an access was recorded for the device within the
+// debounce window.
+func (t *AccessTracker) Known(uaid string) bool {
+	t.lock.Lock()
+	last, ok := t.recorded[uaid]
+	t.lock.Unlock()
+	return ok && time.Since(last) < t.debounce
+}
+
+// Forget discards the device's pending access, and stops considering it
+// known. Called when the device's records are dropped.
+func (t *AccessTracker) Forget(uaid string) {
+	t.lock.Lock()
+	delete(t.pending, uaid)
+	delete(t.recorded, uaid)
+	t.lock.Unlock()
+}
+
+// Flush writes all buffered access times to the store, and discards
+// accesses recorded before the debounce window.
+func (t *AccessTracker) Flush() error {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = make(map[string]time.Time, len(pending))
+	for uaid, last := range t.recorded {
+		if time.Since(last) >= t.debounce {
+			delete(t.recorded, uaid)
+		}
+	}
+	t.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return t.put(pending)
+}
+
+func (t *AccessTracker) put(accessed map[string]time.Time) (err error) {
+	if t.store == nil {
+		return nil
+	}
+	if err = t.store.PutAccessed(accessed); err != nil {
+		if t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("access", "Could not store last-access times", LogFields{
+				"error": err.Error(), "devices": strconv.Itoa(len(accessed))})
+		}
+		t.metrics.Increment("access.flush.error")
+		return err
+	}
+	t.metrics.IncrementBy("access.flush.devices", int64(len(accessed)))
+	return nil
+}
+
+func (t *AccessTracker) flushLoop(period time.Duration) {
+	defer t.closeWait.Done()
+	ticker := time.NewTicker(period)
+	for ok := true; ok; {
+		select {
+		case ok = <-t.closeSignal:
+		case <-ticker.C:
+			t.Flush()
+		case <-t.flushSignal:
+			t.Flush()
+		}
+	}
+	ticker.Stop()
+}
+
+// Close stops the flush loop and writes any buffered access times.
+func (t *AccessTracker) Close() error {
+	t.closeLock.Lock()
+	if t.isClosed {
+		t.closeLock.Unlock()
+		return nil
+	}
+	t.isClosed = true
+	close(t.closeSignal)
+	t.closeLock.Unlock()
+	t.closeWait.Wait()
+	return t.Flush()
+}
@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+// accessTestStore counts last-access writes per device.
+type accessTestStore map[string]int
+
+func (s accessTestStore) PutAccessed(accessed map[string]time.Time) error {
+	for uaid := range accessed {
+		s[uaid]++
+	}
+	return nil
+}
+
+func Test_AccessTrackerDebounce(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	store := make(accessTestStore)
+	metrics := new(TestMetrics)
+	metrics.Init(nil, nil)
+	// Not initialized, so that the test controls when flushes happen.
+	tracker := NewAccessTracker()
+	tracker.metrics = metrics
+	tracker.store = store
+	tracker.interval = time.Minute
+	tracker.debounce = time.Hour
+
+	if tracker.Known(uaid) {
+		t.Errorf("Device known before first access")
+	}
+	// A device that keeps pinging is written once per debounce window, not
+	// once per flush.
+	for i := 0; i < 3; i++ {
+		tracker.Touch(uaid)
+		tracker.Touch(uaid)
+		tracker.Flush()
+	}
+	if store[uaid] != 1 {
+		t.Errorf("Wrong number of writes for pinging device: got %d; want 1", store[uaid])
+	}
+	if n := metrics.Counters["access.debounced"]; n != 5 {
+		t.Errorf("Wrong debounced access count: got %d; want 5", n)
+	}
+	if !tracker.Known(uaid) {
+		t.Errorf("Device not known within debounce window")
+	}
+
+	// Dropped devices are no longer known, and are recorded again on their
+	// next access.
+	tracker.Forget(uaid)
+	if tracker.Known(uaid) {
+		t.Errorf("Device still known after it was forgotten")
+	}
+	tracker.Touch(uaid)
+	tracker.Flush()
+	if store[uaid] != 2 {
+		t.Errorf("Wrong number of writes after forgetting: got %d; want 2", store[uaid])
+	}
+
+	// Accesses recorded before the window are discarded on flush.
+	tracker.recorded[uaid] = time.Now().Add(-2 * time.Hour)
+	if tracker.Known(uaid) {
+		t.Errorf("Device known after the debounce window")
+	}
+	tracker.Flush()
+	if _, ok := tracker.recorded[uaid]; ok {
+		t.Errorf("Old access not discarded on flush")
+	}
+}
+
+func Test_AccessTrackerWriteThrough(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	store := make(accessTestStore)
+	metrics := new(TestMetrics)
+	metrics.Init(nil, nil)
+	tracker := NewAccessTracker()
+	tracker.metrics = metrics
+	tracker.store = store
+
+	// Without buffering or debouncing, each access is written.
+	tracker.Touch(uaid)
+	tracker.Touch(uaid)
+	if store[uaid] != 2 {
+		t.Errorf("Wrong number of writes: got %d; want 2", store[uaid])
+	}
+	if len(tracker.recorded) != 0 {
+		t.Errorf("Accesses recorded with debouncing disabled")
+	}
+}
@@ -0,0 +1,433 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+var (
+	ErrMissingAdminAuth  = errors.New("Missing admin credentials")
+	ErrInvalidAdminToken = errors.New("Invalid admin token")
+	ErrInvalidAdminSpec  = errors.New(`Admin tokens must be of the form "name:token"`)
+)
+
+// adminHandoffTimeout bounds requests to the node holding a device's
+// connection when disconnecting the device.
+const adminHandoffTimeout = 10 * time.Second
+
+type AdminConfig struct {
+	// Listener configures the admin listener. The admin API is disabled if
+	// no address is set.
+	Listener ListenerConfig `toml:"listener" env:"listener"`
+
+	// Tokens lists the operators allowed to use the admin API, each of the
+	// form "name:token". Tokens are sent as "Authorization: Bearer <token>".
+	// If the listener verifies client certificates, operators may
+	// authenticate with a certificate instead; the certificate's common
+	// name identifies the operator.
+	Tokens []string `env:"tokens"`
+
+	// Debug serves runtime profiles, expvar variables, goroutine dumps, and
+	// a dump of all connection states on the admin listener.
+	Debug bool `env:"debug"`
+}
+
+// AdminAuth authenticates requests to the admin listener.
+type AdminAuth struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	certs      bool
+	debug      bool
+	tokensLock sync.RWMutex
+	tokens     map[string]string // Operator names, keyed by token hash.
+}
+
+func NewAdminAuth() *AdminAuth {
+	return &AdminAuth{tokens: make(map[string]string)}
+}
+
+func (*AdminAuth) ConfigStruct() interface{} {
+	return &AdminConfig{
+		Listener: ListenerConfig{
+			MaxConns:        100,
+			KeepAlivePeriod: "3m",
+		},
+	}
+}
+
+func (a *AdminAuth) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AdminConfig)
+	a.logger = app.Logger()
+	a.metrics = app.Metrics()
+	if err = a.SetTokens(conf.Tokens); err != nil {
+		a.logger.Panic("admin", "Could not parse admin token",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	a.certs = conf.Listener.UseTLS() && len(conf.Listener.ClientCAFile) > 0
+	a.debug = conf.Debug
+	if len(conf.Listener.Addr) > 0 && len(conf.Tokens) == 0 &&
+		!conf.Listener.RequireClientCert {
+
+		// Never expose the admin API without authentication.
+		a.logger.Panic("admin", "Admin listener requires tokens or client certificates",
+			LogFields{"addr": conf.Listener.Addr})
+		return ConfigurationErr
+	}
+	app.Secrets().OnChange("default.admin.tokens", a.SetTokens)
+	return nil
+}
+
+// Debug indicates whether runtime diagnostics are served on the admin
+// listener.
+func (a *AdminAuth) Debug() bool {
+	return a.debug
+}
+
+// SetTokens replaces the operator tokens, each of the form "name:token".
+func (a *AdminAuth) SetTokens(specs []string) error {
+	tokens := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		colon := strings.Index(spec, ":")
+		if colon < 1 || colon == len(spec)-1 {
+			return ErrInvalidAdminSpec
+		}
+		tokens[HashAPIKey(spec[colon+1:])] = spec[:colon]
+	}
+	a.tokensLock.Lock()
+	a.tokens = tokens
+	a.tokensLock.Unlock()
+	return nil
+}
+
+// Authenticate returns the name of the operator that sent an admin request.
+func (a *AdminAuth) Authenticate(req *http.Request) (name string, err error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		hash := HashAPIKey(strings.TrimSpace(auth[7:]))
+		a.tokensLock.RLock()
+		defer a.tokensLock.RUnlock()
+		for tokenHash, operator := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(tokenHash)) == 1 {
+				return operator, nil
+			}
+		}
+		return "", ErrInvalidAdminToken
+	}
+	if a.certs && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		if name = cert.Subject.CommonName; len(name) == 0 {
+			name = cert.Subject.String()
+		}
+		return name, nil
+	}
+	return "", ErrMissingAdminAuth
+}
+
+// Handler wraps an admin handler, rejecting unauthenticated requests.
+func (a *AdminAuth) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		operator, err := a.Authenticate(req)
+		if err != nil {
+			if a.logger.ShouldLog(WARNING) {
+				a.logger.Warn("admin", "Rejected admin request",
+					LogFields{"rid": req.Header.Get(HeaderID), "path": req.URL.Path,
+						"error": err.Error()})
+			}
+			a.metrics.Increment("admin.auth.failed")
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="pushgo"`)
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method != "GET" && a.logger.ShouldLog(NOTICE) {
+			a.logger.Notice("admin", "Admin request",
+				LogFields{"rid": req.Header.Get(HeaderID), "operator": operator,
+					"method": req.Method, "path": req.URL.Path})
+		}
+		a.metrics.Increment("admin.requests")
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// AdminChannel describes a channel registered to a device.
+type AdminChannel struct {
+	ChannelID   string `json:"channelID"`
+	LastTouched int64  `json:"lastTouched,omitempty"`
+}
+
+// AdminClientReply is the body of the admin device lookup reply.
+type AdminClientReply struct {
+	UAID string `json:"uaid"`
+
+	// Tenant is the tenant that issued the device ID, if any.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Connected indicates whether the device is connected to this node.
+	Connected bool `json:"connected"`
+
+	// Node is the routing URL of the node holding the device's connection,
+	// if known.
+	Node string `json:"node,omitempty"`
+
+	// Channels lists the device's channels, if the store can list them.
+	Channels []AdminChannel `json:"channels,omitempty"`
+
+	// Pending is the number of updates not yet acknowledged by the device.
+	Pending int `json:"pending"`
+
+	// Pinger indicates whether the device registered proprietary ping data.
+	Pinger bool `json:"pinger"`
+
+	// LastPing is the result of the last proprietary ping sent to the
+	// device, if recorded.
+	LastPing *PingOutcome `json:"lastPing,omitempty"`
+}
+
+// AdminPurgeReply is the body of the admin disconnect and purge replies.
+type AdminPurgeReply struct {
+	UAID         string `json:"uaid"`
+	Disconnected bool   `json:"disconnected"`
+	Purged       bool   `json:"purged"`
+}
+
+// AdminStatusReply is the body of the admin node status reply.
+type AdminStatusReply struct {
+	StatusReport
+	Hostname    string `json:"hostname"`
+	ClientURL   string `json:"clientURL"`
+	EndpointURL string `json:"endpointURL"`
+	RouterURL   string `json:"routerURL"`
+	Draining    bool   `json:"draining"`
+	Routes      int    `json:"routes"`
+}
+
+// AdminClientHandler looks up a device's connection node, channels, and
+// pending updates. DELETE requests disconnect the device and remove all its
+// channels, pending updates, and proprietary ping data.
+func (self *Handler) AdminClientHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		self.adminLookup(resp, req, uaid)
+	case "DELETE":
+		self.adminPurge(resp, req, uaid)
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (self *Handler) adminLookup(resp http.ResponseWriter, req *http.Request,
+	uaid string) {
+
+	reply := &AdminClientReply{UAID: uaid,
+		Tenant: self.app.Server().Tenants().Of(uaid).Name()}
+	if reply.Connected = self.app.ClientExists(uaid); reply.Connected {
+		reply.Node = self.router.URL()
+	} else {
+		reply.Node = self.router.Routes().Lookup(uaid)
+	}
+	if !reply.Connected && !self.store.Exists(uaid) {
+		http.NotFound(resp, req)
+		return
+	}
+	updates, _, err := self.store.FetchAll(uaid, time.Time{})
+	if err != nil {
+		self.writeAdminError(resp, req, uaid, "Could not fetch pending updates", err)
+		return
+	}
+	reply.Pending = len(updates)
+	if lister, ok := self.store.(ChannelLister); ok {
+		channels, err := lister.Channels(uaid)
+		if err != nil {
+			self.writeAdminError(resp, req, uaid, "Could not list channels", err)
+			return
+		}
+		reply.Channels = make([]AdminChannel, len(channels))
+		for i, channel := range channels {
+			reply.Channels[i].ChannelID = channel.ChannelID
+			if !channel.LastTouched.IsZero() {
+				reply.Channels[i].LastTouched = channel.LastTouched.Unix()
+			}
+		}
+	}
+	if pingData, err := self.store.FetchPing(uaid); err == nil {
+		reply.Pinger = len(pingData) > 0
+	}
+	if outcomes, ok := self.store.(PingOutcomeStore); ok {
+		reply.LastPing, _ = outcomes.FetchPingOutcome(uaid)
+	}
+	self.metrics.Increment("admin.client.lookup")
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+func (self *Handler) adminPurge(resp http.ResponseWriter, req *http.Request,
+	uaid string) {
+
+	reply := &AdminPurgeReply{UAID: uaid}
+	var err error
+	if reply.Disconnected, err = self.adminDisconnect(uaid); err != nil {
+		self.writeAdminError(resp, req, uaid, "Could not disconnect client", err)
+		return
+	}
+	if err = self.store.DropAll(uaid); err != nil {
+		self.writeAdminError(resp, req, uaid, "Could not purge client", err)
+		return
+	}
+	self.app.Server().Access().Forget(uaid)
+	if err = self.store.DropPing(uaid); err != nil {
+		self.writeAdminError(resp, req, uaid, "Could not purge ping data", err)
+		return
+	}
+	reply.Purged = true
+	if self.logger.ShouldLog(NOTICE) {
+		self.logger.Notice("handler", "Purged client",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	self.metrics.Increment("admin.client.purged")
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// AdminDisconnectHandler closes a device's connection, whether it is held by
+// this node or another. The device reconnects as usual.
+func (self *Handler) AdminDisconnectHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	reply := &AdminPurgeReply{UAID: uaid}
+	var err error
+	if reply.Disconnected, err = self.adminDisconnect(uaid); err != nil {
+		self.writeAdminError(resp, req, uaid, "Could not disconnect client", err)
+		return
+	}
+	if !reply.Disconnected {
+		http.NotFound(resp, req)
+		return
+	}
+	if self.logger.ShouldLog(NOTICE) {
+		self.logger.Notice("handler", "Disconnected client",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	self.metrics.Increment("admin.client.disconnected")
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// adminDisconnect closes the device's connection. Connections held by other
+// nodes are released via the node's handoff endpoint.
+func (self *Handler) adminDisconnect(uaid string) (disconnected bool, err error) {
+	if client, ok := self.app.GetClient(uaid); ok {
+		client.PushWS.Bye(CloseGoingAway)
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, client.PushWS)
+		return true, nil
+	}
+	node := self.router.Routes().Lookup(uaid)
+	if len(node) == 0 || node == self.router.URL() {
+		return false, nil
+	}
+	req, err := self.router.NewPeerRequest("POST", node+"/handoff/"+uaid, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := self.router.HTTPClient(adminHandoffTimeout).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Unexpected handoff response: %s", resp.Status)
+	}
+	reply := new(HandoffReply)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return false, err
+	}
+	if reply.Released {
+		self.router.Routes().Forget(uaid, node)
+	}
+	return reply.Released, nil
+}
+
+// AdminStatusHandler reports the health, listeners, and load of this node.
+func (self *Handler) AdminStatusHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	server := self.app.Server()
+	reply := &AdminStatusReply{
+		StatusReport: self.statusReport(),
+		Hostname:     self.app.Hostname(),
+		ClientURL:    server.ClientURL(),
+		EndpointURL:  server.EndpointURL(),
+		RouterURL:    self.router.URL(),
+		Draining:     self.app.Draining(),
+		Routes:       self.router.Routes().Size(),
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// AdminDrainReply is the body of the admin drain reply.
+type AdminDrainReply struct {
+	Hostname string `json:"hostname"`
+	Clients  int    `json:"clients"`
+	Draining bool   `json:"draining"`
+}
+
+// AdminDrainHandler asks the node to drain and exit, as on SIGTERM. The
+// reply is sent before draining begins.
+func (self *Handler) AdminDrainHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if self.app.RequestDrain() && self.logger.ShouldLog(NOTICE) {
+		self.logger.Notice("handler", "Drain requested",
+			LogFields{"rid": req.Header.Get(HeaderID)})
+	}
+	reply := &AdminDrainReply{
+		Hostname: self.app.Hostname(),
+		Clients:  self.app.ClientCount(),
+		Draining: true,
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(resp).Encode(reply)
+}
+
+func (self *Handler) writeAdminError(resp http.ResponseWriter, req *http.Request,
+	uaid, message string, err error) {
+
+	if self.logger.ShouldLog(ERROR) {
+		self.logger.Error("handler", message,
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+				"error": err.Error()})
+	}
+	http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+}
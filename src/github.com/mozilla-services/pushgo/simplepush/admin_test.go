@@ -0,0 +1,201 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+func Test_AdminAuth(t *testing.T) {
+	_, app := newTestHandler(t)
+	auth := NewAdminAuth()
+	conf := auth.ConfigStruct().(*AdminConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	if err := auth.Init(app, conf); err != ConfigurationErr {
+		t.Errorf("Admin listener started without authentication: %v", err)
+	}
+	conf.Tokens = []string{"ops:s3cret"}
+	if err := auth.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing admin auth: %s", err)
+	}
+
+	handler := auth.Handler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	}))
+	for token, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer s3cret": http.StatusOK,
+	} {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/status", nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", token)
+		}
+		handler.ServeHTTP(resp, req)
+		if resp.Code != status {
+			t.Errorf("Wrong status for %q: got %d; want %d", token, resp.Code, status)
+		}
+	}
+	mx := app.Metrics().(*TestMetrics)
+	if n := mx.Counters["admin.auth.failed"]; n != 2 {
+		t.Errorf("Wrong auth failure count: got %d; want 2", n)
+	}
+}
+
+func Test_AdminRebalance(t *testing.T) {
+	handler, app := newTestHandler(t)
+	app.SetHandlers(handler)
+	app.Server().Admin().SetTokens([]string{"ops:s3cret"})
+	admin := app.adminHandler()
+	server := httptest.NewServer(DefaultTransport.Handler(
+		handler.PushSocketHandler, nil))
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	helloTestWorker(t, socket)
+
+	hosts := "wss://a.example.com/, wss://b.example.com/"
+	tests := []struct {
+		method string
+		token  string
+		form   url.Values
+		status int
+	}{
+		{"POST", "", url.Values{"percent": {"100"}}, http.StatusUnauthorized},
+		{"POST", "wrong", url.Values{"percent": {"100"}}, http.StatusUnauthorized},
+		{"GET", "s3cret", url.Values{"percent": {"100"}}, http.StatusMethodNotAllowed},
+		{"POST", "s3cret", url.Values{"percent": {"0"}}, http.StatusBadRequest},
+		{"POST", "s3cret", url.Values{"percent": {"101"}}, http.StatusBadRequest},
+		{"POST", "s3cret", url.Values{"percent": {"1"}, "hosts": {"not a URL"}},
+			http.StatusBadRequest},
+		{"POST", "s3cret", url.Values{"percent": {"1"}, "retry_after": {"-1s"}},
+			http.StatusBadRequest},
+		// Rounds up, so that small nodes still shed clients.
+		{"POST", "s3cret", url.Values{"percent": {"1"}, "hosts": {hosts}},
+			http.StatusOK},
+	}
+	for i, test := range tests {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, "/admin/rebalance",
+			strings.NewReader(test.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(test.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		admin.ServeHTTP(resp, req)
+		if resp.Code != test.status {
+			t.Errorf("On test %d, wrong status: got %d; want %d", i, resp.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			if n := app.ClientCount(); n != 1 {
+				t.Fatalf("On test %d, rejected rebalance disconnected clients: %d remaining", i, n)
+			}
+			continue
+		}
+		reply := new(RebalanceReply)
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			t.Fatalf("On test %d, error decoding rebalance reply: %s", i, err)
+		}
+		if reply.Clients != 1 || reply.Rebalanced != 1 {
+			t.Errorf("On test %d, wrong rebalance reply: %#v", i, reply)
+		}
+	}
+	bye := new(ByeMessage)
+	if err := websocket.JSON.Receive(socket, bye); err != nil {
+		t.Fatalf("Error reading bye message: %s", err)
+	}
+	if bye.Code != int(CloseRedirect) || len(bye.Hosts) != 2 ||
+		bye.Hosts[0] != "wss://a.example.com/" || bye.RetryAfter != 0 {
+		t.Errorf("Unexpected bye message: %#v", bye)
+	}
+	waitFor(t, "disconnected client", func() bool { return app.ClientCount() == 0 })
+}
+
+func Test_AdminClientHandler(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	handler, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	handler.store = store
+	tmux := mux.NewRouter()
+	tmux.HandleFunc("/admin/clients/{uaid}", handler.AdminClientHandler)
+	tmux.HandleFunc("/admin/clients/{uaid}/disconnect", handler.AdminDisconnectHandler)
+
+	// Unknown devices are not found.
+	addExistsHook(uaid, false)
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/clients/"+uaid, nil)
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Wrong status for unknown device: got %d", resp.Code)
+	}
+	removeExistsHook(uaid)
+
+	addExistsHook(uaid, true)
+	defer removeExistsHook(uaid)
+	store.PutPing(uaid, []byte(`{"type":"fcm"}`))
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/clients/"+uaid, nil)
+	tmux.ServeHTTP(resp, req)
+	reply := new(AdminClientReply)
+	if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+		t.Fatalf("Error decoding lookup reply: %s", err)
+	}
+	if reply.UAID != uaid || reply.Connected || !reply.Pinger {
+		t.Errorf("Wrong lookup reply: %#v", reply)
+	}
+
+	// Purging removes ping data.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/admin/clients/"+uaid, nil)
+	tmux.ServeHTTP(resp, req)
+	purge := new(AdminPurgeReply)
+	if err := json.Unmarshal(resp.Body.Bytes(), purge); err != nil {
+		t.Fatalf("Error decoding purge reply: %s", err)
+	}
+	if !purge.Purged || purge.Disconnected {
+		t.Errorf("Wrong purge reply: %#v", purge)
+	}
+	if data, _ := store.FetchPing(uaid); data != nil {
+		t.Errorf("Ping data not purged: %s", data)
+	}
+
+	// Disconnecting a device that is not connected anywhere fails.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/clients/"+uaid+"/disconnect", nil)
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Wrong status for disconnected device: got %d", resp.Code)
+	}
+}
+
+func Test_AdminStatusHandler(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/status", nil)
+	handler.AdminStatusHandler(resp, req)
+	reply := new(AdminStatusReply)
+	if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+		t.Fatalf("Error decoding status reply: %s", err)
+	}
+	if reply.Hostname != "test" || len(reply.RouterURL) == 0 || reply.Draining {
+		t.Errorf("Wrong status reply: %#v", reply)
+	}
+}
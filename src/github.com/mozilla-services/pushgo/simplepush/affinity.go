@@ -0,0 +1,217 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AffinityOff disables client affinity. Devices connect to any node.
+	AffinityOff = "off"
+
+	// AffinityRedirect redirects devices that connect to a node other than
+	// their owner.
+	AffinityRedirect = "redirect"
+
+	// AffinityHandoff accepts devices on any node, and asks the owner to
+	// release the device's state.
+	AffinityHandoff = "handoff"
+)
+
+type AffinityConfig struct {
+	// Mode is one of "off", "redirect", or "handoff". Defaults to "off".
+	Mode string `env:"mode"`
+
+	// Replicas is the number of points on the hash ring for each node.
+	Replicas int `env:"replicas"`
+
+	// RefreshInterval is the amount of time to wait between updates of the
+	// hash ring from the locator's contacts.
+	RefreshInterval string `toml:"refresh_interval" env:"refresh_interval"`
+}
+
+// HandoffReply is returned by the owning node's handoff endpoint. Updates
+// holds the updates that the device did not acknowledge on the released
+// connection, if the caller asked to take them.
+type HandoffReply struct {
+	UAID     string   `json:"uaid"`
+	Released bool     `json:"released"`
+	Updates  []Update `json:"updates,omitempty"`
+}
+
+// Affinity assigns device IDs to nodes with a consistent hash ring of the
+// routing URLs returned by the locator. Routers try the owning node before
+// broadcasting, which bounds fan-out in large clusters. Devices that connect
+// to a node other than their owner are either redirected to the owner, or
+// accepted, in which case the owner is asked to release the device.
+type Affinity struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	router   *Router
+	mode     string
+	ring     *HashRing
+	interval time.Duration
+	client   *http.Client
+}
+
+func NewAffinity() *Affinity {
+	return new(Affinity)
+}
+
+func (*Affinity) ConfigStruct() interface{} {
+	return &AffinityConfig{
+		Mode:            AffinityOff,
+		Replicas:        100,
+		RefreshInterval: "10s",
+	}
+}
+
+// Init initializes the hash ring for the given router.
+func (a *Affinity) Init(app *Application, config interface{}, router *Router) (err error) {
+	conf := config.(*AffinityConfig)
+	a.logger = app.Logger()
+	a.metrics = app.Metrics()
+	a.router = router
+	a.ring = NewHashRing(conf.Replicas)
+
+	switch a.mode = strings.ToLower(conf.Mode); a.mode {
+	case "", AffinityOff:
+		a.mode = AffinityOff
+		return nil
+	case AffinityRedirect, AffinityHandoff:
+	default:
+		err = fmt.Errorf("Unknown affinity mode: %q", conf.Mode)
+		a.logger.Panic("router", "Could not configure affinity",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	if a.interval, err = time.ParseDuration(conf.RefreshInterval); err != nil {
+		a.logger.Panic("router", "Could not parse affinity refresh interval",
+			LogFields{"error": err.Error(), "interval": conf.RefreshInterval})
+		return err
+	}
+	a.client = router.HTTPClient(router.rwtimeout)
+	a.ring.Set([]string{router.URL()})
+	return nil
+}
+
+// Enabled indicates whether client affinity is enabled.
+func (a *Affinity) Enabled() bool {
+	return a != nil && a.mode != AffinityOff
+}
+
+// Mode returns the affinity mode.
+func (a *Affinity) Mode() string {
+	return a.mode
+}
+
+// Owner returns the routing URL of the node that owns the device, or an
+// empty string if affinity is disabled.
+func (a *Affinity) Owner(uaid string) string {
+	if !a.Enabled() {
+		return ""
+	}
+	return a.ring.Owner(uaid)
+}
+
+// RedirectURL returns the client listener URL of the given owner. Nodes are
+// assumed to share the scheme and port of clientURL, the current node's
+// client listener URL.
+func (a *Affinity) RedirectURL(owner, clientURL string) (string, error) {
+	ownerURI, err := url.Parse(owner)
+	if err != nil {
+		return "", err
+	}
+	clientURI, err := url.Parse(clientURL)
+	if err != nil {
+		return "", err
+	}
+	host := ownerURI.Hostname()
+	if port := clientURI.Port(); len(port) > 0 {
+		host = net.JoinHostPort(host, port)
+	}
+	redirect := &url.URL{Scheme: clientURI.Scheme, Host: host, Path: "/"}
+	return redirect.String(), nil
+}
+
+// Handoff asks the owning node to release a device that connected to the
+// current node, disconnecting any stale connection on the owner. The reply
+// includes the updates that the device did not acknowledge on the stale
+// connection, which the owner no longer delivers.
+func (a *Affinity) Handoff(uaid, owner string) (reply *HandoffReply, err error) {
+	req, err := a.router.NewPeerRequest("POST",
+		owner+"/handoff/"+uaid+"?take=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		a.metrics.Increment("router.affinity.handoff.error")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		a.metrics.Increment("router.affinity.handoff.error")
+		return nil, fmt.Errorf("Unexpected handoff response: %s", resp.Status)
+	}
+	reply = new(HandoffReply)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		a.metrics.Increment("router.affinity.handoff.error")
+		return nil, err
+	}
+	if reply.Released {
+		a.metrics.Increment("router.affinity.handoff.released")
+	}
+	a.metrics.Increment("router.affinity.handoff")
+	return reply, nil
+}
+
+// Refresh rebuilds the hash ring from the locator's contacts and the
+// current node.
+func (a *Affinity) Refresh() {
+	locator := a.router.Locator()
+	if locator == nil {
+		return
+	}
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		if a.logger.ShouldLog(WARNING) {
+			a.logger.Warn("router", "Could not refresh hash ring",
+				LogFields{"error": err.Error()})
+		}
+		a.metrics.Increment("router.affinity.refresh.error")
+		return
+	}
+	nodes := append(contacts, a.router.URL())
+	if a.ring.Set(nodes) {
+		if a.logger.ShouldLog(INFO) {
+			a.logger.Info("router", "Hash ring membership changed",
+				LogFields{"nodes": strings.Join(a.ring.Nodes(), ",")})
+		}
+		a.metrics.Gauge("router.affinity.nodes", int64(len(nodes)))
+	}
+}
+
+func (a *Affinity) refreshLoop(closeSignal <-chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	a.Refresh()
+	ticker := time.NewTicker(a.interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-closeSignal:
+		case <-ticker.C:
+			a.Refresh()
+		}
+	}
+	ticker.Stop()
+}
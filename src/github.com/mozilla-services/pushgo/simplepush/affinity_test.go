@@ -0,0 +1,118 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing(100)
+	if owner := ring.Owner("abc"); owner != "" {
+		t.Errorf("Expected empty ring to have no owner; got %q", owner)
+	}
+	nodes := []string{"http://a:3000", "http://b:3000", "http://c:3000"}
+	if !ring.Set(nodes) {
+		t.Errorf("Expected ring to change")
+	}
+	if ring.Set([]string{nodes[2], nodes[0], nodes[1]}) {
+		t.Errorf("Expected reordered nodes to leave ring unchanged")
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%032x", i)
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 {
+			t.Errorf("Uneven distribution: %s owns %d of 3000 keys", node, counts[node])
+		}
+	}
+
+	// Removing a node only moves the keys it owned.
+	ring.Set(nodes[:2])
+	for key, owner := range owners {
+		if owner != nodes[2] && ring.Owner(key) != owner {
+			t.Errorf("Key %s moved from %s to %s", key, owner, ring.Owner(key))
+		}
+	}
+}
+
+func TestAffinityRedirectURL(t *testing.T) {
+	affinity := NewAffinity()
+	redirect, err := affinity.RedirectURL("http://10.0.0.2:3000", "wss://push.example.com:8080")
+	if err != nil {
+		t.Fatalf("Error building redirect URL: %s", err)
+	}
+	if redirect != "wss://10.0.0.2:8080/" {
+		t.Errorf("Wrong redirect URL: %s", redirect)
+	}
+	var reply string
+	writeJSON(redirectReply("hello", "abc", redirect), func(data []byte) error {
+		reply = string(data)
+		return nil
+	})
+	expected := `{"messageType":"hello","status":302,"uaid":"abc","redirect":"wss://10.0.0.2:8080/"}`
+	if reply != expected {
+		t.Errorf("Wrong redirect reply: got %s; want %s", reply, expected)
+	}
+}
+
+func Test_RouterAffinity(t *testing.T) {
+	chid := "decafbad000000000000000000000000"
+
+	var requests [2]int32
+	peers := make([]*httptest.Server, 2)
+	contacts := make([]string, 2)
+	for i := range peers {
+		i := i
+		peers[i] = httptest.NewServer(http.HandlerFunc(
+			func(resp http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests[i], 1)
+				resp.Write([]byte("{}"))
+			}))
+		defer peers[i].Close()
+		contacts[i] = peers[i].URL
+	}
+
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.Affinity.Mode = AffinityHandoff
+	if err := router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&StaticLocator{contacts: contacts})
+	router.Affinity().Refresh()
+
+	// Find a device owned by the second peer.
+	var uaid string
+	for i := 0; ; i++ {
+		uaid = fmt.Sprintf("%032x", i)
+		if router.Affinity().Owner(uaid) == contacts[1] {
+			break
+		}
+	}
+	err := router.Route(nil, uaid, chid, 1, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests[1]); n != 1 {
+		t.Errorf("Wrong number of requests to owner: got %d; want 1", n)
+	}
+	if n := atomic.LoadInt32(&requests[0]); n != 0 {
+		t.Errorf("Expected other peers to be skipped; got %d requests", n)
+	}
+}
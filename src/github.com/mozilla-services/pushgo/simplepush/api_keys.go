@@ -0,0 +1,307 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingAPIKey  = errors.New("Missing API key")
+	ErrInvalidAPIKey  = errors.New("Invalid API key")
+	ErrAPIKeyQuota    = errors.New("API key quota exceeded")
+	ErrInvalidKeySpec = errors.New(`API keys must be of the form "name:key[:rate[:burst]]"`)
+)
+
+// apiKeyCacheSize is the maximum number of store lookups cached. The least
+// recently used lookups are evicted first.
+const apiKeyCacheSize = 10000
+
+// APIKey describes an app server allowed to send updates.
+type APIKey struct {
+	// Name identifies the app server in logs and metrics.
+	Name string `json:"name"`
+
+	// Rate and Burst are the app server's update quota. A rate of 0 means
+	// unlimited.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// APIKeyStore is implemented by storage adapters that can store API keys,
+// so that keys can be issued without changing the config of each node.
+// Keys are looked up by HashAPIKey.
+type APIKeyStore interface {
+	// FetchAPIKey returns the key with the given hash, or nil if there is
+	// no such key.
+	FetchAPIKey(hash string) (*APIKey, error)
+
+	// PutAPIKey stores a key under the given hash.
+	PutAPIKey(hash string, key *APIKey) error
+}
+
+// HashAPIKey returns the hex-encoded SHA-256 hash of an API key. Keys are
+// stored and compared by hash, so that stored keys cannot be used directly.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type APIKeyConfig struct {
+	// Required rejects updates without a valid API key. If not set,
+	// updates without a key are accepted, but invalid keys are rejected.
+	Required bool `env:"required"`
+
+	// Keys lists the accepted keys, each of the form
+	// "name:key[:rate[:burst]]", where rate is the number of updates allowed
+	// per second.
+	Keys []string `env:"keys"`
+
+	// Header is the request header that holds the key. Keys may also be
+	// sent as "Authorization: Bearer <key>". Defaults to "X-API-Key".
+	Header string `env:"header"`
+
+	// CacheTTL is how long keys fetched from storage are cached. Defaults
+	// to 1 minute.
+	CacheTTL string `toml:"cache_ttl" env:"cache_ttl"`
+}
+
+// AppServer is an app server authenticated by API key or client
+// certificate. Authentication does not take from the app server's quota;
+// each update it sends is taken separately, so that batches are charged
+// per update.
+type AppServer struct {
+	*APIKey
+	quota    *tokenBuckets
+	quotaErr error // Returned by AllowUpdate once the quota is exceeded.
+}
+
+// AllowUpdate takes one update from the app server's quota. A nil app
+// server did not authenticate, and has no quota of its own.
+func (s *AppServer) AllowUpdate() error {
+	if s == nil || s.quota.Allow(s.Name, time.Now()) {
+		return nil
+	}
+	return s.quotaErr
+}
+
+type cachedAPIKey struct {
+	hash    string
+	entry   *AppServer // nil if the key does not exist.
+	expires time.Time
+}
+
+// APIKeyAuth authenticates app servers by API key, and enforces per-key
+// update quotas.
+type APIKeyAuth struct {
+	app       *Application
+	logger    *SimpleLogger
+	metrics   Statistician
+	required  bool
+	header    string
+	cacheTTL  time.Duration
+	keysLock  sync.RWMutex
+	keys      map[string]*AppServer // Keyed by hash.
+	cacheLock sync.Mutex
+	cache     map[string]*list.Element // Keyed by hash.
+	cacheLRU  *list.List               // Most recently used first.
+}
+
+func NewAPIKeyAuth() *APIKeyAuth {
+	return &APIKeyAuth{
+		keys:     make(map[string]*AppServer),
+		cache:    make(map[string]*list.Element),
+		cacheLRU: list.New(),
+	}
+}
+
+func (*APIKeyAuth) ConfigStruct() interface{} {
+	return &APIKeyConfig{
+		Header:   "X-API-Key",
+		CacheTTL: "1m",
+	}
+}
+
+func (a *APIKeyAuth) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*APIKeyConfig)
+	a.app = app
+	a.logger = app.Logger()
+	a.metrics = app.Metrics()
+	a.required = conf.Required
+	a.header = conf.Header
+	if a.cacheTTL, err = time.ParseDuration(conf.CacheTTL); err != nil {
+		a.logger.Panic("apikey", "Could not parse API key cache TTL",
+			LogFields{"error": err.Error(), "ttl": conf.CacheTTL})
+		return err
+	}
+	if err = a.SetKeys(conf.Keys); err != nil {
+		a.logger.Panic("apikey", "Could not parse API key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	app.Secrets().OnChange("default.apikeys.keys", a.SetKeys)
+	return nil
+}
+
+// SetKeys replaces the configured keys, each of the form
+// "name:key[:rate[:burst]]". The quotas of unchanged keys are kept.
+func (a *APIKeyAuth) SetKeys(specs []string) error {
+	keys := make(map[string]*AppServer, len(specs))
+	for _, spec := range specs {
+		key, apiKey, err := parseAPIKeySpec(spec)
+		if err != nil {
+			return err
+		}
+		keys[HashAPIKey(key)] = newAPIKeyEntry(apiKey)
+	}
+	a.keysLock.Lock()
+	for hash, entry := range keys {
+		if old, ok := a.keys[hash]; ok && *old.APIKey == *entry.APIKey {
+			keys[hash] = old
+		}
+	}
+	a.keys = keys
+	a.keysLock.Unlock()
+	return nil
+}
+
+// parseAPIKeySpec parses a key of the form "name:key[:rate[:burst]]".
+func parseAPIKeySpec(spec string) (key string, apiKey *APIKey, err error) {
+	fields := strings.Split(strings.TrimSpace(spec), ":")
+	if len(fields) < 2 || len(fields) > 4 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+		return "", nil, ErrInvalidKeySpec
+	}
+	apiKey = &APIKey{Name: fields[0]}
+	if len(fields) > 2 {
+		if apiKey.Rate, err = strconv.ParseFloat(fields[2], 64); err != nil || apiKey.Rate < 0 {
+			return "", nil, ErrInvalidKeySpec
+		}
+	}
+	if len(fields) > 3 {
+		if apiKey.Burst, err = strconv.Atoi(fields[3]); err != nil || apiKey.Burst < 0 {
+			return "", nil, ErrInvalidKeySpec
+		}
+	}
+	return fields[1], apiKey, nil
+}
+
+func newAPIKeyEntry(apiKey *APIKey) *AppServer {
+	return &AppServer{apiKey, newTokenBuckets(
+		RateBudget{Rate: apiKey.Rate, Burst: apiKey.Burst}, 2), ErrAPIKeyQuota}
+}
+
+// requestAPIKey returns the API key sent with a request, if any.
+func (a *APIKeyAuth) requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get(a.header); len(key) > 0 {
+		return key
+	}
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// lookup returns the entry for a key hash from the config or storage.
+func (a *APIKeyAuth) lookup(hash string) (*AppServer, error) {
+	a.keysLock.RLock()
+	entry, ok := a.keys[hash]
+	a.keysLock.RUnlock()
+	if ok {
+		return entry, nil
+	}
+	store, ok := a.app.Store().(APIKeyStore)
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	cached, ok := a.cached(hash)
+	if ok && now.Before(cached.expires) {
+		return cached.entry, nil
+	}
+	apiKey, err := store.FetchAPIKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	entry = nil
+	if apiKey != nil {
+		if ok && cached.entry != nil && *cached.entry.APIKey == *apiKey {
+			// Keep the quota of an unchanged key.
+			entry = cached.entry
+		} else {
+			entry = newAPIKeyEntry(apiKey)
+		}
+	}
+	a.cacheKey(&cachedAPIKey{hash, entry, now.Add(a.cacheTTL)})
+	return entry, nil
+}
+
+// cached returns a cached store lookup, marking it as recently used.
+func (a *APIKeyAuth) cached(hash string) (cached *cachedAPIKey, ok bool) {
+	a.cacheLock.Lock()
+	defer a.cacheLock.Unlock()
+	elem, ok := a.cache[hash]
+	if !ok {
+		return nil, false
+	}
+	a.cacheLRU.MoveToFront(elem)
+	return elem.Value.(*cachedAPIKey), true
+}
+
+// cacheKey caches a store lookup, evicting the least recently used lookup
+// if the cache is full.
+func (a *APIKeyAuth) cacheKey(cached *cachedAPIKey) {
+	a.cacheLock.Lock()
+	defer a.cacheLock.Unlock()
+	if elem, ok := a.cache[cached.hash]; ok {
+		elem.Value = cached
+		a.cacheLRU.MoveToFront(elem)
+		return
+	}
+	if a.cacheLRU.Len() >= apiKeyCacheSize {
+		oldest := a.cacheLRU.Back()
+		a.cacheLRU.Remove(oldest)
+		delete(a.cache, oldest.Value.(*cachedAPIKey).hash)
+	}
+	a.cache[cached.hash] = a.cacheLRU.PushFront(cached)
+}
+
+// Authenticate checks the API key sent with an update request. It returns
+// the app server, which is nil if keys are not required and none was sent.
+// Updates are taken from the app server's quota by AppServer.AllowUpdate.
+func (a *APIKeyAuth) Authenticate(req *http.Request) (appServer *AppServer, err error) {
+	if a == nil {
+		return nil, nil
+	}
+	key := a.requestAPIKey(req)
+	if len(key) == 0 {
+		if a.required {
+			a.metrics.Increment("apikey.missing")
+			return nil, ErrMissingAPIKey
+		}
+		return nil, nil
+	}
+	entry, err := a.lookup(HashAPIKey(key))
+	if err != nil {
+		if a.logger.ShouldLog(ERROR) {
+			a.logger.Error("apikey", "Could not fetch API key",
+				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+		}
+		return nil, err
+	}
+	if entry == nil {
+		a.metrics.Increment("apikey.invalid")
+		return nil, ErrInvalidAPIKey
+	}
+	return entry, nil
+}
@@ -0,0 +1,134 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// apiKeyTestStore is a storage adapter with a fixed set of API keys.
+type apiKeyTestStore struct {
+	*NoStore
+	keys    map[string]*APIKey
+	fetches int
+}
+
+func (s *apiKeyTestStore) FetchAPIKey(hash string) (*APIKey, error) {
+	s.fetches++
+	return s.keys[hash], nil
+}
+
+func (s *apiKeyTestStore) PutAPIKey(hash string, key *APIKey) error {
+	s.keys[hash] = key
+	return nil
+}
+
+// authorizeTestUpdate authenticates an update request and takes one update
+// from the app server's quota, as UpdateHandler does.
+func authorizeTestUpdate(handler *Handler, req *http.Request) (
+	resp *httptest.ResponseRecorder, appServer *AppServer) {
+
+	resp = httptest.NewRecorder()
+	appServer, ok := handler.checkAppServer(resp, req, 0)
+	if !ok {
+		return resp, appServer
+	}
+	if !handler.allowAppServer(appServer) {
+		handler.writeTooManyRequests(resp)
+		return resp, appServer
+	}
+	resp.WriteHeader(http.StatusOK)
+	return resp, appServer
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	handler, app := newTestHandler(t)
+	store := &apiKeyTestStore{NoStore: app.Store().(*NoStore),
+		keys: make(map[string]*APIKey)}
+	store.PutAPIKey(HashAPIKey("stored"), &APIKey{Name: "stored"})
+	app.store = store
+
+	auth := NewAPIKeyAuth()
+	conf := auth.ConfigStruct().(*APIKeyConfig)
+	conf.Required = true
+	conf.Keys = []string{"limited:s3cr3t:0.001:2"}
+	if err := auth.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing API keys: %s", err)
+	}
+	app.Server().apiKeys = auth
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"Missing key", "", "", http.StatusUnauthorized},
+		{"Invalid key", "X-API-Key", "wrong", http.StatusUnauthorized},
+		{"Configured key", "X-API-Key", "s3cr3t", http.StatusOK},
+		{"Bearer token", "Authorization", "Bearer s3cr3t", http.StatusOK},
+		{"Over quota", "X-API-Key", "s3cr3t", http.StatusTooManyRequests},
+		{"Stored key", "Authorization", "bearer stored", http.StatusOK},
+		{"Cached stored key", "X-API-Key", "stored", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://test/update", nil)
+		if len(test.header) > 0 {
+			req.Header.Set(test.header, test.value)
+		}
+		resp, _ := authorizeTestUpdate(handler, req)
+		if resp.Code != test.status {
+			t.Errorf("%s: got status %d; want %d", test.name, resp.Code, test.status)
+		}
+	}
+	// The invalid key and the first stored key lookup hit the store.
+	if store.fetches != 2 {
+		t.Errorf("Wrong number of store lookups: got %d; want 2", store.fetches)
+	}
+	if _, _, err := parseAPIKeySpec("nokey"); err == nil {
+		t.Errorf("Key spec without a key was accepted")
+	}
+}
+
+func TestAPIKeyCacheEviction(t *testing.T) {
+	handler, app := newTestHandler(t)
+	store := &apiKeyTestStore{NoStore: app.Store().(*NoStore),
+		keys: make(map[string]*APIKey)}
+	app.store = store
+	auth := NewAPIKeyAuth()
+	if err := auth.Init(app, auth.ConfigStruct()); err != nil {
+		t.Fatalf("Error initializing API keys: %s", err)
+	}
+	app.Server().apiKeys = auth
+
+	lookup := func(key string) {
+		req, _ := http.NewRequest("POST", "http://test/update", nil)
+		req.Header.Set("X-API-Key", key)
+		authorizeTestUpdate(handler, req)
+	}
+	// Keep the first key in use while filling the cache with invalid keys.
+	lookup("first")
+	for i := 0; i < apiKeyCacheSize; i++ {
+		lookup(strconv.Itoa(i))
+		if i%1000 == 0 {
+			lookup("first")
+		}
+	}
+	fetches := store.fetches
+	lookup("first")
+	if store.fetches != fetches {
+		t.Errorf("Recently used lookup was evicted")
+	}
+	lookup("0")
+	if store.fetches != fetches+1 {
+		t.Errorf("Least recently used lookup was not evicted")
+	}
+	if len(auth.cache) != apiKeyCacheSize {
+		t.Errorf("Wrong cache size: got %d; want %d", len(auth.cache), apiKeyCacheSize)
+	}
+}
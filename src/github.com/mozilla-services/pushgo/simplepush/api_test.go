@@ -1001,3 +1001,159 @@ func TestACK(t *testing.T) {
 		t.Fatalf("Error sending and acknowledge update: %#v", err)
 	}
 }
+
+func TestRegisterMany(t *testing.T) {
+	origin, err := Server.Origin()
+	if err != nil {
+		t.Fatalf("Error initializing test server: %#v", err)
+	}
+	socket, err := ws.Dial(origin, "", origin)
+	if err != nil {
+		t.Fatalf("Error dialing origin: %#v", err)
+	}
+	defer socket.Close()
+	helo := map[string]interface{}{"messageType": "hello", "uaid": "", "channelIDs": []string{}}
+	if err = ws.JSON.Send(socket, helo); err != nil {
+		t.Fatalf("Error writing handshake request: %#v", err)
+	}
+	heloReply := make(map[string]interface{})
+	if err = ws.JSON.Receive(socket, &heloReply); err != nil {
+		t.Fatalf("Error reading handshake reply: %#v", err)
+	}
+	channelIds := make([]string, 3)
+	for index := range channelIds {
+		if channelIds[index], err = id.Generate(); err != nil {
+			t.Fatalf("Error generating channel ID: %#v", err)
+		}
+	}
+	for _, messageType := range []string{"registerMany", "unregisterMany"} {
+		request := RegisterManyRequest{channelIds}
+		if err = ws.JSON.Send(socket, struct {
+			Type string `json:"messageType"`
+			RegisterManyRequest
+		}{messageType, request}); err != nil {
+			t.Fatalf("Error writing %s request: %#v", messageType, err)
+		}
+		reply := new(RegisterManyReply)
+		if err = ws.JSON.Receive(socket, reply); err != nil {
+			t.Fatalf("Error reading %s reply: %#v", messageType, err)
+		}
+		if reply.Status != 200 {
+			t.Errorf("Unexpected %s status: got %d; want 200", messageType, reply.Status)
+		}
+		if len(reply.Channels) != len(channelIds) {
+			t.Fatalf("Wrong number of %s results: got %d; want %d",
+				messageType, len(reply.Channels), len(channelIds))
+		}
+		for index, result := range reply.Channels {
+			if result.ChannelID != channelIds[index] || result.Status != 200 {
+				t.Errorf("Unexpected %s result %d: %#v", messageType, index, result)
+			}
+			if messageType == "registerMany" && !isValidEndpoint(result.Endpoint) {
+				t.Errorf("Invalid push endpoint for channel %#v: %#v",
+					result.ChannelID, result.Endpoint)
+			}
+		}
+	}
+	// A single invalid channel ID rejects the entire batch.
+	invalid := map[string]interface{}{
+		"messageType": "registerMany",
+		"channelIDs":  []string{channelIds[0], "invalid_channel"},
+	}
+	if err = ws.JSON.Send(socket, invalid); err != nil {
+		t.Fatalf("Error writing invalid registerMany request: %#v", err)
+	}
+	errReply := make(map[string]interface{})
+	if err = ws.JSON.Receive(socket, &errReply); err != nil {
+		t.Fatalf("Error reading invalid registerMany reply: %#v", err)
+	}
+	if status, _ := errReply["status"].(float64); status != 401 {
+		t.Errorf("Unexpected status for invalid registerMany: got %#v; want 401", errReply["status"])
+	}
+}
+
+func TestHelloResume(t *testing.T) {
+	origin, err := Server.Origin()
+	if err != nil {
+		t.Fatalf("Error initializing test server: %#v", err)
+	}
+	tests := []struct {
+		name       string
+		resume     int64
+		statusCode float64
+	}{
+		{"valid cursor", time.Now().Unix() - 60, 200},
+		{"future cursor", time.Now().Unix() + 3600, 200},
+		{"negative cursor", -1, 401},
+	}
+	for _, test := range tests {
+		socket, err := ws.Dial(origin, "", origin)
+		if err != nil {
+			t.Fatalf("Error dialing origin: %#v", err)
+		}
+		helo := map[string]interface{}{
+			"messageType": "hello",
+			"uaid":        "",
+			"channelIDs":  []string{},
+			"resume":      test.resume,
+		}
+		if err = ws.JSON.Send(socket, helo); err != nil {
+			t.Fatalf("On test %s, error writing handshake request: %#v", test.name, err)
+		}
+		reply := make(map[string]interface{})
+		if err = ws.JSON.Receive(socket, &reply); err != nil {
+			t.Fatalf("On test %s, error reading handshake reply: %#v", test.name, err)
+		}
+		if status, _ := reply["status"].(float64); status != test.statusCode {
+			t.Errorf("On test %s, unexpected status: got %#v; want %#v",
+				test.name, reply["status"], test.statusCode)
+		}
+		socket.Close()
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	origin, err := Server.Origin()
+	if err != nil {
+		t.Fatalf("Error initializing test server: %#v", err)
+	}
+	socket, err := ws.Dial(origin, "", origin)
+	if err != nil {
+		t.Fatalf("Error dialing origin: %#v", err)
+	}
+	defer socket.Close()
+	helo := map[string]interface{}{
+		"messageType": "hello",
+		"uaid":        "",
+		"channelIDs":  []string{},
+	}
+	if err = ws.JSON.Send(socket, helo); err != nil {
+		t.Fatalf("Error writing handshake request: %#v", err)
+	}
+	heloReply := make(map[string]interface{})
+	if err = ws.JSON.Receive(socket, &heloReply); err != nil {
+		t.Fatalf("Error reading handshake reply: %#v", err)
+	}
+	if err = ws.JSON.Send(socket, map[string]string{"messageType": "whoami"}); err != nil {
+		t.Fatalf("Error writing whoami request: %#v", err)
+	}
+	reply := new(WhoamiReply)
+	if err = ws.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error reading whoami reply: %#v", err)
+	}
+	if reply.Status != 200 {
+		t.Errorf("Unexpected whoami status: got %d; want 200", reply.Status)
+	}
+	if reply.DeviceID != heloReply["uaid"] {
+		t.Errorf("Mismatched device ID: got %q; want %#v", reply.DeviceID, heloReply["uaid"])
+	}
+	if len(reply.NodeID) == 0 {
+		t.Errorf("Missing node ID")
+	}
+	if since := time.Now().Unix() - reply.ConnectedAt; since < 0 || since > 60 {
+		t.Errorf("Unexpected connection time: %d", reply.ConnectedAt)
+	}
+	if reply.PingInterval != 20 {
+		t.Errorf("Wrong ping interval: got %d; want 20", reply.PingInterval)
+	}
+}
@@ -0,0 +1,485 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+func init() {
+	AvailablePings["apns"] = func() HasConfigStruct { return NewAPNsPing() }
+}
+
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+
+	// apnsTokenLifetime is how long a provider token is reused. APNs rejects
+	// tokens older than an hour, and throttles tokens refreshed more often
+	// than every 20 minutes.
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNs error reasons that indicate the device token is no longer valid.
+var apnsInvalidTokenReasons = map[string]bool{
+	"BadDeviceToken":         true,
+	"DeviceTokenNotForTopic": true,
+	"Unregistered":           true,
+}
+
+var ErrInvalidAPNsKey = errors.New("APNs signing key must be a PEM-encoded P-256 private key")
+
+type APNsPingConfig struct {
+	// TeamID and KeyID identify the provider token signing key.
+	TeamID string `toml:"team_id" env:"team_id"`
+	KeyID  string `toml:"key_id" env:"key_id"`
+
+	// KeyFile names the .p8 file containing the signing key. Key may hold
+	// the PEM-encoded key instead.
+	KeyFile string `toml:"key_file" env:"key_file"`
+	Key     string `env:"key"`
+
+	// Topic is the bundle ID of the app.
+	Topic string `env:"topic"`
+
+	// Sandbox sends wakes through the development environment.
+	Sandbox bool `env:"sandbox"`
+
+	// URL overrides the APNs endpoint.
+	URL string `env:"url"`
+
+	// TTL is how long APNs holds wakes for offline devices. Defaults to 72
+	// hours.
+	TTL string `env:"ttl"`
+
+	// CollapseID coalesces pending wakes, so that devices only receive the
+	// most recent one. Defaults to "simplepush".
+	CollapseID string `toml:"collapse_id" env:"collapse_id"`
+
+	// PoolSize is the number of HTTP/2 connections to APNs. Each connection
+	// multiplexes concurrent wakes. Defaults to 2.
+	PoolSize int `toml:"pool_size" env:"pool_size"`
+
+	// Timeout is the maximum time to wait for an APNs response. Defaults to
+	// 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Retry configures retries for throttled and unavailable responses.
+	Retry retry.Config
+
+	// Simulate logs and counts wakes instead of sending them to APNs, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// APNsPingData is the "connect" data sent by iOS devices in the handshake.
+type APNsPingData struct {
+	Token string `json:"token"`
+}
+
+// apnsPayload is the body of a silent background push.
+type apnsPayload struct {
+	APS struct {
+		ContentAvailable int `json:"content-available"`
+	} `json:"aps"`
+	Version string `json:"version"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// apnsError is the body of an APNs error response.
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+// APNsPing wakes disconnected iOS devices with silent background pushes,
+// using token-based authentication over a pool of HTTP/2 connections.
+type APNsPing struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	store       Store
+	url         string
+	topic       string
+	collapseID  string
+	ttl         time.Duration
+	teamID      string
+	keyID       string
+	key         *ecdsa.PrivateKey
+	clients     []*http.Client
+	next        uint32
+	feedback    *PingFeedback
+	guard       *BridgeGuard
+	simulate    bool
+	rh          *retry.Helper
+	tokenLock   sync.Mutex
+	token       string
+	tokenIssued time.Time
+	closeLock   sync.Mutex
+	closeSignal chan bool
+	isClosed    bool
+}
+
+func NewAPNsPing() *APNsPing {
+	return &APNsPing{closeSignal: make(chan bool)}
+}
+
+func (*APNsPing) ConfigStruct() interface{} {
+	return &APNsPingConfig{
+		TTL:        "72h",
+		CollapseID: "simplepush",
+		PoolSize:   2,
+		Timeout:    "10s",
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+		Guard: DefaultBridgeGuard(),
+	}
+}
+
+func (r *APNsPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*APNsPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("apns", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "apns", r.guard)
+	r.simulate = conf.Simulate
+
+	if len(conf.TeamID) == 0 || len(conf.KeyID) == 0 || len(conf.Topic) == 0 {
+		r.logger.Panic("propping", "APNs requires a team ID, key ID, and topic", nil)
+		return ConfigurationErr
+	}
+	r.teamID, r.keyID, r.topic = conf.TeamID, conf.KeyID, conf.Topic
+	r.collapseID = conf.CollapseID
+
+	keyPEM := []byte(conf.Key)
+	if len(conf.KeyFile) > 0 {
+		if keyPEM, err = ioutil.ReadFile(conf.KeyFile); err != nil {
+			r.logger.Panic("propping", "Could not read APNs signing key",
+				LogFields{"error": err.Error(), "file": conf.KeyFile})
+			return err
+		}
+	}
+	if r.key, err = parseAPNsKey(keyPEM); err != nil {
+		r.logger.Panic("propping", "Could not parse APNs signing key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	switch {
+	case len(conf.URL) > 0:
+		r.url = conf.URL
+	case conf.Sandbox:
+		r.url = apnsSandboxURL
+	default:
+		r.url = apnsProductionURL
+	}
+	if r.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		r.logger.Panic("propping", "Could not parse TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse APNs timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	poolSize := conf.PoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	// Each client has its own transport, and so its own connection. APNs
+	// only speaks HTTP/2; prior knowledge is used for plaintext URL overrides.
+	plaintext := strings.HasPrefix(r.url, "http:")
+	r.clients = make([]*http.Client, poolSize)
+	for i := range r.clients {
+		transport := new(http2.Transport)
+		if plaintext {
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		r.clients[i] = &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		}
+	}
+
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+	return nil
+}
+
+// parseAPNsKey parses a PKCS #8 P-256 private key, as downloaded from the
+// Apple developer portal.
+func parseAPNsKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, ErrInvalidAPNsKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve.Params().BitSize != 256 {
+		return nil, ErrInvalidAPNsKey
+	}
+	return ecKey, nil
+}
+
+// providerToken returns the current provider token, signing a new one if
+// the current token is too old or was rejected.
+func (r *APNsPing) providerToken(refresh bool) (string, error) {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if !refresh && len(r.token) > 0 && time.Since(r.tokenIssued) < apnsTokenLifetime {
+		return r.token, nil
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": r.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": r.teamID, "iat": now.Unix()})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, r.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	sigR.FillBytes(sig[:32])
+	sigS.FillBytes(sig[32:])
+	r.token = signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	r.tokenIssued = now
+	r.metrics.Increment("ping.apns.token.refresh")
+	return r.token, nil
+}
+
+// client returns the next connection in the pool.
+func (r *APNsPing) client() *http.Client {
+	n := atomic.AddUint32(&r.next, 1)
+	return r.clients[int(n)%len(r.clients)]
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and APNs is only used to wake disconnected devices.
+func (r *APNsPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *APNsPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's APNs device token.
+func (r *APNsPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(APNsPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || len(ping.Token) == 0 {
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store APNs device token",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// Send wakes a device with a silent background push. It returns false
+// without an error if the device did not register a token, or if APNs
+// reports that the token is no longer valid; invalid tokens are removed
+// from storage.
+func (r *APNsPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch APNs device token",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(APNsPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || len(ping.Token) == 0 {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid APNs registration data",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	payload := new(apnsPayload)
+	payload.APS.ContentAvailable = 1
+	payload.Version = strconv.FormatInt(vers, 10)
+	payload.Msg = data
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	var reason string
+	sendOnce := func() (err error) {
+		reason, err = r.send(ping.Token, body)
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.apns.retry", int64(retries))
+	if apnsInvalidTokenReasons[reason] {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Removing invalid APNs device token",
+				LogFields{"uaid": uaid, "reason": reason})
+		}
+		r.metrics.Increment("ping.apns.unregistered")
+		r.feedback.Invalid(uaid)
+		return false, nil
+	}
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send APNs push",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.apns.error")
+		r.feedback.Failed(uaid, err)
+		return false, err
+	}
+	r.metrics.Increment("ping.apns.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// send posts a push for a device token, returning the APNs error reason, if
+// any. Throttled, unavailable, and expired provider token responses are
+// temporary errors.
+func (r *APNsPing) send(deviceToken string, body []byte) (reason string, err error) {
+	token, err := r.providerToken(false)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", r.url+"/3/device/"+deviceToken,
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", r.topic)
+	req.Header.Set("apns-push-type", "background")
+	req.Header.Set("apns-priority", "5")
+	req.Header.Set("apns-expiration",
+		strconv.FormatInt(time.Now().Add(r.ttl).Unix(), 10))
+	if len(r.collapseID) > 0 {
+		req.Header.Set("apns-collapse-id", r.collapseID)
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", nil
+	}
+	reply := new(apnsError)
+	json.NewDecoder(resp.Body).Decode(reply)
+	switch {
+	case reply.Reason == "ExpiredProviderToken":
+		r.providerToken(true)
+		return reply.Reason, &PingerError{"APNs error: " + reply.Reason, true}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if !r.retryAfter(resp.Header.Get("Retry-After")) {
+			return reply.Reason, PingerClosedErr
+		}
+		return reply.Reason, &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode), true}
+	}
+	return reply.Reason, &PingerError{fmt.Sprintf(
+		"APNs error: %d %s", resp.StatusCode, reply.Reason), false}
+}
+
+func (r *APNsPing) retryAfter(header string) (ok bool) {
+	d, ok := ParseRetryAfter(header)
+	if !ok {
+		return true
+	}
+	select {
+	case <-r.closeSignal:
+		return false
+	case <-time.After(d):
+	}
+	return true
+}
+
+func (r *APNsPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *APNsPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *APNsPing) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	for _, client := range r.clients {
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTestAPNsPing(t *testing.T, url string) (*APNsPing, *testPingStore) {
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating APNs key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding APNs key: %s", err)
+	}
+	pinger := NewAPNsPing()
+	conf := pinger.ConfigStruct().(*APNsPingConfig)
+	conf.URL = url
+	conf.TeamID = "team"
+	conf.KeyID = "key"
+	conf.Topic = "org.mozilla.test"
+	conf.Key = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	conf.Retry.Delay = "1ms"
+	conf.Retry.MaxDelay = "1ms"
+	conf.Retry.MaxJitter = "0"
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing APNs pinger: %s", err)
+	}
+	return pinger, store
+}
+
+func Test_APNsPingSend(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests int
+		tokens   []string
+		payloads []apnsPayload
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if req.ProtoMajor != 2 {
+			t.Errorf("Wrong protocol version: %s", req.Proto)
+		}
+		if req.Header.Get("apns-topic") != "org.mozilla.test" ||
+			req.Header.Get("apns-push-type") != "background" {
+			t.Errorf("Wrong APNs headers: %v", req.Header)
+		}
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "bearer ") || strings.Count(auth, ".") != 2 {
+			t.Errorf("Wrong provider token: %q", auth)
+		}
+		tokens = append(tokens, auth)
+		payload := apnsPayload{}
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("Error decoding APNs payload: %s", err)
+		}
+		payloads = append(payloads, payload)
+		reply := apnsError{}
+		switch strings.TrimPrefix(req.URL.Path, "/3/device/") {
+		case "expired":
+			if len(tokens) == 1 {
+				resp.WriteHeader(http.StatusForbidden)
+				reply.Reason = "ExpiredProviderToken"
+			}
+		case "gone":
+			resp.WriteHeader(http.StatusGone)
+			reply.Reason = "Unregistered"
+		}
+		if len(reply.Reason) > 0 {
+			json.NewEncoder(resp).Encode(&reply)
+		}
+	}))
+	srv.Config.Handler = h2c.NewHandler(srv.Config.Handler, new(http2.Server))
+	srv.Start()
+	defer srv.Close()
+
+	pinger, store := newTestAPNsPing(t, srv.URL)
+	defer pinger.Close()
+	if err := pinger.Register("uaid0", []byte(`{"type":"apns"}`)); err != UnsupportedProtocolErr {
+		t.Errorf("Wrong error for missing token: %v", err)
+	}
+	for uaid, pingData := range map[string]string{
+		"uaid1": `{"token":"expired"}`,
+		"uaid2": `{"token":"gone"}`,
+	} {
+		if err := pinger.Register(uaid, []byte(pingData)); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	// Expired provider tokens are refreshed and the push is retried.
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	lock.Lock()
+	if requests != 2 {
+		t.Errorf("Wrong APNs request count: got %d; want 2", requests)
+	} else if tokens[0] == tokens[1] {
+		t.Errorf("Provider token not refreshed")
+	}
+	if p := payloads[len(payloads)-1]; p.APS.ContentAvailable != 1 ||
+		p.Version != "5" || p.Msg != "hi" {
+		t.Errorf("Wrong APNs payload: %+v", p)
+	}
+	lock.Unlock()
+
+	// Invalid device tokens are removed.
+	if ok, err := pinger.Send("uaid2", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for unregistered token: ok=%v, err=%v", ok, err)
+	}
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Unregistered token not removed: %s", data)
+	}
+	if ok, err := pinger.Send("uaid3", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for device without token: ok=%v, err=%v", ok, err)
+	}
+}
+
+func Test_APNsPingInvalidKey(t *testing.T) {
+	if _, err := parseAPNsKey([]byte("not a key")); err != ErrInvalidAPNsKey {
+		t.Errorf("Wrong error for invalid key: %v", err)
+	}
+}
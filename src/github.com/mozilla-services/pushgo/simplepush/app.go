@@ -5,52 +5,102 @@
 package simplepush
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/net/websocket"
 )
 
 // The Simple Push server version, set by the linker.
 var VERSION string
 
+// drainPollInterval is the amount of time to wait between checks for
+// disconnected clients and pending routing requests while draining.
+const drainPollInterval = 100 * time.Millisecond
+
 var (
 	ErrMissingOrigin = errors.New("Missing WebSocket origin")
 	ErrInvalidOrigin = errors.New("WebSocket origin not allowed")
+
+	ErrMissingSubprotocol = errors.New("Missing WebSocket subprotocol")
+	ErrInvalidSubprotocol = errors.New("WebSocket subprotocol not allowed")
 )
 
 type ApplicationConfig struct {
 	Origins            []string
-	Hostname           string `toml:"current_host" env:"current_host"`
-	TokenKey           string `toml:"token_key" env:"token_key"`
-	UseAwsHost         bool   `toml:"use_aws_host" env:"use_aws"`
-	ResolveHost        bool   `toml:"resolve_host" env:"resolve_host"`
-	ClientMinPing      string `toml:"client_min_ping_interval" env:"min_ping"`
-	ClientHelloTimeout string `toml:"client_hello_timeout" env:"hello_timeout"`
-	PushLongPongs      bool   `toml:"push_long_pongs" env:"long_pongs"`
+	Subprotocols       []string
+	RequireSubprotocol bool     `toml:"require_subprotocol" env:"require_subprotocol"`
+	Hostname           string   `toml:"current_host" env:"current_host"`
+	TokenKey           string   `toml:"token_key" env:"token_key"`
+	TokenKeys          []string `toml:"token_keys" env:"token_keys"`
+	TokenKeyID         int      `toml:"token_key_id" env:"token_key_id"`
+	TokenTTL           string   `toml:"token_ttl" env:"token_ttl"`
+	UseAwsHost         bool     `toml:"use_aws_host" env:"use_aws"`
+	ResolveHost        bool     `toml:"resolve_host" env:"resolve_host"`
+	ClientMinPing      string   `toml:"client_min_ping_interval" env:"min_ping"`
+	ClientHelloTimeout string   `toml:"client_hello_timeout" env:"hello_timeout"`
+	PushLongPongs      bool     `toml:"push_long_pongs" env:"long_pongs"`
+	ServerPing         string   `toml:"server_ping_interval" env:"server_ping"`
+	MaxMissedPongs     int      `toml:"max_missed_pongs" env:"max_missed_pongs"`
+	WatchdogTimeout    string   `toml:"watchdog_timeout" env:"watchdog_timeout"`
+	WriteTimeout       string   `toml:"client_write_timeout" env:"write_timeout"`
+	MaxMessageSize     int64    `toml:"client_max_message_size" env:"max_message_size"`
+	FlushQueueDepth    int      `toml:"client_flush_queue" env:"flush_queue"`
+	ConfigHistory      int      `toml:"config_history" env:"config_history"`
+	DrainTimeout       string   `toml:"drain_timeout" env:"drain_timeout"`
+	DrainRetryAfter    string   `toml:"drain_retry_after" env:"drain_retry_after"`
+
+	// LogLevels sets log levels for individual message types or components,
+	// as "module=level" pairs; e.g., ["worker=debug", "storage=warning"].
+	LogLevels []string `toml:"log_levels" env:"log_levels"`
+
+	// LogSampling limits how often individual messages are logged, as
+	// "message=1%" (keep 1%) or "message=10/s" (keep 10 per second) rules.
+	LogSampling []string `toml:"log_sampling" env:"log_sampling"`
 }
 
 type Application struct {
 	origins            []*url.URL
+	subprotocols       []string
+	requireSubprotocol bool
 	hostname           string
 	host               string
 	port               int
 	clientMinPing      time.Duration
 	clientHelloTimeout time.Duration
 	pushLongPongs      bool
+	serverPing         time.Duration
+	maxMissedPongs     int
+	watchdogTimeout    time.Duration
+	lastStackDump      int64 // Accessed atomically.
+	writeTimeout       time.Duration
+	maxMessageSize     int64
+	flushQueueDepth    int
+	drainTimeout       time.Duration
+	drainRetryAfter    time.Duration
+	draining           int32
+	connCount          int32
 	tokenKey           []byte
+	tokens             *TokenKeyring
+	tokensOnce         sync.Once
 	log                *SimpleLogger
+	logLevels          map[string]LogLevel
+	logSamplers        map[string]*LogSampler
 	metrics            Statistician
+	tracer             *Tracer
 	clients            map[string]*Client
 	clientMux          *sync.RWMutex
 	clientCount        *int32
@@ -59,6 +109,17 @@ type Application struct {
 	router             *Router
 	handlers           *Handler
 	propping           PropPinger
+	events             *EventBus
+	eventsOnce         sync.Once
+	drainRequests      chan bool
+	drainOnce          sync.Once
+	configAudit        *ConfigAudit
+	configAuditOnce    sync.Once
+	secrets            *Secrets
+	secretsOnce        sync.Once
+	ctx                context.Context
+	cancel             context.CancelFunc
+	ctxOnce            sync.Once
 }
 
 func (a *Application) ConfigStruct() interface{} {
@@ -67,8 +128,17 @@ func (a *Application) ConfigStruct() interface{} {
 		Hostname:           defaultHost,
 		UseAwsHost:         false,
 		ResolveHost:        false,
+		TokenTTL:           "0",
 		ClientMinPing:      "20s",
 		ClientHelloTimeout: "30s",
+		ServerPing:         "0",
+		MaxMissedPongs:     3,
+		WatchdogTimeout:    "1m",
+		WriteTimeout:       "30s",
+		MaxMessageSize:     1 << 20,
+		ConfigHistory:      10,
+		DrainTimeout:       "30s",
+		DrainRetryAfter:    "30s",
 	}
 }
 
@@ -76,6 +146,43 @@ func (a *Application) ConfigStruct() interface{} {
 // as well.
 // Note: We implement the Init method to comply with the interface, so the app
 // passed here will be nil.
+// TokenKeyring returns the legacy token key, and a keyring holding the
+// legacy and versioned keys.
+func (conf *ApplicationConfig) TokenKeyring() (legacy []byte,
+	tokens *TokenKeyring, err error) {
+
+	if len(conf.TokenKey) > 0 {
+		if legacy, err = base64.URLEncoding.DecodeString(conf.TokenKey); err != nil {
+			return nil, nil, fmt.Errorf("Malformed token key: %s", err)
+		}
+	}
+
+	tokens = NewTokenKeyring(legacy)
+	keys, current, err := ParseTokenKeys(conf.TokenKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(conf.TokenKeys) > 0 && current < 0 {
+		// A key marked current in the list overrides token_key_id.
+		if conf.TokenKeyID < 0 || conf.TokenKeyID > 255 {
+			return nil, nil, fmt.Errorf("Invalid 'token_key_id': %d", conf.TokenKeyID)
+		}
+		current = conf.TokenKeyID
+	}
+	if err = tokens.Sync(keys, current); err == ErrUnknownTokenID {
+		return nil, nil, fmt.Errorf("Unable to select token key %d: %s",
+			current, err)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	tokenTTL, err := time.ParseDuration(conf.TokenTTL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse 'token_ttl': %s", err)
+	}
+	tokens.SetTTL(tokenTTL)
+	return legacy, tokens, nil
+}
+
 func (a *Application) Init(_ *Application, config interface{}) (err error) {
 	conf := config.(*ApplicationConfig)
 
@@ -87,6 +194,8 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 			}
 		}
 	}
+	a.subprotocols = conf.Subprotocols
+	a.requireSubprotocol = conf.RequireSubprotocol
 
 	if conf.UseAwsHost {
 		if a.hostname, err = GetAWSPublicHostname(); err != nil {
@@ -102,11 +211,10 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 		a.hostname = conf.Hostname
 	}
 
-	if len(conf.TokenKey) > 0 {
-		if a.tokenKey, err = base64.URLEncoding.DecodeString(conf.TokenKey); err != nil {
-			return fmt.Errorf("Malformed token key: %s", err)
-		}
+	if a.tokenKey, a.tokens, err = conf.TokenKeyring(); err != nil {
+		return err
 	}
+	a.Secrets().OnChange("default.token_keys", a.syncTokenKeys)
 
 	if a.clientMinPing, err = time.ParseDuration(conf.ClientMinPing); err != nil {
 		return fmt.Errorf("Unable to parse 'client_min_ping_interval': %s",
@@ -116,7 +224,56 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 		return fmt.Errorf("Unable to parse 'client_hello_timeout': %s",
 			err.Error())
 	}
+	if a.serverPing, err = time.ParseDuration(conf.ServerPing); err != nil {
+		return fmt.Errorf("Unable to parse 'server_ping_interval': %s",
+			err.Error())
+	}
+	if a.maxMissedPongs = conf.MaxMissedPongs; a.maxMissedPongs < 1 {
+		a.maxMissedPongs = 1
+	}
+	if a.watchdogTimeout, err = time.ParseDuration(conf.WatchdogTimeout); err != nil {
+		return fmt.Errorf("Unable to parse 'watchdog_timeout': %s",
+			err.Error())
+	}
+	if a.writeTimeout, err = time.ParseDuration(conf.WriteTimeout); err != nil {
+		return fmt.Errorf("Unable to parse 'client_write_timeout': %s",
+			err.Error())
+	}
+	if a.drainTimeout, err = time.ParseDuration(conf.DrainTimeout); err != nil {
+		return fmt.Errorf("Unable to parse 'drain_timeout': %s",
+			err.Error())
+	}
+	if a.drainRetryAfter, err = time.ParseDuration(conf.DrainRetryAfter); err != nil {
+		return fmt.Errorf("Unable to parse 'drain_retry_after': %s",
+			err.Error())
+	}
+	a.maxMessageSize = conf.MaxMessageSize
+	if a.flushQueueDepth = conf.FlushQueueDepth; a.flushQueueDepth < 0 {
+		a.flushQueueDepth = 0
+	}
 	a.pushLongPongs = conf.PushLongPongs
+	a.configAudit = NewConfigAudit(conf.ConfigHistory)
+	a.logLevels = make(map[string]LogLevel, len(conf.LogLevels))
+	for _, pair := range conf.LogLevels {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return fmt.Errorf("Invalid log level setting: %q", pair)
+		}
+		module := strings.TrimSpace(pair[:i])
+		level, err := ParseLogLevel(pair[i+1:])
+		if len(module) == 0 || err != nil {
+			return fmt.Errorf("Invalid log level setting: %q", pair)
+		}
+		a.logLevels[module] = level
+	}
+	a.logSamplers = make(map[string]*LogSampler, len(conf.LogSampling))
+	for _, rule := range conf.LogSampling {
+		message, sampler, err := ParseLogSampleRule(rule)
+		if err != nil {
+			return fmt.Errorf("Invalid log sampling rule %q: %s", rule, err)
+		}
+		a.logSamplers[message] = sampler
+	}
 	a.clients = make(map[string]*Client)
 	a.clientMux = new(sync.RWMutex)
 	count := int32(0)
@@ -126,8 +283,16 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 
 // Set a logger
 func (a *Application) SetLogger(logger Logger) (err error) {
-	a.log, err = NewLogger(logger)
-	return
+	if a.log, err = NewLogger(logger); err != nil {
+		return err
+	}
+	for module, level := range a.logLevels {
+		a.log.SetModuleLevel(module, level)
+	}
+	for message, sampler := range a.logSamplers {
+		a.log.SetSampler(message, sampler)
+	}
+	return nil
 }
 
 func (a *Application) SetPropPinger(ping PropPinger) (err error) {
@@ -137,6 +302,7 @@ func (a *Application) SetPropPinger(ping PropPinger) (err error) {
 
 func (a *Application) SetMetrics(metrics *Metrics) error {
 	a.metrics = metrics
+	a.tracer = metrics.Tracer()
 	return nil
 }
 
@@ -150,6 +316,11 @@ func (a *Application) SetRouter(router *Router) error {
 	return nil
 }
 
+func (a *Application) SetSecrets(secrets *Secrets) error {
+	a.secrets = secrets
+	return nil
+}
+
 func (a *Application) SetServer(server *Serv) error {
 	a.server = server
 	return nil
@@ -160,6 +331,32 @@ func (a *Application) SetHandlers(handlers *Handler) error {
 	return nil
 }
 
+// adminHandler returns the handler for the admin listener. Every admin
+// endpoint requires an operator token or client certificate.
+func (a *Application) adminHandler() http.Handler {
+	adminMux := mux.NewRouter()
+	adminMux.HandleFunc("/admin/status", a.handlers.AdminStatusHandler)
+	adminMux.HandleFunc("/admin/clients/{uaid}", a.handlers.AdminClientHandler)
+	adminMux.HandleFunc("/admin/clients/{uaid}/disconnect", a.handlers.AdminDisconnectHandler)
+	adminMux.HandleFunc("/admin/drain", a.handlers.AdminDrainHandler)
+	adminMux.HandleFunc("/admin/rotate-keys", a.handlers.RotateKeysHandler)
+	adminMux.HandleFunc("/admin/config", a.handlers.ConfigSourcesHandler)
+	adminMux.HandleFunc("/admin/config/changes", a.handlers.ConfigChangesHandler)
+	adminMux.HandleFunc("/admin/rebalance", a.handlers.RebalanceHandler)
+	adminMux.HandleFunc("/admin/connection-counts", a.handlers.ConnectionCountsHandler)
+	adminMux.HandleFunc("/admin/log-levels", a.handlers.LogLevelsHandler)
+	adminMux.HandleFunc("/admin/features", a.handlers.FeaturesHandler)
+	adminMux.HandleFunc("/admin/maintenance", a.handlers.MaintenanceHandler)
+	adminMux.HandleFunc("/admin/tenants", a.handlers.TenantsHandler)
+	adminMux.HandleFunc("/admin/bans", a.handlers.BansHandler)
+	adminMux.HandleFunc("/metrics/prometheus", a.handlers.PrometheusHandler)
+	if a.server.Admin().Debug() {
+		adminMux.HandleFunc("/admin/connections", a.handlers.ConnectionsHandler)
+		HandleDebug(adminMux)
+	}
+	return a.server.Admin().Handler(adminMux)
+}
+
 // Start the application
 func (a *Application) Run() (errChan chan error) {
 	errChan = make(chan error)
@@ -167,17 +364,38 @@ func (a *Application) Run() (errChan chan error) {
 	clientMux := mux.NewRouter()
 	clientMux.HandleFunc("/status/", a.handlers.StatusHandler)
 	clientMux.HandleFunc("/realstatus/", a.handlers.RealStatusHandler)
-	clientMux.Handle("/", websocket.Server{Handler: a.handlers.PushSocketHandler,
-		Handshake: a.checkOrigin})
+	clientMux.Handle("/", a.server.Handshakes().Handler(a.server.Workers().Transport(),
+		a.handlers.PushSocketHandler, a.checkUpgrade))
 
 	endpointMux := mux.NewRouter()
-	endpointMux.HandleFunc("/update/{key}", a.handlers.UpdateHandler)
+	signer := a.server.Signer()
+	endpointMux.HandleFunc("/update/batch", signer.Handler(a.handlers.BatchUpdateHandler))
+	endpointMux.HandleFunc("/update/{key}", signer.Handler(a.handlers.UpdateHandler))
+	endpointMux.HandleFunc("/v1/receipts/stream", a.handlers.ReceiptStreamHandler)
+	endpointMux.HandleFunc("/v1/validate", a.handlers.ValidateHandler)
 	endpointMux.HandleFunc("/status/", a.handlers.StatusHandler)
 	endpointMux.HandleFunc("/realstatus/", a.handlers.RealStatusHandler)
 	endpointMux.HandleFunc("/metrics/", a.handlers.MetricsHandler)
+	endpointMux.HandleFunc("/realstats", a.handlers.RealStatsHandler)
+	endpointMux.HandleFunc(SigningKeysPath, a.handlers.SigningKeysHandler)
 
+	grpcMux := mux.NewRouter()
+	grpcMux.PathPrefix(grpcServicePath).HandlerFunc(a.handlers.PushServiceHandler)
+
+	// Internal routes only accept requests signed by other nodes, or sent
+	// over router mutual TLS.
 	routeMux := mux.NewRouter()
-	routeMux.HandleFunc("/route/{uaid}", a.handlers.RouteHandler)
+	routeMux.HandleFunc("/route/{uaid}", signer.PeerHandler(a.handlers.RouteHandler))
+	routeMux.HandleFunc("/status/", a.handlers.StatusHandler)
+	routeMux.HandleFunc("/gossip", signer.PeerHandler(a.handlers.GossipHandler))
+	routeMux.HandleFunc("/handoff/{uaid}", signer.PeerHandler(a.handlers.HandoffHandler))
+	routeMux.HandleFunc("/inflight/{uaid}", signer.PeerHandler(a.handlers.InFlightHandler))
+	routeMux.HandleFunc("/region", signer.PeerHandler(a.handlers.RegionHandler))
+	routeMux.HandleFunc("/connections", signer.PeerHandler(a.handlers.NodeConnectionsHandler))
+	routeMux.HandleFunc("/maintenance", signer.PeerHandler(a.handlers.NodeMaintenanceHandler))
+	routeMux.HandleFunc("/registry/{uaid}", signer.PeerHandler(a.handlers.RegistryHandler))
+	routeMux.HandleFunc("/relay/{uaid}", signer.PeerHandler(a.handlers.RelayHandler))
+	routeMux.HandleFunc(SigningKeysPath, a.handlers.SigningKeysHandler)
 
 	// Weigh the anchor!
 	go func() {
@@ -187,7 +405,7 @@ func (a *Application) Run() (errChan chan error) {
 				LogFields{"addr": clientLn.Addr().String()})
 		}
 		clientSrv := &http.Server{
-			Handler:  &LogHandler{clientMux, a.log},
+			Handler:  &LogHandler{a.server.TrustedProxies().Handler(clientMux), a.log, a.server.TrustedProxies()},
 			ErrorLog: log.New(&LogWriter{a.log.Logger, "worker", ERROR}, "", 0)}
 		errChan <- clientSrv.Serve(clientLn)
 	}()
@@ -199,11 +417,49 @@ func (a *Application) Run() (errChan chan error) {
 				LogFields{"addr": endpointLn.Addr().String()})
 		}
 		endpointSrv := &http.Server{
-			Handler:  &LogHandler{endpointMux, a.log},
+			Handler:  &LogHandler{a.server.TrustedProxies().Handler(endpointMux), a.log, a.server.TrustedProxies()},
 			ErrorLog: log.New(&LogWriter{a.log.Logger, "endpoint", ERROR}, "", 0)}
+		a.server.ConfigureEndpoint(endpointSrv)
 		errChan <- endpointSrv.Serve(endpointLn)
 	}()
 
+	if grpcLn := a.server.GRPCListener(); grpcLn != nil {
+		go func() {
+			if a.log.ShouldLog(INFO) {
+				a.log.Info("app", "Starting gRPC server",
+					LogFields{"addr": grpcLn.Addr().String()})
+			}
+			grpcSrv := &http.Server{
+				Handler:  &LogHandler{a.server.TrustedProxies().Handler(grpcMux), a.log, a.server.TrustedProxies()},
+				ErrorLog: log.New(&LogWriter{a.log.Logger, "grpc", ERROR}, "", 0)}
+			a.server.ConfigureGRPC(grpcSrv)
+			errChan <- grpcSrv.Serve(grpcLn)
+		}()
+	}
+
+	if mqttLn := a.server.MQTTListener(); mqttLn != nil {
+		go func() {
+			if a.log.ShouldLog(INFO) {
+				a.log.Info("app", "Starting MQTT server",
+					LogFields{"addr": mqttLn.Addr().String()})
+			}
+			errChan <- a.handlers.ServeMQTT(mqttLn)
+		}()
+	}
+
+	if adminLn := a.server.AdminListener(); adminLn != nil {
+		go func() {
+			if a.log.ShouldLog(INFO) {
+				a.log.Info("app", "Starting admin server",
+					LogFields{"addr": adminLn.Addr().String()})
+			}
+			adminSrv := &http.Server{
+				Handler:  &LogHandler{a.adminHandler(), a.log, nil},
+				ErrorLog: log.New(&LogWriter{a.log.Logger, "admin", ERROR}, "", 0)}
+			errChan <- adminSrv.Serve(adminLn)
+		}()
+	}
+
 	go func() {
 		routeLn := a.router.Listener()
 		if a.log.ShouldLog(INFO) {
@@ -211,11 +467,15 @@ func (a *Application) Run() (errChan chan error) {
 				LogFields{"addr": routeLn.Addr().String()})
 		}
 		routeSrv := &http.Server{
-			Handler:  &LogHandler{routeMux, a.log},
+			Handler:  &LogHandler{routeMux, a.log, nil},
 			ErrorLog: log.New(&LogWriter{a.log.Logger, "router", ERROR}, "", 0)}
 		errChan <- routeSrv.Serve(routeLn)
 	}()
 
+	// The listeners are open, so load balancers may start sending traffic.
+	// Failures are logged by the registration.
+	go a.server.Registration().Register()
+
 	return errChan
 }
 
@@ -240,6 +500,11 @@ func (a *Application) Metrics() Statistician {
 	return a.metrics
 }
 
+// Tracer returns the request tracer, or nil if tracing is not configured.
+func (a *Application) Tracer() *Tracer {
+	return a.tracer
+}
+
 func (a *Application) Router() *Router {
 	return a.router
 }
@@ -252,19 +517,150 @@ func (a *Application) Handlers() *Handler {
 	return a.handlers
 }
 
+// Events returns the in-process event bus.
+func (a *Application) Events() *EventBus {
+	a.eventsOnce.Do(func() {
+		if a.events == nil {
+			a.events = NewEventBus()
+		}
+	})
+	return a.events
+}
+
+// Context returns the application context, which is cancelled on Stop.
+// Connection contexts are derived from it.
+func (a *Application) Context() context.Context {
+	a.ctxOnce.Do(func() {
+		a.ctx, a.cancel = context.WithCancel(context.Background())
+	})
+	return a.ctx
+}
+
 func (a *Application) TokenKey() []byte {
 	return a.tokenKey
 }
 
+// Tokens returns the keyring used to mint and decode endpoint tokens.
+func (a *Application) Tokens() *TokenKeyring {
+	a.tokensOnce.Do(func() {
+		if a.tokens == nil {
+			a.tokens = NewTokenKeyring(a.tokenKey)
+		}
+	})
+	return a.tokens
+}
+
+// Secrets returns the resolver for secret references in the config.
+func (a *Application) Secrets() *Secrets {
+	a.secretsOnce.Do(func() {
+		if a.secrets == nil {
+			a.secrets = NewSecrets()
+		}
+	})
+	return a.secrets
+}
+
+// syncTokenKeys applies the token keys read from a shared secret, so that
+// every node mints and accepts the same keys. Keys removed from the secret
+// are revoked, and a key marked current becomes the minting key.
+func (a *Application) syncTokenKeys(specs []string) error {
+	keys, current, err := ParseTokenKeys(specs)
+	if err != nil {
+		return err
+	}
+	return a.Tokens().Sync(keys, current)
+}
+
+// ConfigAudit returns the trail of config changes applied by reloads.
+func (a *Application) ConfigAudit() *ConfigAudit {
+	a.configAuditOnce.Do(func() {
+		if a.configAudit == nil {
+			a.configAudit = NewConfigAudit(10)
+		}
+	})
+	return a.configAudit
+}
+
+// ReloadConfig re-reads the config file and its overlays, and records the
+// settings that changed since the last load. Each change is logged to the
+// audit stream, with secret values redacted. Components read their settings
+// once, at startup, so the changes are not applied: they take effect on the
+// next restart. Certificates are reloaded separately.
+func (a *Application) ReloadConfig(filenames ...string) (*ConfigRevision, error) {
+	layers, err := LoadConfigLayers(filenames...)
+	if err != nil {
+		return nil, err
+	}
+	filename := strings.Join(filenames, ",")
+	settings, err := FlattenConfig(layers.Config)
+	if err != nil {
+		return nil, err
+	}
+	revision := a.ConfigAudit().Apply(settings)
+	a.metrics.Increment("config.reload")
+	if revision == nil {
+		if a.log.ShouldLog(INFO) {
+			a.log.Info("audit", "Config reloaded without changes",
+				LogFields{"file": filename})
+		}
+		return nil, nil
+	}
+	if a.log.ShouldLog(NOTICE) {
+		for _, change := range revision.Changes {
+			a.log.Notice("audit", "Config setting changed; restart to apply", LogFields{
+				"file": filename,
+				"key":  change.Key,
+				"old":  change.Old,
+				"new":  change.New})
+		}
+	}
+	if a.log.ShouldLog(WARNING) {
+		a.log.Warn("audit", "Config changes take effect on restart", LogFields{
+			"file":    filename,
+			"changes": strconv.Itoa(len(revision.Changes))})
+	}
+	a.metrics.IncrementBy("config.changes", int64(len(revision.Changes)))
+	return revision, nil
+}
+
 func (a *Application) ClientCount() (count int) {
 	return int(atomic.LoadInt32(a.clientCount))
 }
 
+// ConnectionCount returns the number of live WebSocket and MQTT
+// connections, including connections that have not completed the
+// handshake. ClientCount only counts registered devices.
+func (a *Application) ConnectionCount() int {
+	return int(atomic.LoadInt32(&a.connCount))
+}
+
+// ConnectionOpened increments the live connection count. Workers call it
+// when they start running, and ConnectionClosed when they stop.
+func (a *Application) ConnectionOpened() {
+	atomic.AddInt32(&a.connCount, 1)
+}
+
+// ConnectionClosed decrements the live connection count.
+func (a *Application) ConnectionClosed() {
+	atomic.AddInt32(&a.connCount, -1)
+}
+
 func (a *Application) ClientExists(uaid string) (collision bool) {
 	_, collision = a.GetClient(uaid)
 	return
 }
 
+// Clients returns a snapshot of the connected clients.
+func (a *Application) Clients() []*Client {
+	a.clientMux.RLock()
+	clients := make([]*Client, 0, len(a.clients))
+	for _, client := range a.clients {
+		clients = append(clients, client)
+	}
+	a.clientMux.RUnlock()
+	return clients
+}
+
 func (a *Application) GetClient(uaid string) (client *Client, ok bool) {
 	a.clientMux.RLock()
 	client, ok = a.clients[uaid]
@@ -272,30 +668,76 @@ func (a *Application) GetClient(uaid string) (client *Client, ok bool) {
 	return
 }
 
-func (a *Application) checkOrigin(conf *websocket.Config,
-	req *http.Request) (err error) {
+// checkUpgrade validates the origin and subprotocols of a WebSocket upgrade
+// request, so that disallowed clients are rejected before a worker starts.
+func (a *Application) checkUpgrade(req *http.Request) (subprotocol string, err error) {
+	// Addresses behind proxies are only known once the request is read.
+	if a.server.Abuse().Banned(BanIP, requestRemoteAddr(req)) {
+		a.metrics.Increment("abuse.rejected.upgrade")
+		return "", ErrBanned
+	}
+	if err = a.checkOrigin(req); err != nil {
+		a.metrics.Increment("socket.upgrade.rejected.origin")
+		return "", err
+	}
+	if subprotocol, err = a.selectSubprotocol(req); err != nil {
+		a.metrics.Increment("socket.upgrade.rejected.subprotocol")
+		return "", err
+	}
+	return subprotocol, nil
+}
+
+// selectSubprotocol returns the first allowed subprotocol offered by the
+// client. If no subprotocols are configured, none is selected.
+func (a *Application) selectSubprotocol(req *http.Request) (string, error) {
+	if len(a.subprotocols) == 0 {
+		return "", nil
+	}
+	offered := requestSubprotocols(req)
+	if len(offered) == 0 {
+		if a.requireSubprotocol {
+			return "", ErrMissingSubprotocol
+		}
+		return "", nil
+	}
+	for _, protocol := range offered {
+		for _, allowed := range a.subprotocols {
+			if protocol == allowed {
+				return protocol, nil
+			}
+		}
+	}
+	if a.log.ShouldLog(WARNING) {
+		a.log.Warn("http", "Rejected WebSocket connection with unknown subprotocols",
+			LogFields{"rid": req.Header.Get(HeaderID),
+				"subprotocols": strings.Join(offered, ", ")})
+	}
+	return "", ErrInvalidSubprotocol
+}
 
+func (a *Application) checkOrigin(req *http.Request) error {
 	if len(a.origins) == 0 {
 		return nil
 	}
-	if conf.Origin, err = websocket.Origin(conf, req); err != nil {
+	origin, err := requestOrigin(req)
+	if err != nil {
 		if a.log.ShouldLog(WARNING) {
 			a.log.Warn("http", "Error parsing WebSocket origin",
 				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
 		}
 		return err
 	}
-	if conf.Origin == nil {
+	if origin == nil {
 		return ErrMissingOrigin
 	}
-	for _, origin := range a.origins {
-		if isSameOrigin(conf.Origin, origin) {
+	for _, allowed := range a.origins {
+		if isSameOrigin(origin, allowed) {
 			return nil
 		}
 	}
 	if a.log.ShouldLog(WARNING) {
 		a.log.Warn("http", "Rejected WebSocket connection from unknown origin",
-			LogFields{"rid": req.Header.Get(HeaderID), "origin": conf.Origin.String()})
+			LogFields{"rid": req.Header.Get(HeaderID), "origin": origin.String()})
 	}
 	return ErrInvalidOrigin
 }
@@ -319,10 +761,75 @@ func (a *Application) RemoveClient(uaid string) {
 	}
 }
 
+// DrainRequests receives a value when an operator asks the node to drain
+// and exit via the admin API. The caller should drain as on SIGTERM.
+func (a *Application) DrainRequests() <-chan bool {
+	return a.drainChan()
+}
+
+func (a *Application) drainChan() chan bool {
+	a.drainOnce.Do(func() {
+		a.drainRequests = make(chan bool, 1)
+	})
+	return a.drainRequests
+}
+
+// RequestDrain asks the application's owner to drain and exit. Returns false
+// if a drain is already pending.
+func (a *Application) RequestDrain() bool {
+	select {
+	case a.drainChan() <- true:
+		return true
+	default:
+	}
+	return false
+}
+
+// Draining indicates whether the application is shutting down gracefully.
+func (a *Application) Draining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// Drain prepares the application for a graceful shutdown: it stops accepting
+// client connections, asks connected clients to reconnect elsewhere after a
+// randomized delay, then waits for clients to disconnect and for queued
+// routing requests to finish. Returns once everything has drained or the
+// drain timeout elapses; the caller should then call Stop.
+func (a *Application) Drain() {
+	if !atomic.CompareAndSwapInt32(&a.draining, 0, 1) {
+		return
+	}
+	startTime := time.Now()
+	deadline := startTime.Add(a.drainTimeout)
+	// Stop load balancers from sending new clients before asking connected
+	// clients to reconnect.
+	a.server.Registration().Deregister()
+	a.server.Drain(a.drainRetryAfter)
+	for a.ClientCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	remaining := a.ClientCount()
+	drained := a.router.Drain(deadline.Sub(time.Now()))
+	if a.log.ShouldLog(NOTICE) {
+		a.log.Notice("app", "Finished draining", LogFields{
+			"clients":  strconv.Itoa(remaining),
+			"routed":   strconv.FormatBool(drained),
+			"duration": time.Since(startTime).String()})
+	}
+	a.metrics.Timer("app.drain", time.Since(startTime))
+	a.metrics.Gauge("app.drain.remaining", int64(remaining))
+}
+
 func (a *Application) Stop() {
+	a.Secrets().Close()
 	a.server.Close()
+	a.Context()
+	a.cancel()
 	a.router.Close()
 	a.store.Close()
+	if closer, ok := a.metrics.(io.Closer); ok {
+		closer.Close()
+	}
 	a.log.Close()
 }
 
@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAuditChainBroken = errors.New("Audit log hash chain is broken")
+	ErrAuditNoChainKey  = errors.New("Audit log requires a chain key")
+)
+
+// auditActions maps published events to audit log actions.
+var auditActions = map[EventType]string{
+	EventChannelRegistered:   "register",
+	EventChannelUnregistered: "unregister",
+	EventUAIDReset:           "reset",
+}
+
+type AuditConfig struct {
+	// Path is the file that receives the audit log. Records are appended;
+	// an existing log is verified and its hash chain continued. Auditing is
+	// disabled if no path is set.
+	Path string `env:"path"`
+
+	// HashKey is the secret used to hash device IDs. If not set, device IDs
+	// are hashed with plain SHA-256, which an attacker can reverse for a
+	// known device ID.
+	HashKey string `toml:"hash_key" env:"hash_key"`
+
+	// ChainKey is the secret used to sign the hash chain. Without it,
+	// anyone who can write to the file could rewrite the chain. Required if
+	// a path is set; store it apart from the log.
+	ChainKey string `toml:"chain_key" env:"chain_key"`
+}
+
+// AuditRecord is a registration lifecycle event in the audit log. Each
+// record includes the keyed hash of the previous record, so that removing
+// or editing a record breaks the chain from that point on.
+type AuditRecord struct {
+	Seq        uint64 `json:"seq"`
+	Time       string `json:"time"`
+	Action     string `json:"action"`
+	UAIDHash   string `json:"uaidHash"`
+	ChannelID  string `json:"channelID,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Prev       string `json:"prev"`
+	Hash       string `json:"hash,omitempty"`
+}
+
+// sum returns the HMAC-SHA256 of the record, excluding its own hash.
+func (r *AuditRecord) sum(key []byte) (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	body, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyAuditLog checks the hash chain of an audit log against the chain
+// key, and returns the last record that verified. The error identifies the
+// first record that did not.
+func VerifyAuditLog(r io.Reader, key []byte) (last *AuditRecord, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		record := new(AuditRecord)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return last, fmt.Errorf("Malformed audit record on line %d: %s",
+				line, err)
+		}
+		expected := AuditRecord{}
+		if last != nil {
+			expected.Seq, expected.Prev = last.Seq+1, last.Hash
+		}
+		sum, err := record.sum(key)
+		if err != nil || record.Seq != expected.Seq || record.Prev != expected.Prev ||
+			!hmac.Equal([]byte(record.Hash), []byte(sum)) {
+
+			return last, fmt.Errorf("%s on line %d", ErrAuditChainBroken, line)
+		}
+		last = record
+	}
+	return last, scanner.Err()
+}
+
+// AuditLog records device registration lifecycle events (register,
+// unregister, and device ID reset) to a dedicated, tamper-evident log for
+// abuse investigations. Device IDs are hashed, not logged.
+type AuditLog struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	hashKey  []byte
+	chainKey []byte
+	lock     sync.Mutex
+	file     *os.File
+	closed   bool
+	seq      uint64
+	prev     string
+}
+
+func NewAuditLog() *AuditLog {
+	return new(AuditLog)
+}
+
+func (*AuditLog) ConfigStruct() interface{} {
+	return new(AuditConfig)
+}
+
+func (a *AuditLog) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AuditConfig)
+	a.logger = app.Logger()
+	a.metrics = app.Metrics()
+	if len(conf.Path) == 0 {
+		return nil
+	}
+	if len(conf.ChainKey) == 0 {
+		a.logger.Panic("audit", "Missing audit log chain key",
+			LogFields{"path": conf.Path})
+		return ErrAuditNoChainKey
+	}
+	a.chainKey = []byte(conf.ChainKey)
+	if len(conf.HashKey) > 0 {
+		a.hashKey = []byte(conf.HashKey)
+	}
+	if err = a.open(conf.Path); err != nil {
+		a.logger.Panic("audit", "Could not open audit log",
+			LogFields{"error": err.Error(), "path": conf.Path})
+		return err
+	}
+	// Continue the existing chain. A broken log is reported and moved aside
+	// for investigation, but doesn't prevent startup; new records start a
+	// fresh chain, so that a single bad record doesn't fail every
+	// verification that follows.
+	last, err := VerifyAuditLog(a.file, a.chainKey)
+	if err != nil {
+		a.metrics.Increment("audit.verify.error")
+		brokenPath := fmt.Sprintf("%s.broken-%d", conf.Path, time.Now().Unix())
+		a.file.Close()
+		if err := os.Rename(conf.Path, brokenPath); err != nil {
+			a.logger.Panic("audit", "Could not move broken audit log",
+				LogFields{"error": err.Error(), "path": conf.Path})
+			return err
+		}
+		if a.logger.ShouldLog(CRITICAL) {
+			a.logger.Critical("audit", "Existing audit log failed verification",
+				LogFields{"error": err.Error(), "path": conf.Path, "movedTo": brokenPath})
+		}
+		if err = a.open(conf.Path); err != nil {
+			a.logger.Panic("audit", "Could not open audit log",
+				LogFields{"error": err.Error(), "path": conf.Path})
+			return err
+		}
+		last = nil
+	}
+	if last != nil {
+		a.seq, a.prev = last.Seq+1, last.Hash
+	}
+	events := app.Events()
+	for eventType := range auditActions {
+		events.Subscribe(eventType, a.Record)
+	}
+	return nil
+}
+
+// open opens the log file for appending, creating it if necessary.
+func (a *AuditLog) open(path string) (err error) {
+	a.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+// Enabled indicates whether events are audited.
+func (a *AuditLog) Enabled() bool {
+	return a != nil && a.file != nil
+}
+
+// HashUAID returns the hex-encoded keyed hash of a device ID.
+func (a *AuditLog) HashUAID(uaid string) string {
+	var h hash.Hash
+	if a != nil && len(a.hashKey) > 0 {
+		h = hmac.New(sha256.New, a.hashKey)
+	} else {
+		h = sha256.New()
+	}
+	io.WriteString(h, uaid)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Record appends a registration lifecycle event to the log.
+func (a *AuditLog) Record(event *Event) {
+	action, ok := auditActions[event.Type]
+	if !a.Enabled() || !ok {
+		return
+	}
+	record := &AuditRecord{
+		Time:       event.Time.UTC().Format(time.RFC3339Nano),
+		Action:     action,
+		UAIDHash:   a.HashUAID(event.UAID),
+		ChannelID:  event.ChannelID,
+		RemoteAddr: event.RemoteAddr,
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return
+	}
+	record.Seq, record.Prev = a.seq, a.prev
+	sum, err := record.sum(a.chainKey)
+	if err == nil {
+		record.Hash = sum
+		var line []byte
+		if line, err = json.Marshal(record); err == nil {
+			_, err = a.file.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		a.metrics.Increment("audit.error")
+		if a.logger.ShouldLog(ERROR) {
+			a.logger.Error("audit", "Could not write audit record",
+				LogFields{"error": err.Error(), "seq": strconv.FormatUint(record.Seq, 10)})
+		}
+		return
+	}
+	a.seq, a.prev = record.Seq+1, record.Hash
+	a.metrics.Increment("audit.recorded")
+}
+
+// Close flushes and closes the log.
+func (a *AuditLog) Close() error {
+	if !a.Enabled() {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	a.file.Sync()
+	return a.file.Close()
+}
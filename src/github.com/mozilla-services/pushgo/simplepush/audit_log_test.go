@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-audit")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+	open := func() *AuditLog {
+		_, app := newTestHandler(t)
+		audit := NewAuditLog()
+		conf := audit.ConfigStruct().(*AuditConfig)
+		conf.Path = path
+		conf.HashKey = "secret"
+		conf.ChainKey = "chain secret"
+		if err := audit.Init(app, conf); err != nil {
+			t.Fatalf("Error initializing audit log: %s", err)
+		}
+		events := app.Events()
+		events.Publish(&Event{Type: EventChannelRegistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: "192.0.2.1"})
+		events.Publish(&Event{Type: EventUpdateAccepted, UAID: uaid, ChannelID: chid})
+		events.Publish(&Event{Type: EventChannelUnregistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: "192.0.2.1"})
+		events.Publish(&Event{Type: EventUAIDReset, UAID: uaid})
+		return audit
+	}
+	// Reopening the log continues the chain.
+	open().Close()
+	audit := open()
+	audit.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading audit log: %s", err)
+	}
+	if bytes.Contains(data, []byte(uaid)) {
+		t.Errorf("Audit log contains unhashed device ID")
+	}
+	key := []byte("chain secret")
+	last, err := VerifyAuditLog(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatalf("Error verifying audit log: %s", err)
+	}
+	if last.Seq != 5 || last.Action != "reset" || last.UAIDHash != audit.HashUAID(uaid) {
+		t.Errorf("Wrong last record: %#v", last)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i, tampered := range [][]string{
+		append(append([]string{}, lines[:2]...), lines[3:]...),
+		append([]string{strings.Replace(lines[0], "192.0.2.1", "192.0.2.2", 1)}, lines[1:]...),
+	} {
+		last, err := VerifyAuditLog(strings.NewReader(strings.Join(tampered, "\n")), key)
+		if err == nil {
+			t.Errorf("Tampered log %d verified", i)
+			continue
+		}
+		if i == 0 && (last == nil || last.Seq != 1) {
+			t.Errorf("Wrong last verified record for tampered log %d: %#v", i, last)
+		}
+	}
+	// The chain can't be recomputed without the key.
+	if _, err := VerifyAuditLog(bytes.NewReader(data), []byte("guess")); err == nil {
+		t.Errorf("Audit log verified with the wrong key")
+	}
+
+	// A broken log is moved aside, and a new chain started.
+	tampered := strings.Join(append(lines[:1], lines[2:]...), "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(tampered), 0600); err != nil {
+		t.Fatalf("Error writing tampered audit log: %s", err)
+	}
+	open().Close()
+	if broken, _ := filepath.Glob(path + ".broken-*"); len(broken) != 1 {
+		t.Errorf("Broken audit log not moved aside: got %#v", broken)
+	}
+	if data, err = ioutil.ReadFile(path); err != nil {
+		t.Fatalf("Error reading audit log: %s", err)
+	}
+	if last, err = VerifyAuditLog(bytes.NewReader(data), key); err != nil || last.Seq != 2 {
+		t.Errorf("Wrong new audit log: got %#v, %v", last, err)
+	}
+
+	_, app := newTestHandler(t)
+	conf := &AuditConfig{Path: path}
+	if err := NewAuditLog().Init(app, conf); err != ErrAuditNoChainKey {
+		t.Errorf("Expected missing chain key error; got %v", err)
+	}
+}
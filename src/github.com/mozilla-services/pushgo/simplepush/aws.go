@@ -6,11 +6,17 @@ package simplepush
 
 import (
 	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
@@ -19,8 +25,12 @@ import (
 var (
 	ErrNoElastiCache      StorageError = "ElastiCache returned no endpoints"
 	ErrElastiCacheTimeout StorageError = "ElastiCache query timed out"
+	ErrNoAWSCredentials   StorageError = "No AWS credentials available"
 )
 
+// awsMetadataURL is the base URL of the EC2 instance metadata service.
+var awsMetadataURL = "http://169.254.169.254/latest/meta-data/"
+
 /* Get the public AWS hostname for this machine.
  * TODO: Make this a generic utility for getting public info from
  * the aws meta server?
@@ -113,3 +123,173 @@ func dropSpace(r rune) rune {
 	}
 	return r
 }
+
+// GetAWSMetadata fetches a value from the EC2 instance metadata service.
+func GetAWSMetadata(path string) (value string, err error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(awsMetadataURL + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Unexpected metadata response for %s: %s",
+			path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// GetAWSRegion returns the region of the current instance.
+func GetAWSRegion() (string, error) {
+	zone, err := GetAWSMetadata("placement/availability-zone")
+	if err != nil {
+		return "", err
+	}
+	if len(zone) == 0 {
+		return "", fmt.Errorf("Empty availability zone")
+	}
+	// Availability zones are named by appending a letter to the region.
+	return zone[:len(zone)-1], nil
+}
+
+// AWSCredentials are used to sign requests to AWS APIs.
+type AWSCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// GetAWSCredentials returns credentials from the standard AWS environment
+// variables, or from the instance's IAM role.
+func GetAWSCredentials() (creds *AWSCredentials, err error) {
+	if keyID := os.Getenv("AWS_ACCESS_KEY_ID"); len(keyID) > 0 {
+		return &AWSCredentials{
+			AccessKeyID:     keyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	roles, err := GetAWSMetadata("iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	role := strings.SplitN(roles, "\n", 2)[0]
+	if len(role) == 0 {
+		return nil, ErrNoAWSCredentials
+	}
+	body, err := GetAWSMetadata("iam/security-credentials/" + role)
+	if err != nil {
+		return nil, err
+	}
+	creds = new(AWSCredentials)
+	if err = json.Unmarshal([]byte(body), creds); err != nil {
+		return nil, err
+	}
+	if len(creds.AccessKeyID) == 0 {
+		return nil, ErrNoAWSCredentials
+	}
+	return creds, nil
+}
+
+// SignAWSRequest signs a GET request with AWS Signature Version 4. The
+// request must not have a body.
+func SignAWSRequest(req *http.Request, creds *AWSCredentials, region,
+	service string, now time.Time) {
+
+	SignAWSRequestBody(req, nil, creds, region, service, now)
+}
+
+// SignAWSRequestBody signs a request with the given body, which must match
+// the request's body, with AWS Signature Version 4.
+func SignAWSRequestBody(req *http.Request, body []byte, creds *AWSCredentials,
+	region, service string, now time.Time) {
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if len(creds.Token) > 0 {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	// Canonical headers are sorted by lowercase name.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := awsHMAC([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = awsHMAC(key, region)
+	key = awsHMAC(key, service)
+	key = awsHMAC(key, "aws4_request")
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCanonicalQuery encodes query parameters sorted by name, escaping
+// everything except unreserved characters, as required by Signature
+// Version 4.
+func awsCanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.Replace(s, "+", "%20", -1)
+	return strings.Replace(s, "%7E", "~", -1)
+}
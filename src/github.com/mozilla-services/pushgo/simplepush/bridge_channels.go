@@ -0,0 +1,31 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strings"
+)
+
+// bridgeKeyPrefix marks the primary keys of bridge-preferred channels.
+// Updates for these channels are sent through the device's proprietary
+// pinger even if the device is connected, so that the OS can display them;
+// they fall back to regular delivery if the pinger does not accept them.
+// Like groupKeyPrefix, the prefix cannot collide with a regular key.
+const bridgeKeyPrefix = "b."
+
+// BridgeKey returns the primary key for a bridge-preferred channel, given
+// the channel's regular primary key.
+func BridgeKey(pk string) string {
+	return bridgeKeyPrefix + pk
+}
+
+// BridgeKeyToKey strips the bridge-preferred marker from a primary key,
+// returning the regular key and whether the marker was present.
+func BridgeKeyToKey(key string) (pk string, bridge bool) {
+	if !strings.HasPrefix(key, bridgeKeyPrefix) {
+		return key, false
+	}
+	return key[len(bridgeKeyPrefix):], true
+}
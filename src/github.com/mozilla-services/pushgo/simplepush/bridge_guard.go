@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// BridgeLimitedErr is returned by pingers when the outbound rate limit
+	// for the bridge is exceeded.
+	BridgeLimitedErr = &PingerError{"Bridge rate limit exceeded", true}
+
+	// BridgeOpenErr is returned by pingers while the bridge's circuit
+	// breaker is open.
+	BridgeOpenErr = &PingerError{"Bridge circuit breaker open", true}
+)
+
+// BridgeGuardConfig configures the outbound rate limit and circuit breaker
+// of a proprietary ping backend.
+type BridgeGuardConfig struct {
+	// Limit is the outbound rate limit for the bridge. Wakes over the limit
+	// are dropped instead of queued, since pending updates are delivered
+	// when the device reconnects. Disabled by default.
+	Limit RateBudget `toml:"limit" env:"limit"`
+
+	// MaxFailures is the number of consecutive throttled or failed wakes
+	// that opens the circuit breaker. Setting this to 0 disables the
+	// breaker. Defaults to 10.
+	MaxFailures int `toml:"max_failures" env:"max_failures"`
+
+	// Cooldown is the amount of time the breaker stays open before letting
+	// a trial wake through. Defaults to 30 seconds.
+	Cooldown string `env:"cooldown"`
+}
+
+// DefaultBridgeGuard returns the default guard configuration for pinger
+// config structs.
+func DefaultBridgeGuard() BridgeGuardConfig {
+	return BridgeGuardConfig{
+		MaxFailures: 10,
+		Cooldown:    "30s",
+	}
+}
+
+// NewGuard returns a guard for the named backend.
+func (conf *BridgeGuardConfig) NewGuard(backend string,
+	metrics Statistician) (*BridgeGuard, error) {
+
+	cooldown, err := time.ParseDuration(conf.Cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid breaker cooldown (%s): %s",
+			conf.Cooldown, err)
+	}
+	return &BridgeGuard{
+		backend: backend,
+		metrics: metrics,
+		// A single bucket, keyed by backend name.
+		limit:       newTokenBuckets(conf.Limit, 2),
+		maxFailures: conf.MaxFailures,
+		cooldown:    cooldown,
+	}, nil
+}
+
+// BridgeGuard protects a bridge from bursts of wakes, and stops sending to
+// it after repeated failures, so that an outage or throttled sender does
+// not back up the delivery pipeline. Once open, the breaker lets a trial
+// wake through after each cooldown; a successful wake closes it.
+type BridgeGuard struct {
+	backend     string
+	metrics     Statistician
+	limit       *tokenBuckets
+	maxFailures int
+	cooldown    time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+}
+
+// Allow returns an error if a wake should not be sent to the bridge.
+func (g *BridgeGuard) Allow() error {
+	if g == nil {
+		return nil
+	}
+	now := time.Now()
+	g.lock.Lock()
+	if g.open {
+		if now.Before(g.openUntil) {
+			g.lock.Unlock()
+			g.metrics.Increment("ping." + g.backend + ".guard.open")
+			return BridgeOpenErr
+		}
+		// Let one trial wake through per cooldown.
+		g.openUntil = now.Add(g.cooldown)
+	}
+	g.lock.Unlock()
+	if !g.limit.Allow(g.backend, now) {
+		g.metrics.Increment("ping." + g.backend + ".guard.limited")
+		return BridgeLimitedErr
+	}
+	return nil
+}
+
+// Success records a wake accepted by the bridge, closing the breaker.
+func (g *BridgeGuard) Success() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.failures = 0
+	if g.open {
+		g.open = false
+		g.metrics.Gauge("ping."+g.backend+".guard.state", 0)
+	}
+}
+
+// Failure records a throttled or failed wake, opening the breaker after
+// too many consecutive failures.
+func (g *BridgeGuard) Failure() {
+	if g == nil {
+		return
+	}
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.failures++
+	if g.maxFailures <= 0 || g.failures < g.maxFailures {
+		return
+	}
+	if !g.open {
+		g.open = true
+		g.metrics.Increment("ping." + g.backend + ".guard.tripped")
+		g.metrics.Gauge("ping."+g.backend+".guard.state", 1)
+	}
+	g.openUntil = now.Add(g.cooldown)
+}
+
+// IsOpen indicates whether the breaker is open.
+func (g *BridgeGuard) IsOpen() bool {
+	if g == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.open
+}
@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_BridgeGuardLimit(t *testing.T) {
+	_, app := newTestHandler(t)
+	conf := DefaultBridgeGuard()
+	conf.Limit = RateBudget{Rate: 1, Burst: 2}
+	guard, err := conf.NewGuard("fcm", app.Metrics())
+	if err != nil {
+		t.Fatalf("Error creating guard: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := guard.Allow(); err != nil {
+			t.Errorf("Wake %d rejected: %s", i, err)
+		}
+	}
+	if err := guard.Allow(); err != BridgeLimitedErr {
+		t.Errorf("Wrong error for wake over the limit: %v", err)
+	}
+	mx := app.Metrics().(*TestMetrics)
+	if n := mx.Counters["ping.fcm.guard.limited"]; n != 1 {
+		t.Errorf("Wrong limited count: got %d; want 1", n)
+	}
+}
+
+func Test_BridgeGuardBreaker(t *testing.T) {
+	_, app := newTestHandler(t)
+	conf := BridgeGuardConfig{MaxFailures: 2, Cooldown: "20ms"}
+	guard, err := conf.NewGuard("apns", app.Metrics())
+	if err != nil {
+		t.Fatalf("Error creating guard: %s", err)
+	}
+	guard.Failure()
+	if err := guard.Allow(); err != nil {
+		t.Errorf("Breaker opened early: %s", err)
+	}
+	guard.Failure()
+	if !guard.IsOpen() {
+		t.Fatalf("Breaker not opened after consecutive failures")
+	}
+	if err := guard.Allow(); err != BridgeOpenErr {
+		t.Errorf("Wrong error while open: %v", err)
+	}
+
+	// One trial wake is let through after the cooldown.
+	time.Sleep(30 * time.Millisecond)
+	if err := guard.Allow(); err != nil {
+		t.Errorf("Trial wake rejected: %s", err)
+	}
+	if err := guard.Allow(); err != BridgeOpenErr {
+		t.Errorf("Wrong error during trial: %v", err)
+	}
+	guard.Success()
+	if guard.IsOpen() {
+		t.Errorf("Breaker not closed after successful trial")
+	}
+	if err := guard.Allow(); err != nil {
+		t.Errorf("Wake rejected after close: %s", err)
+	}
+	mx := app.Metrics().(*TestMetrics)
+	if n := mx.Counters["ping.apns.guard.tripped"]; n != 1 {
+		t.Errorf("Wrong tripped count: got %d; want 1", n)
+	}
+}
@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+const (
+	// RouterTypeHTTP routes updates with direct requests between routers.
+	RouterTypeHTTP = "http"
+
+	// RouterTypeRedis routes updates through Redis pub/sub channels.
+	RouterTypeRedis = "redis"
+
+	// RouterTypeNATS routes updates through NATS subjects.
+	RouterTypeNATS = "nats"
+)
+
+var errBrokerMessage = errors.New("Malformed broker message")
+
+// Broker delivers updates between nodes over a message bus, in place of
+// direct requests between routers. Routers subscribe to the devices
+// connected to the current node, and publish updates for all others.
+type Broker interface {
+	// Publish sends an encoded Routable for the device. Returns true if any
+	// node received the update.
+	Publish(uaid string, payload []byte) (received bool, err error)
+
+	// Subscribe starts receiving updates for the device.
+	Subscribe(uaid string) error
+
+	// Unsubscribe stops receiving updates for the device.
+	Unsubscribe(uaid string) error
+
+	// Status indicates whether the message bus is reachable.
+	Status() (bool, error)
+
+	// Close disconnects from the message bus.
+	Close() error
+}
+
+// encodeBrokerMessage prefixes an encoded Routable with the device ID, as
+// brokers may share a channel among several devices.
+func encodeBrokerMessage(uaid string, segment *capn.Segment) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(uaid)
+	buf.WriteByte('\n')
+	if _, err := segment.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBrokerMessage splits a message into the device ID and Routable.
+func decodeBrokerMessage(message []byte) (uaid string, segment *capn.Segment,
+	err error) {
+
+	i := bytes.IndexByte(message, '\n')
+	if i <= 0 {
+		return "", nil, errBrokerMessage
+	}
+	if segment, err = capn.ReadFromStream(bytes.NewReader(message[i+1:]), nil); err != nil {
+		return "", nil, err
+	}
+	return string(message[:i]), segment, nil
+}
+
+// deliver hands an update received from the broker to a locally connected
+// device. Updates for devices connected to other nodes are ignored. Returns
+// true if the update was delivered.
+func (r *Router) deliver(message []byte) (delivered bool) {
+	uaid, segment, err := decodeBrokerMessage(message)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not decode broker message",
+				LogFields{"error": err.Error()})
+		}
+		r.metrics.Increment("updates.routed.invalid")
+		return false
+	}
+	return r.deliverSegment(uaid, segment)
+}
+
+// deliverSegment hands an encoded Routable to a locally connected device.
+func (r *Router) deliverSegment(uaid string, segment *capn.Segment) (
+	delivered bool) {
+
+	if !r.app.ClientExists(uaid) {
+		r.metrics.Increment("updates.routed.unknown")
+		return false
+	}
+	routable := ReadRootRoutable(segment)
+	chid := routable.ChannelID()
+	if len(chid) == 0 {
+		r.metrics.Increment("updates.routed.invalid")
+		return false
+	}
+	r.metrics.Increment("updates.routed.incoming")
+	timeNano := routable.Time()
+	sentAt := time.Unix(timeNano/1e9, timeNano%1e9)
+	span := r.app.Tracer().StartSpan("router.deliver", SpanConsumer,
+		ParseTraceParent(routable.TraceParent()))
+	span.SetAttribute("uaid", uaid)
+	err := r.app.Server().Update(chid, uaid, routable.Version(), sentAt,
+		routable.Data(), span.Context())
+	span.End(err)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not update local user",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		r.metrics.Increment("updates.routed.error")
+		return false
+	}
+	r.metrics.Increment("updates.routed.received")
+	return true
+}
+
+// publish sends an update through the broker. Returns true if any node
+// received the update.
+func (r *Router) publish(uaid string, segment *capn.Segment, logID string) (
+	received bool, err error) {
+
+	payload, err := encodeBrokerMessage(uaid, segment)
+	if err != nil {
+		return false, err
+	}
+	if received, err = r.broker.Publish(uaid, payload); err != nil {
+		return false, err
+	}
+	if r.logger.ShouldLog(DEBUG) {
+		r.logger.Debug("router", "Published update", LogFields{"rid": logID,
+			"uaid": uaid, "received": strconv.FormatBool(received)})
+	}
+	return received, nil
+}
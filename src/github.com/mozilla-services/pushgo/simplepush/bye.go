@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"time"
+)
+
+// byeWriteTimeout bounds the time spent writing the "bye" message and close
+// frame, so that a client that stops reading can't hold up a drain or
+// rebalance.
+const byeWriteTimeout = 5 * time.Second
+
+// CloseCode is a WebSocket close status code sent to clients when the server
+// terminates a connection. Codes in the 4000-4999 range are specific to the
+// SimplePush protocol, and indicate that the client should not simply
+// reconnect and retry.
+type CloseCode int
+
+const (
+	// CloseNormal acknowledges a close frame sent by the client.
+	CloseNormal CloseCode = 1000
+
+	// CloseGoingAway indicates that the server is shutting down or
+	// restarting. Clients should reconnect after a delay.
+	CloseGoingAway CloseCode = 1001
+
+	// CloseProtocolError indicates that the client sent a malformed
+	// WebSocket frame.
+	CloseProtocolError CloseCode = 1002
+
+	// CloseMessageTooBig indicates that the client sent a message larger
+	// than the read limit.
+	CloseMessageTooBig CloseCode = 1009
+
+	// CloseTryAgainLater indicates that the server is over its connection
+	// memory budget. Clients should wait for the "retryAfter" interval
+	// before reconnecting.
+	CloseTryAgainLater CloseCode = 1013
+
+	// CloseUAIDConflict indicates that another connection claimed the same
+	// device ID.
+	CloseUAIDConflict CloseCode = 4001
+
+	// CloseTooManyChannels indicates that the client exceeded the maximum
+	// number of channels per device.
+	CloseTooManyChannels CloseCode = 4002
+
+	// CloseTooManyPings indicates that the client pinged more frequently
+	// than the minimum ping interval.
+	CloseTooManyPings CloseCode = 4003
+
+	// CloseMissedPongs indicates that the client did not reply to
+	// server-initiated pings.
+	CloseMissedPongs CloseCode = 4004
+
+	// CloseHelloTimeout indicates that the client did not complete the
+	// handshake in time.
+	CloseHelloTimeout CloseCode = 4005
+
+	// CloseRedirect indicates that the device belongs to another node. The
+	// "hello" reply includes the URL of that node.
+	CloseRedirect CloseCode = 4006
+
+	// CloseBanned indicates that the client was temporarily banned for
+	// abusive behavior. Clients should not reconnect until the ban expires.
+	CloseBanned CloseCode = 4007
+
+	// CloseMaintenance indicates that the server is in maintenance mode.
+	// Clients should wait for the "retryAfter" interval before reconnecting.
+	CloseMaintenance CloseCode = 4008
+
+	// CloseTenantLimit indicates that the tenant of the connected host has
+	// reached its connection limit on this node.
+	CloseTenantLimit CloseCode = 4009
+)
+
+var closeReasons = map[CloseCode]string{
+	CloseGoingAway:       "Server restarting",
+	CloseProtocolError:   "Protocol error",
+	CloseMessageTooBig:   "Message too large",
+	CloseTryAgainLater:   "Try again later",
+	CloseUAIDConflict:    "UAID conflict",
+	CloseTooManyChannels: "Too many channels",
+	CloseTooManyPings:    "Too many pings",
+	CloseMissedPongs:     "Missed pings",
+	CloseHelloTimeout:    "Handshake timeout",
+	CloseRedirect:        "Redirected",
+	CloseBanned:          "Banned",
+	CloseMaintenance:     "Maintenance",
+	CloseTenantLimit:     "Tenant connection limit",
+}
+
+// errToCloseCode maps fatal command errors to close codes.
+var errToCloseCode = map[error]CloseCode{
+	ErrExistingID:      CloseUAIDConflict,
+	ErrTooManyChannels: CloseTooManyChannels,
+	ErrTooManyPings:    CloseTooManyPings,
+	ErrBanned:          CloseBanned,
+}
+
+// Reason returns the human-readable close reason.
+func (c CloseCode) Reason() string {
+	return closeReasons[c]
+}
+
+// ByeMessage is sent to the client before the server closes the connection.
+type ByeMessage struct {
+	Type   string `json:"messageType"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+
+	// RetryAfter is the number of seconds the client should wait before
+	// reconnecting. Omitted if the client may reconnect immediately.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+
+	// Hosts lists the client URLs of alternate nodes, in order of preference.
+	// Sent with CloseRedirect when rebalancing connections.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Bye sends a "bye" message and a close frame with the given code, then
+// closes the underlying socket. Clean-up of the client session is left to
+// the socket handler.
+func (ws *PushWS) Bye(code CloseCode) error {
+	return ws.ByeAfter(code, 0)
+}
+
+// ByeAfter is like Bye, but asks the client to wait for retryAfter before
+// reconnecting.
+func (ws *PushWS) ByeAfter(code CloseCode, retryAfter time.Duration) error {
+	return ws.sendBye(code, retryAfter, nil)
+}
+
+// ByeRedirect closes the connection with CloseRedirect, asking the client to
+// reconnect to one of the given hosts after retryAfter.
+func (ws *PushWS) ByeRedirect(hosts []string, retryAfter time.Duration) error {
+	return ws.sendBye(CloseRedirect, retryAfter, hosts)
+}
+
+func (ws *PushWS) sendBye(code CloseCode, retryAfter time.Duration,
+	hosts []string) error {
+
+	// Only the first caller says goodbye; the connection is closed at once,
+	// so that concurrent callers don't send a second bye and close frame.
+	if ws == nil || !ws.markClosed() {
+		return nil
+	}
+	if ws.Socket == nil {
+		// Other transports have no close handshake; drop the connection.
+		if ws.Conn != nil {
+			return ws.Conn.Close()
+		}
+		return nil
+	}
+	reason := code.Reason()
+	ws.writeTimed(byeWriteTimeout, func() error {
+		ws.Socket.WriteJSON(ByeMessage{"bye", int(code), reason,
+			int64(retryAfter / time.Second), hosts})
+		return ws.Socket.WriteClose(code, reason)
+	})
+	if ws.Logger != nil && ws.Logger.ShouldLog(INFO) {
+		ws.Logger.Info("worker", "Closing client connection", LogFields{
+			"uaid":   ws.UAID(),
+			"code":   strconv.Itoa(int(code)),
+			"reason": reason})
+	}
+	return ws.Socket.Close()
+}
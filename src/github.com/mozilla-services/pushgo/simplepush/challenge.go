@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type ChallengeConfig struct {
+	// Threshold is the rate of handshakes per second above which new
+	// devices must solve a proof-of-work challenge. A threshold of 0 (the
+	// default) disables challenges.
+	Threshold float64 `env:"threshold"`
+
+	// Difficulty is the number of leading zero bits required in the
+	// SHA-256 hash of the challenge nonce and solution. Defaults to 16.
+	Difficulty int `env:"difficulty"`
+}
+
+// HelloChallenge is the challenge sent in reply to a handshake from a new
+// device while the node is under a handshake flood.
+type HelloChallenge struct {
+	Nonce      string `json:"nonce"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// ChallengeSolution is sent with a repeated handshake to solve a challenge.
+type ChallengeSolution struct {
+	Nonce    string `json:"nonce"`
+	Solution string `json:"solution"`
+}
+
+// ChallengeReply is the "hello" reply that carries a challenge.
+type ChallengeReply struct {
+	Type      string          `json:"messageType"`
+	Status    int             `json:"status"`
+	Challenge *HelloChallenge `json:"challenge"`
+}
+
+// rateMeter counts events per second.
+type rateMeter struct {
+	lock   sync.Mutex
+	second int64
+	count  float64
+	last   float64 // Count for the previous second.
+}
+
+func (m *rateMeter) rollLocked(now time.Time) {
+	second := now.Unix()
+	if second == m.second {
+		return
+	}
+	if second == m.second+1 {
+		m.last = m.count
+	} else {
+		m.last = 0
+	}
+	m.second, m.count = second, 0
+}
+
+// Mark records an event, and returns the current rate.
+func (m *rateMeter) Mark(now time.Time) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rollLocked(now)
+	m.count++
+	if m.count > m.last {
+		return m.count
+	}
+	return m.last
+}
+
+// HelloChallenger requires new devices to solve a small proof-of-work
+// challenge during the handshake while the handshake rate exceeds a
+// threshold, to damp registration floods without affecting normal clients.
+// Devices that reconnect with a known ID are never challenged.
+type HelloChallenger struct {
+	metrics    Statistician
+	threshold  float64
+	difficulty int
+	hellos     rateMeter
+}
+
+func NewHelloChallenger() *HelloChallenger {
+	return new(HelloChallenger)
+}
+
+func (*HelloChallenger) ConfigStruct() interface{} {
+	return &ChallengeConfig{
+		Difficulty: 16,
+	}
+}
+
+func (c *HelloChallenger) Init(app *Application, config interface{}) error {
+	conf := config.(*ChallengeConfig)
+	c.metrics = app.Metrics()
+	c.threshold = conf.Threshold
+	c.difficulty = conf.Difficulty
+	return nil
+}
+
+// Observe records a handshake, and indicates whether new devices must solve
+// a challenge.
+func (c *HelloChallenger) Observe() (required bool) {
+	if c == nil || c.threshold <= 0 {
+		return false
+	}
+	return c.hellos.Mark(time.Now()) > c.threshold
+}
+
+// New issues a challenge.
+func (c *HelloChallenger) New() (*HelloChallenge, error) {
+	nonce, err := genKey(16)
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.Increment("client.hello.challenge.issued")
+	return &HelloChallenge{hex.EncodeToString(nonce), c.difficulty}, nil
+}
+
+// Verify checks the solution to a challenge.
+func (c *HelloChallenger) Verify(challenge *HelloChallenge,
+	solution *ChallengeSolution) bool {
+
+	if challenge == nil || solution == nil || solution.Nonce != challenge.Nonce {
+		c.metrics.Increment("client.hello.challenge.failed")
+		return false
+	}
+	if !solvesChallenge(challenge.Nonce, solution.Solution, challenge.Difficulty) {
+		c.metrics.Increment("client.hello.challenge.failed")
+		return false
+	}
+	c.metrics.Increment("client.hello.challenge.solved")
+	return true
+}
+
+// solvesChallenge indicates whether the SHA-256 hash of the nonce and
+// solution has at least the given number of leading zero bits.
+func solvesChallenge(nonce, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(nonce + solution))
+	for _, b := range sum {
+		if difficulty <= 0 {
+			return true
+		}
+		if difficulty < 8 {
+			return b>>uint(8-difficulty) == 0
+		}
+		if b != 0 {
+			return false
+		}
+		difficulty -= 8
+	}
+	return difficulty <= 0
+}
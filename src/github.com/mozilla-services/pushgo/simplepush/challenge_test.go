@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// solveChallenge brute-forces a challenge solution.
+func solveChallenge(challenge *HelloChallenge) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if solvesChallenge(challenge.Nonce, solution, challenge.Difficulty) {
+			return solution
+		}
+	}
+}
+
+func TestSolvesChallenge(t *testing.T) {
+	challenge := &HelloChallenge{"abc", 12}
+	solution := solveChallenge(challenge)
+	if !solvesChallenge("abc", solution, 12) {
+		t.Errorf("Solution %q rejected", solution)
+	}
+	if !solvesChallenge("abc", "anything", 0) {
+		t.Error("Solution rejected without difficulty")
+	}
+	if solvesChallenge("abc", solution, 256) {
+		t.Error("Solution accepted for impossible difficulty")
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	start := time.Unix(1000, 0)
+	for i := 1; i <= 3; i++ {
+		if rate := m.Mark(start); rate != float64(i) {
+			t.Errorf("Wrong rate after %d events: %v", i, rate)
+		}
+	}
+	// The previous second's rate is used until the current second exceeds it.
+	if rate := m.Mark(start.Add(time.Second)); rate != 3 {
+		t.Errorf("Wrong rate in the next second: %v", rate)
+	}
+	if rate := m.Mark(start.Add(5 * time.Second)); rate != 1 {
+		t.Errorf("Wrong rate after an idle period: %v", rate)
+	}
+}
+
+// lookupCountingStore counts device lookups.
+type lookupCountingStore struct {
+	*NoStore
+	lookups int32
+}
+
+func (s *lookupCountingStore) Exists(uaid string) bool {
+	atomic.AddInt32(&s.lookups, 1)
+	return s.NoStore.Exists(uaid)
+}
+
+func Test_WorkerHelloChallenge(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := &lookupCountingStore{NoStore: app.Store().(*NoStore)}
+	app.store = store
+	challenger := NewHelloChallenger()
+	conf := challenger.ConfigStruct().(*ChallengeConfig)
+	conf.Threshold = 0.5
+	conf.Difficulty = 8
+	if err := challenger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing challenger: %s", err)
+	}
+	app.Server().challenger = challenger
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Device IDs are not looked up before the challenge is solved.
+	hello := map[string]interface{}{
+		"messageType": "hello",
+		"uaid":        "d1c7c768-b1be-4c70-93a6-9b52910d4baa",
+		"channelIDs":  []string{"decafbad-0000-4000-8000-000000000000"},
+	}
+	if err := websocket.JSON.Send(socket, hello); err != nil {
+		t.Fatalf("Error sending handshake: %s", err)
+	}
+	reply := new(ChallengeReply)
+	if err := websocket.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error receiving challenge: %s", err)
+	}
+	if reply.Status != 401 || reply.Challenge == nil {
+		t.Fatalf("Wrong challenge reply: %#v", reply)
+	}
+	if lookups := atomic.LoadInt32(&store.lookups); lookups != 0 {
+		t.Errorf("Device looked up %d times before the challenge", lookups)
+	}
+	if reply.Challenge.Difficulty != 8 || len(reply.Challenge.Nonce) != 32 {
+		t.Errorf("Wrong challenge: %#v", reply.Challenge)
+	}
+
+	// A wrong solution is answered with a new challenge.
+	hello["pow"] = ChallengeSolution{reply.Challenge.Nonce, "wrong"}
+	if solvesChallenge(reply.Challenge.Nonce, "wrong", 8) {
+		t.Skip("Wrong solution solves the challenge")
+	}
+	if err := websocket.JSON.Send(socket, hello); err != nil {
+		t.Fatalf("Error sending handshake: %s", err)
+	}
+	next := new(ChallengeReply)
+	if err := websocket.JSON.Receive(socket, next); err != nil {
+		t.Fatalf("Error receiving challenge: %s", err)
+	}
+	if next.Status != 401 || next.Challenge == nil ||
+		next.Challenge.Nonce == reply.Challenge.Nonce {
+		t.Fatalf("Wrong reply to wrong solution: %#v", next)
+	}
+
+	hello["pow"] = ChallengeSolution{next.Challenge.Nonce, solveChallenge(next.Challenge)}
+	if err := websocket.JSON.Send(socket, hello); err != nil {
+		t.Fatalf("Error sending handshake: %s", err)
+	}
+	final := new(struct {
+		Status   int    `json:"status"`
+		DeviceID string `json:"uaid"`
+	})
+	if err := websocket.JSON.Receive(socket, final); err != nil {
+		t.Fatalf("Error receiving handshake reply: %s", err)
+	}
+	if final.Status != 200 || len(final.DeviceID) == 0 {
+		t.Errorf("Wrong handshake reply: %#v", final)
+	}
+}
@@ -0,0 +1,207 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ChurnConfig struct {
+	// Window is the amount of time after a device disconnects during which
+	// its next connection counts as a reconnect. Set to "0" to disable
+	// reconnect tracking. Defaults to 5 minutes.
+	Window string `env:"window"`
+
+	// MaxSize is the maximum number of recently disconnected devices
+	// tracked. Defaults to 100000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// MaxReconnects is the number of reconnects, each within the window of
+	// the previous disconnect, after which a device is counted as churning.
+	// Defaults to 5.
+	MaxReconnects int `toml:"max_reconnects" env:"max_reconnects"`
+
+	// LifespanBuckets are the upper bounds of the connection duration
+	// histogram. Defaults to 30s, 1m, 2m, 5m, 10m, 30m, and 1h, which
+	// bracket common carrier NAT timeouts.
+	LifespanBuckets []string `toml:"lifespan_buckets" env:"lifespan_buckets"`
+}
+
+type churnEntry struct {
+	disconnected time.Time
+	reconnects   int
+}
+
+type lifespanBucket struct {
+	max   time.Duration
+	label string
+}
+
+// ChurnTracker measures how long connections last and how often devices
+// reconnect shortly after disconnecting, to quantify churn caused by
+// intermediaries that silently drop idle connections.
+type ChurnTracker struct {
+	logger        *SimpleLogger
+	metrics       Statistician
+	window        time.Duration
+	maxSize       int
+	maxReconnects int
+	buckets       []lifespanBucket
+	lock          sync.Mutex
+	current       map[string]churnEntry
+	previous      map[string]churnEntry
+	rotated       time.Time
+}
+
+func NewChurnTracker() *ChurnTracker {
+	return &ChurnTracker{
+		current:  make(map[string]churnEntry),
+		previous: make(map[string]churnEntry),
+	}
+}
+
+func (*ChurnTracker) ConfigStruct() interface{} {
+	return &ChurnConfig{
+		Window:          "5m",
+		MaxSize:         100000,
+		MaxReconnects:   5,
+		LifespanBuckets: []string{"30s", "1m", "2m", "5m", "10m", "30m", "1h"},
+	}
+}
+
+func (c *ChurnTracker) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*ChurnConfig)
+	c.logger = app.Logger()
+	c.metrics = app.Metrics()
+	c.maxSize = conf.MaxSize
+	c.maxReconnects = conf.MaxReconnects
+
+	for _, label := range conf.LifespanBuckets {
+		label = strings.TrimSpace(label)
+		max, err := time.ParseDuration(label)
+		if err != nil {
+			c.logger.Panic("churn", "Could not parse lifespan bucket",
+				LogFields{"error": err.Error(), "bucket": label})
+			return err
+		}
+		c.buckets = append(c.buckets, lifespanBucket{max, label})
+	}
+	sort.Sort(lifespanBuckets(c.buckets))
+
+	if c.window, err = time.ParseDuration(conf.Window); err != nil {
+		c.logger.Panic("churn", "Could not parse reconnect window",
+			LogFields{"error": err.Error(), "window": conf.Window})
+		return err
+	}
+	if c.window <= 0 || c.maxSize <= 0 {
+		return nil
+	}
+	c.rotated = time.Now()
+	events := app.Events()
+	events.Subscribe(EventClientConnected, func(event *Event) {
+		c.Connected(event.UAID, event.Time)
+	})
+	events.Subscribe(EventClientDisconnected, func(event *Event) {
+		c.Disconnected(event.UAID, event.Time)
+	})
+	return nil
+}
+
+// Lifespan records the duration of a closed connection in the histogram
+// for the given listener, e.g. "socket" or "mqtt".
+func (c *ChurnTracker) Lifespan(listener string, lifespan time.Duration) {
+	if c == nil {
+		return
+	}
+	c.metrics.Timer(listener+".lifespan", lifespan)
+	for _, bucket := range c.buckets {
+		if lifespan <= bucket.max {
+			c.metrics.Increment(listener + ".lifespan.le_" + bucket.label)
+			return
+		}
+	}
+	if len(c.buckets) > 0 {
+		c.metrics.Increment(listener + ".lifespan.gt_" +
+			c.buckets[len(c.buckets)-1].label)
+	}
+}
+
+// Disconnected notes when a device disconnected, so that its next
+// connection can be recognized as a reconnect.
+func (c *ChurnTracker) Disconnected(uaid string, now time.Time) {
+	if len(uaid) == 0 {
+		return
+	}
+	c.lock.Lock()
+	c.maybeRotate(now)
+	entry, _ := c.lookup(uaid)
+	entry.disconnected = now
+	c.current[uaid] = entry
+	size := len(c.current) + len(c.previous)
+	c.lock.Unlock()
+	c.metrics.Gauge("client.reconnect.tracked", int64(size))
+}
+
+// Connected records a reconnect if the device disconnected within the
+// window.
+func (c *ChurnTracker) Connected(uaid string, now time.Time) {
+	if len(uaid) == 0 {
+		return
+	}
+	c.lock.Lock()
+	c.maybeRotate(now)
+	entry, ok := c.lookup(uaid)
+	if !ok || now.Sub(entry.disconnected) > c.window {
+		delete(c.current, uaid)
+		c.lock.Unlock()
+		return
+	}
+	entry.reconnects++
+	c.current[uaid] = entry
+	c.lock.Unlock()
+
+	c.metrics.Increment("client.reconnect")
+	c.metrics.Timer("client.reconnect.gap", now.Sub(entry.disconnected))
+	if c.maxReconnects > 0 && entry.reconnects == c.maxReconnects {
+		c.metrics.Increment("client.reconnect.churning")
+		if c.logger.ShouldLog(INFO) {
+			c.logger.Info("churn", "Device is reconnecting frequently",
+				LogFields{"uaid": uaid, "reconnects": strconv.Itoa(entry.reconnects)})
+		}
+	}
+}
+
+// lookup returns the device's entry from either generation, promoting it to
+// the current one. The caller must hold the lock.
+func (c *ChurnTracker) lookup(uaid string) (entry churnEntry, ok bool) {
+	if entry, ok = c.current[uaid]; ok {
+		return
+	}
+	if entry, ok = c.previous[uaid]; ok {
+		delete(c.previous, uaid)
+	}
+	return
+}
+
+// maybeRotate discards devices that have not disconnected for two windows,
+// or early if the tracker is full. The caller must hold the lock.
+func (c *ChurnTracker) maybeRotate(now time.Time) {
+	if now.Sub(c.rotated) < c.window && len(c.current) < c.maxSize/2 {
+		return
+	}
+	c.previous = c.current
+	c.current = make(map[string]churnEntry, len(c.previous))
+	c.rotated = now
+}
+
+type lifespanBuckets []lifespanBucket
+
+func (b lifespanBuckets) Len() int           { return len(b) }
+func (b lifespanBuckets) Less(i, j int) bool { return b[i].max < b[j].max }
+func (b lifespanBuckets) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,52 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChurnTracker(t *testing.T) {
+	_, app := newTestHandler(t)
+	metrics := app.metrics.(*TestMetrics)
+	churn := NewChurnTracker()
+	conf := churn.ConfigStruct().(*ChurnConfig)
+	conf.MaxReconnects = 2
+	conf.LifespanBuckets = []string{"5m", "30s"}
+	if err := churn.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing churn tracker: %s", err)
+	}
+
+	churn.Lifespan("socket", 10*time.Second)
+	churn.Lifespan("socket", time.Minute)
+	churn.Lifespan("socket", time.Hour)
+
+	uaid := "deadbeef000000000000000000000000"
+	now := time.Now()
+	churn.Connected(uaid, now)
+	churn.Disconnected(uaid, now.Add(time.Second))
+	churn.Connected(uaid, now.Add(2*time.Second))
+	churn.Disconnected(uaid, now.Add(3*time.Second))
+	churn.Connected(uaid, now.Add(4*time.Second))
+	// Connections after the window are not reconnects.
+	churn.Disconnected(uaid, now.Add(5*time.Second))
+	churn.Connected(uaid, now.Add(time.Hour))
+
+	metrics.RLock()
+	defer metrics.RUnlock()
+	for name, expected := range map[string]int64{
+		"socket.lifespan.le_30s":    1,
+		"socket.lifespan.le_5m":     1,
+		"socket.lifespan.gt_5m":     1,
+		"client.reconnect":          2,
+		"client.reconnect.churning": 1,
+	} {
+		if actual := metrics.Counters[name]; actual != expected {
+			t.Errorf("Wrong value for %q: got %d; want %d", name, actual,
+				expected)
+		}
+	}
+}
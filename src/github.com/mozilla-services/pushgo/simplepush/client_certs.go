@@ -0,0 +1,140 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingClientCert = errors.New("Missing client certificate")
+	ErrUnknownClientCert = errors.New("Unknown client certificate")
+	ErrClientCertQuota   = errors.New("Client certificate quota exceeded")
+	ErrInvalidCertSpec   = errors.New(`Certificate identities must be of the form "name[:rate[:burst]] subject"`)
+)
+
+type ClientCertConfig struct {
+	// Required rejects updates without a client certificate that maps to an
+	// identity. If not set, updates without one fall back to API keys.
+	Required bool `env:"required"`
+
+	// Identities maps certificate subjects to app server identities, each
+	// of the form "name[:rate[:burst]] subject", where rate is the number of
+	// updates allowed per second. The subject matches the certificate's
+	// distinguished name (e.g., "CN=billing,O=Example"), common name, or any
+	// DNS, URI, or email subject alternative name.
+	Identities []string `env:"identities"`
+}
+
+// ClientCertAuth authenticates app servers by TLS client certificate, as an
+// alternative to API keys for internal mTLS meshes. Certificates must be
+// verified by the endpoint listener; see ListenerConfig.ClientCAFile.
+type ClientCertAuth struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	required   bool
+	identities map[string]*AppServer // Keyed by subject.
+}
+
+func NewClientCertAuth() *ClientCertAuth {
+	return &ClientCertAuth{identities: make(map[string]*AppServer)}
+}
+
+func (*ClientCertAuth) ConfigStruct() interface{} {
+	return new(ClientCertConfig)
+}
+
+func (c *ClientCertAuth) Init(app *Application, config interface{}) error {
+	conf := config.(*ClientCertConfig)
+	c.logger = app.Logger()
+	c.metrics = app.Metrics()
+	c.required = conf.Required
+	for _, spec := range conf.Identities {
+		subject, identity, err := parseCertIdentitySpec(spec)
+		if err != nil {
+			c.logger.Panic("clientcert", "Could not parse certificate identity",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		appServer := newAPIKeyEntry(identity)
+		appServer.quotaErr = ErrClientCertQuota
+		c.identities[subject] = appServer
+	}
+	return nil
+}
+
+// parseCertIdentitySpec parses an identity of the form
+// "name[:rate[:burst]] subject".
+func parseCertIdentitySpec(spec string) (subject string, identity *APIKey, err error) {
+	spec = strings.TrimSpace(spec)
+	space := strings.IndexAny(spec, " \t")
+	if space < 1 {
+		return "", nil, ErrInvalidCertSpec
+	}
+	subject = strings.TrimSpace(spec[space+1:])
+	fields := strings.Split(spec[:space], ":")
+	if len(fields) > 3 || len(fields[0]) == 0 || len(subject) == 0 {
+		return "", nil, ErrInvalidCertSpec
+	}
+	identity = &APIKey{Name: fields[0]}
+	if len(fields) > 1 {
+		if identity.Rate, err = strconv.ParseFloat(fields[1], 64); err != nil || identity.Rate < 0 {
+			return "", nil, ErrInvalidCertSpec
+		}
+	}
+	if len(fields) > 2 {
+		if identity.Burst, err = strconv.Atoi(fields[2]); err != nil || identity.Burst < 0 {
+			return "", nil, ErrInvalidCertSpec
+		}
+	}
+	return subject, identity, nil
+}
+
+// certSubjects returns the names that identify a certificate.
+func certSubjects(cert *x509.Certificate) []string {
+	subjects := []string{cert.Subject.String()}
+	if len(cert.Subject.CommonName) > 0 {
+		subjects = append(subjects, cert.Subject.CommonName)
+	}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	return subjects
+}
+
+// Authenticate maps the verified client certificate of an update request to
+// an app server identity. It returns the app server, which is nil if
+// certificates are not required and the request did not present a known one.
+func (c *ClientCertAuth) Authenticate(req *http.Request) (appServer *AppServer, err error) {
+	if c == nil || len(c.identities) == 0 && !c.required {
+		return nil, nil
+	}
+	var entry *AppServer
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		for _, subject := range certSubjects(req.TLS.VerifiedChains[0][0]) {
+			if entry = c.identities[subject]; entry != nil {
+				break
+			}
+		}
+	}
+	if entry == nil {
+		if !c.required {
+			return nil, nil
+		}
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			c.metrics.Increment("clientcert.missing")
+			return nil, ErrMissingClientCert
+		}
+		c.metrics.Increment("clientcert.unknown")
+		return nil, ErrUnknownClientCert
+	}
+	return entry, nil
+}
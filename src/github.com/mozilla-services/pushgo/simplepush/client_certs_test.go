@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newCertRequest returns an update request with a verified client
+// certificate.
+func newCertRequest(cert *x509.Certificate) *http.Request {
+	req, _ := http.NewRequest("POST", "https://test/update", nil)
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+	return req
+}
+
+func TestClientCertAuth(t *testing.T) {
+	handler, app := newTestHandler(t)
+	certAuth := NewClientCertAuth()
+	conf := certAuth.ConfigStruct().(*ClientCertConfig)
+	conf.Identities = []string{
+		"billing:0.001:1 CN=billing,O=Example",
+		"mesh spiffe://cluster.local/ns/push/sa/mesh",
+	}
+	if err := certAuth.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing client certificate auth: %s", err)
+	}
+	app.Server().certAuth = certAuth
+
+	billing := &x509.Certificate{Subject: pkix.Name{
+		CommonName: "billing", Organization: []string{"Example"}}}
+	meshURI, _ := url.Parse("spiffe://cluster.local/ns/push/sa/mesh")
+	mesh := &x509.Certificate{URIs: []*url.URL{meshURI}}
+	unknown := &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}}
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		status   int
+		identity string
+	}{
+		{"No certificate", nil, http.StatusOK, ""},
+		{"Unknown certificate", unknown, http.StatusOK, ""},
+		{"Distinguished name", billing, http.StatusOK, "billing"},
+		{"Over quota", billing, http.StatusTooManyRequests, "billing"},
+		{"URI subject", mesh, http.StatusOK, "mesh"},
+	}
+	for _, test := range tests {
+		resp, appServer := authorizeTestUpdate(handler, newCertRequest(test.cert))
+		if resp.Code != test.status {
+			t.Errorf("%s: got status %d; want %d", test.name, resp.Code, test.status)
+		}
+		var name string
+		if appServer != nil {
+			name = appServer.Name
+		}
+		if name != test.identity {
+			t.Errorf("%s: got identity %q; want %q", test.name, name, test.identity)
+		}
+	}
+
+	certAuth.required = true
+	for _, cert := range []*x509.Certificate{nil, unknown} {
+		resp := httptest.NewRecorder()
+		if _, ok := handler.checkAppServer(resp, newCertRequest(cert), 0); ok {
+			t.Errorf("Request without a known certificate accepted: %#v", cert)
+		} else if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Wrong status for unknown certificate: %d", resp.Code)
+		}
+	}
+
+	for _, spec := range []string{"billing", " CN=billing", "billing:x CN=billing"} {
+		if _, _, err := parseCertIdentitySpec(spec); err == nil {
+			t.Errorf("Invalid identity %q was accepted", spec)
+		}
+	}
+}
@@ -269,6 +269,11 @@ func LoadConfigForSection(app *Application, sectionName string, obj HasConfigStr
 			sectionName, err)
 	}
 
+	if err = app.Secrets().Resolve(sectionName, confStruct); err != nil {
+		return fmt.Errorf("Unable to load secrets for section '%s': %s",
+			sectionName, err)
+	}
+
 	err = obj.Init(app, confStruct)
 	return
 }
@@ -303,6 +308,10 @@ func LoadExtensibleSection(app *Application, sectionName string,
 	if err != nil {
 		return nil, err
 	}
+	if err = app.Secrets().Resolve(sectionName, loadedConfig); err != nil {
+		return nil, fmt.Errorf("Unable to load secrets for section '%s': %s",
+			sectionName, err)
+	}
 
 	err = obj.Init(app, loadedConfig)
 	return obj, err
@@ -313,20 +322,47 @@ func LoadExtensibleSection(app *Application, sectionName string,
 func LoadApplicationFromFileName(filename string, logging int) (
 	app *Application, err error) {
 
-	var configFile ConfigFile
+	return LoadApplicationFromFileNames([]string{filename}, logging)
+}
+
+// LoadApplicationFromFileNames loads an Application from a base config file
+// and overlays, and records the source of each setting. See ConfigLayers for
+// the order of precedence.
+func LoadApplicationFromFileNames(filenames []string, logging int) (
+	app *Application, err error) {
+
+	layers, err := LoadConfigLayers(filenames...)
+	if err != nil {
+		return nil, err
+	}
+	env := envconf.Load()
+	if app, err = LoadApplication(layers.Config, env, logging); err != nil {
+		return nil, err
+	}
+	app.ConfigAudit().SetSources(layers.Sources(env))
+	return app, nil
+}
+
+// LoadConfigFile reads and decodes a TOML config file.
+func LoadConfigFile(filename string) (configFile ConfigFile, err error) {
 	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
 		return nil, fmt.Errorf("Error decoding config file: %s", err)
 	}
-	env := envconf.Load()
-	return LoadApplication(configFile, env, logging)
+	return configFile, nil
 }
 
 func LoadApplication(configFile ConfigFile, env envconf.Environment,
 	logging int) (app *Application, err error) {
 
+	// Secrets are loaded first, so that other sections can reference them.
+	secrets, err := LoadSecrets(configFile, env)
+	if err != nil {
+		return nil, err
+	}
 	loaders := PluginLoaders{
 		PluginApp: func(app *Application) (HasConfigStruct, error) {
-			return nil, LoadConfigForSection(nil, "default", app, env, configFile)
+			app.SetSecrets(secrets)
+			return nil, LoadConfigForSection(app, "default", app, env, configFile)
 		},
 		PluginLogger: func(app *Application) (HasConfigStruct, error) {
 			return LoadExtensibleSection(app, "logging", AvailableLoggers, env, configFile)
@@ -370,7 +406,16 @@ func LoadApplication(configFile ConfigFile, env envconf.Environment,
 		},
 	}
 
-	return loaders.Load(logging)
+	if app, err = loaders.Load(logging); err != nil {
+		return nil, err
+	}
+	app.Secrets().Start(app)
+	settings, err := FlattenConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	app.ConfigAudit().Reset(settings)
+	return app, nil
 }
 
 func toEnvName(params ...string) string {
@@ -0,0 +1,214 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbangert/toml"
+)
+
+// redactedValue replaces the old and new values of secret settings in
+// config diffs.
+const redactedValue = "[redacted]"
+
+// secretKeyWords identify settings whose values must not be logged.
+var secretKeyWords = []string{"key", "secret", "password", "token", "auth"}
+
+// ConfigChange describes a single setting that changed between two configs.
+// Old is empty for added settings; New is empty for removed settings.
+type ConfigChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// ConfigRevision is a set of changes applied by a config reload.
+type ConfigRevision struct {
+	Time    time.Time       `json:"time"`
+	Changes []*ConfigChange `json:"changes"`
+}
+
+// FlattenConfig returns the settings in a config file as a map of
+// dot-separated keys to string values.
+func FlattenConfig(configFile ConfigFile) (settings map[string]string, err error) {
+	settings = make(map[string]string)
+	for name, section := range configFile {
+		values := make(map[string]interface{})
+		if err = toml.PrimitiveDecode(section, &values); err != nil {
+			return nil, fmt.Errorf("Unable to decode config for section '%s': %s",
+				name, err)
+		}
+		flattenValues(settings, name, values)
+	}
+	return settings, nil
+}
+
+func flattenValues(settings map[string]string, prefix string,
+	values map[string]interface{}) {
+
+	for key, value := range values {
+		flattenValue(settings, prefix+"."+key, value)
+	}
+}
+
+// flattenValue adds a setting, or the settings in a table. Tables in arrays
+// are keyed by their index, as in "tenants.hosts[0].name".
+func flattenValue(settings map[string]string, name string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		flattenValues(settings, name, value)
+	case []map[string]interface{}:
+		for i, table := range value {
+			flattenValues(settings, name+"["+strconv.Itoa(i)+"]", table)
+		}
+	case []interface{}:
+		if !hasTables(value) {
+			settings[name] = fmt.Sprint(value)
+			return
+		}
+		for i, item := range value {
+			flattenValue(settings, name+"["+strconv.Itoa(i)+"]", item)
+		}
+	default:
+		settings[name] = fmt.Sprint(value)
+	}
+}
+
+// hasTables indicates whether an array contains tables.
+func hasTables(values []interface{}) bool {
+	for _, value := range values {
+		if _, ok := value.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecretKey indicates whether the named setting holds a secret. Every
+// part of the name is checked, so that all settings in a secret table, like
+// "auth.user", are redacted.
+func isSecretKey(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range secretKeyWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffConfig returns the settings that differ between old and new, sorted
+// by key. Secret values are redacted.
+func DiffConfig(old, new map[string]string) (changes []*ConfigChange) {
+	for key, oldValue := range old {
+		if newValue, ok := new[key]; !ok || newValue != oldValue {
+			changes = append(changes, &ConfigChange{key, oldValue, newValue})
+		}
+	}
+	for key, newValue := range new {
+		if _, ok := old[key]; !ok {
+			changes = append(changes, &ConfigChange{Key: key, New: newValue})
+		}
+	}
+	for _, change := range changes {
+		if !isSecretKey(change.Key) {
+			continue
+		}
+		if len(change.Old) > 0 {
+			change.Old = redactedValue
+		}
+		if len(change.New) > 0 {
+			change.New = redactedValue
+		}
+	}
+	sort.Sort(configChanges(changes))
+	return changes
+}
+
+type configChanges []*ConfigChange
+
+func (c configChanges) Len() int           { return len(c) }
+func (c configChanges) Less(i, j int) bool { return c[i].Key < c[j].Key }
+func (c configChanges) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// ConfigAudit tracks the most recently loaded config and a bounded history
+// of changes applied by reloads.
+type ConfigAudit struct {
+	sync.Mutex
+	current    map[string]string
+	sources    []*ConfigSource
+	history    []*ConfigRevision
+	maxHistory int
+}
+
+// NewConfigAudit creates a config audit trail that retains up to maxHistory
+// revisions.
+func NewConfigAudit(maxHistory int) *ConfigAudit {
+	if maxHistory < 1 {
+		maxHistory = 1
+	}
+	return &ConfigAudit{
+		current:    make(map[string]string),
+		maxHistory: maxHistory,
+	}
+}
+
+// Reset sets the baseline config without recording a revision.
+func (c *ConfigAudit) Reset(settings map[string]string) {
+	c.Lock()
+	c.current = settings
+	c.Unlock()
+}
+
+// SetSources records the effective settings and their sources, as loaded
+// at startup.
+func (c *ConfigAudit) SetSources(sources []*ConfigSource) {
+	c.Lock()
+	c.sources = sources
+	c.Unlock()
+}
+
+// Sources returns the effective settings and their sources.
+func (c *ConfigAudit) Sources() []*ConfigSource {
+	c.Lock()
+	defer c.Unlock()
+	return c.sources
+}
+
+// Apply records the differences between the current and new configs, and
+// makes the new config current. Returns nil if nothing changed.
+func (c *ConfigAudit) Apply(settings map[string]string) *ConfigRevision {
+	c.Lock()
+	defer c.Unlock()
+	changes := DiffConfig(c.current, settings)
+	c.current = settings
+	if len(changes) == 0 {
+		return nil
+	}
+	revision := &ConfigRevision{Time: time.Now().UTC(), Changes: changes}
+	if len(c.history) >= c.maxHistory {
+		copy(c.history, c.history[1:])
+		c.history = c.history[:len(c.history)-1]
+	}
+	c.history = append(c.history, revision)
+	return revision
+}
+
+// History returns the retained revisions, newest first.
+func (c *ConfigAudit) History() []*ConfigRevision {
+	c.Lock()
+	defer c.Unlock()
+	history := make([]*ConfigRevision, len(c.history))
+	for i, revision := range c.history {
+		history[len(c.history)-1-i] = revision
+	}
+	return history
+}
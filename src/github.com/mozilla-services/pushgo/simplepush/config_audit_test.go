@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bbangert/toml"
+)
+
+func TestConfigAudit(t *testing.T) {
+	var oldFile, newFile ConfigFile
+	if _, err := toml.Decode(configSource, &oldFile); err != nil {
+		t.Fatalf("Error decoding old config: %s", err)
+	}
+	if _, err := toml.Decode(`
+[default]
+current_host = "push.services.mozilla.com"
+use_aws_host = false
+token_key = "c2VjcmV0"
+
+    [default.websocket]
+    addr = ":8080"
+    max_connections = 30000
+
+[handlers]
+max_data_len = 256
+
+[[tenants.hosts]]
+name = "a.example.com"
+
+    [tenants.hosts.auth]
+    user = "alice"
+`, &newFile); err != nil {
+		t.Fatalf("Error decoding new config: %s", err)
+	}
+	oldSettings, err := FlattenConfig(oldFile)
+	if err != nil {
+		t.Fatalf("Error flattening old config: %s", err)
+	}
+	if oldSettings["default.websocket.max_connections"] != "25000" {
+		t.Errorf("Wrong flattened value: got %q; want 25000",
+			oldSettings["default.websocket.max_connections"])
+	}
+	newSettings, err := FlattenConfig(newFile)
+	if err != nil {
+		t.Fatalf("Error flattening new config: %s", err)
+	}
+
+	audit := NewConfigAudit(1)
+	audit.Reset(oldSettings)
+	if revision := audit.Apply(oldSettings); revision != nil {
+		t.Errorf("Unexpected revision for unchanged config: %#v", revision)
+	}
+	revision := audit.Apply(newSettings)
+	if revision == nil {
+		t.Fatal("Missing revision for changed config")
+	}
+	changes := make(map[string]ConfigChange)
+	for _, change := range revision.Changes {
+		changes[change.Key] = *change
+	}
+	expected := map[string]ConfigChange{
+		"default.use_aws_host":              {"default.use_aws_host", "true", "false"},
+		"default.token_key":                 {"default.token_key", "", redactedValue},
+		"default.websocket.max_connections": {"default.websocket.max_connections", "25000", "30000"},
+		"router.bucket_size":                {"router.bucket_size", "15", ""},
+		"tenants.hosts[0].name":             {"tenants.hosts[0].name", "", "a.example.com"},
+		"tenants.hosts[0].auth.user":        {"tenants.hosts[0].auth.user", "", redactedValue},
+	}
+	for key, change := range expected {
+		if !reflect.DeepEqual(changes[key], change) {
+			t.Errorf("Wrong change for %s: got %#v; want %#v", key,
+				changes[key], change)
+		}
+	}
+	if _, ok := changes["handlers.max_data_len"]; ok {
+		t.Error("Unchanged setting reported as changed")
+	}
+
+	// Only the most recent revision is retained.
+	audit.Apply(oldSettings)
+	history := audit.History()
+	if len(history) != 1 {
+		t.Fatalf("Wrong history length: got %d; want 1", len(history))
+	}
+	if history[0] == revision {
+		t.Error("Expected oldest revision to be evicted")
+	}
+}
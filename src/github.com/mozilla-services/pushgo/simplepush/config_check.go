@@ -0,0 +1,350 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// Config check modes, as accepted by the -check-config flag.
+const (
+	// CheckShallow decodes each section, rejecting unknown settings,
+	// malformed values, unknown plugin types, and invalid environment
+	// overrides.
+	CheckShallow = "shallow"
+
+	// CheckDeep also resolves secrets and listener addresses, loads TLS
+	// certificates, and connects to storage.
+	CheckDeep = "deep"
+)
+
+// ConfigCheck is the result of validating a config file without starting
+// the server.
+type ConfigCheck struct {
+	// Settings holds the effective settings, after environment overrides,
+	// as a map of dot-separated keys to values. Secret values are redacted.
+	Settings map[string]string
+
+	// Errors lists the problems found, in section order.
+	Errors []error
+
+	// raw holds the unredacted settings, for comparison.
+	raw map[string]string
+}
+
+// OK indicates whether the config is valid.
+func (c *ConfigCheck) OK() bool {
+	return len(c.Errors) == 0
+}
+
+func (c *ConfigCheck) fail(err error) {
+	c.Errors = append(c.Errors, err)
+}
+
+// WriteSettings writes the effective settings to w, one per line, sorted
+// by key.
+func (c *ConfigCheck) WriteSettings(w io.Writer) error {
+	keys := make([]string, 0, len(c.Settings))
+	for key := range c.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s = %s\n", key, c.Settings[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkedSection is a config section and the plugins that read it.
+type checkedSection struct {
+	name       string
+	extensions AvailableExtensions // nil for sections without a type.
+	plugins    []HasConfigStruct
+}
+
+// CheckConfig validates a config file in the given mode, collecting every
+// problem instead of stopping at the first.
+func CheckConfig(configFile ConfigFile, env envconf.Environment,
+	mode string) (check *ConfigCheck) {
+
+	check = &ConfigCheck{
+		Settings: make(map[string]string),
+		raw:      make(map[string]string),
+	}
+	if mode != CheckShallow && mode != CheckDeep {
+		check.fail(fmt.Errorf("Unknown config check mode '%s'", mode))
+		return check
+	}
+	sections := []checkedSection{
+		{name: "default", plugins: []HasConfigStruct{new(Application), NewServer()}},
+		{name: "logging", extensions: AvailableLoggers},
+		{name: "metrics", plugins: []HasConfigStruct{new(Metrics)}},
+		{name: "storage", extensions: AvailableStores},
+		{name: "propping", extensions: AvailablePings},
+		{name: "router", plugins: []HasConfigStruct{NewRouter()}},
+		{name: "discovery", extensions: AvailableLocators},
+		{name: "handlers", plugins: []HasConfigStruct{new(Handler)}},
+	}
+	var secrets *Secrets
+	if mode == CheckDeep {
+		var err error
+		if secrets, err = LoadSecrets(configFile, env); err != nil {
+			check.fail(err)
+		}
+	}
+	known := map[string]bool{"secrets": true}
+	for _, section := range sections {
+		known[section.name] = true
+		configs := check.decodeSection(configFile, env, section)
+		if mode != CheckDeep {
+			continue
+		}
+		for _, config := range configs {
+			if secrets != nil {
+				if err := secrets.Resolve(section.name, config); err != nil {
+					check.fail(err)
+					continue
+				}
+			}
+			check.checkListeners(section.name, reflect.ValueOf(config).Elem())
+		}
+	}
+	for name := range configFile {
+		if !known[name] {
+			check.fail(fmt.Errorf("Unknown config section '%s'", name))
+		}
+	}
+	if mode == CheckDeep && check.OK() {
+		check.checkStorage(configFile, env, secrets)
+	}
+	return check
+}
+
+// decodeSection strictly decodes a section into the config structs of its
+// plugins, records the effective settings, and returns the structs.
+func (c *ConfigCheck) decodeSection(configFile ConfigFile,
+	env envconf.Environment, section checkedSection) (configs []interface{}) {
+
+	primitive, ok := configFile[section.name]
+	if !ok {
+		c.fail(fmt.Errorf("Missing section '%s'", section.name))
+		return nil
+	}
+	structs := make([]interface{}, 0, len(section.plugins)+1)
+	for _, plugin := range section.plugins {
+		structs = append(structs, plugin.ConfigStruct())
+	}
+	if section.extensions != nil {
+		globals := new(ExtensibleGlobals)
+		if err := toml.PrimitiveDecode(primitive, globals); err != nil {
+			c.fail(fmt.Errorf("Unable to decode config for section '%s': %s",
+				section.name, err))
+			return nil
+		}
+		if err := env.Decode(toEnvName(section.name), EnvSep, globals); err != nil {
+			c.fail(fmt.Errorf("Invalid environment variable for section '%s': %s",
+				section.name, err))
+			return nil
+		}
+		ext, ok := section.extensions.Get(globals.Typ)
+		if !ok {
+			c.fail(fmt.Errorf("No type '%s' available to load for section '%s'",
+				globals.Typ, section.name))
+			return nil
+		}
+		if len(globals.Typ) > 0 {
+			c.setting(section.name+".type", reflect.ValueOf(globals.Typ))
+		}
+		structs = append(structs, ext().ConfigStruct(), globals)
+	}
+	for i, config := range structs {
+		if _, ok := config.(*ExtensibleGlobals); ok || config == nil {
+			continue
+		}
+		// Settings read by the section's other plugins are not unknown.
+		ignoreConfig := make(map[string]interface{})
+		ignoreEnv := make(map[string]interface{})
+		for j, other := range structs {
+			if j != i && other != nil {
+				configKeys(section.name, other, ignoreConfig, ignoreEnv)
+			}
+		}
+		if err := toml.PrimitiveDecodeStrict(primitive, config, ignoreConfig); err != nil {
+			if matches := unknownOptionRegex.FindStringSubmatch(err.Error()); len(matches) == 2 {
+				err = fmt.Errorf("Unknown config setting for section '%s': %s",
+					section.name, matches[1])
+			} else {
+				err = fmt.Errorf("Unable to decode config for section '%s': %s",
+					section.name, err)
+			}
+			c.fail(err)
+			continue
+		}
+		if err := env.DecodeStrict(toEnvName(section.name), EnvSep, config, ignoreEnv); err != nil {
+			c.fail(fmt.Errorf("Invalid environment variable for section '%s': %s",
+				section.name, err))
+			continue
+		}
+		c.flattenStruct(section.name, reflect.ValueOf(config).Elem())
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// configKeys adds the names of the top-level settings of a config struct to
+// the given ignore maps, in the form expected by strict decoding.
+func configKeys(sectionName string, config interface{},
+	tomlKeys, envKeys map[string]interface{}) {
+
+	t := reflect.TypeOf(config).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			tomlKeys[field.Name] = true
+			name = strings.ToLower(field.Name)
+		}
+		tomlKeys[name] = true
+		if name = field.Tag.Get("env"); len(name) == 0 {
+			name = field.Name
+		}
+		envKeys[toEnvName(sectionName, name)] = true
+	}
+}
+
+// flattenStruct records the settings of a decoded config struct, using the
+// same dot-separated keys as FlattenConfig.
+func (c *ConfigCheck) flattenStruct(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + "." + name
+		if value := v.Field(i); value.Kind() == reflect.Struct {
+			c.flattenStruct(key, value)
+		} else {
+			c.setting(key, value)
+		}
+	}
+}
+
+// setting records the value of a setting. Secret values are redacted.
+func (c *ConfigCheck) setting(key string, value reflect.Value) {
+	c.raw[key] = fmt.Sprint(value.Interface())
+	switch {
+	case isSecretKey(key) && isSetValue(value):
+		c.Settings[key] = redactedValue
+	case value.Kind() == reflect.String:
+		c.Settings[key] = fmt.Sprintf("%q", value.String())
+	default:
+		c.Settings[key] = c.raw[key]
+	}
+}
+
+// isSetValue indicates whether a setting holds a non-empty string or list.
+func isSetValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice:
+		return value.Len() > 0
+	}
+	return false
+}
+
+// checkListeners resolves the addresses and loads the TLS certificates of
+// the listeners in a config struct.
+func (c *ConfigCheck) checkListeners(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 || v.Field(i).Kind() != reflect.Struct {
+			continue
+		}
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + "." + name
+		listener, ok := v.Field(i).Addr().Interface().(*ListenerConfig)
+		if !ok {
+			c.checkListeners(key, v.Field(i))
+			continue
+		}
+		if len(listener.Addr) == 0 || listener.IsUnix() {
+			continue
+		}
+		if _, err := net.ResolveTCPAddr("tcp", listener.Addr); err != nil {
+			c.fail(fmt.Errorf("Unable to resolve listener '%s': %s", key, err))
+		}
+		if listener.UseTLS() {
+			if _, _, err := listener.TLSConfig(); err != nil {
+				c.fail(fmt.Errorf("Unable to load certificates for listener '%s': %s",
+					key, err))
+			}
+		}
+	}
+}
+
+// checkStorage initializes the storage adapter and checks that its backing
+// store is reachable. The logger and metrics are initialized first, since
+// the adapter depends on them.
+func (c *ConfigCheck) checkStorage(configFile ConfigFile,
+	env envconf.Environment, secrets *Secrets) {
+
+	app := new(Application)
+	app.SetSecrets(secrets)
+	if err := LoadConfigForSection(app, "default", app, env, configFile); err != nil {
+		c.fail(err)
+		return
+	}
+	obj, err := LoadExtensibleSection(app, "logging", AvailableLoggers, env, configFile)
+	if err == nil {
+		err = app.SetLogger(obj.(Logger))
+	}
+	if err != nil {
+		c.fail(fmt.Errorf("Unable to initialize logger: %s", err))
+		return
+	}
+	defer app.Logger().Close()
+	metrics := new(Metrics)
+	if err = LoadConfigForSection(app, "metrics", metrics, env, configFile); err != nil {
+		c.fail(fmt.Errorf("Unable to initialize metrics: %s", err))
+		return
+	}
+	app.SetMetrics(metrics)
+	if closer, ok := app.Metrics().(io.Closer); ok {
+		defer closer.Close()
+	}
+	if obj, err = LoadExtensibleSection(app, "storage", AvailableStores, env, configFile); err != nil {
+		c.fail(fmt.Errorf("Unable to initialize storage: %s", err))
+		return
+	}
+	store := obj.(Store)
+	defer store.Close()
+	if ok, err := store.Status(); !ok {
+		if err == nil {
+			err = fmt.Errorf("Storage unhealthy")
+		}
+		c.fail(fmt.Errorf("Storage unreachable: %s", err))
+	}
+}
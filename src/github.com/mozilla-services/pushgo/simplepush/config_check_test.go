@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+func TestCheckConfig(t *testing.T) {
+	var configFile ConfigFile
+	if _, err := toml.Decode(configSource, &configFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	checkEnv := envconf.New([]string{"PUSHGO_HANDLERS_MAX_DATA_LEN=512"})
+	check := CheckConfig(configFile, checkEnv, CheckShallow)
+	if !check.OK() {
+		t.Fatalf("Unexpected config errors: %v", check.Errors)
+	}
+	for key, value := range map[string]string{
+		"default.current_host":            `"push.services.mozilla.com"`,
+		"default.websocket.addr":          `":8080"`,
+		"handlers.max_data_len":           "512",
+		"logging.type":                    `"stdout"`,
+		"router.listener.max_connections": "6000",
+	} {
+		if actual := check.Settings[key]; actual != value {
+			t.Errorf("Wrong setting for %s: got %s; want %s", key, actual, value)
+		}
+	}
+	var out bytes.Buffer
+	check.WriteSettings(&out)
+	if !strings.Contains(out.String(), "handlers.max_data_len = 512\n") {
+		t.Errorf("Missing setting in output: %s", out.String())
+	}
+
+	// Secret settings are redacted.
+	var secretFile ConfigFile
+	if _, err := toml.Decode(configSource+`
+[default.apikeys]
+keys = ["app:s3cret"]
+`, &secretFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	check = CheckConfig(secretFile, checkEnv, CheckShallow)
+	if value := check.Settings["default.apikeys.keys"]; value != redactedValue {
+		t.Errorf("Secret setting not redacted: %s", value)
+	}
+
+	// Every problem is reported, not just the first.
+	var badFile ConfigFile
+	if _, err := toml.Decode(`
+[default]
+[logging]
+type = "carrier-pigeon"
+[handlers]
+max_data_size = 256
+[bogus]
+`, &badFile); err != nil {
+		t.Fatalf("Error decoding config: %s", err)
+	}
+	check = CheckConfig(badFile, checkEnv, CheckShallow)
+	// Bad logger type, unknown setting, unknown section, and five missing
+	// sections.
+	if len(check.Errors) != 8 {
+		t.Errorf("Wrong error count: got %d; want 8: %v", len(check.Errors), check.Errors)
+	}
+	if check = CheckConfig(configFile, checkEnv, "deeper"); check.OK() {
+		t.Errorf("Unknown check mode accepted")
+	}
+}
@@ -0,0 +1,237 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// Sources of settings that were not read from a config file.
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+)
+
+// ConfigSource reports the effective value of a setting, and where it came
+// from: the name of the config file that last set it, SourceEnv if it was
+// overridden by an environment variable, or SourceDefault.
+type ConfigSource struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type configSources []*ConfigSource
+
+func (s configSources) Len() int           { return len(s) }
+func (s configSources) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s configSources) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ConfigLayers is a config assembled from a base file and overlay files.
+// Settings are resolved in order of increasing precedence: built-in
+// defaults, the base file, each overlay in order, and finally environment
+// variables. An overlay replaces individual settings, not whole sections;
+// lists are replaced, not appended to.
+type ConfigLayers struct {
+	Files  []string
+	Config ConfigFile
+
+	// files maps each setting to the last file that set it.
+	files map[string]string
+}
+
+// LoadConfigLayers reads and merges a base config file and its overlays.
+func LoadConfigLayers(filenames ...string) (layers *ConfigLayers, err error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("No config files specified")
+	}
+	layers = &ConfigLayers{
+		Files: filenames,
+		files: make(map[string]string),
+	}
+	merged := make(map[string]interface{})
+	for _, filename := range filenames {
+		values := make(map[string]interface{})
+		if _, err = toml.DecodeFile(filename, &values); err != nil {
+			return nil, fmt.Errorf("Error decoding config file '%s': %s",
+				filename, err)
+		}
+		mergeValues(merged, values, "", filename, layers.files)
+	}
+	if len(filenames) == 1 {
+		// Decode the file as written, rather than a re-encoded copy.
+		if layers.Config, err = LoadConfigFile(filenames[0]); err != nil {
+			return nil, err
+		}
+		return layers, nil
+	}
+	var buf bytes.Buffer
+	if err = writeTable(&buf, "", merged); err != nil {
+		return nil, fmt.Errorf("Error merging config files: %s", err)
+	}
+	if _, err = toml.Decode(buf.String(), &layers.Config); err != nil {
+		return nil, fmt.Errorf("Error merging config files: %s", err)
+	}
+	return layers, nil
+}
+
+// Sources reports the effective value and source of every setting read by
+// the server, sorted by key. Secret values are redacted. Settings in
+// sections that fail to decode are omitted.
+func (l *ConfigLayers) Sources(env envconf.Environment) []*ConfigSource {
+	check := CheckConfig(l.Config, env, CheckShallow)
+	defaults := CheckConfig(l.Config, envconf.New(nil), CheckShallow)
+	sources := make([]*ConfigSource, 0, len(check.Settings))
+	for key, value := range check.Settings {
+		source := SourceDefault
+		if check.raw[key] != defaults.raw[key] {
+			source = SourceEnv
+		} else if filename, ok := l.files[key]; ok {
+			source = filename
+		}
+		sources = append(sources, &ConfigSource{key, value, source})
+	}
+	sort.Sort(configSources(sources))
+	return sources
+}
+
+// mergeValues copies the values of an overlay into dst, merging tables and
+// recording the source of each setting.
+func mergeValues(dst, src map[string]interface{}, prefix, source string,
+	files map[string]string) {
+
+	for key, value := range src {
+		name := key
+		if len(prefix) > 0 {
+			name = prefix + "." + key
+		}
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			dst[key] = value
+			files[name] = source
+			continue
+		}
+		table, ok := dst[key].(map[string]interface{})
+		if !ok {
+			table = make(map[string]interface{})
+			dst[key] = table
+		}
+		mergeValues(table, nested, name, source, files)
+	}
+}
+
+// writeTable encodes a decoded TOML table. Values are written before
+// subtables, so that they are not mistaken for subtable values.
+func writeTable(buf *bytes.Buffer, prefix string,
+	table map[string]interface{}) error {
+
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var subtables []string
+	for _, key := range keys {
+		switch table[key].(type) {
+		case map[string]interface{}, []map[string]interface{}:
+			subtables = append(subtables, key)
+			continue
+		}
+		fmt.Fprintf(buf, "%s = ", key)
+		if err := writeValue(buf, table[key]); err != nil {
+			return fmt.Errorf("Invalid value for '%s': %s", key, err)
+		}
+		buf.WriteByte('\n')
+	}
+	for _, key := range subtables {
+		name := key
+		if len(prefix) > 0 {
+			name = prefix + "." + key
+		}
+		switch value := table[key].(type) {
+		case map[string]interface{}:
+			fmt.Fprintf(buf, "\n[%s]\n", name)
+			if err := writeTable(buf, name, value); err != nil {
+				return err
+			}
+		case []map[string]interface{}:
+			for _, element := range value {
+				fmt.Fprintf(buf, "\n[[%s]]\n", name)
+				if err := writeTable(buf, name, element); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeValue(buf *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case string:
+		writeString(buf, value)
+	case bool:
+		buf.WriteString(strconv.FormatBool(value))
+	case int64:
+		buf.WriteString(strconv.FormatInt(value, 10))
+	case float64:
+		s := strconv.FormatFloat(value, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		buf.WriteString(s)
+	case time.Time:
+		buf.WriteString(value.UTC().Format("2006-01-02T15:04:05Z"))
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, element := range value {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeValue(buf, element); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		return fmt.Errorf("unsupported type %T", value)
+	}
+	return nil
+}
+
+// writeString writes a TOML basic string, escaping quotes, backslashes, and
+// control characters.
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(buf, `\u%04X`, r)
+				continue
+			}
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
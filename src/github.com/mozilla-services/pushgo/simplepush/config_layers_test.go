@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kitcambridge/envconf"
+)
+
+func TestConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-config")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "config.toml")
+	overlay := filepath.Join(dir, "stage.toml")
+	if err = ioutil.WriteFile(base, []byte(configSource), 0644); err != nil {
+		t.Fatalf("Error writing base config: %s", err)
+	}
+	if err = ioutil.WriteFile(overlay, []byte(`
+[default]
+current_host = "push.stage.mozaws.net"
+origins = ["https://push.stage.mozaws.net"]
+
+    [default.websocket]
+    max_connections = 500
+
+[router]
+pool_size = 10
+`), 0644); err != nil {
+		t.Fatalf("Error writing overlay: %s", err)
+	}
+
+	layers, err := LoadConfigLayers(base, overlay)
+	if err != nil {
+		t.Fatalf("Error loading config layers: %s", err)
+	}
+	layerEnv := envconf.New([]string{"PUSHGO_ROUTER_POOL_SIZE=20"})
+	sources := make(map[string]*ConfigSource)
+	for _, source := range layers.Sources(layerEnv) {
+		sources[source.Key] = source
+	}
+	for key, expected := range map[string]ConfigSource{
+		"default.current_host":              {Value: `"push.stage.mozaws.net"`, Source: overlay},
+		"default.origins":                   {Value: "[https://push.stage.mozaws.net]", Source: overlay},
+		"default.websocket.addr":            {Value: `":8080"`, Source: base},
+		"default.websocket.max_connections": {Value: "500", Source: overlay},
+		"router.bucket_size":                {Value: "15", Source: base},
+		"router.pool_size":                  {Value: "20", Source: SourceEnv},
+		"handlers.max_data_len":             {Value: "256", Source: base},
+		"default.resolve_host":              {Value: "false", Source: SourceDefault},
+	} {
+		source, ok := sources[key]
+		if !ok {
+			t.Errorf("Missing source for %s", key)
+			continue
+		}
+		if source.Value != expected.Value || source.Source != expected.Source {
+			t.Errorf("Wrong source for %s: got %s from %s; want %s from %s",
+				key, source.Value, source.Source, expected.Value, expected.Source)
+		}
+	}
+
+	if _, err = LoadConfigLayers(base, filepath.Join(dir, "missing.toml")); err == nil {
+		t.Errorf("Missing overlay accepted")
+	}
+}
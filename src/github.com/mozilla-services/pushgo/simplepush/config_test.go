@@ -66,7 +66,7 @@ var env = envconf.New([]string{
 	"pushgo_LOGGING_FORMAT=text",
 	"pushgo_logging_FILTER=0",
 	"PUSHGO_PROPPING_TYPE=udp",
-	"PUSHGO_PROPPING_URL=http://push.services.mozilla.com/ping",
+	"PUSHGO_PROPPING_REPEAT=2",
 	"PushGo_Router_Bucket_Size=15",
 	"PushGo_Router_Pool_Size=250",
 	"PUSHGO_ROUTER_LISTENER_ADDR=",
@@ -117,14 +117,13 @@ func TestConfigFile(t *testing.T) {
 	}
 	pinger := app.PropPinger()
 	if udpPing, ok := pinger.(*UDPPing); ok {
-		if udpPing.app != app {
-			t.Errorf("Wrong app instance for pinger: got %#v; want %#v",
-				udpPing.app, app)
+		if udpPing.store != store {
+			t.Errorf("Wrong store instance for pinger: got %#v; want %#v",
+				udpPing.store, store)
 		}
-		url := "http://push.services.mozilla.com/ping"
-		if udpPing.config.URL != url {
-			t.Errorf("Wrong pinger URL: got %#v; want %#v",
-				udpPing.config.URL, url)
+		if udpPing.repeat != 2 {
+			t.Errorf("Wrong pinger repeat count: got %d; want 2",
+				udpPing.repeat)
 		}
 	} else {
 		t.Errorf("Pinger type assertion failed: %#v", pinger)
@@ -0,0 +1,163 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// NodeConnections is the connection count of a single node.
+type NodeConnections struct {
+	// Node is the node's routing URL, or its hostname if routing is
+	// disabled.
+	Node string `json:"node"`
+
+	// Connections is the number of live WebSocket and MQTT connections.
+	Connections int `json:"connections"`
+
+	// Clients is the number of devices that completed the handshake.
+	Clients int `json:"clients"`
+
+	// Error is set if the node could not be queried.
+	Error string `json:"error,omitempty"`
+}
+
+// ClusterConnections sums the connection counts of every node returned by
+// the locator, including the current node.
+type ClusterConnections struct {
+	Connections int                `json:"connections"`
+	Clients     int                `json:"clients"`
+	Unreachable int                `json:"unreachable"`
+	Nodes       []*NodeConnections `json:"nodes"`
+}
+
+// nodeConnections returns the connection count of the current node.
+func (self *Handler) nodeConnections() *NodeConnections {
+	node := self.app.Hostname()
+	if self.router != nil && len(self.router.URL()) > 0 {
+		node = self.router.URL()
+	}
+	return &NodeConnections{
+		Node:        node,
+		Connections: self.app.ConnectionCount(),
+		Clients:     self.app.ClientCount(),
+	}
+}
+
+// ClusterConnections queries the connection counts of every peer, and adds
+// them to the count of the current node, local. Unreachable peers are
+// listed with an error, and are not included in the totals.
+func (r *Router) ClusterConnections(local *NodeConnections) (
+	cluster *ClusterConnections, err error) {
+
+	cluster = &ClusterConnections{
+		Connections: local.Connections,
+		Clients:     local.Clients,
+		Nodes:       []*NodeConnections{local},
+	}
+	locator := r.Locator()
+	if locator == nil {
+		return cluster, nil
+	}
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		return nil, err
+	}
+	client := r.HTTPClient(r.rwtimeout)
+	nodes := make([]*NodeConnections, len(contacts))
+	var wg sync.WaitGroup
+	for i, contact := range contacts {
+		wg.Add(1)
+		go func(i int, contact string) {
+			defer wg.Done()
+			node, err := fetchConnections(r, client, contact)
+			if err != nil {
+				node = &NodeConnections{Node: contact, Error: err.Error()}
+			}
+			node.Node = contact
+			nodes[i] = node
+		}(i, contact)
+	}
+	wg.Wait()
+	for _, node := range nodes {
+		if node.Node == local.Node {
+			continue
+		}
+		if len(node.Error) > 0 {
+			cluster.Unreachable++
+			r.metrics.Increment("router.connections.error")
+		} else {
+			cluster.Connections += node.Connections
+			cluster.Clients += node.Clients
+		}
+		cluster.Nodes = append(cluster.Nodes, node)
+	}
+	return cluster, nil
+}
+
+func fetchConnections(router *Router, client *http.Client, contact string) (
+	node *NodeConnections, err error) {
+
+	req, err := router.NewPeerRequest("GET", contact+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected connections response: %s", resp.Status)
+	}
+	node = new(NodeConnections)
+	if err = json.NewDecoder(resp.Body).Decode(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// NodeConnectionsHandler returns the connection count of this node. Peers
+// query it to compute cluster-wide totals.
+func (self *Handler) NodeConnectionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.nodeConnections())
+}
+
+// ConnectionCountsHandler reports the number of live connections on this
+// node. If the `cluster` query parameter is "true", the counts of every
+// node known to the locator are queried and summed, for capacity planning.
+func (self *Handler) ConnectionCountsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	local := self.nodeConnections()
+	cluster, _ := strconv.ParseBool(req.FormValue("cluster"))
+	if !cluster || self.router == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(local)
+		return
+	}
+	reply, err := self.router.ClusterConnections(local)
+	if err != nil {
+		if self.logger.ShouldLog(ERROR) {
+			self.logger.Error("handler", "Could not list cluster nodes",
+				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+		}
+		http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
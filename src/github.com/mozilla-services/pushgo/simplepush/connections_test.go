@@ -0,0 +1,65 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClusterConnections(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/connections" {
+				http.NotFound(resp, req)
+				return
+			}
+			resp.Write([]byte(`{"node":"peer","connections":5,"clients":4}`))
+		}))
+	defer peer.Close()
+
+	handler, app := newTestHandler(t)
+	app.ConnectionOpened()
+	app.ConnectionOpened()
+	app.ConnectionClosed()
+	defer app.ConnectionClosed()
+	if n := app.ConnectionCount(); n != 1 {
+		t.Errorf("Wrong connection count: got %d; want 1", n)
+	}
+	handler.router.SetLocator(&StaticLocator{
+		contacts: []string{peer.URL, "http://127.0.0.1:1"}})
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/connection-counts?cluster=true", nil)
+	handler.ConnectionCountsHandler(resp, req)
+	reply := new(ClusterConnections)
+	if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+		t.Fatalf("Error decoding connection counts: %s", err)
+	}
+	if reply.Connections != 6 || reply.Clients != 4 {
+		t.Errorf("Wrong cluster totals: got %d connections, %d clients; want 6, 4",
+			reply.Connections, reply.Clients)
+	}
+	if reply.Unreachable != 1 || len(reply.Nodes) != 3 {
+		t.Errorf("Wrong nodes: %#v", reply.Nodes)
+	}
+	if reply.Nodes[1].Node != peer.URL {
+		t.Errorf("Wrong peer URL: got %q; want %q", reply.Nodes[1].Node, peer.URL)
+	}
+
+	// Without the cluster flag, only this node is counted.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/connection-counts", nil)
+	handler.ConnectionCountsHandler(resp, req)
+	node := new(NodeConnections)
+	if err := json.Unmarshal(resp.Body.Bytes(), node); err != nil {
+		t.Fatalf("Error decoding connection count: %s", err)
+	}
+	if node.Connections != 1 {
+		t.Errorf("Wrong node count: got %d; want 1", node.Connections)
+	}
+}
@@ -0,0 +1,87 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// updatePathPrefix precedes the token in push endpoint URLs.
+const updatePathPrefix = "/update/"
+
+// EndpointToken describes the channel addressed by a push endpoint.
+type EndpointToken struct {
+	PK        string `json:"pk"`
+	UAID      string `json:"uaid,omitempty"`
+	ChannelID string `json:"channelID"`
+
+	// Bridge indicates a bridge-preferred channel.
+	Bridge bool `json:"bridge,omitempty"`
+
+	// Shared indicates a shared channel, addressing every member device.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// LoadTokenKeyring reads the endpoint token keys from the base config file
+// and its overlays, without loading the rest of the application.
+func LoadTokenKeyring(filenames ...string) (*TokenKeyring, error) {
+	layers, err := LoadConfigLayers(filenames...)
+	if err != nil {
+		return nil, err
+	}
+	env := envconf.Load()
+	secrets, err := LoadSecrets(layers.Config, env)
+	if err != nil {
+		return nil, err
+	}
+	conf := new(Application).ConfigStruct().(*ApplicationConfig)
+	if section, ok := layers.Config["default"]; ok {
+		if err = toml.PrimitiveDecode(section, conf); err != nil {
+			return nil, fmt.Errorf("Unable to decode config for section 'default': %s", err)
+		}
+	}
+	if err = env.Decode(toEnvName("default"), EnvSep, conf); err != nil {
+		return nil, fmt.Errorf("Invalid environment variable for section 'default': %s", err)
+	}
+	if err = secrets.Resolve("default", conf); err != nil {
+		return nil, fmt.Errorf("Unable to load secrets for section 'default': %s", err)
+	}
+	_, tokens, err := conf.TokenKeyring()
+	return tokens, err
+}
+
+// DecodeEndpoint returns the channel addressed by a push endpoint URL, or by
+// a bare endpoint token.
+func DecodeEndpoint(tokens *TokenKeyring, endpoint string) (*EndpointToken, error) {
+	token := endpoint
+	if i := strings.LastIndex(endpoint, updatePathPrefix); i >= 0 {
+		token = endpoint[i+len(updatePathPrefix):]
+	}
+	bpk, err := tokens.Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	pk := string(bpk)
+	if !validPK(pk) {
+		return nil, ErrInvalidToken
+	}
+	decoded := &EndpointToken{PK: pk}
+	pk, decoded.Bridge = BridgeKeyToKey(pk)
+	if chid, ok := GroupKeyToID(pk); ok {
+		decoded.ChannelID, decoded.Shared = chid, true
+		return decoded, nil
+	}
+	// Both storage backends use "uaid.chid" primary keys.
+	items := strings.SplitN(pk, ".", 2)
+	if len(items) < 2 {
+		return nil, ErrInvalidToken
+	}
+	decoded.UAID, decoded.ChannelID = items[0], items[1]
+	return decoded, nil
+}
@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeEndpoint(t *testing.T) {
+	tokens := NewTokenKeyring(nil)
+	if err := tokens.AddKey(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Error adding token key: %s", err)
+	}
+	if err := tokens.SetCurrent(1); err != nil {
+		t.Fatalf("Error setting current key: %s", err)
+	}
+	tests := []struct {
+		pk     string
+		uaid   string
+		chid   string
+		bridge bool
+		shared bool
+	}{
+		{"deadbeef.cafe", "deadbeef", "cafe", false, false},
+		{BridgeKey("deadbeef.cafe"), "deadbeef", "cafe", true, false},
+		{GroupKey("cafe"), "", "cafe", false, true},
+	}
+	for _, test := range tests {
+		token, err := tokens.Encode(test.pk)
+		if err != nil {
+			t.Fatalf("Error encoding %q: %s", test.pk, err)
+		}
+		decoded, err := DecodeEndpoint(tokens, "https://push.example.com/update/"+token)
+		if err != nil {
+			t.Errorf("Error decoding %q: %s", test.pk, err)
+			continue
+		}
+		if decoded.PK != test.pk || decoded.UAID != test.uaid ||
+			decoded.ChannelID != test.chid || decoded.Bridge != test.bridge ||
+			decoded.Shared != test.shared {
+
+			t.Errorf("Wrong decoded token for %q: %#v", test.pk, decoded)
+		}
+	}
+	if _, err := DecodeEndpoint(tokens, "/update/garbage"); err == nil {
+		t.Errorf("Decoded an invalid token")
+	}
+}
+
+func TestAdminDrainHandler(t *testing.T) {
+	handler, app := newTestHandler(t)
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/drain", nil)
+	handler.AdminDrainHandler(resp, req)
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wrong status for GET: got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/drain", nil)
+	handler.AdminDrainHandler(resp, req)
+	if resp.Code != http.StatusAccepted {
+		t.Errorf("Wrong status for POST: got %d", resp.Code)
+	}
+	select {
+	case <-app.DrainRequests():
+	default:
+		t.Errorf("Drain not requested")
+	}
+}
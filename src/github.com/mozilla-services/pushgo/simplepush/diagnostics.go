@@ -0,0 +1,112 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleDebug registers the runtime profiling and diagnostics handlers on an
+// admin router:
+//
+//	/debug/pprof/ lists the available profiles; e.g., heap, block, and
+//	goroutine. /debug/pprof/goroutine?debug=2 dumps the stacks of all
+//	goroutines.
+//	/debug/pprof/profile?seconds=N records a CPU profile.
+//	/debug/pprof/trace?seconds=N records an execution trace.
+//	/debug/vars reports expvar variables, including memory statistics.
+//
+// The handlers are never registered on the public listeners.
+func HandleDebug(m *mux.Router) {
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	m.Handle("/debug/vars", expvar.Handler())
+}
+
+// ConnectionState is a snapshot of a client connection, for debugging.
+type ConnectionState struct {
+	UAID        string    `json:"uaid"`
+	ID          string    `json:"id,omitempty"`
+	Transport   string    `json:"transport"`
+	RemoteAddr  string    `json:"remoteAddr,omitempty"`
+	Born        time.Time `json:"born"`
+	LastRecv    time.Time `json:"lastRecv,omitempty"`
+	MissedPongs int32     `json:"missedPongs,omitempty"`
+	Unacked     int       `json:"unacked"`
+	Closed      bool      `json:"closed"`
+}
+
+// connectionReporter is implemented by workers that report the state of
+// their connections.
+type connectionReporter interface {
+	ReportState(state *ConnectionState)
+}
+
+// ConnectionState returns a snapshot of the client's connection.
+func (c *Client) ConnectionState() *ConnectionState {
+	state := &ConnectionState{UAID: c.UAID, Transport: "unknown"}
+	if sock := c.PushWS; sock != nil {
+		state.Born = sock.Born
+		state.Closed = sock.IsClosed()
+		if sock.Socket != nil {
+			if req := sock.Socket.Request(); req != nil {
+				state.RemoteAddr = req.RemoteAddr
+			}
+		}
+	}
+	if reporter, ok := c.Worker.(connectionReporter); ok {
+		reporter.ReportState(state)
+	}
+	return state
+}
+
+// ReportState reports the worker's view of its WebSocket connection.
+func (self *WorkerWS) ReportState(state *ConnectionState) {
+	state.ID = self.id
+	state.Transport = "websocket"
+	if lastRecv := atomic.LoadInt64(&self.lastRecv); lastRecv > 0 {
+		state.LastRecv = time.Unix(0, lastRecv)
+	}
+	state.MissedPongs = atomic.LoadInt32(&self.missedPongs)
+	self.inFlightLock.Lock()
+	state.Unacked = len(self.inFlight)
+	self.inFlightLock.Unlock()
+}
+
+// ReportState reports the worker's view of its MQTT connection.
+func (self *MQTTWorker) ReportState(state *ConnectionState) {
+	state.ID = self.id
+	state.Transport = "mqtt"
+	state.RemoteAddr = self.conn.RemoteAddr().String()
+	self.pendingLock.Lock()
+	state.Unacked = len(self.pending)
+	self.pendingLock.Unlock()
+}
+
+// ConnectionsHandler dumps the state of every client connected to this
+// node, as one JSON object per line.
+func (self *Handler) ConnectionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(resp)
+	for _, client := range self.app.Clients() {
+		if err := encoder.Encode(client.ConnectionState()); err != nil {
+			return
+		}
+	}
+}
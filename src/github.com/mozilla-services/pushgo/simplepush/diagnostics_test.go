@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestConnectionsHandler(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	handler, app := newTestHandler(t)
+	worker := NewWorker(app, "rid")
+	worker.inFlight = map[string]Update{"chid": {"chid", 1, ""}}
+	born := time.Now().Add(-time.Minute).UTC()
+	app.AddClient(uaid, &Client{
+		Worker: worker,
+		PushWS: &PushWS{Born: born},
+		UAID:   uaid,
+	})
+	defer app.RemoveClient(uaid)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/connections", nil)
+	handler.ConnectionsHandler(resp, req)
+	state := new(ConnectionState)
+	if err := json.Unmarshal(resp.Body.Bytes(), state); err != nil {
+		t.Fatalf("Error decoding connection state: %s", err)
+	}
+	if state.UAID != uaid || state.ID != "rid" || state.Transport != "websocket" {
+		t.Errorf("Wrong connection state: %#v", state)
+	}
+	if !state.Born.Equal(born) || state.Unacked != 1 || state.Closed {
+		t.Errorf("Wrong connection state: %#v", state)
+	}
+}
+
+func TestHandleDebug(t *testing.T) {
+	m := mux.NewRouter()
+	HandleDebug(m)
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/goroutine?debug=2"} {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		m.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("Wrong status for %s: got %d", path, resp.Code)
+		}
+	}
+}
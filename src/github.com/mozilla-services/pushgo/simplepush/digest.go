@@ -0,0 +1,359 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DigestConfig struct {
+	// Sink selects where digests are sent: "webhook" or "smtp". Digests are
+	// disabled if no sink is set.
+	Sink string `env:"sink"`
+
+	// Threshold is how long a device must have had pending updates without
+	// connecting before a digest is sent. Defaults to 24 hours.
+	Threshold string `env:"threshold"`
+
+	// Interval is the amount of time to wait between checks for long-offline
+	// devices. Defaults to 5 minutes.
+	Interval string `env:"interval"`
+
+	// MaxSize is the maximum number of offline devices tracked. Defaults to
+	// 100000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// URL receives digests as JSON POSTs for the "webhook" sink. If Secret
+	// is set, digests are signed as in the webhook pinger.
+	URL    string `env:"url"`
+	Secret string `env:"secret"`
+
+	// Timeout is the maximum time to wait for the webhook to respond.
+	// Defaults to 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// SMTPAddr, From, and To configure the "smtp" sink. Username and
+	// Password enable PLAIN authentication.
+	SMTPAddr string   `toml:"smtp_addr" env:"smtp_addr"`
+	From     string   `env:"from"`
+	To       []string `env:"to"`
+	Username string   `env:"username"`
+	Password string   `env:"password"`
+}
+
+// DigestEvent summarizes the updates pending for a long-offline device, so
+// that the product can nudge the user through another channel.
+type DigestEvent struct {
+	Type         string   `json:"type"`
+	UAID         string   `json:"uaid"`
+	OfflineSince int64    `json:"offline_since"`
+	Pending      int      `json:"pending"`
+	Channels     []string `json:"channels"`
+	Node         string   `json:"node"`
+	Time         int64    `json:"time"`
+}
+
+type digestEntry struct {
+	since    time.Time // First update accepted while the device was offline.
+	notified bool
+}
+
+// OfflineDigest watches for devices that have not connected for a while
+// despite pending updates, and sends a digest of those updates to a webhook
+// or mailbox. Devices are tracked from the first update accepted by this
+// node while they are not connected to it; pending updates are confirmed
+// with the store before each digest. At most one digest is sent per device
+// until it reconnects.
+type OfflineDigest struct {
+	app       *Application
+	logger    *SimpleLogger
+	metrics   Statistician
+	node      string
+	sink      string
+	threshold time.Duration
+	interval  time.Duration
+	maxSize   int
+	url       string
+	secret    []byte
+	client    *http.Client
+	smtpAddr  string
+	smtpAuth  smtp.Auth
+	from      string
+	to        []string
+
+	lock    sync.Mutex
+	offline map[string]*digestEntry
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewOfflineDigest() *OfflineDigest {
+	return &OfflineDigest{
+		offline:     make(map[string]*digestEntry),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*OfflineDigest) ConfigStruct() interface{} {
+	return &DigestConfig{
+		Threshold: "24h",
+		Interval:  "5m",
+		MaxSize:   100000,
+		Timeout:   "10s",
+	}
+}
+
+func (d *OfflineDigest) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*DigestConfig)
+	d.app = app
+	d.logger = app.Logger()
+	d.metrics = app.Metrics()
+	if d.sink = conf.Sink; len(d.sink) == 0 {
+		return nil
+	}
+	d.node = app.Hostname()
+	d.maxSize = conf.MaxSize
+
+	if d.threshold, err = time.ParseDuration(conf.Threshold); err != nil {
+		d.logger.Panic("digest", "Could not parse offline threshold",
+			LogFields{"error": err.Error(), "threshold": conf.Threshold})
+		return err
+	}
+	if d.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		d.logger.Panic("digest", "Could not parse check interval",
+			LogFields{"error": err.Error(), "interval": conf.Interval})
+		return err
+	}
+	switch d.sink {
+	case "webhook":
+		if _, err = url.ParseRequestURI(conf.URL); err != nil {
+			d.logger.Panic("digest", "Invalid digest webhook URL",
+				LogFields{"error": err.Error(), "url": conf.URL})
+			return err
+		}
+		timeout, err := time.ParseDuration(conf.Timeout)
+		if err != nil {
+			d.logger.Panic("digest", "Could not parse webhook timeout",
+				LogFields{"error": err.Error(), "timeout": conf.Timeout})
+			return err
+		}
+		d.url = conf.URL
+		d.secret = []byte(conf.Secret)
+		d.client = &http.Client{Timeout: timeout}
+
+	case "smtp":
+		if len(conf.SMTPAddr) == 0 || len(conf.From) == 0 || len(conf.To) == 0 {
+			d.logger.Panic("digest",
+				"SMTP digests require an address, sender, and recipients", nil)
+			return ConfigurationErr
+		}
+		d.smtpAddr, d.from, d.to = conf.SMTPAddr, conf.From, conf.To
+		if len(conf.Username) > 0 {
+			host := d.smtpAddr
+			if i := strings.LastIndex(host, ":"); i >= 0 {
+				host = host[:i]
+			}
+			d.smtpAuth = smtp.PlainAuth("", conf.Username, conf.Password, host)
+		}
+
+	default:
+		d.logger.Panic("digest", "Unknown digest sink",
+			LogFields{"sink": d.sink})
+		return ConfigurationErr
+	}
+
+	events := app.Events()
+	events.Subscribe(EventUpdateAccepted, d.updateAccepted)
+	events.Subscribe(EventClientConnected, d.seen)
+	events.Subscribe(EventUpdateAcked, d.seen)
+	d.closeWait.Add(1)
+	go d.run()
+	return nil
+}
+
+// Enabled indicates whether digests are sent.
+func (d *OfflineDigest) Enabled() bool {
+	return len(d.sink) > 0
+}
+
+// updateAccepted starts tracking a device that is not connected to this
+// node. Called from the event bus, so it must not block.
+func (d *OfflineDigest) updateAccepted(event *Event) {
+	if _, ok := d.app.GetClient(event.UAID); ok {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.offline[event.UAID]; ok {
+		return
+	}
+	if len(d.offline) >= d.maxSize {
+		d.metrics.Increment("digest.dropped")
+		return
+	}
+	d.offline[event.UAID] = &digestEntry{since: event.Time}
+}
+
+// seen stops tracking a device that connected or acknowledged an update.
+func (d *OfflineDigest) seen(event *Event) {
+	d.lock.Lock()
+	delete(d.offline, event.UAID)
+	d.lock.Unlock()
+}
+
+func (d *OfflineDigest) run() {
+	defer d.closeWait.Done()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeSignal:
+			return
+		case now := <-ticker.C:
+			d.check(now)
+		}
+	}
+}
+
+// check sends digests for devices offline longer than the threshold.
+func (d *OfflineDigest) check(now time.Time) {
+	due := make(map[string]time.Time)
+	d.lock.Lock()
+	for uaid, entry := range d.offline {
+		if !entry.notified && now.Sub(entry.since) >= d.threshold {
+			due[uaid] = entry.since
+		}
+	}
+	d.lock.Unlock()
+	for uaid, since := range due {
+		d.notify(uaid, since)
+	}
+}
+
+// notify confirms that a device still has pending updates, and sends its
+// digest. Failed digests are retried on the next check.
+func (d *OfflineDigest) notify(uaid string, since time.Time) {
+	if _, ok := d.app.GetClient(uaid); ok {
+		d.seen(&Event{UAID: uaid})
+		return
+	}
+	updates, _, err := d.app.Store().FetchAll(uaid, time.Time{})
+	if err != nil {
+		if d.logger.ShouldLog(WARNING) {
+			d.logger.Warn("digest", "Could not fetch pending updates",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return
+	}
+	if len(updates) == 0 {
+		d.seen(&Event{UAID: uaid})
+		return
+	}
+	channels := make([]string, len(updates))
+	for i, update := range updates {
+		channels[i] = update.ChannelID
+	}
+	sort.Strings(channels)
+	digest := &DigestEvent{
+		Type:         "offline.digest",
+		UAID:         uaid,
+		OfflineSince: since.Unix(),
+		Pending:      len(updates),
+		Channels:     channels,
+		Node:         d.node,
+		Time:         time.Now().Unix(),
+	}
+	if d.sink == "smtp" {
+		err = d.sendMail(digest)
+	} else {
+		err = d.post(digest)
+	}
+	if err != nil {
+		if d.logger.ShouldLog(WARNING) {
+			d.logger.Warn("digest", "Could not send offline digest",
+				LogFields{"error": err.Error(), "uaid": uaid, "sink": d.sink})
+		}
+		d.metrics.Increment("digest.error")
+		return
+	}
+	d.lock.Lock()
+	if entry, ok := d.offline[uaid]; ok {
+		entry.notified = true
+	}
+	d.lock.Unlock()
+	d.metrics.Increment("digest.sent")
+}
+
+// post sends a digest to the webhook sink.
+func (d *OfflineDigest) post(digest *DigestEvent) error {
+	body, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(d.secret) > 0 {
+		ts := time.Now().Unix()
+		req.Header.Set(HeaderWebhookSignature, fmt.Sprintf("ts=%d,sig=%s", ts,
+			base64.RawURLEncoding.EncodeToString(webhookMAC(d.secret, ts,
+				req.URL.EscapedPath(), body))))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendMail sends a digest to the SMTP sink. The body is the JSON digest, so
+// that mailbox processors can parse it.
+func (d *OfflineDigest) sendMail(digest *DigestEvent) error {
+	body, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return err
+	}
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", d.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(d.to, ", "))
+	fmt.Fprintf(msg, "Subject: %d pending updates for %s\r\n", digest.Pending,
+		digest.UAID)
+	fmt.Fprintf(msg, "Content-Type: application/json\r\n\r\n")
+	msg.Write(body)
+	msg.WriteString("\r\n")
+	return smtp.SendMail(d.smtpAddr, d.smtpAuth, d.from, d.to, msg.Bytes())
+}
+
+func (d *OfflineDigest) Close() error {
+	if !d.Enabled() {
+		return nil
+	}
+	d.closeOnce.Do(func() {
+		close(d.closeSignal)
+		d.closeWait.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type digestTestStore struct {
+	*NoStore
+	updates map[string][]Update
+}
+
+func (s *digestTestStore) FetchAll(uaid string, since time.Time) ([]Update, []string, error) {
+	return s.updates[uaid], nil, nil
+}
+
+func Test_OfflineDigest(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		digests []*DigestEvent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if _, err := VerifyWebhookSignature([]byte("secret"),
+			req.Header.Get(HeaderWebhookSignature), req.URL.EscapedPath(), body); err != nil {
+			t.Errorf("Error verifying digest signature: %s", err)
+		}
+		digest := new(DigestEvent)
+		if err := json.Unmarshal(body, digest); err != nil {
+			t.Errorf("Error decoding digest: %s", err)
+		}
+		digests = append(digests, digest)
+	}))
+	defer srv.Close()
+
+	_, app := newTestHandler(t)
+	app.SetStore(&digestTestStore{
+		NoStore: app.Store().(*NoStore),
+		updates: map[string][]Update{
+			"offline": {{ChannelID: "b", Version: 2}, {ChannelID: "a", Version: 1}},
+		},
+	})
+	digest := NewOfflineDigest()
+	conf := digest.ConfigStruct().(*DigestConfig)
+	conf.Sink = "webhook"
+	conf.URL = srv.URL + "/digest"
+	conf.Secret = "secret"
+	conf.Threshold = "1h"
+	conf.Interval = "1h"
+	if err := digest.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing digest: %s", err)
+	}
+	defer digest.Close()
+
+	start := time.Now()
+	events := app.Events()
+	for _, uaid := range []string{"offline", "acked", "empty"} {
+		events.Publish(&Event{Type: EventUpdateAccepted, UAID: uaid, Time: start})
+	}
+	events.Publish(&Event{Type: EventUpdateAcked, UAID: "acked"})
+
+	// Devices are not reported before the threshold.
+	digest.check(start.Add(30 * time.Minute))
+	lock.Lock()
+	if len(digests) != 0 {
+		t.Errorf("Digest sent before threshold: %+v", digests)
+	}
+	lock.Unlock()
+
+	// Only devices with pending updates are reported, and only once.
+	digest.check(start.Add(2 * time.Hour))
+	digest.check(start.Add(3 * time.Hour))
+	lock.Lock()
+	defer lock.Unlock()
+	if len(digests) != 1 {
+		t.Fatalf("Wrong digest count: got %d; want 1", len(digests))
+	}
+	if d := digests[0]; d.UAID != "offline" || d.Pending != 2 ||
+		len(d.Channels) != 2 || d.Channels[0] != "a" || d.OfflineSince != start.Unix() {
+		t.Errorf("Wrong digest: %+v", d)
+	}
+}
@@ -0,0 +1,273 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoContacts = errors.New("Discovery returned no contacts")
+
+// DiscoveryConf configures the periodic refresh and health probing shared
+// by the DNS SRV, static, and EC2 locators.
+type DiscoveryConf struct {
+	// RefreshInterval is the amount of time to wait between contact list
+	// refreshes. Ignored by the static locator.
+	RefreshInterval string `toml:"refresh_interval" env:"refresh_interval"`
+
+	// ProbeInterval is the amount of time to wait between health probes.
+	// Contacts are probed with a GET request to the router's /status/
+	// endpoint. Set to "0" to disable probing.
+	ProbeInterval string `toml:"probe_interval" env:"probe_interval"`
+
+	// ProbeTimeout is the maximum amount of time to wait for a probe.
+	ProbeTimeout string `toml:"probe_timeout" env:"probe_timeout"`
+
+	// MaxFailures is the number of consecutive failed probes before a
+	// contact is excluded from the list. Contacts are restored once a probe
+	// succeeds.
+	MaxFailures int `toml:"max_failures" env:"max_failures"`
+}
+
+// contactPool maintains a list of peer routing URLs, refreshed from a
+// discovery source and filtered by health probes.
+type contactPool struct {
+	logger          *SimpleLogger
+	metrics         Statistician
+	name            string
+	self            string
+	fetch           func() ([]string, error)
+	client          *http.Client
+	refreshInterval time.Duration
+	probeInterval   time.Duration
+	maxFailures     int
+	lock            sync.RWMutex
+	contacts        []string
+	failures        map[string]int
+	lastErr         error
+	closeSignal     chan bool
+	closeWait       sync.WaitGroup
+	closeOnce       sync.Once
+}
+
+// newContactPool creates a pool that fetches contacts with fetch. The
+// routing URL of the current node, self, is excluded from the list.
+func newContactPool(app *Application, name string, conf *DiscoveryConf,
+	fetch func() ([]string, error)) (p *contactPool, err error) {
+
+	p = &contactPool{
+		logger:      app.Logger(),
+		metrics:     app.Metrics(),
+		name:        name,
+		fetch:       fetch,
+		maxFailures: conf.MaxFailures,
+		failures:    make(map[string]int),
+		closeSignal: make(chan bool),
+	}
+	if router := app.Router(); router != nil {
+		p.self = router.URL()
+	}
+	if len(conf.RefreshInterval) > 0 {
+		if p.refreshInterval, err = time.ParseDuration(conf.RefreshInterval); err != nil {
+			p.logger.Panic(name, "Could not parse refresh interval", LogFields{
+				"error": err.Error(), "interval": conf.RefreshInterval})
+			return nil, err
+		}
+	}
+	if p.probeInterval, err = time.ParseDuration(conf.ProbeInterval); err != nil {
+		p.logger.Panic(name, "Could not parse probe interval", LogFields{
+			"error": err.Error(), "interval": conf.ProbeInterval})
+		return nil, err
+	}
+	probeTimeout, err := time.ParseDuration(conf.ProbeTimeout)
+	if err != nil {
+		p.logger.Panic(name, "Could not parse probe timeout", LogFields{
+			"error": err.Error(), "timeout": conf.ProbeTimeout})
+		return nil, err
+	}
+	p.client = &http.Client{Timeout: probeTimeout}
+	return p, nil
+}
+
+// Start fetches the initial contact list, and starts the refresh and probe
+// loops.
+func (p *contactPool) Start() error {
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	if p.refreshInterval > 0 {
+		p.closeWait.Add(1)
+		go p.loop(p.refreshInterval, func() { p.refresh() })
+	}
+	if p.probeInterval > 0 {
+		p.closeWait.Add(1)
+		go p.loop(p.probeInterval, p.probe)
+	}
+	return nil
+}
+
+// Contacts returns a shuffled list of healthy contacts.
+func (p *contactPool) Contacts() (contacts []string, err error) {
+	p.lock.RLock()
+	contacts = make([]string, 0, len(p.contacts))
+	for _, contact := range p.contacts {
+		if p.maxFailures > 0 && p.failures[contact] >= p.maxFailures {
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	if len(p.contacts) == 0 {
+		err = p.lastErr
+	}
+	p.lock.RUnlock()
+	for length := len(contacts); length > 0; {
+		i := rand.Intn(length)
+		length--
+		contacts[i], contacts[length] = contacts[length], contacts[i]
+	}
+	return contacts, err
+}
+
+// Status returns the result of the last refresh.
+func (p *contactPool) Status() (bool, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.lastErr != nil {
+		return false, p.lastErr
+	}
+	return true, nil
+}
+
+// Close stops the refresh and probe loops.
+func (p *contactPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeSignal)
+		p.closeWait.Wait()
+	})
+	return nil
+}
+
+func (p *contactPool) loop(interval time.Duration, f func()) {
+	defer p.closeWait.Done()
+	ticker := time.NewTicker(interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-p.closeSignal:
+		case <-ticker.C:
+			f()
+		}
+	}
+	ticker.Stop()
+}
+
+// refresh replaces the contact list. On error, the previous list is kept.
+func (p *contactPool) refresh() error {
+	fetched, err := p.fetch()
+	if err == nil && len(fetched) == 0 {
+		err = ErrNoContacts
+	}
+	if err != nil {
+		if p.logger.ShouldLog(ERROR) {
+			p.logger.Error(p.name, "Could not refresh contact list",
+				LogFields{"error": err.Error()})
+		}
+		p.metrics.Increment("locator." + p.name + ".refresh.error")
+		p.lock.Lock()
+		p.lastErr = err
+		p.lock.Unlock()
+		return err
+	}
+	contacts := make([]string, 0, len(fetched))
+	for _, contact := range fetched {
+		if contact == p.self || len(contact) == 0 {
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	p.lock.Lock()
+	failures := make(map[string]int, len(contacts))
+	for _, contact := range contacts {
+		failures[contact] = p.failures[contact]
+	}
+	p.contacts, p.failures, p.lastErr = contacts, failures, nil
+	p.lock.Unlock()
+	p.metrics.Gauge("locator."+p.name+".contacts", int64(len(contacts)))
+	if p.logger.ShouldLog(DEBUG) {
+		p.logger.Debug(p.name, "Refreshed contact list",
+			LogFields{"contacts": strings.Join(contacts, ",")})
+	}
+	return nil
+}
+
+// probe checks the health of each contact concurrently.
+func (p *contactPool) probe() {
+	p.lock.RLock()
+	contacts := make([]string, len(p.contacts))
+	copy(contacts, p.contacts)
+	p.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	results := make([]bool, len(contacts))
+	for i, contact := range contacts {
+		wg.Add(1)
+		go func(i int, contact string) {
+			defer wg.Done()
+			results[i] = p.probeContact(contact)
+		}(i, contact)
+	}
+	wg.Wait()
+
+	healthy := 0
+	p.lock.Lock()
+	for i, contact := range contacts {
+		failures, ok := p.failures[contact]
+		if !ok {
+			// Removed by a concurrent refresh.
+			continue
+		}
+		if results[i] {
+			if p.maxFailures > 0 && failures >= p.maxFailures && p.logger.ShouldLog(INFO) {
+				p.logger.Info(p.name, "Contact recovered",
+					LogFields{"contact": contact})
+			}
+			p.failures[contact] = 0
+			healthy++
+			continue
+		}
+		failures++
+		p.failures[contact] = failures
+		if failures == p.maxFailures && p.logger.ShouldLog(WARNING) {
+			p.logger.Warn(p.name, "Excluding unhealthy contact",
+				LogFields{"contact": contact})
+		}
+		if p.maxFailures <= 0 || failures < p.maxFailures {
+			healthy++
+		}
+	}
+	p.lock.Unlock()
+	p.metrics.Gauge("locator."+p.name+".healthy", int64(healthy))
+}
+
+func (p *contactPool) probeContact(contact string) bool {
+	resp, err := p.client.Get(contact + "/status/")
+	if err != nil {
+		p.metrics.Increment("locator." + p.name + ".probe.error")
+		return false
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		p.metrics.Increment("locator." + p.name + ".probe.error")
+		return false
+	}
+	return true
+}
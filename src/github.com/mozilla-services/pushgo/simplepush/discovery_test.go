@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// The "get-vanilla" case from the AWS Signature Version 4 test suite.
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	creds := &AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	SignAWSRequest(req, creds, "us-east-1", "service", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("Wrong signature: got %q; want %q", actual, expected)
+	}
+}
+
+func TestDNSLocator(t *testing.T) {
+	var healthy int32 = 1
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/status/" {
+				t.Errorf("Wrong probe path: %s", req.URL.Path)
+			}
+			if atomic.LoadInt32(&healthy) == 0 {
+				http.Error(resp, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			resp.Write([]byte(`{"status":"OK"}`))
+		}))
+	defer peer.Close()
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(peer.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+
+	_, app := newTestHandler(t)
+	locator := new(DNSLocator)
+	locator.lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_pushgo._tcp.example.com" {
+			t.Errorf("Wrong SRV name: %s", name)
+		}
+		return "", []*net.SRV{
+			{Target: host + ".", Port: uint16(port)},
+			{Target: "gone.invalid.", Port: 3000},
+		}, nil
+	}
+	conf := locator.ConfigStruct().(*DNSLocatorConf)
+	conf.Name = "_pushgo._tcp.example.com"
+	conf.RefreshInterval = "1h"
+	conf.ProbeInterval = "1h"
+	conf.MaxFailures = 1
+	if err := locator.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing locator: %s", err)
+	}
+	defer locator.Close()
+
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		t.Fatalf("Error fetching contacts: %s", err)
+	}
+	sort.Strings(contacts)
+	expected := []string{peer.URL, "http://gone.invalid:3000"}
+	if len(contacts) != 2 || contacts[0] != expected[0] || contacts[1] != expected[1] {
+		t.Errorf("Wrong contacts: got %#v; want %#v", contacts, expected)
+	}
+
+	// Unreachable contacts are excluded after a failed probe.
+	locator.pool.probe()
+	contacts, _ = locator.Contacts("")
+	if len(contacts) != 1 || contacts[0] != peer.URL {
+		t.Errorf("Expected unreachable contact to be excluded: got %#v", contacts)
+	}
+	atomic.StoreInt32(&healthy, 0)
+	locator.pool.probe()
+	if contacts, _ = locator.Contacts(""); len(contacts) != 0 {
+		t.Errorf("Expected unhealthy contact to be excluded: got %#v", contacts)
+	}
+	atomic.StoreInt32(&healthy, 1)
+	locator.pool.probe()
+	if contacts, _ = locator.Contacts(""); len(contacts) != 1 {
+		t.Errorf("Expected contact to recover: got %#v", contacts)
+	}
+}
+
+func TestEC2Locator(t *testing.T) {
+	var requests int32
+	api := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			query := req.URL.Query()
+			if query.Get("Action") != "DescribeInstances" ||
+				query.Get("Filter.1.Name") != "tag:role" ||
+				query.Get("Filter.1.Value.1") != "pushgo" {
+				t.Errorf("Wrong query: %s", req.URL.RawQuery)
+			}
+			auth := req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+				!strings.Contains(auth, "/us-west-2/ec2/aws4_request") {
+				t.Errorf("Wrong authorization header: %s", auth)
+			}
+			if query.Get("NextToken") == "" {
+				resp.Write([]byte(`<DescribeInstancesResponse>
+  <reservationSet><item><instancesSet>
+    <item><privateIpAddress>10.0.0.1</privateIpAddress></item>
+    <item><privateIpAddress>10.0.0.2</privateIpAddress></item>
+  </instancesSet></item></reservationSet>
+  <nextToken>page2</nextToken>
+</DescribeInstancesResponse>`))
+				return
+			}
+			resp.Write([]byte(`<DescribeInstancesResponse>
+  <reservationSet><item><instancesSet>
+    <item><privateIpAddress>10.0.0.3</privateIpAddress></item>
+  </instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`))
+		}))
+	defer api.Close()
+
+	_, app := newTestHandler(t)
+	locator := new(EC2Locator)
+	locator.credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	}
+	conf := locator.ConfigStruct().(*EC2LocatorConf)
+	conf.TagValue = "pushgo"
+	conf.Region = "us-west-2"
+	conf.Endpoint = api.URL
+	conf.RefreshInterval = "1h"
+	conf.ProbeInterval = "0"
+	if err := locator.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing locator: %s", err)
+	}
+	defer locator.Close()
+
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		t.Fatalf("Error fetching contacts: %s", err)
+	}
+	sort.Strings(contacts)
+	expected := []string{"http://10.0.0.1:3000", "http://10.0.0.2:3000", "http://10.0.0.3:3000"}
+	if len(contacts) != len(expected) {
+		t.Fatalf("Wrong contacts: got %#v; want %#v", contacts, expected)
+	}
+	for i := range expected {
+		if contacts[i] != expected[i] {
+			t.Errorf("Wrong contact at %d: got %q; want %q", i, contacts[i], expected[i])
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Wrong number of requests: got %d; want 2", n)
+	}
+}
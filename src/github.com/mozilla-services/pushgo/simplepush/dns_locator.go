@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"strings"
+)
+
+type DNSLocatorConf struct {
+	DiscoveryConf
+
+	// Name is the SRV record name, e.g. "_pushgo-router._tcp.example.com".
+	Name string `env:"name"`
+
+	// Scheme is the scheme of the contact URLs. Defaults to "http".
+	Scheme string `env:"scheme"`
+}
+
+// DNSLocator discovers peers from DNS SRV records. Records are resolved
+// periodically, so that nodes are picked up as the fleet scales.
+type DNSLocator struct {
+	logger *SimpleLogger
+	scheme string
+	name   string
+	pool   *contactPool
+
+	// lookupSRV is net.LookupSRV; overridden by tests.
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (*DNSLocator) ConfigStruct() interface{} {
+	return &DNSLocatorConf{
+		DiscoveryConf: DiscoveryConf{
+			RefreshInterval: "1m",
+			ProbeInterval:   "30s",
+			ProbeTimeout:    "2s",
+			MaxFailures:     3,
+		},
+		Scheme: "http",
+	}
+}
+
+func (l *DNSLocator) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*DNSLocatorConf)
+	l.logger = app.Logger()
+	l.scheme = conf.Scheme
+	l.name = conf.Name
+	if l.lookupSRV == nil {
+		l.lookupSRV = net.LookupSRV
+	}
+	if len(l.name) == 0 {
+		l.logger.Panic("dns", "Missing SRV record name", nil)
+		return ErrNoContacts
+	}
+	if l.pool, err = newContactPool(app, "dns", &conf.DiscoveryConf, l.fetch); err != nil {
+		return err
+	}
+	if err = l.pool.Start(); err != nil {
+		l.logger.Panic("dns", "Could not resolve SRV records",
+			LogFields{"error": err.Error(), "name": l.name})
+		return err
+	}
+	return nil
+}
+
+func (l *DNSLocator) fetch() (contacts []string, err error) {
+	_, records, err := l.lookupSRV("", "", l.name)
+	if err != nil {
+		return nil, err
+	}
+	contacts = make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		contacts = append(contacts, CanonicalURL(l.scheme, host, int(record.Port)))
+	}
+	return contacts, nil
+}
+
+func (l *DNSLocator) Close() error                      { return l.pool.Close() }
+func (l *DNSLocator) Contacts(string) ([]string, error) { return l.pool.Contacts() }
+func (l *DNSLocator) Status() (bool, error)             { return l.pool.Status() }
+
+func init() {
+	AvailableLocators["dns"] = func() HasConfigStruct { return new(DNSLocator) }
+}
@@ -0,0 +1,197 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const ec2APIVersion = "2016-11-15"
+
+type EC2LocatorConf struct {
+	DiscoveryConf
+
+	// TagKey and TagValue select the instances running Simple Push.
+	TagKey   string `toml:"tag_key" env:"tag_key"`
+	TagValue string `toml:"tag_value" env:"tag_value"`
+
+	// Region is the EC2 region to query. Defaults to the region of the
+	// current instance.
+	Region string `env:"region"`
+
+	// Endpoint overrides the EC2 API endpoint,
+	// "https://ec2.<region>.amazonaws.com".
+	Endpoint string `env:"endpoint"`
+
+	// Scheme and Port are used to construct each instance's routing URL.
+	Scheme string `env:"scheme"`
+	Port   int    `env:"port"`
+
+	// UsePublicIP uses the instance's public address instead of its private
+	// address.
+	UsePublicIP bool `toml:"use_public_ip" env:"use_public_ip"`
+}
+
+// EC2Locator discovers peers by querying EC2 for running instances with a
+// given tag. Requests are signed with credentials from the environment or
+// the instance's IAM role.
+type EC2Locator struct {
+	logger      *SimpleLogger
+	client      *http.Client
+	endpoint    string
+	region      string
+	tagKey      string
+	tagValue    string
+	scheme      string
+	port        int
+	usePublicIP bool
+	pool        *contactPool
+
+	// credentials returns AWS credentials; overridden by tests.
+	credentials func() (*AWSCredentials, error)
+}
+
+func (*EC2Locator) ConfigStruct() interface{} {
+	return &EC2LocatorConf{
+		DiscoveryConf: DiscoveryConf{
+			RefreshInterval: "1m",
+			ProbeInterval:   "30s",
+			ProbeTimeout:    "2s",
+			MaxFailures:     3,
+		},
+		TagKey: "role",
+		Scheme: "http",
+		Port:   3000,
+	}
+}
+
+func (l *EC2Locator) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*EC2LocatorConf)
+	l.logger = app.Logger()
+	l.client = &http.Client{Timeout: 10 * time.Second}
+	l.tagKey = conf.TagKey
+	l.tagValue = conf.TagValue
+	l.scheme = conf.Scheme
+	l.port = conf.Port
+	l.usePublicIP = conf.UsePublicIP
+	if l.credentials == nil {
+		l.credentials = GetAWSCredentials
+	}
+
+	if len(l.tagKey) == 0 || len(l.tagValue) == 0 {
+		l.logger.Panic("ec2", "Missing instance tag", LogFields{
+			"key": l.tagKey, "value": l.tagValue})
+		return ErrNoContacts
+	}
+	if l.region = conf.Region; len(l.region) == 0 {
+		if l.region, err = GetAWSRegion(); err != nil {
+			l.logger.Panic("ec2", "Could not determine region",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if l.endpoint = conf.Endpoint; len(l.endpoint) == 0 {
+		l.endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com", l.region)
+	}
+
+	if l.pool, err = newContactPool(app, "ec2", &conf.DiscoveryConf, l.fetch); err != nil {
+		return err
+	}
+	if err = l.pool.Start(); err != nil {
+		l.logger.Panic("ec2", "Could not describe instances",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+type ec2Instance struct {
+	PrivateIP string `xml:"privateIpAddress"`
+	PublicIP  string `xml:"ipAddress"`
+}
+
+type ec2DescribeInstancesResponse struct {
+	Reservations []struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// fetch returns the routing URLs of all running instances with the tag.
+func (l *EC2Locator) fetch() (contacts []string, err error) {
+	creds, err := l.credentials()
+	if err != nil {
+		return nil, err
+	}
+	var nextToken string
+	for {
+		resp, err := l.describeInstances(creds, nextToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				host := instance.PrivateIP
+				if l.usePublicIP {
+					host = instance.PublicIP
+				}
+				if len(host) == 0 {
+					continue
+				}
+				contacts = append(contacts, CanonicalURL(l.scheme, host, l.port))
+			}
+		}
+		if nextToken = resp.NextToken; len(nextToken) == 0 {
+			break
+		}
+	}
+	return contacts, nil
+}
+
+func (l *EC2Locator) describeInstances(creds *AWSCredentials,
+	nextToken string) (*ec2DescribeInstancesResponse, error) {
+
+	query := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {ec2APIVersion},
+		"Filter.1.Name":    {"tag:" + l.tagKey},
+		"Filter.1.Value.1": {l.tagValue},
+		"Filter.2.Name":    {"instance-state-name"},
+		"Filter.2.Value.1": {"running"},
+	}
+	if len(nextToken) > 0 {
+		query.Set("NextToken", nextToken)
+	}
+	req, err := http.NewRequest("GET", l.endpoint+"/?"+awsCanonicalQuery(query), nil)
+	if err != nil {
+		return nil, err
+	}
+	SignAWSRequest(req, creds, l.region, "ec2", time.Now())
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("EC2 DescribeInstances failed: %s", resp.Status)
+	}
+	result := new(ec2DescribeInstancesResponse)
+	if err = xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (l *EC2Locator) Close() error                      { return l.pool.Close() }
+func (l *EC2Locator) Contacts(string) ([]string, error) { return l.pool.Contacts() }
+func (l *EC2Locator) Status() (bool, error)             { return l.pool.Status() }
+
+func init() {
+	AvailableLocators["ec2"] = func() HasConfigStruct { return new(EC2Locator) }
+}
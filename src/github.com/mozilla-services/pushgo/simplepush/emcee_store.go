@@ -94,6 +94,8 @@ type EmceeStore struct {
 	Hosts         []string
 	MaxConns      int
 	PingPrefix    string
+	AccessPrefix  string
+	RoutePrefix   string
 	recvTimeout   uint64
 	sendTimeout   uint64
 	pollTimeout   uint64
@@ -104,7 +106,9 @@ type EmceeStore struct {
 	HandleTimeout time.Duration
 	maxChannels   int
 	defaultHost   string
+	app           *Application
 	logger        *SimpleLogger
+	pingCipher    *PingCipher
 	closeWait     sync.WaitGroup
 	closeSignal   chan bool
 	closeLock     sync.Mutex
@@ -141,6 +145,8 @@ func (*EmceeStore) ConfigStruct() interface{} {
 			TimeoutDel:    24 * 60 * 60,
 			HandleTimeout: "5s",
 			PingPrefix:    "_pc-",
+			AccessPrefix:  "_la-",
+			RoutePrefix:   "_rt-",
 		},
 	}
 }
@@ -149,6 +155,7 @@ func (*EmceeStore) ConfigStruct() interface{} {
 // Implements HasConfigStruct.Init().
 func (s *EmceeStore) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*EmceeConf)
+	s.app = app
 	s.logger = app.Logger()
 
 	s.defaultHost = app.Hostname()
@@ -169,6 +176,13 @@ func (s *EmceeStore) Init(app *Application, config interface{}) (err error) {
 
 	s.MaxConns = conf.Driver.MaxConns
 	s.PingPrefix = conf.Db.PingPrefix
+	if s.pingCipher, err = NewPingCipher(conf.Db.PingKeys, conf.Db.PingKeyID); err != nil {
+		s.logger.Panic("emcee", "Invalid proprietary ping keys",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	s.AccessPrefix = conf.Db.AccessPrefix
+	s.RoutePrefix = conf.Db.RoutePrefix
 
 	if s.HandleTimeout, err = time.ParseDuration(conf.Db.HandleTimeout); err != nil {
 		s.logger.Panic("emcee", "Db.HandleTimeout must be a valid duration",
@@ -262,6 +276,23 @@ func (*EmceeStore) IDsToKey(uaid, chid string) (string, bool) {
 	return fmt.Sprintf("%s.%s", uaid, chid), true
 }
 
+// tenantKey prefixes a storage key for the given device ID with the key
+// prefix of the device's tenant. Keys of devices without a tenant are
+// unchanged.
+func (s *EmceeStore) tenantKey(uaid, key string) string {
+	return tenantKeyPrefix(s.app, uaid) + key
+}
+
+// recordKey returns the storage key of the channel record with the given
+// primary key.
+func (s *EmceeStore) recordKey(pk string) string {
+	uaid := pk
+	if dot := strings.IndexByte(pk, '.'); dot >= 0 {
+		uaid = pk[:dot]
+	}
+	return s.tenantKey(uaid, pk)
+}
+
 // Status queries whether memcached is available for reading and writing.
 // Implements Store.Status().
 func (s *EmceeStore) Status() (success bool, err error) {
@@ -479,6 +510,35 @@ func (s *EmceeStore) storeUnregister(uaid, chid string) error {
 	return nil
 }
 
+// RegisterMany creates channel records for the given channel IDs. The
+// records are written before the subscription list; if any write fails, the
+// records are restored and the subscription list is unchanged. Implements
+// BatchStore.RegisterMany().
+func (s *EmceeStore) RegisterMany(uaid string, chids []string, version int64) (err error) {
+	if err = validBatch(uaid, chids); err != nil {
+		return err
+	}
+	existing, err := s.fetchAppIDArray(uaid)
+	if err != nil && !isMissing(err) {
+		return err
+	}
+	return registerMany(s, s.logger, "emcee", uaid, existing, chids, version)
+}
+
+// UnregisterMany removes the given channel IDs from the subscription list in
+// a single write, then marks their records as deleted. Fails without changes
+// if any channel is not registered. Implements BatchStore.UnregisterMany().
+func (s *EmceeStore) UnregisterMany(uaid string, chids []string) (err error) {
+	if err = validBatch(uaid, chids); err != nil {
+		return err
+	}
+	existing, err := s.fetchAppIDArray(uaid)
+	if err != nil && !isMissing(err) {
+		return err
+	}
+	return unregisterMany(s, s.logger, "emcee", uaid, existing, chids)
+}
+
 // Unregister marks the channel ID associated with the given device ID
 // as inactive. Implements Store.Unregister().
 func (s *EmceeStore) Unregister(uaid, chid string) (err error) {
@@ -513,19 +573,11 @@ func (s *EmceeStore) Drop(uaid, chid string) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	client, err := s.getClient()
-	if err != nil {
-		return err
-	}
-	defer s.releaseWithout(client, &err)
 	key, ok := s.IDsToKey(uaid, chid)
 	if !ok {
 		return ErrInvalidKey
 	}
-	if err = client.Delete(key, 0); err == nil || isMissing(err) {
-		return nil
-	}
-	return err
+	return s.dropRec(key)
 }
 
 // FetchAll returns all channel updates and expired channels for a device ID
@@ -566,7 +618,7 @@ func (s *EmceeStore) FetchAll(uaid string, since time.Time) ([]Update, []string,
 	sinceUnix := since.Unix()
 	for index, key := range keys {
 		channel := new(ChannelRecord)
-		if err := client.Get(key, channel); err != nil {
+		if err := client.Get(s.recordKey(key), channel); err != nil {
 			continue
 		}
 		chid := chids[index]
@@ -628,6 +680,47 @@ func (s *EmceeStore) FetchAll(uaid string, since time.Time) ([]Update, []string,
 	return updates, expired, nil
 }
 
+// ChannelIDs returns the device's channel ID list. Implements
+// ChannelLister.ChannelIDs().
+func (s *EmceeStore) ChannelIDs(uaid string) ([]string, error) {
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && !isMissing(err) {
+		return nil, err
+	}
+	return chids, nil
+}
+
+// Channels returns the channels registered to a device. Implements
+// ChannelLister.Channels().
+func (s *EmceeStore) Channels(uaid string) ([]RegisteredChannel, error) {
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && !isMissing(err) {
+		return nil, err
+	}
+	channels := make([]RegisteredChannel, 0, len(chids))
+	for _, chid := range chids {
+		key, _ := s.IDsToKey(uaid, chid)
+		rec, err := s.fetchRec(key)
+		if err != nil {
+			return nil, err
+		}
+		if rec.State == StateDeleted {
+			continue
+		}
+		channels = append(channels, RegisteredChannel{
+			ChannelID:   chid,
+			LastTouched: time.Unix(rec.LastTouched, 0),
+		})
+	}
+	return channels, nil
+}
+
 // DropAll removes all channel records for the given device ID. Implements
 // Store.DropAll().
 func (s *EmceeStore) DropAll(uaid string) error {
@@ -648,9 +741,9 @@ func (s *EmceeStore) DropAll(uaid string) error {
 		if !ok {
 			return ErrInvalidKey
 		}
-		client.Delete(key, 0)
+		client.Delete(s.recordKey(key), 0)
 	}
-	if err = client.Delete(uaid, 0); err != nil && !isMissing(err) {
+	if err = client.Delete(s.tenantKey(uaid, uaid), 0); err != nil && !isMissing(err) {
 		return err
 	}
 	return nil
@@ -670,22 +763,48 @@ func (s *EmceeStore) FetchPing(uaid string) (pingData []byte, err error) {
 		return
 	}
 	defer s.releaseWithout(client, &err)
-	err = client.Get(s.PingPrefix+uaid, &pingData)
-	return
+	if err = client.Get(s.tenantKey(uaid, s.PingPrefix+uaid), &pingData); err != nil {
+		return nil, err
+	}
+	return s.pingCipher.Open(uaid, pingData)
 }
 
 // PutPing stores the proprietary ping info blob for the given device ID in
 // memcached. Implements Store.PutPing().
-func (s *EmceeStore) PutPing(uaid string, pingData []byte) error {
+func (s *EmceeStore) PutPing(uaid string, pingData []byte) (err error) {
 	if !id.Valid(uaid) {
 		return ErrInvalidID
 	}
+	sealed, err := s.pingCipher.Seal(uaid, pingData)
+	if err != nil {
+		return err
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	defer s.releaseWithout(client, &err)
+	return client.Set(s.tenantKey(uaid, s.PingPrefix+uaid), sealed, 0)
+}
+
+// PutAccessed stores the last-access times for a batch of devices. Entries
+// expire along with the device's channel records. Implements
+// AccessStore.PutAccessed().
+func (s *EmceeStore) PutAccessed(accessed map[string]time.Time) (err error) {
 	client, err := s.getClient()
 	if err != nil {
 		return err
 	}
 	defer s.releaseWithout(client, &err)
-	return client.Set(s.PingPrefix+uaid, pingData, 0)
+	for uaid, lastAccess := range accessed {
+		if !id.Valid(uaid) {
+			continue
+		}
+		if err = client.Set(s.tenantKey(uaid, s.AccessPrefix+uaid), lastAccess.Unix(), s.TimeoutLive); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // DropPing removes all proprietary ping info for the given device ID.
@@ -702,7 +821,75 @@ func (s *EmceeStore) DropPing(uaid string) error {
 		return err
 	}
 	defer s.releaseWithout(client, &err)
-	return client.Delete(s.PingPrefix+uaid, 0)
+	return client.Delete(s.tenantKey(uaid, s.PingPrefix+uaid), 0)
+}
+
+// PutRoute records the routing URL of the node connected to the device.
+// Routes expire along with the device's channel records. Implements
+// RouteStore.PutRoute().
+func (s *EmceeStore) PutRoute(uaid, routeURL string) (err error) {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	defer s.releaseWithout(client, &err)
+	return client.Set(s.tenantKey(uaid, s.RoutePrefix+uaid), []byte(routeURL), s.TimeoutLive)
+}
+
+// FetchRoute returns the routing URL of the node connected to the device.
+// Implements RouteStore.FetchRoute().
+func (s *EmceeStore) FetchRoute(uaid string) (routeURL string, err error) {
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return "", err
+	}
+	defer s.releaseWithout(client, &err)
+	var raw []byte
+	if err = client.Get(s.tenantKey(uaid, s.RoutePrefix+uaid), &raw); err != nil {
+		if isMissing(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// DropRoute removes the device's route if it still points to the given
+// node. Implements RouteStore.DropRoute().
+func (s *EmceeStore) DropRoute(uaid, routeURL string) (err error) {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	defer s.releaseWithout(client, &err)
+	key := s.tenantKey(uaid, s.RoutePrefix+uaid)
+	var raw []byte
+	if err = client.Get(key, &raw); err != nil {
+		if isMissing(err) {
+			return nil
+		}
+		return err
+	}
+	if string(raw) != routeURL {
+		// The device reconnected to another node.
+		return nil
+	}
+	// The driver doesn't support compare-and-swap, so a route stored by
+	// another node between the check and the delete is lost. Routers fall
+	// back to probing every contact for devices without a route.
+	if err = client.Delete(key, 0); err != nil && !isMissing(err) {
+		return err
+	}
+	return nil
 }
 
 // Queries memcached for a list of current subscriptions associated with the
@@ -716,7 +903,7 @@ func (s *EmceeStore) fetchChannelIDs(uaid string) (result ChannelIDs, err error)
 		return nil, err
 	}
 	defer s.releaseWithout(client, &err)
-	if err = client.Get(uaid, &result); err != nil {
+	if err = client.Get(s.tenantKey(uaid, uaid), &result); err != nil {
 		return nil, err
 	}
 	return
@@ -750,7 +937,7 @@ func (s *EmceeStore) storeAppIDArray(uaid string, chids ChannelIDs) error {
 	defer s.releaseWithout(client, &err)
 	// sort the array
 	sort.Sort(chids)
-	return client.Set(uaid, chids, 0)
+	return client.Set(s.tenantKey(uaid, uaid), chids, 0)
 }
 
 // Retrieves a channel record from memcached. Returns an empty record if the
@@ -765,7 +952,7 @@ func (s *EmceeStore) fetchRec(pk string) (*ChannelRecord, error) {
 	}
 	defer s.releaseWithout(client, &err)
 	result := new(ChannelRecord)
-	if err = client.Get(pk, result); err != nil && !isMissing(err) {
+	if err = client.Get(s.recordKey(pk), result); err != nil && !isMissing(err) {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("emcee", "Get Failed", LogFields{
 				"pk":    pk,
@@ -806,7 +993,7 @@ func (s *EmceeStore) storeRec(pk string, rec *ChannelRecord) error {
 		return err
 	}
 	defer s.releaseWithout(client, &err)
-	if err = client.Set(pk, rec, ttl); err != nil {
+	if err = client.Set(s.recordKey(pk), rec, ttl); err != nil {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("emcee", "Failure to set item", LogFields{
 				"pk":    pk,
@@ -814,7 +1001,20 @@ func (s *EmceeStore) storeRec(pk string, rec *ChannelRecord) error {
 			})
 		}
 	}
-	return nil
+	return err
+}
+
+// Removes a channel record from memcached.
+func (s *EmceeStore) dropRec(pk string) (err error) {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	defer s.releaseWithout(client, &err)
+	if err = client.Delete(s.recordKey(pk), 0); err == nil || isMissing(err) {
+		return nil
+	}
+	return err
 }
 
 // Releases an acquired memcached connection.
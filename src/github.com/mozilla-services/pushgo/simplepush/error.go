@@ -1,6 +1,8 @@
 package simplepush
 
 import (
+	"io"
+	"net"
 	"net/http"
 )
 
@@ -27,7 +29,15 @@ const (
 	ErrNonexistentRecord  ErrorCode = 115
 	ErrRecordUpdateFailed ErrorCode = 116
 	ErrBadPayload         ErrorCode = 117
+	ErrDataTooLarge       ErrorCode = 118
+	ErrTooManyChannels    ErrorCode = 119
+	ErrDeviceIDLength     ErrorCode = 120
+	ErrChannelIDLength    ErrorCode = 121
+	ErrChannelLimit       ErrorCode = 122
+	ErrSharedChannelJoin  ErrorCode = 123
 	ErrTooManyPings       ErrorCode = 201
+	ErrTooManyRequests    ErrorCode = 202
+	ErrBanned             ErrorCode = 203
 	ErrServerError        ErrorCode = 999
 )
 
@@ -41,6 +51,30 @@ func (c ErrorCode) Status() int {
 	return codeToError[c].StatusCode
 }
 
+// Class returns a short name for the error code, used to label metrics.
+func (c ErrorCode) Class() string {
+	if class := codeToError[c].Class; len(class) > 0 {
+		return class
+	}
+	return "unknown"
+}
+
+// ErrorClass returns a short name for the kind of error, used to label
+// metrics. Service errors are named by code; other errors are classed as
+// "network" or "internal".
+func ErrorClass(err error) string {
+	switch err := err.(type) {
+	case ErrorCode:
+		return err.Class()
+	case net.Error:
+		return "network"
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "network"
+	}
+	return "internal"
+}
+
 // ErrToStatus converts an error into an HTTP status code and message. The
 // message should not expose implementation details.
 func ErrToStatus(err error) (status int, message string) {
@@ -48,11 +82,19 @@ func ErrToStatus(err error) (status int, message string) {
 		return http.StatusOK, ""
 	}
 	if code, ok := err.(ErrorCode); ok {
+		if code == ErrDeviceIDLength || code == ErrChannelIDLength {
+			// Describe length violations, so that clients can tell them apart
+			// from malformed IDs.
+			return code.Status(), code.Error()
+		}
 		switch status = code.Status(); status {
 		case http.StatusServiceUnavailable:
 			return status, "Service Unavailable"
 		case http.StatusUnauthorized:
 			return status, "Invalid Command"
+		case http.StatusConflict, http.StatusForbidden,
+			http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+			return status, code.Error()
 		}
 	}
 	return http.StatusInternalServerError, "An unexpected error occurred"
@@ -61,25 +103,34 @@ func ErrToStatus(err error) (status int, message string) {
 type serviceError struct {
 	StatusCode int
 	Message    string
+	Class      string
 }
 
 var codeToError = map[ErrorCode]serviceError{
-	ErrUnknownCommand:     {http.StatusUnauthorized, "Unknown command"},
-	ErrInvalidCommand:     {http.StatusUnauthorized, "Invalid Command"},
-	ErrNoID:               {http.StatusUnauthorized, "Missing device ID"},
-	ErrInvalidID:          {http.StatusServiceUnavailable, "Invalid device ID"},
-	ErrExistingID:         {http.StatusServiceUnavailable, "Device ID already assigned"},
-	ErrNoChannel:          {http.StatusUnauthorized, "No Channel ID Specified"},
-	ErrInvalidChannel:     {http.StatusServiceUnavailable, "Invalid Channel ID Specified"},
-	ErrExistingChannel:    {http.StatusServiceUnavailable, "Channel Already Exists"},
-	ErrNonexistentChannel: {http.StatusServiceUnavailable, "Nonexistent channel ID"},
-	ErrNoKey:              {http.StatusUnauthorized, "No primary key value specified"},
-	ErrInvalidKey:         {http.StatusInternalServerError, "Invalid Primary Key Value"},
-	ErrNoParams:           {http.StatusUnauthorized, "Missing required fields for command"},
-	ErrInvalidParams:      {http.StatusUnauthorized, "An Invalid value was specified"},
-	ErrNoData:             {http.StatusServiceUnavailable, "No Data to Store"},
-	ErrNonexistentRecord:  {http.StatusServiceUnavailable, "No record found"},
-	ErrRecordUpdateFailed: {http.StatusServiceUnavailable, "Error updating channel record"},
-	ErrTooManyPings:       {http.StatusUnauthorized, "Client sent too many pings"},
-	ErrServerError:        {http.StatusInternalServerError, "An unknown Error occured"},
+	ErrUnknownCommand:     {http.StatusUnauthorized, "Unknown command", "unknown_command"},
+	ErrInvalidCommand:     {http.StatusUnauthorized, "Invalid Command", "invalid_command"},
+	ErrNoID:               {http.StatusUnauthorized, "Missing device ID", "missing_id"},
+	ErrInvalidID:          {http.StatusServiceUnavailable, "Invalid device ID", "invalid_id"},
+	ErrExistingID:         {http.StatusServiceUnavailable, "Device ID already assigned", "existing_id"},
+	ErrNoChannel:          {http.StatusUnauthorized, "No Channel ID Specified", "missing_channel"},
+	ErrInvalidChannel:     {http.StatusServiceUnavailable, "Invalid Channel ID Specified", "invalid_channel"},
+	ErrExistingChannel:    {http.StatusServiceUnavailable, "Channel Already Exists", "existing_channel"},
+	ErrNonexistentChannel: {http.StatusServiceUnavailable, "Nonexistent channel ID", "nonexistent_channel"},
+	ErrNoKey:              {http.StatusUnauthorized, "No primary key value specified", "missing_key"},
+	ErrInvalidKey:         {http.StatusInternalServerError, "Invalid Primary Key Value", "invalid_key"},
+	ErrNoParams:           {http.StatusUnauthorized, "Missing required fields for command", "missing_params"},
+	ErrInvalidParams:      {http.StatusUnauthorized, "An Invalid value was specified", "invalid_params"},
+	ErrNoData:             {http.StatusServiceUnavailable, "No Data to Store", "missing_data"},
+	ErrNonexistentRecord:  {http.StatusServiceUnavailable, "No record found", "nonexistent_record"},
+	ErrRecordUpdateFailed: {http.StatusServiceUnavailable, "Error updating channel record", "update_failed"},
+	ErrDataTooLarge:       {http.StatusRequestEntityTooLarge, "Data exceeds maximum size", "too_large"},
+	ErrTooManyChannels:    {http.StatusUnauthorized, "Too many channels", "too_many_channels"},
+	ErrDeviceIDLength:     {http.StatusServiceUnavailable, "Device ID length out of range", "invalid_id_length"},
+	ErrChannelIDLength:    {http.StatusUnauthorized, "Channel ID length out of range", "invalid_channel_length"},
+	ErrChannelLimit:       {http.StatusConflict, "Channel limit reached", "channel_limit"},
+	ErrSharedChannelJoin:  {http.StatusForbidden, "Not allowed to join shared channel", "shared_channel_join"},
+	ErrTooManyPings:       {http.StatusUnauthorized, "Client sent too many pings", "too_many_pings"},
+	ErrTooManyRequests:    {http.StatusTooManyRequests, "Too many requests", "rate_limited"},
+	ErrBanned:             {http.StatusForbidden, "Client temporarily banned", "banned"},
+	ErrServerError:        {http.StatusInternalServerError, "An unknown Error occured", "server"},
 }
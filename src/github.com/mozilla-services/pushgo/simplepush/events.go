@@ -0,0 +1,110 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	// EventClientConnected is published when a client completes the opening
+	// handshake.
+	EventClientConnected EventType = iota
+
+	// EventUpdateAccepted is published when an app server update is stored.
+	EventUpdateAccepted
+
+	// EventUpdateDelivered is published when an update is written to a
+	// connected client or handed to a proprietary pinger. The client may not
+	// have received it; see EventUpdateAcked.
+	EventUpdateDelivered
+
+	// EventUAIDReset is published when a client's device ID is discarded
+	// during the handshake.
+	EventUAIDReset
+
+	// EventClientDisconnected is published when a connected client is
+	// removed from this node.
+	EventClientDisconnected
+
+	// EventUpdateAcked is published when a client acknowledges an update.
+	EventUpdateAcked
+
+	// EventChannelRegistered is published when a client registers a
+	// channel.
+	EventChannelRegistered
+
+	// EventChannelUnregistered is published when a client unregisters a
+	// channel.
+	EventChannelUnregistered
+)
+
+var eventLabels = map[EventType]string{
+	EventClientConnected: "client.connected",
+	EventUpdateAccepted:  "update.accepted",
+	EventUpdateDelivered: "update.delivered",
+	EventUAIDReset:       "uaid.reset",
+
+	EventClientDisconnected: "client.disconnected",
+	EventUpdateAcked:        "update.acked",
+
+	EventChannelRegistered:   "channel.registered",
+	EventChannelUnregistered: "channel.unregistered",
+}
+
+func (t EventType) String() string {
+	return eventLabels[t]
+}
+
+// Event describes an occurrence of interest to other modules.
+type Event struct {
+	Type      EventType
+	UAID      string
+	ChannelID string
+	Version   int64
+	Time      time.Time
+
+	// RemoteAddr is the client's address, for events caused by a client.
+	RemoteAddr string
+}
+
+// EventHandler is called synchronously for each published event, and must
+// not block.
+type EventHandler func(*Event)
+
+// EventBus is an in-process publish-subscribe mechanism. Modules publish
+// events without knowing which subscribers (metrics, receipts, webhooks,
+// etc.) are interested.
+type EventBus struct {
+	lock     sync.RWMutex
+	handlers map[EventType][]EventHandler
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{handlers: make(map[EventType][]EventHandler)}
+}
+
+// Subscribe registers a handler for the given event type.
+func (b *EventBus) Subscribe(t EventType, handler EventHandler) {
+	b.lock.Lock()
+	b.handlers[t] = append(b.handlers[t], handler)
+	b.lock.Unlock()
+}
+
+// Publish calls all handlers subscribed to the event type.
+func (b *EventBus) Publish(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	b.lock.RLock()
+	handlers := b.handlers[event.Type]
+	b.lock.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strings"
+)
+
+// fanOutWorkers is the maximum number of member devices that an update to a
+// shared channel is delivered to concurrently.
+const fanOutWorkers = 16
+
+// groupKeyPrefix marks primary keys that identify a shared channel, rather
+// than a single (device ID, channel ID) tuple. Device IDs are hex-encoded,
+// so the prefix cannot collide with a regular key.
+const groupKeyPrefix = "g."
+
+// GroupStore is implemented by storage adapters that track the set of
+// devices registered for a shared channel. An update sent to a shared
+// channel's endpoint is delivered to every member device. Adapters that do
+// not implement it reject shared registrations.
+type GroupStore interface {
+	// AddMember adds a device to the shared channel. Any device may create
+	// a channel without members, but joining a channel with other members
+	// requires join to be set; otherwise, AddMember returns
+	// ErrSharedChannelJoin. Adding an existing member is not an error.
+	AddMember(schid, suaid string, join bool) error
+
+	// RemoveMember removes a device from the shared channel. Removing a
+	// device that is not a member is not an error. Channels are removed once
+	// their last member leaves.
+	RemoveMember(schid, suaid string) error
+
+	// Members returns the devices registered for the shared channel.
+	Members(schid string) ([]string, error)
+}
+
+// GroupKey returns the primary key for a shared channel.
+func GroupKey(chid string) string {
+	return groupKeyPrefix + chid
+}
+
+// GroupKeyToID extracts the channel ID from a shared channel primary key.
+func GroupKeyToID(key string) (chid string, ok bool) {
+	if !strings.HasPrefix(key, groupKeyPrefix) {
+		return "", false
+	}
+	chid = key[len(groupKeyPrefix):]
+	return chid, len(chid) > 0
+}
+
+// FanOutReply is the response body for updates sent to shared channels.
+type FanOutReply struct {
+	Devices   int `json:"devices"`
+	Delivered int `json:"delivered"`
+}
@@ -0,0 +1,774 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+func init() {
+	AvailablePings["fcm"] = func() HasConfigStruct { return NewFCMPing() }
+}
+
+// OfflinePinger is implemented by proprietary pingers that only wake devices
+// without a live WebSocket connection. Updates are stored and routed as
+// usual; Send is called only if no node accepted the update.
+type OfflinePinger interface {
+	PropPinger
+
+	// OnlyOffline indicates whether the pinger should be skipped for
+	// devices with a live connection.
+	OnlyOffline() bool
+}
+
+// isOfflinePinger indicates whether a pinger only wakes disconnected
+// devices.
+func isOfflinePinger(pinger PropPinger) bool {
+	offline, ok := pinger.(OfflinePinger)
+	return ok && offline.OnlyOffline()
+}
+
+const (
+	// fcmScope is the OAuth 2.0 scope for sending messages.
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+	// fcmTokenURL is the default OAuth 2.0 token endpoint for service
+	// accounts.
+	fcmTokenURL = "https://oauth2.googleapis.com/token"
+
+	// fcmAssertionLifetime is the lifetime of the signed assertion exchanged
+	// for an access token. Google rejects assertions valid for longer than an
+	// hour.
+	fcmAssertionLifetime = time.Hour
+)
+
+// FCM error codes that indicate the registration token is no longer valid.
+// Messages are well-formed, so an invalid argument is the device's token.
+var fcmInvalidTokenCodes = map[string]bool{
+	"UNREGISTERED":       true,
+	"INVALID_ARGUMENT":   true,
+	"SENDER_ID_MISMATCH": true,
+}
+
+var ErrInvalidFCMCredentials = errors.New(
+	"FCM credentials must be a service account key with an RSA private key")
+
+type FCMPingConfig struct {
+	// CredentialsFile names the service account key file (JSON) for the
+	// Firebase project. Credentials may hold the contents of the key file
+	// instead, e.g., as a secret reference.
+	CredentialsFile string `toml:"credentials_file" env:"credentials_file"`
+	Credentials     string `env:"credentials"`
+
+	// ProjectID overrides the project ID in the service account key.
+	ProjectID string `toml:"project_id" env:"project_id"`
+
+	// URL is the FCM HTTP v1 API endpoint. Defaults to
+	// "https://fcm.googleapis.com".
+	URL string `env:"url"`
+
+	// CollapseKey groups wake messages, so that devices only receive the
+	// most recent one. Defaults to "simplepush".
+	CollapseKey string `toml:"collapse_key" env:"collapse_key"`
+
+	// TTL is how long FCM holds wake messages for offline devices. Defaults
+	// to 72 hours.
+	TTL string `env:"ttl"`
+
+	// Priority is the Android message priority, "normal" or "high". High
+	// priority messages wake devices in Doze mode. Defaults to "high".
+	Priority string `env:"priority"`
+
+	// DryRun validates messages without delivering them.
+	DryRun bool `toml:"dry_run" env:"dry_run"`
+
+	// Timeout is the maximum time to wait for an FCM response. Defaults to
+	// 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Retry configures retries for throttled, unavailable, and 5xx
+	// responses.
+	Retry retry.Config
+
+	// Simulate logs and counts wakes instead of sending them to FCM, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+
+	// Topics configures the topic fallback for mass notifications.
+	Topics FCMTopicConfig
+}
+
+// FCMTopicConfig configures the topic fallback for mass notifications. Once
+// more than Quota device messages are sent within Window, wakes for devices
+// that joined a topic are sent once per topic and channel version instead of
+// once per device. Topic messages reach every device in the topic, so they
+// carry no update data; devices fetch their updates when they reconnect.
+type FCMTopicConfig struct {
+	// Quota is the number of device messages allowed per window before
+	// falling back to topic messages. Defaults to 0 (topics disabled).
+	Quota int64 `env:"quota"`
+
+	// Window is the quota accounting period. Defaults to "1m".
+	Window string `env:"window"`
+
+	// Prefix is prepended to the topic names supplied by devices.
+	Prefix string `env:"prefix"`
+
+	// URL is the instance ID service endpoint used to manage topic
+	// subscriptions. Defaults to "https://iid.googleapis.com/iid/v1".
+	URL string `env:"url"`
+}
+
+// fcmServiceAccount holds the fields of a service account key file used to
+// obtain access tokens.
+type fcmServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// fcmToken is an OAuth 2.0 access token response.
+type fcmToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// FCMPingData is the "connect" data sent by Android devices in the
+// handshake. Devices registered with GCM send "regid" instead of "token".
+type FCMPingData struct {
+	// Type is preserved in stored registration data, so that MultiPing
+	// continues to select FCM for the device.
+	Type  string `json:"type,omitempty"`
+	Token string `json:"token,omitempty"`
+	RegID string `json:"regid,omitempty"`
+
+	// Topic optionally names the broadcast topic that the device joins when
+	// its connect data is stored.
+	Topic string `json:"topic,omitempty"`
+}
+
+// token returns the device's registration token.
+func (d *FCMPingData) token() string {
+	if len(d.Token) > 0 {
+		return d.Token
+	}
+	return d.RegID
+}
+
+// FCMRequest is an FCM HTTP v1 send request.
+type FCMRequest struct {
+	Message      FCMMessage `json:"message"`
+	ValidateOnly bool       `json:"validate_only,omitempty"`
+}
+
+// FCMMessage is a data message for a single registration token or, if the
+// topic fallback is in use, for every device in a topic.
+type FCMMessage struct {
+	Token   string            `json:"token,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+	Data    map[string]string `json:"data"`
+	Android *FCMAndroidConfig `json:"android,omitempty"`
+}
+
+// FCMAndroidConfig holds the Android delivery options for a message.
+type FCMAndroidConfig struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+	Priority    string `json:"priority,omitempty"` // "NORMAL" or "HIGH".
+	TTL         string `json:"ttl,omitempty"`      // Seconds, e.g., "60s".
+}
+
+// FCMErrorResponse is the body of a failed FCM HTTP v1 request. The FCM
+// error code is in the details.
+type FCMErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// errorCode returns the FCM error code, or the canonical status if the
+// response has no FCM details.
+func (e *FCMErrorResponse) errorCode() string {
+	for _, detail := range e.Error.Details {
+		if len(detail.ErrorCode) > 0 {
+			return detail.ErrorCode
+		}
+	}
+	return e.Error.Status
+}
+
+// FCMPing wakes disconnected Android devices with FCM data messages, sent
+// with the HTTP v1 API. Requests are authorized with OAuth 2.0 access tokens
+// for a service account. The message carries the update version and data;
+// the device reconnects to fetch pending updates.
+type FCMPing struct {
+	logger       *SimpleLogger
+	metrics      Statistician
+	store        Store
+	client       *http.Client
+	url          string
+	account      fcmServiceAccount
+	key          *rsa.PrivateKey
+	collapseKey  string
+	priority     string
+	dryRun       bool
+	ttl          string
+	feedback     *PingFeedback
+	guard        *BridgeGuard
+	simulate     bool
+	rh           *retry.Helper
+	tokenLock    sync.Mutex
+	token        string
+	tokenExpires time.Time
+	topics       *fcmTopics
+	closeLock    sync.Mutex
+	closeSignal  chan bool
+	isClosed     bool
+}
+
+func NewFCMPing() *FCMPing {
+	return &FCMPing{closeSignal: make(chan bool)}
+}
+
+func (*FCMPing) ConfigStruct() interface{} {
+	return &FCMPingConfig{
+		URL:         "https://fcm.googleapis.com",
+		CollapseKey: "simplepush",
+		TTL:         "72h",
+		Priority:    "high",
+		Timeout:     "10s",
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+		Guard: DefaultBridgeGuard(),
+		Topics: FCMTopicConfig{
+			Window: "1m",
+			URL:    "https://iid.googleapis.com/iid/v1",
+		},
+	}
+}
+
+func (r *FCMPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*FCMPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("fcm", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "fcm", r.guard)
+	r.simulate = conf.Simulate
+
+	credentials := []byte(conf.Credentials)
+	if len(conf.CredentialsFile) > 0 {
+		if credentials, err = ioutil.ReadFile(conf.CredentialsFile); err != nil {
+			r.logger.Panic("propping", "Could not read FCM credentials",
+				LogFields{"error": err.Error(), "file": conf.CredentialsFile})
+			return err
+		}
+	}
+	if err = r.parseCredentials(credentials); err != nil {
+		r.logger.Panic("propping", "Could not parse FCM credentials",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	if len(conf.ProjectID) > 0 {
+		r.account.ProjectID = conf.ProjectID
+	}
+	if len(r.account.ProjectID) == 0 {
+		r.logger.Panic("propping", "Missing FCM project ID", nil)
+		return ConfigurationErr
+	}
+	r.url = strings.TrimRight(conf.URL, "/") + "/v1/projects/" +
+		url.PathEscape(r.account.ProjectID) + "/messages:send"
+	r.collapseKey = conf.CollapseKey
+	r.dryRun = conf.DryRun
+	switch conf.Priority {
+	case "", "normal", "high":
+		r.priority = strings.ToUpper(conf.Priority)
+	default:
+		r.logger.Panic("propping", "Invalid FCM priority",
+			LogFields{"priority": conf.Priority})
+		return ConfigurationErr
+	}
+
+	ttl, err := time.ParseDuration(conf.TTL)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	r.ttl = strconv.FormatInt(int64(ttl/time.Second), 10) + "s"
+
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse FCM timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	r.client = &http.Client{Timeout: timeout}
+
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+
+	if conf.Topics.Quota > 0 {
+		window, err := time.ParseDuration(conf.Topics.Window)
+		if err != nil {
+			r.logger.Panic("propping", "Could not parse topic quota window",
+				LogFields{"error": err.Error(), "window": conf.Topics.Window})
+			return err
+		}
+		r.topics = &fcmTopics{
+			quota:    conf.Topics.Quota,
+			window:   window,
+			prefix:   conf.Topics.Prefix,
+			url:      strings.TrimRight(conf.Topics.URL, "/"),
+			versions: make(map[string]int64),
+		}
+	}
+	return nil
+}
+
+// fcmTopics tracks device message volume and the versions already sent to
+// each topic, per channel.
+type fcmTopics struct {
+	sync.Mutex
+	quota       int64
+	window      time.Duration
+	prefix      string
+	url         string
+	windowStart time.Time
+	sent        int64
+	versions    map[string]int64 // Keyed by topic and channel ID.
+}
+
+// overQuota records a device message and indicates whether the quota for
+// the current window is exhausted.
+func (t *fcmTopics) overQuota(now time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+	if now.Sub(t.windowStart) >= t.window {
+		t.windowStart = now
+		t.sent = 0
+	}
+	if t.sent >= t.quota {
+		return true
+	}
+	t.sent++
+	return false
+}
+
+// markSent records a topic message for the given channel version, returning
+// false if the topic was already sent this or a newer version of the
+// channel. Versions are only comparable within a channel.
+func (t *fcmTopics) markSent(topic, chid string, vers int64) bool {
+	key := topic + "/" + chid
+	t.Lock()
+	defer t.Unlock()
+	if last, ok := t.versions[key]; ok && last >= vers {
+		return false
+	}
+	t.versions[key] = vers
+	return true
+}
+
+// unmarkSent forgets a failed topic message so that it can be retried by
+// the next device.
+func (t *fcmTopics) unmarkSent(topic, chid string, vers int64) {
+	key := topic + "/" + chid
+	t.Lock()
+	defer t.Unlock()
+	if t.versions[key] == vers {
+		delete(t.versions, key)
+	}
+}
+
+// parseCredentials parses a service account key file, as downloaded from the
+// Google Cloud console.
+func (r *FCMPing) parseCredentials(credentials []byte) error {
+	if err := json.Unmarshal(credentials, &r.account); err != nil {
+		return err
+	}
+	if len(r.account.ClientEmail) == 0 {
+		return ErrInvalidFCMCredentials
+	}
+	if len(r.account.TokenURI) == 0 {
+		r.account.TokenURI = fcmTokenURL
+	}
+	block, _ := pem.Decode([]byte(r.account.PrivateKey))
+	if block == nil {
+		return ErrInvalidFCMCredentials
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if r.key, ok = key.(*rsa.PrivateKey); !ok {
+		return ErrInvalidFCMCredentials
+	}
+	return nil
+}
+
+// accessToken returns the current access token, exchanging a new signed
+// assertion for one if the current token has expired or was rejected.
+func (r *FCMPing) accessToken(refresh bool) (string, error) {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if !refresh && len(r.token) > 0 && time.Now().Before(r.tokenExpires) {
+		return r.token, nil
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256", "typ": "JWT", "kid": r.account.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   r.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   r.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(fcmAssertionLifetime).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, r.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	resp, err := r.client.PostForm(r.account.TokenURI, form)
+	if err != nil {
+		return "", &PingerError{"FCM token request failed: " + err.Error(), true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", &PingerError{fmt.Sprintf(
+			"FCM token request failed with status code: %d", resp.StatusCode),
+			resp.StatusCode >= 500}
+	}
+	token := new(fcmToken)
+	if err = json.NewDecoder(resp.Body).Decode(token); err != nil ||
+		len(token.AccessToken) == 0 {
+		return "", &PingerError{"Invalid FCM token response", false}
+	}
+	// Refresh tokens a minute early, so that in-flight wakes do not race
+	// the expiry.
+	expiresIn := time.Duration(token.ExpiresIn)*time.Second - time.Minute
+	r.token = token.AccessToken
+	r.tokenExpires = now.Add(expiresIn)
+	r.metrics.Increment("ping.fcm.token.refresh")
+	return r.token, nil
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and FCM is only used to wake disconnected devices.
+func (r *FCMPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *FCMPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's FCM registration token.
+func (r *FCMPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(FCMPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || len(ping.token()) == 0 {
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store FCM registration data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	if r.topics == nil || len(ping.Topic) == 0 || r.simulate {
+		return nil
+	}
+	// Topic subscriptions are best-effort: the device can still be woken
+	// individually if the subscription fails.
+	if err = r.subscribe(ping.token(), r.topics.prefix+ping.Topic); err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Could not subscribe device to FCM topic",
+				LogFields{"error": err.Error(), "uaid": uaid, "topic": ping.Topic})
+		}
+		r.metrics.Increment("ping.fcm.topic.subscribe.error")
+		return nil
+	}
+	r.metrics.Increment("ping.fcm.topic.subscribe")
+	return nil
+}
+
+// subscribe adds the registration token to the named topic via the instance
+// ID service, authorized with the service account's access token.
+func (r *FCMPing) subscribe(token, topic string) error {
+	subscribeOnce := func() error {
+		accessToken, err := r.accessToken(false)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/rel/topics/%s",
+			r.topics.url, url.PathEscape(token), url.PathEscape(topic)), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Access_token_auth", "true")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return &PingerError{err.Error(), true}
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			r.accessToken(true)
+		}
+		return &PingerError{fmt.Sprintf(
+			"Unexpected status code: %d", resp.StatusCode),
+			resp.StatusCode == http.StatusUnauthorized || resp.StatusCode >= 500}
+	}
+	_, err := r.rh.RetryFunc(subscribeOnce)
+	return err
+}
+
+// Send wakes a device with an FCM data message. It returns false without an
+// error if the device did not register a token, or if FCM reports that the
+// token is no longer valid; invalid tokens are removed from storage.
+func (r *FCMPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	return r.SendChannel(uaid, "", vers, data)
+}
+
+// SendChannel is like Send. Once the topic quota is exhausted, devices that
+// joined a topic are woken with one data-less message per topic and channel
+// version. Implements ChannelPinger.SendChannel().
+func (r *FCMPing) SendChannel(uaid, chid string, vers int64, data string) (
+	ok bool, err error) {
+
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch FCM registration data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(FCMPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || len(ping.token()) == 0 {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid FCM registration data",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	message := FCMMessage{
+		Token: ping.token(),
+		Data: map[string]string{
+			"msg":     data,
+			"version": strconv.FormatInt(vers, 10),
+		},
+		Android: &FCMAndroidConfig{
+			CollapseKey: r.collapseKey,
+			Priority:    r.priority,
+			TTL:         r.ttl,
+		},
+	}
+	var topic string
+	if r.topics != nil && len(ping.Topic) > 0 && len(chid) > 0 &&
+		r.topics.overQuota(time.Now()) {
+
+		topic = r.topics.prefix + ping.Topic
+		if !r.topics.markSent(topic, chid, vers) {
+			// Another device already woke the topic for this version.
+			r.metrics.Increment("ping.fcm.topic.coalesced")
+			return true, nil
+		}
+		message.Token, message.Topic = "", topic
+		message.Data = map[string]string{"version": strconv.FormatInt(vers, 10)}
+	}
+	body, err := json.Marshal(&FCMRequest{Message: message, ValidateOnly: r.dryRun})
+	if err != nil {
+		return false, err
+	}
+	if err = r.guard.Allow(); err != nil {
+		if len(topic) > 0 {
+			r.topics.unmarkSent(topic, chid, vers)
+		}
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	var errorCode string
+	sendOnce := func() (err error) {
+		errorCode, err = r.send(body)
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.fcm.retry", int64(retries))
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send FCM message",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.fcm.error")
+		r.feedback.Failed(uaid, err)
+		if len(topic) > 0 {
+			r.topics.unmarkSent(topic, chid, vers)
+		}
+		return false, err
+	}
+	if len(topic) > 0 {
+		if len(errorCode) > 0 {
+			// The topic is invalid, not the device's token.
+			r.topics.unmarkSent(topic, chid, vers)
+			r.metrics.Increment("ping.fcm.topic.error")
+			return false, nil
+		}
+		r.metrics.Increment("ping.fcm.topic.success")
+		r.feedback.Accepted(uaid)
+		return true, nil
+	}
+	if len(errorCode) > 0 {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Removing invalid FCM registration token",
+				LogFields{"uaid": uaid, "error": errorCode})
+		}
+		r.metrics.Increment("ping.fcm.unregistered")
+		r.feedback.Invalid(uaid)
+		return false, nil
+	}
+	r.metrics.Increment("ping.fcm.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// send posts a message to FCM. If FCM rejects the registration token,
+// send returns the FCM error code. Rejected access tokens, throttled,
+// unavailable, and 5xx responses are temporary errors.
+func (r *FCMPing) send(body []byte) (errorCode string, err error) {
+	token, err := r.accessToken(false)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", nil
+	}
+	reply := new(FCMErrorResponse)
+	json.NewDecoder(resp.Body).Decode(reply)
+	errorCode = reply.errorCode()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		r.accessToken(true)
+		return "", &PingerError{"FCM access token rejected", true}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if !r.retryAfter(resp.Header.Get("Retry-After")) {
+			return "", PingerClosedErr
+		}
+		return "", &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode), true}
+	case fcmInvalidTokenCodes[errorCode]:
+		return errorCode, nil
+	}
+	return "", &PingerError{fmt.Sprintf("FCM error: %d %s",
+		resp.StatusCode, errorCode), false}
+}
+
+func (r *FCMPing) retryAfter(header string) (ok bool) {
+	d, ok := ParseRetryAfter(header)
+	if !ok {
+		return true
+	}
+	select {
+	case <-r.closeSignal:
+		return false
+	case <-time.After(d):
+	}
+	return true
+}
+
+func (r *FCMPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *FCMPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *FCMPing) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	return nil
+}
@@ -0,0 +1,433 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testFCMKeyOnce sync.Once
+	testFCMKey     *rsa.PrivateKey
+)
+
+// testFCMCredentials returns a service account key for the "test" project,
+// with the given token endpoint.
+func testFCMCredentials(t *testing.T, tokenURL string) string {
+	testFCMKeyOnce.Do(func() {
+		var err error
+		if testFCMKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("Error generating service account key: %s", err)
+		}
+	})
+	der, err := x509.MarshalPKCS8PrivateKey(testFCMKey)
+	if err != nil {
+		t.Fatalf("Error encoding service account key: %s", err)
+	}
+	credentials, _ := json.Marshal(&fcmServiceAccount{
+		ProjectID:    "test",
+		PrivateKeyID: "1",
+		PrivateKey: string(pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail: "pushgo@test.iam.gserviceaccount.com",
+		TokenURI:    tokenURL,
+	})
+	return string(credentials)
+}
+
+// newTestFCMServer returns a server that issues access tokens for signed
+// assertions, and passes send requests for the "test" project to send.
+// Tokens are numbered in the order they are issued: "token1", "token2", etc.
+func newTestFCMServer(t *testing.T, send http.HandlerFunc) *httptest.Server {
+	var (
+		lock   sync.Mutex
+		tokens int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(resp http.ResponseWriter, req *http.Request) {
+		if req.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(req.PostFormValue("assertion"), ".")
+		if len(parts) != 3 {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&testFCMKey.PublicKey, crypto.SHA256,
+			digest[:], sig); err != nil {
+
+			t.Errorf("Invalid assertion signature: %s", err)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		tokens++
+		token := &fcmToken{
+			AccessToken: fmt.Sprintf("token%d", tokens),
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+		}
+		lock.Unlock()
+		json.NewEncoder(resp).Encode(token)
+	})
+	mux.Handle("/v1/projects/test/messages:send", send)
+	return httptest.NewServer(mux)
+}
+
+type testPingStore struct {
+	*NoStore
+	sync.Mutex
+	pings map[string][]byte
+}
+
+func (s *testPingStore) PutPing(uaid string, pingData []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.pings[uaid] = pingData
+	return nil
+}
+
+func (s *testPingStore) FetchPing(uaid string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.pings[uaid], nil
+}
+
+func (s *testPingStore) DropPing(uaid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pings, uaid)
+	return nil
+}
+
+func newTestFCMPing(t *testing.T, url string) (*FCMPing, *testPingStore, *Handler) {
+	handler, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	handler.store = store
+	pinger := NewFCMPing()
+	conf := pinger.ConfigStruct().(*FCMPingConfig)
+	conf.URL = url
+	conf.Credentials = testFCMCredentials(t, url+"/token")
+	conf.Retry.Delay = "1ms"
+	conf.Retry.MaxDelay = "1ms"
+	conf.Retry.MaxJitter = "0"
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing FCM pinger: %s", err)
+	}
+	handler.SetPropPinger(pinger)
+	return pinger, store, handler
+}
+
+// writeFCMError writes an FCM HTTP v1 error response with the given FCM
+// error code.
+func writeFCMError(resp http.ResponseWriter, status int, errorCode string) {
+	reply := new(FCMErrorResponse)
+	reply.Error.Code = status
+	reply.Error.Details = append(reply.Error.Details, struct {
+		Type      string `json:"@type"`
+		ErrorCode string `json:"errorCode"`
+	}{"type.googleapis.com/google.firebase.fcm.v1.FcmError", errorCode})
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(reply)
+}
+
+func Test_FCMPingSend(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		requests []*FCMRequest
+	)
+	fcm := newTestFCMServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer token") {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := new(FCMRequest)
+		if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+			t.Errorf("Error decoding FCM request: %s", err)
+		}
+		requests = append(requests, request)
+		switch request.Message.Token {
+		case "stale":
+			// Reject the first access token.
+			if auth == "Bearer token1" {
+				writeFCMError(resp, http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR")
+				return
+			}
+		case "flaky":
+			if len(requests) == 1 {
+				writeFCMError(resp, http.StatusServiceUnavailable, "UNAVAILABLE")
+				return
+			}
+		case "gone":
+			writeFCMError(resp, http.StatusNotFound, "UNREGISTERED")
+			return
+		case "invalid":
+			writeFCMError(resp, http.StatusForbidden, "SENDER_ID_MISMATCH")
+			return
+		}
+		json.NewEncoder(resp).Encode(map[string]string{
+			"name": "projects/test/messages/1"})
+	})
+	defer fcm.Close()
+
+	pinger, store, _ := newTestFCMPing(t, fcm.URL)
+	defer pinger.Close()
+	if err := pinger.Register("uaid0", []byte(`{"type":"fcm"}`)); err != UnsupportedProtocolErr {
+		t.Errorf("Wrong error for missing token: %v", err)
+	}
+	for uaid, pingData := range map[string]string{
+		"uaid1": `{"regid":"stale"}`,
+		"uaid2": `{"token":"flaky"}`,
+		"uaid3": `{"token":"gone"}`,
+		"uaid4": `{"token":"invalid"}`,
+	} {
+		if err := pinger.Register(uaid, []byte(pingData)); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	// Rejected access tokens are refreshed, and the message retried.
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Wrong FCM request count: got %d; want 2", len(requests))
+	}
+	message := requests[1].Message
+	if message.Data["version"] != "5" || message.Data["msg"] != "hi" {
+		t.Errorf("Wrong FCM message data: %+v", message.Data)
+	}
+	if android := message.Android; android == nil || android.Priority != "HIGH" ||
+		android.TTL != "259200s" || android.CollapseKey != "simplepush" {
+
+		t.Errorf("Wrong Android config: %+v", android)
+	}
+
+	// Unavailable responses are retried.
+	requests = nil
+	if ok, err := pinger.Send("uaid2", 1, ""); !ok || err != nil {
+		t.Fatalf("Error sending to uaid2: ok=%v, err=%v", ok, err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("Wrong FCM request count: got %d; want 2", len(requests))
+	}
+
+	// Unregistered and mismatched tokens are removed.
+	for _, uaid := range []string{"uaid3", "uaid4"} {
+		if ok, err := pinger.Send(uaid, 1, ""); ok || err != nil {
+			t.Errorf("Wrong result for invalid token %s: ok=%v, err=%v", uaid, ok, err)
+		}
+		if data, _ := store.FetchPing(uaid); data != nil {
+			t.Errorf("Invalid token not removed for %s: %s", uaid, data)
+		}
+	}
+	if ok, err := pinger.Send("uaid5", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for device without token: ok=%v, err=%v", ok, err)
+	}
+}
+
+func Test_FCMPingWakesOfflineDevices(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		wakes int
+	)
+	fcm := newTestFCMServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		wakes++
+		lock.Unlock()
+		json.NewEncoder(resp).Encode(map[string]string{
+			"name": "projects/test/messages/1"})
+	})
+	defer fcm.Close()
+
+	pinger, _, handler := newTestFCMPing(t, fcm.URL)
+	defer pinger.Close()
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+	if err := pinger.Register(uaid, []byte(`{"token":"device"}`)); err != nil {
+		t.Fatalf("Error registering device: %s", err)
+	}
+	pk, _ := handler.store.IDsToKey(uaid, chid)
+	stored, err := handler.deliverUpdate(uaid, chid, pk, 1, "", "test",
+		PriorityNormal, false, SpanContext{}, make(chan bool))
+	if !stored || err != nil {
+		t.Errorf("Wake not accepted: stored=%v, err=%v", stored, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if wakes != 1 {
+		t.Errorf("Wrong wake count: got %d; want 1", wakes)
+	}
+}
+
+func Test_FCMPingBridgePreferred(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		wakes int
+	)
+	fcm := newTestFCMServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		wakes++
+		lock.Unlock()
+		json.NewEncoder(resp).Encode(map[string]string{
+			"name": "projects/test/messages/1"})
+	})
+	defer fcm.Close()
+
+	pinger, _, handler := newTestFCMPing(t, fcm.URL)
+	defer pinger.Close()
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+	if err := pinger.Register(uaid, []byte(`{"token":"device"}`)); err != nil {
+		t.Fatalf("Error registering device: %s", err)
+	}
+	noPush := &PushWS{Born: time.Now()}
+	noPush.SetUAID(uaid)
+	worker := &NoWorker{Socket: noPush, Logger: handler.app.Logger()}
+	handler.app.AddClient(uaid, &Client{worker, noPush, uaid})
+
+	// Connected devices are not woken for regular channels, but are for
+	// bridge-preferred channels.
+	pk, _ := handler.store.IDsToKey(uaid, chid)
+	for i, bridge := range []bool{false, true} {
+		stored, err := handler.deliverUpdate(uaid, chid, pk, int64(i+1), "", "test",
+			PriorityNormal, bridge, SpanContext{}, make(chan bool))
+		if !stored || err != nil {
+			t.Errorf("Update not accepted: bridge=%v, stored=%v, err=%v", bridge, stored, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if wakes != 1 {
+		t.Errorf("Wrong wake count: got %d; want 1", wakes)
+	}
+	if bpk, bridge := BridgeKeyToKey(BridgeKey(pk)); bpk != pk || !bridge {
+		t.Errorf("Wrong bridge key: got %q, %v; want %q, true", bpk, bridge, pk)
+	}
+}
+
+func Test_FCMPingTopicFallback(t *testing.T) {
+	var (
+		lock          sync.Mutex
+		subscriptions []string
+		requests      []*FCMRequest
+	)
+	fcm := newTestFCMServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		request := new(FCMRequest)
+		if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+			t.Errorf("Error decoding FCM request: %s", err)
+		}
+		requests = append(requests, request)
+		json.NewEncoder(resp).Encode(map[string]string{
+			"name": "projects/test/messages/1"})
+	})
+	defer fcm.Close()
+	fcm.Config.Handler.(*http.ServeMux).HandleFunc("/iid/v1/",
+		func(resp http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if req.Header.Get("Authorization") != "Bearer token1" {
+				t.Errorf("Wrong subscription authorization: %q",
+					req.Header.Get("Authorization"))
+			}
+			subscriptions = append(subscriptions, req.URL.Path)
+		})
+
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := NewFCMPing()
+	conf := pinger.ConfigStruct().(*FCMPingConfig)
+	conf.URL = fcm.URL
+	conf.Credentials = testFCMCredentials(t, fcm.URL+"/token")
+	conf.Topics.URL = fcm.URL + "/iid/v1"
+	conf.Topics.Quota = 1
+	conf.Topics.Prefix = "pushgo-"
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing FCM pinger: %s", err)
+	}
+	defer pinger.Close()
+
+	uaids := []string{"uaid1", "uaid2", "uaid3"}
+	for i, uaid := range uaids {
+		pingData := fmt.Sprintf(`{"token":"device%d","topic":"news"}`, i+1)
+		if err := pinger.Register(uaid, []byte(pingData)); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+	if len(subscriptions) != len(uaids) {
+		t.Fatalf("Wrong subscription count: got %d; want %d",
+			len(subscriptions), len(uaids))
+	}
+	if subscriptions[0] != "/iid/v1/device1/rel/topics/pushgo-news" {
+		t.Errorf("Wrong subscription path: %s", subscriptions[0])
+	}
+
+	// The first wake uses the device quota; the rest share one topic message
+	// per channel, without the update data.
+	for _, chid := range []string{"chid1", "chid2"} {
+		for _, uaid := range uaids {
+			ok, err := pinger.SendChannel(uaid, chid, 5, "secret")
+			if !ok || err != nil {
+				t.Fatalf("Error sending to %s: ok=%v, err=%v", uaid, ok, err)
+			}
+		}
+	}
+	if len(requests) != 3 {
+		t.Fatalf("Wrong FCM request count: got %d; want 3", len(requests))
+	}
+	if message := requests[0].Message; message.Token != "device1" ||
+		message.Data["msg"] != "secret" {
+
+		t.Errorf("Wrong device message: %+v", message)
+	}
+	for _, request := range requests[1:] {
+		message := request.Message
+		if message.Topic != "pushgo-news" || len(message.Token) > 0 {
+			t.Errorf("Wrong topic message target: %+v", message)
+		}
+		if _, ok := message.Data["msg"]; ok || message.Data["version"] != "5" {
+			t.Errorf("Wrong topic message data: %+v", message.Data)
+		}
+	}
+
+	// Newer versions wake the topic again.
+	if ok, err := pinger.SendChannel("uaid2", "chid1", 6, ""); !ok || err != nil {
+		t.Fatalf("Error sending newer version: ok=%v, err=%v", ok, err)
+	}
+	if len(requests) != 4 {
+		t.Errorf("Wrong FCM request count: got %d; want 4", len(requests))
+	}
+}
@@ -0,0 +1,319 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags checked by the server. Flags that are not configured use
+// the defaults in featureDefaults.
+const (
+	// FeatureData delivers update payloads to WebSocket clients. Devices
+	// outside the rollout receive version-only updates, and are not told
+	// that the server supports data.
+	FeatureData = "data"
+)
+
+// featureDefaults are the rollout percentages of flags that are not
+// configured.
+var featureDefaults = map[string]float64{
+	FeatureData: 100,
+}
+
+var ErrInvalidFeature = errors.New(`Feature flags must be of the form "name=percent"`)
+
+// FeaturesConfig configures feature flags, which roll behaviors out to a
+// percentage of devices. Each device is assigned to a stable bucket per
+// flag, so that a device enabled at 5% stays enabled at 10%, and the same
+// devices are enabled on every node.
+type FeaturesConfig struct {
+	// Flags lists the rollout percentage of each flag, as "name=percent"
+	// entries; e.g., ["data=100", "new_storage=5"]. Percentages may be
+	// fractional, and must be between 0 and 100.
+	Flags []string `env:"flags"`
+
+	// RemoteURL is an optional URL that returns a JSON object of flag names
+	// to percentages. Remote percentages override configured ones, so that
+	// rollouts can be adjusted across a cluster without a restart.
+	RemoteURL string `toml:"remote_url" env:"remote_url"`
+
+	// Refresh is how often the remote flags are re-read. Defaults to 1
+	// minute.
+	Refresh string `env:"refresh"`
+
+	// Timeout bounds each remote request. Defaults to 10 seconds.
+	Timeout string `env:"timeout"`
+}
+
+// FeatureFlag reports the rollout percentage of a flag, and where it was
+// set: "default", "config", "remote", or "override".
+type FeatureFlag struct {
+	Name    string  `json:"name"`
+	Percent float64 `json:"percent"`
+	Source  string  `json:"source"`
+}
+
+type featureFlags []*FeatureFlag
+
+func (f featureFlags) Len() int           { return len(f) }
+func (f featureFlags) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f featureFlags) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// Features decides which devices each feature flag is enabled for.
+// Percentages are resolved in order of increasing precedence: defaults,
+// configured flags, remote flags, and runtime overrides set through the
+// admin API.
+type Features struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	remoteURL   string
+	refresh     time.Duration
+	client      *http.Client
+	lock        sync.RWMutex
+	config      map[string]float64
+	remote      map[string]float64
+	overrides   map[string]float64
+	closeOnce   sync.Once
+	closeSignal chan bool
+}
+
+func NewFeatures() *Features {
+	return &Features{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		config:      make(map[string]float64),
+		remote:      make(map[string]float64),
+		overrides:   make(map[string]float64),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*Features) ConfigStruct() interface{} {
+	return &FeaturesConfig{
+		Refresh: "1m",
+		Timeout: "10s",
+	}
+}
+
+func (f *Features) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*FeaturesConfig)
+	f.logger = app.Logger()
+	f.metrics = app.Metrics()
+
+	for _, spec := range conf.Flags {
+		name, percent, err := parseFeature(spec)
+		if err != nil {
+			f.logger.Panic("features", "Invalid feature flag",
+				LogFields{"error": err.Error(), "flag": spec})
+			return err
+		}
+		f.config[name] = percent
+	}
+	if f.refresh, err = time.ParseDuration(conf.Refresh); err != nil {
+		f.logger.Panic("features", "Could not parse refresh interval",
+			LogFields{"error": err.Error(), "refresh": conf.Refresh})
+		return err
+	}
+	if f.client.Timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		f.logger.Panic("features", "Could not parse remote timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	if f.remoteURL = conf.RemoteURL; len(f.remoteURL) == 0 {
+		return nil
+	}
+	// Start with the configured flags if the remote flags are unavailable.
+	if err := f.Refresh(); err != nil && f.logger.ShouldLog(WARNING) {
+		f.logger.Warn("features", "Could not load remote feature flags",
+			LogFields{"error": err.Error(), "url": f.remoteURL})
+	}
+	if f.refresh > 0 {
+		go f.run()
+	}
+	return nil
+}
+
+// parseFeature parses a "name=percent" flag.
+func parseFeature(spec string) (name string, percent float64, err error) {
+	i := strings.Index(spec, "=")
+	if i < 1 {
+		return "", 0, ErrInvalidFeature
+	}
+	name = strings.TrimSpace(spec[:i])
+	value := strings.TrimSuffix(strings.TrimSpace(spec[i+1:]), "%")
+	if percent, err = strconv.ParseFloat(value, 64); err != nil {
+		return "", 0, ErrInvalidFeature
+	}
+	if err = checkPercent(percent); err != nil {
+		return "", 0, err
+	}
+	return name, percent, nil
+}
+
+func checkPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Feature percentages must be between 0 and 100: %v",
+			percent)
+	}
+	return nil
+}
+
+func (f *Features) run() {
+	ticker := time.NewTicker(f.refresh)
+	defer ticker.Stop()
+	for ok := true; ok; {
+		select {
+		case ok = <-f.closeSignal:
+		case <-ticker.C:
+			if err := f.Refresh(); err != nil && f.logger.ShouldLog(WARNING) {
+				f.logger.Warn("features", "Could not refresh remote feature flags",
+					LogFields{"error": err.Error(), "url": f.remoteURL})
+			}
+		}
+	}
+}
+
+// Refresh re-reads the remote flags. The current remote flags are kept if
+// the request fails or returns an invalid percentage.
+func (f *Features) Refresh() error {
+	if len(f.remoteURL) == 0 {
+		return nil
+	}
+	resp, err := f.client.Get(f.remoteURL)
+	if err != nil {
+		f.metrics.Increment("features.remote.error")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.metrics.Increment("features.remote.error")
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		f.metrics.Increment("features.remote.error")
+		return err
+	}
+	remote := make(map[string]float64)
+	if err = json.Unmarshal(body, &remote); err != nil {
+		f.metrics.Increment("features.remote.error")
+		return err
+	}
+	for _, percent := range remote {
+		if err = checkPercent(percent); err != nil {
+			f.metrics.Increment("features.remote.error")
+			return err
+		}
+	}
+	f.lock.Lock()
+	f.remote = remote
+	f.lock.Unlock()
+	f.metrics.Increment("features.remote.refreshed")
+	return nil
+}
+
+// Percent returns the rollout percentage of a flag, and where it was set.
+func (f *Features) Percent(name string) (percent float64, source string) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if percent, ok := f.overrides[name]; ok {
+		return percent, "override"
+	}
+	if percent, ok := f.remote[name]; ok {
+		return percent, "remote"
+	}
+	if percent, ok := f.config[name]; ok {
+		return percent, "config"
+	}
+	return featureDefaults[name], "default"
+}
+
+// Enabled indicates whether a flag is enabled for a device. Flags that are
+// neither configured nor have a default are disabled.
+func (f *Features) Enabled(name, uaid string) bool {
+	if f == nil {
+		return featureDefaults[name] >= 100
+	}
+	percent, _ := f.Percent(name)
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	return float64(featureBucket(name, uaid)) < percent*100
+}
+
+// featureBucket assigns a device to one of 10,000 buckets for a flag.
+// Including the flag name keeps rollouts of different flags independent.
+func featureBucket(name, uaid string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(uaid))
+	return h.Sum32() % 10000
+}
+
+// Override sets the rollout percentage of a flag on this node until the
+// next restart, taking precedence over configured and remote flags.
+func (f *Features) Override(name string, percent float64) error {
+	if len(name) == 0 {
+		return ErrInvalidFeature
+	}
+	if err := checkPercent(percent); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.overrides[name] = percent
+	f.lock.Unlock()
+	return nil
+}
+
+// ResetOverride removes the runtime override for a flag.
+func (f *Features) ResetOverride(name string) {
+	f.lock.Lock()
+	delete(f.overrides, name)
+	f.lock.Unlock()
+}
+
+// Flags returns the percentage and source of every known flag, sorted by
+// name.
+func (f *Features) Flags() []*FeatureFlag {
+	f.lock.RLock()
+	names := make(map[string]bool)
+	for _, set := range []map[string]float64{
+		featureDefaults, f.config, f.remote, f.overrides} {
+
+		for name := range set {
+			names[name] = true
+		}
+	}
+	f.lock.RUnlock()
+	flags := make([]*FeatureFlag, 0, len(names))
+	for name := range names {
+		percent, source := f.Percent(name)
+		flags = append(flags, &FeatureFlag{name, percent, source})
+	}
+	sort.Sort(featureFlags(flags))
+	return flags
+}
+
+// Close stops refreshing remote flags.
+func (f *Features) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closeSignal)
+	})
+	return nil
+}
@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	_, app := newTestHandler(t)
+	remote := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{"new_storage": 50}`))
+	}))
+	defer remote.Close()
+
+	features := NewFeatures()
+	conf := features.ConfigStruct().(*FeaturesConfig)
+	conf.Flags = []string{"data=0", "new_storage=5%"}
+	conf.RemoteURL = remote.URL
+	conf.Refresh = "0"
+	if err := features.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing features: %s", err)
+	}
+	defer features.Close()
+
+	if features.Enabled(FeatureData, "uaid") {
+		t.Errorf("Disabled flag enabled")
+	}
+	if features.Enabled("unknown", "uaid") {
+		t.Errorf("Unknown flag enabled")
+	}
+	if percent, source := features.Percent("new_storage"); percent != 50 || source != "remote" {
+		t.Errorf("Wrong percentage: got %v from %s; want 50 from remote", percent, source)
+	}
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		uaid := fmt.Sprintf("%032x", i)
+		ok := features.Enabled("new_storage", uaid)
+		if ok != features.Enabled("new_storage", uaid) {
+			t.Fatalf("Unstable bucket for %s", uaid)
+		}
+		if ok {
+			enabled++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Errorf("Wrong rollout: got %d of 1000 devices; want about 500", enabled)
+	}
+
+	// Overrides take precedence until reset.
+	if err := features.Override(FeatureData, 101); err == nil {
+		t.Errorf("Invalid percentage accepted")
+	}
+	features.Override(FeatureData, 100)
+	if !features.Enabled(FeatureData, "uaid") {
+		t.Errorf("Overridden flag disabled")
+	}
+	features.ResetOverride(FeatureData)
+	if percent, source := features.Percent(FeatureData); percent != 0 || source != "config" {
+		t.Errorf("Override not reset: got %v from %s", percent, source)
+	}
+	if flags := features.Flags(); len(flags) != 2 {
+		t.Errorf("Wrong flag count: got %d; want 2", len(flags))
+	}
+
+	if err := features.Init(app, &FeaturesConfig{
+		Flags: []string{"data"}, Refresh: "0", Timeout: "1s"}); err != ErrInvalidFeature {
+		t.Errorf("Wrong error for invalid flag: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FixtureVersion is the version of the conformance fixture format. It must
+// be incremented whenever a fixture changes in a way that clients can
+// observe.
+const FixtureVersion = 1
+
+// Sample identifiers used in the conformance fixtures.
+const (
+	fixtureUAID     = "d1c7c768b1be4c7093a69b52910d4baa"
+	fixtureNewUAID  = "3c7f3f9e0ce64b0ba2a4d0a6b7e2c0f1"
+	fixtureChannel  = "a7695fa0-9623-4890-9c08-cce0231e4b36"
+	fixtureChannel2 = "6d7b6f3a-3f4c-4f0e-8c0b-2b8a1c6e5f42"
+	fixtureEndpoint = "https://push.example.com/update/AQAAAbcdEFGHijklMNOPqrst"
+	fixtureCursor   = 1420070400
+)
+
+// Fixture directions.
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+// FixtureFrame is a single WebSocket text frame.
+type FixtureFrame struct {
+	Direction string          `json:"direction"`
+	Frame     json.RawMessage `json:"frame"`
+}
+
+// Fixture is a recorded protocol interaction. If Closes is set, the server
+// closes the connection with that code after the last frame.
+type Fixture struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Frames      []*FixtureFrame `json:"frames"`
+	Closes      int             `json:"closeCode,omitempty"`
+}
+
+// FixtureManifest lists the fixtures in a fixture set.
+type FixtureManifest struct {
+	Version       int      `json:"version"`
+	ServerVersion string   `json:"serverVersion"`
+	Fixtures      []string `json:"fixtures"`
+}
+
+type fixtureBuilder struct {
+	fixture *Fixture
+	err     error
+}
+
+func newFixture(name, description string) *fixtureBuilder {
+	return &fixtureBuilder{fixture: &Fixture{Name: name, Description: description}}
+}
+
+func (b *fixtureBuilder) add(direction string, frame interface{}) *fixtureBuilder {
+	if b.err != nil {
+		return b
+	}
+	var data []byte
+	switch v := frame.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		if data, b.err = json.Marshal(frame); b.err != nil {
+			return b
+		}
+	}
+	if !json.Valid(data) {
+		b.err = fmt.Errorf("Invalid frame in fixture '%s': %s", b.fixture.Name, data)
+		return b
+	}
+	b.fixture.Frames = append(b.fixture.Frames,
+		&FixtureFrame{direction, json.RawMessage(data)})
+	return b
+}
+
+func (b *fixtureBuilder) client(frame interface{}) *fixtureBuilder {
+	return b.add(FromClient, frame)
+}
+
+func (b *fixtureBuilder) server(frame interface{}) *fixtureBuilder {
+	return b.add(FromServer, frame)
+}
+
+// fail records a request rejected with the given error. The server echoes
+// the request fields alongside the status, then closes the connection.
+func (b *fixtureBuilder) fail(request JsMap, err error) *fixtureBuilder {
+	if b.err != nil {
+		return b
+	}
+	message, ret := json.Marshal(request)
+	if ret != nil {
+		b.err = ret
+		return b
+	}
+	reply, ret := errorReply(message, err)
+	if ret != nil {
+		b.err = ret
+		return b
+	}
+	b.client(message).server(reply)
+	if code, ok := errToCloseCode[err]; ok {
+		b.bye(code)
+	}
+	return b
+}
+
+func (b *fixtureBuilder) bye(code CloseCode) *fixtureBuilder {
+	b.fixture.Closes = int(code)
+	return b.server(ByeMessage{"bye", int(code), code.Reason(), 0, nil})
+}
+
+func (b *fixtureBuilder) hello() *fixtureBuilder {
+	return b.client(JsMap{"messageType": "hello", "uaid": fixtureUAID,
+		"channelIDs": []string{}}).
+		server(helloReply("hello", 200, fixtureUAID))
+}
+
+// Fixtures returns the conformance fixtures for the current protocol,
+// encoded with the same functions and types that the server uses.
+func Fixtures() (fixtures []*Fixture, err error) {
+	builders := []*fixtureBuilder{
+		newFixture("hello-new-device",
+			"A new device omits its device ID and is assigned one.").
+			client(JsMap{"messageType": "hello", "uaid": "",
+				"channelIDs": []string{}}).
+			server(helloReply("hello", 200, fixtureNewUAID)),
+
+		newFixture("hello-existing-device",
+			"A known device reconnects, resuming from a cursor.").
+			client(JsMap{"messageType": "hello", "uaid": fixtureUAID,
+				"channelIDs": []string{fixtureChannel}, "resume": fixtureCursor}).
+			server(helloReply("hello", 200, fixtureUAID)).
+			server(FlushReply{"notification", []Update{
+				{fixtureChannel, 10, ""}}, nil, fixtureCursor + 60}),
+
+		newFixture("hello-reset",
+			"A device with unknown channels is assigned a new ID and told which channels to re-register.").
+			client(JsMap{"messageType": "hello", "uaid": fixtureUAID,
+				"channelIDs": []string{fixtureChannel, fixtureChannel2}}).
+			server(helloReply("hello", 200, fixtureNewUAID)).
+			server(ResetReply{"reset", fixtureNewUAID,
+				[]string{fixtureChannel, fixtureChannel2}}),
+
+		newFixture("hello-invalid-uaid",
+			"The device ID contains invalid characters.").
+			fail(JsMap{"messageType": "hello", "uaid": "not a device ID!",
+				"channelIDs": []string{}}, ErrInvalidID),
+
+		newFixture("hello-missing-channels",
+			"The handshake omits the channel ID list.").
+			fail(JsMap{"messageType": "hello", "uaid": fixtureUAID},
+				ErrNoParams),
+
+		newFixture("register", "The device registers a channel.").
+			hello().
+			client(JsMap{"messageType": "register", "channelID": fixtureChannel}).
+			server(RegisterReply{"register", fixtureUAID, 200, fixtureChannel,
+				fixtureEndpoint}),
+
+		newFixture("register-shared",
+			"The device registers a channel shared with its other devices.").
+			hello().
+			client(JsMap{"messageType": "register", "channelID": fixtureChannel,
+				"shared": true}).
+			server(RegisterReply{"register", fixtureUAID, 200, fixtureChannel,
+				fixtureEndpoint}),
+
+		newFixture("register-before-hello",
+			"The device registers a channel without completing the handshake.").
+			fail(JsMap{"messageType": "register", "channelID": fixtureChannel},
+				ErrInvalidCommand),
+
+		newFixture("register-invalid-channel",
+			"The channel ID is not a valid UUID.").
+			hello().
+			fail(JsMap{"messageType": "register", "channelID": "abc"},
+				ErrInvalidParams),
+
+		newFixture("unregister", "The device unregisters a channel.").
+			hello().
+			client(JsMap{"messageType": "unregister", "channelID": fixtureChannel}).
+			server(UnregisterReply{"unregister", 200, fixtureChannel}),
+
+		newFixture("registermany", "The device registers several channels at once.").
+			hello().
+			client(JsMap{"messageType": "registerMany",
+				"channelIDs": []string{fixtureChannel, fixtureChannel2}}).
+			server(RegisterManyReply{"registerMany", fixtureUAID, 200,
+				[]*ChannelResult{
+					{ChannelID: fixtureChannel, Status: 200, Endpoint: fixtureEndpoint},
+					{ChannelID: fixtureChannel2, Status: 200, Endpoint: fixtureEndpoint},
+				}}),
+
+		newFixture("registermany-invalid-channel",
+			"A batch registration containing an invalid channel ID is rejected.").
+			hello().
+			fail(JsMap{"messageType": "registerMany",
+				"channelIDs": []string{fixtureChannel, "abc"}}, ErrInvalidParams),
+
+		newFixture("unregistermany", "The device unregisters several channels at once.").
+			hello().
+			client(JsMap{"messageType": "unregisterMany",
+				"channelIDs": []string{fixtureChannel, fixtureChannel2}}).
+			server(RegisterManyReply{"unregisterMany", fixtureUAID, 200,
+				[]*ChannelResult{
+					{ChannelID: fixtureChannel, Status: 200},
+					{ChannelID: fixtureChannel2, Status: 200},
+				}}),
+
+		newFixture("notification-ack",
+			"The server delivers updates, and the device acknowledges them.").
+			hello().
+			server(FlushReply{"notification", []Update{
+				{fixtureChannel, 12, "Hello"},
+				{fixtureChannel2, 3, ""},
+			}, []string{}, fixtureCursor}).
+			client(JsMap{"messageType": "ack", "updates": []Update{
+				{fixtureChannel, 12, "Hello"},
+				{fixtureChannel2, 3, ""},
+			}}),
+
+		newFixture("notification-nack",
+			"The device rejects an update it could not process.").
+			hello().
+			server(FlushReply{"notification", []Update{
+				{fixtureChannel, 13, "Garbled"}}, nil, fixtureCursor}).
+			client(JsMap{"messageType": "nack", "code": 1, "updates": []Update{
+				{fixtureChannel, 13, "Garbled"}}}),
+
+		newFixture("ping", "The device sends a keep-alive ping.").
+			hello().
+			client("{}").
+			server("{}"),
+
+		newFixture("ping-long-pongs",
+			"The device sends a keep-alive ping to a server with push_long_pongs enabled.").
+			hello().
+			client("{}").
+			server(PingReply{"", 200}),
+
+		newFixture("ping-too-frequent",
+			"The device pings more often than the minimum ping interval.").
+			hello().
+			client("{}").
+			server("{}").
+			fail(JsMap{}, ErrTooManyPings),
+
+		newFixture("whoami", "The device asks the server to describe the session.").
+			hello().
+			client(JsMap{"messageType": "whoami"}).
+			server(WhoamiReply{"whoami", 200, fixtureUAID, "http://node.example.com:3000",
+				fixtureCursor, []string{"data", "nack", "registerMany"}, 0, 20, 0}),
+
+		newFixture("unknown-command", "The device sends an unsupported command.").
+			hello().
+			fail(JsMap{"messageType": "frobnicate"}, ErrUnknownCommand),
+	}
+	for _, code := range []CloseCode{CloseGoingAway, CloseUAIDConflict,
+		CloseTooManyChannels, CloseTooManyPings, CloseMissedPongs,
+		CloseHelloTimeout} {
+
+		builders = append(builders, newFixture(fmt.Sprintf("bye-%d", code),
+			fmt.Sprintf("The server closes the connection: %s.", code.Reason())).
+			bye(code))
+	}
+	fixtures = make([]*Fixture, len(builders))
+	for i, b := range builders {
+		if b.err != nil {
+			return nil, b.err
+		}
+		fixtures[i] = b.fixture
+	}
+	return fixtures, nil
+}
+
+// WriteFixtures writes the conformance fixtures and a manifest to a
+// versioned subdirectory of dir, returning the subdirectory path.
+func WriteFixtures(dir string) (path string, err error) {
+	fixtures, err := Fixtures()
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Join(dir, fmt.Sprintf("v%d", FixtureVersion))
+	if err = os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+	manifest := &FixtureManifest{
+		Version:       FixtureVersion,
+		ServerVersion: VERSION,
+		Fixtures:      make([]string, len(fixtures)),
+	}
+	for i, fixture := range fixtures {
+		name := fixture.Name + ".json"
+		if err = writeFixtureFile(filepath.Join(path, name), fixture); err != nil {
+			return "", err
+		}
+		manifest.Fixtures[i] = name
+	}
+	if err = writeFixtureFile(filepath.Join(path, "manifest.json"), manifest); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func writeFixtureFile(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,76 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFixtures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-fixtures")
+	if err != nil {
+		t.Fatalf("Error creating fixture directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := WriteFixtures(dir)
+	if err != nil {
+		t.Fatalf("Error writing fixtures: %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, "manifest.json"))
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err)
+	}
+	manifest := new(FixtureManifest)
+	if err = json.Unmarshal(data, manifest); err != nil {
+		t.Fatalf("Error decoding manifest: %s", err)
+	}
+	if manifest.Version != FixtureVersion {
+		t.Errorf("Wrong fixture version: got %d; want %d", manifest.Version,
+			FixtureVersion)
+	}
+	fixtures := make(map[string]*Fixture)
+	for _, name := range manifest.Fixtures {
+		if data, err = ioutil.ReadFile(filepath.Join(path, name)); err != nil {
+			t.Fatalf("Error reading fixture %s: %s", name, err)
+		}
+		fixture := new(Fixture)
+		if err = json.Unmarshal(data, fixture); err != nil {
+			t.Fatalf("Error decoding fixture %s: %s", name, err)
+		}
+		if len(fixture.Frames) == 0 {
+			t.Errorf("Fixture %s has no frames", name)
+		}
+		fixtures[fixture.Name] = fixture
+	}
+
+	// Error fixtures echo the request with the status and error message.
+	fixture, ok := fixtures["hello-invalid-uaid"]
+	if !ok {
+		t.Fatal("Missing fixture for invalid device IDs")
+	}
+	reply := make(map[string]interface{})
+	if err = json.Unmarshal(fixture.Frames[1].Frame, &reply); err != nil {
+		t.Fatalf("Error decoding error reply: %s", err)
+	}
+	if reply["status"] != float64(503) || reply["uaid"] != "not a device ID!" {
+		t.Errorf("Wrong error reply: %#v", reply)
+	}
+
+	// Fatal errors are followed by a bye message.
+	fixture = fixtures["ping-too-frequent"]
+	if fixture == nil || fixture.Closes != int(CloseTooManyPings) {
+		t.Fatalf("Wrong close code for ping flood fixture: %#v", fixture)
+	}
+	bye := new(ByeMessage)
+	last := fixture.Frames[len(fixture.Frames)-1]
+	if err = json.Unmarshal(last.Frame, bye); err != nil || bye.Type != "bye" {
+		t.Errorf("Expected final frame to be a bye message: %s", last.Frame)
+	}
+}
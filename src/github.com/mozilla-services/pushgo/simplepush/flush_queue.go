@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sort"
+	"sync"
+)
+
+// flushQueue holds the flushes waiting to be written to a client, so that
+// slow storage fetches and socket writes do not block command handling.
+// Queued flushes are merged:
+//   - A full flush absorbs later full flushes, fetching from the earlier of
+//     their cutoff times.
+//   - Direct updates for the same channel keep the highest version.
+//   - Direct updates are sent with a queued full flush, so that their data
+//     is not lost.
+//
+// If more than depth channels have queued direct updates, the updates are
+// dropped in favor of a full flush. Versions are stored before they are
+// flushed, so the client still receives them, but without their data.
+type flushQueue struct {
+	lock     sync.Mutex
+	depth    int
+	full     bool
+	since    int64
+	updates  map[string]Update // Keyed by channel ID.
+	draining bool
+}
+
+func newFlushQueue(depth int) *flushQueue {
+	return &flushQueue{depth: depth, updates: make(map[string]Update)}
+}
+
+// Push queues a flush: a full flush if channel is empty, or a direct update.
+// Returns whether the caller should start draining the queue, and whether
+// queued updates were dropped.
+func (q *flushQueue) Push(lastAccessed int64, channel string, version int64,
+	data string) (drain, dropped bool) {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(channel) == 0 {
+		if !q.full || lastAccessed < q.since {
+			q.since = lastAccessed
+		}
+		q.full = true
+	} else {
+		update := Update{channel, uint64(version), data}
+		if current, ok := q.updates[channel]; ok {
+			if update.Version > current.Version ||
+				update.Version == current.Version && len(current.Data) == 0 {
+				q.updates[channel] = update
+			}
+		} else if len(q.updates) >= q.depth {
+			q.full, q.since = true, 0
+			q.updates = make(map[string]Update)
+			dropped = true
+		} else {
+			q.updates[channel] = update
+		}
+	}
+	if !q.draining {
+		q.draining = true
+		drain = true
+	}
+	return
+}
+
+// Take removes and returns the queued flushes, in a single batch. ok is
+// false once the queue is empty, and the caller must stop draining.
+func (q *flushQueue) Take() (full bool, since int64, updates []Update, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.full && len(q.updates) == 0 {
+		q.draining = false
+		return false, 0, nil, false
+	}
+	full, since = q.full, q.since
+	updates = make([]Update, 0, len(q.updates))
+	for _, update := range q.updates {
+		updates = append(updates, update)
+	}
+	sort.Sort(updatesByChannel(updates))
+	q.full, q.since = false, 0
+	q.updates = make(map[string]Update)
+	return full, since, updates, true
+}
@@ -0,0 +1,68 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlushQueueMerge(t *testing.T) {
+	q := newFlushQueue(10)
+	if drain, _ := q.Push(0, "a", 1, "one"); !drain {
+		t.Fatalf("First flush did not start draining")
+	}
+	if drain, _ := q.Push(0, "a", 3, "three"); drain {
+		t.Errorf("Second flush started another drain")
+	}
+	q.Push(0, "a", 2, "two")
+	q.Push(0, "b", 1, "")
+	full, _, updates, ok := q.Take()
+	if !ok || full {
+		t.Fatalf("Wrong batch: ok=%v full=%v", ok, full)
+	}
+	expected := []Update{{"a", 3, "three"}, {"b", 1, ""}}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Wrong merged updates: got %v; want %v", updates, expected)
+	}
+	if _, _, _, ok = q.Take(); ok {
+		t.Errorf("Empty queue returned a batch")
+	}
+	if drain, _ := q.Push(0, "a", 4, ""); !drain {
+		t.Errorf("Flush after draining did not start draining")
+	}
+}
+
+func TestFlushQueueFull(t *testing.T) {
+	q := newFlushQueue(10)
+	q.Push(100, "", 0, "")
+	q.Push(0, "a", 1, "data")
+	q.Push(50, "", 0, "")
+	full, since, updates, ok := q.Take()
+	if !ok || !full || since != 50 {
+		t.Fatalf("Wrong full flush: ok=%v full=%v since=%d", ok, full, since)
+	}
+	// Direct updates are sent with the full flush, keeping their data.
+	if len(updates) != 1 || updates[0].Data != "data" {
+		t.Errorf("Wrong updates for full flush: %v", updates)
+	}
+}
+
+func TestFlushQueueOverflow(t *testing.T) {
+	q := newFlushQueue(2)
+	q.Push(0, "a", 1, "")
+	q.Push(0, "b", 1, "")
+	if _, dropped := q.Push(0, "a", 2, ""); dropped {
+		t.Errorf("Merged update dropped queued updates")
+	}
+	if _, dropped := q.Push(0, "c", 1, ""); !dropped {
+		t.Errorf("Overflow did not drop queued updates")
+	}
+	full, since, updates, _ := q.Take()
+	if !full || since != 0 || len(updates) != 0 {
+		t.Errorf("Wrong batch after overflow: full=%v since=%d updates=%v",
+			full, since, updates)
+	}
+}
@@ -6,6 +6,8 @@ package simplepush
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -34,13 +36,21 @@ type GomemcDriverConf struct {
 type GomemcStore struct {
 	Hosts         []string
 	PingPrefix    string
+	AccessPrefix  string
+	GroupPrefix   string
+	RoutePrefix   string
+	APIKeyPrefix  string
+	OutcomePrefix string
+	NoncePrefix   string
 	TimeoutLive   time.Duration
 	TimeoutReg    time.Duration
 	TimeoutDel    time.Duration
 	HandleTimeout time.Duration
 	maxChannels   int
 	defaultHost   string
+	app           *Application
 	logger        *SimpleLogger
+	pingCipher    *PingCipher
 	client        *mc.Client
 }
 
@@ -66,6 +76,12 @@ func (*GomemcStore) ConfigStruct() interface{} {
 			TimeoutDel:    24 * 60 * 60,
 			HandleTimeout: "5s",
 			PingPrefix:    "_pc-",
+			AccessPrefix:  "_la-",
+			GroupPrefix:   "_gm-",
+			RoutePrefix:   "_rt-",
+			APIKeyPrefix:  "_ak-",
+			OutcomePrefix: "_po-",
+			NoncePrefix:   "_hn-",
 		},
 	}
 }
@@ -74,6 +90,7 @@ func (*GomemcStore) ConfigStruct() interface{} {
 // Implements HasConfigStruct.Init().
 func (s *GomemcStore) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*GomemcConf)
+	s.app = app
 	s.logger = app.Logger()
 	s.defaultHost = app.Hostname()
 	s.maxChannels = conf.MaxChannels
@@ -98,6 +115,17 @@ func (s *GomemcStore) Init(app *Application, config interface{}) (err error) {
 	}
 
 	s.PingPrefix = conf.Db.PingPrefix
+	if s.pingCipher, err = NewPingCipher(conf.Db.PingKeys, conf.Db.PingKeyID); err != nil {
+		s.logger.Panic("gomemc", "Invalid proprietary ping keys",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	s.AccessPrefix = conf.Db.AccessPrefix
+	s.GroupPrefix = conf.Db.GroupPrefix
+	s.RoutePrefix = conf.Db.RoutePrefix
+	s.APIKeyPrefix = conf.Db.APIKeyPrefix
+	s.OutcomePrefix = conf.Db.OutcomePrefix
+	s.NoncePrefix = conf.Db.NoncePrefix
 
 	if s.HandleTimeout, err = time.ParseDuration(conf.Db.HandleTimeout); err != nil {
 		s.logger.Panic("gomemc", "Db.HandleTimeout must be a valid duration",
@@ -155,6 +183,23 @@ func (s *GomemcStore) IDsToKey(uaid, chid string) (string, bool) {
 	return fmt.Sprintf("%s.%s", uaid, chid), true
 }
 
+// tenantKey prefixes a storage key for the given device ID with the key
+// prefix of the device's tenant, so that the records of each tenant are
+// kept apart. Keys of devices without a tenant are unchanged.
+func (s *GomemcStore) tenantKey(uaid, key string) string {
+	return tenantKeyPrefix(s.app, uaid) + key
+}
+
+// recordKey returns the storage key of the channel record with the given
+// primary key.
+func (s *GomemcStore) recordKey(pk string) string {
+	uaid := pk
+	if dot := strings.IndexByte(pk, '.'); dot >= 0 {
+		uaid = pk[:dot]
+	}
+	return s.tenantKey(uaid, pk)
+}
+
 // Status queries whether memcached is available for reading and writing.
 // Implements Store.Status().
 func (s *GomemcStore) Status() (success bool, err error) {
@@ -205,7 +250,7 @@ func (s *GomemcStore) Exists(uaid string) bool {
 	if !id.Valid(uaid) {
 		return false
 	}
-	if _, err = s.client.Get(uaid); err != nil && err != mc.ErrCacheMiss {
+	if _, err = s.client.Get(s.tenantKey(uaid, uaid)); err != nil && err != mc.ErrCacheMiss {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("gomemc", "Exists encountered unknown error",
 				LogFields{"uaid": uaid, "error": err.Error()})
@@ -262,6 +307,35 @@ func (s *GomemcStore) Register(uaid, chid string, version int64) (err error) {
 	return s.storeRegister(uaid, chid, version)
 }
 
+// RegisterMany creates channel records for the given channel IDs. The
+// records are written before the subscription list; if any write fails, the
+// records are restored and the subscription list is unchanged. Implements
+// BatchStore.RegisterMany().
+func (s *GomemcStore) RegisterMany(uaid string, chids []string, version int64) (err error) {
+	if err = validBatch(uaid, chids); err != nil {
+		return err
+	}
+	existing, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	return registerMany(s, s.logger, "gomemc", uaid, existing, chids, version)
+}
+
+// UnregisterMany removes the given channel IDs from the subscription list in
+// a single write, then marks their records as deleted. Fails without changes
+// if any channel is not registered. Implements BatchStore.UnregisterMany().
+func (s *GomemcStore) UnregisterMany(uaid string, chids []string) (err error) {
+	if err = validBatch(uaid, chids); err != nil {
+		return err
+	}
+	existing, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	return unregisterMany(s, s.logger, "gomemc", uaid, existing, chids)
+}
+
 // Updates a channel record in memcached.
 func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
 	key, ok := s.IDsToKey(uaid, chid)
@@ -405,7 +479,7 @@ func (s *GomemcStore) Drop(uaid, chid string) (err error) {
 	if !ok {
 		return ErrInvalidKey
 	}
-	if err = s.client.Delete(key); err != nil && err != mc.ErrCacheMiss {
+	if err = s.client.Delete(s.recordKey(key)); err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
 	return nil
@@ -440,7 +514,7 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 	sinceUnix := since.Unix()
 	for index, key := range keys {
 		channel := new(ChannelRecord)
-		raw, err := s.client.Get(key)
+		raw, err := s.client.Get(s.recordKey(key))
 		if err != nil {
 			continue
 		}
@@ -503,6 +577,47 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 	return updates, expired, nil
 }
 
+// ChannelIDs returns the device's channel ID list. Implements
+// ChannelLister.ChannelIDs().
+func (s *GomemcStore) ChannelIDs(uaid string) ([]string, error) {
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return nil, err
+	}
+	return chids, nil
+}
+
+// Channels returns the channels registered to a device. Implements
+// ChannelLister.Channels().
+func (s *GomemcStore) Channels(uaid string) ([]RegisteredChannel, error) {
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return nil, err
+	}
+	channels := make([]RegisteredChannel, 0, len(chids))
+	for _, chid := range chids {
+		key, _ := s.IDsToKey(uaid, chid)
+		rec, err := s.fetchRec(key)
+		if err != nil {
+			return nil, err
+		}
+		if rec.State == StateDeleted {
+			continue
+		}
+		channels = append(channels, RegisteredChannel{
+			ChannelID:   chid,
+			LastTouched: time.Unix(rec.LastTouched, 0),
+		})
+	}
+	return channels, nil
+}
+
 // DropAll removes all channel records for the given device ID. Implements
 // Store.DropAll().
 func (s *GomemcStore) DropAll(uaid string) error {
@@ -518,9 +633,9 @@ func (s *GomemcStore) DropAll(uaid string) error {
 		if !ok {
 			return ErrInvalidKey
 		}
-		s.client.Delete(key)
+		s.client.Delete(s.recordKey(key))
 	}
-	if err = s.client.Delete(uaid); err != nil && err != mc.ErrCacheMiss {
+	if err = s.client.Delete(s.tenantKey(uaid, uaid)); err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
 	return nil
@@ -535,11 +650,11 @@ func (s *GomemcStore) FetchPing(uaid string) (pingData []byte, err error) {
 	if !id.Valid(uaid) {
 		return nil, ErrInvalidID
 	}
-	raw, err := s.client.Get(s.PingPrefix + uaid)
+	raw, err := s.client.Get(s.tenantKey(uaid, s.PingPrefix+uaid))
 	if err != nil {
 		return nil, err
 	}
-	return raw.Value, nil
+	return s.pingCipher.Open(uaid, raw.Value)
 }
 
 // PutPing stores the proprietary ping info blob for the given device ID in
@@ -548,12 +663,144 @@ func (s *GomemcStore) PutPing(uaid string, pingData []byte) error {
 	if !id.Valid(uaid) {
 		return ErrInvalidID
 	}
+	sealed, err := s.pingCipher.Seal(uaid, pingData)
+	if err != nil {
+		return err
+	}
 	return s.client.Set(&mc.Item{
-		Key:        s.PingPrefix + uaid,
-		Value:      pingData,
+		Key:        s.tenantKey(uaid, s.PingPrefix+uaid),
+		Value:      sealed,
 		Expiration: 0})
 }
 
+// PutAccessed stores the last-access times for a batch of devices. Entries
+// expire along with the device's channel records. Implements
+// AccessStore.PutAccessed().
+func (s *GomemcStore) PutAccessed(accessed map[string]time.Time) (err error) {
+	for uaid, lastAccess := range accessed {
+		if !id.Valid(uaid) {
+			continue
+		}
+		err := s.client.Set(&mc.Item{
+			Key:        s.tenantKey(uaid, s.AccessPrefix+uaid),
+			Value:      []byte(strconv.FormatInt(lastAccess.Unix(), 10)),
+			Expiration: int32(s.TimeoutLive / time.Second)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddMember adds a device to a shared channel. Implements
+// GroupStore.AddMember().
+func (s *GomemcStore) AddMember(chid, uaid string, join bool) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	var denied bool
+	err := s.updateMembers(chid, func(members ChannelIDs) ChannelIDs {
+		if members.IndexOf(uaid) >= 0 {
+			return nil
+		}
+		if denied = len(members) > 0 && !join; denied {
+			return nil
+		}
+		return append(members, uaid)
+	})
+	if err == nil && denied {
+		return ErrSharedChannelJoin
+	}
+	return err
+}
+
+// RemoveMember removes a device from a shared channel. Implements
+// GroupStore.RemoveMember().
+func (s *GomemcStore) RemoveMember(chid, uaid string) error {
+	return s.updateMembers(chid, func(members ChannelIDs) ChannelIDs {
+		pos := members.IndexOf(uaid)
+		if pos < 0 {
+			return nil
+		}
+		return remove(members, pos)
+	})
+}
+
+// Members returns the devices registered for a shared channel. Implements
+// GroupStore.Members().
+func (s *GomemcStore) Members(chid string) (members []string, err error) {
+	if !id.Valid(chid) {
+		return nil, ErrInvalidChannel
+	}
+	item, err := s.client.Get(s.GroupPrefix + chid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(item.Value) == 0 {
+		// Removed with the last member.
+		return nil, nil
+	}
+	if err = json.Unmarshal(item.Value, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// updateMembers applies a change to a shared channel's member list, retrying
+// if the list is modified concurrently. The change function returns nil if
+// the list should be left as-is. Lists do not expire; empty lists are
+// cleared with a compare-and-swap, like routes, and expire after a second.
+// Items returned by Get do not carry their expiration, so every write sets
+// it explicitly.
+func (s *GomemcStore) updateMembers(chid string, change func(ChannelIDs) ChannelIDs) error {
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	key := s.GroupPrefix + chid
+	for attempt := 0; attempt < 5; attempt++ {
+		var members ChannelIDs
+		item, err := s.client.Get(key)
+		if err == nil {
+			if len(item.Value) > 0 {
+				if err = json.Unmarshal(item.Value, &members); err != nil {
+					return err
+				}
+			}
+		} else if err != mc.ErrCacheMiss {
+			return err
+		}
+		updated := change(members)
+		if updated == nil {
+			return nil
+		}
+		var raw []byte
+		var expiration int32
+		if len(updated) > 0 {
+			if raw, err = json.Marshal(updated); err != nil {
+				return err
+			}
+		} else {
+			expiration = 1
+		}
+		if item == nil {
+			if len(raw) == 0 {
+				return nil
+			}
+			err = s.client.Add(&mc.Item{Key: key, Value: raw})
+		} else {
+			item.Value, item.Expiration = raw, expiration
+			err = s.client.CompareAndSwap(item)
+		}
+		if err != mc.ErrCASConflict && err != mc.ErrNotStored {
+			return err
+		}
+	}
+	return ErrRecordUpdateFailed
+}
+
 // DropPing removes all proprietary ping info for the given device ID.
 // Implements Store.DropPing().
 func (s *GomemcStore) DropPing(uaid string) error {
@@ -563,7 +810,145 @@ func (s *GomemcStore) DropPing(uaid string) error {
 	if !id.Valid(uaid) {
 		return ErrInvalidID
 	}
-	return s.client.Delete(s.PingPrefix + uaid)
+	return s.client.Delete(s.tenantKey(uaid, s.PingPrefix+uaid))
+}
+
+// PutRoute records the routing URL of the node connected to the device.
+// Routes expire along with the device's channel records. Implements
+// RouteStore.PutRoute().
+func (s *GomemcStore) PutRoute(uaid, routeURL string) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.tenantKey(uaid, s.RoutePrefix+uaid),
+		Value:      []byte(routeURL),
+		Expiration: int32(s.TimeoutLive / time.Second)})
+}
+
+// FetchRoute returns the routing URL of the node connected to the device.
+// Implements RouteStore.FetchRoute().
+func (s *GomemcStore) FetchRoute(uaid string) (routeURL string, err error) {
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	raw, err := s.client.Get(s.tenantKey(uaid, s.RoutePrefix+uaid))
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw.Value), nil
+}
+
+// DropRoute removes the device's route if it still points to the given
+// node. Implements RouteStore.DropRoute().
+func (s *GomemcStore) DropRoute(uaid, routeURL string) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	key := s.tenantKey(uaid, s.RoutePrefix+uaid)
+	raw, err := s.client.Get(key)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil
+		}
+		return err
+	}
+	if string(raw.Value) != routeURL {
+		// The device reconnected to another node.
+		return nil
+	}
+	// Clear the route with a compare-and-swap, so that a route stored
+	// concurrently by another node is kept. Empty routes are treated as
+	// missing, and expire after a second.
+	raw.Value, raw.Expiration = nil, 1
+	if err = s.client.CompareAndSwap(raw); err != nil &&
+		err != mc.ErrCASConflict && err != mc.ErrNotStored && err != mc.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// PutPingOutcome records the result of the last proprietary ping sent to the
+// device. Outcomes expire along with the device's channel records.
+// Implements PingOutcomeStore.PutPingOutcome().
+func (s *GomemcStore) PutPingOutcome(uaid string, outcome *PingOutcome) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	raw, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.tenantKey(uaid, s.OutcomePrefix+uaid),
+		Value:      raw,
+		Expiration: int32(s.TimeoutLive / time.Second)})
+}
+
+// FetchPingOutcome returns the result of the last proprietary ping sent to
+// the device, or nil if no outcome was recorded. Implements
+// PingOutcomeStore.FetchPingOutcome().
+func (s *GomemcStore) FetchPingOutcome(uaid string) (*PingOutcome, error) {
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	raw, err := s.client.Get(s.tenantKey(uaid, s.OutcomePrefix+uaid))
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	outcome := new(PingOutcome)
+	if err = json.Unmarshal(raw.Value, outcome); err != nil {
+		return nil, err
+	}
+	return outcome, nil
+}
+
+// FetchAPIKey returns the app server API key with the given hash, or nil
+// if there is no such key. Implements APIKeyStore.FetchAPIKey().
+func (s *GomemcStore) FetchAPIKey(hash string) (*APIKey, error) {
+	raw, err := s.client.Get(s.APIKeyPrefix + hash)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	key := new(APIKey)
+	if err = json.Unmarshal(raw.Value, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// PutAPIKey stores an app server API key under the given hash. Keys do not
+// expire. Implements APIKeyStore.PutAPIKey().
+func (s *GomemcStore) PutAPIKey(hash string, key *APIKey) error {
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{Key: s.APIKeyPrefix + hash, Value: value})
+}
+
+// AddNonce records a Hawk nonce under its SHA-256 hash, which is safe to
+// use as a memcached key. Implements NonceStore.AddNonce().
+func (s *GomemcStore) AddNonce(nonce string, ttl time.Duration) (bool, error) {
+	sum := sha256.Sum256([]byte(nonce))
+	expiration := int32((ttl + time.Second - 1) / time.Second)
+	err := s.client.Add(&mc.Item{
+		Key:        s.NoncePrefix + hex.EncodeToString(sum[:]),
+		Value:      []byte{1},
+		Expiration: expiration})
+	if err == mc.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 // Returns a duplicate-free list of subscriptions associated with the device
@@ -572,7 +957,7 @@ func (s *GomemcStore) fetchAppIDArray(uaid string) (result ChannelIDs, err error
 	if len(uaid) == 0 {
 		return nil, nil
 	}
-	raw, err := s.client.Get(uaid)
+	raw, err := s.client.Get(s.tenantKey(uaid, uaid))
 	if err != nil {
 		if err != mc.ErrCacheMiss {
 			if s.logger.ShouldLog(ERROR) {
@@ -616,7 +1001,7 @@ func (s *GomemcStore) storeAppIDArray(uaid string, chids ChannelIDs) error {
 		}
 		return err
 	}
-	return s.client.Set(&mc.Item{Key: uaid, Value: raw, Expiration: 0})
+	return s.client.Set(&mc.Item{Key: s.tenantKey(uaid, uaid), Value: raw, Expiration: 0})
 }
 
 // Retrieves a channel record from memcached. Returns an empty record if the
@@ -626,7 +1011,7 @@ func (s *GomemcStore) fetchRec(pk string) (*ChannelRecord, error) {
 		return nil, ErrNoKey
 	}
 	result := new(ChannelRecord)
-	raw, err := s.client.Get(pk)
+	raw, err := s.client.Get(s.recordKey(pk))
 	if err != nil {
 		if err != mc.ErrCacheMiss {
 			if s.logger.ShouldLog(ERROR) {
@@ -684,7 +1069,7 @@ func (s *GomemcStore) storeRec(pk string, rec *ChannelRecord) error {
 		return err
 	}
 	err = s.client.Set(&mc.Item{
-		Key:        pk,
+		Key:        s.recordKey(pk),
 		Value:      raw,
 		Expiration: int32(ttl.Seconds()),
 	})
@@ -696,6 +1081,15 @@ func (s *GomemcStore) storeRec(pk string, rec *ChannelRecord) error {
 			})
 		}
 	}
+	return err
+}
+
+// Removes a channel record from memcached.
+func (s *GomemcStore) dropRec(pk string) error {
+	err := s.client.Delete(s.recordKey(pk))
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,506 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrGossipIsolated = errors.New("No gossip peers reachable")
+
+// maxGossipBody is the maximum size of a gossip request or response body.
+const maxGossipBody = maxPeerBody
+
+const (
+	// minGossipBuckets is the smallest number of buckets that a node
+	// advertises.
+	minGossipBuckets = 64
+
+	// gossipBucketsPerDevice is the number of buckets advertised per
+	// connected device, which keeps about a fifth of a node's buckets set.
+	gossipBucketsPerDevice = 4
+)
+
+type GossipLocatorConf struct {
+	// Seeds are the routing URLs of nodes contacted to join the cluster.
+	Seeds []string `env:"seeds"`
+
+	// Interval is the amount of time between gossip rounds. Each node
+	// increments its heartbeat once per round.
+	Interval string `env:"interval"`
+
+	// Fanout is the number of peers contacted each round.
+	Fanout int `env:"fanout"`
+
+	// Timeout is the maximum amount of time to wait for a peer to respond.
+	Timeout string `env:"timeout"`
+
+	// SuspectTimeout is the amount of time without a heartbeat after which a
+	// peer is excluded from routing. DeadTimeout is the amount of time after
+	// which the peer is removed from the member list.
+	SuspectTimeout string `toml:"suspect_timeout" env:"suspect_timeout"`
+	DeadTimeout    string `toml:"dead_timeout" env:"dead_timeout"`
+
+	// Buckets is the maximum number of buckets that device IDs are hashed
+	// into, rounded up to a power of two. Each node advertises the buckets of
+	// its connected devices, sized to the number of devices so that nodes
+	// with many connections do not set every bucket, and updates are only
+	// broadcast to peers that advertise the device's bucket. Set to 0 to
+	// broadcast to all live peers.
+	Buckets int `env:"buckets"`
+}
+
+// gossipMember is the state of a node, as exchanged between peers. Buckets
+// is a bit set of BucketCount buckets.
+type gossipMember struct {
+	URL         string `json:"url"`
+	Heartbeat   int64  `json:"heartbeat"`
+	BucketCount int    `json:"bucket_count,omitempty"`
+	Buckets     []byte `json:"buckets,omitempty"`
+}
+
+// gossipDigest is the body of a gossip request and response.
+type gossipDigest struct {
+	Members []gossipMember `json:"members"`
+}
+
+type memberState struct {
+	gossipMember
+	updated time.Time // Local time at which the heartbeat last advanced.
+}
+
+// GossipLocator discovers peers through push-pull gossip over the router
+// listener. Each round, a node sends its member list to a few random peers,
+// which reply with theirs; members whose heartbeats stop advancing are
+// excluded from routing within SuspectTimeout. Nodes also share which device
+// ID buckets they hold connections for, so that broadcasts skip peers that
+// cannot accept the update.
+type GossipLocator struct {
+	logger         *SimpleLogger
+	metrics        Statistician
+	router         *Router
+	client         *http.Client
+	self           string
+	seeds          []string
+	interval       time.Duration
+	fanout         int
+	suspectTimeout time.Duration
+	deadTimeout    time.Duration
+	bucketCounts   []int32 // Accessed atomically.
+	devices        int32   // Accessed atomically.
+	heartbeat      int64
+	lastExchange   time.Time
+	lock           sync.RWMutex
+	members        map[string]*memberState
+	closeSignal    chan bool
+	closeWait      sync.WaitGroup
+	closeOnce      sync.Once
+}
+
+func (*GossipLocator) ConfigStruct() interface{} {
+	return &GossipLocatorConf{
+		Interval:       "1s",
+		Fanout:         3,
+		Timeout:        "500ms",
+		SuspectTimeout: "5s",
+		DeadTimeout:    "1m",
+		Buckets:        1 << 16,
+	}
+}
+
+func (l *GossipLocator) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*GossipLocatorConf)
+	l.logger = app.Logger()
+	l.metrics = app.Metrics()
+	l.fanout = conf.Fanout
+	l.members = make(map[string]*memberState)
+	l.closeSignal = make(chan bool)
+	if router := app.Router(); router != nil {
+		l.self = router.URL()
+	}
+	for _, seed := range conf.Seeds {
+		if seed != l.self {
+			l.seeds = append(l.seeds, seed)
+		}
+	}
+
+	if l.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		l.logger.Panic("gossip", "Could not parse gossip interval",
+			LogFields{"error": err.Error(), "interval": conf.Interval})
+		return err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		l.logger.Panic("gossip", "Could not parse gossip timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	if l.router = app.Router(); l.router != nil {
+		// Gossip with peers over the routing listener's TLS settings.
+		l.client = l.router.HTTPClient(timeout)
+	} else {
+		l.client = &http.Client{Timeout: timeout}
+	}
+	if l.suspectTimeout, err = time.ParseDuration(conf.SuspectTimeout); err != nil {
+		l.logger.Panic("gossip", "Could not parse suspect timeout",
+			LogFields{"error": err.Error(), "timeout": conf.SuspectTimeout})
+		return err
+	}
+	if l.deadTimeout, err = time.ParseDuration(conf.DeadTimeout); err != nil {
+		l.logger.Panic("gossip", "Could not parse dead timeout",
+			LogFields{"error": err.Error(), "timeout": conf.DeadTimeout})
+		return err
+	}
+
+	// Heartbeats start from the current time, so that peers accept the
+	// state of a restarted node.
+	l.heartbeat = time.Now().UnixNano()
+
+	if conf.Buckets > 0 {
+		buckets := minGossipBuckets
+		for buckets < conf.Buckets {
+			buckets <<= 1
+		}
+		l.bucketCounts = make([]int32, buckets)
+		app.Events().Subscribe(EventClientConnected, func(event *Event) {
+			l.trackClient(event.UAID, 1)
+		})
+		app.Events().Subscribe(EventClientDisconnected, func(event *Event) {
+			l.trackClient(event.UAID, -1)
+		})
+	}
+
+	l.closeWait.Add(1)
+	go l.gossipLoop()
+	return nil
+}
+
+// Contacts returns a shuffled list of live peers. If the locator tracks
+// buckets, only peers that advertise the device's bucket are returned, unless
+// no peer does.
+func (l *GossipLocator) Contacts(uaid string) (contacts []string, err error) {
+	now := time.Now()
+	hash, hashed := l.hash(uaid)
+	var all []string
+	l.lock.RLock()
+	for url, member := range l.members {
+		if now.Sub(member.updated) >= l.suspectTimeout {
+			continue
+		}
+		all = append(all, url)
+		if hashed && member.hasBucket(hash) {
+			contacts = append(contacts, url)
+		}
+	}
+	l.lock.RUnlock()
+	if !hashed || len(contacts) == 0 {
+		contacts = all
+	}
+	for length := len(contacts); length > 0; {
+		i := rand.Intn(length)
+		length--
+		contacts[i], contacts[length] = contacts[length], contacts[i]
+	}
+	return contacts, nil
+}
+
+// Alive indicates whether a peer's heartbeat has advanced within the
+// suspect timeout. Implements MemberChecker.Alive().
+func (l *GossipLocator) Alive(contact string) bool {
+	if contact == l.self {
+		return true
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	member, ok := l.members[contact]
+	return ok && time.Since(member.updated) < l.suspectTimeout
+}
+
+// Status reports whether the node has exchanged state with a peer recently.
+// Nodes without seeds form a cluster of one. Implements Locator.Status().
+func (l *GossipLocator) Status() (bool, error) {
+	if len(l.seeds) == 0 {
+		return true, nil
+	}
+	l.lock.RLock()
+	lastExchange := l.lastExchange
+	l.lock.RUnlock()
+	if time.Since(lastExchange) >= l.suspectTimeout {
+		return false, ErrGossipIsolated
+	}
+	return true, nil
+}
+
+func (l *GossipLocator) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeSignal)
+		l.closeWait.Wait()
+	})
+	return nil
+}
+
+// ServeHTTP handles a gossip exchange from a peer, replying with the local
+// member list.
+func (l *GossipLocator) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := new(gossipDigest)
+	body := http.MaxBytesReader(resp, req.Body, maxGossipBody)
+	if err := json.NewDecoder(body).Decode(digest); err != nil {
+		http.Error(resp, "Invalid gossip digest", http.StatusBadRequest)
+		return
+	}
+	l.merge(digest.Members)
+	l.metrics.Increment("locator.gossip.received")
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(l.digest())
+}
+
+func (l *GossipLocator) gossipLoop() {
+	defer l.closeWait.Done()
+	l.round()
+	ticker := time.NewTicker(l.interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-l.closeSignal:
+		case <-ticker.C:
+			l.round()
+		}
+	}
+	ticker.Stop()
+}
+
+// round advances the local heartbeat, exchanges state with up to Fanout
+// peers, and removes dead members.
+func (l *GossipLocator) round() {
+	atomic.AddInt64(&l.heartbeat, 1)
+	digest := l.digest()
+	targets := l.targets()
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			l.exchange(target, digest)
+		}(target)
+	}
+	wg.Wait()
+	l.reap()
+}
+
+// targets selects random live or suspect peers to contact. Seeds are
+// contacted if no peers are known, and occasionally otherwise, so that
+// partitioned clusters rejoin.
+func (l *GossipLocator) targets() []string {
+	l.lock.RLock()
+	peers := make([]string, 0, len(l.members))
+	for url := range l.members {
+		peers = append(peers, url)
+	}
+	l.lock.RUnlock()
+	for length := len(peers); length > 0; {
+		i := rand.Intn(length)
+		length--
+		peers[i], peers[length] = peers[length], peers[i]
+	}
+	if len(peers) > l.fanout {
+		peers = peers[:l.fanout]
+	}
+	if len(l.seeds) > 0 && (len(peers) == 0 || rand.Intn(len(peers)+1) == 0) {
+		seed := l.seeds[rand.Intn(len(l.seeds))]
+		for _, peer := range peers {
+			if peer == seed {
+				return peers
+			}
+		}
+		peers = append(peers, seed)
+	}
+	return peers
+}
+
+func (l *GossipLocator) exchange(target string, digest *gossipDigest) {
+	body, err := json.Marshal(digest)
+	if err != nil {
+		return
+	}
+	var req *http.Request
+	if l.router != nil {
+		// Sign the exchange, so that peers only merge state from known nodes.
+		req, err = l.router.NewPeerRequest("POST", target+"/gossip", body)
+	} else {
+		req, err = http.NewRequest("POST", target+"/gossip", bytes.NewReader(body))
+	}
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		if l.logger.ShouldLog(DEBUG) {
+			l.logger.Debug("gossip", "Could not contact peer",
+				LogFields{"peer": target, "error": err.Error()})
+		}
+		l.metrics.Increment("locator.gossip.error")
+		return
+	}
+	defer resp.Body.Close()
+	reply := new(gossipDigest)
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(resp.Status)
+	} else {
+		err = json.NewDecoder(http.MaxBytesReader(nil, resp.Body,
+			maxGossipBody)).Decode(reply)
+	}
+	if err != nil {
+		if l.logger.ShouldLog(WARNING) {
+			l.logger.Warn("gossip", "Invalid gossip reply",
+				LogFields{"peer": target, "error": err.Error()})
+		}
+		l.metrics.Increment("locator.gossip.error")
+		return
+	}
+	l.merge(reply.Members)
+	l.lock.Lock()
+	l.lastExchange = time.Now()
+	l.lock.Unlock()
+	l.metrics.Increment("locator.gossip.sent")
+}
+
+// digest returns the local node's state and that of all live peers. Suspect
+// members are omitted, so that stale state does not spread.
+func (l *GossipLocator) digest() *gossipDigest {
+	now := time.Now()
+	l.lock.RLock()
+	members := make([]gossipMember, 0, len(l.members)+1)
+	for _, member := range l.members {
+		if now.Sub(member.updated) < l.suspectTimeout {
+			members = append(members, member.gossipMember)
+		}
+	}
+	l.lock.RUnlock()
+	bucketCount, buckets := l.localBuckets()
+	members = append(members, gossipMember{
+		URL:         l.self,
+		Heartbeat:   atomic.LoadInt64(&l.heartbeat),
+		BucketCount: bucketCount,
+		Buckets:     buckets,
+	})
+	return &gossipDigest{Members: members}
+}
+
+// merge records the state of members with newer heartbeats.
+func (l *GossipLocator) merge(members []gossipMember) {
+	now := time.Now()
+	l.lock.Lock()
+	for _, incoming := range members {
+		if len(incoming.URL) == 0 || incoming.URL == l.self {
+			continue
+		}
+		member, ok := l.members[incoming.URL]
+		if !ok {
+			if l.logger.ShouldLog(INFO) {
+				l.logger.Info("gossip", "Peer joined",
+					LogFields{"peer": incoming.URL})
+			}
+			l.members[incoming.URL] = &memberState{incoming, now}
+			continue
+		}
+		if incoming.Heartbeat > member.Heartbeat {
+			member.gossipMember = incoming
+			member.updated = now
+		}
+	}
+	l.lock.Unlock()
+}
+
+// reap removes members whose heartbeats have not advanced within the dead
+// timeout.
+func (l *GossipLocator) reap() {
+	now := time.Now()
+	alive := 0
+	l.lock.Lock()
+	for url, member := range l.members {
+		age := now.Sub(member.updated)
+		if age >= l.deadTimeout {
+			if l.logger.ShouldLog(WARNING) {
+				l.logger.Warn("gossip", "Removing dead peer",
+					LogFields{"peer": url})
+			}
+			delete(l.members, url)
+			continue
+		}
+		if age < l.suspectTimeout {
+			alive++
+		}
+	}
+	total := len(l.members)
+	l.lock.Unlock()
+	l.metrics.Gauge("locator.gossip.alive", int64(alive))
+	l.metrics.Gauge("locator.gossip.suspect", int64(total-alive))
+}
+
+// hash returns the hash of a device ID, or false if buckets are disabled.
+func (l *GossipLocator) hash(uaid string) (hash uint32, ok bool) {
+	if len(l.bucketCounts) == 0 || len(uaid) == 0 {
+		return 0, false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uaid))
+	return h.Sum32(), true
+}
+
+func (l *GossipLocator) trackClient(uaid string, delta int32) {
+	if hash, ok := l.hash(uaid); ok {
+		atomic.AddInt32(&l.bucketCounts[hash%uint32(len(l.bucketCounts))], delta)
+		atomic.AddInt32(&l.devices, delta)
+	}
+}
+
+// localBuckets returns a bit set of buckets with connected devices. The
+// number of buckets grows with the number of devices, up to the configured
+// maximum. Both are powers of two, so a device's bucket is its tracked
+// bucket modulo the advertised count.
+func (l *GossipLocator) localBuckets() (count int, buckets []byte) {
+	if len(l.bucketCounts) == 0 {
+		return 0, nil
+	}
+	devices := int(atomic.LoadInt32(&l.devices))
+	count = minGossipBuckets
+	for count < len(l.bucketCounts) && count < gossipBucketsPerDevice*devices {
+		count <<= 1
+	}
+	buckets = make([]byte, count/8)
+	for i := range l.bucketCounts {
+		if atomic.LoadInt32(&l.bucketCounts[i]) > 0 {
+			bucket := i % count
+			buckets[bucket/8] |= 1 << uint(bucket%8)
+		}
+	}
+	return count, buckets
+}
+
+// hasBucket indicates whether the member advertises the bucket of a device
+// ID hash.
+func (m *gossipMember) hasBucket(hash uint32) bool {
+	if m.BucketCount <= 0 {
+		return false
+	}
+	bucket := int(hash % uint32(m.BucketCount))
+	return bucket/8 < len(m.Buckets) && m.Buckets[bucket/8]&(1<<uint(bucket%8)) != 0
+}
+
+func init() {
+	AvailableLocators["gossip"] = func() HasConfigStruct { return new(GossipLocator) }
+}
@@ -0,0 +1,124 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testGossipNode struct {
+	app     *Application
+	router  *Router
+	locator *GossipLocator
+}
+
+func (n *testGossipNode) Close() {
+	n.locator.Close()
+	n.router.Close()
+}
+
+func newTestGossipNode(t *testing.T, seeds ...string) *testGossipNode {
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	routerConf := router.ConfigStruct().(*RouterConfig)
+	routerConf.Listener.Addr = "127.0.0.1:0"
+	routerConf.DefaultHost = "127.0.0.1"
+	if err := router.Init(app, routerConf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	app.SetRouter(router)
+	locator := new(GossipLocator)
+	conf := locator.ConfigStruct().(*GossipLocatorConf)
+	conf.Seeds = seeds
+	conf.Interval = "10ms"
+	conf.SuspectTimeout = "200ms"
+	if err := locator.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing gossip locator: %s", err)
+	}
+	router.SetLocator(locator)
+	go http.Serve(router.Listener(), locator)
+	return &testGossipNode{app, router, locator}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func Test_GossipLocator(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+
+	a := newTestGossipNode(t)
+	defer a.Close()
+	b := newTestGossipNode(t, a.router.URL())
+	defer b.Close()
+	c := newTestGossipNode(t, a.router.URL())
+	defer c.Close()
+
+	// Nodes learn about each other through the seed.
+	waitFor(t, "membership", func() bool {
+		return a.locator.Alive(b.router.URL()) && a.locator.Alive(c.router.URL()) &&
+			b.locator.Alive(c.router.URL()) && c.locator.Alive(b.router.URL())
+	})
+	if ok, err := b.locator.Status(); !ok {
+		t.Errorf("Expected gossip locator to be healthy: %s", err)
+	}
+
+	// Broadcasts are limited to peers that hold the device's bucket.
+	c.app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
+	waitFor(t, "bucket ownership", func() bool {
+		contacts, _ := a.locator.Contacts(uaid)
+		return len(contacts) == 1 && contacts[0] == c.router.URL()
+	})
+
+	// Dead peers are excluded once their heartbeats stop.
+	c.Close()
+	waitFor(t, "failure detection", func() bool {
+		return !a.locator.Alive(c.router.URL())
+	})
+	contacts, _ := a.locator.Contacts(uaid)
+	if len(contacts) != 1 || contacts[0] != b.router.URL() {
+		t.Errorf("Wrong contacts after failure: got %#v", contacts)
+	}
+}
+
+func TestGossipLocatorBuckets(t *testing.T) {
+	l := &GossipLocator{bucketCounts: make([]int32, 1<<10)}
+	if count, _ := l.localBuckets(); count != minGossipBuckets {
+		t.Errorf("Wrong bucket count without devices: got %d", count)
+	}
+	uaids := make([]string, 100)
+	for i := range uaids {
+		uaids[i] = fmt.Sprintf("%032x", i)
+		l.trackClient(uaids[i], 1)
+	}
+	count, buckets := l.localBuckets()
+	if count != 512 {
+		t.Errorf("Wrong bucket count for %d devices: got %d", len(uaids), count)
+	}
+	member := &gossipMember{BucketCount: count, Buckets: buckets}
+	for _, uaid := range uaids {
+		if hash, _ := l.hash(uaid); !member.hasBucket(hash) {
+			t.Errorf("Missing bucket for device %s", uaid)
+		}
+	}
+	set := 0
+	for _, b := range buckets {
+		for ; b != 0; b &= b - 1 {
+			set++
+		}
+	}
+	if set > len(uaids) {
+		t.Errorf("Too many buckets set: got %d; want at most %d", set, len(uaids))
+	}
+}
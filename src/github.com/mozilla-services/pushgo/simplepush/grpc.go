@@ -0,0 +1,535 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gRPC push service, described by push.proto. Requests are served over
+// HTTP/2 using the gRPC wire format: each message is a length-prefixed
+// protocol buffer, and the call status is returned in the response trailers.
+
+const (
+	grpcServicePath     = "/simplepush.PushService/"
+	grpcContentType     = "application/grpc"
+	grpcHeaderLen       = 5
+	grpcMaxMessageSlack = 1024
+)
+
+// gRPC status codes, as defined by google.golang.org/grpc/codes.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+var (
+	ErrProtoTruncated  = errors.New("Truncated protocol buffer")
+	ErrProtoWireType   = errors.New("Unsupported protocol buffer wire type")
+	ErrGRPCCompressed  = errors.New("Compressed gRPC messages are not supported")
+	ErrGRPCMessageSize = errors.New("gRPC message exceeds maximum size")
+	ErrGRPCAnonymous   = errors.New("gRPC calls require a client certificate or API key")
+)
+
+// SendUpdateRequest is the request message for PushService.SendUpdate.
+// Version defaults to the current time if omitted.
+type SendUpdateRequest struct {
+	Token   string // 1
+	Version int64  // 2
+	Data    string // 3
+}
+
+// SendUpdateResponse is the response message for PushService.SendUpdate.
+// Devices is the number of devices targeted by the update, and Delivered is
+// the number that accepted it.
+type SendUpdateResponse struct {
+	Devices   int32 // 1
+	Delivered int32 // 2
+}
+
+// SubscriptionInfoRequest is the request message for
+// PushService.SubscriptionInfo.
+type SubscriptionInfoRequest struct {
+	Token string // 1
+}
+
+// SubscriptionInfoResponse describes the subscription behind an endpoint
+// token. For shared channels, Devices is the number of member devices.
+// Connected reports whether the device is connected to this node; it is
+// always false for shared channels. The device ID is never returned, since
+// it is the device's credential; field 1 is reserved.
+type SubscriptionInfoResponse struct {
+	ChannelID string // 2
+	Shared    bool   // 3
+	Devices   int32  // 4
+	Connected bool   // 5
+}
+
+func (m *SendUpdateRequest) Unmarshal(data []byte) error {
+	return readProto(data, func(field int, value uint64, bytes []byte) {
+		switch field {
+		case 1:
+			m.Token = string(bytes)
+		case 2:
+			m.Version = int64(value)
+		case 3:
+			m.Data = string(bytes)
+		}
+	})
+}
+
+func (m *SendUpdateRequest) Marshal() []byte {
+	var w protoWriter
+	w.bytesField(1, m.Token)
+	w.uintField(2, uint64(m.Version))
+	w.bytesField(3, m.Data)
+	return w
+}
+
+func (m *SendUpdateResponse) Unmarshal(data []byte) error {
+	return readProto(data, func(field int, value uint64, _ []byte) {
+		switch field {
+		case 1:
+			m.Devices = int32(value)
+		case 2:
+			m.Delivered = int32(value)
+		}
+	})
+}
+
+func (m *SendUpdateResponse) Marshal() []byte {
+	var w protoWriter
+	w.uintField(1, uint64(m.Devices))
+	w.uintField(2, uint64(m.Delivered))
+	return w
+}
+
+func (m *SubscriptionInfoRequest) Unmarshal(data []byte) error {
+	return readProto(data, func(field int, _ uint64, bytes []byte) {
+		if field == 1 {
+			m.Token = string(bytes)
+		}
+	})
+}
+
+func (m *SubscriptionInfoRequest) Marshal() []byte {
+	var w protoWriter
+	w.bytesField(1, m.Token)
+	return w
+}
+
+func (m *SubscriptionInfoResponse) Unmarshal(data []byte) error {
+	return readProto(data, func(field int, value uint64, bytes []byte) {
+		switch field {
+		case 2:
+			m.ChannelID = string(bytes)
+		case 3:
+			m.Shared = value != 0
+		case 4:
+			m.Devices = int32(value)
+		case 5:
+			m.Connected = value != 0
+		}
+	})
+}
+
+func (m *SubscriptionInfoResponse) Marshal() []byte {
+	var w protoWriter
+	w.bytesField(2, m.ChannelID)
+	w.boolField(3, m.Shared)
+	w.uintField(4, uint64(m.Devices))
+	w.boolField(5, m.Connected)
+	return w
+}
+
+// protoWriter encodes protocol buffer fields. Fields with zero values are
+// omitted, per proto3.
+type protoWriter []byte
+
+func (w *protoWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*w = append(*w, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (w *protoWriter) uintField(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.varint(uint64(field) << 3)
+	w.varint(v)
+}
+
+func (w *protoWriter) boolField(field int, v bool) {
+	if v {
+		w.uintField(field, 1)
+	}
+}
+
+func (w *protoWriter) bytesField(field int, v string) {
+	if len(v) == 0 {
+		return
+	}
+	w.varint(uint64(field)<<3 | 2)
+	w.varint(uint64(len(v)))
+	*w = append(*w, v...)
+}
+
+// readProto decodes a protocol buffer, calling fn with the number and value
+// of each varint and length-delimited field. Fixed-width fields are skipped.
+func readProto(data []byte, fn func(field int, value uint64, bytes []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrProtoTruncated
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return ErrProtoTruncated
+			}
+			data = data[n:]
+			fn(field, value, nil)
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return ErrProtoTruncated
+			}
+			data = data[size:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return ErrProtoTruncated
+			}
+			data = data[n:]
+			fn(field, 0, data[:size])
+			data = data[size:]
+		default:
+			return ErrProtoWireType
+		}
+	}
+	return nil
+}
+
+// readGRPCMessage reads a single length-prefixed gRPC message.
+func readGRPCMessage(r io.Reader, maxLen int) ([]byte, error) {
+	var header [grpcHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, ErrGRPCCompressed
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if uint64(size) > uint64(maxLen) {
+		return nil, ErrGRPCMessageSize
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeGRPCMessage writes a single length-prefixed gRPC message.
+func writeGRPCMessage(w io.Writer, message []byte) (err error) {
+	var header [grpcHeaderLen]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	if _, err = w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	return err
+}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header: an integer of
+// up to 8 digits followed by a unit.
+func parseGRPCTimeout(value string) (timeout time.Duration, err error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("Malformed gRPC timeout '%s'", value)
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Malformed gRPC timeout '%s'", value)
+	}
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("Unknown gRPC timeout unit in '%s'", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// statusToGRPC maps an update status code to a gRPC status code.
+func statusToGRPC(status int) int {
+	switch status {
+	case http.StatusOK:
+		return grpcOK
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// PushServiceHandler serves the gRPC push service, allowing internal
+// services to send updates without constructing endpoint URLs. Clients may
+// set a deadline with the grpc-timeout header. Calls are authenticated like
+// HTTP updates, and must identify the app server with a client certificate
+// or an API key.
+func (self *Handler) PushServiceHandler(resp http.ResponseWriter, req *http.Request) {
+	timer := time.Now()
+	requestID := req.Header.Get(HeaderID)
+	if req.ProtoMajor != 2 {
+		http.Error(resp, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		self.metrics.Increment("grpc.invalid")
+		return
+	}
+	if req.Method != "POST" ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), grpcContentType) {
+		http.Error(resp, "", http.StatusUnsupportedMediaType)
+		self.metrics.Increment("grpc.invalid")
+		return
+	}
+	resp.Header().Set("Content-Type", grpcContentType)
+	resp.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	method := strings.TrimPrefix(req.URL.Path, grpcServicePath)
+	span := self.app.Tracer().StartSpan("grpc."+method, SpanServer,
+		ParseTraceParent(req.Header.Get(HeaderTraceParent)))
+
+	code, message := grpcOK, ""
+	wroteHeader := false
+	defer func() {
+		if code != grpcOK {
+			span.End(errors.New(message))
+		} else {
+			span.End(nil)
+		}
+		if !wroteHeader {
+			// Send the status in the trailers, after an empty response body.
+			resp.WriteHeader(http.StatusOK)
+		}
+		resp.Header().Set("Grpc-Status", strconv.Itoa(code))
+		if len(message) > 0 {
+			resp.Header().Set("Grpc-Message", message)
+		}
+		if code != grpcOK {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("grpc", "gRPC call failed", LogFields{
+					"rid": requestID, "method": method,
+					"code": strconv.Itoa(code), "error": message})
+			}
+			self.metrics.Increment("grpc.error")
+		}
+		self.metrics.Timer("grpc.handled", time.Since(timer))
+	}()
+
+	var timeout time.Duration
+	if value := req.Header.Get("Grpc-Timeout"); len(value) > 0 {
+		var err error
+		if timeout, err = parseGRPCTimeout(value); err != nil {
+			code, message = grpcInvalidArgument, err.Error()
+			return
+		}
+	}
+
+	var (
+		appServer *AppServer
+		request   []byte
+		response  []byte
+		err       error
+	)
+	// Calls are authenticated as HTTP updates are, so that gRPC clients are
+	// held to the same signatures, credentials, and quotas.
+	maxMessage := self.maxDataLen + grpcMaxMessageSlack
+	if appServer, _, err = self.authenticateUpdate(req,
+		int64(grpcHeaderLen+maxMessage)); err != nil {
+
+		code, message = statusToGRPC(authStatus(err)), err.Error()
+		return
+	}
+	if appServer == nil {
+		// Unlike endpoint URLs, gRPC calls are not scoped to a device, so
+		// anonymous callers are never accepted.
+		code, message = grpcUnauthenticated, ErrGRPCAnonymous.Error()
+		self.metrics.Increment("grpc.unauthorized")
+		return
+	}
+	if request, err = readGRPCMessage(req.Body, maxMessage); err != nil {
+		code, message = grpcInvalidArgument, err.Error()
+		if err == ErrGRPCCompressed {
+			code = grpcUnimplemented
+		}
+		return
+	}
+
+	// Close the cancel signal if the deadline passes or the client goes away.
+	cancelSignal := make(chan bool)
+	done := make(chan bool)
+	defer close(done)
+	var closeNotify <-chan bool
+	if cn, ok := resp.(http.CloseNotifier); ok {
+		closeNotify = cn.CloseNotify()
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadlineTimer := time.NewTimer(timeout)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+	expired := make(chan bool)
+	go func() {
+		select {
+		case <-deadline:
+			close(expired)
+		case <-closeNotify:
+		case <-done:
+			return
+		}
+		close(cancelSignal)
+	}()
+
+	switch method {
+	case "SendUpdate":
+		if maintenance := self.app.Server().Maintenance(); maintenance.Enabled() {
+			// Sent as response metadata, as for HTTP updates.
+			retryAfter := maintenance.RetryAfter()
+			resp.Header().Set("Retry-After",
+				strconv.FormatInt(int64(retryAfter/time.Second), 10))
+			self.metrics.Increment("grpc.SendUpdate.maintenance")
+			code, message = grpcUnavailable, "Service Unavailable"
+			return
+		}
+		var name string
+		if appServer != nil {
+			name = appServer.Name
+		}
+		response, code, message = self.grpcSendUpdate(requestID, appServer,
+			self.app.Server().Tenants().ForUpdate(req, name),
+			requestRemoteAddr(req), request, span.Context(), cancelSignal)
+	case "SubscriptionInfo":
+		response, code, message = self.grpcSubscriptionInfo(requestID, request)
+	default:
+		code, message = grpcUnimplemented, fmt.Sprintf("Unknown method '%s'", method)
+		return
+	}
+	if code != grpcOK {
+		select {
+		case <-expired:
+			code, message = grpcDeadlineExceeded, "Deadline exceeded"
+		case <-cancelSignal:
+			code, message = grpcCanceled, "Canceled"
+		default:
+		}
+		return
+	}
+	self.metrics.Increment("grpc." + method)
+	wroteHeader = true
+	if err = writeGRPCMessage(resp, response); err != nil {
+		code, message = grpcInternal, err.Error()
+	}
+}
+
+func (self *Handler) grpcSendUpdate(requestID string, appServer *AppServer,
+	tenant *Tenant, remoteAddr string, data []byte, trace SpanContext,
+	cancelSignal <-chan bool) (
+	response []byte, code int, message string) {
+
+	request := new(SendUpdateRequest)
+	if err := request.Unmarshal(data); err != nil {
+		return nil, grpcInvalidArgument, err.Error()
+	}
+	result := self.sendUpdate(requestID, appServer, tenant, remoteAddr, &BatchUpdate{
+		Token:   request.Token,
+		Version: request.Version,
+		Data:    request.Data,
+	}, trace, cancelSignal)
+	if result.Status != http.StatusOK {
+		return nil, statusToGRPC(result.Status), result.Error
+	}
+	reply := &SendUpdateResponse{Devices: 1, Delivered: 1}
+	if result.FanOut != nil {
+		reply.Devices = int32(result.FanOut.Devices)
+		reply.Delivered = int32(result.FanOut.Delivered)
+	}
+	return reply.Marshal(), grpcOK, ""
+}
+
+func (self *Handler) grpcSubscriptionInfo(requestID string, data []byte) (
+	response []byte, code int, message string) {
+
+	request := new(SubscriptionInfoRequest)
+	if err := request.Unmarshal(data); err != nil {
+		return nil, grpcInvalidArgument, err.Error()
+	}
+	pk, err := self.decodePK(requestID, request.Token)
+	if err == ErrExpiredToken {
+		return nil, grpcNotFound, "Expired Token"
+	}
+	if err != nil {
+		return nil, grpcNotFound, "Invalid Token"
+	}
+	pk, _ = BridgeKeyToKey(pk)
+	reply := new(SubscriptionInfoResponse)
+	if chid, ok := GroupKeyToID(pk); ok {
+		groups, ok := self.store.(GroupStore)
+		if !ok {
+			return nil, grpcNotFound, "Invalid Token"
+		}
+		members, err := groups.Members(chid)
+		if err != nil {
+			return nil, grpcUnavailable, "Could not look up channel members"
+		}
+		reply.ChannelID, reply.Shared = chid, true
+		reply.Devices = int32(len(members))
+		return reply.Marshal(), grpcOK, ""
+	}
+	uaid, chid, ok := self.store.KeyToIDs(pk)
+	if !ok || len(chid) == 0 {
+		return nil, grpcNotFound, "Invalid Token"
+	}
+	reply.ChannelID, reply.Devices = chid, 1
+	reply.Connected = self.app.ClientExists(uaid)
+	return reply.Marshal(), grpcOK, ""
+}
@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	request := &SendUpdateRequest{"token", -1, "data"}
+	decoded := new(SendUpdateRequest)
+	if err := decoded.Unmarshal(request.Marshal()); err != nil {
+		t.Fatalf("Error decoding request: %s", err)
+	}
+	if *decoded != *request {
+		t.Errorf("Wrong request: got %+v; want %+v", decoded, request)
+	}
+	reply := &SubscriptionInfoResponse{"chid", true, 3, true}
+	decodedReply := new(SubscriptionInfoResponse)
+	if err := decodedReply.Unmarshal(reply.Marshal()); err != nil {
+		t.Fatalf("Error decoding reply: %s", err)
+	}
+	if *decodedReply != *reply {
+		t.Errorf("Wrong reply: got %+v; want %+v", decodedReply, reply)
+	}
+	if err := decoded.Unmarshal([]byte{0x0a, 0x05, 'a'}); err != ErrProtoTruncated {
+		t.Errorf("Wrong error for truncated message: got %v; want %v", err,
+			ErrProtoTruncated)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"100m", 100 * time.Millisecond, true},
+		{"5S", 5 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"S", 0, false},
+		{"10x", 0, false},
+		{"123456789S", 0, false},
+	}
+	for _, test := range tests {
+		timeout, err := parseGRPCTimeout(test.value)
+		if (err == nil) != test.ok || timeout != test.expected {
+			t.Errorf("parseGRPCTimeout(%q): got %s, %v; want %s",
+				test.value, timeout, err, test.expected)
+		}
+	}
+}
+
+func Test_PushServiceHandler(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	handler, app := newTestHandler(t)
+	store := &testGroupStore{
+		NoStore: app.Store().(*NoStore),
+		members: make(map[string][]string),
+	}
+	app.SetStore(store)
+	handler.store = store
+	noPush := &PushWS{Born: time.Now()}
+	noPush.SetUAID(uaid)
+	worker := &NoWorker{Socket: noPush, Logger: app.Logger()}
+	app.AddClient(uaid, &Client{worker, noPush, uaid})
+	store.AddMember(chid, uaid, true)
+
+	auth := NewAPIKeyAuth()
+	authConf := auth.ConfigStruct().(*APIKeyConfig)
+	authConf.Keys = []string{"grpc:s3cr3t"}
+	if err := auth.Init(app, authConf); err != nil {
+		t.Fatalf("Error initializing API keys: %s", err)
+	}
+	app.Server().apiKeys = auth
+
+	ln, err := Listen("127.0.0.1:0", 10, 0)
+	if err != nil {
+		t.Fatalf("Error starting gRPC listener: %s", err)
+	}
+	defer ln.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(handler.PushServiceHandler)}
+	app.Server().ConfigureGRPC(srv)
+	go srv.Serve(ln)
+
+	transport := newH2CTransport()
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	apiKey := "s3cr3t"
+	call := func(method string, request []byte) (reply []byte, code int) {
+		body := new(bytes.Buffer)
+		writeGRPCMessage(body, request)
+		req, err := http.NewRequest("POST", "http://"+ln.Addr().String()+
+			grpcServicePath+method, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", grpcContentType)
+		req.Header.Set("Grpc-Timeout", "5S")
+		if len(apiKey) > 0 {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error calling %s: %s", method, err)
+		}
+		defer resp.Body.Close()
+		reply, err = readGRPCMessage(resp.Body, 1024)
+		if err != nil {
+			reply = nil
+		}
+		// Trailers are available once the body is consumed.
+		io.Copy(ioutil.Discard, resp.Body)
+		if code, err = strconv.Atoi(resp.Trailer.Get("Grpc-Status")); err != nil {
+			t.Fatalf("Missing gRPC status for %s: %q", method,
+				resp.Trailer.Get("Grpc-Status"))
+		}
+		return reply, code
+	}
+
+	request := &SendUpdateRequest{Token: GroupKey(chid), Version: 3, Data: "Hi"}
+	apiKey = ""
+	if _, code := call("SendUpdate", request.Marshal()); code != grpcUnauthenticated {
+		t.Errorf("Wrong status for anonymous call: got %d; want %d", code,
+			grpcUnauthenticated)
+	}
+	apiKey = "s3cr3t"
+	data, code := call("SendUpdate", request.Marshal())
+	if code != grpcOK {
+		t.Fatalf("Wrong status for SendUpdate: got %d; want %d", code, grpcOK)
+	}
+	reply := new(SendUpdateResponse)
+	if err = reply.Unmarshal(data); err != nil {
+		t.Fatalf("Error decoding SendUpdate reply: %s", err)
+	}
+	if reply.Devices != 1 || reply.Delivered != 1 {
+		t.Errorf("Wrong SendUpdate reply: got %+v; want 1 device, 1 delivered",
+			reply)
+	}
+
+	info := &SubscriptionInfoRequest{GroupKey(chid)}
+	if data, code = call("SubscriptionInfo", info.Marshal()); code != grpcOK {
+		t.Fatalf("Wrong status for SubscriptionInfo: got %d; want %d", code,
+			grpcOK)
+	}
+	infoReply := new(SubscriptionInfoResponse)
+	if err = infoReply.Unmarshal(data); err != nil {
+		t.Fatalf("Error decoding SubscriptionInfo reply: %s", err)
+	}
+	if !infoReply.Shared || infoReply.ChannelID != chid || infoReply.Devices != 1 {
+		t.Errorf("Wrong SubscriptionInfo reply: got %+v", infoReply)
+	}
+
+	// Shared channels without members do not exist.
+	request.Token = GroupKey(uaid)
+	if _, code = call("SendUpdate", request.Marshal()); code != grpcNotFound {
+		t.Errorf("Wrong status for unknown channel: got %d; want %d", code,
+			grpcNotFound)
+	}
+	if _, code = call("Frobnicate", nil); code != grpcUnimplemented {
+		t.Errorf("Wrong status for unknown method: got %d; want %d", code,
+			grpcUnimplemented)
+	}
+}
@@ -6,20 +6,49 @@ package simplepush
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	capn "github.com/glycerine/go-capnproto"
 	"github.com/gorilla/mux"
-	"golang.org/x/net/websocket"
+
+	"github.com/mozilla-services/pushgo/id"
 )
 
 type HandlerConfig struct {
+	// MaxDataLen is the maximum update payload size, in bytes. Deprecated in
+	// favor of MaxDataSize.
 	MaxDataLen int `toml:"max_data_len" env:"max_data_len"`
+
+	// MaxDataSize is the maximum update payload size, in bytes. Overrides
+	// MaxDataLen if set.
+	MaxDataSize int `toml:"max_data_size" env:"max_data_size"`
+
+	// MaxBatchSize is the maximum number of updates accepted in a single
+	// batch request.
+	MaxBatchSize int `toml:"max_batch_size" env:"max_batch_size"`
+
+	// BatchConcurrency is the number of updates in a batch that are
+	// processed at once.
+	BatchConcurrency int `toml:"batch_concurrency" env:"batch_concurrency"`
+}
+
+// DataTooLargeReply is the response body for rejected oversized updates.
+type DataTooLargeReply struct {
+	Status      int    `json:"status"`
+	Error       string `json:"error"`
+	MaxDataSize int    `json:"maxDataSize"`
 }
 
 type Handler struct {
@@ -31,6 +60,8 @@ type Handler struct {
 	tokenKey   []byte
 	propping   PropPinger
 	maxDataLen int
+	maxBatch   int
+	batchProcs int
 }
 
 type StatusReport struct {
@@ -52,7 +83,9 @@ type PluginStatus struct {
 
 func (self *Handler) ConfigStruct() interface{} {
 	return &HandlerConfig{
-		MaxDataLen: 1024,
+		MaxDataLen:       1024,
+		MaxBatchSize:     1000,
+		BatchConcurrency: 16,
 	}
 }
 
@@ -64,10 +97,34 @@ func (self *Handler) Init(app *Application, config interface{}) error {
 	self.router = app.Router()
 	self.tokenKey = app.TokenKey()
 	self.SetPropPinger(app.PropPinger())
-	self.maxDataLen = config.(*HandlerConfig).MaxDataLen
+	if server := app.Server(); server != nil {
+		server.Maintenance().SetDeliver(self.deliverQueued)
+	}
+	conf := config.(*HandlerConfig)
+	if self.maxDataLen = conf.MaxDataLen; conf.MaxDataSize > 0 {
+		self.maxDataLen = conf.MaxDataSize
+	}
+	self.maxBatch = conf.MaxBatchSize
+	if self.batchProcs = conf.BatchConcurrency; self.batchProcs < 1 {
+		self.batchProcs = 1
+	}
 	return nil
 }
 
+// PrometheusHandler serves metrics for scraping by Prometheus, if the
+// "prometheus" metrics sink is configured.
+func (self *Handler) PrometheusHandler(resp http.ResponseWriter, req *http.Request) {
+	var sink *PrometheusSink
+	if metrics, ok := self.metrics.(*Metrics); ok {
+		sink = metrics.Prometheus()
+	}
+	if sink == nil {
+		http.Error(resp, "", http.StatusNotFound)
+		return
+	}
+	sink.ServeHTTP(resp, req)
+}
+
 func (self *Handler) MetricsHandler(resp http.ResponseWriter, req *http.Request) {
 	snapshot := self.metrics.Snapshot()
 	resp.Header().Set("Content-Type", "application/json")
@@ -90,17 +147,46 @@ func (self *Handler) MetricsHandler(resp http.ResponseWriter, req *http.Request)
 // VIP response
 func (self *Handler) StatusHandler(resp http.ResponseWriter,
 	req *http.Request) {
-	reply := []byte(fmt.Sprintf(`{"status":"OK","clients":%d,"version":"%s"}`,
-		self.app.ClientCount(), VERSION))
+	status, draining := "OK", self.app.Draining()
+	if draining {
+		// Take the node out of load balancer rotation while draining.
+		status = "DRAINING"
+	}
+	reply := []byte(fmt.Sprintf(`{"status":"%s","clients":%d,"version":"%s"}`,
+		status, self.app.ClientCount(), VERSION))
 
 	resp.Header().Set("Content-Type", "application/json")
+	if draining {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
 	resp.Write(reply)
 }
 
 func (self *Handler) RealStatusHandler(resp http.ResponseWriter,
 	req *http.Request) {
 
-	status := StatusReport{
+	status := self.statusReport()
+	resp.Header().Set("Content-Type", "application/json")
+	reply, err := json.Marshal(status)
+	if err != nil {
+		if self.logger.ShouldLog(ERROR) {
+			self.logger.Error("handler", "Could not generate status report",
+				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+		}
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		resp.Write([]byte("{}"))
+		return
+	}
+
+	if !status.Healthy {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	resp.Write(reply)
+}
+
+// statusReport checks the health of the store, pinger, and locator.
+func (self *Handler) statusReport() (status StatusReport) {
+	status = StatusReport{
 		MaxClientConns:   self.app.Server().MaxClientConns(),
 		MaxEndpointConns: self.app.Server().MaxEndpointConns(),
 		Version:          VERSION,
@@ -119,23 +205,7 @@ func (self *Handler) RealStatusHandler(resp http.ResponseWriter,
 
 	status.Clients = self.app.ClientCount()
 	status.Goroutines = runtime.NumGoroutine()
-
-	resp.Header().Set("Content-Type", "application/json")
-	reply, err := json.Marshal(status)
-	if err != nil {
-		if self.logger.ShouldLog(ERROR) {
-			self.logger.Error("handler", "Could not generate status report",
-				LogFields{"error": err.Error()})
-		}
-		resp.WriteHeader(http.StatusServiceUnavailable)
-		resp.Write([]byte("{}"))
-		return
-	}
-
-	if !status.Healthy {
-		resp.WriteHeader(http.StatusServiceUnavailable)
-	}
-	resp.Write(reply)
+	return status
 }
 
 // -- REST
@@ -148,11 +218,19 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 		err        error
 		version    int64
 		uaid, chid string
+		appServer  string
 	)
+	span := self.app.Tracer().StartSpan("update", SpanServer,
+		ParseTraceParent(req.Header.Get(HeaderTraceParent)))
 
 	defer func(err *error) {
 		now := time.Now()
 		ok := *err == nil
+		span.SetAttribute("rid", requestID)
+		span.SetAttribute("uaid", uaid)
+		span.SetAttribute("chid", chid)
+		span.SetAttribute("appServer", appServer)
+		span.End(*err)
 		if self.logger.ShouldLog(DEBUG) {
 			self.logger.Debug("update", "+++++++++++++ DONE +++",
 				LogFields{"rid": requestID})
@@ -162,6 +240,7 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 				"rid":        requestID,
 				"uaid":       uaid,
 				"chid":       chid,
+				"appServer":  appServer,
 				"successful": strconv.FormatBool(ok)})
 		}
 		if ok {
@@ -180,6 +259,39 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	server, authorized := self.checkAppServer(resp, req, int64(3*self.maxDataLen+1024))
+	if !authorized {
+		return
+	}
+	if server != nil {
+		appServer = server.Name
+	}
+	tenant := self.app.Server().Tenants().ForUpdate(req, appServer)
+	if !self.allowAppServer(server) || !tenant.AllowUpdate() {
+		self.writeTooManyRequests(resp)
+		return
+	}
+
+	// Bound the request body. Form encoding can triple the size of the data,
+	// so allow some slack before rejecting the request outright.
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(resp, req.Body, int64(3*self.maxDataLen+1024))
+		if err = req.ParseForm(); err != nil {
+			if logWarning {
+				self.logger.Warn("update", "Could not parse request body",
+					LogFields{"rid": requestID, "error": err.Error()})
+			}
+			if isBodyTooLarge(err) {
+				self.writeDataTooLarge(resp)
+				self.metrics.Increment("updates.appserver.toolong")
+				return
+			}
+			http.Error(resp, "Invalid Request", http.StatusBadRequest)
+			self.metrics.Increment("updates.appserver.invalid")
+			return
+		}
+	}
+
 	svers := req.FormValue("version")
 	if svers != "" {
 		if version, err = strconv.ParseInt(svers, 10, 64); err != nil || version < 0 {
@@ -193,14 +305,25 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 		version = time.Now().UTC().Unix()
 	}
 
+	priority := PriorityNormal
+	if spriority := req.FormValue("priority"); spriority != "" {
+		var valid bool
+		if priority, valid = ParseRoutePriority(spriority); !valid {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(`"Invalid Priority"`))
+			self.metrics.Increment("updates.appserver.invalid")
+			return
+		}
+	}
+
 	data := req.FormValue("data")
 	if len(data) > self.maxDataLen {
 		if logWarning {
 			self.logger.Warn("update", "Data too large, rejecting request",
 				LogFields{"rid": requestID})
 		}
-		http.Error(resp, fmt.Sprintf("Data exceeds max length of %d bytes",
-			self.maxDataLen), http.StatusRequestEntityTooLarge)
+		self.writeDataTooLarge(resp)
 		self.metrics.Increment("updates.appserver.toolong")
 		return
 	}
@@ -221,34 +344,29 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if tokenKey := self.tokenKey; len(tokenKey) > 0 {
-		// Note: dumping the []uint8 keys can produce terminal glitches
-		if self.logger.ShouldLog(DEBUG) {
-			self.logger.Debug("main", "Decoding...",
-				LogFields{"rid": requestID})
-		}
-		var err error
-		bpk, err := Decode(tokenKey, pk)
-		if err != nil {
-			if logWarning {
-				self.logger.Warn("update", "Could not decode primary key", LogFields{
-					"rid": requestID, "pk": pk, "error": err.Error()})
-			}
-			http.Error(resp, "", http.StatusNotFound)
-			self.metrics.Increment("updates.appserver.invalid")
-			return
-		}
+	if pk, err = self.decodePK(requestID, pk); err != nil {
+		self.writeTokenError(resp, err)
+		return
+	}
+	pk, bridge := BridgeKeyToKey(pk)
 
-		pk = string(bytes.TrimSpace(bpk))
+	var cancelSignal <-chan bool
+	if cn, ok := resp.(http.CloseNotifier); ok {
+		cancelSignal = cn.CloseNotify()
 	}
 
-	if !validPK(pk) {
-		if logWarning {
-			self.logger.Warn("update", "Invalid primary key for update",
-				LogFields{"rid": requestID, "pk": pk})
+	remoteAddr := requestRemoteAddr(req)
+	if chid, ok = GroupKeyToID(pk); ok {
+		if !self.app.Server().RateLimiter().AllowUpdate("", remoteAddr) {
+			self.writeTooManyRequests(resp)
+			return
 		}
-		http.Error(resp, "Invalid Token", http.StatusNotFound)
-		self.metrics.Increment("updates.appserver.invalid")
+		if self.app.Server().Maintenance().Enabled() {
+			self.writeMaintenance(resp, "updates.group")
+			return
+		}
+		err = self.fanOut(resp, requestID, tenant, chid, version, data, priority,
+			span.Context(), cancelSignal)
 		return
 	}
 
@@ -273,15 +391,74 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if !self.app.Server().Tenants().Owns(tenant, uaid) {
+		self.writeTenantDenied(resp, requestID, tenant, uaid)
+		return
+	}
+
+	if !self.app.Server().RateLimiter().AllowUpdate(uaid, remoteAddr) {
+		self.writeTooManyRequests(resp)
+		return
+	}
+
+	if maintenance := self.app.Server().Maintenance(); maintenance.Enabled() {
+		// Queued updates are delivered once maintenance ends, after the app
+		// server's request completes, so they are not tied to its span or
+		// connection.
+		queued := maintenance.Queue(&QueuedUpdate{
+			UAID: uaid, ChannelID: chid, Key: pk, Version: version, Data: data,
+			RequestID: requestID, Priority: priority, Bridge: bridge})
+		if !queued {
+			self.writeMaintenance(resp, "updates.appserver")
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusAccepted)
+		resp.Write([]byte("{}"))
+		return
+	}
+
 	// At this point we should have a valid endpoint in the URL
 	self.metrics.Increment("updates.appserver.incoming")
 
+	var stored bool
+	if stored, err = self.deliverUpdate(uaid, chid, pk, version, data,
+		requestID, priority, bridge, span.Context(), cancelSignal); err != nil {
+		if !stored {
+			status, _ := ErrToStatus(err)
+			http.Error(resp, "Could not update channel version", status)
+			return
+		}
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("false"))
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write([]byte("{}"))
+	return
+}
+
+// deliverUpdate stores an update for a single device, then sends it via the
+// proprietary pinger, the device's connection, or the router. Pingers that
+// only wake offline devices are used if no node accepts the update. Updates
+// for bridge-preferred channels are stored, then sent via the pinger even if
+// the device is connected. stored indicates whether the update was stored
+// before delivery failed. trace is the context of the request's span, if
+// any.
+func (self *Handler) deliverUpdate(uaid, chid, pk string, version int64,
+	data, requestID string, priority RoutePriority, bridge bool,
+	trace SpanContext, cancelSignal <-chan bool) (stored bool, err error) {
+
+	logWarning := self.logger.ShouldLog(WARNING)
+	var ok bool
+
 	// is there a Proprietary Ping for this?
-	pinger := self.PropPinger()
-	if pinger == nil {
+	pinger := self.devicePinger(uaid, requestID)
+	if pinger == nil || bridge || isOfflinePinger(pinger) {
 		goto sendUpdate
 	}
-	if ok, err = pinger.Send(uaid, version, data); err != nil {
+	if ok, err = SendPing(pinger, uaid, chid, version, data); err != nil {
 		if logWarning {
 			self.logger.Warn("update", "Could not send proprietary ping", LogFields{
 				"rid": requestID, "uaid": uaid, "error": err.Error()})
@@ -293,9 +470,12 @@ func (self *Handler) UpdateHandler(resp http.ResponseWriter, req *http.Request)
 	if ok && pinger.CanBypassWebsocket() {
 		// Neat! Might as well return.
 		self.metrics.Increment("updates.appserver.received")
-		resp.Header().Set("Content-Type", "application/json")
-		resp.Write([]byte("{}"))
-		return
+		self.app.Events().Publish(&Event{
+			Type:      EventUpdateDelivered,
+			UAID:      uaid,
+			ChannelID: chid,
+			Version:   version})
+		return true, nil
 	}
 
 sendUpdate:
@@ -307,7 +487,14 @@ sendUpdate:
 			"version": strconv.FormatInt(version, 10)})
 	}
 
-	if err = self.store.Update(pk, version); err != nil {
+	span := self.app.Tracer().StartSpan("store.update", SpanClient, trace)
+	startTime := time.Now()
+	err = self.app.Server().Writes().Update(pk, version)
+	elapsed := time.Since(startTime)
+	self.metrics.Timer("store.update", elapsed)
+	self.app.Server().SlowLog().Storage("update", requestID, uaid, self.store, elapsed)
+	span.End(err)
+	if err != nil {
 		if logWarning {
 			self.logger.Warn("update", "Could not update channel", LogFields{
 				"rid":     requestID,
@@ -316,65 +503,593 @@ sendUpdate:
 				"version": strconv.FormatInt(version, 10),
 				"error":   err.Error()})
 		}
-		status, _ := ErrToStatus(err)
 		self.metrics.Increment("updates.appserver.error")
-		http.Error(resp, "Could not update channel version", status)
-		return
+		return false, err
+	}
+	self.app.Events().Publish(&Event{
+		Type:      EventUpdateAccepted,
+		UAID:      uaid,
+		ChannelID: chid,
+		Version:   version})
+
+	// The device fetches bridged updates from storage when it next syncs.
+	// Regular delivery is used if the pinger does not accept the update.
+	if bridge && pinger != nil && self.wake(pinger, uaid, chid, version, data, requestID) {
+		self.metrics.Increment("updates.appserver.bridged")
+		self.app.Events().Publish(&Event{
+			Type:      EventUpdateDelivered,
+			UAID:      uaid,
+			ChannelID: chid,
+			Version:   version})
+		return true, nil
 	}
 
 	// Ping the appropriate server
 	// Is this ours or should we punt to a different server?
 	client, clientConnected := self.app.GetClient(uaid)
 	if !clientConnected {
-		// TODO: Move PropPinger here? otherwise it's connected?
 		self.metrics.Increment("updates.routed.outgoing")
-		var cancelSignal <-chan bool
-		if cn, ok := resp.(http.CloseNotifier); ok {
-			cancelSignal = cn.CloseNotify()
+		var routed bool
+		routed, err = self.router.RouteUpdate(cancelSignal, uaid, chid, version, time.Now().UTC(), requestID, data, priority, trace)
+		if !routed && pinger != nil && isOfflinePinger(pinger) &&
+			self.wake(pinger, uaid, chid, version, data, requestID) {
+			// The device will fetch the stored update when it reconnects.
+			err = nil
 		}
-		if err = self.router.Route(cancelSignal, uaid, chid, version, time.Now().UTC(), requestID, data); err != nil {
-			resp.WriteHeader(http.StatusNotFound)
-			resp.Write([]byte("false"))
-			return
+		if err != nil {
+			return true, err
 		}
+		// The node that accepts the update publishes the delivery.
 	}
 
 	if clientConnected {
-		self.app.Server().RequestFlush(client, chid, int64(version), data)
+		self.app.Server().RequestFlush(client, chid, int64(version), data, trace)
 		self.metrics.Increment("updates.appserver.received")
 	}
+	return true, nil
+}
+
+// devicePinger returns the proprietary pinger for a device, resolving the
+// device's backend if the pinger selects one per device.
+func (self *Handler) devicePinger(uaid, requestID string) PropPinger {
+	pinger := self.PropPinger()
+	multi, ok := pinger.(DevicePinger)
+	if !ok {
+		return pinger
+	}
+	backend, err := multi.Backend(uaid)
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("update", "Could not select proprietary pinger", LogFields{
+				"rid": requestID, "uaid": uaid, "error": err.Error()})
+		}
+		return nil
+	}
+	return backend
+}
+
+// wake sends a proprietary ping to a device without a live connection,
+// returning true if the pinger accepted it.
+func (self *Handler) wake(pinger PropPinger, uaid, chid string, version int64,
+	data, requestID string) bool {
+
+	ok, err := SendPing(pinger, uaid, chid, version, data)
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("update", "Could not wake disconnected device", LogFields{
+				"rid": requestID, "uaid": uaid, "error": err.Error()})
+		}
+		return false
+	}
+	if ok {
+		self.metrics.Increment("updates.appserver.woken")
+	}
+	return ok
+}
+
+// fanOut delivers an update sent to a shared channel to every member device.
+// The update is accepted if at least one device receives it.
+func (self *Handler) fanOut(resp http.ResponseWriter, requestID string,
+	tenant *Tenant, chid string, version int64, data string,
+	priority RoutePriority, trace SpanContext, cancelSignal <-chan bool) (err error) {
 
+	reply, err := self.deliverShared(requestID, tenant, chid, version, data,
+		priority, trace, cancelSignal)
+	if reply == nil {
+		if err == ErrNonexistentChannel {
+			http.Error(resp, "Invalid Token", http.StatusNotFound)
+			return err
+		}
+		status, _ := ErrToStatus(err)
+		http.Error(resp, "Could not update channel version", status)
+		return err
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("false"))
+		return err
+	}
+	body, _ := json.Marshal(reply)
 	resp.Header().Set("Content-Type", "application/json")
-	resp.Write([]byte("{}"))
-	return
+	resp.Write(body)
+	return nil
+}
+
+// deliverShared delivers an update to every member of a shared channel that
+// belongs to the given tenant, up to fanOutWorkers at a time. Returns
+// ErrNonexistentChannel if the channel has no such members, or a nil reply if
+// the members could not be retrieved. If no device received the update, the
+// last delivery error is returned with the reply. Members whose channel
+// registrations no longer exist are removed from the channel.
+func (self *Handler) deliverShared(requestID string, tenant *Tenant,
+	chid string, version int64, data string, priority RoutePriority,
+	trace SpanContext, cancelSignal <-chan bool) (reply *FanOutReply, err error) {
+
+	groups, ok := self.store.(GroupStore)
+	if !ok {
+		self.metrics.Increment("updates.appserver.invalid")
+		return nil, ErrNonexistentChannel
+	}
+	members, err := groups.Members(chid)
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("update", "Could not fetch shared channel members",
+				LogFields{"rid": requestID, "chid": chid, "error": err.Error()})
+		}
+		self.metrics.Increment("updates.appserver.error")
+		return nil, err
+	}
+	// Tenants may share channel IDs, but not each other's devices.
+	members = self.app.Server().Tenants().Filter(tenant, members)
+	if len(members) == 0 {
+		self.metrics.Increment("updates.appserver.invalid")
+		return nil, ErrNonexistentChannel
+	}
+	self.metrics.Increment("updates.appserver.incoming")
+	self.metrics.IncrementBy("updates.appserver.fanout", int64(len(members)))
+	reply = &FanOutReply{Devices: len(members)}
+	var (
+		lastErr   error
+		replyLock sync.Mutex
+		wg        sync.WaitGroup
+	)
+	pending := make(chan string)
+	workers := fanOutWorkers
+	if len(members) < workers {
+		workers = len(members)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uaid := range pending {
+				err := self.deliverMember(requestID, groups, uaid, chid, version,
+					data, priority, trace, cancelSignal)
+				replyLock.Lock()
+				if err != nil {
+					lastErr = err
+				} else {
+					reply.Delivered++
+				}
+				replyLock.Unlock()
+			}
+		}()
+	}
+	for _, uaid := range members {
+		pending <- uaid
+	}
+	close(pending)
+	wg.Wait()
+	if reply.Delivered == 0 {
+		return reply, lastErr
+	}
+	return reply, nil
+}
+
+// deliverMember delivers a shared channel update to one member device,
+// removing the device from the channel if it no longer has a registration.
+func (self *Handler) deliverMember(requestID string, groups GroupStore,
+	uaid, chid string, version int64, data string, priority RoutePriority,
+	trace SpanContext, cancelSignal <-chan bool) error {
+
+	pk, ok := self.store.IDsToKey(uaid, chid)
+	if !ok {
+		return ErrInvalidKey
+	}
+	_, err := self.deliverUpdate(uaid, chid, pk, version, data, requestID,
+		priority, false, trace, cancelSignal)
+	if err == ErrNonexistentChannel {
+		if rmErr := groups.RemoveMember(chid, uaid); rmErr == nil {
+			self.metrics.Increment("updates.appserver.fanout.pruned")
+		}
+	}
+	return err
+}
+
+// writeDataTooLarge responds with a 413 and a JSON body describing the
+// maximum payload size.
+func (self *Handler) writeDataTooLarge(resp http.ResponseWriter) {
+	status, message := ErrToStatus(ErrDataTooLarge)
+	reply, _ := json.Marshal(DataTooLargeReply{status, message, self.maxDataLen})
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(reply)
+}
+
+// writeTooManyRequests rejects a rate-limited update.
+func (self *Handler) writeTooManyRequests(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", "1")
+	http.Error(resp, "Too Many Requests", http.StatusTooManyRequests)
+	self.metrics.Increment("updates.appserver.ratelimited")
+}
+
+// authenticateUpdate runs the checks shared by the update, batch, and gRPC
+// interfaces. It verifies the Hawk signature, reading at most maxBody bytes
+// of the body, then authenticates the app server by client certificate or
+// API key. The returned app server is nil if neither is required and none
+// was presented; updates are not taken from its quota.
+func (self *Handler) authenticateUpdate(req *http.Request, maxBody int64) (
+	appServer *AppServer, hawkID string, err error) {
+
+	if hawkID, err = self.app.Server().Hawk().Verify(req, maxBody); err != nil {
+		return nil, hawkID, err
+	}
+	// Certificate identities take precedence over API keys.
+	appServer, err = self.app.Server().ClientCerts().Authenticate(req)
+	if err == nil && appServer == nil {
+		appServer, err = self.app.Server().APIKeys().Authenticate(req)
+	}
+	return appServer, hawkID, err
+}
+
+// authStatus returns the HTTP status code for an authenticateUpdate or
+// AppServer.AllowUpdate error.
+func authStatus(err error) int {
+	switch err {
+	case nil:
+		return http.StatusOK
+	case ErrSignedBodyTooLong:
+		return http.StatusRequestEntityTooLarge
+	case ErrUnreadableBody:
+		return http.StatusBadRequest
+	case ErrMissingSignature, ErrInvalidSignature, ErrUnknownHawkID,
+		ErrStaleTimestamp, ErrReplayedNonce, ErrInvalidPayload,
+		ErrMissingAPIKey, ErrInvalidAPIKey,
+		ErrMissingClientCert, ErrUnknownClientCert:
+		return http.StatusUnauthorized
+	case ErrAPIKeyQuota, ErrClientCertQuota:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// checkAppServer authenticates an update request with authenticateUpdate,
+// and rejects the request if the signature is invalid or the app server is
+// unauthorized. It returns the app server, if known.
+func (self *Handler) checkAppServer(resp http.ResponseWriter, req *http.Request,
+	maxBody int64) (appServer *AppServer, ok bool) {
+
+	appServer, hawkID, err := self.authenticateUpdate(req, maxBody)
+	switch status := authStatus(err); status {
+	case http.StatusOK:
+		return appServer, true
+	case http.StatusRequestEntityTooLarge:
+		self.writeDataTooLarge(resp)
+		self.metrics.Increment("updates.appserver.toolong")
+	case http.StatusBadRequest:
+		http.Error(resp, "Invalid Request", status)
+		self.metrics.Increment("updates.appserver.invalid")
+	case http.StatusUnauthorized:
+		switch err {
+		case ErrMissingAPIKey, ErrInvalidAPIKey:
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+		case ErrMissingClientCert, ErrUnknownClientCert:
+		default:
+			resp.Header().Set("WWW-Authenticate",
+				self.app.Server().Hawk().Challenge(hawkID, err))
+		}
+		http.Error(resp, err.Error(), status)
+		self.metrics.Increment("updates.appserver.unauthorized")
+	default:
+		http.Error(resp, "Service Unavailable", status)
+		self.metrics.Increment("updates.appserver.error")
+	}
+	if self.logger.ShouldLog(INFO) {
+		self.logger.Info("update", "Rejected app server update", LogFields{
+			"rid": req.Header.Get(HeaderID), "hawkID": hawkID, "error": err.Error()})
+	}
+	return nil, false
+}
+
+// allowAppServer takes one update from the app server's quota, and counts
+// updates rejected because the quota is exceeded.
+func (self *Handler) allowAppServer(appServer *AppServer) bool {
+	if err := appServer.AllowUpdate(); err != nil {
+		self.metrics.Increment("updates.appserver.quota." + appServer.Name)
+		return false
+	}
+	return true
+}
+
+// ValidateHandler lints an endpoint URL, VAPID JWT, and payload sample
+// without delivering an update, and returns a ValidationReport.
+func (self *Handler) ValidateHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	// Payload samples are base64-encoded; allow some slack for the other fields.
+	body := http.MaxBytesReader(resp, req.Body, int64(2*self.maxDataLen+4096))
+	request := new(ValidateRequest)
+	if err := json.NewDecoder(body).Decode(request); err != nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`"Invalid Request"`))
+		self.metrics.Increment("updates.validate.invalid")
+		return
+	}
+	validator := &Validator{
+		app:        self.app,
+		store:      self.store,
+		maxDataLen: self.maxDataLen,
+	}
+	report := validator.Validate(request)
+	if report.Valid {
+		self.metrics.Increment("updates.validate.passed")
+	} else {
+		self.metrics.Increment("updates.validate.failed")
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(report)
+}
+
+// isBodyTooLarge indicates whether err was returned by a request body
+// bounded with http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// decodePK decrypts the endpoint token, if a token key is configured, and
+// validates the resulting primary key. It returns ErrExpiredToken for
+// expired tokens, and ErrInvalidToken for all other invalid tokens.
+func (self *Handler) decodePK(requestID, token string) (pk string, err error) {
+	logWarning := self.logger.ShouldLog(WARNING)
+	// Note: dumping the []uint8 keys can produce terminal glitches
+	if self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("main", "Decoding...",
+			LogFields{"rid": requestID})
+	}
+	bpk, err := self.app.Tokens().Decode(token)
+	if err != nil {
+		if logWarning {
+			self.logger.Warn("update", "Could not decode primary key", LogFields{
+				"rid": requestID, "pk": token, "error": err.Error()})
+		}
+		if err == ErrExpiredToken {
+			return "", err
+		}
+		return "", ErrInvalidToken
+	}
+	pk = string(bpk)
+	if !validPK(pk) {
+		if logWarning {
+			self.logger.Warn("update", "Invalid primary key for update",
+				LogFields{"rid": requestID, "pk": pk})
+		}
+		return "", ErrInvalidToken
+	}
+	return pk, nil
+}
+
+// writeTokenError rejects a request with an expired or invalid token.
+func (self *Handler) writeTokenError(resp http.ResponseWriter, err error) {
+	if err == ErrExpiredToken {
+		http.Error(resp, "Expired Token", http.StatusGone)
+		self.metrics.Increment("updates.appserver.expired")
+		return
+	}
+	http.Error(resp, "Invalid Token", http.StatusNotFound)
+	self.metrics.Increment("updates.appserver.invalid")
+}
+
+// ReceiptStreamHandler streams delivery, expiry, and failure receipts for
+// the endpoint identified by the "key" query parameter as Server-Sent Events.
+// Recent receipts are replayed when the stream is opened.
+func (self *Handler) ReceiptStreamHandler(resp http.ResponseWriter, req *http.Request) {
+	requestID := req.Header.Get(HeaderID)
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming not supported", http.StatusNotImplemented)
+		return
+	}
+	token := req.FormValue("key")
+	if len(token) == 0 {
+		http.Error(resp, "Token not found", http.StatusNotFound)
+		self.metrics.Increment("receipts.stream.invalid")
+		return
+	}
+	pk, err := self.decodePK(requestID, token)
+	if err == ErrExpiredToken {
+		http.Error(resp, "Expired Token", http.StatusGone)
+		self.metrics.Increment("receipts.stream.invalid")
+		return
+	}
+	if err != nil {
+		http.Error(resp, "Invalid Token", http.StatusNotFound)
+		self.metrics.Increment("receipts.stream.invalid")
+		return
+	}
+	pk, _ = BridgeKeyToKey(pk)
+	if _, chid, ok := self.store.KeyToIDs(pk); !ok || len(chid) == 0 {
+		http.Error(resp, "Invalid Token", http.StatusNotFound)
+		self.metrics.Increment("receipts.stream.invalid")
+		return
+	}
+
+	hub := self.app.Server().Receipts()
+	receipts, recent := hub.Subscribe(pk)
+	defer hub.Unsubscribe(pk, receipts)
+
+	var closeNotify <-chan bool
+	if cn, ok := resp.(http.CloseNotifier); ok {
+		closeNotify = cn.CloseNotify()
+	}
+	var keepAlive <-chan time.Time
+	if interval := hub.KeepAlive(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	header := resp.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	for _, receipt := range recent {
+		if err := writeReceiptEvent(resp, receipt); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-closeNotify:
+			return
+		case <-hub.CloseNotify():
+			return
+		case <-keepAlive:
+			if _, err := resp.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+		case receipt := <-receipts:
+			if err := writeReceiptEvent(resp, receipt); err != nil {
+				if self.logger.ShouldLog(DEBUG) {
+					self.logger.Debug("handler", "Could not write receipt",
+						LogFields{"rid": requestID, "error": err.Error()})
+				}
+				return
+			}
+		}
+		flusher.Flush()
+	}
 }
 
-func (self *Handler) PushSocketHandler(ws *websocket.Conn) {
+// RealStatsHandler streams snapshots of this node's activity as Server-Sent
+// Events for operations dashboards. Callers authenticate with a bearer
+// token in the Authorization header. Tokens are not accepted as query
+// parameters, which end up in access logs.
+func (self *Handler) RealStatsHandler(resp http.ResponseWriter, req *http.Request) {
+	stats := self.app.Server().RealStats()
+	if !stats.Enabled() {
+		http.Error(resp, "", http.StatusNotFound)
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	var token string
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if !stats.Authorized(token) {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "", http.StatusUnauthorized)
+		self.metrics.Increment("realstats.unauthorized")
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming not supported", http.StatusNotImplemented)
+		return
+	}
+
+	snapshots := stats.Subscribe()
+	defer stats.Unsubscribe(snapshots)
+
+	var closeNotify <-chan bool
+	if cn, ok := resp.(http.CloseNotifier); ok {
+		closeNotify = cn.CloseNotify()
+	}
+
+	header := resp.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-closeNotify:
+			return
+		case <-stats.CloseNotify():
+			return
+		case snapshot := <-snapshots:
+			data, err := json.Marshal(snapshot)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(resp, "event: stats\ndata: %s\n\n", data); err != nil {
+				if self.logger.ShouldLog(DEBUG) {
+					self.logger.Debug("handler", "Could not write stats snapshot",
+						LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+				}
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeReceiptEvent(w io.Writer, receipt Receipt) error {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", receipt.Type, data)
+	return err
+}
+
+func (self *Handler) PushSocketHandler(ws Socket) {
 	requestID := ws.Request().Header.Get(HeaderID)
-	sock := PushWS{Socket: ws,
+	ws.SetReadLimit(self.app.maxMessageSize)
+	sock := &PushWS{Socket: ws,
 		Store:  self.store,
+		Tenant: self.app.Server().Tenants().ForHost(ws.Request().Host),
 		Logger: self.logger,
 		Born:   time.Now()}
 
+	if !sock.Tenant.Connect() {
+		sock.Bye(CloseTenantLimit)
+		self.metrics.Increment("socket.tenant.rejected")
+		return
+	}
+
 	if self.logger.ShouldLog(INFO) {
 		self.logger.Info("handler", "websocket connection",
 			LogFields{"rid": requestID})
 	}
-	defer func() {
+	self.metrics.Increment("socket.connect")
+
+	// With polling, Serve returns before the connection closes.
+	NewWorker(self.app, requestID).Serve(sock, func() {
 		now := time.Now()
 		// Clean-up the resources
-		self.app.Server().HandleCommand(PushCommand{DIE, nil}, &sock)
-		self.metrics.Timer("socket.lifespan", now.Sub(sock.Born))
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, sock)
+		self.app.Server().Churn().Lifespan("socket", now.Sub(sock.Born))
 		self.metrics.Increment("socket.disconnect")
-	}()
-
-	self.metrics.Increment("socket.connect")
-
-	NewWorker(self.app, requestID).Run(&sock)
-	if self.logger.ShouldLog(INFO) {
-		self.logger.Info("main", "Server for client shut-down",
-			LogFields{"rid": requestID})
-	}
+		sock.Tenant.Disconnect()
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("main", "Server for client shut-down",
+				LogFields{"rid": requestID})
+		}
+	})
 }
 
 // Boy Golly, sure would be nice to put this in router.go, huh?
@@ -402,6 +1117,7 @@ func (self *Handler) RouteHandler(resp http.ResponseWriter, req *http.Request) {
 		timeNano int64
 		sentAt   time.Time
 		data     string
+		trace    SpanContext
 	)
 	segment, err := capn.ReadFromStream(req.Body, nil)
 	if err != nil {
@@ -424,17 +1140,23 @@ func (self *Handler) RouteHandler(resp http.ResponseWriter, req *http.Request) {
 	self.metrics.Increment("updates.routed.incoming")
 	timeNano = r.Time()
 	sentAt = time.Unix(timeNano/1e9, timeNano%1e9)
+	trace = ParseTraceParent(req.Header.Get(HeaderTraceParent))
+	if !trace.Valid() {
+		trace = ParseTraceParent(r.TraceParent())
+	}
 	// Never trust external data
 	data = r.Data()
 	if len(data) > self.maxDataLen {
 		if logWarning {
-			self.logger.Warn("router", "Data segment too long, truncating",
+			self.logger.Warn("router", "Data segment too long, rejecting request",
 				LogFields{"rid": req.Header.Get(HeaderID),
 					"uaid": uaid})
 		}
-		data = data[:self.maxDataLen]
+		self.writeDataTooLarge(resp)
+		self.metrics.Increment("updates.routed.toolong")
+		return
 	}
-	if err = self.app.Server().Update(chid, uaid, r.Version(), sentAt, data); err != nil {
+	if err = self.app.Server().Update(chid, uaid, r.Version(), sentAt, data, trace); err != nil {
 		if logWarning {
 			self.logger.Warn("router", "Could not update local user",
 				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
@@ -452,6 +1174,454 @@ invalidBody:
 	self.metrics.Increment("updates.routed.invalid")
 }
 
+// RotateKeysReply is the response body for the rotate-keys admin action.
+type RotateKeysReply struct {
+	Changed int   `json:"changed"`
+	Current int   `json:"current"`
+	Keys    []int `json:"keys"`
+}
+
+// ConfigChangesHandler returns the most recent config changes applied by
+// reloads, newest first.
+func (self *Handler) ConfigChangesHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.app.ConfigAudit().History())
+}
+
+// ConfigSourcesHandler returns the effective settings, as loaded at
+// startup, and the config file or environment override each came from.
+// Secret values are redacted.
+func (self *Handler) ConfigSourcesHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.app.ConfigAudit().Sources())
+}
+
+// HandoffHandler releases a device that connected to another node, closing
+// any stale connection held by this node. Used by client affinity. If take
+// is set, the caller takes over the updates that the device did not
+// acknowledge; otherwise, they are stashed for the device's next connection.
+func (self *Handler) HandoffHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	take := req.FormValue("take") == "true"
+	reply := HandoffReply{UAID: uaid}
+	if client, ok := self.app.GetClient(uaid); ok {
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("handler", "Releasing client to another node",
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+		}
+		if worker, ok := client.Worker.(*WorkerWS); ok && take {
+			reply.Updates = worker.TakeInFlight()
+		}
+		client.PushWS.Bye(CloseUAIDConflict)
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, client.PushWS)
+		reply.Released = true
+		self.metrics.Increment("router.affinity.released")
+	}
+	if take && self.router != nil {
+		reply.Updates = MergeUpdates(reply.Updates, self.router.InFlight().Take(uaid))
+		self.metrics.IncrementBy("router.inflight.handoff", int64(len(reply.Updates)))
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// InFlightHandler hands off the updates that a device did not acknowledge
+// before reconnecting to another node. If the device is still connected to
+// this node, the stale connection is closed first.
+func (self *Handler) InFlightHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	if self.router == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	reply := InFlightReply{UAID: uaid, Updates: []Update{}}
+	if client, ok := self.app.GetClient(uaid); ok {
+		if worker, ok := client.Worker.(*WorkerWS); ok {
+			reply.Updates = append(reply.Updates, worker.TakeInFlight()...)
+		}
+		client.PushWS.Bye(CloseUAIDConflict)
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, client.PushWS)
+	}
+	reply.Updates = MergeUpdates(reply.Updates, self.router.InFlight().Take(uaid))
+	if self.logger.ShouldLog(INFO) && len(reply.Updates) > 0 {
+		self.logger.Info("handler", "Handing off in-flight updates",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+				"updates": strconv.Itoa(len(reply.Updates))})
+	}
+	self.metrics.IncrementBy("router.inflight.handoff", int64(len(reply.Updates)))
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// RegistryHandler looks up, registers, and unregisters the node holding a
+// device's connection. Nodes use it as an HTTP client registry. Devices
+// connected to this node are always reported as local.
+func (self *Handler) RegistryHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	if self.router == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	registry := self.router.Routes().Registry()
+	entry := &RegistryEntry{UAID: uaid}
+	var err error
+	switch req.Method {
+	case "GET":
+		if self.app.ClientExists(uaid) {
+			entry.Node = self.router.URL()
+		} else if registry != nil {
+			entry.Node, err = registry.Lookup(uaid)
+		}
+		self.metrics.Increment("router.registry.lookup")
+	case "PUT", "DELETE":
+		if registry == nil {
+			http.NotFound(resp, req)
+			return
+		}
+		if err = json.NewDecoder(req.Body).Decode(entry); err != nil || entry.UAID != uaid ||
+			len(entry.Node) == 0 {
+			http.Error(resp, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if req.Method == "PUT" {
+			err = registry.Register(uaid, entry.Node)
+		} else {
+			err = registry.Unregister(uaid, entry.Node)
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("handler", "Client registry request failed",
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+					"method": req.Method, "error": err.Error()})
+		}
+		http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if len(entry.Node) == 0 {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(entry)
+}
+
+// RegionHandler returns the region tag of the current node.
+func (self *Handler) RegionHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	var tag PeerTag
+	if self.router != nil {
+		tag = self.router.Regions().Local()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(tag)
+}
+
+// SigningKeysHandler returns the public keys used to sign update responses
+// and routed updates.
+func (self *Handler) SigningKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.app.Server().Signer().Keys())
+}
+
+// RelayHandler accepts updates relayed from other regions, and routes them
+// within the current region. Returns a 404 if the current node is not a
+// gateway, or if no node in the region accepted the update.
+func (self *Handler) RelayHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if self.router == nil || !self.router.Regions().IsGateway() {
+		http.NotFound(resp, req)
+		return
+	}
+	logID := req.Header.Get(HeaderID)
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		http.Error(resp, "Invalid UAID", http.StatusBadRequest)
+		return
+	}
+	// Signed peer bodies are already bounded; bound the decompressed body
+	// too, so that a small compressed body cannot expand without limit.
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(resp, "Invalid body", http.StatusNotAcceptable)
+			self.metrics.Increment("router.region.relay.invalid")
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+	maxBody := int64(2*self.maxDataLen + 4096)
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxBody+1))
+	if int64(len(data)) > maxBody {
+		http.Error(resp, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		self.metrics.Increment("router.region.relay.toolarge")
+		return
+	}
+	var segment *capn.Segment
+	if err == nil {
+		segment, err = capn.ReadFromStream(bytes.NewReader(data), nil)
+	}
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("router", "Could not read relayed update",
+				LogFields{"rid": logID, "region": req.Header.Get(HeaderRelay),
+					"error": err.Error()})
+		}
+		http.Error(resp, "Invalid body", http.StatusNotAcceptable)
+		self.metrics.Increment("router.region.relay.invalid")
+		return
+	}
+	accepted, err := self.router.RouteRelay(nil, uaid, segment, logID)
+	if err != nil {
+		http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if len(accepted) == 0 {
+		http.Error(resp, "UID Not Found", http.StatusNotFound)
+		return
+	}
+	resp.Write([]byte("Ok"))
+}
+
+// GossipHandler handles gossip exchanges between routers. Returns a 404 if
+// the gossip locator is not configured.
+func (self *Handler) GossipHandler(resp http.ResponseWriter, req *http.Request) {
+	var gossip *GossipLocator
+	if self.router != nil {
+		gossip, _ = self.router.Locator().(*GossipLocator)
+	}
+	if gossip == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	gossip.ServeHTTP(resp, req)
+}
+
+// RotateKeysHandler re-reads the shared secrets, applying rotated endpoint
+// token keys without waiting for the next refresh, and returns the keys in
+// use. Keys are rotated by updating the `token_keys` secret, rather than on
+// individual nodes, so that every node mints and accepts the same keys.
+func (self *Handler) RotateKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	changed := self.app.Secrets().Refresh()
+	tokens := self.app.Tokens()
+	reply := RotateKeysReply{Changed: changed, Current: -1, Keys: tokens.IDs()}
+	if id, ok := tokens.Current(); ok {
+		reply.Current = int(id)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// RebalanceReply is the body of the rebalance endpoint's reply.
+type RebalanceReply struct {
+	Clients    int `json:"clients"`
+	Rebalanced int `json:"rebalanced"`
+}
+
+// RebalanceHandler asks the percentage of connected clients given by the
+// `percent` form field (1-100) to reconnect. `hosts` is an optional
+// comma-separated list of client URLs to redirect them to; `retry_after`
+// optionally spreads reconnections over the given duration.
+func (self *Handler) RebalanceHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	percent, err := strconv.Atoi(req.FormValue("percent"))
+	if err != nil || percent < 1 || percent > 100 {
+		http.Error(resp, "Invalid percentage", http.StatusBadRequest)
+		return
+	}
+	var hosts []string
+	for _, host := range strings.Split(req.FormValue("hosts"), ",") {
+		if host = strings.TrimSpace(host); len(host) == 0 {
+			continue
+		}
+		if _, err = url.ParseRequestURI(host); err != nil {
+			http.Error(resp, "Invalid host URL", http.StatusBadRequest)
+			return
+		}
+		hosts = append(hosts, host)
+	}
+	var retryAfter time.Duration
+	if value := req.FormValue("retry_after"); len(value) > 0 {
+		if retryAfter, err = time.ParseDuration(value); err != nil || retryAfter < 0 {
+			http.Error(resp, "Invalid retry interval", http.StatusBadRequest)
+			return
+		}
+	}
+	reply := RebalanceReply{Clients: self.app.ClientCount()}
+	reply.Rebalanced = self.app.Server().Rebalance(percent, hosts, retryAfter)
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// LogLevelsReply is the body of the log level endpoint's reply.
+type LogLevelsReply struct {
+	Default string            `json:"default"`
+	Modules map[string]string `json:"modules"`
+}
+
+// LogLevelsHandler returns the default log level and the levels set for
+// individual message types and components. POST requests set the level
+// given by the `level` form field for the `module` field; an empty level
+// or "default" removes the module's level. Changes apply to this node
+// only, and are not persisted across restarts.
+func (self *Handler) LogLevelsHandler(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		module := strings.TrimSpace(req.FormValue("module"))
+		if len(module) == 0 {
+			http.Error(resp, "Missing module", http.StatusBadRequest)
+			return
+		}
+		value := req.FormValue("level")
+		if len(value) == 0 || strings.EqualFold(value, "default") {
+			self.logger.ResetModuleLevel(module)
+		} else {
+			level, err := ParseLogLevel(value)
+			if err != nil {
+				http.Error(resp, "Invalid log level", http.StatusBadRequest)
+				return
+			}
+			self.logger.SetModuleLevel(module, level)
+		}
+		if self.logger.ShouldLog(NOTICE) {
+			self.logger.Notice("handler", "Changed module log level",
+				LogFields{"module": module, "level": value})
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defaultLevel, modules := self.logger.ModuleLevels()
+	reply := LogLevelsReply{
+		Default: defaultLevel.String(),
+		Modules: make(map[string]string, len(modules)),
+	}
+	for module, level := range modules {
+		reply.Modules[module] = level.String()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// FeaturesHandler lists the feature flags and their rollout percentages.
+// POST requests override the percentage of the flag given by the `name`
+// form field with the `percent` field (0-100), or remove the override if
+// `percent` is empty or "default". Overrides apply to this node only.
+func (self *Handler) FeaturesHandler(resp http.ResponseWriter, req *http.Request) {
+	features := self.app.Server().Features()
+	switch req.Method {
+	case "GET":
+	case "POST":
+		name := strings.TrimSpace(req.FormValue("name"))
+		if len(name) == 0 {
+			http.Error(resp, "Missing flag name", http.StatusBadRequest)
+			return
+		}
+		value := req.FormValue("percent")
+		if len(value) == 0 || strings.EqualFold(value, "default") {
+			features.ResetOverride(name)
+		} else {
+			percent, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				err = features.Override(name, percent)
+			}
+			if err != nil {
+				http.Error(resp, "Invalid percentage", http.StatusBadRequest)
+				return
+			}
+		}
+		if self.logger.ShouldLog(NOTICE) {
+			self.logger.Notice("handler", "Changed feature flag",
+				LogFields{"name": name, "percent": value})
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(features.Flags())
+}
+
+// BansHandler lists the clients banned for abusive behavior. POST requests
+// lift the ban given by the `kind` ("ip" or "uaid") and `value` form
+// fields. Bans apply to this node only.
+func (self *Handler) BansHandler(resp http.ResponseWriter, req *http.Request) {
+	abuse := self.app.Server().Abuse()
+	switch req.Method {
+	case "GET":
+	case "POST":
+		kind, value := req.FormValue("kind"), req.FormValue("value")
+		if kind != BanIP && kind != BanUAID || len(value) == 0 {
+			http.Error(resp, "Invalid ban", http.StatusBadRequest)
+			return
+		}
+		if !abuse.Unban(kind, value) {
+			http.Error(resp, "Ban not found", http.StatusNotFound)
+			return
+		}
+		if self.logger.ShouldLog(NOTICE) {
+			self.logger.Notice("handler", "Lifted client ban",
+				LogFields{"kind": kind, "value": value})
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(abuse.Bans())
+}
+
 func (r *Handler) SetPropPinger(ping PropPinger) (err error) {
 	r.propping = ping
 	return
@@ -44,11 +44,16 @@ func newTestHandler(t *testing.T) (*Handler, *Application) {
 	}
 	app.SetLogger(tlogger)
 	server := &Serv{}
-	server.Init(app, server.ConfigStruct())
+	serverConf := server.ConfigStruct().(*ServerConfig)
+	serverConf.Client.Addr = "127.0.0.1:0"
+	serverConf.Endpoint.Addr = "127.0.0.1:0"
+	server.Init(app, serverConf)
 	app.SetServer(server)
 	locator := &NoLocator{logger: tlogger}
 	router := NewRouter()
-	router.Init(app, router.ConfigStruct())
+	routerConf := router.ConfigStruct().(*RouterConfig)
+	routerConf.Listener.Addr = "127.0.0.1:0"
+	router.Init(app, routerConf)
 	router.SetLocator(locator)
 	app.SetRouter(router)
 
@@ -60,6 +65,8 @@ func newTestHandler(t *testing.T) (*Handler, *Application) {
 		metrics:    mx,
 		tokenKey:   app.TokenKey(),
 		maxDataLen: 140,
+		maxBatch:   10,
+		batchProcs: 2,
 		propping:   pping,
 	}
 	return handler, app
@@ -121,6 +128,71 @@ func Test_UpdateHandler(t *testing.T) {
 	}
 }
 
+func Test_UpdateHandlerTooLarge(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	handler, app := newTestHandler(t)
+	resp := httptest.NewRecorder()
+	key, _ := app.Store().IDsToKey(uaid, chid)
+	body := url.Values{"data": {strings.Repeat("x", handler.maxDataLen+1)}}
+	req, err := http.NewRequest("PUT",
+		fmt.Sprintf("http://test/update/%s", key),
+		strings.NewReader(body.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tmux := mux.NewRouter()
+	tmux.HandleFunc("/update/{key}", handler.UpdateHandler)
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Wrong status code: got %d; want %d", resp.Code,
+			http.StatusRequestEntityTooLarge)
+	}
+	reply := DataTooLargeReply{}
+	if err = json.Unmarshal(resp.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("Error decoding response body: %s", err)
+	}
+	if reply.MaxDataSize != handler.maxDataLen {
+		t.Errorf("Wrong maximum data size: got %d; want %d",
+			reply.MaxDataSize, handler.maxDataLen)
+	}
+}
+
+func Test_UpdateHandlerMalformed(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	handler, app := newTestHandler(t)
+	key, _ := app.Store().IDsToKey(uaid, chid)
+	tmux := mux.NewRouter()
+	tmux.HandleFunc("/update/{key}", handler.UpdateHandler)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{"version=%zz", http.StatusBadRequest},
+		{"data=" + strings.Repeat("x", 4*handler.maxDataLen+1024),
+			http.StatusRequestEntityTooLarge},
+	}
+	for i, test := range tests {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT",
+			fmt.Sprintf("http://test/update/%s", key),
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		tmux.ServeHTTP(resp, req)
+		if resp.Code != test.status {
+			t.Errorf("On test %d, wrong status code: got %d; want %d",
+				i, resp.Code, test.status)
+		}
+	}
+}
+
 func endpointIds(uri *url.URL) (deviceId, channelId string, ok bool) {
 	if !uri.IsAbs() {
 		ok = false
@@ -215,3 +287,251 @@ func TestMissingKey(t *testing.T) {
 		t.Errorf("Unexpected endpoint status: got %#v; want 404", clientErr.Status())
 	}
 }
+
+type testGroupStore struct {
+	*NoStore
+	members map[string][]string
+}
+
+func (s *testGroupStore) AddMember(schid, suaid string, join bool) error {
+	members := s.members[schid]
+	for _, member := range members {
+		if member == suaid {
+			return nil
+		}
+	}
+	if len(members) > 0 && !join {
+		return ErrSharedChannelJoin
+	}
+	s.members[schid] = append(members, suaid)
+	return nil
+}
+
+func (s *testGroupStore) RemoveMember(schid, suaid string) error {
+	members := s.members[schid]
+	for i, member := range members {
+		if member == suaid {
+			s.members[schid] = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *testGroupStore) Members(schid string) ([]string, error) {
+	return s.members[schid], nil
+}
+
+func Test_UpdateHandlerFanOut(t *testing.T) {
+	uaids := []string{
+		"deadbeef000000000000000000000000",
+		"deadbeef000000000000000000000001",
+	}
+	chid := "decafbad000000000000000000000000"
+	data := "Shared update"
+
+	handler, app := newTestHandler(t)
+	store := &testGroupStore{
+		NoStore: app.Store().(*NoStore),
+		members: make(map[string][]string),
+	}
+	app.SetStore(store)
+	handler.store = store
+
+	workers := make([]*NoWorker, len(uaids))
+	for i, uaid := range uaids {
+		noPush := &PushWS{Born: time.Now()}
+		noPush.SetUAID(uaid)
+		workers[i] = &NoWorker{Socket: noPush, Logger: app.Logger()}
+		app.AddClient(uaid, &Client{workers[i], noPush, uaid})
+		store.AddMember(chid, uaid, true)
+	}
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT",
+		fmt.Sprintf("http://test/update/%s", GroupKey(chid)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{"version": {"2"}, "data": {data}}
+	tmux := mux.NewRouter()
+	tmux.HandleFunc("/update/{key}", handler.UpdateHandler)
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: got %d; want %d", resp.Code, http.StatusOK)
+	}
+	reply := FanOutReply{}
+	if err = json.Unmarshal(resp.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("Error decoding response body: %s", err)
+	}
+	if reply.Devices != 2 || reply.Delivered != 2 {
+		t.Errorf("Wrong fan-out reply: got %+v; want 2 devices, 2 delivered",
+			reply)
+	}
+	for i, worker := range workers {
+		rep := FlushData{}
+		if err = json.Unmarshal(worker.Outbuffer, &rep); err != nil {
+			t.Errorf("Could not read output buffer for %s: %s", uaids[i], err)
+			continue
+		}
+		if rep.Data != data || rep.Version != 2 {
+			t.Errorf("Wrong update for %s: got %+v", uaids[i], rep)
+		}
+	}
+
+	// Updates to a shared channel without members should be rejected.
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT",
+		fmt.Sprintf("http://test/update/%s", GroupKey(uaids[0])), nil)
+	req.Form = url.Values{"version": {"3"}}
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Wrong status code for empty channel: got %d; want %d",
+			resp.Code, http.StatusNotFound)
+	}
+}
+
+func Test_BatchUpdateHandler(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chids := []string{
+		"decafbad000000000000000000000000",
+		"decafbad000000000000000000000001",
+	}
+
+	handler, app := newTestHandler(t)
+	noPush := &PushWS{Born: time.Now()}
+	noPush.SetUAID(uaid)
+	worker := &NoWorker{Socket: noPush, Logger: app.Logger()}
+	app.AddClient(uaid, &Client{worker, noPush, uaid})
+
+	updates := make([]*BatchUpdate, 0, len(chids)+2)
+	for i, chid := range chids {
+		key, _ := app.Store().IDsToKey(uaid, chid)
+		updates = append(updates, &BatchUpdate{Token: key, Version: int64(i + 1)})
+	}
+	updates = append(updates,
+		&BatchUpdate{Token: "!invalid!"},
+		&BatchUpdate{Token: updates[0].Token, Version: -1})
+	body, _ := json.Marshal(updates)
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://test/update/batch",
+		strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.BatchUpdateHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: got %d; want %d", resp.Code, http.StatusOK)
+	}
+	reply := new(BatchUpdateReply)
+	if err = json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+		t.Fatalf("Error decoding response body: %s", err)
+	}
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusNotFound,
+		http.StatusBadRequest}
+	if len(reply.Results) != len(expected) {
+		t.Fatalf("Wrong result count: got %d; want %d", len(reply.Results),
+			len(expected))
+	}
+	for i, result := range reply.Results {
+		if result.Token != updates[i].Token {
+			t.Errorf("Result %d: wrong token: got %q; want %q", i, result.Token,
+				updates[i].Token)
+		}
+		if result.Status != expected[i] {
+			t.Errorf("Result %d: wrong status: got %d; want %d", i, result.Status,
+				expected[i])
+		}
+	}
+
+	// Batches over the size limit are rejected outright.
+	updates = make([]*BatchUpdate, handler.maxBatch+1)
+	for i := range updates {
+		updates[i] = &BatchUpdate{Token: reply.Results[0].Token}
+	}
+	body, _ = json.Marshal(updates)
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://test/update/batch",
+		strings.NewReader(string(body)))
+	handler.BatchUpdateHandler(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Wrong status code for large batch: got %d; want %d",
+			resp.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// So are bodies over the byte limit, before they are fully decoded.
+	handler.maxBatch = 1
+	updates = []*BatchUpdate{{Token: reply.Results[0].Token,
+		Data: strings.Repeat("x", 2*handler.maxDataLen+1024)}}
+	body, _ = json.Marshal(updates)
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://test/update/batch",
+		strings.NewReader(string(body)))
+	handler.BatchUpdateHandler(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Wrong status code for large body: got %d; want %d",
+			resp.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func Test_RealStatsHandler(t *testing.T) {
+	handler, app := newTestHandler(t)
+	stats := NewRealStats()
+	conf := stats.ConfigStruct().(*RealStatsConfig)
+	conf.Tokens = []string{"secret"}
+	conf.Interval = "10ms"
+	if err := stats.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing real-time stats: %s", err)
+	}
+	defer stats.Close()
+	app.Server().realStats = stats
+
+	server := httptest.NewServer(http.HandlerFunc(handler.RealStatsHandler))
+	defer server.Close()
+
+	// Tokens in the query string are rejected, even if valid.
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest("GET", server.URL+"?token=secret", nil)
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error opening stream: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Wrong status for header %q: got %d; want 401", auth,
+				resp.StatusCode)
+		}
+	}
+
+	app.Events().Publish(&Event{Type: EventUpdateAccepted})
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error opening stream: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Wrong content type: got %q", ct)
+	}
+	buf := make([]byte, 1024)
+	n, err := resp.Body.Read(buf)
+	if err != nil {
+		t.Fatalf("Error reading snapshot: %s", err)
+	}
+	event := string(buf[:n])
+	if !strings.HasPrefix(event, "event: stats\ndata: ") {
+		t.Fatalf("Wrong event: %q", event)
+	}
+	snapshot := new(RealStatsSnapshot)
+	data := strings.TrimSpace(strings.TrimPrefix(event, "event: stats\ndata: "))
+	if err = json.Unmarshal([]byte(data), snapshot); err != nil {
+		t.Fatalf("Error decoding snapshot %q: %s", data, err)
+	}
+	if !snapshot.Store.Healthy {
+		t.Errorf("Expected healthy store in snapshot: %#v", snapshot)
+	}
+}
@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HandshakeConfig limits the number of WebSocket upgrades processed at once.
+// Established connections are not counted against either limit.
+type HandshakeConfig struct {
+	// MaxConcurrent is the maximum number of in-flight handshakes. Defaults
+	// to 0 (unlimited).
+	MaxConcurrent int `toml:"max_concurrent" env:"max_concurrent"`
+
+	// QueueSize is the number of handshakes that may wait for a free slot.
+	// Requests that arrive when the queue is full are rejected immediately.
+	QueueSize int `toml:"queue_size" env:"queue_size"`
+
+	// QueueTimeout is the maximum time a handshake may wait in the queue.
+	QueueTimeout string `toml:"queue_timeout" env:"queue_timeout"`
+}
+
+// HandshakeLimiter bounds concurrent WebSocket handshakes, queuing a limited
+// number of waiting requests and rejecting the overflow with a 503.
+type HandshakeLimiter struct {
+	logger       *SimpleLogger
+	metrics      Statistician
+	slots        chan bool
+	queue        chan bool
+	queueTimeout time.Duration
+}
+
+func (l *HandshakeLimiter) ConfigStruct() interface{} {
+	return &HandshakeConfig{
+		MaxConcurrent: 0,
+		QueueSize:     100,
+		QueueTimeout:  "5s",
+	}
+}
+
+func (l *HandshakeLimiter) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*HandshakeConfig)
+	l.logger = app.Logger()
+	l.metrics = app.Metrics()
+
+	if l.queueTimeout, err = time.ParseDuration(conf.QueueTimeout); err != nil {
+		l.logger.Panic("handshake", "Could not parse handshake queue timeout",
+			LogFields{"error": err.Error(), "timeout": conf.QueueTimeout})
+		return err
+	}
+	if conf.MaxConcurrent > 0 {
+		l.slots = make(chan bool, conf.MaxConcurrent)
+		if conf.QueueSize > 0 {
+			l.queue = make(chan bool, conf.QueueSize)
+		}
+	}
+	return nil
+}
+
+// Acquire reserves a handshake slot, waiting in the queue if all slots are
+// taken. Returns false if the queue is full or the wait times out.
+func (l *HandshakeLimiter) Acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- true:
+		return true
+	default:
+	}
+	select {
+	case l.queue <- true:
+	default:
+		l.metrics.Increment("socket.handshake.overflow")
+		return false
+	}
+	defer func() { <-l.queue }()
+	l.metrics.Increment("socket.handshake.queued")
+	startTime := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- true:
+		l.metrics.Timer("socket.handshake.wait", time.Since(startTime))
+		return true
+	case <-timer.C:
+		l.metrics.Increment("socket.handshake.timeout")
+		return false
+	}
+}
+
+// Release frees a slot reserved by Acquire.
+func (l *HandshakeLimiter) Release() {
+	if l.slots == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Handler returns an http.Handler that upgrades connections with the given
+// transport, upgrade check, and WebSocket handler. A slot is held from the
+// time the request is accepted until the upgrade completes or fails.
+func (l *HandshakeLimiter) Handler(transport Transport, serve func(Socket),
+	check UpgradeCheck) http.Handler {
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !l.Acquire() {
+			if l.logger.ShouldLog(WARNING) {
+				l.logger.Warn("handshake", "Too many pending handshakes, rejecting",
+					LogFields{"rid": req.Header.Get(HeaderID)})
+			}
+			resp.Header().Set("Retry-After", fmt.Sprintf("%d",
+				int64(l.queueTimeout/time.Second)+1))
+			http.Error(resp, "Too many pending handshakes",
+				http.StatusServiceUnavailable)
+			l.metrics.Increment("socket.handshake.rejected")
+			return
+		}
+		var releaseOnce sync.Once
+		startTime := time.Now()
+		release := func() {
+			releaseOnce.Do(func() {
+				l.Release()
+				l.metrics.Timer("socket.handshake", time.Since(startTime))
+			})
+		}
+		defer release()
+		transport.Handler(func(ws Socket) {
+			release()
+			serve(ws)
+		}, check).ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,120 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func Test_HandshakeLimiter(t *testing.T) {
+	_, app := newTestHandler(t)
+	limiter := new(HandshakeLimiter)
+	conf := limiter.ConfigStruct().(*HandshakeConfig)
+	conf.MaxConcurrent = 1
+	conf.QueueSize = 1
+	conf.QueueTimeout = "10ms"
+	if err := limiter.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing handshake limiter: %s", err)
+	}
+
+	if !limiter.Acquire() {
+		t.Fatal("Expected first handshake to acquire a slot")
+	}
+	// The queued handshake times out while the slot is held.
+	if limiter.Acquire() {
+		t.Fatal("Expected queued handshake to time out")
+	}
+
+	handler := limiter.Handler(DefaultTransport, nil, nil)
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://test/", nil)
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status code: got %d; want %d", resp.Code,
+			http.StatusServiceUnavailable)
+	}
+	if resp.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header for rejected handshake")
+	}
+
+	// Releasing the slot admits the next handshake.
+	limiter.Release()
+	if !limiter.Acquire() {
+		t.Fatal("Expected handshake to acquire released slot")
+	}
+	limiter.Release()
+
+	// Failed upgrades release their slot.
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error sending invalid upgrade: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Wrong status code for invalid upgrade: got %d; want %d",
+			res.StatusCode, http.StatusBadRequest)
+	}
+	if !limiter.Acquire() {
+		t.Error("Expected failed upgrade to release its slot")
+	}
+}
+
+func Test_UpgradeCheck(t *testing.T) {
+	_, app := newTestHandler(t)
+	allowed, _ := url.ParseRequestURI("https://example.com")
+	app.origins = []*url.URL{allowed}
+	app.subprotocols = []string{"push-notification"}
+	app.requireSubprotocol = true
+
+	server := httptest.NewServer(DefaultTransport.Handler(func(ws Socket) {
+		ws.Close()
+	}, app.checkUpgrade))
+	defer server.Close()
+	location := "ws" + server.URL[len("http"):]
+
+	tests := []struct {
+		name      string
+		origin    string
+		protocols []string
+		ok        bool
+	}{
+		{"Allowed", "https://example.com", []string{"other", "push-notification"}, true},
+		{"Wrong origin", "https://evil.example.com", []string{"push-notification"}, false},
+		{"Wrong subprotocol", "https://example.com", []string{"other"}, false},
+		{"Missing subprotocol", "https://example.com", nil, false},
+	}
+	for _, test := range tests {
+		config, err := websocket.NewConfig(location, test.origin)
+		if err != nil {
+			t.Fatalf("%s: error creating config: %s", test.name, err)
+		}
+		config.Protocol = test.protocols
+		ws, err := websocket.DialConfig(config)
+		if !test.ok {
+			if err == nil {
+				ws.Close()
+				t.Errorf("%s: handshake accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error dialing: %s", test.name, err)
+			continue
+		}
+		// The client records the subprotocol selected by the server.
+		if protocol := ws.Config().Protocol; len(protocol) != 1 ||
+			protocol[0] != "push-notification" {
+			t.Errorf("%s: wrong subprotocol: got %q", test.name, protocol)
+		}
+		ws.Close()
+	}
+}
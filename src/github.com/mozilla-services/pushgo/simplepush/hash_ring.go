@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// HashRing assigns keys to nodes with consistent hashing. Each node is
+// placed on the ring at several points, so that keys are spread evenly, and
+// only the keys owned by a node move when it joins or leaves.
+type HashRing struct {
+	replicas int
+	lock     sync.RWMutex
+	nodes    []string          // Sorted.
+	points   []uint32          // Sorted.
+	owners   map[uint32]string // Maps points to nodes.
+}
+
+// NewHashRing creates an empty ring that places each node at the given
+// number of points.
+func NewHashRing(replicas int) *HashRing {
+	if replicas < 1 {
+		replicas = 1
+	}
+	return &HashRing{replicas: replicas, owners: make(map[uint32]string)}
+}
+
+// Set replaces the nodes on the ring. Returns true if the nodes changed.
+// The comparison and the update happen under the same lock, so that
+// concurrent refreshes do not both report a change, or apply stale nodes.
+func (h *HashRing) Set(nodes []string) bool {
+	sorted := make([]string, len(nodes))
+	copy(sorted, nodes)
+	sort.Strings(sorted)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	unchanged := len(sorted) == len(h.nodes)
+	for i := 0; unchanged && i < len(sorted); i++ {
+		unchanged = sorted[i] == h.nodes[i]
+	}
+	if unchanged {
+		return false
+	}
+	points := make([]uint32, 0, len(sorted)*h.replicas)
+	owners := make(map[uint32]string, len(sorted)*h.replicas)
+	for _, node := range sorted {
+		for i := 0; i < h.replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + node))
+			if _, ok := owners[point]; ok {
+				// Resolve collisions in favor of the first node.
+				continue
+			}
+			owners[point] = node
+			points = append(points, point)
+		}
+	}
+	sort.Sort(uint32Slice(points))
+	h.nodes, h.points, h.owners = sorted, points, owners
+	return true
+}
+
+// Owner returns the node that owns the key, or an empty string if the ring
+// is empty.
+func (h *HashRing) Owner(key string) string {
+	point := crc32.ChecksumIEEE([]byte(key))
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= point })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// Nodes returns the nodes on the ring.
+func (h *HashRing) Nodes() []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	nodes := make([]string, len(h.nodes))
+	copy(nodes, h.nodes)
+	return nodes
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
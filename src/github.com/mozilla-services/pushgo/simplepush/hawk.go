@@ -0,0 +1,399 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingSignature  = errors.New("Missing request signature")
+	ErrInvalidSignature  = errors.New("Invalid request signature")
+	ErrUnknownHawkID     = errors.New("Unknown Hawk credentials")
+	ErrStaleTimestamp    = errors.New("Stale timestamp")
+	ErrReplayedNonce     = errors.New("Replayed nonce")
+	ErrInvalidPayload    = errors.New("Payload hash mismatch")
+	ErrInvalidHawkCreds  = errors.New(`Hawk credentials must be of the form "id:secret"`)
+	ErrSignedBodyTooLong = errors.New("Signed request body too long")
+	ErrUnreadableBody    = errors.New("Could not read signed request body")
+)
+
+type HawkConfig struct {
+	// Required rejects updates without a Hawk signature. If not set,
+	// unsigned updates are accepted, but invalid signatures are rejected.
+	Required bool `env:"required"`
+
+	// Credentials lists the shared secret of each app server, each of the
+	// form "id:secret".
+	Credentials []string `env:"credentials"`
+
+	// RequireHash rejects signatures that do not cover the request body.
+	RequireHash bool `toml:"require_hash" env:"require_hash"`
+
+	// Skew is the maximum allowed difference between the signature
+	// timestamp and the server clock. Defaults to 1 minute.
+	Skew string `env:"skew"`
+
+	// MaxNonces is the maximum number of nonces remembered to detect
+	// replayed requests. Defaults to 100000.
+	MaxNonces int `toml:"max_nonces" env:"max_nonces"`
+}
+
+// NonceStore is implemented by storage adapters that can record nonces for
+// all nodes, so that a signed request replayed against another node is
+// rejected. Without one, each node only detects replays that it has seen.
+type NonceStore interface {
+	// AddNonce records a nonce for at least ttl, and returns false if it
+	// was already recorded.
+	AddNonce(nonce string, ttl time.Duration) (added bool, err error)
+}
+
+// hawkAuth holds the attributes of a Hawk Authorization header.
+type hawkAuth struct {
+	id, ts, nonce, hash, ext, app, dlg, mac string
+}
+
+// parseHawkHeader parses a header of the form `Hawk id="...", ts="...",
+// nonce="...", mac="..."`. Values are quoted strings, which may contain
+// commas and backslash-escaped characters.
+func parseHawkHeader(header string) (auth *hawkAuth, ok bool) {
+	if len(header) < 5 || !strings.EqualFold(header[:5], "Hawk ") {
+		return nil, false
+	}
+	auth = new(hawkAuth)
+	rest := header[5:]
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if len(rest) == 0 {
+			break
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq < 1 || eq+1 >= len(rest) || rest[eq+1] != '"' {
+			return nil, false
+		}
+		name := strings.TrimSpace(rest[:eq])
+		var value string
+		if value, rest, ok = parseQuotedString(rest[eq+1:]); !ok {
+			return nil, false
+		}
+		var field *string
+		switch name {
+		case "id":
+			field = &auth.id
+		case "ts":
+			field = &auth.ts
+		case "nonce":
+			field = &auth.nonce
+		case "hash":
+			field = &auth.hash
+		case "ext":
+			field = &auth.ext
+		case "app":
+			field = &auth.app
+		case "dlg":
+			field = &auth.dlg
+		case "mac":
+			field = &auth.mac
+		default:
+			return nil, false
+		}
+		if len(*field) > 0 {
+			// Duplicate attributes are ambiguous.
+			return nil, false
+		}
+		*field = value
+		if rest = strings.TrimLeft(rest, " \t"); len(rest) > 0 {
+			if rest[0] != ',' {
+				return nil, false
+			}
+			rest = rest[1:]
+		}
+	}
+	if len(auth.id) == 0 || len(auth.ts) == 0 || len(auth.nonce) == 0 || len(auth.mac) == 0 {
+		return nil, false
+	}
+	return auth, true
+}
+
+// parseQuotedString parses a quoted string at the start of s, as defined by
+// RFC 7230, section 3.2.6, and returns its unescaped value and the rest of s.
+func parseQuotedString(s string) (value, rest string, ok bool) {
+	if len(s) == 0 || s[0] != '"' {
+		return "", s, false
+	}
+	var buf []byte
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return string(buf), s[i+1:], true
+		case '\\':
+			if i++; i == len(s) {
+				return "", s, false
+			}
+			buf = append(buf, s[i])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", s, false
+}
+
+// hawkMAC returns the base64-encoded HMAC-SHA256 of a normalized string.
+func hawkMAC(secret []byte, normalized string) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, normalized)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hawkPayloadHash returns the Hawk hash of a request body.
+func hawkPayloadHash(contentType string, body []byte) string {
+	if semi := strings.Index(contentType, ";"); semi >= 0 {
+		contentType = contentType[:semi]
+	}
+	hash := sha256.New()
+	io.WriteString(hash, "hawk.1.payload\n")
+	io.WriteString(hash, strings.ToLower(strings.TrimSpace(contentType)))
+	io.WriteString(hash, "\n")
+	hash.Write(body)
+	io.WriteString(hash, "\n")
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// normalized returns the Hawk normalized request string for a header MAC.
+func (auth *hawkAuth) normalized(req *http.Request) string {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	fields := []string{"hawk.1.header", auth.ts, auth.nonce, req.Method,
+		req.URL.RequestURI(), strings.ToLower(host), port, auth.hash, auth.ext}
+	if len(auth.app) > 0 {
+		fields = append(fields, auth.app, auth.dlg)
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// nonceCache remembers recently seen nonces. Nonces are kept for at least
+// the allowed clock skew, after which requests using them are stale.
+type nonceCache struct {
+	lock     sync.Mutex
+	maxSize  int
+	ttl      time.Duration
+	current  map[string]bool
+	previous map[string]bool
+	rotated  time.Time
+}
+
+func newNonceCache(ttl time.Duration, maxSize int) *nonceCache {
+	return &nonceCache{
+		maxSize:  maxSize,
+		ttl:      ttl,
+		current:  make(map[string]bool),
+		previous: make(map[string]bool),
+		rotated:  time.Now(),
+	}
+}
+
+// Add records a nonce, and returns false if it was already seen.
+func (c *nonceCache) Add(nonce string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.current[nonce] || c.previous[nonce] {
+		return false
+	}
+	if now.Sub(c.rotated) >= 2*c.ttl || len(c.current) >= c.maxSize/2 {
+		c.previous = c.current
+		c.current = make(map[string]bool, len(c.previous))
+		c.rotated = now
+	}
+	c.current[nonce] = true
+	return true
+}
+
+// HawkVerifier verifies Hawk request signatures made with per-app shared
+// secrets, for app servers that cannot use VAPID.
+type HawkVerifier struct {
+	app         *Application
+	logger      *SimpleLogger
+	metrics     Statistician
+	required    bool
+	requireHash bool
+	skew        time.Duration
+	secretsLock sync.RWMutex
+	secrets     map[string][]byte
+	nonces      *nonceCache
+}
+
+func NewHawkVerifier() *HawkVerifier {
+	return &HawkVerifier{secrets: make(map[string][]byte)}
+}
+
+func (*HawkVerifier) ConfigStruct() interface{} {
+	return &HawkConfig{
+		Skew:      "1m",
+		MaxNonces: 100000,
+	}
+}
+
+func (h *HawkVerifier) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*HawkConfig)
+	h.app = app
+	h.logger = app.Logger()
+	h.metrics = app.Metrics()
+	h.required = conf.Required
+	h.requireHash = conf.RequireHash
+	if h.skew, err = time.ParseDuration(conf.Skew); err != nil {
+		h.logger.Panic("hawk", "Could not parse Hawk clock skew",
+			LogFields{"error": err.Error(), "skew": conf.Skew})
+		return err
+	}
+	if err = h.SetCredentials(conf.Credentials); err != nil {
+		h.logger.Panic("hawk", "Could not parse Hawk credentials",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	app.Secrets().OnChange("default.hawk.credentials", h.SetCredentials)
+	h.nonces = newNonceCache(h.skew, conf.MaxNonces)
+	return nil
+}
+
+// SetCredentials replaces the shared secrets, each of the form "id:secret".
+func (h *HawkVerifier) SetCredentials(credentials []string) error {
+	secrets := make(map[string][]byte, len(credentials))
+	for _, creds := range credentials {
+		colon := strings.Index(creds, ":")
+		if colon < 1 || colon == len(creds)-1 {
+			return ErrInvalidHawkCreds
+		}
+		secrets[creds[:colon]] = []byte(creds[colon+1:])
+	}
+	h.secretsLock.Lock()
+	h.secrets = secrets
+	h.secretsLock.Unlock()
+	return nil
+}
+
+// secret returns the shared secret for a Hawk ID.
+func (h *HawkVerifier) secret(id string) (secret []byte, ok bool) {
+	h.secretsLock.RLock()
+	secret, ok = h.secrets[id]
+	h.secretsLock.RUnlock()
+	return
+}
+
+// Verify checks the Hawk signature of an update request, reading at most
+// maxBody bytes of the body to verify the payload hash. The body is
+// replaced so that it can be read again. Verify returns the app server's
+// Hawk ID, which is empty if signatures are not required and none was sent.
+func (h *HawkVerifier) Verify(req *http.Request, maxBody int64) (id string, err error) {
+	if h == nil {
+		return "", nil
+	}
+	header := req.Header.Get("Authorization")
+	auth, ok := parseHawkHeader(header)
+	if !ok {
+		if len(header) >= 5 && strings.EqualFold(header[:5], "Hawk ") {
+			h.metrics.Increment("hawk.invalid")
+			return "", ErrInvalidSignature
+		}
+		// Other schemes, like bearer API keys, are not signatures.
+		if h.required {
+			h.metrics.Increment("hawk.missing")
+			return "", ErrMissingSignature
+		}
+		return "", nil
+	}
+	secret, ok := h.secret(auth.id)
+	if !ok {
+		h.metrics.Increment("hawk.unknown")
+		return auth.id, ErrUnknownHawkID
+	}
+	expected := hawkMAC(secret, auth.normalized(req))
+	if !hmac.Equal([]byte(expected), []byte(auth.mac)) {
+		h.metrics.Increment("hawk.invalid")
+		return auth.id, ErrInvalidSignature
+	}
+	now := time.Now()
+	ts, err := strconv.ParseInt(auth.ts, 10, 64)
+	if err != nil {
+		h.metrics.Increment("hawk.invalid")
+		return auth.id, ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > h.skew || skew < -h.skew {
+		h.metrics.Increment("hawk.stale")
+		return auth.id, ErrStaleTimestamp
+	}
+	if len(auth.hash) > 0 {
+		var body []byte
+		if req.Body != nil {
+			if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1)); err != nil {
+				return auth.id, ErrUnreadableBody
+			}
+			if int64(len(body)) > maxBody {
+				return auth.id, ErrSignedBodyTooLong
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		payloadHash := hawkPayloadHash(req.Header.Get("Content-Type"), body)
+		if !hmac.Equal([]byte(payloadHash), []byte(auth.hash)) {
+			h.metrics.Increment("hawk.payload")
+			return auth.id, ErrInvalidPayload
+		}
+	} else if h.requireHash {
+		h.metrics.Increment("hawk.payload")
+		return auth.id, ErrInvalidPayload
+	}
+	// Check the nonce last, so that invalid requests cannot fill the cache.
+	nonce := auth.id + ":" + auth.ts + ":" + auth.nonce
+	if !h.nonces.Add(nonce, now) {
+		h.metrics.Increment("hawk.replayed")
+		return auth.id, ErrReplayedNonce
+	}
+	if store, ok := h.app.Store().(NonceStore); ok {
+		// Signatures are accepted while the timestamp is within the skew of
+		// the clock, on either side.
+		added, err := store.AddNonce(nonce, 2*h.skew)
+		if err != nil {
+			if h.logger.ShouldLog(ERROR) {
+				h.logger.Error("hawk", "Could not record nonce",
+					LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+			}
+			return auth.id, err
+		}
+		if !added {
+			h.metrics.Increment("hawk.replayed")
+			return auth.id, ErrReplayedNonce
+		}
+	}
+	return auth.id, nil
+}
+
+// Challenge returns the WWW-Authenticate header value for a failed
+// verification. Stale timestamp errors include the server time, signed
+// with the app server's secret, so that it can correct its clock.
+func (h *HawkVerifier) Challenge(id string, err error) string {
+	if err != ErrStaleTimestamp {
+		return "Hawk"
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	secret, _ := h.secret(id)
+	tsm := hawkMAC(secret, "hawk.1.ts\n"+ts+"\n")
+	return `Hawk ts="` + ts + `", tsm="` + tsm + `", error="` + err.Error() + `"`
+}
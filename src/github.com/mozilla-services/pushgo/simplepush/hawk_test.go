@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signHawkRequest signs a request as an app server would.
+func signHawkRequest(req *http.Request, id, secret, nonce string, ts time.Time,
+	body string) {
+
+	auth := &hawkAuth{id: id, ts: strconv.FormatInt(ts.Unix(), 10), nonce: nonce}
+	if len(body) > 0 {
+		auth.hash = hawkPayloadHash(req.Header.Get("Content-Type"), []byte(body))
+	}
+	auth.mac = hawkMAC([]byte(secret), auth.normalized(req))
+	header := `Hawk id="` + auth.id + `", ts="` + auth.ts + `", nonce="` +
+		auth.nonce + `", mac="` + auth.mac + `"`
+	if len(auth.hash) > 0 {
+		header += `, hash="` + auth.hash + `"`
+	}
+	req.Header.Set("Authorization", header)
+}
+
+func TestHawkVerifier(t *testing.T) {
+	_, app := newTestHandler(t)
+	hawk := NewHawkVerifier()
+	conf := hawk.ConfigStruct().(*HawkConfig)
+	conf.Required = true
+	conf.Credentials = []string{"app:s3cr3t"}
+	if err := hawk.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing Hawk verifier: %s", err)
+	}
+
+	now := time.Now()
+	newRequest := func(body string) *http.Request {
+		req, _ := http.NewRequest("PUT", "http://push.example.com:8081/update/abc?x=1",
+			strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		return req
+	}
+	tests := []struct {
+		name string
+		sign func(*http.Request)
+		err  error
+	}{
+		{"Unsigned", func(*http.Request) {}, ErrMissingSignature},
+		{"Bearer token", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+		}, ErrMissingSignature},
+		{"Malformed", func(req *http.Request) {
+			req.Header.Set("Authorization", `Hawk id="app"`)
+		}, ErrInvalidSignature},
+		{"Unknown ID", func(req *http.Request) {
+			signHawkRequest(req, "other", "s3cr3t", "n1", now, "")
+		}, ErrUnknownHawkID},
+		{"Wrong secret", func(req *http.Request) {
+			signHawkRequest(req, "app", "wrong", "n1", now, "")
+		}, ErrInvalidSignature},
+		{"Stale", func(req *http.Request) {
+			signHawkRequest(req, "app", "s3cr3t", "n1", now.Add(-2*time.Minute), "")
+		}, ErrStaleTimestamp},
+		{"Tampered payload", func(req *http.Request) {
+			signHawkRequest(req, "app", "s3cr3t", "n1", now, "version=2")
+		}, ErrInvalidPayload},
+		{"Signed", func(req *http.Request) {
+			signHawkRequest(req, "app", "s3cr3t", "n1", now, "version=1")
+		}, nil},
+		{"Replayed", func(req *http.Request) {
+			signHawkRequest(req, "app", "s3cr3t", "n1", now, "version=1")
+		}, ErrReplayedNonce},
+	}
+	for _, test := range tests {
+		req := newRequest("version=1")
+		test.sign(req)
+		id, err := hawk.Verify(req, 1024)
+		if err != test.err {
+			t.Errorf("%s: got error %v; want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if id != "app" {
+			t.Errorf("%s: wrong Hawk ID: got %q; want app", test.name, id)
+		}
+		// The body can be read again after verification.
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != "version=1" {
+			t.Errorf("%s: wrong body after verification: %q", test.name, body)
+		}
+	}
+
+	challenge := hawk.Challenge("app", ErrStaleTimestamp)
+	if !strings.Contains(challenge, `tsm="`) || !strings.Contains(challenge, "Stale timestamp") {
+		t.Errorf("Wrong stale timestamp challenge: %s", challenge)
+	}
+}
+
+func TestParseHawkHeader(t *testing.T) {
+	auth, ok := parseHawkHeader(`Hawk id="app", ts="1", nonce="a,b", ` +
+		`ext="say \"hi\", x=\\y",mac="m"`)
+	if !ok {
+		t.Fatalf("Valid header was rejected")
+	}
+	if auth.nonce != "a,b" || auth.ext != `say "hi", x=\y` || auth.mac != "m" {
+		t.Errorf("Wrong attributes: %#v", auth)
+	}
+	for _, header := range []string{
+		`Hawk id="app", ts="1", nonce="n", mac="m`,
+		`Hawk id="app", ts="1", nonce="n", mac="m" x`,
+		`Hawk id="app" ts="1", nonce="n", mac="m"`,
+		`Hawk id="app", id="other", ts="1", nonce="n", mac="m"`,
+		`Hawk id=app, ts="1", nonce="n", mac="m"`,
+	} {
+		if _, ok := parseHawkHeader(header); ok {
+			t.Errorf("Invalid header was accepted: %s", header)
+		}
+	}
+}
+
+// nonceTestStore records nonces for several verifiers, as a shared storage
+// adapter would.
+type nonceTestStore struct {
+	*NoStore
+	nonces map[string]bool
+}
+
+func (s *nonceTestStore) AddNonce(nonce string, ttl time.Duration) (bool, error) {
+	if s.nonces[nonce] {
+		return false, nil
+	}
+	s.nonces[nonce] = true
+	return true, nil
+}
+
+func TestHawkVerifierSharedNonces(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.store = &nonceTestStore{NoStore: app.Store().(*NoStore),
+		nonces: make(map[string]bool)}
+	// Each verifier has its own nonce cache, as separate nodes do.
+	verifiers := make([]*HawkVerifier, 2)
+	for i := range verifiers {
+		verifiers[i] = NewHawkVerifier()
+		conf := verifiers[i].ConfigStruct().(*HawkConfig)
+		conf.Credentials = []string{"app:s3cr3t"}
+		if err := verifiers[i].Init(app, conf); err != nil {
+			t.Fatalf("Error initializing Hawk verifier: %s", err)
+		}
+	}
+	now := time.Now()
+	for i, want := range []error{nil, ErrReplayedNonce} {
+		req, _ := http.NewRequest("PUT", "http://push.example.com/update/abc", nil)
+		signHawkRequest(req, "app", "s3cr3t", "n1", now, "")
+		if _, err := verifiers[i].Verify(req, 1024); err != want {
+			t.Errorf("Node %d: got error %v; want %v", i, err, want)
+		}
+	}
+}
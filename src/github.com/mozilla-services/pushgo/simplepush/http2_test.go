@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// newH2CTransport returns a client transport that speaks HTTP/2 with prior
+// knowledge over plain TCP.
+func newH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+func TestEndpointH2C(t *testing.T) {
+	_, app := newTestHandler(t)
+	serv := app.Server()
+	conf := serv.ConfigStruct().(*ServerConfig)
+	conf.HTTP2.Cleartext = true
+	if err := serv.initHTTP2(&conf.HTTP2); err != nil {
+		t.Fatalf("Error configuring HTTP/2: %s", err)
+	}
+	ln, err := Listen("127.0.0.1:0", 10, 0)
+	if err != nil {
+		t.Fatalf("Error starting update listener: %s", err)
+	}
+	defer ln.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte(req.Proto))
+		})}
+	serv.ConfigureEndpoint(srv)
+	go srv.Serve(ln)
+
+	transport := newH2CTransport()
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Error sending h2c request: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Errorf("Wrong protocol: got %s (server saw %s); want HTTP/2.0",
+				resp.Proto, body)
+		}
+	}
+	if n := ln.(*LimitListener).ConnCount(); n != 1 {
+		t.Errorf("Wrong connection count: got %d; want 1", n)
+	}
+}
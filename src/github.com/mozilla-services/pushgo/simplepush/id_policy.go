@@ -0,0 +1,202 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+// ID validation modes.
+const (
+	IDModeUUID    = "uuid"
+	IDModeHex     = "hex"
+	IDModePattern = "pattern"
+)
+
+var (
+	ErrIDFormat = errors.New("Malformed ID")
+	ErrIDLength = errors.New("ID length out of range")
+)
+
+type IDPolicyConfig struct {
+	// Mode selects how client-supplied device and channel IDs are validated:
+	// "uuid" (the default) accepts hyphenated or unhyphenated UUIDs; "hex"
+	// accepts legacy hex-encoded IDs; "pattern" accepts IDs that match
+	// Pattern. The memcached storage adapters only accept UUIDs.
+	Mode string `env:"mode"`
+
+	// Pattern is the regular expression that IDs must match in "pattern"
+	// mode. The pattern is anchored at both ends.
+	Pattern string `env:"pattern"`
+
+	// MinLength and MaxLength bound the length of IDs in "hex" and "pattern"
+	// modes. Default to 1 and 64.
+	MinLength int `toml:"min_length" env:"min_length"`
+	MaxLength int `toml:"max_length" env:"max_length"`
+}
+
+// IDValidator checks the format of a device or channel ID, returning
+// ErrIDLength or ErrIDFormat for invalid IDs.
+type IDValidator interface {
+	Validate(id string) error
+}
+
+// uuidValidator accepts UUIDs, as validated by the id package.
+type uuidValidator struct{}
+
+func (uuidValidator) Validate(s string) error {
+	if len(s) != 32 && len(s) != 36 {
+		return ErrIDLength
+	}
+	if !id.Valid(s) {
+		return ErrIDFormat
+	}
+	return nil
+}
+
+// hexValidator accepts hex-encoded IDs of any case.
+type hexValidator struct {
+	minLen, maxLen int
+}
+
+func (v hexValidator) Validate(s string) error {
+	if len(s) < v.minLen || len(s) > v.maxLen {
+		return ErrIDLength
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if (b < '0' || b > '9') && (b < 'a' || b > 'f') && (b < 'A' || b > 'F') {
+			return ErrIDFormat
+		}
+	}
+	return nil
+}
+
+// patternValidator accepts IDs that match a regular expression.
+type patternValidator struct {
+	pattern        *regexp.Regexp
+	minLen, maxLen int
+}
+
+func (v patternValidator) Validate(s string) error {
+	if len(s) < v.minLen || len(s) > v.maxLen {
+		return ErrIDLength
+	}
+	if !v.pattern.MatchString(s) {
+		return ErrIDFormat
+	}
+	return nil
+}
+
+// NewIDValidator returns the validator for the configured mode.
+func NewIDValidator(conf *IDPolicyConfig) (IDValidator, error) {
+	minLen, maxLen := conf.MinLength, conf.MaxLength
+	if minLen <= 0 {
+		minLen = 1
+	}
+	if maxLen <= 0 {
+		maxLen = 64
+	}
+	if minLen > maxLen {
+		return nil, fmt.Errorf("ID min_length %d exceeds max_length %d",
+			minLen, maxLen)
+	}
+	switch conf.Mode {
+	case "", IDModeUUID:
+		return uuidValidator{}, nil
+	case IDModeHex:
+		return hexValidator{minLen, maxLen}, nil
+	case IDModePattern:
+		if len(conf.Pattern) == 0 {
+			return nil, fmt.Errorf("ID mode %q requires a pattern", IDModePattern)
+		}
+		pattern, err := regexp.Compile("^(?:" + conf.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ID pattern: %s", err)
+		}
+		return patternValidator{pattern, minLen, maxLen}, nil
+	}
+	return nil, fmt.Errorf("Unknown ID mode %q", conf.Mode)
+}
+
+// IDPolicy validates client-supplied device and channel IDs, reporting
+// format and length violations with distinct service errors.
+type IDPolicy struct {
+	validator IDValidator
+	metrics   Statistician
+}
+
+func NewIDPolicy() *IDPolicy {
+	return &IDPolicy{validator: uuidValidator{}}
+}
+
+func (*IDPolicy) ConfigStruct() interface{} {
+	return &IDPolicyConfig{
+		Mode:      IDModeUUID,
+		MinLength: 1,
+		MaxLength: 64,
+	}
+}
+
+func (p *IDPolicy) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*IDPolicyConfig)
+	p.metrics = app.Metrics()
+	if p.validator, err = NewIDValidator(conf); err != nil {
+		app.Logger().Panic("ids", "Invalid ID policy",
+			LogFields{"error": err.Error(), "mode": conf.Mode})
+		return err
+	}
+	return nil
+}
+
+// SetValidator replaces the validator, for deployments with custom rules.
+func (p *IDPolicy) SetValidator(validator IDValidator) {
+	p.validator = validator
+}
+
+// DeviceID validates a device ID, returning ErrDeviceIDLength or
+// ErrInvalidID.
+func (p *IDPolicy) DeviceID(uaid string) error {
+	switch p.validate(uaid) {
+	case nil:
+		return nil
+	case ErrIDLength:
+		p.increment("ids.invalid.device.length")
+		return ErrDeviceIDLength
+	}
+	p.increment("ids.invalid.device.format")
+	return ErrInvalidID
+}
+
+// ChannelID validates a channel ID, returning ErrChannelIDLength or
+// ErrInvalidParams.
+func (p *IDPolicy) ChannelID(chid string) error {
+	switch p.validate(chid) {
+	case nil:
+		return nil
+	case ErrIDLength:
+		p.increment("ids.invalid.channel.length")
+		return ErrChannelIDLength
+	}
+	p.increment("ids.invalid.channel.format")
+	return ErrInvalidParams
+}
+
+func (p *IDPolicy) validate(s string) error {
+	if p == nil {
+		return uuidValidator{}.Validate(s)
+	}
+	return p.validator.Validate(s)
+}
+
+func (p *IDPolicy) increment(metric string) {
+	if p != nil && p.metrics != nil {
+		p.metrics.Increment(metric)
+	}
+}
@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIDValidators(t *testing.T) {
+	tests := []struct {
+		name string
+		conf IDPolicyConfig
+		id   string
+		err  error
+	}{
+		{"UUID", IDPolicyConfig{}, "d1c7c768b1be4c7093a69b52910d4baa", nil},
+		{"Hyphenated UUID", IDPolicyConfig{Mode: IDModeUUID},
+			"d1c7c768-b1be-4c70-93a6-9b52910d4baa", nil},
+		{"Short UUID", IDPolicyConfig{}, "d1c7c768", ErrIDLength},
+		{"Malformed UUID", IDPolicyConfig{}, "z1c7c768b1be4c7093a69b52910d4baa", ErrIDFormat},
+		{"Legacy hex", IDPolicyConfig{Mode: IDModeHex}, "D1C7c768", nil},
+		{"Malformed hex", IDPolicyConfig{Mode: IDModeHex}, "d1c7-c768", ErrIDFormat},
+		{"Long hex", IDPolicyConfig{Mode: IDModeHex, MaxLength: 8}, "d1c7c768b", ErrIDLength},
+		{"Pattern", IDPolicyConfig{Mode: IDModePattern, Pattern: "[a-z]+-[0-9]+"},
+			"device-42", nil},
+		{"Unanchored pattern", IDPolicyConfig{Mode: IDModePattern, Pattern: "[a-z]+"},
+			"device-42", ErrIDFormat},
+		{"Short pattern", IDPolicyConfig{Mode: IDModePattern, Pattern: "[a-z]+",
+			MinLength: 4}, "dev", ErrIDLength},
+	}
+	for _, test := range tests {
+		validator, err := NewIDValidator(&test.conf)
+		if err != nil {
+			t.Errorf("%s: error creating validator: %s", test.name, err)
+			continue
+		}
+		if err = validator.Validate(test.id); err != test.err {
+			t.Errorf("%s: got %v; want %v", test.name, err, test.err)
+		}
+	}
+
+	invalid := []IDPolicyConfig{
+		{Mode: "base64"},
+		{Mode: IDModePattern},
+		{Mode: IDModePattern, Pattern: "["},
+		{Mode: IDModeHex, MinLength: 10, MaxLength: 5},
+	}
+	for _, conf := range invalid {
+		if _, err := NewIDValidator(&conf); err == nil {
+			t.Errorf("Invalid policy accepted: %#v", conf)
+		}
+	}
+}
+
+func TestIDPolicyErrors(t *testing.T) {
+	var policy *IDPolicy
+	if err := policy.DeviceID("d1c7c768b1be4c7093a69b52910d4baa"); err != nil {
+		t.Errorf("Valid device ID rejected: %s", err)
+	}
+	if err := policy.DeviceID(strings.Repeat("a", 64000)); err != ErrDeviceIDLength {
+		t.Errorf("Wrong error for long device ID: %v", err)
+	}
+	if err := policy.DeviceID("!@#$%^&*()-+!@#$%^&*()-+!@#$%^&*"); err != ErrInvalidID {
+		t.Errorf("Wrong error for malformed device ID: %v", err)
+	}
+	if err := policy.ChannelID(""); err != ErrChannelIDLength {
+		t.Errorf("Wrong error for empty channel ID: %v", err)
+	}
+	if err := policy.ChannelID("z1c7c768b1be4c7093a69b52910d4baa"); err != ErrInvalidParams {
+		t.Errorf("Wrong error for malformed channel ID: %v", err)
+	}
+
+	// Length violations are described to clients; format errors are not.
+	status, message := ErrToStatus(ErrChannelIDLength)
+	if status != 401 || message != ErrChannelIDLength.Error() {
+		t.Errorf("Wrong channel length error reply: %d %q", status, message)
+	}
+	if _, message = ErrToStatus(ErrInvalidParams); message == ErrChannelIDLength.Error() {
+		t.Errorf("Format and length errors are indistinguishable: %q", message)
+	}
+}
@@ -0,0 +1,236 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+type InFlightConfig struct {
+	// MaxSize is the maximum number of disconnected devices whose
+	// unacknowledged updates are kept for handoff. Set to 0 to disable
+	// handoff; devices then only receive updates kept in storage. Defaults
+	// to 10000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// TTL is the amount of time to keep a disconnected device's
+	// unacknowledged updates. Defaults to 2 minutes.
+	TTL string `env:"ttl"`
+}
+
+// InFlightReply is the body of the in-flight handoff endpoint's reply.
+type InFlightReply struct {
+	UAID    string   `json:"uaid"`
+	Updates []Update `json:"updates"`
+}
+
+type inFlightEntry struct {
+	updates []Update
+	expires time.Time
+}
+
+// InFlight holds updates that were sent to a device that disconnected
+// before acknowledging them. When the device reconnects, the node that
+// accepts it takes these updates, either from its own cache or from the
+// previous node, and merges them with the updates in storage, so that
+// updates are neither lost nor delivered twice when a device switches
+// nodes.
+type InFlight struct {
+	logger  *SimpleLogger
+	metrics Statistician
+	router  *Router
+	ttl     time.Duration
+	maxSize int
+	client  *http.Client
+
+	lock    sync.Mutex
+	entries map[string]inFlightEntry
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{entries: make(map[string]inFlightEntry)}
+}
+
+func (*InFlight) ConfigStruct() interface{} {
+	return &InFlightConfig{
+		MaxSize: 10000,
+		TTL:     "2m",
+	}
+}
+
+// Init configures in-flight handoff for the given router.
+func (f *InFlight) Init(app *Application, config interface{}, router *Router) (err error) {
+	conf := config.(*InFlightConfig)
+	f.logger = app.Logger()
+	f.metrics = app.Metrics()
+	f.router = router
+	f.maxSize = conf.MaxSize
+	if !f.Enabled() {
+		return nil
+	}
+	if f.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		f.logger.Panic("router", "Could not parse in-flight TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	f.client = router.HTTPClient(router.rwtimeout)
+	return nil
+}
+
+// Enabled indicates whether unacknowledged updates are handed off.
+func (f *InFlight) Enabled() bool {
+	return f != nil && f.maxSize > 0
+}
+
+// Len returns the number of devices with stashed updates.
+func (f *InFlight) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.entries)
+}
+
+// Stash keeps a disconnected device's unacknowledged updates until the
+// device reconnects or the TTL elapses.
+func (f *InFlight) Stash(uaid string, updates []Update) {
+	if !f.Enabled() || len(uaid) == 0 || len(updates) == 0 {
+		return
+	}
+	now := time.Now()
+	f.lock.Lock()
+	if _, ok := f.entries[uaid]; !ok && len(f.entries) >= f.maxSize {
+		f.evict(now)
+	}
+	if len(f.entries) < f.maxSize {
+		f.entries[uaid] = inFlightEntry{updates, now.Add(f.ttl)}
+		f.metrics.Increment("router.inflight.stashed")
+	} else {
+		f.metrics.Increment("router.inflight.full")
+	}
+	f.metrics.Gauge("router.inflight.size", int64(len(f.entries)))
+	f.lock.Unlock()
+}
+
+// evict removes expired entries, or an arbitrary entry if none have
+// expired. The caller must hold the lock.
+func (f *InFlight) evict(now time.Time) {
+	var evicted bool
+	for uaid, entry := range f.entries {
+		if now.After(entry.expires) {
+			delete(f.entries, uaid)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for uaid := range f.entries {
+		delete(f.entries, uaid)
+		break
+	}
+}
+
+// Take removes and returns a device's stashed updates.
+func (f *InFlight) Take(uaid string) []Update {
+	if !f.Enabled() {
+		return nil
+	}
+	f.lock.Lock()
+	entry, ok := f.entries[uaid]
+	delete(f.entries, uaid)
+	f.lock.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	f.metrics.Increment("router.inflight.taken")
+	return entry.updates
+}
+
+// Recover returns a reconnecting device's unacknowledged updates. previous
+// is the routing URL of the node that last held the device's connection, if
+// known; updates are taken from that node if it is not the current one.
+func (f *InFlight) Recover(uaid, previous string) []Update {
+	if !f.Enabled() {
+		return nil
+	}
+	if len(previous) == 0 || previous == f.router.URL() {
+		return f.Take(uaid)
+	}
+	updates, err := f.fetch(uaid, previous)
+	if err != nil {
+		if f.logger.ShouldLog(WARNING) {
+			f.logger.Warn("router", "Could not take in-flight updates from peer",
+				LogFields{"uaid": uaid, "peer": previous, "error": err.Error()})
+		}
+		f.metrics.Increment("router.inflight.error")
+		return f.Take(uaid)
+	}
+	if local := f.Take(uaid); len(local) > 0 {
+		updates = MergeUpdates(updates, local)
+	}
+	return updates
+}
+
+// fetch takes a device's unacknowledged updates from the given peer.
+func (f *InFlight) fetch(uaid, peer string) ([]Update, error) {
+	req, err := f.router.NewPeerRequest("POST",
+		peer+"/inflight/"+url.QueryEscape(uaid), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected in-flight response: %s", resp.Status)
+	}
+	reply := new(InFlightReply)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Updates) > 0 {
+		f.metrics.Increment("router.inflight.fetched")
+	}
+	return reply.Updates, nil
+}
+
+// MergeUpdates combines two sets of updates, keeping the latest version of
+// each channel. If both sets contain the same version, the update with a
+// payload is kept. This de-duplicates updates recovered from another node
+// against those fetched from storage.
+func MergeUpdates(a, b []Update) []Update {
+	if len(b) == 0 {
+		return a
+	}
+	latest := make(map[string]Update, len(a)+len(b))
+	for _, updates := range [][]Update{a, b} {
+		for _, update := range updates {
+			current, ok := latest[update.ChannelID]
+			if !ok || update.Version > current.Version ||
+				update.Version == current.Version && len(current.Data) == 0 {
+				latest[update.ChannelID] = update
+			}
+		}
+	}
+	merged := make([]Update, 0, len(latest))
+	for _, update := range latest {
+		merged = append(merged, update)
+	}
+	sort.Sort(updatesByChannel(merged))
+	return merged
+}
+
+type updatesByChannel []Update
+
+func (u updatesByChannel) Len() int           { return len(u) }
+func (u updatesByChannel) Less(i, j int) bool { return u[i].ChannelID < u[j].ChannelID }
+func (u updatesByChannel) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
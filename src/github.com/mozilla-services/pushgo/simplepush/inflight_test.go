@@ -0,0 +1,112 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMergeUpdates(t *testing.T) {
+	stored := []Update{
+		{ChannelID: "b", Version: 2},
+		{ChannelID: "a", Version: 1},
+		{ChannelID: "c", Version: 5},
+	}
+	inFlight := []Update{
+		{ChannelID: "a", Version: 1, Data: "hello"},
+		{ChannelID: "b", Version: 1, Data: "stale"},
+		{ChannelID: "d", Version: 3},
+	}
+	expected := []Update{
+		{ChannelID: "a", Version: 1, Data: "hello"},
+		{ChannelID: "b", Version: 2},
+		{ChannelID: "c", Version: 5},
+		{ChannelID: "d", Version: 3},
+	}
+	if merged := MergeUpdates(stored, inFlight); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Wrong merged updates: got %#v; want %#v", merged, expected)
+	}
+	if merged := MergeUpdates(inFlight, stored); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Merge should be symmetric: got %#v; want %#v", merged, expected)
+	}
+}
+
+func TestInFlightStash(t *testing.T) {
+	_, app := newTestHandler(t)
+	inFlight := NewInFlight()
+	conf := inFlight.ConfigStruct().(*InFlightConfig)
+	conf.MaxSize = 2
+	conf.TTL = "50ms"
+	if err := inFlight.Init(app, conf, app.Router()); err != nil {
+		t.Fatalf("Error initializing in-flight cache: %s", err)
+	}
+	updates := []Update{{ChannelID: "a", Version: 1}}
+	inFlight.Stash("uaid1", updates)
+	inFlight.Stash("uaid2", updates)
+	inFlight.Stash("uaid3", updates)
+	if n := inFlight.Len(); n != 2 {
+		t.Errorf("Wrong cache size: got %d; want 2", n)
+	}
+	if taken := inFlight.Take("uaid3"); !reflect.DeepEqual(taken, updates) {
+		t.Errorf("Wrong stashed updates: got %#v; want %#v", taken, updates)
+	}
+	if taken := inFlight.Take("uaid3"); len(taken) != 0 {
+		t.Errorf("Expected updates to be taken once; got %#v", taken)
+	}
+
+	// Expired updates are discarded.
+	inFlight.Stash("uaid4", updates)
+	time.Sleep(100 * time.Millisecond)
+	if taken := inFlight.Take("uaid4"); len(taken) != 0 {
+		t.Errorf("Expected expired updates to be discarded; got %#v", taken)
+	}
+}
+
+func Test_InFlightHandoff(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+
+	// The device was connected to the previous node when it went away.
+	previous, _ := newTestHandler(t)
+	previous.router.InFlight().Stash(uaid, []Update{
+		{ChannelID: "a", Version: 2, Data: "hello"},
+	})
+	peerMux := mux.NewRouter()
+	peerMux.HandleFunc("/inflight/{uaid}", previous.InFlightHandler)
+	peer := httptest.NewServer(peerMux)
+	defer peer.Close()
+
+	// The current node holds an older update from an earlier connection.
+	_, app := newTestHandler(t)
+	current := app.Router().InFlight()
+	current.Stash(uaid, []Update{
+		{ChannelID: "a", Version: 1},
+		{ChannelID: "b", Version: 1},
+	})
+
+	expected := []Update{
+		{ChannelID: "a", Version: 2, Data: "hello"},
+		{ChannelID: "b", Version: 1},
+	}
+	if updates := current.Recover(uaid, peer.URL); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Wrong recovered updates: got %#v; want %#v", updates, expected)
+	}
+	if n := previous.router.InFlight().Len(); n != 0 {
+		t.Errorf("Expected previous node to hand off updates; %d remaining", n)
+	}
+	if updates := current.Recover(uaid, peer.URL); len(updates) != 0 {
+		t.Errorf("Expected updates to be recovered once; got %#v", updates)
+	}
+
+	// Updates stashed locally are recovered if the peer is unreachable.
+	current.Stash(uaid, expected)
+	if updates := current.Recover(uaid, "http://127.0.0.1:1"); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Wrong local updates: got %#v; want %#v", updates, expected)
+	}
+}
@@ -0,0 +1,373 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// Kafka API keys and the implemented versions. Produce version 3 is the
+// oldest version accepted by current brokers, and requires the version 2
+// record batch format; both are supported by brokers since 0.11.
+const (
+	kafkaProduceKey      int16 = 0
+	kafkaProduceVersion  int16 = 3
+	kafkaMetadataKey     int16 = 3
+	kafkaMetadataVersion int16 = 4
+)
+
+// kafkaCRCTable computes the CRC-32C checksums used by record batches.
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errKafkaProtocol = errors.New("Malformed Kafka response")
+
+// KafkaError is an error code returned by a Kafka broker.
+type KafkaError int16
+
+func (err KafkaError) Error() string {
+	return fmt.Sprintf("Kafka error code %d", int16(err))
+}
+
+// kafkaEncoder writes big-endian Kafka protocol primitives.
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) putInt8(v int8)   { e.WriteByte(byte(v)) }
+func (e *kafkaEncoder) putInt16(v int16) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) putInt32(v int32) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) putInt64(v int64) { binary.Write(e, binary.BigEndian, v) }
+
+// putVarint writes a zigzag-encoded variable-length integer, as used in
+// record batches.
+func (e *kafkaEncoder) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *kafkaEncoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) putBytes(b []byte) {
+	if b == nil {
+		e.putInt32(-1)
+		return
+	}
+	e.putInt32(int32(len(b)))
+	e.Write(b)
+}
+
+// kafkaDecoder reads big-endian Kafka protocol primitives. The first
+// error is sticky, so callers only need to check err once.
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = errKafkaProtocol
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errKafkaProtocol
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// kafkaMessage is a single keyed message in a message set.
+type kafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// putVarBytes writes a varint-prefixed byte string, or -1 for nil.
+func (e *kafkaEncoder) putVarBytes(b []byte) {
+	if b == nil {
+		e.putVarint(-1)
+		return
+	}
+	e.putVarint(int64(len(b)))
+	e.Write(b)
+}
+
+// encodeKafkaRecordBatch encodes messages as a single uncompressed,
+// non-transactional record batch in the version 2 format.
+func encodeKafkaRecordBatch(messages []kafkaMessage, now time.Time) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	records := new(kafkaEncoder)
+	for i, m := range messages {
+		record := new(kafkaEncoder)
+		record.putInt8(0)          // Attributes.
+		record.putVarint(0)        // Timestamp delta.
+		record.putVarint(int64(i)) // Offset delta.
+		record.putVarBytes(m.Key)
+		record.putVarBytes(m.Value)
+		record.putVarint(0) // Headers.
+		records.putVarint(int64(record.Len()))
+		records.Write(record.Bytes())
+	}
+	// The checksum covers everything following the CRC field.
+	body := new(kafkaEncoder)
+	body.putInt16(0) // Attributes; no compression, timestamps set by client.
+	body.putInt32(int32(len(messages) - 1))
+	body.putInt64(timestamp) // First timestamp.
+	body.putInt64(timestamp) // Max timestamp.
+	body.putInt64(-1)        // Producer ID.
+	body.putInt16(-1)        // Producer epoch.
+	body.putInt32(-1)        // Base sequence.
+	body.putInt32(int32(len(messages)))
+	body.Write(records.Bytes())
+
+	batch := new(kafkaEncoder)
+	batch.putInt64(0) // Base offset; assigned by the broker.
+	batch.putInt32(int32(4 + 1 + 4 + body.Len()))
+	batch.putInt32(-1) // Partition leader epoch.
+	batch.putInt8(2)   // Magic byte.
+	batch.putInt32(int32(crc32.Checksum(body.Bytes(), kafkaCRCTable)))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaBroker is a broker address from a metadata response.
+type kafkaBroker struct {
+	ID   int32
+	Addr string
+}
+
+// kafkaTopic lists the leader of each partition of a topic.
+type kafkaTopic struct {
+	Name    string
+	Err     int16
+	Leaders []int32 // Leader node IDs, indexed by partition.
+}
+
+// kafkaConn is a minimal Kafka client connection. Requests are issued
+// sequentially; callers must serialize access.
+type kafkaConn struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	clientID      string
+	timeout       time.Duration
+	correlationID int32
+}
+
+func dialKafka(addr, clientID string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		clientID: clientID,
+		timeout:  timeout,
+	}, nil
+}
+
+// send writes a request. If expectReply is true, it returns the response
+// body following the correlation ID.
+func (c *kafkaConn) send(key, version int16, body []byte, expectReply bool) (
+	*kafkaDecoder, error) {
+
+	c.correlationID++
+	header := new(kafkaEncoder)
+	header.putInt16(key)
+	header.putInt16(version)
+	header.putInt32(c.correlationID)
+	header.putString(c.clientID)
+
+	request := new(kafkaEncoder)
+	request.putInt32(int32(header.Len() + len(body)))
+	request.Write(header.Bytes())
+	request.Write(body)
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+	if !expectReply {
+		return nil, nil
+	}
+	var size int32
+	if err := binary.Read(c.reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 {
+		return nil, errKafkaProtocol
+	}
+	response := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{data: response}
+	if d.int32() != c.correlationID {
+		return nil, errKafkaProtocol
+	}
+	return d, nil
+}
+
+// Metadata returns the brokers in the cluster, and the partition leaders
+// of the given topics.
+func (c *kafkaConn) Metadata(topics []string) (brokers []kafkaBroker,
+	metadata []kafkaTopic, err error) {
+
+	e := new(kafkaEncoder)
+	e.putInt32(int32(len(topics)))
+	for _, topic := range topics {
+		e.putString(topic)
+	}
+	e.putInt8(1) // Allow auto topic creation.
+	d, err := c.send(kafkaMetadataKey, kafkaMetadataVersion, e.Bytes(), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.int32() // Throttle time.
+	brokers = make([]kafkaBroker, d.int32())
+	for i := range brokers {
+		if d.err != nil {
+			break
+		}
+		brokers[i].ID = d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // Rack.
+		brokers[i].Addr = net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	}
+	d.string() // Cluster ID.
+	d.int32()  // Controller ID.
+	metadata = make([]kafkaTopic, d.int32())
+	for i := range metadata {
+		metadata[i].Err = d.int16()
+		metadata[i].Name = d.string()
+		d.int8() // Internal topic flag.
+		partitions := int(d.int32())
+		if d.err != nil {
+			break
+		}
+		leaders := make(map[int32]int32, partitions)
+		for j := 0; j < partitions; j++ {
+			d.int16() // Partition error code.
+			partition := d.int32()
+			leaders[partition] = d.int32()
+			for k := d.int32(); k > 0; k-- { // Replicas.
+				d.int32()
+			}
+			for k := d.int32(); k > 0; k-- { // In-sync replicas.
+				d.int32()
+			}
+		}
+		metadata[i].Leaders = make([]int32, len(leaders))
+		for partition, leader := range leaders {
+			if int(partition) < len(leaders) {
+				metadata[i].Leaders[partition] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return brokers, metadata, nil
+}
+
+// Produce writes a record batch to a topic partition. If acks is 0, the
+// broker does not reply, and delivery is not confirmed.
+func (c *kafkaConn) Produce(topic string, partition int32, acks int16,
+	timeout time.Duration, messages []kafkaMessage) error {
+
+	set := encodeKafkaRecordBatch(messages, time.Now())
+	e := new(kafkaEncoder)
+	e.putInt16(-1) // Transactional ID; null.
+	e.putInt16(acks)
+	e.putInt32(int32(timeout / time.Millisecond))
+	e.putInt32(1) // Topics.
+	e.putString(topic)
+	e.putInt32(1) // Partitions.
+	e.putInt32(partition)
+	e.putInt32(int32(len(set)))
+	e.Write(set)
+	d, err := c.send(kafkaProduceKey, kafkaProduceVersion, e.Bytes(), acks != 0)
+	if err != nil || d == nil {
+		return err
+	}
+	for topics := d.int32(); topics > 0; topics-- {
+		d.string()
+		for partitions := d.int32(); partitions > 0; partitions-- {
+			d.int32()
+			if code := d.int16(); code != 0 && d.err == nil {
+				return KafkaError(code)
+			}
+			d.int64() // Base offset.
+			d.int64() // Log append time.
+		}
+	}
+	return d.err
+}
+
+func (c *kafkaConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,439 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errKafkaNoLeader = errors.New("No leader available for Kafka partition")
+
+type KafkaConfig struct {
+	// Brokers lists the addresses of the Kafka brokers used to discover the
+	// cluster. The sink is disabled if no brokers are set.
+	Brokers []string `env:"brokers"`
+
+	// ClientID identifies this producer to the brokers. Defaults to
+	// "pushgo".
+	ClientID string `toml:"client_id" env:"client_id"`
+
+	// UpdateTopic receives update events: received, delivered, and acked.
+	// Defaults to "push.updates". Set to an empty string to disable.
+	UpdateTopic string `toml:"update_topic" env:"update_topic"`
+
+	// ClientTopic receives client connection and disconnection events.
+	// Defaults to "push.clients". Set to an empty string to disable.
+	ClientTopic string `toml:"client_topic" env:"client_topic"`
+
+	// BatchSize is the maximum number of events sent in a single request.
+	// Defaults to 100.
+	BatchSize int `toml:"batch_size" env:"batch_size"`
+
+	// BatchInterval is the maximum amount of time to buffer events before
+	// sending an incomplete batch. Defaults to 1 second.
+	BatchInterval string `toml:"batch_interval" env:"batch_interval"`
+
+	// MaxPending is the maximum number of buffered events. Events published
+	// while the buffer is full are dropped. Defaults to 10000.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// RequiredAcks is the number of replicas that must acknowledge each
+	// batch: 0 for none, 1 for the leader, or -1 for all in-sync replicas.
+	// Defaults to 1.
+	RequiredAcks int `toml:"required_acks" env:"required_acks"`
+
+	// Timeout is the maximum amount of time to wait for a broker.
+	Timeout string `env:"timeout"`
+
+	// RetryBackoff is the initial delay before fetching metadata for a topic
+	// again after a failure. The delay doubles with each consecutive
+	// failure, up to MaxRetryBackoff; events for the topic are dropped in
+	// the meantime. Defaults to 100 milliseconds.
+	RetryBackoff string `toml:"retry_backoff" env:"retry_backoff"`
+
+	// MaxRetryBackoff is the maximum metadata retry delay. Defaults to 30
+	// seconds.
+	MaxRetryBackoff string `toml:"max_retry_backoff" env:"max_retry_backoff"`
+}
+
+// KafkaEvent is the body of an event sent to Kafka.
+type KafkaEvent struct {
+	Type      string `json:"type"`
+	UAID      string `json:"uaid"`
+	ChannelID string `json:"chid,omitempty"`
+	Version   int64  `json:"version,omitempty"`
+	Node      string `json:"node"`
+	Time      int64  `json:"time"`
+}
+
+// kafkaEventTypes maps event bus types to Kafka event types.
+var kafkaEventTypes = map[EventType]string{
+	EventUpdateAccepted:     "update.received",
+	EventUpdateDelivered:    "update.delivered",
+	EventUpdateAcked:        "update.acked",
+	EventClientConnected:    "client.connected",
+	EventClientDisconnected: "client.disconnected",
+}
+
+type kafkaRecord struct {
+	topic   string
+	message kafkaMessage
+}
+
+// kafkaBackoff tracks consecutive metadata failures for a topic.
+type kafkaBackoff struct {
+	delay time.Duration
+	until time.Time
+	err   error
+}
+
+// KafkaSink sends notification and connection events to Kafka topics for
+// downstream analytics. Events are buffered and sent in batches, keyed by
+// device ID so that each device's events land in a single partition.
+// Events are dropped rather than blocking clients if Kafka falls behind.
+type KafkaSink struct {
+	logger        *SimpleLogger
+	metrics       Statistician
+	node          string
+	brokers       []string
+	clientID      string
+	batchSize     int
+	batchInterval time.Duration
+	acks          int16
+	timeout       time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	records       chan kafkaRecord
+
+	// Guarded by the send loop.
+	conns   map[int32]*kafkaConn // Connections by broker ID.
+	addrs   map[int32]string     // Broker addresses by ID.
+	leaders map[string][]int32   // Partition leaders by topic.
+	backoff map[string]*kafkaBackoff
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewKafkaSink() *KafkaSink {
+	return &KafkaSink{
+		conns:       make(map[int32]*kafkaConn),
+		addrs:       make(map[int32]string),
+		leaders:     make(map[string][]int32),
+		backoff:     make(map[string]*kafkaBackoff),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*KafkaSink) ConfigStruct() interface{} {
+	return &KafkaConfig{
+		ClientID:        "pushgo",
+		UpdateTopic:     "push.updates",
+		ClientTopic:     "push.clients",
+		BatchSize:       100,
+		BatchInterval:   "1s",
+		MaxPending:      10000,
+		RequiredAcks:    1,
+		Timeout:         "5s",
+		RetryBackoff:    "100ms",
+		MaxRetryBackoff: "30s",
+	}
+}
+
+func (k *KafkaSink) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*KafkaConfig)
+	k.logger = app.Logger()
+	k.metrics = app.Metrics()
+	if len(conf.Brokers) == 0 {
+		return nil
+	}
+	k.node = app.Hostname()
+	k.brokers = conf.Brokers
+	k.clientID = conf.ClientID
+	k.batchSize = conf.BatchSize
+	k.acks = int16(conf.RequiredAcks)
+
+	if k.batchInterval, err = time.ParseDuration(conf.BatchInterval); err != nil {
+		k.logger.Panic("kafka", "Could not parse batch interval",
+			LogFields{"error": err.Error(), "interval": conf.BatchInterval})
+		return err
+	}
+	if k.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		k.logger.Panic("kafka", "Could not parse timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	if k.minBackoff, err = time.ParseDuration(conf.RetryBackoff); err != nil {
+		k.logger.Panic("kafka", "Could not parse retry backoff",
+			LogFields{"error": err.Error(), "backoff": conf.RetryBackoff})
+		return err
+	}
+	if k.maxBackoff, err = time.ParseDuration(conf.MaxRetryBackoff); err != nil {
+		k.logger.Panic("kafka", "Could not parse maximum retry backoff",
+			LogFields{"error": err.Error(), "backoff": conf.MaxRetryBackoff})
+		return err
+	}
+	if k.batchSize < 1 {
+		k.batchSize = 1
+	}
+	k.records = make(chan kafkaRecord, conf.MaxPending)
+
+	for t, kind := range kafkaEventTypes {
+		topic := conf.UpdateTopic
+		if t == EventClientConnected || t == EventClientDisconnected {
+			topic = conf.ClientTopic
+		}
+		if len(topic) == 0 {
+			continue
+		}
+		kind, topic := kind, topic
+		app.Events().Subscribe(t, func(event *Event) {
+			k.publish(topic, kind, event)
+		})
+	}
+	k.closeWait.Add(1)
+	go k.sendLoop()
+	return nil
+}
+
+// Enabled indicates whether the sink is configured.
+func (k *KafkaSink) Enabled() bool {
+	return k.records != nil
+}
+
+// publish encodes and buffers an event. Called from the event bus, so it
+// must not block.
+func (k *KafkaSink) publish(topic, kind string, event *Event) {
+	value, err := json.Marshal(&KafkaEvent{
+		Type:      kind,
+		UAID:      event.UAID,
+		ChannelID: event.ChannelID,
+		Version:   event.Version,
+		Node:      k.node,
+		Time:      event.Time.UnixNano(),
+	})
+	if err != nil {
+		return
+	}
+	record := kafkaRecord{topic, kafkaMessage{Key: []byte(event.UAID), Value: value}}
+	select {
+	case k.records <- record:
+	default:
+		k.metrics.Increment("kafka.dropped")
+	}
+}
+
+// sendLoop batches buffered events, sending a batch when it is full or the
+// batch interval elapses.
+func (k *KafkaSink) sendLoop() {
+	defer k.closeWait.Done()
+	ticker := time.NewTicker(k.batchInterval)
+	defer ticker.Stop()
+	batch := make([]kafkaRecord, 0, k.batchSize)
+	for {
+		select {
+		case <-k.closeSignal:
+			// Send everything buffered before closing.
+			for pending := len(k.records); pending > 0; pending-- {
+				if batch = append(batch, <-k.records); len(batch) >= k.batchSize {
+					k.send(batch)
+					batch = batch[:0]
+				}
+			}
+			k.send(batch)
+			k.closeConns()
+			return
+		case record := <-k.records:
+			if batch = append(batch, record); len(batch) >= k.batchSize {
+				k.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			k.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// send groups a batch by topic partition, and produces each group to the
+// partition leader. Failed groups are dropped.
+func (k *KafkaSink) send(batch []kafkaRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	startTime := time.Now()
+	type partitionKey struct {
+		topic     string
+		partition int32
+	}
+	groups := make(map[partitionKey][]kafkaMessage)
+	for _, record := range batch {
+		leaders, err := k.partitions(record.topic)
+		if err != nil {
+			k.failed(record.topic, 1, err)
+			continue
+		}
+		h := fnv.New32a()
+		h.Write(record.message.Key)
+		key := partitionKey{record.topic, int32(h.Sum32() % uint32(len(leaders)))}
+		groups[key] = append(groups[key], record.message)
+	}
+	for key, messages := range groups {
+		err := k.produce(key.topic, key.partition, messages)
+		if err != nil {
+			// Refresh the leaders and retry once, in case the partition moved.
+			delete(k.leaders, key.topic)
+			err = k.produce(key.topic, key.partition, messages)
+		}
+		if err != nil {
+			k.failed(key.topic, len(messages), err)
+			continue
+		}
+		k.metrics.IncrementBy("kafka.sent", int64(len(messages)))
+	}
+	k.metrics.Increment("kafka.batch")
+	k.metrics.Timer("kafka.batch.duration", time.Since(startTime))
+}
+
+func (k *KafkaSink) failed(topic string, count int, err error) {
+	if k.logger.ShouldLog(WARNING) {
+		k.logger.Warn("kafka", "Could not send events", LogFields{
+			"topic": topic, "count": strconv.Itoa(count), "error": err.Error()})
+	}
+	k.metrics.IncrementBy("kafka.failed", int64(count))
+}
+
+func (k *KafkaSink) produce(topic string, partition int32,
+	messages []kafkaMessage) error {
+
+	leaders, err := k.partitions(topic)
+	if err != nil {
+		return err
+	}
+	if int(partition) >= len(leaders) {
+		return errKafkaNoLeader
+	}
+	conn, err := k.conn(leaders[partition])
+	if err != nil {
+		return err
+	}
+	if err = conn.Produce(topic, partition, k.acks, k.timeout, messages); err != nil {
+		if _, ok := err.(KafkaError); !ok {
+			conn.Close()
+			delete(k.conns, leaders[partition])
+		}
+		return err
+	}
+	return nil
+}
+
+// partitions returns the partition leaders for a topic, fetching metadata
+// from the bootstrap brokers if needed. After a failed fetch, the last error
+// is returned without contacting the brokers until the backoff elapses.
+func (k *KafkaSink) partitions(topic string) (leaders []int32, err error) {
+	if leaders = k.leaders[topic]; len(leaders) > 0 {
+		return leaders, nil
+	}
+	backoff := k.backoff[topic]
+	if backoff != nil && time.Now().Before(backoff.until) {
+		return nil, backoff.err
+	}
+	if leaders, err = k.fetchPartitions(topic); err != nil {
+		if backoff == nil {
+			backoff = &kafkaBackoff{delay: k.minBackoff}
+			k.backoff[topic] = backoff
+		} else if backoff.delay *= 2; backoff.delay > k.maxBackoff {
+			backoff.delay = k.maxBackoff
+		}
+		backoff.until = time.Now().Add(backoff.delay)
+		backoff.err = err
+		k.metrics.Increment("kafka.metadata.error")
+		return nil, err
+	}
+	delete(k.backoff, topic)
+	return leaders, nil
+}
+
+// fetchPartitions requests the partition leaders for a topic from the first
+// available bootstrap broker, and updates the broker addresses.
+func (k *KafkaSink) fetchPartitions(topic string) (leaders []int32, err error) {
+	err = errKafkaNoLeader
+	for _, addr := range k.brokers {
+		var conn *kafkaConn
+		if conn, err = dialKafka(addr, k.clientID, k.timeout); err != nil {
+			continue
+		}
+		brokers, metadata, metaErr := conn.Metadata([]string{topic})
+		conn.Close()
+		if err = metaErr; err != nil {
+			continue
+		}
+		err = errKafkaNoLeader
+		for _, broker := range brokers {
+			if old, ok := k.addrs[broker.ID]; ok && old != broker.Addr {
+				if conn, ok := k.conns[broker.ID]; ok {
+					conn.Close()
+					delete(k.conns, broker.ID)
+				}
+			}
+			k.addrs[broker.ID] = broker.Addr
+		}
+		for _, t := range metadata {
+			if t.Name != topic {
+				continue
+			}
+			if t.Err != 0 {
+				err = KafkaError(t.Err)
+				break
+			}
+			if len(t.Leaders) > 0 {
+				k.leaders[topic] = t.Leaders
+				return t.Leaders, nil
+			}
+		}
+		return nil, err
+	}
+	return nil, err
+}
+
+func (k *KafkaSink) conn(id int32) (conn *kafkaConn, err error) {
+	if conn = k.conns[id]; conn != nil {
+		return conn, nil
+	}
+	addr, ok := k.addrs[id]
+	if !ok {
+		return nil, errKafkaNoLeader
+	}
+	if conn, err = dialKafka(addr, k.clientID, k.timeout); err != nil {
+		return nil, err
+	}
+	k.conns[id] = conn
+	return conn, nil
+}
+
+func (k *KafkaSink) closeConns() {
+	for id, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, id)
+	}
+}
+
+// Close sends buffered events and disconnects from the brokers.
+func (k *KafkaSink) Close() error {
+	if !k.Enabled() {
+		return nil
+	}
+	k.closeOnce.Do(func() {
+		close(k.closeSignal)
+		k.closeWait.Wait()
+	})
+	return nil
+}
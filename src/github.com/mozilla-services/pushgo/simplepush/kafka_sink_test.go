@@ -0,0 +1,268 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testKafkaBroker implements version 4 metadata and version 3 produce
+// requests for a single broker that leads every partition.
+type testKafkaBroker struct {
+	listener   net.Listener
+	partitions int
+	messages   chan kafkaRecord
+}
+
+func newTestKafkaBroker(t *testing.T, partitions int) *testKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test Kafka broker: %s", err)
+	}
+	b := &testKafkaBroker{
+		listener:   listener,
+		partitions: partitions,
+		messages:   make(chan kafkaRecord, 100),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *testKafkaBroker) Addr() string { return b.listener.Addr().String() }
+func (b *testKafkaBroker) Close()       { b.listener.Close() }
+
+func (b *testKafkaBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *testKafkaBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		request := make([]byte, size)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		d := &kafkaDecoder{data: request}
+		key := d.int16()
+		version := d.int16()
+		correlationID := d.int32()
+		d.string() // Client ID.
+
+		e := new(kafkaEncoder)
+		e.putInt32(correlationID)
+		switch key {
+		case kafkaMetadataKey:
+			if version != kafkaMetadataVersion {
+				return
+			}
+			topics := make([]string, d.int32())
+			for i := range topics {
+				topics[i] = d.string()
+			}
+			host, port, _ := net.SplitHostPort(b.Addr())
+			portNum, _ := strconv.Atoi(port)
+			e.putInt32(0) // Throttle time.
+			e.putInt32(1)
+			e.putInt32(7)
+			e.putString(host)
+			e.putInt32(int32(portNum))
+			e.putInt16(-1) // Rack.
+			e.putInt16(-1) // Cluster ID.
+			e.putInt32(7)  // Controller ID.
+			e.putInt32(int32(len(topics)))
+			for _, topic := range topics {
+				e.putInt16(0)
+				e.putString(topic)
+				e.putInt8(0)
+				e.putInt32(int32(b.partitions))
+				for p := 0; p < b.partitions; p++ {
+					e.putInt16(0)
+					e.putInt32(int32(p))
+					e.putInt32(7)
+					e.putInt32(0)
+					e.putInt32(0)
+				}
+			}
+		case kafkaProduceKey:
+			if version != kafkaProduceVersion {
+				return
+			}
+			d.string() // Transactional ID.
+			acks := d.int16()
+			d.int32() // Timeout.
+			d.int32() // Topics.
+			topic := d.string()
+			d.int32() // Partitions.
+			partition := d.int32()
+			batch := &kafkaDecoder{data: d.next(int(d.int32()))}
+			batch.int64() // Base offset.
+			batch = &kafkaDecoder{data: batch.next(int(batch.int32()))}
+			batch.int32() // Partition leader epoch.
+			if batch.int8() != 2 {
+				return
+			}
+			crc := uint32(batch.int32())
+			if batch.err != nil || crc != crc32.Checksum(batch.data, kafkaCRCTable) {
+				return
+			}
+			batch.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+			for records := batch.int32(); records > 0 && batch.err == nil; records-- {
+				r := &kafkaDecoder{data: batch.next(int(batch.varint()))}
+				r.int8()   // Attributes.
+				r.varint() // Timestamp delta.
+				r.varint() // Offset delta.
+				key := r.next(int(r.varint()))
+				value := r.next(int(r.varint()))
+				if r.err != nil {
+					return
+				}
+				b.messages <- kafkaRecord{topic, kafkaMessage{key, value}}
+			}
+			if acks == 0 {
+				continue
+			}
+			e.putInt32(1)
+			e.putString(topic)
+			e.putInt32(1)
+			e.putInt32(partition)
+			e.putInt16(0)
+			e.putInt64(0)
+			e.putInt64(-1) // Log append time.
+			e.putInt32(0)  // Throttle time.
+		default:
+			return
+		}
+		binary.Write(conn, binary.BigEndian, int32(e.Len()))
+		conn.Write(e.Bytes())
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+
+	broker := newTestKafkaBroker(t, 4)
+	defer broker.Close()
+	_, app := newTestHandler(t)
+
+	sink := NewKafkaSink()
+	conf := sink.ConfigStruct().(*KafkaConfig)
+	conf.Brokers = []string{"127.0.0.1:1", broker.Addr()}
+	conf.BatchSize = 3
+	conf.BatchInterval = "10ms"
+	if err := sink.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing sink: %s", err)
+	}
+
+	app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
+	app.Events().Publish(&Event{Type: EventUpdateAccepted, UAID: uaid,
+		ChannelID: "chid", Version: 1})
+	app.Events().Publish(&Event{Type: EventUpdateDelivered, UAID: uaid,
+		ChannelID: "chid", Version: 1})
+	app.Events().Publish(&Event{Type: EventUpdateAcked, UAID: uaid,
+		ChannelID: "chid", Version: 1})
+	app.Events().Publish(&Event{Type: EventClientDisconnected, UAID: uaid})
+	sink.Close()
+
+	// Batches are split by topic partition, so events may arrive out of order.
+	expected := map[string]string{
+		"client.connected":    "push.clients",
+		"update.received":     "push.updates",
+		"update.delivered":    "push.updates",
+		"update.acked":        "push.updates",
+		"client.disconnected": "push.clients",
+	}
+	for i := 0; i < len(expected); i++ {
+		var record kafkaRecord
+		select {
+		case record = <-broker.messages:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event %d", i)
+		}
+		event := new(KafkaEvent)
+		if err := json.Unmarshal(record.message.Value, event); err != nil {
+			t.Fatalf("Error decoding event: %s", err)
+		}
+		if event.UAID != uaid || event.Node != app.Hostname() {
+			t.Errorf("Wrong event: %#v", event)
+		}
+		if topic, ok := expected[event.Type]; !ok || record.topic != topic ||
+			string(record.message.Key) != uaid {
+			t.Errorf("Wrong record for %q: topic %q, key %q", event.Type,
+				record.topic, record.message.Key)
+		}
+	}
+}
+
+func TestKafkaSinkMetadataBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test listener: %s", err)
+	}
+	defer listener.Close()
+	dials := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dials <- true
+			conn.Close()
+		}
+	}()
+
+	_, app := newTestHandler(t)
+	sink := NewKafkaSink()
+	sink.metrics = app.Metrics()
+	sink.brokers = []string{listener.Addr().String()}
+	sink.timeout = time.Second
+	sink.minBackoff = 50 * time.Millisecond
+	sink.maxBackoff = 50 * time.Millisecond
+
+	// Failed metadata requests are not retried until the backoff elapses.
+	for i := 0; i < 3; i++ {
+		if _, err := sink.partitions("push.updates"); err == nil {
+			t.Fatalf("Expected metadata request %d to fail", i)
+		}
+	}
+	if len(dials) != 1 {
+		t.Errorf("Wrong dial count during backoff: got %d; want 1", len(dials))
+	}
+	time.Sleep(60 * time.Millisecond)
+	sink.partitions("push.updates")
+	if len(dials) != 2 {
+		t.Errorf("Wrong dial count after backoff: got %d; want 2", len(dials))
+	}
+}
+
+func TestKafkaSinkDisabled(t *testing.T) {
+	_, app := newTestHandler(t)
+	sink := NewKafkaSink()
+	if err := sink.Init(app, sink.ConfigStruct()); err != nil {
+		t.Fatalf("Error initializing sink: %s", err)
+	}
+	if sink.Enabled() {
+		t.Errorf("Expected sink without brokers to be disabled")
+	}
+	app.Events().Publish(&Event{Type: EventClientConnected, UAID: "uaid"})
+	sink.Close()
+}
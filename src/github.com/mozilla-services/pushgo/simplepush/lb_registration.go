@@ -0,0 +1,598 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AvailableRegistrars lists the load balancer backends that a node may
+// register with.
+var AvailableRegistrars = []string{"consul", "route53", "elb"}
+
+const (
+	route53APIVersion = "2013-04-01"
+	elbAPIVersion     = "2015-12-01"
+)
+
+// RegisteredNode is the public address registered with load balancers.
+type RegisteredNode struct {
+	Hostname string
+	Port     int
+
+	// StatusURL is the URL of the WebSocket listener's status endpoint, for
+	// health checks.
+	StatusURL string
+}
+
+// statusSchemes maps WebSocket schemes to the scheme of the status endpoint
+// served by the same listener.
+var statusSchemes = map[string]string{"ws": "http", "wss": "https"}
+
+// Registrar adds and removes a node from a load balancer or service
+// registry. Register may be called for a node that is already registered.
+type Registrar interface {
+	Register(node RegisteredNode) error
+	Deregister(node RegisteredNode) error
+}
+
+type RegistrationConfig struct {
+	// Backends lists the load balancers to register with: "consul",
+	// "route53", and "elb". Registration is disabled if empty.
+	Backends []string `env:"backends"`
+
+	// Hostname is the public hostname to register. Defaults to the node's
+	// hostname, which is the public AWS hostname if use_aws_host is set.
+	Hostname string `env:"hostname"`
+
+	// Port is the public port to register. Defaults to the port of the
+	// WebSocket listener.
+	Port int `env:"port"`
+
+	// Timeout is the maximum time to wait for each backend. Defaults to 10
+	// seconds.
+	Timeout string `env:"timeout"`
+
+	Consul  ConsulRegistrarConfig  `toml:"consul" env:"consul"`
+	Route53 Route53RegistrarConfig `toml:"route53" env:"route53"`
+	ELB     ELBRegistrarConfig     `toml:"elb" env:"elb"`
+}
+
+// Registration registers the node with external load balancers once it is
+// serving, and deregisters it on graceful shutdown, so that the load
+// balancers stop sending new connections before the node drains.
+type Registration struct {
+	app        *Application
+	logger     *SimpleLogger
+	metrics    Statistician
+	hostname   string
+	port       int
+	backends   []string
+	registrars map[string]Registrar
+	lock       sync.Mutex
+	registered bool
+	released   bool
+}
+
+func NewRegistration() *Registration {
+	return &Registration{registrars: make(map[string]Registrar)}
+}
+
+func (*Registration) ConfigStruct() interface{} {
+	return &RegistrationConfig{
+		Timeout: "10s",
+		Consul:  *new(ConsulRegistrar).ConfigStruct().(*ConsulRegistrarConfig),
+		Route53: *new(Route53Registrar).ConfigStruct().(*Route53RegistrarConfig),
+		ELB:     *new(ELBRegistrar).ConfigStruct().(*ELBRegistrarConfig),
+	}
+}
+
+func (r *Registration) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*RegistrationConfig)
+	r.app = app
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.hostname = conf.Hostname
+	r.port = conf.Port
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("registration", "Could not parse timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	for _, name := range conf.Backends {
+		var registrar Registrar
+		switch name {
+		case "consul":
+			registrar, err = NewConsulRegistrar(client, &conf.Consul)
+		case "route53":
+			registrar, err = NewRoute53Registrar(client, &conf.Route53)
+		case "elb":
+			registrar, err = NewELBRegistrar(client, &conf.ELB)
+		default:
+			err = fmt.Errorf("Unknown load balancer backend '%s'", name)
+		}
+		if err != nil {
+			r.logger.Panic("registration", "Could not configure load balancer",
+				LogFields{"error": err.Error(), "backend": name})
+			return err
+		}
+		r.backends = append(r.backends, name)
+		r.registrars[name] = registrar
+	}
+	return nil
+}
+
+// Node returns the public address registered with load balancers.
+func (r *Registration) Node() (node RegisteredNode, err error) {
+	clientURL, err := url.Parse(r.app.Server().ClientURL())
+	if err != nil {
+		return node, err
+	}
+	node = RegisteredNode{Hostname: r.hostname, Port: r.port}
+	if len(node.Hostname) == 0 {
+		node.Hostname = clientURL.Hostname()
+	}
+	if node.Port == 0 {
+		if port := clientURL.Port(); len(port) > 0 {
+			node.Port, _ = strconv.Atoi(port)
+		} else {
+			node.Port = defaultPorts[clientURL.Scheme]
+		}
+	}
+	node.StatusURL = CanonicalURL(statusSchemes[clientURL.Scheme],
+		node.Hostname, node.Port) + "/status/"
+	return node, nil
+}
+
+// Register adds the node to each configured load balancer. Failures are
+// logged, and do not prevent the node from serving. Returns the first
+// error.
+func (r *Registration) Register() (err error) {
+	if len(r.backends) == 0 {
+		return nil
+	}
+	node, err := r.Node()
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.released {
+		return nil
+	}
+	for _, name := range r.backends {
+		if rerr := r.registrars[name].Register(node); rerr != nil {
+			r.failed(name, "register", node, rerr)
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		r.metrics.Increment("registration." + name + ".register")
+		if r.logger.ShouldLog(NOTICE) {
+			r.logger.Notice("registration", "Registered with load balancer",
+				LogFields{"backend": name, "hostname": node.Hostname,
+					"port": strconv.Itoa(node.Port)})
+		}
+	}
+	r.registered = true
+	return err
+}
+
+// Deregister removes the node from each configured load balancer. It does
+// nothing if the node was not registered, or if the registration was
+// released to another process.
+func (r *Registration) Deregister() (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.registered || r.released {
+		return nil
+	}
+	r.registered = false
+	node, err := r.Node()
+	if err != nil {
+		return err
+	}
+	for _, name := range r.backends {
+		if rerr := r.registrars[name].Deregister(node); rerr != nil {
+			r.failed(name, "deregister", node, rerr)
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		r.metrics.Increment("registration." + name + ".deregister")
+		if r.logger.ShouldLog(NOTICE) {
+			r.logger.Notice("registration", "Deregistered from load balancer",
+				LogFields{"backend": name, "hostname": node.Hostname})
+		}
+	}
+	return err
+}
+
+// Release hands the registration to another process serving the same
+// address, such as one started by Upgrade. The node is not deregistered
+// when this process shuts down.
+func (r *Registration) Release() {
+	r.lock.Lock()
+	r.released = true
+	r.lock.Unlock()
+}
+
+// Close deregisters the node, unless it was deregistered while draining.
+func (r *Registration) Close() error {
+	return r.Deregister()
+}
+
+func (r *Registration) failed(name, op string, node RegisteredNode, err error) {
+	r.metrics.Increment("registration." + name + "." + op + ".error")
+	if r.logger.ShouldLog(ERROR) {
+		r.logger.Error("registration", "Could not "+op+" with load balancer",
+			LogFields{"backend": name, "hostname": node.Hostname,
+				"error": err.Error()})
+	}
+}
+
+// registrarDo sends a request to a registrar backend, and discards the
+// response body.
+func registrarDo(client *http.Client, req *http.Request, name string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s request failed: %s: %s", name, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+type ConsulRegistrarConfig struct {
+	// Addr is the URL of the local Consul agent. Defaults to
+	// "http://127.0.0.1:8500".
+	Addr string `env:"addr"`
+
+	// Service is the registered service name. Defaults to "pushgo".
+	Service string `env:"service"`
+
+	// Tags are added to the service registration.
+	Tags []string `env:"tags"`
+
+	// Token is the Consul ACL token, if required.
+	Token string `env:"token"`
+
+	// CheckInterval is the interval of the health check that Consul runs
+	// against the node's /status/ endpoint. Set to "0" to disable the
+	// check. Defaults to 10 seconds.
+	CheckInterval string `toml:"check_interval" env:"check_interval"`
+}
+
+// ConsulRegistrar registers the node as a service with the local Consul
+// agent, for load balancers that route via Consul's catalog.
+type ConsulRegistrar struct {
+	client        *http.Client
+	addr          string
+	service       string
+	tags          []string
+	token         string
+	checkInterval string
+}
+
+func (*ConsulRegistrar) ConfigStruct() interface{} {
+	return &ConsulRegistrarConfig{
+		Addr:          "http://127.0.0.1:8500",
+		Service:       "pushgo",
+		CheckInterval: "10s",
+	}
+}
+
+func NewConsulRegistrar(client *http.Client, conf *ConsulRegistrarConfig) (
+	*ConsulRegistrar, error) {
+
+	interval, err := time.ParseDuration(conf.CheckInterval)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse check interval: %s", err)
+	}
+	r := &ConsulRegistrar{
+		client:  client,
+		addr:    strings.TrimRight(conf.Addr, "/"),
+		service: conf.Service,
+		tags:    conf.Tags,
+		token:   conf.Token,
+	}
+	if interval > 0 {
+		r.checkInterval = interval.String()
+	}
+	return r, nil
+}
+
+type consulCheck struct {
+	HTTP     string `json:"HTTP"`
+	Interval string `json:"Interval"`
+}
+
+type consulService struct {
+	ID      string       `json:"ID"`
+	Name    string       `json:"Name"`
+	Address string       `json:"Address"`
+	Port    int          `json:"Port"`
+	Tags    []string     `json:"Tags,omitempty"`
+	Check   *consulCheck `json:"Check,omitempty"`
+}
+
+// serviceID identifies the node's registration, so that several nodes may
+// share an agent.
+func (r *ConsulRegistrar) serviceID(node RegisteredNode) string {
+	return fmt.Sprintf("%s-%s-%d", r.service, node.Hostname, node.Port)
+}
+
+func (r *ConsulRegistrar) Register(node RegisteredNode) error {
+	service := &consulService{
+		ID:      r.serviceID(node),
+		Name:    r.service,
+		Address: node.Hostname,
+		Port:    node.Port,
+		Tags:    r.tags,
+	}
+	if len(r.checkInterval) > 0 {
+		service.Check = &consulCheck{
+			HTTP:     node.StatusURL,
+			Interval: r.checkInterval,
+		}
+	}
+	body, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	return r.put("/v1/agent/service/register", body)
+}
+
+func (r *ConsulRegistrar) Deregister(node RegisteredNode) error {
+	return r.put("/v1/agent/service/deregister/"+url.QueryEscape(r.serviceID(node)), nil)
+}
+
+func (r *ConsulRegistrar) put(path string, body []byte) error {
+	req, err := http.NewRequest("PUT", r.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(r.token) > 0 {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+	return registrarDo(r.client, req, "Consul")
+}
+
+type Route53RegistrarConfig struct {
+	// ZoneID is the ID of the hosted zone containing the record.
+	ZoneID string `toml:"zone_id" env:"zone_id"`
+
+	// Name is the DNS name shared by all nodes; e.g., "push.example.com".
+	// Each node adds a weighted CNAME record for its hostname.
+	Name string `env:"name"`
+
+	// TTL is the record's time-to-live, in seconds. Defaults to 60.
+	TTL int `env:"ttl"`
+
+	// Weight is the node's share of DNS responses. Defaults to 100.
+	Weight int `env:"weight"`
+
+	// Endpoint overrides the Route53 API endpoint,
+	// "https://route53.amazonaws.com".
+	Endpoint string `env:"endpoint"`
+}
+
+// Route53Registrar adds a weighted CNAME record for the node to a shared
+// DNS name.
+type Route53Registrar struct {
+	client   *http.Client
+	endpoint string
+	zoneID   string
+	name     string
+	ttl      int
+	weight   int
+
+	// credentials returns AWS credentials; overridden by tests.
+	credentials func() (*AWSCredentials, error)
+}
+
+func (*Route53Registrar) ConfigStruct() interface{} {
+	return &Route53RegistrarConfig{
+		TTL:      60,
+		Weight:   100,
+		Endpoint: "https://route53.amazonaws.com",
+	}
+}
+
+func NewRoute53Registrar(client *http.Client, conf *Route53RegistrarConfig) (
+	*Route53Registrar, error) {
+
+	if len(conf.ZoneID) == 0 || len(conf.Name) == 0 {
+		return nil, fmt.Errorf("Route53 registration requires a zone ID and name")
+	}
+	return &Route53Registrar{
+		client:      client,
+		endpoint:    strings.TrimRight(conf.Endpoint, "/"),
+		zoneID:      strings.TrimPrefix(conf.ZoneID, "/hostedzone/"),
+		name:        conf.Name,
+		ttl:         conf.TTL,
+		weight:      conf.Weight,
+		credentials: GetAWSCredentials,
+	}, nil
+}
+
+type route53ResourceRecord struct {
+	Value string `xml:"Value"`
+}
+
+type route53RecordSet struct {
+	Name            string                  `xml:"Name"`
+	Type            string                  `xml:"Type"`
+	SetIdentifier   string                  `xml:"SetIdentifier"`
+	Weight          int                     `xml:"Weight"`
+	TTL             int                     `xml:"TTL"`
+	ResourceRecords []route53ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+func (r *Route53Registrar) Register(node RegisteredNode) error {
+	return r.change("UPSERT", node)
+}
+
+func (r *Route53Registrar) Deregister(node RegisteredNode) error {
+	return r.change("DELETE", node)
+}
+
+func (r *Route53Registrar) change(action string, node RegisteredNode) error {
+	creds, err := r.credentials()
+	if err != nil {
+		return err
+	}
+	// CNAME records cannot carry a port; the load balancer name must be
+	// served on the same port by every node.
+	request := &route53ChangeRequest{Changes: []route53Change{{
+		Action: action,
+		RecordSet: route53RecordSet{
+			Name:            r.name,
+			Type:            "CNAME",
+			SetIdentifier:   node.Hostname,
+			Weight:          r.weight,
+			TTL:             r.ttl,
+			ResourceRecords: []route53ResourceRecord{{node.Hostname}},
+		},
+	}}}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/hostedzone/%s/rrset",
+		r.endpoint, route53APIVersion, r.zoneID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	// Route53 is a global service, signed for us-east-1.
+	SignAWSRequestBody(req, body, creds, "us-east-1", "route53", time.Now())
+	return registrarDo(r.client, req, "Route53")
+}
+
+type ELBRegistrarConfig struct {
+	// TargetGroupARN is the ARN of the target group to join.
+	TargetGroupARN string `toml:"target_group_arn" env:"target_group_arn"`
+
+	// TargetID is the instance ID or IP address registered with the target
+	// group. Defaults to the ID of the current instance.
+	TargetID string `toml:"target_id" env:"target_id"`
+
+	// Region is the region of the target group. Defaults to the region of
+	// the current instance.
+	Region string `env:"region"`
+
+	// Endpoint overrides the Elastic Load Balancing API endpoint,
+	// "https://elasticloadbalancing.<region>.amazonaws.com".
+	Endpoint string `env:"endpoint"`
+}
+
+// ELBRegistrar registers the node with an Elastic Load Balancing target
+// group.
+type ELBRegistrar struct {
+	client         *http.Client
+	endpoint       string
+	region         string
+	targetGroupARN string
+	targetID       string
+
+	// credentials returns AWS credentials; overridden by tests.
+	credentials func() (*AWSCredentials, error)
+}
+
+func (*ELBRegistrar) ConfigStruct() interface{} {
+	return new(ELBRegistrarConfig)
+}
+
+func NewELBRegistrar(client *http.Client, conf *ELBRegistrarConfig) (
+	r *ELBRegistrar, err error) {
+
+	if len(conf.TargetGroupARN) == 0 {
+		return nil, fmt.Errorf("ELB registration requires a target group ARN")
+	}
+	r = &ELBRegistrar{
+		client:         client,
+		endpoint:       conf.Endpoint,
+		region:         conf.Region,
+		targetGroupARN: conf.TargetGroupARN,
+		targetID:       conf.TargetID,
+		credentials:    GetAWSCredentials,
+	}
+	if len(r.targetID) == 0 {
+		if r.targetID, err = GetAWSMetadata("instance-id"); err != nil {
+			return nil, fmt.Errorf("Could not determine instance ID: %s", err)
+		}
+	}
+	if len(r.region) == 0 {
+		if r.region, err = GetAWSRegion(); err != nil {
+			return nil, fmt.Errorf("Could not determine region: %s", err)
+		}
+	}
+	if len(r.endpoint) == 0 {
+		r.endpoint = fmt.Sprintf("https://elasticloadbalancing.%s.amazonaws.com",
+			r.region)
+	}
+	return r, nil
+}
+
+func (r *ELBRegistrar) Register(node RegisteredNode) error {
+	return r.targets("RegisterTargets", node)
+}
+
+func (r *ELBRegistrar) Deregister(node RegisteredNode) error {
+	return r.targets("DeregisterTargets", node)
+}
+
+func (r *ELBRegistrar) targets(action string, node RegisteredNode) error {
+	creds, err := r.credentials()
+	if err != nil {
+		return err
+	}
+	query := url.Values{
+		"Action":                {action},
+		"Version":               {elbAPIVersion},
+		"TargetGroupArn":        {r.targetGroupARN},
+		"Targets.member.1.Id":   {r.targetID},
+		"Targets.member.1.Port": {strconv.Itoa(node.Port)},
+	}
+	req, err := http.NewRequest("GET", r.endpoint+"/?"+awsCanonicalQuery(query), nil)
+	if err != nil {
+		return err
+	}
+	SignAWSRequest(req, creds, r.region, "elasticloadbalancing", time.Now())
+	return registrarDo(r.client, req, "ELB")
+}
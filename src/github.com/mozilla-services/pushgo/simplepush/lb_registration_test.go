@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistrationConsul(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		services = make(map[string]*consulService)
+	)
+	agent := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.Method != "PUT" || req.Header.Get("X-Consul-Token") != "secret" {
+				http.Error(resp, "", http.StatusForbidden)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if req.URL.Path == "/v1/agent/service/register" {
+				service := new(consulService)
+				if err := json.NewDecoder(req.Body).Decode(service); err != nil {
+					http.Error(resp, "", http.StatusBadRequest)
+					return
+				}
+				services[service.ID] = service
+				return
+			}
+			const deregister = "/v1/agent/service/deregister/"
+			if strings.HasPrefix(req.URL.Path, deregister) {
+				delete(services, strings.TrimPrefix(req.URL.Path, deregister))
+				return
+			}
+			http.NotFound(resp, req)
+		}))
+	defer agent.Close()
+
+	_, app := newTestHandler(t)
+	registration := NewRegistration()
+	conf := registration.ConfigStruct().(*RegistrationConfig)
+	conf.Backends = []string{"consul"}
+	conf.Hostname = "push1.example.com"
+	conf.Consul.Addr = agent.URL
+	conf.Consul.Token = "secret"
+	if err := registration.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing registration: %s", err)
+	}
+	if err := registration.Register(); err != nil {
+		t.Fatalf("Error registering: %s", err)
+	}
+	node, _ := registration.Node()
+	lock.Lock()
+	service := services["pushgo-push1.example.com-"+strconv.Itoa(node.Port)]
+	lock.Unlock()
+	if service == nil || service.Address != "push1.example.com" || service.Port != node.Port {
+		t.Fatalf("Wrong service registration: %#v", services)
+	}
+	if service.Check == nil || !strings.HasPrefix(service.Check.HTTP, "http://push1.example.com:") {
+		t.Errorf("Wrong health check: %#v", service.Check)
+	}
+	if err := registration.Deregister(); err != nil {
+		t.Fatalf("Error deregistering: %s", err)
+	}
+	lock.Lock()
+	remaining := len(services)
+	lock.Unlock()
+	if remaining != 0 {
+		t.Errorf("Service not deregistered: %#v", services)
+	}
+
+	// Released registrations are left in place for the new process.
+	registration.Register()
+	registration.Release()
+	registration.Close()
+	lock.Lock()
+	remaining = len(services)
+	lock.Unlock()
+	if remaining != 1 {
+		t.Errorf("Released service deregistered")
+	}
+}
+
+func TestRegistrationRoute53(t *testing.T) {
+	var body string
+	api := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/2013-04-01/hostedzone/Z123/rrset" {
+				http.NotFound(resp, req)
+				return
+			}
+			if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+				http.Error(resp, "", http.StatusForbidden)
+				return
+			}
+			data, _ := ioutil.ReadAll(req.Body)
+			body = string(data)
+		}))
+	defer api.Close()
+
+	registrar, err := NewRoute53Registrar(http.DefaultClient, &Route53RegistrarConfig{
+		ZoneID:   "/hostedzone/Z123",
+		Name:     "push.example.com",
+		TTL:      60,
+		Weight:   10,
+		Endpoint: api.URL,
+	})
+	if err != nil {
+		t.Fatalf("Error creating Route53 registrar: %s", err)
+	}
+	registrar.credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{AccessKeyID: "id", SecretAccessKey: "key"}, nil
+	}
+	if err = registrar.Register(RegisteredNode{Hostname: "push1.example.com", Port: 443}); err != nil {
+		t.Fatalf("Error registering: %s", err)
+	}
+	for _, s := range []string{"<Action>UPSERT</Action>", "<Name>push.example.com</Name>",
+		"<SetIdentifier>push1.example.com</SetIdentifier>", "<Weight>10</Weight>",
+		"<Value>push1.example.com</Value>"} {
+
+		if !strings.Contains(body, s) {
+			t.Errorf("Change request missing %s: %s", s, body)
+		}
+	}
+	if _, err = NewRoute53Registrar(http.DefaultClient, &Route53RegistrarConfig{}); err == nil {
+		t.Errorf("Route53 registrar created without a zone")
+	}
+}
+
+func TestRegistrationELB(t *testing.T) {
+	var query map[string][]string
+	api := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			query = req.URL.Query()
+		}))
+	defer api.Close()
+
+	registrar, err := NewELBRegistrar(http.DefaultClient, &ELBRegistrarConfig{
+		TargetGroupARN: "arn:tg",
+		TargetID:       "i-123",
+		Region:         "us-east-1",
+		Endpoint:       api.URL,
+	})
+	if err != nil {
+		t.Fatalf("Error creating ELB registrar: %s", err)
+	}
+	registrar.credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{AccessKeyID: "id", SecretAccessKey: "key"}, nil
+	}
+	if err = registrar.Deregister(RegisteredNode{Hostname: "push1", Port: 8080}); err != nil {
+		t.Fatalf("Error deregistering: %s", err)
+	}
+	if action := query["Action"]; len(action) != 1 || action[0] != "DeregisterTargets" {
+		t.Errorf("Wrong action: %v", action)
+	}
+	if id := query["Targets.member.1.Id"]; len(id) != 1 || id[0] != "i-123" {
+		t.Errorf("Wrong target: %v", id)
+	}
+	if port := query["Targets.member.1.Port"]; len(port) != 1 || port[0] != "8080" {
+		t.Errorf("Wrong port: %v", port)
+	}
+}
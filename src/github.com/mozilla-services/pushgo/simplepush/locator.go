@@ -20,3 +20,10 @@ type Locator interface {
 	// Status indicates whether the discovery service is healthy.
 	Status() (bool, error)
 }
+
+// MemberChecker is implemented by locators that track the liveness of peers.
+// Routers skip known routes to peers that are not alive.
+type MemberChecker interface {
+	// Alive indicates whether the peer with the given routing URL is alive.
+	Alive(contact string) bool
+}
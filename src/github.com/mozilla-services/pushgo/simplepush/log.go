@@ -7,6 +7,7 @@ package simplepush
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,6 +17,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -81,8 +84,78 @@ type Logger interface {
 
 var AvailableLoggers = make(AvailableExtensions)
 
+var ErrInvalidLogLevel = errors.New("Invalid log level")
+
+// logComponents maps message types to the component whose log level applies
+// to them, if the message type itself has no level set.
+var logComponents = map[string]string{
+	"gomemc":   "storage",
+	"emcee":    "storage",
+	"nostore":  "storage",
+	"update":   "endpoint",
+	"handler":  "endpoint",
+	"http":     "endpoint",
+	"grpc":     "endpoint",
+	"receipts": "endpoint",
+	"gossip":   "router",
+	"nats":     "router",
+	"redis":    "router",
+	"etcd":     "router",
+	"dns":      "router",
+	"mqtt":     "worker",
+	"noworker": "worker",
+}
+
+// ParseLogLevel parses a log level name (e.g. "debug") or syslog severity
+// number.
+func ParseLogLevel(value string) (LogLevel, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < int(EMERGENCY) || n > int(DEBUG) {
+			return 0, ErrInvalidLogLevel
+		}
+		return LogLevel(n), nil
+	}
+	if value == "WARN" {
+		return WARNING, nil
+	}
+	for level, name := range levelNames {
+		if name == value {
+			return level, nil
+		}
+	}
+	return 0, ErrInvalidLogLevel
+}
+
+// A LogReporter receives log messages at or above a severity, regardless of
+// the logger's filter; e.g., to forward errors to an aggregation service.
+// Reporters are called synchronously, and must not block.
+type LogReporter interface {
+	Report(level LogLevel, mtype, msg string, fields LogFields)
+}
+
+type logReporter struct {
+	LogReporter
+	level LogLevel
+}
+
+// SimpleLogger wraps a Logger with convenience methods and per-component
+// log levels. Components are identified by message type; see
+// SetModuleLevel.
 type SimpleLogger struct {
 	Logger
+	maxModuleLevel int32 // Most verbose module level, or -1; accessed atomically.
+	levelLock      sync.RWMutex
+	modules        map[string]LogLevel
+	reporter       atomic.Value // logReporter
+	samplers       atomic.Value // map[string]*LogSampler
+}
+
+// An emitter writes log messages without applying a filter. Loggers built
+// on a LogEmitter implement it, which allows per-component levels to be
+// more verbose than the logger's filter.
+type emitter interface {
+	Emit(level LogLevel, messageType, payload string, fields LogFields) error
 }
 
 // Error string helper that ignores nil errors
@@ -106,40 +179,159 @@ func IStr(i interface{}) (reply string) {
 
 // SimplePush Logger implementation, utilizes the passed in Logger
 func NewLogger(log Logger) (*SimpleLogger, error) {
-	return &SimpleLogger{log}, nil
+	return &SimpleLogger{Logger: log, maxModuleLevel: -1}, nil
+}
+
+// SetReporter registers a reporter for messages at or above the given
+// level. A nil reporter removes the current one.
+func (sl *SimpleLogger) SetReporter(reporter LogReporter, level LogLevel) {
+	sl.reporter.Store(logReporter{reporter, level})
+}
+
+// reporterFor returns the reporter for messages at the given level, if any.
+func (sl *SimpleLogger) reporterFor(level LogLevel) LogReporter {
+	r, _ := sl.reporter.Load().(logReporter)
+	if r.LogReporter == nil || level > r.level {
+		return nil
+	}
+	return r.LogReporter
+}
+
+// ShouldLog indicates whether messages at the given level are logged for
+// any component, or reported.
+func (sl *SimpleLogger) ShouldLog(level LogLevel) bool {
+	return sl.Logger.ShouldLog(level) ||
+		int32(level) <= atomic.LoadInt32(&sl.maxModuleLevel) ||
+		sl.reporterFor(level) != nil
+}
+
+// filterLevel returns the most verbose level accepted by the underlying
+// logger.
+func (sl *SimpleLogger) filterLevel() LogLevel {
+	for level := DEBUG; level > EMERGENCY; level-- {
+		if sl.Logger.ShouldLog(level) {
+			return level
+		}
+	}
+	return EMERGENCY
+}
+
+// SetModuleLevel sets the log level for a message type (e.g. "worker") or
+// component ("storage", "router", "endpoint", "worker"), overriding the
+// logger's filter for that component. Levels are kept separately from the
+// filter, which is not changed.
+func (sl *SimpleLogger) SetModuleLevel(module string, level LogLevel) {
+	sl.levelLock.Lock()
+	defer sl.levelLock.Unlock()
+	if sl.modules == nil {
+		sl.modules = make(map[string]LogLevel)
+	}
+	sl.modules[module] = level
+	sl.updateMaxModuleLevel()
+}
+
+// ResetModuleLevel removes the log level set for a message type or
+// component.
+func (sl *SimpleLogger) ResetModuleLevel(module string) {
+	sl.levelLock.Lock()
+	defer sl.levelLock.Unlock()
+	delete(sl.modules, module)
+	sl.updateMaxModuleLevel()
+}
+
+// updateMaxModuleLevel records the most verbose module level, so that
+// ShouldLog() checks pass for that component. The caller must hold the
+// lock.
+func (sl *SimpleLogger) updateMaxModuleLevel() {
+	max := int32(-1)
+	for _, level := range sl.modules {
+		if int32(level) > max {
+			max = int32(level)
+		}
+	}
+	atomic.StoreInt32(&sl.maxModuleLevel, max)
+}
+
+// moduleLevel returns the level set for a message type or its component.
+func (sl *SimpleLogger) moduleLevel(mtype string) (level LogLevel, ok bool) {
+	sl.levelLock.RLock()
+	defer sl.levelLock.RUnlock()
+	if level, ok = sl.modules[mtype]; !ok {
+		level, ok = sl.modules[logComponents[mtype]]
+	}
+	return
+}
+
+// ModuleLevels returns the default log level and the levels set for
+// individual message types and components.
+func (sl *SimpleLogger) ModuleLevels() (defaultLevel LogLevel, modules map[string]LogLevel) {
+	sl.levelLock.RLock()
+	defer sl.levelLock.RUnlock()
+	if len(sl.modules) == 0 {
+		return sl.filterLevel(), nil
+	}
+	modules = make(map[string]LogLevel, len(sl.modules))
+	for module, level := range sl.modules {
+		modules[module] = level
+	}
+	return sl.filterLevel(), modules
+}
+
+// Log logs a message if the level is enabled for its message type, and
+// passes it to the reporter, if any. Messages with a sampler are dropped
+// if the sampler does not allow them.
+func (sl *SimpleLogger) Log(level LogLevel, mtype, msg string, fields LogFields) error {
+	fields, ok := sl.sample(mtype, msg, fields)
+	if !ok {
+		return nil
+	}
+	if reporter := sl.reporterFor(level); reporter != nil {
+		reporter.Report(level, mtype, msg, fields)
+	}
+	if atomic.LoadInt32(&sl.maxModuleLevel) >= 0 {
+		if filter, ok := sl.moduleLevel(mtype); ok {
+			if level > filter {
+				return nil
+			}
+			if e, ok := sl.Logger.(emitter); ok {
+				return e.Emit(level, mtype, msg, fields)
+			}
+		}
+	}
+	return sl.Logger.Log(level, mtype, msg, fields)
 }
 
 // Default logging calls for convenience
 func (sl *SimpleLogger) Debug(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(DEBUG, mtype, msg, fields)
+	return sl.Log(DEBUG, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Info(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(INFO, mtype, msg, fields)
+	return sl.Log(INFO, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Notice(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(NOTICE, mtype, msg, fields)
+	return sl.Log(NOTICE, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Warn(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(WARNING, mtype, msg, fields)
+	return sl.Log(WARNING, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Error(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(ERROR, mtype, msg, fields)
+	return sl.Log(ERROR, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Critical(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(CRITICAL, mtype, msg, fields)
+	return sl.Log(CRITICAL, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Alert(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(ALERT, mtype, msg, fields)
+	return sl.Log(ALERT, mtype, msg, fields)
 }
 
 func (sl *SimpleLogger) Panic(mtype, msg string, fields LogFields) error {
-	return sl.Logger.Log(EMERGENCY, mtype, msg, fields)
+	return sl.Log(EMERGENCY, mtype, msg, fields)
 }
 
 // A NetworkLogger sends log messages to a remote Heka instance over TCP,
@@ -193,7 +385,7 @@ func (nl *NetworkLogger) Init(app *Application, config interface{}) (err error)
 			nl.LogEmitter = NewProtobufEmitter(sender, conf.EnvVersion, hostname, conf.Name)
 		}
 
-	case "text":
+	case "text", "structured", "mozlog":
 		var conn net.Conn
 		if conf.UseTLS {
 			conn, err = tls.Dial(conf.Proto, conf.Addr, nil)
@@ -203,7 +395,14 @@ func (nl *NetworkLogger) Init(app *Application, config interface{}) (err error)
 		if err != nil {
 			return err
 		}
-		nl.LogEmitter = NewTextEmitter(conn)
+		switch conf.Format {
+		case "structured":
+			nl.LogEmitter = NewStructuredEmitter(conn, app.Hostname(), conf.Name)
+		case "mozlog":
+			nl.LogEmitter = NewMozlogEmitter(conn, app.Hostname(), conf.Name)
+		default:
+			nl.LogEmitter = NewTextEmitter(conn)
+		}
 
 	default:
 		return fmt.Errorf("NetworkLogger: Unrecognized log format '%s'", conf.Format)
@@ -273,6 +472,12 @@ func (fl *FileLogger) Init(app *Application, config interface{}) (err error) {
 	case "text":
 		fl.LogEmitter = NewTextEmitter(logFile)
 
+	case "structured":
+		fl.LogEmitter = NewStructuredEmitter(logFile, app.Hostname(), conf.Name)
+
+	case "mozlog":
+		fl.LogEmitter = NewMozlogEmitter(logFile, app.Hostname(), conf.Name)
+
 	default:
 		logFile.Close()
 		return fmt.Errorf("FileLogger: Unsupported log format '%s'", conf.Format)
@@ -335,6 +540,12 @@ func (ml *StdOutLogger) Init(app *Application, config interface{}) (err error) {
 	case "text":
 		ml.LogEmitter = NewTextEmitter(writer)
 
+	case "structured":
+		ml.LogEmitter = NewStructuredEmitter(writer, app.Hostname(), conf.Name)
+
+	case "mozlog":
+		ml.LogEmitter = NewMozlogEmitter(writer, app.Hostname(), conf.Name)
+
 	default:
 		return fmt.Errorf("StdOutLogger: Unsupported log format '%s'", conf.Format)
 	}
@@ -453,6 +664,10 @@ func (w *logResponseWriter) Flush() {
 type LogHandler struct {
 	http.Handler
 	Log *SimpleLogger
+
+	// Proxies lists the proxies trusted to forward the client address.
+	// Other X-Forwarded-For entries are not logged.
+	Proxies TrustedProxies
 }
 
 // formatRequest generates a Common Log Format request line.
@@ -471,10 +686,7 @@ func (h *LogHandler) logResponse(writer *logResponseWriter, req *http.Request, r
 	if !h.Log.ShouldLog(INFO) {
 		return
 	}
-	forwardedFor := req.Header[http.CanonicalHeaderKey("X-Forwarded-For")]
-	remoteAddrs := make([]string, len(forwardedFor)+1)
-	copy(remoteAddrs, forwardedFor)
-	remoteAddrs[len(remoteAddrs)-1], _, _ = net.SplitHostPort(req.RemoteAddr)
+	remoteAddrs := h.Proxies.AddrChain(req)
 	h.Log.Info("http", h.formatRequest(writer, req, remoteAddrs), LogFields{
 		"rid":                requestID,
 		"agent":              req.Header.Get("User-Agent"),
@@ -496,6 +708,8 @@ func (h *LogHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		requestID, _ = id.Generate()
 		req.Header.Set(HeaderID, requestID)
 	}
+	// Echo the ID so that users can quote it when reporting errors.
+	res.Header().Set(HeaderID, requestID)
 
 	writer := &logResponseWriter{ResponseWriter: res, StatusCode: http.StatusOK}
 	defer h.logResponse(writer, req, requestID, receivedAt)
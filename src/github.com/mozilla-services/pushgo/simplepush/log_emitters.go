@@ -21,6 +21,9 @@ import (
 
 const TextLogTime = "2006-01-02 15:04:05 -0700"
 
+// MozlogEnvVersion is the mozlog envelope version.
+const MozlogEnvVersion = "2.0"
+
 // hekaMessagePool holds recycled Heka message objects and encoding buffers.
 var hekaMessagePool = sync.Pool{New: func() interface{} {
 	return &hekaMessage{msg: new(message.Message)}
@@ -91,6 +94,136 @@ func (te *TextEmitter) Close() (err error) {
 	return
 }
 
+// NewStructuredEmitter creates an emitter that writes one JSON object per
+// line, suitable for ingestion by log shippers such as Logstash or Filebeat.
+func NewStructuredEmitter(writer io.Writer, hostname, loggerName string) *StructuredEmitter {
+	return &StructuredEmitter{
+		Writer:   writer,
+		LogName:  fmt.Sprintf("%s-%s", loggerName, VERSION),
+		Pid:      os.Getpid(),
+		Hostname: hostname,
+	}
+}
+
+// A StructuredEmitter emits newline-delimited JSON log messages.
+type StructuredEmitter struct {
+	io.Writer
+	LogName  string
+	Pid      int
+	Hostname string
+}
+
+// structuredMessage is the JSON representation of a log message.
+type structuredMessage struct {
+	Timestamp string    `json:"@timestamp"`
+	Severity  string    `json:"severity"`
+	Level     LogLevel  `json:"level"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	Logger    string    `json:"logger"`
+	Hostname  string    `json:"hostname"`
+	Pid       int       `json:"pid"`
+	Fields    LogFields `json:"fields,omitempty"`
+}
+
+// Emit writes a JSON log message. Implements LogEmitter.Emit.
+func (se *StructuredEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	reply, err := json.Marshal(&structuredMessage{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Severity:  level.String(),
+		Level:     level,
+		Type:      messageType,
+		Message:   payload,
+		Logger:    se.LogName,
+		Hostname:  se.Hostname,
+		Pid:       se.Pid,
+		Fields:    fields,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding log message: %s", err)
+	}
+	// Write the message and trailing newline at once, so that concurrent
+	// messages are not interleaved.
+	_, err = se.Writer.Write(append(reply, '\n'))
+	return
+}
+
+// Close closes the underlying write stream. Implements LogEmitter.Close.
+func (se *StructuredEmitter) Close() (err error) {
+	if c, ok := se.Writer.(io.Closer); ok {
+		err = c.Close()
+	}
+	return
+}
+
+// NewMozlogEmitter creates an emitter that writes messages in the mozlog
+// JSON format, one per line, for Mozilla's centralized logging pipeline.
+func NewMozlogEmitter(writer io.Writer, hostname, loggerName string) *MozlogEmitter {
+	return &MozlogEmitter{
+		Writer:   writer,
+		LogName:  fmt.Sprintf("%s-%s", loggerName, VERSION),
+		Pid:      os.Getpid(),
+		Hostname: hostname,
+	}
+}
+
+// A MozlogEmitter emits newline-delimited mozlog messages.
+type MozlogEmitter struct {
+	io.Writer
+	LogName  string
+	Pid      int
+	Hostname string
+}
+
+// mozlogMessage is the mozlog envelope. The message is stored in the "msg"
+// field.
+type mozlogMessage struct {
+	Timestamp  int64     `json:"Timestamp"`
+	Type       string    `json:"Type"`
+	Logger     string    `json:"Logger"`
+	Hostname   string    `json:"Hostname"`
+	EnvVersion string    `json:"EnvVersion"`
+	Severity   LogLevel  `json:"Severity"`
+	Pid        int       `json:"Pid"`
+	Fields     LogFields `json:"Fields"`
+}
+
+// Emit writes a mozlog message. Implements LogEmitter.Emit.
+func (me *MozlogEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	msgFields := make(LogFields, len(fields)+1)
+	for name, value := range fields {
+		msgFields[name] = value
+	}
+	msgFields["msg"] = payload
+	reply, err := json.Marshal(&mozlogMessage{
+		Timestamp:  time.Now().UnixNano(),
+		Type:       messageType,
+		Logger:     me.LogName,
+		Hostname:   me.Hostname,
+		EnvVersion: MozlogEnvVersion,
+		Severity:   level,
+		Pid:        me.Pid,
+		Fields:     msgFields,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding log message: %s", err)
+	}
+	_, err = me.Writer.Write(append(reply, '\n'))
+	return
+}
+
+// Close closes the underlying write stream. Implements LogEmitter.Close.
+func (me *MozlogEmitter) Close() (err error) {
+	if c, ok := me.Writer.(io.Closer); ok {
+		err = c.Close()
+	}
+	return
+}
+
 // NewJSONEmitter creates a JSON-encoded log message emitter.
 func NewJSONEmitter(sender client.Sender, envVersion,
 	hostname, loggerName string) *HekaEmitter {
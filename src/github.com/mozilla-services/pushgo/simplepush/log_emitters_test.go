@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStructuredEmitter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	emitter := NewStructuredEmitter(buf, "push.example.com", "pushgo")
+	emitter.Emit(WARNING, "worker", "Could not \"flush\"", LogFields{"uaid": "123"})
+	emitter.Emit(INFO, "main", "Started", nil)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected one message per line; got %q", buf.String())
+	}
+	var msg struct {
+		Timestamp string            `json:"@timestamp"`
+		Severity  string            `json:"severity"`
+		Level     int               `json:"level"`
+		Type      string            `json:"type"`
+		Message   string            `json:"message"`
+		Hostname  string            `json:"hostname"`
+		Fields    map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(lines[0], &msg); err != nil {
+		t.Fatalf("Error decoding message %q: %s", lines[0], err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err != nil {
+		t.Errorf("Invalid timestamp %q: %s", msg.Timestamp, err)
+	}
+	if msg.Severity != "WARNING" || msg.Level != int(WARNING) {
+		t.Errorf("Wrong severity: got %q (%d)", msg.Severity, msg.Level)
+	}
+	if msg.Type != "worker" || msg.Message != "Could not \"flush\"" {
+		t.Errorf("Wrong type or message: got %q, %q", msg.Type, msg.Message)
+	}
+	if msg.Hostname != "push.example.com" || msg.Fields["uaid"] != "123" {
+		t.Errorf("Wrong hostname or fields: got %q, %#v", msg.Hostname, msg.Fields)
+	}
+}
+
+func TestMozlogEmitter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	emitter := NewMozlogEmitter(buf, "push.example.com", "pushgo")
+	emitter.Emit(ERROR, "worker", "Could not flush", LogFields{"uaid": "123"})
+
+	var msg struct {
+		Timestamp  int64
+		Type       string
+		Logger     string
+		Hostname   string
+		EnvVersion string
+		Severity   int
+		Pid        int
+		Fields     map[string]string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("Error decoding message %q: %s", buf.Bytes(), err)
+	}
+	if msg.Timestamp <= 0 || msg.Pid <= 0 {
+		t.Errorf("Missing timestamp or pid: got %d, %d", msg.Timestamp, msg.Pid)
+	}
+	if msg.EnvVersion != "2.0" || msg.Severity != int(ERROR) {
+		t.Errorf("Wrong version or severity: got %q, %d", msg.EnvVersion, msg.Severity)
+	}
+	if msg.Type != "worker" || msg.Logger != "pushgo-"+VERSION || msg.Hostname != "push.example.com" {
+		t.Errorf("Wrong type, logger, or hostname: got %q, %q, %q", msg.Type,
+			msg.Logger, msg.Hostname)
+	}
+	if msg.Fields["msg"] != "Could not flush" || msg.Fields["uaid"] != "123" {
+		t.Errorf("Wrong fields: got %#v", msg.Fields)
+	}
+}
@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidSampleRule = errors.New(
+	`Log sampling rules must be of the form "message=1%" or "message=10/s"`)
+
+// A LogSampler limits how often a log message is emitted, either by
+// sampling a fraction of messages or by capping the number of messages per
+// second.
+type LogSampler struct {
+	rate   float64 // Fraction of messages to keep; 0 if rate-limited.
+	seen   uint64  // Accessed atomically.
+	limit  int
+	lock   sync.Mutex
+	window int64 // Current one-second window, in Unix seconds.
+	count  int
+	// suppressed is the number of messages dropped since the last message
+	// emitted. Accessed atomically.
+	suppressed int64
+}
+
+// NewRateSampler returns a sampler that keeps the given fraction (0-1] of
+// messages.
+func NewRateSampler(rate float64) *LogSampler {
+	return &LogSampler{rate: rate}
+}
+
+// NewLimitSampler returns a sampler that keeps at most limit messages per
+// second.
+func NewLimitSampler(limit int) *LogSampler {
+	return &LogSampler{limit: limit}
+}
+
+// ParseLogSampleRule parses a rule of the form "message=1%", which keeps 1%
+// of messages, or "message=10/s", which keeps at most 10 messages per
+// second. The message may be prefixed with a message type, as in
+// "worker:Socket receive", to limit the rule to that type.
+func ParseLogSampleRule(rule string) (message string, sampler *LogSampler, err error) {
+	i := strings.LastIndex(rule, "=")
+	if i < 0 {
+		return "", nil, ErrInvalidSampleRule
+	}
+	message, value := strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:])
+	if len(message) == 0 {
+		return "", nil, ErrInvalidSampleRule
+	}
+	switch {
+	case strings.HasSuffix(value, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return "", nil, ErrInvalidSampleRule
+		}
+		return message, NewRateSampler(percent / 100), nil
+	case strings.HasSuffix(value, "/s"):
+		limit, err := strconv.Atoi(strings.TrimSuffix(value, "/s"))
+		if err != nil || limit < 0 {
+			return "", nil, ErrInvalidSampleRule
+		}
+		return message, NewLimitSampler(limit), nil
+	}
+	return "", nil, ErrInvalidSampleRule
+}
+
+// Allow indicates whether the next message should be emitted. If so, it also
+// returns the number of messages suppressed since the last one emitted.
+func (s *LogSampler) Allow(now time.Time) (ok bool, suppressed int64) {
+	if s.rate > 0 {
+		// Keep a message each time the running total of kept fractions
+		// crosses an integer, so that sampling is even rather than random.
+		n := atomic.AddUint64(&s.seen, 1)
+		ok = uint64(float64(n)*s.rate) != uint64(float64(n-1)*s.rate)
+	} else {
+		second := now.Unix()
+		s.lock.Lock()
+		if second != s.window {
+			s.window, s.count = second, 0
+		}
+		if ok = s.count < s.limit; ok {
+			s.count++
+		}
+		s.lock.Unlock()
+	}
+	if !ok {
+		atomic.AddInt64(&s.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapInt64(&s.suppressed, 0)
+}
+
+// SetSampler limits how often the given message is logged. The message may
+// be prefixed with a message type, as in "worker:Socket receive". A nil
+// sampler removes the limit. Sampled messages are not passed to the
+// reporter either, so that a storm of errors doesn't flood it.
+func (sl *SimpleLogger) SetSampler(message string, sampler *LogSampler) {
+	sl.levelLock.Lock()
+	defer sl.levelLock.Unlock()
+	current, _ := sl.samplers.Load().(map[string]*LogSampler)
+	samplers := make(map[string]*LogSampler, len(current)+1)
+	for m, s := range current {
+		samplers[m] = s
+	}
+	if sampler == nil {
+		delete(samplers, message)
+	} else {
+		samplers[message] = sampler
+	}
+	sl.samplers.Store(samplers)
+}
+
+// sample applies the sampler for a message, if any. If the message should be
+// logged, it returns the fields to log, including the number of suppressed
+// messages.
+func (sl *SimpleLogger) sample(mtype, msg string, fields LogFields) (LogFields, bool) {
+	samplers, _ := sl.samplers.Load().(map[string]*LogSampler)
+	if len(samplers) == 0 {
+		return fields, true
+	}
+	sampler, ok := samplers[mtype+":"+msg]
+	if !ok {
+		if sampler, ok = samplers[msg]; !ok {
+			return fields, true
+		}
+	}
+	ok, suppressed := sampler.Allow(time.Now())
+	if !ok {
+		return nil, false
+	}
+	if suppressed > 0 {
+		sampled := make(LogFields, len(fields)+1)
+		for name, value := range fields {
+			sampled[name] = value
+		}
+		sampled["suppressed"] = strconv.FormatInt(suppressed, 10)
+		fields = sampled
+	}
+	return fields, true
+}
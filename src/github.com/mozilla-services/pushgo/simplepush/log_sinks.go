@@ -0,0 +1,538 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSyslog      = errors.New("Could not connect to the local syslog daemon")
+	ErrEntryTooLarge = errors.New("Log message too large for the journal")
+)
+
+// Local syslog sockets, in order of preference.
+var syslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// JournalSocket is the systemd journal's native protocol socket.
+const JournalSocket = "/run/systemd/journal/socket"
+
+// NewSyslogEmitter creates an emitter that formats messages according to RFC
+// 5424, with fields as structured data. If proto is empty, messages are sent
+// to the local syslog daemon.
+func NewSyslogEmitter(proto, addr string, facility int, hostname, appName,
+	sdID string) (*SyslogEmitter, error) {
+
+	se := &SyslogEmitter{
+		Proto:    proto,
+		Addr:     addr,
+		Facility: facility,
+		Hostname: hostname,
+		AppName:  appName,
+		SDID:     sdID,
+		Pid:      os.Getpid(),
+	}
+	if err := se.connect(); err != nil {
+		return nil, err
+	}
+	return se, nil
+}
+
+// A SyslogEmitter emits RFC 5424 syslog messages.
+type SyslogEmitter struct {
+	Proto    string
+	Addr     string
+	Facility int
+	Hostname string
+	AppName  string
+	SDID     string
+	Pid      int
+	lock     sync.Mutex
+	conn     net.Conn
+}
+
+// connect dials the syslog daemon. The caller must hold the lock, or have
+// exclusive access to the emitter.
+func (se *SyslogEmitter) connect() (err error) {
+	if se.conn != nil {
+		se.conn.Close()
+		se.conn = nil
+	}
+	if len(se.Proto) > 0 {
+		se.conn, err = net.Dial(se.Proto, se.Addr)
+		return err
+	}
+	paths := syslogPaths
+	if len(se.Addr) > 0 {
+		paths = []string{se.Addr}
+	}
+	for _, path := range paths {
+		for _, proto := range []string{"unixgram", "unix"} {
+			if se.conn, err = net.Dial(proto, path); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrNoSyslog
+}
+
+// Format returns the RFC 5424 representation of a log message.
+func (se *SyslogEmitter) Format(level LogLevel, messageType, payload string,
+	fields LogFields) []byte {
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "<%d>1 %s %s %s %d %s ", se.Facility*8+int(level),
+		time.Now().UTC().Format(time.RFC3339Nano), syslogHeader(se.Hostname, 255),
+		syslogHeader(se.AppName, 48), se.Pid, syslogHeader(messageType, 32))
+	if len(fields) == 0 {
+		msg.WriteByte('-')
+	} else {
+		msg.WriteByte('[')
+		msg.WriteString(se.SDID)
+		for _, name := range fields.Names() {
+			msg.WriteByte(' ')
+			msg.WriteString(syslogParamName(name))
+			msg.WriteString(`="`)
+			syslogParamValue(msg, fields[name])
+			msg.WriteByte('"')
+		}
+		msg.WriteByte(']')
+	}
+	if len(payload) > 0 {
+		msg.WriteByte(' ')
+		msg.WriteString(payload)
+	}
+	return msg.Bytes()
+}
+
+// Emit sends a syslog message, reconnecting once if the daemon went away.
+// Implements LogEmitter.Emit.
+func (se *SyslogEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	msg := se.Format(level, messageType, payload, fields)
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.conn != nil {
+		if err = se.write(msg); err == nil {
+			return nil
+		}
+	}
+	if err = se.connect(); err != nil {
+		return err
+	}
+	return se.write(msg)
+}
+
+// write frames and sends a message. Datagrams are sent as-is; stream sockets
+// use RFC 6587 octet counting for TCP, and newline framing for local
+// daemons. The caller must hold the lock.
+func (se *SyslogEmitter) write(msg []byte) (err error) {
+	switch se.conn.RemoteAddr().Network() {
+	case "tcp", "tcp4", "tcp6":
+		_, err = fmt.Fprintf(se.conn, "%d %s", len(msg), msg)
+	case "unix":
+		_, err = se.conn.Write(append(msg, '\n'))
+	default:
+		_, err = se.conn.Write(msg)
+	}
+	return err
+}
+
+// Close closes the connection to the syslog daemon. Implements
+// LogEmitter.Close.
+func (se *SyslogEmitter) Close() (err error) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.conn != nil {
+		err = se.conn.Close()
+		se.conn = nil
+	}
+	return
+}
+
+// syslogHeader returns a header field with non-printable characters and
+// spaces removed, truncated to max bytes, or the nil value "-" if empty.
+func syslogHeader(value string, max int) string {
+	header := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(header) < max; i++ {
+		if c := value[i]; c > ' ' && c <= '~' {
+			header = append(header, c)
+		}
+	}
+	if len(header) == 0 {
+		return "-"
+	}
+	return string(header)
+}
+
+// syslogParamName returns a structured data parameter name with reserved
+// characters replaced.
+func syslogParamName(name string) string {
+	param := []byte(syslogHeader(name, 32))
+	for i, c := range param {
+		if c == '=' || c == ']' || c == '"' {
+			param[i] = '_'
+		}
+	}
+	return string(param)
+}
+
+// syslogParamValue writes a structured data parameter value, escaping '"',
+// '\', and ']'.
+func syslogParamValue(buf *bytes.Buffer, value string) {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\\', ']':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// NewJournalEmitter creates an emitter that sends messages to the systemd
+// journal using its native protocol. Fields are sent as journal fields,
+// with names upper-cased.
+func NewJournalEmitter(path, identifier string) (*JournalEmitter, error) {
+	if len(path) == 0 {
+		path = JournalSocket
+	}
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	return &JournalEmitter{Identifier: identifier, conn: conn}, nil
+}
+
+// A JournalEmitter emits messages to the systemd journal.
+type JournalEmitter struct {
+	Identifier string
+	conn       net.Conn
+}
+
+// Format returns the native protocol representation of a log message.
+func (je *JournalEmitter) Format(level LogLevel, messageType, payload string,
+	fields LogFields) []byte {
+
+	entry := new(bytes.Buffer)
+	journalField(entry, "MESSAGE", payload)
+	journalField(entry, "PRIORITY", strconv.Itoa(int(level)))
+	journalField(entry, "SYSLOG_IDENTIFIER", je.Identifier)
+	journalField(entry, "MESSAGE_TYPE", messageType)
+	for _, name := range fields.Names() {
+		if key := journalFieldName(name); len(key) > 0 {
+			journalField(entry, key, fields[name])
+		}
+	}
+	return entry.Bytes()
+}
+
+// Emit sends a journal entry. Implements LogEmitter.Emit.
+func (je *JournalEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) error {
+
+	if _, err := je.conn.Write(je.Format(level, messageType, payload, fields)); err != nil {
+		if isMessageTooLarge(err) {
+			return ErrEntryTooLarge
+		}
+		return err
+	}
+	return nil
+}
+
+// Close closes the journal socket. Implements LogEmitter.Close.
+func (je *JournalEmitter) Close() error {
+	return je.conn.Close()
+}
+
+// journalField writes a journal field. Values containing newlines use the
+// length-prefixed binary encoding.
+func journalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if strings.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts a log field name to a journal field name, which
+// may only contain upper-case letters, digits, and underscores, and may not
+// start with an underscore or digit.
+func journalFieldName(name string) string {
+	key := make([]byte, 0, len(name))
+	for i := 0; i < len(name) && len(key) < 64; i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z':
+			key = append(key, c-'a'+'A')
+		case c >= 'A' && c <= 'Z', c == '_' && len(key) > 0,
+			c >= '0' && c <= '9' && len(key) > 0:
+			key = append(key, c)
+		default:
+			if len(key) > 0 {
+				key = append(key, '_')
+			}
+		}
+	}
+	return string(key)
+}
+
+func isMessageTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "message too long")
+}
+
+// SyslogLogger writes log messages to syslog.
+type SyslogLogger struct {
+	LogEmitter
+	filter LogLevel
+}
+
+type SyslogLoggerConfig struct {
+	// Proto and Addr specify a remote syslog server, e.g. "udp" and
+	// "logs:514". If Proto is empty, messages are sent to the local daemon;
+	// Addr then optionally overrides the socket path.
+	Proto string
+	Addr  string
+
+	// Facility is the syslog facility code. Defaults to 16 (local0).
+	Facility int
+
+	// Name is the syslog APP-NAME. Defaults to "pushgo".
+	Name string `toml:"name" env:"name"`
+
+	// SDID is the structured data ID for message fields. Defaults to
+	// "pushgo@32473".
+	SDID string `toml:"sd_id" env:"sd_id"`
+
+	Filter int32
+}
+
+func (sl *SyslogLogger) ConfigStruct() interface{} {
+	return &SyslogLoggerConfig{
+		Facility: 16,
+		Name:     "pushgo",
+		SDID:     "pushgo@32473",
+		Filter:   0,
+	}
+}
+
+func (sl *SyslogLogger) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*SyslogLoggerConfig)
+	if conf.Facility < 0 || conf.Facility > 23 {
+		return fmt.Errorf("SyslogLogger: Invalid facility %d", conf.Facility)
+	}
+	if sl.LogEmitter, err = NewSyslogEmitter(conf.Proto, conf.Addr,
+		conf.Facility, app.Hostname(), conf.Name, conf.SDID); err != nil {
+		return err
+	}
+	sl.filter = LogLevel(conf.Filter)
+	return nil
+}
+
+func (sl *SyslogLogger) ShouldLog(level LogLevel) bool {
+	return level <= sl.filter
+}
+
+func (sl *SyslogLogger) SetFilter(level LogLevel) {
+	sl.filter = level
+}
+
+func (sl *SyslogLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
+	if !sl.ShouldLog(level) {
+		return
+	}
+	return sl.Emit(level, messageType, payload, fields)
+}
+
+// JournalLogger writes log messages to the systemd journal.
+type JournalLogger struct {
+	LogEmitter
+	filter LogLevel
+}
+
+type JournalLoggerConfig struct {
+	// Path is the journal socket. Defaults to the systemd journal's native
+	// protocol socket.
+	Path string
+
+	// Name is the SYSLOG_IDENTIFIER for journal entries. Defaults to
+	// "pushgo".
+	Name string `toml:"name" env:"name"`
+
+	Filter int32
+}
+
+func (jl *JournalLogger) ConfigStruct() interface{} {
+	return &JournalLoggerConfig{
+		Path:   JournalSocket,
+		Name:   "pushgo",
+		Filter: 0,
+	}
+}
+
+func (jl *JournalLogger) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*JournalLoggerConfig)
+	if jl.LogEmitter, err = NewJournalEmitter(conf.Path, conf.Name); err != nil {
+		return err
+	}
+	jl.filter = LogLevel(conf.Filter)
+	return nil
+}
+
+func (jl *JournalLogger) ShouldLog(level LogLevel) bool {
+	return level <= jl.filter
+}
+
+func (jl *JournalLogger) SetFilter(level LogLevel) {
+	jl.filter = level
+}
+
+func (jl *JournalLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
+	if !jl.ShouldLog(level) {
+		return
+	}
+	return jl.Emit(level, messageType, payload, fields)
+}
+
+// MultiLogger sends each log message to several loggers, each with its own
+// format and filter.
+type MultiLogger struct {
+	loggers []Logger
+}
+
+type MultiLoggerConfig struct {
+	// Targets lists the loggers that receive each message, e.g.
+	// ["syslog", "journal"]. Each target is configured in its own
+	// subsection.
+	Targets []string
+
+	Stdout  StdOutLoggerConfig  `toml:"stdout" env:"stdout"`
+	File    FileLoggerConfig    `toml:"file" env:"file"`
+	Net     NetworkLoggerConfig `toml:"net" env:"net"`
+	Syslog  SyslogLoggerConfig  `toml:"syslog" env:"syslog"`
+	Journal JournalLoggerConfig `toml:"journal" env:"journal"`
+}
+
+func (ml *MultiLogger) ConfigStruct() interface{} {
+	return &MultiLoggerConfig{
+		Stdout:  *new(StdOutLogger).ConfigStruct().(*StdOutLoggerConfig),
+		File:    *new(FileLogger).ConfigStruct().(*FileLoggerConfig),
+		Net:     *new(NetworkLogger).ConfigStruct().(*NetworkLoggerConfig),
+		Syslog:  *new(SyslogLogger).ConfigStruct().(*SyslogLoggerConfig),
+		Journal: *new(JournalLogger).ConfigStruct().(*JournalLoggerConfig),
+	}
+}
+
+func (ml *MultiLogger) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*MultiLoggerConfig)
+	if len(conf.Targets) == 0 {
+		return fmt.Errorf("MultiLogger: Missing log targets")
+	}
+	for _, target := range conf.Targets {
+		var (
+			logger     Logger
+			loggerConf interface{}
+		)
+		switch target {
+		case "stdout":
+			logger, loggerConf = new(StdOutLogger), &conf.Stdout
+		case "file":
+			logger, loggerConf = new(FileLogger), &conf.File
+		case "net":
+			logger, loggerConf = new(NetworkLogger), &conf.Net
+		case "syslog":
+			logger, loggerConf = new(SyslogLogger), &conf.Syslog
+		case "journal":
+			logger, loggerConf = new(JournalLogger), &conf.Journal
+		default:
+			ml.Close()
+			return fmt.Errorf("MultiLogger: Unrecognized log target '%s'", target)
+		}
+		if err = logger.Init(app, loggerConf); err != nil {
+			ml.Close()
+			return fmt.Errorf("MultiLogger: Could not initialize '%s': %s", target, err)
+		}
+		ml.loggers = append(ml.loggers, logger)
+	}
+	return nil
+}
+
+func (ml *MultiLogger) ShouldLog(level LogLevel) bool {
+	for _, logger := range ml.loggers {
+		if logger.ShouldLog(level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ml *MultiLogger) SetFilter(level LogLevel) {
+	for _, logger := range ml.loggers {
+		logger.SetFilter(level)
+	}
+}
+
+// Log sends the message to each logger that accepts its level, returning the
+// first error.
+func (ml *MultiLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
+	for _, logger := range ml.loggers {
+		if !logger.ShouldLog(level) {
+			continue
+		}
+		if lerr := logger.Log(level, messageType, payload, fields); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return
+}
+
+// Emit sends the message to every logger, regardless of its filter.
+func (ml *MultiLogger) Emit(level LogLevel, messageType, payload string, fields LogFields) (err error) {
+	for _, logger := range ml.loggers {
+		var lerr error
+		if e, ok := logger.(emitter); ok {
+			lerr = e.Emit(level, messageType, payload, fields)
+		} else {
+			lerr = logger.Log(level, messageType, payload, fields)
+		}
+		if lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return
+}
+
+func (ml *MultiLogger) Close() (err error) {
+	for _, logger := range ml.loggers {
+		if cerr := logger.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+func init() {
+	AvailableLoggers["syslog"] = func() HasConfigStruct { return new(SyslogLogger) }
+	AvailableLoggers["journal"] = func() HasConfigStruct { return new(JournalLogger) }
+	AvailableLoggers["multi"] = func() HasConfigStruct { return new(MultiLogger) }
+}
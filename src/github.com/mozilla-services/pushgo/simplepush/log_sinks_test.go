@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUnixgram returns a datagram socket in a temporary directory, and a
+// function that removes it.
+func listenUnixgram(t *testing.T, name string) (*net.UnixConn, string, func()) {
+	dir, err := ioutil.TempDir("", "pushgo")
+	if err != nil {
+		t.Fatalf("Error creating socket directory: %s", err)
+	}
+	path := filepath.Join(dir, name)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error listening on %q: %s", path, err)
+	}
+	return conn, path, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Error reading log message: %s", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogEmitter(t *testing.T) {
+	conn, path, done := listenUnixgram(t, "log")
+	defer done()
+
+	emitter, err := NewSyslogEmitter("", path, 16, "push.example.com",
+		"pushgo", "pushgo@32473")
+	if err != nil {
+		t.Fatalf("Error connecting to syslog: %s", err)
+	}
+	defer emitter.Close()
+
+	emitter.Emit(WARNING, "worker", "Could not flush",
+		LogFields{"uaid": "123", "error": `bad "quote"]`})
+	msg := readDatagram(t, conn)
+	expected := regexp.MustCompile(`^<132>1 \S+ push\.example\.com pushgo \d+ worker ` +
+		regexp.QuoteMeta(`[pushgo@32473 error="bad \"quote\"\]" uaid="123"] Could not flush`) + `$`)
+	if !expected.MatchString(msg) {
+		t.Errorf("Wrong syslog message: %q", msg)
+	}
+
+	emitter.Emit(INFO, "main started", "", nil)
+	if msg = readDatagram(t, conn); !strings.HasSuffix(msg, " mainstarted -") {
+		t.Errorf("Wrong syslog message without fields: %q", msg)
+	}
+}
+
+func TestJournalEmitter(t *testing.T) {
+	conn, path, done := listenUnixgram(t, "journal")
+	defer done()
+
+	emitter, err := NewJournalEmitter(path, "pushgo")
+	if err != nil {
+		t.Fatalf("Error connecting to journal: %s", err)
+	}
+	defer emitter.Close()
+
+	emitter.Emit(ERROR, "worker", "line 1\nline 2", LogFields{"uaid": "123", "_secret": "x"})
+	entry := readDatagram(t, conn)
+	for _, field := range []string{
+		"MESSAGE\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\n",
+		"PRIORITY=3\n",
+		"SYSLOG_IDENTIFIER=pushgo\n",
+		"MESSAGE_TYPE=worker\n",
+		"UAID=123\n",
+		"SECRET=x\n",
+	} {
+		if !strings.Contains(entry, field) {
+			t.Errorf("Missing field %q in journal entry %q", field, entry)
+		}
+	}
+}
+
+func TestMultiLogger(t *testing.T) {
+	syslogConn, syslogPath, syslogDone := listenUnixgram(t, "log")
+	defer syslogDone()
+	journalConn, journalPath, journalDone := listenUnixgram(t, "journal")
+	defer journalDone()
+
+	_, app := newTestHandler(t)
+	logger := new(MultiLogger)
+	conf := logger.ConfigStruct().(*MultiLoggerConfig)
+	conf.Targets = []string{"syslog", "journal"}
+	conf.Syslog.Addr = syslogPath
+	conf.Syslog.Filter = int32(INFO)
+	conf.Journal.Path = journalPath
+	conf.Journal.Filter = int32(ERROR)
+	if err := logger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing logger: %s", err)
+	}
+	defer logger.Close()
+
+	if !logger.ShouldLog(INFO) || logger.ShouldLog(DEBUG) {
+		t.Errorf("Expected logger to accept the most verbose target level")
+	}
+	logger.Log(INFO, "main", "info", nil)
+	logger.Log(ERROR, "main", "error", nil)
+	if msg := readDatagram(t, syslogConn); !strings.HasSuffix(msg, " info") {
+		t.Errorf("Expected info message in syslog; got %q", msg)
+	}
+	if msg := readDatagram(t, syslogConn); !strings.HasSuffix(msg, " error") {
+		t.Errorf("Expected error message in syslog; got %q", msg)
+	}
+	if entry := readDatagram(t, journalConn); !strings.Contains(entry, "MESSAGE=error\n") {
+		t.Errorf("Expected only error message in journal; got %q", entry)
+	}
+
+	conf.Targets = []string{"syslog", "carrier-pigeon"}
+	if err := new(MultiLogger).Init(app, conf); err == nil {
+		t.Errorf("Expected error for unrecognized log target")
+	}
+}
@@ -0,0 +1,207 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingLogger records the message types of logged messages.
+type recordingLogger struct {
+	TestLogger
+	messages []string
+	fields   []LogFields
+}
+
+func (r *recordingLogger) Log(level LogLevel, mType, payload string, fields LogFields) error {
+	if !r.ShouldLog(level) {
+		return nil
+	}
+	return r.Emit(level, mType, payload, fields)
+}
+
+func (r *recordingLogger) Emit(level LogLevel, mType, payload string, fields LogFields) error {
+	r.messages = append(r.messages, mType)
+	r.fields = append(r.fields, fields)
+	return nil
+}
+
+func TestModuleLevels(t *testing.T) {
+	recorder := &recordingLogger{TestLogger: TestLogger{filter: WARNING}}
+	logger, _ := NewLogger(recorder)
+
+	logger.SetModuleLevel("storage", DEBUG)
+	logger.SetModuleLevel("router", ERROR)
+	if !logger.ShouldLog(DEBUG) {
+		t.Errorf("Expected DEBUG messages to pass the filter")
+	}
+	if recorder.filter != WARNING {
+		t.Errorf("Module levels changed the logger's filter: got %s", recorder.filter)
+	}
+	logger.Debug("worker", "dropped", nil)
+	logger.Debug("gomemc", "logged", nil)
+	logger.Debug("storage", "logged", nil)
+	logger.Warn("worker", "logged", nil)
+	logger.Warn("router", "dropped", nil)
+	logger.Warn("gossip", "dropped", nil)
+	expected := []string{"gomemc", "storage", "worker"}
+	if !reflect.DeepEqual(recorder.messages, expected) {
+		t.Errorf("Wrong messages: got %#v; want %#v", recorder.messages, expected)
+	}
+
+	defaultLevel, modules := logger.ModuleLevels()
+	if defaultLevel != WARNING || len(modules) != 2 {
+		t.Errorf("Wrong levels: got %s, %#v", defaultLevel, modules)
+	}
+	logger.ResetModuleLevel("storage")
+	logger.ResetModuleLevel("router")
+	if logger.ShouldLog(INFO) || !logger.ShouldLog(WARNING) {
+		t.Errorf("Expected filter to be restored after removing module levels")
+	}
+
+	// Targets keep their own filters for other components.
+	verbose := &recordingLogger{TestLogger: TestLogger{filter: INFO}}
+	quiet := &recordingLogger{TestLogger: TestLogger{filter: ERROR}}
+	multi, _ := NewLogger(&MultiLogger{loggers: []Logger{verbose, quiet}})
+	multi.SetModuleLevel("storage", DEBUG)
+	multi.Debug("storage", "logged", nil)
+	multi.Info("worker", "logged", nil)
+	if len(verbose.messages) != 2 || len(quiet.messages) != 1 {
+		t.Errorf("Wrong messages: got %#v, %#v", verbose.messages, quiet.messages)
+	}
+	if verbose.filter != INFO || quiet.filter != ERROR {
+		t.Errorf("Module levels changed target filters: got %s, %s",
+			verbose.filter, quiet.filter)
+	}
+
+	for value, expected := range map[string]LogLevel{
+		"debug": DEBUG, "WARN": WARNING, "3": ERROR, " notice ": NOTICE,
+	} {
+		if level, err := ParseLogLevel(value); err != nil || level != expected {
+			t.Errorf("Wrong level for %q: got %s (%v); want %s", value, level,
+				err, expected)
+		}
+	}
+	for _, value := range []string{"", "8", "-1", "verbose"} {
+		if _, err := ParseLogLevel(value); err != ErrInvalidLogLevel {
+			t.Errorf("Expected invalid level error for %q; got %v", value, err)
+		}
+	}
+}
+
+func TestLogLevelsHandler(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	defer handler.logger.ResetModuleLevel("worker")
+
+	form := url.Values{"module": {"worker"}, "level": {"info"}}
+	req, _ := http.NewRequest("POST", "/admin/log-levels",
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	handler.LogLevelsHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Wrong status: got %d; want 200", resp.Code)
+	}
+	reply := new(LogLevelsReply)
+	if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+		t.Fatalf("Error decoding reply: %s", err)
+	}
+	if reply.Modules["worker"] != "INFO" {
+		t.Errorf("Wrong worker level: got %#v", reply)
+	}
+
+	form.Set("level", "chatty")
+	req, _ = http.NewRequest("POST", "/admin/log-levels",
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	handler.LogLevelsHandler(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status for invalid level: got %d; want 400", resp.Code)
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	recorder := &recordingLogger{TestLogger: TestLogger{filter: DEBUG}}
+	logger, _ := NewLogger(recorder)
+	for _, rule := range []string{"worker:Socket receive=10%", "Bad data=2/s"} {
+		message, sampler, err := ParseLogSampleRule(rule)
+		if err != nil {
+			t.Fatalf("Error parsing rule %q: %s", rule, err)
+		}
+		logger.SetSampler(message, sampler)
+	}
+
+	for i := 0; i < 100; i++ {
+		logger.Debug("worker", "Socket receive", nil)
+		logger.Debug("router", "Socket receive", nil)
+	}
+	var worker, router int
+	for _, mtype := range recorder.messages {
+		if mtype == "worker" {
+			worker++
+		} else {
+			router++
+		}
+	}
+	if worker != 10 || router != 100 {
+		t.Errorf("Wrong sampled counts: got %d worker, %d router; want 10, 100",
+			worker, router)
+	}
+	if suppressed := recorder.fields[len(recorder.fields)-1]; suppressed != nil {
+		t.Errorf("Expected unsampled message to be logged as-is; got %#v", suppressed)
+	}
+
+	sampler := NewLimitSampler(2)
+	now := time.Now()
+	for i, expected := range []bool{true, true, false, false} {
+		if ok, _ := sampler.Allow(now); ok != expected {
+			t.Errorf("Wrong result for message %d: got %t; want %t", i, ok, expected)
+		}
+	}
+	if ok, suppressed := sampler.Allow(now.Add(time.Second)); !ok || suppressed != 2 {
+		t.Errorf("Expected message in next second with 2 suppressed; got %t, %d",
+			ok, suppressed)
+	}
+
+	for _, rule := range []string{"Bad data", "=1%", "Bad data=0%", "Bad data=101%", "Bad data=fast"} {
+		if _, _, err := ParseLogSampleRule(rule); err != ErrInvalidSampleRule {
+			t.Errorf("Expected invalid rule error for %q; got %v", rule, err)
+		}
+	}
+}
+
+func TestLogHandlerRequestID(t *testing.T) {
+	_, app := newTestHandler(t)
+	var handled string
+	handler := &LogHandler{http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		handled = req.Header.Get(HeaderID)
+		http.Error(resp, "Invalid Token", http.StatusNotFound)
+	}), app.Logger(), nil}
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, &http.Request{Method: "GET", URL: &url.URL{Path: "/update/x"},
+		Header: make(http.Header), RemoteAddr: "127.0.0.1:1234"})
+	if rid := resp.Header().Get(HeaderID); len(rid) == 0 || rid != handled {
+		t.Errorf("Wrong generated request ID: got %q; handler saw %q", rid, handled)
+	}
+
+	// Valid client-supplied IDs are reused.
+	rid := "d1c7c768-b1be-4c70-93a6-9b52910d4baa"
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/update/x"},
+		Header: http.Header{HeaderID: {rid}}, RemoteAddr: "127.0.0.1:1234"}
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if actual := resp.Header().Get(HeaderID); actual != rid {
+		t.Errorf("Wrong request ID: got %q; want %q", actual, rid)
+	}
+}
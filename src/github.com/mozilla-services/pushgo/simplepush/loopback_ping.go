@@ -0,0 +1,212 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+func init() {
+	AvailablePings["loopback"] = func() HasConfigStruct { return new(LoopbackPing) }
+}
+
+var (
+	// loopbackThrottledErr is returned for devices that asked the loopback
+	// bridge to simulate throttling.
+	loopbackThrottledErr = &PingerError{"Simulated bridge throttling", true}
+
+	// loopbackFailedErr is returned for devices that asked the loopback
+	// bridge to simulate a delivery failure.
+	loopbackFailedErr = &PingerError{"Simulated bridge failure", false}
+)
+
+type LoopbackPingConfig struct {
+	// MaxWakes is the number of wakes kept in memory. Older wakes are
+	// discarded. Defaults to 1000.
+	MaxWakes int `toml:"max_wakes" env:"max_wakes"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// LoopbackPingData is the "connect" data accepted by the loopback pinger.
+// Any JSON object is accepted; the optional result selects the bridge
+// response simulated for the device.
+type LoopbackPingData struct {
+	// Result is one of "accepted", "invalid", "throttled", or "failed".
+	// Defaults to "accepted".
+	Result string `json:"result"`
+}
+
+// LoopbackWake is a wake recorded by the loopback pinger.
+type LoopbackWake struct {
+	UAID    string
+	Version int64
+	Data    string
+	Result  string
+	Time    time.Time
+}
+
+// LoopbackPing is a bridge that records wakes in memory instead of sending
+// them. It is used by integration tests and staging environments to
+// exercise the proprietary ping path, including bridge feedback and
+// guards, without contacting a push service.
+type LoopbackPing struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	store    Store
+	feedback *PingFeedback
+	guard    *BridgeGuard
+	maxWakes int
+
+	wakesLock sync.Mutex
+	wakes     []LoopbackWake
+}
+
+func (*LoopbackPing) ConfigStruct() interface{} {
+	return &LoopbackPingConfig{
+		MaxWakes: 1000,
+		Guard:    DefaultBridgeGuard(),
+	}
+}
+
+func (r *LoopbackPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*LoopbackPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("loopback", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "loopback", r.guard)
+	if r.maxWakes = conf.MaxWakes; r.maxWakes < 1 {
+		r.maxWakes = 1
+	}
+	return nil
+}
+
+// CanBypassWebsocket returns false; loopback wakes do not carry updates.
+func (r *LoopbackPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *LoopbackPing) OnlyOffline() bool {
+	return true
+}
+
+// isLoopbackResult indicates whether result is a simulated bridge response.
+func isLoopbackResult(result string) bool {
+	switch result {
+	case "", PingAccepted, PingInvalid, PingThrottled, PingFailed:
+		return true
+	}
+	return false
+}
+
+// Register stores the device's "connect" data.
+func (r *LoopbackPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(LoopbackPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || !isLoopbackResult(ping.Result) {
+		r.metrics.Increment("ping.loopback.rejected")
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store loopback connect data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// Send records a wake for the device, and reports the result requested in
+// its "connect" data. It returns false without an error if the device did
+// not register.
+func (r *LoopbackPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch loopback connect data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(LoopbackPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil {
+		return false, nil
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	result := ping.Result
+	if len(result) == 0 {
+		result = PingAccepted
+	}
+	r.record(LoopbackWake{
+		UAID:    uaid,
+		Version: vers,
+		Data:    data,
+		Result:  result,
+		Time:    time.Now(),
+	})
+	switch result {
+	case PingInvalid:
+		r.feedback.Invalid(uaid)
+		return false, nil
+	case PingThrottled:
+		r.feedback.Failed(uaid, loopbackThrottledErr)
+		return false, loopbackThrottledErr
+	case PingFailed:
+		r.feedback.Failed(uaid, loopbackFailedErr)
+		return false, loopbackFailedErr
+	}
+	r.metrics.Increment("ping.loopback.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// record appends a wake, discarding the oldest if the log is full.
+func (r *LoopbackPing) record(wake LoopbackWake) {
+	r.wakesLock.Lock()
+	defer r.wakesLock.Unlock()
+	if len(r.wakes) >= r.maxWakes {
+		copy(r.wakes, r.wakes[1:])
+		r.wakes = r.wakes[:len(r.wakes)-1]
+	}
+	r.wakes = append(r.wakes, wake)
+}
+
+// Wakes returns the recorded wakes, oldest first.
+func (r *LoopbackPing) Wakes() []LoopbackWake {
+	r.wakesLock.Lock()
+	defer r.wakesLock.Unlock()
+	wakes := make([]LoopbackWake, len(r.wakes))
+	copy(wakes, r.wakes)
+	return wakes
+}
+
+// Reset discards the recorded wakes.
+func (r *LoopbackPing) Reset() {
+	r.wakesLock.Lock()
+	r.wakes = nil
+	r.wakesLock.Unlock()
+}
+
+func (r *LoopbackPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *LoopbackPing) Close() error {
+	return nil
+}
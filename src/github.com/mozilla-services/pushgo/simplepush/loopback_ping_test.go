@@ -0,0 +1,103 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+)
+
+func Test_LoopbackPing(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := new(LoopbackPing)
+	conf := pinger.ConfigStruct().(*LoopbackPingConfig)
+	conf.MaxWakes = 2
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing loopback pinger: %s", err)
+	}
+	defer pinger.Close()
+
+	if err := pinger.Register("uaid0", []byte(`{"result":"maybe"}`)); err != UnsupportedProtocolErr {
+		t.Errorf("Wrong error for unknown result: %v", err)
+	}
+	for uaid, pingData := range map[string]string{
+		"uaid1": `{}`,
+		"uaid2": `{"result":"invalid"}`,
+		"uaid3": `{"result":"throttled"}`,
+	} {
+		if err := pinger.Register(uaid, []byte(pingData)); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	if ok, err := pinger.Send("uaid0", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for unregistered device: ok=%v, err=%v", ok, err)
+	}
+	if ok, err := pinger.Send("uaid1", 1, "hi"); !ok || err != nil {
+		t.Errorf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	if ok, err := pinger.Send("uaid2", 2, ""); ok || err != nil {
+		t.Errorf("Wrong result for invalid device: ok=%v, err=%v", ok, err)
+	}
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Invalid registration not removed: %s", data)
+	}
+	if ok, err := pinger.Send("uaid3", 3, ""); ok || err != loopbackThrottledErr {
+		t.Errorf("Wrong result for throttled device: ok=%v, err=%v", ok, err)
+	}
+
+	// Only the most recent wakes are kept.
+	wakes := pinger.Wakes()
+	if len(wakes) != 2 {
+		t.Fatalf("Wrong wake count: got %d; want 2", len(wakes))
+	}
+	if w := wakes[0]; w.UAID != "uaid2" || w.Version != 2 || w.Result != PingInvalid {
+		t.Errorf("Wrong first wake: %+v", w)
+	}
+	if w := wakes[1]; w.UAID != "uaid3" || w.Result != PingThrottled {
+		t.Errorf("Wrong second wake: %+v", w)
+	}
+	pinger.Reset()
+	if n := len(pinger.Wakes()); n != 0 {
+		t.Errorf("Wakes not reset: got %d", n)
+	}
+}
+
+func Test_PingSimulate(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := NewWebhookPing()
+	conf := pinger.ConfigStruct().(*WebhookPingConfig)
+	conf.Secret = "secret"
+	conf.Hosts = []string{"mdm.example.com"}
+	conf.Simulate = true
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing webhook pinger: %s", err)
+	}
+	defer pinger.Close()
+	pingData := []byte(`{"callback":"https://mdm.example.com/wake","device":"abc"}`)
+	if err := pinger.Register("uaid1", pingData); err != nil {
+		t.Fatalf("Error registering uaid1: %s", err)
+	}
+	// The callback host does not resolve; simulated wakes are not sent.
+	if ok, err := pinger.Send("uaid1", 1, ""); !ok || err != nil {
+		t.Errorf("Error simulating wake: ok=%v, err=%v", ok, err)
+	}
+	mx := app.Metrics().(*TestMetrics)
+	if n := mx.Counters["ping.webhook.simulated"]; n != 1 {
+		t.Errorf("Wrong simulated count: got %d; want 1", n)
+	}
+	if n := mx.Counters["ping.webhook.outcome.accepted"]; n != 0 {
+		t.Errorf("Simulated wake recorded as outcome: got %d", n)
+	}
+}
@@ -0,0 +1,625 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maintenance mode update handling.
+const (
+	// MaintenanceReject rejects updates with a 503 and a Retry-After header.
+	MaintenanceReject = "reject"
+
+	// MaintenanceQueue accepts updates for individual devices with a 202,
+	// writes them to the queue file, and delivers them once maintenance
+	// ends. Updates beyond the queue limit, batches, gRPC updates, and group
+	// updates are rejected.
+	MaintenanceQueue = "queue"
+)
+
+type MaintenanceConfig struct {
+	// Enabled starts the server in maintenance mode.
+	Enabled bool `env:"enabled"`
+
+	// RetryAfter is the longest time clients and app servers are asked to
+	// wait before retrying. Each client is given a random delay of up to
+	// RetryAfter, so that reconnections after maintenance are spread out.
+	// Defaults to 5 minutes.
+	RetryAfter string `toml:"retry_after" env:"retry_after"`
+
+	// Updates is "reject" (the default) or "queue".
+	Updates string `env:"updates"`
+
+	// MaxQueued is the maximum number of updates queued during maintenance.
+	// Defaults to 10000.
+	MaxQueued int `toml:"max_queued" env:"max_queued"`
+
+	// QueuePath is the file that queued updates are written to, so that
+	// they are not lost if the node restarts before maintenance ends.
+	// Required to queue updates.
+	QueuePath string `toml:"queue_path" env:"queue_path"`
+
+	// ReplayRate is the number of queued updates delivered per second once
+	// maintenance ends, so that storage is not flooded as it comes back.
+	// Defaults to 100.
+	ReplayRate float64 `toml:"replay_rate" env:"replay_rate"`
+}
+
+// QueuedUpdate is an update held until maintenance ends.
+type QueuedUpdate struct {
+	UAID      string        `json:"uaid"`
+	ChannelID string        `json:"chid"`
+	Key       string        `json:"pk"`
+	Version   int64         `json:"version"`
+	Data      string        `json:"data,omitempty"`
+	RequestID string        `json:"rid,omitempty"`
+	Priority  RoutePriority `json:"priority"`
+	Bridge    bool          `json:"bridge,omitempty"`
+}
+
+// Maintenance tracks maintenance mode, in which new clients are asked to
+// reconnect later and updates are rejected or queued, so that storage can
+// be taken offline without a thundering herd of reconnections afterward.
+//
+// Queued updates are appended to the queue file. Once maintenance ends, the
+// file is moved aside and replayed at the replay rate. Files left by a node
+// that stopped before or during a replay are replayed once the handlers
+// start, so updates may be delivered more than once, but are not lost.
+type Maintenance struct {
+	logger         *SimpleLogger
+	metrics        Statistician
+	lock           sync.RWMutex
+	enabled        bool
+	since          time.Time
+	retryAfter     time.Duration
+	queue          bool
+	maxQueued      int
+	queuePath      string
+	queueFile      *os.File
+	queued         int
+	replayInterval time.Duration
+	replaying      bool
+	deliver        func(*QueuedUpdate)
+	closeSignal    chan bool
+	isClosed       bool
+}
+
+func NewMaintenance() *Maintenance {
+	return &Maintenance{closeSignal: make(chan bool)}
+}
+
+func (*Maintenance) ConfigStruct() interface{} {
+	return &MaintenanceConfig{
+		RetryAfter: "5m",
+		Updates:    MaintenanceReject,
+		MaxQueued:  10000,
+		ReplayRate: 100,
+	}
+}
+
+func (m *Maintenance) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*MaintenanceConfig)
+	m.logger = app.Logger()
+	m.metrics = app.Metrics()
+	m.maxQueued = conf.MaxQueued
+	m.queuePath = conf.QueuePath
+	if conf.ReplayRate <= 0 {
+		m.logger.Panic("maintenance", "Replay rate must be positive",
+			LogFields{"replayRate": strconv.FormatFloat(conf.ReplayRate, 'g', -1, 64)})
+		return ConfigurationErr
+	}
+	m.replayInterval = time.Duration(float64(time.Second) / conf.ReplayRate)
+	retryAfter, err := time.ParseDuration(conf.RetryAfter)
+	if err != nil {
+		m.logger.Panic("maintenance", "Could not parse retry interval",
+			LogFields{"error": err.Error(), "retryAfter": conf.RetryAfter})
+		return err
+	}
+	if err = m.Configure(retryAfter, conf.Updates); err != nil {
+		m.logger.Panic("maintenance", "Invalid update handling",
+			LogFields{"error": err.Error(), "updates": conf.Updates})
+		return err
+	}
+	if len(m.queuePath) > 0 {
+		// Updates queued before a restart count toward the limit.
+		if queued, err := ioutil.ReadFile(m.queuePath); err == nil {
+			m.queued = bytes.Count(queued, []byte{'\n'})
+		}
+	}
+	if conf.Enabled {
+		m.Enable()
+	}
+	return nil
+}
+
+// Configure sets the retry interval and update handling.
+func (m *Maintenance) Configure(retryAfter time.Duration, updates string) error {
+	if retryAfter < time.Second {
+		return fmt.Errorf("Retry interval must be at least 1 second")
+	}
+	var queue bool
+	switch updates {
+	case MaintenanceReject:
+	case MaintenanceQueue:
+		if len(m.queuePath) == 0 {
+			return fmt.Errorf("Queued updates require a queue path")
+		}
+		queue = true
+	default:
+		return fmt.Errorf("Unknown update handling '%s'", updates)
+	}
+	m.lock.Lock()
+	m.retryAfter = retryAfter
+	m.queue = queue
+	m.lock.Unlock()
+	return nil
+}
+
+// SetDeliver sets the function that delivers queued updates, and replays
+// updates left in the queue files by a previous run, unless maintenance is
+// enabled.
+func (m *Maintenance) SetDeliver(deliver func(*QueuedUpdate)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deliver = deliver
+	if !m.enabled {
+		m.startReplayLocked()
+	}
+}
+
+// Enabled indicates whether the server is in maintenance mode.
+func (m *Maintenance) Enabled() bool {
+	if m == nil {
+		return false
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.enabled
+}
+
+// Enable starts maintenance mode.
+func (m *Maintenance) Enable() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.enabled {
+		return
+	}
+	m.enabled = true
+	m.since = time.Now()
+	m.metrics.Gauge("maintenance.enabled", 1)
+	if m.logger.ShouldLog(NOTICE) {
+		m.logger.Notice("maintenance", "Entered maintenance mode",
+			LogFields{"retryAfter": m.retryAfter.String()})
+	}
+}
+
+// Disable ends maintenance mode, and delivers queued updates in the
+// background.
+func (m *Maintenance) Disable() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.enabled {
+		return
+	}
+	m.enabled = false
+	duration := time.Since(m.since)
+	m.metrics.Gauge("maintenance.enabled", 0)
+	m.metrics.Timer("maintenance.duration", duration)
+	if m.logger.ShouldLog(NOTICE) {
+		m.logger.Notice("maintenance", "Left maintenance mode", LogFields{
+			"duration": duration.String(),
+			"queued":   strconv.Itoa(m.queued)})
+	}
+	m.startReplayLocked()
+}
+
+// replayPath returns the path of the queue file being replayed.
+func (m *Maintenance) replayPath() string {
+	return m.queuePath + ".replay"
+}
+
+// startReplayLocked replays queued updates in the background, unless a
+// replay is already running. The caller must hold the lock.
+func (m *Maintenance) startReplayLocked() {
+	if m.replaying || m.isClosed || m.deliver == nil || len(m.queuePath) == 0 {
+		return
+	}
+	if _, err := os.Stat(m.replayPath()); err != nil && !m.moveQueueLocked() {
+		return
+	}
+	m.replaying = true
+	go m.replay()
+}
+
+// moveQueueLocked closes the queue file and moves it aside for replay.
+// Returns false if there are no queued updates. The caller must hold the
+// lock.
+func (m *Maintenance) moveQueueLocked() bool {
+	if m.queueFile != nil {
+		m.queueFile.Close()
+		m.queueFile = nil
+	}
+	m.queued = 0
+	err := os.Rename(m.queuePath, m.replayPath())
+	if err != nil && !os.IsNotExist(err) && m.logger.ShouldLog(ERROR) {
+		m.logger.Error("maintenance", "Could not move queued updates for replay",
+			LogFields{"error": err.Error(), "path": m.queuePath})
+	}
+	return err == nil
+}
+
+// replay delivers queued updates until none are left, maintenance starts
+// again, or the node shuts down.
+func (m *Maintenance) replay() {
+	for m.replayFile() {
+		m.lock.Lock()
+		if m.enabled || m.isClosed || !m.moveQueueLocked() {
+			m.replaying = false
+			m.lock.Unlock()
+			return
+		}
+		m.lock.Unlock()
+	}
+	m.lock.Lock()
+	m.replaying = false
+	m.lock.Unlock()
+}
+
+// replayFile delivers the updates in the replay file at the replay rate,
+// and removes the file. Returns false if the node shut down first, leaving
+// the file to be replayed on restart.
+func (m *Maintenance) replayFile() bool {
+	path := m.replayPath()
+	file, err := os.Open(path)
+	if err != nil {
+		if m.logger.ShouldLog(ERROR) {
+			m.logger.Error("maintenance", "Could not open queued updates",
+				LogFields{"error": err.Error(), "path": path})
+		}
+		return false
+	}
+	ticker := time.NewTicker(m.replayInterval)
+	defer ticker.Stop()
+	decoder := json.NewDecoder(file)
+	for {
+		update := new(QueuedUpdate)
+		if err = decoder.Decode(update); err != nil {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-m.closeSignal:
+			file.Close()
+			return false
+		}
+		m.deliver(update)
+		m.metrics.Increment("maintenance.updates.replayed")
+	}
+	file.Close()
+	if err != io.EOF && m.logger.ShouldLog(ERROR) {
+		// A write interrupted by a crash leaves a truncated entry.
+		m.logger.Error("maintenance", "Could not read queued update",
+			LogFields{"error": err.Error(), "path": path})
+	}
+	os.Remove(path)
+	return true
+}
+
+// RetryAfter returns a random delay of up to the retry interval, and at
+// least one second, for a client or app server to wait before retrying.
+func (m *Maintenance) RetryAfter() time.Duration {
+	m.lock.RLock()
+	maxSeconds := int64(m.retryAfter / time.Second)
+	m.lock.RUnlock()
+	return time.Duration(1+rand.Int63n(maxSeconds)) * time.Second
+}
+
+// Queue writes an update to the queue file for delivery once maintenance
+// ends. Returns false if updates are rejected, the queue is full, or the
+// update could not be written, or if maintenance ended while the update was
+// being handled; the caller should then reject or deliver the update.
+func (m *Maintenance) Queue(update *QueuedUpdate) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.enabled || !m.queue || m.isClosed || m.queued >= m.maxQueued {
+		return false
+	}
+	entry, err := json.Marshal(update)
+	if err != nil {
+		return false
+	}
+	if m.queueFile == nil {
+		m.queueFile, err = os.OpenFile(m.queuePath,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err == nil {
+		if _, err = m.queueFile.Write(append(entry, '\n')); err == nil {
+			// Only accept updates that will survive a restart.
+			err = m.queueFile.Sync()
+		}
+	}
+	if err != nil {
+		if m.logger.ShouldLog(ERROR) {
+			m.logger.Error("maintenance", "Could not queue update",
+				LogFields{"error": err.Error(), "path": m.queuePath})
+		}
+		m.metrics.Increment("maintenance.updates.error")
+		return false
+	}
+	m.queued++
+	m.metrics.Increment("maintenance.updates.queued")
+	return true
+}
+
+// MaintenanceStatus describes maintenance mode.
+type MaintenanceStatus struct {
+	Enabled    bool      `json:"enabled"`
+	Since      time.Time `json:"since,omitempty"`
+	RetryAfter string    `json:"retryAfter"`
+	Updates    string    `json:"updates"`
+	Queued     int       `json:"queued"`
+	Replaying  bool      `json:"replaying"`
+}
+
+// Status returns the current maintenance mode settings.
+func (m *Maintenance) Status() *MaintenanceStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	status := &MaintenanceStatus{
+		Enabled:    m.enabled,
+		RetryAfter: m.retryAfter.String(),
+		Updates:    MaintenanceReject,
+		Queued:     m.queued,
+		Replaying:  m.replaying,
+	}
+	if m.enabled {
+		status.Since = m.since.UTC()
+	}
+	if m.queue {
+		status.Updates = MaintenanceQueue
+	}
+	return status
+}
+
+// Close stops replaying updates. Queued updates are kept in the queue
+// files, and delivered once the node restarts.
+func (m *Maintenance) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.isClosed {
+		return nil
+	}
+	m.isClosed = true
+	close(m.closeSignal)
+	if m.queueFile != nil {
+		m.queueFile.Close()
+		m.queueFile = nil
+	}
+	if m.queued > 0 && m.logger.ShouldLog(NOTICE) {
+		m.logger.Notice("maintenance", "Kept queued updates for restart",
+			LogFields{"queued": strconv.Itoa(m.queued), "path": m.queuePath})
+	}
+	return nil
+}
+
+// MaintenanceReply is sent in response to a "hello" during maintenance.
+type MaintenanceReply struct {
+	Type       string `json:"messageType"`
+	Status     int    `json:"status"`
+	RetryAfter int64  `json:"retryAfter"`
+}
+
+func maintenanceReply(messageType string, retryAfter time.Duration) MaintenanceReply {
+	return MaintenanceReply{messageType, 503, int64(retryAfter / time.Second)}
+}
+
+// writeMaintenance rejects an update during maintenance.
+func (self *Handler) writeMaintenance(resp http.ResponseWriter, metric string) {
+	retryAfter := self.app.Server().Maintenance().RetryAfter()
+	resp.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter/time.Second), 10))
+	http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+	self.metrics.Increment(metric + ".maintenance")
+}
+
+// deliverQueued delivers an update queued during maintenance. Queued updates
+// are delivered after the app server's request completes, so they are not
+// tied to its span or connection.
+func (self *Handler) deliverQueued(update *QueuedUpdate) {
+	self.deliverUpdate(update.UAID, update.ChannelID, update.Key,
+		update.Version, update.Data, update.RequestID, update.Priority,
+		update.Bridge, SpanContext{}, nil)
+}
+
+// NodeMaintenance is the maintenance status of a single node.
+type NodeMaintenance struct {
+	// Node is the node's routing URL.
+	Node   string             `json:"node"`
+	Status *MaintenanceStatus `json:"status,omitempty"`
+
+	// Error is set if the node could not be reached.
+	Error string `json:"error,omitempty"`
+}
+
+// ClusterMaintenance is the maintenance status of the current node, and of
+// every peer returned by the locator.
+type ClusterMaintenance struct {
+	*MaintenanceStatus
+	Unreachable int                `json:"unreachable"`
+	Nodes       []*NodeMaintenance `json:"nodes,omitempty"`
+}
+
+// PeerMaintenance sends a maintenance request to every peer except local,
+// with the given form values.
+func (r *Router) PeerMaintenance(method string, form url.Values,
+	local string) (nodes []*NodeMaintenance, err error) {
+
+	locator := r.Locator()
+	if locator == nil {
+		return nil, nil
+	}
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		return nil, err
+	}
+	client := r.HTTPClient(r.rwtimeout)
+	body := []byte(form.Encode())
+	nodes = make([]*NodeMaintenance, 0, len(contacts))
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, contact := range contacts {
+		if contact == local {
+			continue
+		}
+		wg.Add(1)
+		go func(contact string) {
+			defer wg.Done()
+			status, err := peerMaintenance(r, client, method, contact, body)
+			node := &NodeMaintenance{Node: contact, Status: status}
+			if err != nil {
+				node.Error = err.Error()
+				r.metrics.Increment("router.maintenance.error")
+			}
+			lock.Lock()
+			nodes = append(nodes, node)
+			lock.Unlock()
+		}(contact)
+	}
+	wg.Wait()
+	return nodes, nil
+}
+
+func peerMaintenance(router *Router, client *http.Client, method, contact string,
+	body []byte) (status *MaintenanceStatus, err error) {
+
+	req, err := router.NewPeerRequest(method, contact+"/maintenance", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected maintenance response: %s", resp.Status)
+	}
+	status = new(MaintenanceStatus)
+	if err = json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// setMaintenance applies a POST request to the local maintenance mode,
+// writing an error response if the request is invalid.
+func (self *Handler) setMaintenance(resp http.ResponseWriter, req *http.Request) bool {
+	maintenance := self.app.Server().Maintenance()
+	enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+	if err != nil {
+		http.Error(resp, "Invalid enabled flag", http.StatusBadRequest)
+		return false
+	}
+	status := maintenance.Status()
+	retryAfter, _ := time.ParseDuration(status.RetryAfter)
+	if value := req.FormValue("retry_after"); len(value) > 0 {
+		if retryAfter, err = time.ParseDuration(value); err != nil {
+			http.Error(resp, "Invalid retry interval", http.StatusBadRequest)
+			return false
+		}
+	}
+	updates := status.Updates
+	if value := req.FormValue("updates"); len(value) > 0 {
+		updates = value
+	}
+	if err = maintenance.Configure(retryAfter, updates); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if !enabled {
+		maintenance.Disable()
+		return true
+	}
+	maintenance.Enable()
+	if disconnect, _ := strconv.ParseBool(req.FormValue("disconnect")); disconnect {
+		go self.app.Server().byeClients(self.app.Clients(), retryAfter, nil)
+	}
+	return true
+}
+
+// MaintenanceHandler reports maintenance mode. POST requests enter or
+// leave maintenance mode according to the `enabled` form field ("true" or
+// "false"), and optionally change the `retry_after` duration and `updates`
+// handling ("reject" or "queue"). If `disconnect` is "true", connected
+// clients are also asked to reconnect after a random delay. Requests are
+// forwarded to every peer returned by the locator, since storage
+// maintenance affects the whole cluster; peers that could not be reached
+// are listed with an error, and should be retried.
+func (self *Handler) MaintenanceHandler(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if !self.setMaintenance(resp, req) {
+			return
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	reply := &ClusterMaintenance{
+		MaintenanceStatus: self.app.Server().Maintenance().Status(),
+	}
+	if self.router != nil {
+		nodes, err := self.router.PeerMaintenance(req.Method, req.Form,
+			self.nodeConnections().Node)
+		if err != nil {
+			if self.logger.ShouldLog(ERROR) {
+				self.logger.Error("handler", "Could not list cluster nodes",
+					LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
+			}
+			http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		for _, node := range nodes {
+			if len(node.Error) > 0 {
+				reply.Unreachable++
+			}
+		}
+		reply.Nodes = nodes
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// NodeMaintenanceHandler reports or changes the maintenance mode of this
+// node only. Peers forward admin maintenance requests to it.
+func (self *Handler) NodeMaintenanceHandler(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if !self.setMaintenance(resp, req) {
+			return
+		}
+	default:
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.app.Server().Maintenance().Status())
+}
@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	_, app := newTestHandler(t)
+	dir, err := ioutil.TempDir("", "pushgo-maintenance")
+	if err != nil {
+		t.Fatalf("Error creating queue directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	maintenance := NewMaintenance()
+	conf := maintenance.ConfigStruct().(*MaintenanceConfig)
+	conf.RetryAfter = "10s"
+	conf.Updates = MaintenanceQueue
+	conf.MaxQueued = 3
+	conf.ReplayRate = 1000
+	if err := maintenance.Init(app, conf); err == nil {
+		t.Errorf("Queued updates accepted without a queue path")
+	}
+	conf.QueuePath = filepath.Join(dir, "queue")
+	maintenance = NewMaintenance()
+	if err := maintenance.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing maintenance: %s", err)
+	}
+	delivered := make(chan *QueuedUpdate, 2)
+	maintenance.SetDeliver(func(update *QueuedUpdate) { delivered <- update })
+	if maintenance.Enabled() {
+		t.Errorf("Maintenance enabled by default")
+	}
+	if maintenance.Queue(&QueuedUpdate{UAID: "uaid", Version: 1}) {
+		t.Errorf("Update queued outside maintenance")
+	}
+
+	maintenance.Enable()
+	for i := 0; i < 100; i++ {
+		if d := maintenance.RetryAfter(); d < time.Second || d > 10*time.Second {
+			t.Fatalf("Wrong retry interval: got %s; want 1s..10s", d)
+		}
+	}
+	if !maintenance.Queue(&QueuedUpdate{UAID: "uaid", Version: 1}) {
+		t.Fatalf("Update not queued")
+	}
+	if status := maintenance.Status(); !status.Enabled || status.Queued != 1 {
+		t.Errorf("Wrong status: %#v", status)
+	}
+
+	// Queued updates survive a restart, count toward the limit, and are
+	// delivered once maintenance ends.
+	maintenance.Close()
+	maintenance = NewMaintenance()
+	conf.Enabled = true
+	if err := maintenance.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing maintenance: %s", err)
+	}
+	defer maintenance.Close()
+	maintenance.SetDeliver(func(update *QueuedUpdate) { delivered <- update })
+	if !maintenance.Queue(&QueuedUpdate{UAID: "uaid", Version: 2}) {
+		t.Fatalf("Update not queued after restart")
+	}
+	if !maintenance.Queue(&QueuedUpdate{UAID: "uaid", Version: 3}) {
+		t.Fatalf("Update not queued after restart")
+	}
+	if maintenance.Queue(&QueuedUpdate{UAID: "uaid", Version: 4}) {
+		t.Errorf("Queue limit exceeded")
+	}
+	maintenance.Disable()
+	for version := int64(1); version <= 3; version++ {
+		select {
+		case update := <-delivered:
+			if update.UAID != "uaid" || update.Version != version {
+				t.Errorf("Wrong queued update: got %#v; want version %d",
+					update, version)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Queued update %d not delivered", version)
+		}
+	}
+	if err := maintenance.Configure(time.Second, "drop"); err == nil {
+		t.Errorf("Unknown update handling accepted")
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	handler, app := newTestHandler(t)
+	form := url.Values{"enabled": {"true"}, "retry_after": {"30s"}}
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/maintenance",
+		strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.MaintenanceHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Wrong status: got %d; want %d", resp.Code, http.StatusOK)
+	}
+	maintenance := app.Server().Maintenance()
+	defer maintenance.Disable()
+	if !maintenance.Enabled() {
+		t.Fatalf("Maintenance not enabled")
+	}
+
+	// Updates are rejected with a retry hint.
+	resp = httptest.NewRecorder()
+	handler.writeMaintenance(resp, "updates.appserver")
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: got %d; want %d", resp.Code,
+			http.StatusServiceUnavailable)
+	}
+	seconds, _ := strconv.Atoi(resp.Header().Get("Retry-After"))
+	if seconds < 1 || seconds > 30 {
+		t.Errorf("Wrong Retry-After: %q", resp.Header().Get("Retry-After"))
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/maintenance?enabled=maybe", nil)
+	handler.MaintenanceHandler(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Invalid flag accepted: got %d", resp.Code)
+	}
+}
+
+func TestMaintenanceReply(t *testing.T) {
+	var reply string
+	writeJSON(maintenanceReply("hello", 90*time.Second), func(data []byte) error {
+		reply = string(data)
+		return nil
+	})
+	if reply != `{"messageType":"hello","status":503,"retryAfter":90}` {
+		t.Errorf("Wrong maintenance reply: %s", reply)
+	}
+}
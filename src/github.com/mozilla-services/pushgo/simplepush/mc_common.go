@@ -6,6 +6,8 @@ package simplepush
 
 import (
 	"encoding/base64"
+
+	"github.com/mozilla-services/pushgo/id"
 )
 
 // ChannelState represents the state of a channel record.
@@ -110,3 +112,163 @@ func encodeKey(key []byte) string {
 	// return string(key)
 	return base64.StdEncoding.EncodeToString(key)
 }
+
+// mcRecords is implemented by the memcached adapters, and provides the
+// record operations used for batch registration.
+type mcRecords interface {
+	IDsToKey(uaid, chid string) (string, bool)
+	storeAppIDArray(uaid string, chids ChannelIDs) error
+	fetchRec(pk string) (*ChannelRecord, error)
+	storeRec(pk string, rec *ChannelRecord) error
+	dropRec(pk string) error
+}
+
+// validBatch checks the device and channel IDs for a batch operation.
+func validBatch(uaid string, chids []string) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chids) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	for _, chid := range chids {
+		if !id.Valid(chid) {
+			return ErrInvalidChannel
+		}
+	}
+	return nil
+}
+
+// savedRecord is a channel record as it was before a batch operation
+// changed it. rec is nil if the record did not exist.
+type savedRecord struct {
+	key string
+	rec *ChannelRecord
+}
+
+// saveRecord fetches the current record for key, so that it can be
+// restored if a batch operation fails.
+func saveRecord(s mcRecords, key string) (savedRecord, error) {
+	rec, err := s.fetchRec(key)
+	if err != nil {
+		return savedRecord{}, err
+	}
+	if rec.LastTouched == 0 {
+		// fetchRec returns an empty record for missing channels.
+		rec = nil
+	}
+	return savedRecord{key, rec}, nil
+}
+
+// restoreRecords puts back the records changed by a failed batch operation.
+// memcached has no transactions, so a restore can itself fail; failures are
+// logged, and the remaining records are still restored.
+func restoreRecords(s mcRecords, logger *SimpleLogger, name string,
+	saved []savedRecord) {
+
+	for _, prev := range saved {
+		var err error
+		if prev.rec == nil {
+			err = s.dropRec(prev.key)
+		} else {
+			err = s.storeRec(prev.key, prev.rec)
+		}
+		if err != nil && logger.ShouldLog(ERROR) {
+			logger.Error(name, "Could not restore channel record",
+				LogFields{"pk": prev.key, "error": err.Error()})
+		}
+	}
+}
+
+// registerMany writes the channel records for a batch registration, then
+// adds the channels to the subscription list. If any write fails, the
+// records are restored to their previous contents, and the subscription
+// list is left unchanged.
+func registerMany(s mcRecords, logger *SimpleLogger, name string, uaid string,
+	existing ChannelIDs, chids []string, version int64) (err error) {
+
+	saved := make([]savedRecord, 0, len(chids))
+	defer func() {
+		if err != nil {
+			restoreRecords(s, logger, name, saved)
+		}
+	}()
+	for _, chid := range chids {
+		key, ok := s.IDsToKey(uaid, chid)
+		if !ok {
+			return ErrInvalidKey
+		}
+		prev, err := saveRecord(s, key)
+		if err != nil {
+			return err
+		}
+		rec := &ChannelRecord{State: StateRegistered}
+		if version != 0 {
+			rec.State = StateLive
+			rec.Version = uint64(version)
+		}
+		if err = s.storeRec(key, rec); err != nil {
+			return err
+		}
+		saved = append(saved, prev)
+	}
+	updated := make(ChannelIDs, len(existing), len(existing)+len(chids))
+	copy(updated, existing)
+	return s.storeAppIDArray(uaid, append(updated, chids...))
+}
+
+// unregisterMany removes the channels from the subscription list, then
+// marks their records as deleted. Fails without changes if any channel is
+// not registered. If a record cannot be updated, the subscription list and
+// the records already marked are restored.
+func unregisterMany(s mcRecords, logger *SimpleLogger, name string, uaid string,
+	existing ChannelIDs, chids []string) (err error) {
+
+	remaining := make(ChannelIDs, len(existing))
+	copy(remaining, existing)
+	saved := make([]savedRecord, 0, len(chids))
+	for _, chid := range chids {
+		pos := remaining.IndexOf(chid)
+		if pos < 0 {
+			return ErrNonexistentChannel
+		}
+		remaining = remove(remaining, pos)
+		key, ok := s.IDsToKey(uaid, chid)
+		if !ok {
+			return ErrInvalidKey
+		}
+		prev, err := saveRecord(s, key)
+		if err != nil {
+			return err
+		}
+		saved = append(saved, prev)
+	}
+	if err = s.storeAppIDArray(uaid, remaining); err != nil {
+		return err
+	}
+	for i, prev := range saved {
+		channel := &ChannelRecord{State: StateDeleted}
+		if prev.rec != nil {
+			channel.Version = prev.rec.Version
+		}
+		if err = s.storeRec(prev.key, channel); err != nil {
+			if logger.ShouldLog(ERROR) {
+				logger.Error(name, "Could not delete Channel",
+					LogFields{"pk": prev.key, "error": err.Error()})
+			}
+			restoreRecords(s, logger, name, saved[:i])
+			restored := make(ChannelIDs, len(existing))
+			copy(restored, existing)
+			if err := s.storeAppIDArray(uaid, restored); err != nil &&
+				logger.ShouldLog(ERROR) {
+				logger.Error(name, "Could not restore channel list",
+					LogFields{"uaid": uaid, "error": err.Error()})
+			}
+			return ErrRecordUpdateFailed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var errTestWrite = errors.New("write failed")
+
+// memRecords is an in-memory mcRecords that fails writes on request.
+type memRecords struct {
+	chids     map[string]ChannelIDs
+	recs      map[string]ChannelRecord
+	failList  bool
+	failRecAt int // Fail the nth record write; 0 disables.
+	recWrites int
+}
+
+func newMemRecords() *memRecords {
+	return &memRecords{
+		chids: make(map[string]ChannelIDs),
+		recs:  make(map[string]ChannelRecord),
+	}
+}
+
+func (m *memRecords) IDsToKey(uaid, chid string) (string, bool) {
+	return uaid + "." + chid, true
+}
+
+func (m *memRecords) storeAppIDArray(uaid string, chids ChannelIDs) error {
+	if m.failList {
+		m.failList = false
+		return errTestWrite
+	}
+	m.chids[uaid] = chids
+	return nil
+}
+
+func (m *memRecords) fetchRec(pk string) (*ChannelRecord, error) {
+	rec := m.recs[pk]
+	return &rec, nil
+}
+
+func (m *memRecords) storeRec(pk string, rec *ChannelRecord) error {
+	m.recWrites++
+	if m.recWrites == m.failRecAt {
+		return errTestWrite
+	}
+	if rec.LastTouched == 0 {
+		rec.LastTouched = 1
+	}
+	m.recs[pk] = *rec
+	return nil
+}
+
+func (m *memRecords) dropRec(pk string) error {
+	delete(m.recs, pk)
+	return nil
+}
+
+func TestRegisterManyRollback(t *testing.T) {
+	logger, _ := NewLogger(&TestLogger{DEBUG, t})
+	uaid := "deadbeef000000000000000000000000"
+	existing := ChannelIDs{"aaaa"}
+	prev := ChannelRecord{State: StateLive, Version: 5, LastTouched: 1}
+
+	tests := []struct {
+		name      string
+		failList  bool
+		failRecAt int
+	}{
+		{"list write fails", true, 0},
+		{"record write fails", false, 2},
+	}
+	for _, test := range tests {
+		m := newMemRecords()
+		m.chids[uaid] = existing
+		m.recs[uaid+".aaaa"] = prev
+		m.failList, m.failRecAt = test.failList, test.failRecAt
+		err := registerMany(m, logger, "test", uaid, existing,
+			[]string{"aaaa", "bbbb"}, 0)
+		if err != errTestWrite {
+			t.Errorf("%s: wrong error: got %v; want %v", test.name, err, errTestWrite)
+		}
+		if !reflect.DeepEqual(m.chids[uaid], existing) {
+			t.Errorf("%s: subscription list changed: %#v", test.name, m.chids[uaid])
+		}
+		if rec := m.recs[uaid+".aaaa"]; rec.State != prev.State || rec.Version != prev.Version {
+			t.Errorf("%s: overwritten record not restored: %#v", test.name, rec)
+		}
+		if _, ok := m.recs[uaid+".bbbb"]; ok {
+			t.Errorf("%s: new record not removed", test.name)
+		}
+	}
+}
+
+func TestUnregisterManyRollback(t *testing.T) {
+	logger, _ := NewLogger(&TestLogger{DEBUG, t})
+	uaid := "deadbeef000000000000000000000000"
+	existing := ChannelIDs{"aaaa", "bbbb", "cccc"}
+
+	m := newMemRecords()
+	m.chids[uaid] = existing
+	for _, chid := range existing {
+		m.recs[uaid+"."+chid] = ChannelRecord{State: StateLive, Version: 1, LastTouched: 1}
+	}
+	if err := unregisterMany(m, logger, "test", uaid, existing,
+		[]string{"aaaa", "dddd"}); err != ErrNonexistentChannel {
+		t.Errorf("Wrong error for unknown channel: got %v", err)
+	}
+	if m.recWrites != 0 {
+		t.Errorf("Records written for rejected batch: %d", m.recWrites)
+	}
+
+	m.failRecAt = 2
+	if err := unregisterMany(m, logger, "test", uaid, existing,
+		[]string{"aaaa", "bbbb"}); err != ErrRecordUpdateFailed {
+		t.Errorf("Wrong error for failed record write: got %v", err)
+	}
+	if !reflect.DeepEqual(m.chids[uaid], existing) {
+		t.Errorf("Subscription list not restored: %#v", m.chids[uaid])
+	}
+	for _, chid := range existing {
+		if rec := m.recs[uaid+"."+chid]; rec.State != StateLive {
+			t.Errorf("Record for %s not restored: %#v", chid, rec)
+		}
+	}
+}
@@ -5,28 +5,136 @@
 package simplepush
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+)
+
+var ErrInvalidPercentile = errors.New("Timer percentiles must be in (0, 100]")
+
+// AvailableMetricsSinks lists the metrics sinks that may be configured.
+var AvailableMetricsSinks = []string{"statsd", "prometheus", "log"}
 
-	"github.com/cactus/go-statsd-client/statsd"
+// Timer histograms use exponential buckets, histBucketsPerOctave per
+// doubling of the duration, starting at histMinValue. Percentiles are
+// accurate to within about 9%.
+const (
+	histBucketsPerOctave = 8
+	histOctaves          = 36 // 1µs to about 19 hours.
+	histBuckets          = histBucketsPerOctave*histOctaves + 1
+	histMinValue         = time.Microsecond
 )
 
+// trec is a latency histogram for a timer.
 type trec struct {
-	Count uint64
-	Avg   float64
+	Count   uint64
+	Sum     time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	Buckets [histBuckets]uint64
+}
+
+// histBucket returns the index of the bucket for the given duration.
+// Bucket 0 holds durations shorter than histMinValue.
+func histBucket(d time.Duration) int {
+	if d < histMinValue {
+		return 0
+	}
+	i := int(math.Log2(float64(d)/float64(histMinValue))*histBucketsPerOctave) + 1
+	if i >= histBuckets {
+		return histBuckets - 1
+	}
+	return i
+}
+
+// histUpperBound returns the largest duration held by the given bucket.
+func histUpperBound(i int) time.Duration {
+	return time.Duration(float64(histMinValue) *
+		math.Exp2(float64(i)/histBucketsPerOctave))
+}
+
+func (t *trec) Record(d time.Duration) {
+	if t.Count == 0 || d < t.Min {
+		t.Min = d
+	}
+	if d > t.Max {
+		t.Max = d
+	}
+	t.Count++
+	t.Sum += d
+	t.Buckets[histBucket(d)]++
+}
+
+// Avg returns the mean recorded duration.
+func (t *trec) Avg() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return t.Sum / time.Duration(t.Count)
+}
+
+// Percentile estimates the duration below which the given percentage of
+// recorded durations fall.
+func (t *trec) Percentile(p float64) time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(t.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range t.Buckets {
+		if seen += n; seen >= rank {
+			if i == histBuckets-1 {
+				// The last bucket is unbounded.
+				return t.Max
+			}
+			d := histUpperBound(i)
+			if d < t.Min {
+				return t.Min
+			}
+			if d > t.Max {
+				return t.Max
+			}
+			return d
+		}
+	}
+	return t.Max
 }
 
 type JsMap map[string]interface{}
 
-type timer map[string]trec
+type timer map[string]*trec
 
 type MetricsConfig struct {
 	StoreSnapshots bool   `toml:"store_snapshots" env:"snapshots"`
 	Prefix         string `env:"prefix"`
 	StatsdServer   string `toml:"statsd_server" env:"statsd_host"`
 	StatsdName     string `toml:"statsd_name" env:"statsd_name"`
+
+	// Percentiles lists the timer percentiles included in snapshots.
+	// Defaults to the 50th, 90th, and 99th.
+	Percentiles []float64 `env:"percentiles"`
+
+	// Sinks lists the metrics systems that receive each metric: "statsd",
+	// "prometheus", and "log". Defaults to "log", plus "statsd" if a statsd
+	// server is set.
+	Sinks []string `env:"sinks"`
+
+	// Log configures the "log" sink.
+	Log MetricsLogConfig
+
+	// Prometheus configures the "prometheus" sink, which is scraped from
+	// /metrics/prometheus on the admin listener.
+	Prometheus PrometheusConfig
+
+	// Tracing configures the export of request traces.
+	Tracing TracingConfig
 }
 
 type Statistician interface {
@@ -48,9 +156,12 @@ type Metrics struct {
 	gauge          map[string]int64
 	prefix         string // prefix for
 	logger         *SimpleLogger
-	statsd         *statsd.Client
+	sinks          []MetricsSink
+	prometheus     *PrometheusSink
 	born           time.Time
 	storeSnapshots bool
+	percentiles    []float64
+	tracer         *Tracer
 }
 
 func (m *Metrics) ConfigStruct() interface{} {
@@ -58,6 +169,13 @@ func (m *Metrics) ConfigStruct() interface{} {
 		StoreSnapshots: true,
 		Prefix:         "simplepush",
 		StatsdName:     "undef",
+		Percentiles:    []float64{50, 90, 99},
+		Log:            MetricsLogConfig{Level: "debug"},
+		Prometheus: PrometheusConfig{
+			Buckets: []string{"1ms", "5ms", "10ms", "50ms", "100ms", "500ms",
+				"1s", "5s", "10s"},
+		},
+		Tracing: *NewTracer().ConfigStruct().(*TracingConfig),
 	}
 }
 
@@ -65,18 +183,39 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*MetricsConfig)
 
 	m.logger = app.Logger()
+	m.prefix = conf.Prefix
 
-	if conf.StatsdServer != "" {
-		name := strings.ToLower(conf.StatsdName)
-		if m.statsd, err = statsd.New(conf.StatsdServer, name); err != nil {
-			m.logger.Panic("metrics", "Could not init statsd connection",
-				LogFields{"error": err.Error()})
+	sinks := conf.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"log"}
+		if conf.StatsdServer != "" {
+			sinks = append(sinks, "statsd")
+		}
+	}
+	for _, name := range sinks {
+		sink, err := m.newSink(strings.TrimSpace(name), conf)
+		if err != nil {
+			m.logger.Panic("metrics", "Could not init metrics sink",
+				LogFields{"error": err.Error(), "sink": name})
 			return err
 		}
+		m.sinks = append(m.sinks, sink)
 	}
 
-	m.prefix = conf.Prefix
 	m.born = time.Now()
+	for _, p := range conf.Percentiles {
+		if p <= 0 || p > 100 {
+			m.logger.Panic("metrics", "Invalid timer percentile",
+				LogFields{"percentile": strconv.FormatFloat(p, 'f', -1, 64)})
+			return ErrInvalidPercentile
+		}
+	}
+	m.percentiles = conf.Percentiles
+
+	m.tracer = NewTracer()
+	if err = m.tracer.Init(app, &conf.Tracing, m); err != nil {
+		return err
+	}
 
 	if m.storeSnapshots = conf.StoreSnapshots; m.storeSnapshots {
 		m.counter = make(map[string]int64)
@@ -87,10 +226,67 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+// newSink creates the named metrics sink.
+func (m *Metrics) newSink(name string, conf *MetricsConfig) (MetricsSink, error) {
+	switch name {
+	case "statsd":
+		if conf.StatsdServer == "" {
+			return nil, fmt.Errorf("Missing statsd server")
+		}
+		return NewStatsdSink(conf.StatsdServer, conf.StatsdName)
+
+	case "prometheus":
+		if m.prometheus != nil {
+			return nil, fmt.Errorf("Duplicate metrics sink '%s'", name)
+		}
+		buckets := make([]time.Duration, len(conf.Prometheus.Buckets))
+		for i, bucket := range conf.Prometheus.Buckets {
+			d, err := time.ParseDuration(strings.TrimSpace(bucket))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid histogram bucket '%s': %s", bucket, err)
+			}
+			buckets[i] = d
+		}
+		m.prometheus = NewPrometheusSink(m.prefix, buckets)
+		return m.prometheus, nil
+
+	case "log":
+		level, err := ParseLogLevel(conf.Log.Level)
+		if err != nil {
+			return nil, err
+		}
+		return NewLogMetricsSink(m.logger, level), nil
+	}
+	return nil, fmt.Errorf("Unknown metrics sink '%s'; expected one of %s", name,
+		strings.Join(AvailableMetricsSinks, ", "))
+}
+
+// Tracer returns the request tracer.
+func (m *Metrics) Tracer() *Tracer {
+	return m.tracer
+}
+
+// Prometheus returns the Prometheus sink, or nil if the sink is not
+// configured.
+func (m *Metrics) Prometheus() *PrometheusSink {
+	return m.prometheus
+}
+
+// Close exports pending spans, and closes all metrics sinks.
+func (m *Metrics) Close() (err error) {
+	m.tracer.Close()
+	for _, sink := range m.sinks {
+		if sinkErr := sink.Close(); sinkErr != nil {
+			err = sinkErr
+		}
+	}
+	return err
+}
+
 func (m *Metrics) Prefix(newPrefix string) {
 	m.prefix = strings.TrimRight(newPrefix, ".")
-	if m.statsd != nil {
-		m.statsd.SetPrefix(newPrefix)
+	for _, sink := range m.sinks {
+		sink.SetPrefix(newPrefix)
 	}
 }
 
@@ -109,7 +305,12 @@ func (m *Metrics) Snapshot() map[string]interface{} {
 		oldMetrics[pfx+"counter."+k] = v
 	}
 	for k, v := range m.timer {
-		oldMetrics[pfx+"avg."+k] = v.Avg
+		oldMetrics[pfx+"avg."+k] = durationMillis(v.Avg())
+		oldMetrics[pfx+"max."+k] = durationMillis(v.Max)
+		for _, p := range m.percentiles {
+			name := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+			oldMetrics[pfx+name+"."+k] = durationMillis(v.Percentile(p))
+		}
 	}
 	for k, v := range m.gauge {
 		oldMetrics[pfx+"gauge."+k] = v
@@ -126,19 +327,8 @@ func (m *Metrics) IncrementBy(metric string, count int64) {
 		m.counter[metric] = met
 		m.Unlock()
 	}
-
-	if m.logger.ShouldLog(DEBUG) {
-		m.logger.Debug("metrics", "counter."+metric,
-			LogFields{"delta": strconv.FormatInt(count, 10),
-				"type": "counter"})
-	}
-
-	if statsd := m.statsd; statsd != nil {
-		if count >= 0 {
-			statsd.Inc(metric, count, 1.0)
-		} else {
-			statsd.Dec(metric, count, 1.0)
-		}
+	for _, sink := range m.sinks {
+		sink.IncrementBy(metric, count)
 	}
 }
 
@@ -150,33 +340,24 @@ func (m *Metrics) Decrement(metric string) {
 	m.IncrementBy(metric, -1)
 }
 
-func (m *Metrics) Timer(metric string, duration time.Duration) {
-	// statsd supports millisecond granularity.
-	value := int64(duration / time.Millisecond)
+// durationMillis converts a duration to fractional milliseconds.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
 
+func (m *Metrics) Timer(metric string, duration time.Duration) {
 	if m.storeSnapshots {
 		m.Lock()
-		if t, ok := m.timer[metric]; !ok {
-			m.timer[metric] = trec{
-				Count: 1,
-				Avg:   float64(value),
-			}
-		} else {
-			// calculate running average
-			t.Count = t.Count + 1
-			t.Avg = t.Avg + (float64(value)-t.Avg)/float64(t.Count)
+		t, ok := m.timer[metric]
+		if !ok {
+			t = new(trec)
 			m.timer[metric] = t
 		}
+		t.Record(duration)
 		m.Unlock()
 	}
-
-	if m.logger.ShouldLog(DEBUG) {
-		m.logger.Debug("metrics", "timer."+metric,
-			LogFields{"value": strconv.FormatInt(value, 10),
-				"type": "timer"})
-	}
-	if m.statsd != nil {
-		m.statsd.Timing(metric, value, 1.0)
+	for _, sink := range m.sinks {
+		sink.Timer(metric, duration)
 	}
 }
 
@@ -186,17 +367,8 @@ func (m *Metrics) Gauge(metric string, value int64) {
 		m.gauge[metric] = value
 		m.Unlock()
 	}
-
-	if statsd := m.statsd; statsd != nil {
-		if value >= 0 {
-			statsd.Gauge(metric, value, 1.0)
-			return
-		}
-		// Gauges cannot be set to negative values; sign prefixes indicate deltas.
-		if err := statsd.Gauge(metric, 0, 1.0); err != nil {
-			return
-		}
-		statsd.GaugeDelta(metric, value, 1.0)
+	for _, sink := range m.sinks {
+		sink.Gauge(metric, value)
 	}
 }
 
@@ -207,9 +379,8 @@ func (m *Metrics) GaugeDelta(metric string, delta int64) {
 		m.gauge[metric] = gauge + delta
 		m.Unlock()
 	}
-
-	if m.statsd != nil {
-		m.statsd.GaugeDelta(metric, delta, 1.0)
+	for _, sink := range m.sinks {
+		sink.GaugeDelta(metric, delta)
 	}
 }
 
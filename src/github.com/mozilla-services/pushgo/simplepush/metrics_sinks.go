@@ -0,0 +1,278 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+)
+
+// MetricsSink receives counters, timers, and gauges recorded by Metrics.
+// Metrics fans out to all configured sinks, so that several metrics systems
+// can run side by side during a migration. Sinks must be safe for concurrent
+// use.
+type MetricsSink interface {
+	SetPrefix(prefix string)
+	IncrementBy(metric string, count int64)
+	Timer(metric string, duration time.Duration)
+	Gauge(metric string, value int64)
+	GaugeDelta(metric string, delta int64)
+	Close() error
+}
+
+type MetricsLogConfig struct {
+	// Level is the level at which metrics are logged. Defaults to "debug".
+	Level string `env:"level"`
+}
+
+type PrometheusConfig struct {
+	// Buckets are the upper bounds of timer histograms. Defaults to 1ms,
+	// 5ms, 10ms, 50ms, 100ms, 500ms, 1s, 5s, and 10s.
+	Buckets []string `env:"buckets"`
+}
+
+// StatsdSink sends metrics to a statsd server.
+type StatsdSink struct {
+	client *statsd.Client
+}
+
+func NewStatsdSink(addr, name string) (*StatsdSink, error) {
+	client, err := statsd.New(addr, strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{client}, nil
+}
+
+func (s *StatsdSink) SetPrefix(prefix string) {
+	s.client.SetPrefix(prefix)
+}
+
+func (s *StatsdSink) IncrementBy(metric string, count int64) {
+	if count >= 0 {
+		s.client.Inc(metric, count, 1.0)
+	} else {
+		s.client.Dec(metric, count, 1.0)
+	}
+}
+
+func (s *StatsdSink) Timer(metric string, duration time.Duration) {
+	// Timings are reported in fractional milliseconds, so that statsd can
+	// compute percentiles for sub-millisecond operations.
+	value := strconv.FormatFloat(durationMillis(duration), 'f', 3, 64)
+	s.client.Raw(metric, value+"|ms", 1.0)
+}
+
+func (s *StatsdSink) Gauge(metric string, value int64) {
+	if value >= 0 {
+		s.client.Gauge(metric, value, 1.0)
+		return
+	}
+	// Gauges cannot be set to negative values; sign prefixes indicate deltas.
+	if err := s.client.Gauge(metric, 0, 1.0); err != nil {
+		return
+	}
+	s.client.GaugeDelta(metric, value, 1.0)
+}
+
+func (s *StatsdSink) GaugeDelta(metric string, delta int64) {
+	s.client.GaugeDelta(metric, delta, 1.0)
+}
+
+func (s *StatsdSink) Close() error {
+	return s.client.Close()
+}
+
+// LogMetricsSink writes each metric to the log, for development and for
+// environments without a metrics system.
+type LogMetricsSink struct {
+	logger *SimpleLogger
+	level  LogLevel
+}
+
+func NewLogMetricsSink(logger *SimpleLogger, level LogLevel) *LogMetricsSink {
+	return &LogMetricsSink{logger, level}
+}
+
+func (s *LogMetricsSink) SetPrefix(prefix string) {}
+
+func (s *LogMetricsSink) IncrementBy(metric string, count int64) {
+	if s.logger.ShouldLog(s.level) {
+		s.logger.Log(s.level, "metrics", "counter."+metric,
+			LogFields{"delta": strconv.FormatInt(count, 10), "type": "counter"})
+	}
+}
+
+func (s *LogMetricsSink) Timer(metric string, duration time.Duration) {
+	if s.logger.ShouldLog(s.level) {
+		value := strconv.FormatFloat(durationMillis(duration), 'f', 3, 64)
+		s.logger.Log(s.level, "metrics", "timer."+metric,
+			LogFields{"value": value, "type": "timer"})
+	}
+}
+
+func (s *LogMetricsSink) Gauge(metric string, value int64) {
+	if s.logger.ShouldLog(s.level) {
+		s.logger.Log(s.level, "metrics", "gauge."+metric,
+			LogFields{"value": strconv.FormatInt(value, 10), "type": "gauge"})
+	}
+}
+
+func (s *LogMetricsSink) GaugeDelta(metric string, delta int64) {
+	if s.logger.ShouldLog(s.level) {
+		s.logger.Log(s.level, "metrics", "gauge."+metric,
+			LogFields{"delta": strconv.FormatInt(delta, 10), "type": "gauge"})
+	}
+}
+
+func (s *LogMetricsSink) Close() error { return nil }
+
+// promHistogram is a cumulative timer histogram, in seconds.
+type promHistogram struct {
+	counts []uint64 // One per bucket, plus +Inf.
+	sum    float64
+}
+
+// PrometheusSink keeps metrics in memory for scraping by Prometheus, in
+// the text exposition format. Prometheus counters only increase, so
+// decrements are ignored; values that decrease are recorded as gauges.
+type PrometheusSink struct {
+	lock     sync.Mutex
+	prefix   string
+	buckets  []float64 // Upper bounds, in seconds.
+	counters map[string]int64
+	gauges   map[string]int64
+	timers   map[string]*promHistogram
+}
+
+func NewPrometheusSink(prefix string, buckets []time.Duration) *PrometheusSink {
+	s := &PrometheusSink{
+		prefix:   prefix,
+		buckets:  make([]float64, len(buckets)),
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+		timers:   make(map[string]*promHistogram),
+	}
+	for i, bucket := range buckets {
+		s.buckets[i] = bucket.Seconds()
+	}
+	sort.Float64s(s.buckets)
+	return s
+}
+
+func (s *PrometheusSink) SetPrefix(prefix string) {
+	s.lock.Lock()
+	s.prefix = strings.TrimRight(prefix, ".")
+	s.lock.Unlock()
+}
+
+func (s *PrometheusSink) IncrementBy(metric string, count int64) {
+	if count < 0 {
+		return
+	}
+	s.lock.Lock()
+	s.counters[metric] += count
+	s.lock.Unlock()
+}
+
+func (s *PrometheusSink) Timer(metric string, duration time.Duration) {
+	seconds := duration.Seconds()
+	s.lock.Lock()
+	h, ok := s.timers[metric]
+	if !ok {
+		h = &promHistogram{counts: make([]uint64, len(s.buckets)+1)}
+		s.timers[metric] = h
+	}
+	i := sort.SearchFloat64s(s.buckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	s.lock.Unlock()
+}
+
+func (s *PrometheusSink) Gauge(metric string, value int64) {
+	s.lock.Lock()
+	s.gauges[metric] = value
+	s.lock.Unlock()
+}
+
+func (s *PrometheusSink) GaugeDelta(metric string, delta int64) {
+	s.lock.Lock()
+	s.gauges[metric] += delta
+	s.lock.Unlock()
+}
+
+func (s *PrometheusSink) Close() error { return nil }
+
+// promName converts a dotted metric name to a Prometheus metric name.
+func (s *PrometheusSink) promName(metric string) string {
+	if len(s.prefix) > 0 {
+		metric = s.prefix + "." + metric
+	}
+	name := []byte(metric)
+	for i, b := range name {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_' || b == ':' ||
+			b >= '0' && b <= '9' && i > 0) {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Format returns all metrics in the Prometheus text exposition format.
+func (s *PrometheusSink) Format() []byte {
+	buf := new(bytes.Buffer)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, metric := range sortedKeys(s.counters) {
+		name := s.promName(metric)
+		fmt.Fprintf(buf, "# TYPE %s counter\n%s %d\n", name, name, s.counters[metric])
+	}
+	for _, metric := range sortedKeys(s.gauges) {
+		name := s.promName(metric)
+		fmt.Fprintf(buf, "# TYPE %s gauge\n%s %d\n", name, name, s.gauges[metric])
+	}
+	timers := make([]string, 0, len(s.timers))
+	for metric := range s.timers {
+		timers = append(timers, metric)
+	}
+	sort.Strings(timers)
+	for _, metric := range timers {
+		h, name := s.timers[metric], s.promName(metric)+"_seconds"
+		fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+		var count uint64
+		for i, bound := range s.buckets {
+			count += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name,
+				strconv.FormatFloat(bound, 'g', -1, 64), count)
+		}
+		count += h.counts[len(s.buckets)]
+		fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+			name, count, name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, count)
+	}
+	return buf.Bytes()
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP.
+func (s *PrometheusSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Write(s.Format())
+}
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimerPercentiles(t *testing.T) {
+	rec := new(trec)
+	for i := 1; i <= 1000; i++ {
+		rec.Record(time.Duration(i) * time.Millisecond)
+	}
+	if avg := rec.Avg(); avg != 500500*time.Microsecond {
+		t.Errorf("Wrong average: got %s; want 500.5ms", avg)
+	}
+	for _, test := range []struct {
+		percentile float64
+		expected   time.Duration
+	}{
+		{50, 500 * time.Millisecond},
+		{90, 900 * time.Millisecond},
+		{99, 990 * time.Millisecond},
+		{100, 1000 * time.Millisecond},
+	} {
+		actual := rec.Percentile(test.percentile)
+		if relErr := math.Abs(float64(actual-test.expected)) /
+			float64(test.expected); relErr > 0.1 {
+			t.Errorf("Wrong p%g: got %s; want %s", test.percentile,
+				actual, test.expected)
+		}
+	}
+
+	// Sub-microsecond and very long durations fall into the outer buckets.
+	rec = new(trec)
+	rec.Record(time.Nanosecond)
+	rec.Record(1000 * time.Hour)
+	if p := rec.Percentile(50); p > time.Microsecond {
+		t.Errorf("Wrong p50: got %s; want at most 1µs", p)
+	}
+	if p := rec.Percentile(100); p != 1000*time.Hour {
+		t.Errorf("Wrong p100: got %s; want 1000h", p)
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	_, app := newTestHandler(t)
+	m := new(Metrics)
+	conf := m.ConfigStruct().(*MetricsConfig)
+	conf.Prefix = "test"
+	conf.Percentiles = []float64{50, 99.9}
+	if err := m.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing metrics: %s", err)
+	}
+	defer m.Close()
+	m.Timer("client.hello", 250*time.Microsecond)
+	m.Timer("client.hello", 750*time.Microsecond)
+
+	snapshot := m.Snapshot()
+	if avg := snapshot["test.avg.client.hello"]; avg != 0.5 {
+		t.Errorf("Wrong average: got %v; want 0.5", avg)
+	}
+	if max := snapshot["test.max.client.hello"]; max != 0.75 {
+		t.Errorf("Wrong maximum: got %v; want 0.75", max)
+	}
+	for _, name := range []string{"test.p50.client.hello", "test.p99.9.client.hello"} {
+		if _, ok := snapshot[name].(float64); !ok {
+			t.Errorf("Missing percentile %q in snapshot: %#v", name, snapshot)
+		}
+	}
+
+	conf.Percentiles = []float64{0}
+	if err := new(Metrics).Init(app, conf); err != ErrInvalidPercentile {
+		t.Errorf("Expected invalid percentile error; got %v", err)
+	}
+}
+
+func TestMetricsSinks(t *testing.T) {
+	_, app := newTestHandler(t)
+	m := new(Metrics)
+	conf := m.ConfigStruct().(*MetricsConfig)
+	conf.Prefix = "push"
+	conf.Sinks = []string{"prometheus", "log"}
+	conf.Prometheus.Buckets = []string{"10ms", "1ms"}
+	if err := m.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing metrics: %s", err)
+	}
+	defer m.Close()
+	if len(m.sinks) != 2 || m.Prometheus() == nil {
+		t.Fatalf("Wrong sinks: %#v", m.sinks)
+	}
+	m.IncrementBy("client.connect", 2)
+	m.Decrement("client.connect")
+	m.Gauge("client.socket.connections", 5)
+	m.GaugeDelta("client.socket.connections", -1)
+	m.Timer("client.flush", 500*time.Microsecond)
+	m.Timer("client.flush", 5*time.Millisecond)
+	m.Timer("client.flush", time.Second)
+
+	resp := httptest.NewRecorder()
+	m.Prometheus().ServeHTTP(resp, nil)
+	expected := `# TYPE push_client_connect counter
+push_client_connect 2
+# TYPE push_client_socket_connections gauge
+push_client_socket_connections 4
+# TYPE push_client_flush_seconds histogram
+push_client_flush_seconds_bucket{le="0.001"} 1
+push_client_flush_seconds_bucket{le="0.01"} 2
+push_client_flush_seconds_bucket{le="+Inf"} 3
+push_client_flush_seconds_sum 1.0055
+push_client_flush_seconds_count 3
+`
+	if actual := resp.Body.String(); actual != expected {
+		t.Errorf("Wrong Prometheus output: got %q; want %q", actual, expected)
+	}
+
+	for _, sinks := range [][]string{{"graphite"}, {"statsd"}} {
+		conf.Sinks = sinks
+		if err := new(Metrics).Init(app, conf); err == nil {
+			t.Errorf("Expected error for sinks %q", sinks)
+		}
+	}
+}
@@ -0,0 +1,755 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+// MQTT 3.1.1 bridge for devices that cannot keep a WebSocket open. The
+// client ID is the device ID, and each channel is a topic:
+//
+//	CONNECT                  hello
+//	SUBSCRIBE push/{chid}    register; the endpoint is published to
+//	                         push/{chid}/endpoint
+//	UNSUBSCRIBE push/{chid}  unregister
+//	PUBLISH push/{chid}      notification, sent with the QoS granted for
+//	                         the topic
+//	PUBACK                   ack
+//
+// QoS 1 notifications that are not acknowledged are redelivered when the
+// device reconnects; QoS 0 notifications are dropped once sent. Channels
+// registered in an earlier session use QoS 1. A clean session discards the
+// device's channels on connect and disconnect.
+
+// MQTT control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	mqttAccepted    = 0
+	mqttBadProtocol = 1
+	mqttBadClientID = 2
+)
+
+const (
+	mqttTopicPrefix      = "push/"
+	mqttEndpointSuffix   = "/endpoint"
+	mqttSubscribeFailure = 0x80
+	mqttMaxPacketLen     = 1 << 16
+
+	// mqttMaxPending is the maximum number of unacknowledged QoS 1
+	// notifications per connection. Further updates stay in the store, and
+	// are published as the device acknowledges earlier ones.
+	mqttMaxPending = 256
+)
+
+var (
+	ErrMQTTMalformed  = errors.New("Malformed MQTT packet")
+	ErrMQTTPacketSize = errors.New("MQTT packet exceeds maximum size")
+	ErrMQTTPending    = errors.New("Too many unacknowledged MQTT notifications")
+
+	// errMQTTDisconnect is returned when the client disconnects cleanly.
+	errMQTTDisconnect = errors.New("Client disconnected")
+)
+
+// readMQTTPacket reads a single control packet, returning the fixed header
+// byte and the packet body.
+func readMQTTPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	var length int
+	for i := uint(0); ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, ErrMQTTMalformed
+		}
+	}
+	if length > mqttMaxPacketLen {
+		return 0, nil, ErrMQTTPacketSize
+	}
+	body = make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// writeMQTTPacket writes a control packet with the given fixed header byte.
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := make([]byte, 1, len(body)+5)
+	packet[0] = header
+	length := len(body)
+	for {
+		b := byte(length & 0x7f)
+		if length >>= 7; length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func appendMQTTUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return append(appendMQTTUint16(b, uint16(len(s))), s...)
+}
+
+// mqttReader decodes the fields of a packet body. Decoding errors are
+// sticky, and checked once all fields are read.
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqttReader) more() bool {
+	return r.err == nil && len(r.data) > 0
+}
+
+func (r *mqttReader) byte() (b byte) {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 1 {
+		r.err = ErrMQTTMalformed
+		return 0
+	}
+	b, r.data = r.data[0], r.data[1:]
+	return b
+}
+
+func (r *mqttReader) uint16() (v uint16) {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 2 {
+		r.err = ErrMQTTMalformed
+		return 0
+	}
+	v, r.data = binary.BigEndian.Uint16(r.data), r.data[2:]
+	return v
+}
+
+func (r *mqttReader) string() (s string) {
+	size := int(r.uint16())
+	if r.err != nil {
+		return ""
+	}
+	if len(r.data) < size {
+		r.err = ErrMQTTMalformed
+		return ""
+	}
+	s, r.data = string(r.data[:size]), r.data[size:]
+	return s
+}
+
+// MQTTConnect holds the fields of a CONNECT packet used by the bridge. Wills
+// and credentials are parsed, but ignored.
+type MQTTConnect struct {
+	Protocol     string
+	Level        byte
+	CleanSession bool
+	KeepAlive    time.Duration
+	ClientID     string
+}
+
+func parseMQTTConnect(body []byte) (request *MQTTConnect, err error) {
+	r := &mqttReader{data: body}
+	request = &MQTTConnect{Protocol: r.string(), Level: r.byte()}
+	flags := r.byte()
+	request.CleanSession = flags&0x02 != 0
+	request.KeepAlive = time.Duration(r.uint16()) * time.Second
+	request.ClientID = r.string()
+	if flags&0x04 != 0 {
+		r.string() // Will topic.
+		r.string() // Will message.
+	}
+	if flags&0x80 != 0 {
+		r.string() // User name.
+	}
+	if flags&0x40 != 0 {
+		r.string() // Password.
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return request, nil
+}
+
+// mqttChannelID extracts the channel ID from a channel topic.
+func mqttChannelID(topic string, ids *IDPolicy) (chid string, ok bool) {
+	if !strings.HasPrefix(topic, mqttTopicPrefix) {
+		return "", false
+	}
+	chid = topic[len(mqttTopicPrefix):]
+	return chid, ids.ChannelID(chid) == nil
+}
+
+// MQTTWorker serves a single MQTT client connection.
+type MQTTWorker struct {
+	app          *Application
+	logger       *SimpleLogger
+	metrics      Statistician
+	id           string
+	conn         net.Conn
+	reader       *bufio.Reader
+	helloTimeout time.Duration
+	keepAlive    time.Duration
+	writeLock    sync.Mutex
+	cleanSession bool
+	pendingLock  sync.Mutex
+	pending      map[uint16]Update // Unacknowledged updates by packet ID.
+	deferred     bool              // Updates were held back by the pending limit.
+	granted      map[string]byte   // QoS granted by channel ID.
+	lastPacketID uint16
+	firstFlush   sync.Once
+}
+
+func NewMQTTWorker(app *Application, conn net.Conn, id string) *MQTTWorker {
+	return &MQTTWorker{
+		app:          app,
+		logger:       app.Logger(),
+		metrics:      app.Metrics(),
+		id:           id,
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		helloTimeout: app.clientHelloTimeout,
+		pending:      make(map[uint16]Update),
+		granted:      make(map[string]byte),
+	}
+}
+
+// Run handles packets from the client until the connection is closed.
+func (self *MQTTWorker) Run(sock *PushWS) {
+	self.app.ConnectionOpened()
+	defer self.app.ConnectionClosed()
+
+	startTime := time.Now()
+	err := self.connect(sock)
+	recordCommand(self.metrics, "hello", startTime, err)
+	if err != nil {
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("mqtt", "Client handshake failed",
+				LogFields{"rid": self.id, "error": err.Error()})
+		}
+		return
+	}
+	if self.cleanSession {
+		defer self.endSession(sock)
+	}
+	for {
+		// Clients must send a packet within one and a half keep-alive periods.
+		var deadline time.Time
+		if self.keepAlive > 0 {
+			deadline = time.Now().Add(self.keepAlive * 3 / 2)
+		}
+		self.conn.SetReadDeadline(deadline)
+		header, body, err := readMQTTPacket(self.reader)
+		if err != nil {
+			if err != io.EOF && self.logger.ShouldLog(DEBUG) {
+				self.logger.Debug("mqtt", "Error reading packet",
+					LogFields{"rid": self.id, "error": err.Error()})
+			}
+			return
+		}
+		startTime = time.Now()
+		err = self.handle(sock, header, body)
+		if command := mqttCommand(header); len(command) > 0 {
+			recordCommand(self.metrics, command, startTime, err)
+		}
+		if err != nil {
+			if err != errMQTTDisconnect && self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("mqtt", "Closing client connection", LogFields{
+					"rid":    self.id,
+					"uaid":   sock.UAID(),
+					"packet": strconv.Itoa(int(header >> 4)),
+					"error":  err.Error()})
+			}
+			return
+		}
+	}
+}
+
+// mqttCommand returns the name of the WebSocket command equivalent to a
+// packet, for metrics. Disconnects are not counted as commands.
+func mqttCommand(header byte) string {
+	switch header >> 4 {
+	case mqttSubscribe:
+		return "register"
+	case mqttUnsubscribe:
+		return "unregister"
+	case mqttPuback:
+		return "ack"
+	case mqttPingreq:
+		return "ping"
+	case mqttDisconnect:
+		return ""
+	}
+	return "unknown"
+}
+
+func (self *MQTTWorker) handle(sock *PushWS, header byte, body []byte) error {
+	switch header >> 4 {
+	case mqttSubscribe:
+		return self.subscribe(sock, body)
+	case mqttUnsubscribe:
+		return self.unsubscribe(sock, body)
+	case mqttPuback:
+		return self.ack(sock, body)
+	case mqttPingreq:
+		self.app.Server().Access().Touch(sock.UAID())
+		return self.send(mqttPingresp<<4, nil)
+	case mqttDisconnect:
+		return errMQTTDisconnect
+	case mqttPublish:
+		// Devices receive notifications, but may not publish.
+		return ErrUnknownCommand
+	}
+	return ErrInvalidCommand
+}
+
+// connect performs the CONNECT handshake, registering the client with the
+// server, and flushes any pending notifications.
+func (self *MQTTWorker) connect(sock *PushWS) (err error) {
+	self.conn.SetReadDeadline(time.Now().Add(self.helloTimeout))
+	header, body, err := readMQTTPacket(self.reader)
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttConnect {
+		return ErrInvalidCommand
+	}
+	request, err := parseMQTTConnect(body)
+	if err != nil {
+		return err
+	}
+	if request.Protocol != "MQTT" || request.Level != 4 {
+		self.send(mqttConnack<<4, []byte{0, mqttBadProtocol})
+		self.metrics.Increment("mqtt.connect.rejected")
+		return ErrInvalidParams
+	}
+	uaid := request.ClientID
+	if err = self.app.Server().IDs().DeviceID(uaid); err != nil {
+		self.send(mqttConnack<<4, []byte{0, mqttBadClientID})
+		self.metrics.Increment("mqtt.connect.rejected")
+		return err
+	}
+	if !self.app.Server().Tenants().Owns(sock.Tenant, uaid) {
+		self.send(mqttConnack<<4, []byte{0, mqttBadClientID})
+		self.metrics.Increment("mqtt.connect.rejected")
+		return ErrInvalidID
+	}
+	if client, ok := self.app.GetClient(uaid); ok {
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("mqtt", "UAID collision; disconnecting previous client",
+				LogFields{"rid": self.id, "uaid": uaid})
+		}
+		client.PushWS.Bye(CloseUAIDConflict)
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, client.PushWS)
+	}
+	var sessionPresent byte
+	if request.CleanSession {
+		// Discard the channels from any previous session.
+		if err = sock.Store.DropAll(uaid); err != nil {
+			return err
+		}
+		self.app.Server().Access().Forget(uaid)
+	} else if sock.Store.Exists(uaid) {
+		sessionPresent = 1
+	}
+	sock.SetUAID(uaid)
+	self.keepAlive = request.KeepAlive
+	self.cleanSession = request.CleanSession
+
+	// Hold the write lock until the CONNACK is sent, so that updates for the
+	// newly registered client are not published first.
+	self.writeLock.Lock()
+	self.app.Server().HandleCommand(PushCommand{
+		Command:   HELLO,
+		Arguments: &CommandArgs{Worker: self, UAID: uaid},
+	}, sock)
+	err = writeMQTTPacket(self.conn, mqttConnack<<4, []byte{sessionPresent, mqttAccepted})
+	self.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return self.Flush(sock, 0, "", 0, "")
+}
+
+// endSession discards the channels registered during a clean session,
+// unless the device has since reconnected elsewhere.
+func (self *MQTTWorker) endSession(sock *PushWS) {
+	uaid := sock.UAID()
+	if client, ok := self.app.GetClient(uaid); ok && client.Worker != Worker(self) {
+		return
+	}
+	if err := sock.Store.DropAll(uaid); err != nil && self.logger.ShouldLog(WARNING) {
+		self.logger.Warn("mqtt", "Could not discard clean session",
+			LogFields{"rid": self.id, "uaid": uaid, "error": ErrStr(err)})
+	}
+	self.app.Server().Access().Forget(uaid)
+}
+
+// subscribe registers a channel for each topic, then publishes the push
+// endpoints for the new channels.
+func (self *MQTTWorker) subscribe(sock *PushWS, body []byte) error {
+	uaid := sock.UAID()
+	r := &mqttReader{data: body}
+	packetID := r.uint16()
+	var (
+		topics []string
+		qos    []byte
+	)
+	for r.more() {
+		topics = append(topics, r.string())
+		qos = append(qos, r.byte())
+	}
+	if r.err != nil || len(topics) == 0 {
+		return ErrMQTTMalformed
+	}
+	reply := appendMQTTUint16(make([]byte, 0, 2+len(topics)), packetID)
+	endpoints := make([]string, len(topics))
+	for i, topic := range topics {
+		chid, ok := mqttChannelID(topic, self.app.Server().IDs())
+		if !ok {
+			reply = append(reply, mqttSubscribeFailure)
+			continue
+		}
+		if err := sock.Store.Register(uaid, chid, 0); err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("mqtt", "Register failed, error updating backing store",
+					LogFields{"rid": self.id, "uaid": uaid, "error": ErrStr(err)})
+			}
+			reply = append(reply, mqttSubscribeFailure)
+			continue
+		}
+		status, args := self.app.Server().HandleCommand(PushCommand{
+			Command:   REGIS,
+			Arguments: &CommandArgs{ChannelID: chid},
+		}, sock)
+		if status != 200 || len(args.Endpoint) == 0 {
+			reply = append(reply, mqttSubscribeFailure)
+			continue
+		}
+		endpoints[i] = args.Endpoint
+		// Notifications are published with at most QoS 1.
+		granted := qos[i]
+		if granted > 1 {
+			granted = 1
+		}
+		self.pendingLock.Lock()
+		self.granted[chid] = granted
+		self.pendingLock.Unlock()
+		reply = append(reply, granted)
+		self.metrics.Increment("client.channels.registered")
+		self.app.Events().Publish(&Event{Type: EventChannelRegistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: sock.RemoteAddr()})
+	}
+	if err := self.send(mqttSuback<<4, reply); err != nil {
+		return err
+	}
+	for i, endpoint := range endpoints {
+		if len(endpoint) == 0 {
+			continue
+		}
+		body := appendMQTTString(nil, topics[i]+mqttEndpointSuffix)
+		if err := self.send(mqttPublish<<4, append(body, endpoint...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe unregisters the channel for each topic. Like the WebSocket
+// unregister command, it always succeeds.
+func (self *MQTTWorker) unsubscribe(sock *PushWS, body []byte) error {
+	uaid := sock.UAID()
+	r := &mqttReader{data: body}
+	packetID := r.uint16()
+	var topics []string
+	for r.more() {
+		topics = append(topics, r.string())
+	}
+	if r.err != nil || len(topics) == 0 {
+		return ErrMQTTMalformed
+	}
+	for _, topic := range topics {
+		chid, ok := mqttChannelID(topic, self.app.Server().IDs())
+		if !ok {
+			continue
+		}
+		self.pendingLock.Lock()
+		delete(self.granted, chid)
+		self.pendingLock.Unlock()
+		if err := sock.Store.Unregister(uaid, chid); err != nil &&
+			self.logger.ShouldLog(WARNING) {
+
+			self.logger.Warn("mqtt", "Unregister failed, error updating backing store",
+				LogFields{"rid": self.id, "uaid": uaid, "error": ErrStr(err)})
+		}
+		self.metrics.Increment("client.channels.unregistered")
+		self.app.Events().Publish(&Event{Type: EventChannelUnregistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: sock.RemoteAddr()})
+	}
+	return self.send(mqttUnsuback<<4, appendMQTTUint16(nil, packetID))
+}
+
+// ack drops the update acknowledged by a PUBACK.
+func (self *MQTTWorker) ack(sock *PushWS, body []byte) error {
+	uaid := sock.UAID()
+	r := &mqttReader{data: body}
+	packetID := r.uint16()
+	if r.err != nil {
+		return ErrMQTTMalformed
+	}
+	self.pendingLock.Lock()
+	update, ok := self.pending[packetID]
+	delete(self.pending, packetID)
+	// Publish held-back updates once half of the window is free.
+	resume := self.deferred && len(self.pending) <= mqttMaxPending/2
+	if resume {
+		self.deferred = false
+	}
+	self.pendingLock.Unlock()
+	if !ok {
+		return nil
+	}
+	self.app.Server().Access().Touch(uaid)
+	if err := sock.Store.Drop(uaid, update.ChannelID); err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("mqtt", "Could not drop acknowledged update",
+				LogFields{"rid": self.id, "uaid": uaid, "error": ErrStr(err)})
+		}
+	} else {
+		self.app.Events().Publish(&Event{Type: EventUpdateAcked, UAID: uaid,
+			ChannelID: update.ChannelID, Version: int64(update.Version)})
+	}
+	if resume {
+		return self.Flush(sock, 0, "", 0, "")
+	}
+	return nil
+}
+
+// Flush publishes pending updates to the client. Expired channels are
+// dropped, since MQTT clients have no way to acknowledge them.
+func (self *MQTTWorker) Flush(sock *PushWS, lastAccessed int64, channel string,
+	version int64, data string) (err error) {
+
+	uaid := sock.UAID()
+	if uaid == "" {
+		return nil
+	}
+	timer := time.Now()
+	defer func() {
+		now := time.Now()
+		self.metrics.Timer("client.flush", now.Sub(timer))
+		self.app.Server().SlowLog().Flush("mqtt", self.id, uaid, sock.Store, now.Sub(timer))
+		self.firstFlush.Do(func() {
+			self.metrics.Timer("client.first_flush", now.Sub(sock.Born))
+		})
+	}()
+	var updates []Update
+	if len(channel) == 0 {
+		var expired []string
+		startTime := time.Now()
+		updates, expired, err = sock.Store.FetchAll(uaid, time.Unix(lastAccessed, 0))
+		self.app.Server().SlowLog().Storage("fetch", self.id, uaid, sock.Store,
+			time.Since(startTime))
+		if err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("mqtt", "Failed to flush Update to client.",
+					LogFields{"rid": self.id, "uaid": uaid, "error": err.Error()})
+			}
+			return err
+		}
+		for _, chid := range expired {
+			if err = sock.Store.Drop(uaid, chid); err != nil {
+				return err
+			}
+			if pk, ok := sock.Store.IDsToKey(uaid, chid); ok {
+				self.app.Server().Receipts().Publish(pk,
+					Receipt{Type: ReceiptExpired})
+			}
+		}
+	} else {
+		updates = []Update{{channel, uint64(version), data}}
+	}
+	for _, update := range updates {
+		if len(channel) == 0 && self.inFlight(update) {
+			continue
+		}
+		if err = self.publish(sock, update); err != nil {
+			if err != ErrMQTTPending {
+				return err
+			}
+			self.metrics.Increment("mqtt.publish.deferred")
+			if len(channel) == 0 {
+				// The remaining updates are published after the next ack.
+				return nil
+			}
+			return err
+		}
+		self.metrics.Increment("updates.sent")
+	}
+	if len(channel) > 0 {
+		self.app.Events().Publish(&Event{
+			Type:      EventUpdateDelivered,
+			UAID:      uaid,
+			ChannelID: channel,
+			Version:   version})
+	}
+	return nil
+}
+
+// publish sends an update to the channel topic with the granted QoS. QoS 0
+// updates are dropped once sent, since the device won't acknowledge them.
+func (self *MQTTWorker) publish(sock *PushWS, update Update) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	body := appendMQTTString(nil, mqttTopicPrefix+update.ChannelID)
+	self.pendingLock.Lock()
+	qos, ok := self.granted[update.ChannelID]
+	self.pendingLock.Unlock()
+	if ok && qos == 0 {
+		if err = self.send(mqttPublish<<4, append(body, payload...)); err != nil {
+			return err
+		}
+		return sock.Store.Drop(sock.UAID(), update.ChannelID)
+	}
+	packetID, err := self.nextPacketID(update)
+	if err != nil {
+		return err
+	}
+	body = appendMQTTUint16(body, packetID)
+	return self.send(mqttPublish<<4|1<<1, append(body, payload...))
+}
+
+// inFlight indicates whether an update was published, but not yet
+// acknowledged.
+func (self *MQTTWorker) inFlight(update Update) bool {
+	self.pendingLock.Lock()
+	defer self.pendingLock.Unlock()
+	for _, pending := range self.pending {
+		if pending == update {
+			return true
+		}
+	}
+	return false
+}
+
+// nextPacketID reserves a packet ID for an unacknowledged update. Returns
+// ErrMQTTPending if the device has too many unacknowledged updates; the
+// remaining updates are published once it catches up.
+func (self *MQTTWorker) nextPacketID(update Update) (uint16, error) {
+	self.pendingLock.Lock()
+	defer self.pendingLock.Unlock()
+	if len(self.pending) >= mqttMaxPending {
+		self.deferred = true
+		return 0, ErrMQTTPending
+	}
+	// The pending limit is well below the number of packet IDs, so a free
+	// ID is found within mqttMaxPending+1 attempts.
+	for {
+		self.lastPacketID++
+		if _, inUse := self.pending[self.lastPacketID]; self.lastPacketID != 0 && !inUse {
+			break
+		}
+	}
+	self.pending[self.lastPacketID] = update
+	return self.lastPacketID, nil
+}
+
+func (self *MQTTWorker) send(header byte, body []byte) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	return writeMQTTPacket(self.conn, header, body)
+}
+
+// ServeMQTT accepts MQTT connections until the listener is closed.
+func (self *Handler) ServeMQTT(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go self.MQTTHandler(conn)
+	}
+}
+
+// MQTTHandler serves a single MQTT connection.
+func (self *Handler) MQTTHandler(conn net.Conn) {
+	requestID, _ := id.Generate()
+	sock := PushWS{Conn: conn,
+		Store:  self.store,
+		Tenant: self.app.Server().Tenants().ForHost(""),
+		Logger: self.logger,
+		Born:   time.Now()}
+
+	if !sock.Tenant.Connect() {
+		conn.Close()
+		self.metrics.Increment("mqtt.tenant.rejected")
+		return
+	}
+	defer sock.Tenant.Disconnect()
+
+	if self.logger.ShouldLog(INFO) {
+		self.logger.Info("handler", "MQTT connection", LogFields{
+			"rid": requestID, "remote": conn.RemoteAddr().String()})
+	}
+	defer func() {
+		now := time.Now()
+		// Clean-up the resources
+		self.app.Server().HandleCommand(PushCommand{DIE, nil}, &sock)
+		self.app.Server().Churn().Lifespan("mqtt", now.Sub(sock.Born))
+		self.metrics.Increment("mqtt.disconnect")
+	}()
+
+	self.metrics.Increment("mqtt.connect")
+	NewMQTTWorker(self.app, conn, requestID).Run(&sock)
+}
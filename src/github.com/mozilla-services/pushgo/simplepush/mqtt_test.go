@@ -0,0 +1,205 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMQTTClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestMQTT(t *testing.T, addr string) *testMQTTClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing MQTT listener: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testMQTTClient{t, conn, bufio.NewReader(conn)}
+}
+
+func (c *testMQTTClient) send(header byte, body []byte) {
+	if err := writeMQTTPacket(c.conn, header, body); err != nil {
+		c.t.Fatalf("Error writing packet: %s", err)
+	}
+}
+
+func (c *testMQTTClient) expect(packetType byte) []byte {
+	header, body, err := readMQTTPacket(c.reader)
+	if err != nil {
+		c.t.Fatalf("Error reading packet %d: %s", packetType, err)
+	}
+	if header>>4 != packetType {
+		c.t.Fatalf("Wrong packet type: got %d; want %d", header>>4, packetType)
+	}
+	return body
+}
+
+func (c *testMQTTClient) connect(clientID string) []byte {
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0x02)
+	body = appendMQTTUint16(body, 60)
+	c.send(mqttConnect<<4, appendMQTTString(body, clientID))
+	return c.expect(mqttConnack)
+}
+
+func TestMQTTPacketRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384} {
+		conn := new(strings.Builder)
+		if err := writeMQTTPacket(conn, mqttPublish<<4, make([]byte, size)); err != nil {
+			t.Fatalf("Error writing %d-byte packet: %s", size, err)
+		}
+		header, body, err := readMQTTPacket(bufio.NewReader(
+			strings.NewReader(conn.String())))
+		if err != nil {
+			t.Fatalf("Error reading %d-byte packet: %s", size, err)
+		}
+		if header != mqttPublish<<4 || len(body) != size {
+			t.Errorf("Wrong packet: got header %x, %d bytes; want %x, %d bytes",
+				header, len(body), mqttPublish<<4, size)
+		}
+	}
+}
+
+func Test_MQTTHandler(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	handler, app := newTestHandler(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting MQTT listener: %s", err)
+	}
+	defer ln.Close()
+	go handler.ServeMQTT(ln)
+
+	// Client IDs must be valid device IDs.
+	client := dialTestMQTT(t, ln.Addr().String())
+	if reply := client.connect("not a device ID!"); reply[1] != mqttBadClientID {
+		t.Errorf("Wrong return code for invalid client ID: got %d; want %d",
+			reply[1], mqttBadClientID)
+	}
+	client.conn.Close()
+
+	client = dialTestMQTT(t, ln.Addr().String())
+	defer client.conn.Close()
+	if reply := client.connect(uaid); reply[1] != mqttAccepted {
+		t.Fatalf("Wrong return code: got %d; want %d", reply[1], mqttAccepted)
+	}
+	if !app.ClientExists(uaid) {
+		t.Fatal("Expected MQTT client to be registered")
+	}
+
+	// Subscribing registers the channel and publishes the endpoint.
+	body := appendMQTTUint16(nil, 1)
+	body = append(appendMQTTString(body, mqttTopicPrefix+chid), 1)
+	body = append(appendMQTTString(body, "other/topic"), 1)
+	client.send(mqttSubscribe<<4|2, body)
+	if reply := client.expect(mqttSuback); string(reply) != "\x00\x01\x01\x80" {
+		t.Errorf("Wrong SUBACK: got %q", reply)
+	}
+	r := &mqttReader{data: client.expect(mqttPublish)}
+	if topic := r.string(); topic != mqttTopicPrefix+chid+mqttEndpointSuffix {
+		t.Errorf("Wrong endpoint topic: %q", topic)
+	}
+	if endpoint := string(r.data); !strings.Contains(endpoint, "/update/") {
+		t.Errorf("Wrong endpoint: %q", endpoint)
+	}
+
+	// Updates are published to the channel topic with QoS 1.
+	mqttClient, _ := app.GetClient(uaid)
+	if err = app.Server().RequestFlush(mqttClient, chid, 5, "Hi", SpanContext{}); err != nil {
+		t.Fatalf("Error flushing update: %s", err)
+	}
+	header, body, err := readMQTTPacket(client.reader)
+	if err != nil || header != mqttPublish<<4|1<<1 {
+		t.Fatalf("Wrong notification packet: %x, %s", header, err)
+	}
+	r = &mqttReader{data: body}
+	if topic := r.string(); topic != mqttTopicPrefix+chid {
+		t.Errorf("Wrong notification topic: %q", topic)
+	}
+	packetID := r.uint16()
+	update := Update{}
+	if err = json.Unmarshal(r.data, &update); err != nil {
+		t.Fatalf("Error decoding notification: %s", err)
+	}
+	if update.ChannelID != chid || update.Version != 5 || update.Data != "Hi" {
+		t.Errorf("Wrong notification: %+v", update)
+	}
+	client.send(mqttPuback<<4, appendMQTTUint16(nil, packetID))
+
+	// QoS 0 subscriptions receive updates without a packet ID.
+	other := "decafbad000000000000000000000001"
+	client.send(mqttSubscribe<<4|2,
+		append(appendMQTTString(appendMQTTUint16(nil, 3), mqttTopicPrefix+other), 0))
+	if reply := client.expect(mqttSuback); string(reply) != "\x00\x03\x00" {
+		t.Errorf("Wrong QoS 0 SUBACK: got %q", reply)
+	}
+	client.expect(mqttPublish)
+	if err = app.Server().RequestFlush(mqttClient, other, 1, "", SpanContext{}); err != nil {
+		t.Fatalf("Error flushing QoS 0 update: %s", err)
+	}
+	header, body, err = readMQTTPacket(client.reader)
+	if err != nil || header != mqttPublish<<4 {
+		t.Fatalf("Wrong QoS 0 notification packet: %x, %s", header, err)
+	}
+	r = &mqttReader{data: body}
+	if topic := r.string(); topic != mqttTopicPrefix+other {
+		t.Errorf("Wrong QoS 0 notification topic: %q", topic)
+	}
+	if err = json.Unmarshal(r.data, &update); err != nil || update.ChannelID != other {
+		t.Errorf("Wrong QoS 0 notification: %+v, %v", update, err)
+	}
+
+	client.send(mqttPingreq<<4, nil)
+	client.expect(mqttPingresp)
+
+	client.send(mqttUnsubscribe<<4|2,
+		appendMQTTString(appendMQTTUint16(nil, 2), mqttTopicPrefix+chid))
+	if reply := client.expect(mqttUnsuback); binary.BigEndian.Uint16(reply) != 2 {
+		t.Errorf("Wrong UNSUBACK packet ID: %x", reply)
+	}
+
+	client.send(mqttDisconnect<<4, nil)
+	for i := 0; i < 100 && app.ClientExists(uaid); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if app.ClientExists(uaid) {
+		t.Error("Expected MQTT client to be removed after disconnect")
+	}
+}
+
+func TestMQTTPendingLimit(t *testing.T) {
+	_, app := newTestHandler(t)
+	worker := NewMQTTWorker(app, nil, "")
+	worker.lastPacketID = 0xfff0
+	seen := make(map[uint16]bool)
+	for i := 0; i < mqttMaxPending; i++ {
+		packetID, err := worker.nextPacketID(Update{Version: uint64(i)})
+		if err != nil {
+			t.Fatalf("Error reserving packet ID %d: %s", i, err)
+		}
+		if packetID == 0 || seen[packetID] {
+			t.Fatalf("Reused packet ID %d", packetID)
+		}
+		seen[packetID] = true
+	}
+	if _, err := worker.nextPacketID(Update{}); err != ErrMQTTPending {
+		t.Errorf("Expected pending limit error; got %v", err)
+	}
+	if !worker.deferred {
+		t.Errorf("Expected held-back updates to be flushed after the next ack")
+	}
+}
@@ -0,0 +1,240 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func init() {
+	AvailablePings["multi"] = func() HasConfigStruct { return new(MultiPing) }
+}
+
+// DevicePinger is implemented by proprietary pingers that select a
+// different backend for each device.
+type DevicePinger interface {
+	PropPinger
+
+	// Backend returns the pinger registered for the device, or nil if the
+	// device did not register with a configured backend.
+	Backend(uaid string) (PropPinger, error)
+}
+
+type MultiPingConfig struct {
+	// Backends lists the pingers that devices may select with the "type"
+	// field of their handshake "connect" data: "gcm", "fcm", "apns", "wns",
+	// "sns", "webhook", "udp", and "loopback".
+	Backends []string `env:"backends"`
+
+	// Default is the backend used for "connect" data without a type. If
+	// empty, untyped data is rejected.
+	Default string `env:"default"`
+
+	// GCM, FCM, APNs, WNS, SNS, Webhook, UDP, and Loopback configure the
+	// corresponding backends.
+	GCM      GCMPingConfig
+	FCM      FCMPingConfig
+	APNs     APNsPingConfig
+	WNS      WNSPingConfig
+	SNS      SNSPingConfig
+	Webhook  WebhookPingConfig
+	UDP      UDPPingConfig
+	Loopback LoopbackPingConfig
+}
+
+// multiPingData is the part of the "connect" data used to select a backend.
+type multiPingData struct {
+	Type string `json:"type"`
+}
+
+// MultiPing lets FCM, APNs, WNS, SNS, GCM, webhook, UDP, and loopback
+// pingers coexist, dispatching each device to the backend named in its
+// "connect" data. The data is stored by the backend, and read again to
+// select the backend for each update.
+type MultiPing struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	store       Store
+	backends    map[string]PropPinger
+	defaultType string
+}
+
+func (*MultiPing) ConfigStruct() interface{} {
+	return &MultiPingConfig{
+		GCM:      *NewGCMPing().ConfigStruct().(*GCMPingConfig),
+		FCM:      *NewFCMPing().ConfigStruct().(*FCMPingConfig),
+		APNs:     *NewAPNsPing().ConfigStruct().(*APNsPingConfig),
+		WNS:      *NewWNSPing().ConfigStruct().(*WNSPingConfig),
+		SNS:      *NewSNSPing().ConfigStruct().(*SNSPingConfig),
+		Webhook:  *NewWebhookPing().ConfigStruct().(*WebhookPingConfig),
+		UDP:      *new(UDPPing).ConfigStruct().(*UDPPingConfig),
+		Loopback: *new(LoopbackPing).ConfigStruct().(*LoopbackPingConfig),
+	}
+}
+
+func (m *MultiPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*MultiPingConfig)
+	m.logger = app.Logger()
+	m.metrics = app.Metrics()
+	m.store = app.Store()
+
+	m.backends = make(map[string]PropPinger, len(conf.Backends))
+	for _, name := range conf.Backends {
+		name = strings.TrimSpace(name)
+		backend, err := m.newBackend(app, name, conf)
+		if err != nil {
+			m.logger.Panic("propping", "Could not init pinger backend",
+				LogFields{"error": err.Error(), "backend": name})
+			m.Close()
+			return err
+		}
+		m.backends[name] = backend
+	}
+	if len(m.backends) == 0 {
+		m.logger.Panic("propping", "No pinger backends configured", nil)
+		return ConfigurationErr
+	}
+	if m.defaultType = conf.Default; len(m.defaultType) > 0 {
+		if _, ok := m.backends[m.defaultType]; !ok {
+			m.logger.Panic("propping", "Default pinger backend not configured",
+				LogFields{"backend": m.defaultType})
+			m.Close()
+			return ConfigurationErr
+		}
+	}
+	return nil
+}
+
+// newBackend creates and initializes the named backend.
+func (m *MultiPing) newBackend(app *Application, name string,
+	conf *MultiPingConfig) (PropPinger, error) {
+
+	if _, ok := m.backends[name]; ok {
+		return nil, fmt.Errorf("Duplicate pinger backend '%s'", name)
+	}
+	var backendConf interface{}
+	switch name {
+	case "gcm":
+		backendConf = &conf.GCM
+	case "fcm":
+		backendConf = &conf.FCM
+	case "apns":
+		backendConf = &conf.APNs
+	case "wns":
+		backendConf = &conf.WNS
+	case "sns":
+		backendConf = &conf.SNS
+	case "webhook":
+		backendConf = &conf.Webhook
+	case "udp":
+		backendConf = &conf.UDP
+	case "loopback":
+		backendConf = &conf.Loopback
+	default:
+		return nil, fmt.Errorf("Unknown pinger backend '%s'; expected one of %s",
+			name, "gcm, fcm, apns, wns, sns, webhook, udp, loopback")
+	}
+	backend := AvailablePings[name]().(PropPinger)
+	if err := backend.Init(app, backendConf); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// backendFor returns the backend selected by the device's "connect" data.
+func (m *MultiPing) backendFor(pingData []byte) (PropPinger, bool) {
+	ping := new(multiPingData)
+	if err := json.Unmarshal(pingData, ping); err != nil {
+		return nil, false
+	}
+	typ := ping.Type
+	if len(typ) == 0 {
+		typ = m.defaultType
+	}
+	backend, ok := m.backends[typ]
+	return backend, ok
+}
+
+// Backend implements DevicePinger.Backend().
+func (m *MultiPing) Backend(uaid string) (PropPinger, error) {
+	pingData, err := m.store.FetchPing(uaid)
+	if err != nil || len(pingData) == 0 {
+		return nil, err
+	}
+	backend, ok := m.backendFor(pingData)
+	if !ok {
+		// The device registered with a backend that is no longer configured.
+		return nil, nil
+	}
+	return backend, nil
+}
+
+// CanBypassWebsocket returns false; the Handler resolves the device's
+// backend before delivering updates.
+func (m *MultiPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// Register passes the device's "connect" data to the selected backend.
+func (m *MultiPing) Register(uaid string, pingData []byte) error {
+	backend, ok := m.backendFor(pingData)
+	if !ok {
+		m.metrics.Increment("ping.multi.unsupported")
+		return UnsupportedProtocolErr
+	}
+	return backend.Register(uaid, pingData)
+}
+
+// Send pings the device via its registered backend. It returns false
+// without an error if the device did not register with a backend.
+func (m *MultiPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	backend, err := m.Backend(uaid)
+	if err != nil || backend == nil {
+		return false, err
+	}
+	return backend.Send(uaid, vers, data)
+}
+
+// SendChannel is like Send, passing the channel ID to backends that use it.
+// Implements ChannelPinger.SendChannel().
+func (m *MultiPing) SendChannel(uaid, chid string, vers int64, data string) (
+	ok bool, err error) {
+
+	backend, err := m.Backend(uaid)
+	if err != nil || backend == nil {
+		return false, err
+	}
+	return SendPing(backend, uaid, chid, vers, data)
+}
+
+// Status reports the first unhealthy backend, in name order.
+func (m *MultiPing) Status() (bool, error) {
+	names := make([]string, 0, len(m.backends))
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ok, err := m.backends[name].Status(); !ok {
+			if err == nil {
+				err = fmt.Errorf("Pinger backend '%s' unhealthy", name)
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *MultiPing) Close() (err error) {
+	for _, backend := range m.backends {
+		if closeErr := backend.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
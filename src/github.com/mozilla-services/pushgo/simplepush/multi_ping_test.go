@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_MultiPingSelectsBackend(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		wakes int
+	)
+	fcm := newTestFCMServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		wakes++
+		lock.Unlock()
+		json.NewEncoder(resp).Encode(map[string]string{
+			"name": "projects/test/messages/1"})
+	})
+	defer fcm.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening for wakeups: %s", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	handler, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	handler.store = store
+	pinger := new(MultiPing)
+	conf := pinger.ConfigStruct().(*MultiPingConfig)
+	conf.Backends = []string{"fcm", "udp"}
+	conf.Default = "fcm"
+	conf.FCM.URL = fcm.URL
+	conf.FCM.Credentials = testFCMCredentials(t, fcm.URL+"/token")
+	conf.UDP.Networks = []string{"001-01=127.0.0.0/8"}
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing pinger: %s", err)
+	}
+	defer pinger.Close()
+	handler.SetPropPinger(pinger)
+
+	fcmUAID := "deadbeef000000000000000000000001"
+	udpUAID := "deadbeef000000000000000000000002"
+	if err := pinger.Register("uaid0", []byte(`{"type":"apns","token":"a"}`)); err != UnsupportedProtocolErr {
+		t.Errorf("Wrong error for unconfigured backend: %v", err)
+	}
+	if err := pinger.Register(fcmUAID, []byte(`{"token":"device"}`)); err != nil {
+		t.Fatalf("Error registering default backend: %s", err)
+	}
+	if err := pinger.Register(udpUAID, []byte(fmt.Sprintf(
+		`{"type":"udp","wakeup_hostport":{"ip":"127.0.0.1","port":%d},"mobilenetwork":{"mcc":"001","mnc":"01"}}`,
+		port))); err != nil {
+		t.Fatalf("Error registering UDP backend: %s", err)
+	}
+	for uaid, expected := range map[string]PropPinger{
+		fcmUAID:                            pinger.backends["fcm"],
+		udpUAID:                            pinger.backends["udp"],
+		"deadbeef000000000000000000000003": nil,
+	} {
+		if backend, err := pinger.Backend(uaid); backend != expected || err != nil {
+			t.Errorf("Wrong backend for %s: got %#v; want %#v", uaid, backend, expected)
+		}
+	}
+
+	chid := "decafbad000000000000000000000000"
+	for _, uaid := range []string{fcmUAID, udpUAID} {
+		pk, _ := handler.store.IDsToKey(uaid, chid)
+		stored, err := handler.deliverUpdate(uaid, chid, pk, 1, "", "test",
+			PriorityNormal, false, SpanContext{}, make(chan bool))
+		if !stored || err != nil {
+			t.Errorf("Wake not accepted for %s: stored=%v, err=%v", uaid, stored, err)
+		}
+	}
+	lock.Lock()
+	if wakes != 1 {
+		t.Errorf("Wrong FCM wake count: got %d; want 1", wakes)
+	}
+	lock.Unlock()
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadFromUDP(buf); err != nil {
+		t.Errorf("Error reading UDP wakeup: %s", err)
+	}
+}
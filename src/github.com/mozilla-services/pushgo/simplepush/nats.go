@@ -0,0 +1,192 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNATSProtocol = errors.New("Malformed NATS message")
+
+// NATSError is an error sent by a NATS server.
+type NATSError string
+
+func (err NATSError) Error() string { return "NATS: " + string(err) }
+
+// natsConnectOptions is the body of the NATS CONNECT command.
+type natsConnectOptions struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+// natsMsg is a message delivered on a subscription.
+type natsMsg struct {
+	Subject string
+	SID     string
+	Reply   string
+	Data    []byte
+}
+
+// natsConn is a minimal NATS client connection. Messages are read by a
+// single goroutine with Next; writes may be issued concurrently.
+type natsConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+}
+
+// dialNATS connects to a NATS server, and waits for the server to
+// acknowledge the connection.
+func dialNATS(addr string, opts natsConnectOptions, timeout time.Duration) (
+	c *natsConn, err error) {
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c = &natsConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = c.handshake(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *natsConn) handshake(opts natsConnectOptions) error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return errNATSProtocol
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	if err = c.write("CONNECT " + string(connect) + "\r\nPING\r\n"); err != nil {
+		return err
+	}
+	for {
+		if line, err = c.readLine(); err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return NATSError(strings.Trim(line[4:], " '"))
+		}
+	}
+}
+
+// Pub publishes a message. reply may be empty.
+func (c *natsConn) Pub(subject, reply string, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if len(reply) > 0 {
+		fmt.Fprintf(c.writer, "PUB %s %s %d\r\n", subject, reply, len(data))
+	} else {
+		fmt.Fprintf(c.writer, "PUB %s %d\r\n", subject, len(data))
+	}
+	c.writer.Write(data)
+	c.writer.WriteString("\r\n")
+	return c.writer.Flush()
+}
+
+// Sub subscribes to a subject. Messages are tagged with sid.
+func (c *natsConn) Sub(subject, sid string) error {
+	return c.write("SUB " + subject + " " + sid + "\r\n")
+}
+
+// Unsub removes the subscription.
+func (c *natsConn) Unsub(sid string) error {
+	return c.write("UNSUB " + sid + "\r\n")
+}
+
+// Next returns the next message, answering server pings.
+func (c *natsConn) Next() (msg *natsMsg, err error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			return c.readMsg(strings.Fields(line[4:]))
+		case line == "PING":
+			if err = c.write("PONG\r\n"); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, NATSError(strings.Trim(line[4:], " '"))
+		}
+		// Ignore PONG, +OK, and INFO updates.
+	}
+}
+
+func (c *natsConn) readMsg(fields []string) (msg *natsMsg, err error) {
+	msg = new(natsMsg)
+	var size string
+	switch len(fields) {
+	case 3:
+		msg.Subject, msg.SID, size = fields[0], fields[1], fields[2]
+	case 4:
+		msg.Subject, msg.SID, msg.Reply, size = fields[0], fields[1], fields[2], fields[3]
+	default:
+		return nil, errNATSProtocol
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return nil, errNATSProtocol
+	}
+	data := make([]byte, n+2)
+	if _, err = io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+	msg.Data = data[:n]
+	return msg, nil
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsConn) write(s string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.writer.WriteString(s)
+	return c.writer.Flush()
+}
+
+func (c *natsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,456 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+var errNATSClosed = errors.New("NATS connection closed")
+
+const (
+	// natsDeliveryWorkers is the number of updates delivered concurrently,
+	// so that a slow device doesn't hold up updates for the others.
+	natsDeliveryWorkers = 16
+
+	// natsEventQueueSize is the number of lifecycle events waiting to be
+	// published. Events are dropped once the queue is full.
+	natsEventQueueSize = 1000
+)
+
+type NATSBrokerConfig struct {
+	// Server is the address of the NATS server. Defaults to
+	// "127.0.0.1:4222".
+	Server string `env:"server"`
+
+	// User and Password, or Token, authenticate with the server, if set.
+	User     string `env:"user"`
+	Password string `env:"password"`
+	Token    string `env:"token"`
+
+	// UpdateSubject is the subject prefix for updates. Updates for a device
+	// are published to the prefix followed by its device ID. Defaults to
+	// "push.update.".
+	UpdateSubject string `toml:"update_subject" env:"update_subject"`
+
+	// EventSubject is the subject prefix for client lifecycle events,
+	// published as "connected" and "disconnected". Defaults to
+	// "push.client.". Set to an empty string to disable events.
+	EventSubject string `toml:"event_subject" env:"event_subject"`
+
+	// AckTimeout is the maximum amount of time to wait for a node to
+	// acknowledge delivery. Unacknowledged updates stay in storage.
+	AckTimeout string `toml:"ack_timeout" env:"ack_timeout"`
+
+	// Timeout is the maximum amount of time to wait for a connection.
+	Timeout string `env:"timeout"`
+
+	// ReconnectDelay is the amount of time to wait before reconnecting.
+	ReconnectDelay string `toml:"reconnect_delay" env:"reconnect_delay"`
+}
+
+// ClientEvent is the body of a lifecycle event published to NATS.
+type ClientEvent struct {
+	UAID string `json:"uaid"`
+	Node string `json:"node"`
+	Time int64  `json:"time"`
+}
+
+// NATSBroker routes updates through NATS subjects named for each device.
+// Each node subscribes to the subjects of its connected devices, and
+// acknowledges delivered updates on the publisher's reply subject. Client
+// connections and disconnections are published as events for other services
+// to consume.
+type NATSBroker struct {
+	logger         *SimpleLogger
+	metrics        Statistician
+	server         string
+	opts           natsConnectOptions
+	node           string
+	updateSubject  string
+	eventSubject   string
+	ackTimeout     time.Duration
+	timeout        time.Duration
+	reconnectDelay time.Duration
+	deliver        func([]byte) bool
+	inbox          string
+
+	lock    sync.Mutex // Guards the fields below.
+	conn    *natsConn
+	subs    map[string]*natsSub // Subscriptions by device ID.
+	lastSID int64
+	lastReq int64
+	pending map[string]chan bool // Acknowledgements by reply subject.
+
+	deliveries chan natsDelivery
+	events     chan natsEvent
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+type natsSub struct {
+	sid   string
+	count int
+}
+
+// natsDelivery is an update waiting for delivery, with the connection used
+// to acknowledge it.
+type natsDelivery struct {
+	conn *natsConn
+	msg  *natsMsg
+}
+
+// natsEvent is a lifecycle event waiting to be published.
+type natsEvent struct {
+	kind  string
+	event *Event
+}
+
+func NewNATSBroker() *NATSBroker {
+	return &NATSBroker{
+		subs:        make(map[string]*natsSub),
+		pending:     make(map[string]chan bool),
+		deliveries:  make(chan natsDelivery),
+		events:      make(chan natsEvent, natsEventQueueSize),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*NATSBroker) ConfigStruct() interface{} {
+	return &NATSBrokerConfig{
+		Server:         "127.0.0.1:4222",
+		UpdateSubject:  "push.update.",
+		EventSubject:   "push.client.",
+		AckTimeout:     "1s",
+		Timeout:        "3s",
+		ReconnectDelay: "1s",
+	}
+}
+
+// Init connects to NATS. Updates received for subscribed devices are passed
+// to deliver, which returns true if the device is connected to this node.
+func (b *NATSBroker) Init(app *Application, config interface{},
+	deliver func([]byte) bool) (err error) {
+
+	conf := config.(*NATSBrokerConfig)
+	b.logger = app.Logger()
+	b.metrics = app.Metrics()
+	b.server = conf.Server
+	b.opts = natsConnectOptions{Name: "pushgo", User: conf.User,
+		Pass: conf.Password, Token: conf.Token}
+	b.node = app.Hostname()
+	b.updateSubject = conf.UpdateSubject
+	b.eventSubject = conf.EventSubject
+	b.deliver = deliver
+
+	if b.ackTimeout, err = time.ParseDuration(conf.AckTimeout); err != nil {
+		b.logger.Panic("nats", "Could not parse ack timeout",
+			LogFields{"error": err.Error(), "timeout": conf.AckTimeout})
+		return err
+	}
+	if b.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		b.logger.Panic("nats", "Could not parse timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	if b.reconnectDelay, err = time.ParseDuration(conf.ReconnectDelay); err != nil {
+		b.logger.Panic("nats", "Could not parse reconnect delay",
+			LogFields{"error": err.Error(), "delay": conf.ReconnectDelay})
+		return err
+	}
+	nodeID, err := id.Generate()
+	if err != nil {
+		return err
+	}
+	b.inbox = "_INBOX." + nodeID
+
+	conn, err := b.connect()
+	if err != nil {
+		b.logger.Panic("nats", "Could not connect to NATS",
+			LogFields{"error": err.Error(), "server": b.server})
+		return err
+	}
+	b.closeWait.Add(1 + natsDeliveryWorkers)
+	go b.receiveLoop(conn)
+	for i := 0; i < natsDeliveryWorkers; i++ {
+		go b.deliverLoop()
+	}
+
+	if len(b.eventSubject) > 0 {
+		// Events are published in order, off the event goroutine.
+		b.closeWait.Add(1)
+		go b.eventLoop()
+		app.Events().Subscribe(EventClientConnected, func(event *Event) {
+			b.queueEvent("connected", event)
+		})
+		app.Events().Subscribe(EventClientDisconnected, func(event *Event) {
+			b.queueEvent("disconnected", event)
+		})
+	}
+	return nil
+}
+
+// connect dials the server, and subscribes to the reply inbox and all
+// device subjects.
+func (b *NATSBroker) connect() (conn *natsConn, err error) {
+	if conn, err = dialNATS(b.server, b.opts, b.timeout); err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err = conn.Sub(b.inbox+".*", "inbox"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for uaid, sub := range b.subs {
+		if err = conn.Sub(b.updateSubject+uaid, sub.sid); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+// Publish implements Broker.Publish. Waits up to the ack timeout for a node
+// to acknowledge delivery.
+func (b *NATSBroker) Publish(uaid string, payload []byte) (received bool, err error) {
+	b.lock.Lock()
+	conn := b.conn
+	b.lastReq++
+	reply := b.inbox + "." + strconv.FormatInt(b.lastReq, 10)
+	ack := make(chan bool, 1)
+	b.pending[reply] = ack
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.pending, reply)
+		b.lock.Unlock()
+	}()
+
+	if conn == nil {
+		b.metrics.Increment("router.nats.error")
+		return false, errNATSClosed
+	}
+	if err = conn.Pub(b.updateSubject+uaid, reply, payload); err != nil {
+		b.metrics.Increment("router.nats.error")
+		return false, err
+	}
+	b.metrics.Increment("router.nats.published")
+	select {
+	case <-ack:
+		return true, nil
+	case <-time.After(b.ackTimeout):
+		b.metrics.Increment("router.nats.unacked")
+		return false, nil
+	case <-b.closeSignal:
+		return false, errNATSClosed
+	}
+}
+
+// Subscribe implements Broker.Subscribe.
+func (b *NATSBroker) Subscribe(uaid string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if sub, ok := b.subs[uaid]; ok {
+		sub.count++
+		return nil
+	}
+	b.lastSID++
+	sub := &natsSub{sid: strconv.FormatInt(b.lastSID, 10), count: 1}
+	b.subs[uaid] = sub
+	if b.conn == nil {
+		// Subscribed on reconnect.
+		return nil
+	}
+	return b.conn.Sub(b.updateSubject+uaid, sub.sid)
+}
+
+// Unsubscribe implements Broker.Unsubscribe.
+func (b *NATSBroker) Unsubscribe(uaid string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sub, ok := b.subs[uaid]
+	if !ok {
+		return nil
+	}
+	if sub.count--; sub.count > 0 {
+		return nil
+	}
+	delete(b.subs, uaid)
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Unsub(sub.sid)
+}
+
+// Status implements Broker.Status.
+func (b *NATSBroker) Status() (bool, error) {
+	b.lock.Lock()
+	connected := b.conn != nil
+	b.lock.Unlock()
+	if !connected {
+		return false, errNATSClosed
+	}
+	return true, nil
+}
+
+// Close implements Broker.Close.
+func (b *NATSBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closeSignal)
+		b.lock.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.lock.Unlock()
+		b.closeWait.Wait()
+	})
+	return nil
+}
+
+// queueEvent queues a client lifecycle event for publishing.
+func (b *NATSBroker) queueEvent(kind string, event *Event) {
+	if len(event.UAID) == 0 {
+		return
+	}
+	select {
+	case b.events <- natsEvent{kind, event}:
+	default:
+		b.metrics.Increment("router.nats.event.dropped")
+	}
+}
+
+// eventLoop publishes queued lifecycle events until the broker is closed.
+func (b *NATSBroker) eventLoop() {
+	defer b.closeWait.Done()
+	for {
+		select {
+		case <-b.closeSignal:
+			return
+		case e := <-b.events:
+			b.publishEvent(e.kind, e.event)
+		}
+	}
+}
+
+// publishEvent publishes a client lifecycle event.
+func (b *NATSBroker) publishEvent(kind string, event *Event) {
+	uaid := event.UAID
+	if len(uaid) == 0 {
+		return
+	}
+	data, err := json.Marshal(&ClientEvent{UAID: uaid, Node: b.node,
+		Time: event.Time.UnixNano()})
+	if err != nil {
+		return
+	}
+	b.lock.Lock()
+	conn := b.conn
+	b.lock.Unlock()
+	if conn == nil {
+		b.metrics.Increment("router.nats.event.dropped")
+		return
+	}
+	if err = conn.Pub(b.eventSubject+kind, "", data); err != nil {
+		if b.logger.ShouldLog(WARNING) {
+			b.logger.Warn("nats", "Could not publish client event", LogFields{
+				"uaid": uaid, "event": kind, "error": err.Error()})
+		}
+		b.metrics.Increment("router.nats.event.dropped")
+		return
+	}
+	b.metrics.Increment("router.nats.event." + kind)
+}
+
+// receiveLoop reads updates and acknowledgements, reconnecting if the
+// connection drops. Updates are handed to the delivery workers, so that
+// acknowledgements for published updates aren't held up behind them.
+func (b *NATSBroker) receiveLoop(conn *natsConn) {
+	defer b.closeWait.Done()
+	for {
+		msg, err := conn.Next()
+		if err != nil {
+			if conn = b.reconnect(err); conn == nil {
+				return
+			}
+			continue
+		}
+		if strings.HasPrefix(msg.Subject, b.inbox+".") {
+			b.lock.Lock()
+			ack, ok := b.pending[msg.Subject]
+			b.lock.Unlock()
+			if ok {
+				select {
+				case ack <- true:
+				default:
+				}
+			}
+			continue
+		}
+		b.metrics.Increment("router.nats.received")
+		select {
+		case b.deliveries <- natsDelivery{conn, msg}:
+		case <-b.closeSignal:
+			return
+		}
+	}
+}
+
+// deliverLoop delivers updates to local devices, and acknowledges them on
+// the publisher's reply subject.
+func (b *NATSBroker) deliverLoop() {
+	defer b.closeWait.Done()
+	for {
+		select {
+		case <-b.closeSignal:
+			return
+		case d := <-b.deliveries:
+			if b.deliver(d.msg.Data) && len(d.msg.Reply) > 0 {
+				d.conn.Pub(d.msg.Reply, "", nil)
+			}
+		}
+	}
+}
+
+// reconnect replaces a dropped connection. Returns nil if the broker is
+// closing.
+func (b *NATSBroker) reconnect(cause error) *natsConn {
+	b.lock.Lock()
+	b.conn = nil
+	b.lock.Unlock()
+	for {
+		select {
+		case <-b.closeSignal:
+			return nil
+		default:
+		}
+		if b.logger.ShouldLog(WARNING) {
+			b.logger.Warn("nats", "Connection dropped; reconnecting",
+				LogFields{"error": cause.Error()})
+		}
+		b.metrics.Increment("router.nats.reconnect")
+		select {
+		case <-b.closeSignal:
+			return nil
+		case <-time.After(b.reconnectDelay):
+		}
+		conn, err := b.connect()
+		if err != nil {
+			cause = err
+			continue
+		}
+		return conn
+	}
+}
@@ -0,0 +1,259 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNATSServer implements the core publish/subscribe subset of the NATS
+// protocol. Wildcards are only supported as a trailing "*" token.
+type testNATSServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	subs     map[*testNATSClient]map[string]string // Subjects by sid.
+}
+
+type testNATSClient struct {
+	conn   net.Conn
+	writer *bufio.Writer
+}
+
+func newTestNATSServer(t *testing.T) *testNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test NATS server: %s", err)
+	}
+	s := &testNATSServer{
+		listener: listener,
+		subs:     make(map[*testNATSClient]map[string]string),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testNATSServer) Addr() string { return s.listener.Addr().String() }
+func (s *testNATSServer) Close()       { s.listener.Close() }
+
+func (s *testNATSServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func natsSubjectMatch(pattern, subject string) bool {
+	if strings.HasSuffix(pattern, ".*") {
+		prefix := pattern[:len(pattern)-1]
+		return strings.HasPrefix(subject, prefix) &&
+			!strings.Contains(subject[len(prefix):], ".")
+	}
+	return pattern == subject
+}
+
+func (s *testNATSServer) handle(conn net.Conn) {
+	c := &testNATSClient{conn: conn, writer: bufio.NewWriter(conn)}
+	reader := bufio.NewReader(conn)
+	s.lock.Lock()
+	s.subs[c] = make(map[string]string)
+	c.writer.WriteString("INFO {\"server_id\":\"test\"}\r\n")
+	c.writer.Flush()
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.subs, c)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var data []byte
+		if fields[0] == "PUB" {
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data = make([]byte, size+2)
+			if _, err = io.ReadFull(reader, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+		s.lock.Lock()
+		switch fields[0] {
+		case "PING":
+			c.writer.WriteString("PONG\r\n")
+		case "SUB":
+			s.subs[c][fields[2]] = fields[1]
+		case "UNSUB":
+			delete(s.subs[c], fields[1])
+		case "PUB":
+			subject, reply := fields[1], ""
+			if len(fields) == 4 {
+				reply = fields[2]
+			}
+			for sub, sids := range s.subs {
+				for sid, pattern := range sids {
+					if !natsSubjectMatch(pattern, subject) {
+						continue
+					}
+					if len(reply) > 0 {
+						fmt.Fprintf(sub.writer, "MSG %s %s %s %d\r\n", subject, sid, reply, len(data))
+					} else {
+						fmt.Fprintf(sub.writer, "MSG %s %s %d\r\n", subject, sid, len(data))
+					}
+					sub.writer.Write(data)
+					sub.writer.WriteString("\r\n")
+					sub.writer.Flush()
+				}
+			}
+		}
+		c.writer.Flush()
+		s.lock.Unlock()
+	}
+}
+
+func TestNATSBroker(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+
+	server := newTestNATSServer(t)
+	defer server.Close()
+	_, app := newTestHandler(t)
+
+	// Watch lifecycle events with a plain client.
+	watcher, err := dialNATS(server.Addr(), natsConnectOptions{}, time.Second)
+	if err != nil {
+		t.Fatalf("Error connecting watcher: %s", err)
+	}
+	defer watcher.Close()
+	if err = watcher.Sub("push.client.*", "1"); err != nil {
+		t.Fatalf("Error subscribing watcher: %s", err)
+	}
+
+	received := make(chan []byte, 10)
+	subscriber := NewNATSBroker()
+	conf := subscriber.ConfigStruct().(*NATSBrokerConfig)
+	conf.Server = server.Addr()
+	conf.AckTimeout = "50ms"
+	if err := subscriber.Init(app, conf, func(m []byte) bool { received <- m; return true }); err != nil {
+		t.Fatalf("Error initializing subscriber: %s", err)
+	}
+	defer subscriber.Close()
+	publisher := NewNATSBroker()
+	if err := publisher.Init(app, conf, func([]byte) bool { return false }); err != nil {
+		t.Fatalf("Error initializing publisher: %s", err)
+	}
+	defer publisher.Close()
+
+	if ok, err := publisher.Status(); !ok {
+		t.Errorf("Expected broker to be healthy: %s", err)
+	}
+	if ok, _ := publisher.Publish(uaid, []byte("early")); ok {
+		t.Errorf("Expected publish without subscribers to be unacknowledged")
+	}
+
+	subscriber.Subscribe(uaid)
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		ok, _ = publisher.Publish(uaid, []byte("hello"))
+	}
+	if !ok {
+		t.Fatalf("Expected publish to be acknowledged")
+	}
+	select {
+	case m := <-received:
+		if string(m) != "hello" {
+			t.Errorf("Wrong message: %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	subscriber.Unsubscribe(uaid)
+	for i := 0; i < 100 && ok; i++ {
+		ok, _ = publisher.Publish(uaid, []byte("gone"))
+	}
+	if ok {
+		t.Errorf("Expected subject to be unsubscribed")
+	}
+
+	// Both brokers publish lifecycle events for connected devices.
+	app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
+	for i := 0; i < 2; i++ {
+		msg, err := watcher.Next()
+		if err != nil {
+			t.Fatalf("Error reading event: %s", err)
+		}
+		if msg.Subject != "push.client.connected" {
+			t.Errorf("Wrong event subject: %q", msg.Subject)
+		}
+		event := new(ClientEvent)
+		if err = json.Unmarshal(msg.Data, event); err != nil {
+			t.Fatalf("Error decoding event: %s", err)
+		}
+		if event.UAID != uaid || event.Node != app.Hostname() {
+			t.Errorf("Wrong event: %#v", event)
+		}
+	}
+}
+
+func TestNATSBrokerSlowDelivery(t *testing.T) {
+	slow := "deadbeef000000000000000000000000"
+	fast := "decafbad000000000000000000000000"
+
+	server := newTestNATSServer(t)
+	defer server.Close()
+	_, app := newTestHandler(t)
+
+	release := make(chan bool)
+	subscriber := NewNATSBroker()
+	conf := subscriber.ConfigStruct().(*NATSBrokerConfig)
+	conf.Server = server.Addr()
+	if err := subscriber.Init(app, conf, func(m []byte) bool {
+		if string(m) == "slow" {
+			<-release
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("Error initializing subscriber: %s", err)
+	}
+	defer subscriber.Close()
+	publisher := NewNATSBroker()
+	if err := publisher.Init(app, conf, func([]byte) bool { return false }); err != nil {
+		t.Fatalf("Error initializing publisher: %s", err)
+	}
+	defer publisher.Close()
+	// Unblock the delivery before closing the subscriber.
+	defer close(release)
+
+	subscriber.Subscribe(slow)
+	subscriber.Subscribe(fast)
+	waitFor(t, "subscriptions", func() bool {
+		ok, _ := publisher.Publish(fast, []byte("ready"))
+		return ok
+	})
+
+	// A blocked delivery doesn't hold up updates for other devices.
+	go publisher.Publish(slow, []byte("slow"))
+	if ok, err := publisher.Publish(fast, []byte("fast")); !ok {
+		t.Errorf("Expected update to be delivered behind a slow device: %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -58,6 +60,22 @@ func ParseRetryAfter(header string) (d time.Duration, ok bool) {
 	return 0, false
 }
 
+// AllowedHTTPSURL indicates whether rawURL is an HTTPS URL on one of the
+// given domains or their subdomains. Domains must be lowercase.
+func AllowedHTTPSURL(rawURL string, domains []string) bool {
+	uri, err := url.Parse(rawURL)
+	if err != nil || uri.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(uri.Hostname())
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // TooBusyError is a temporary error returned when too many simultaneous
 // connections are open. The server will sleep before accepting new
 // connections.
@@ -83,15 +101,82 @@ func (c *LimitConn) Close() error {
 	return err
 }
 
-// LimitListener restricts the number of concurrent connections accepted by the
-// underlying listener, and sets a keep-alive timer on accepted connections.
-// Based on tcpKeepAliveListener from package net/http, copyright 2009,
-// The Go Authors.
+// Listener overflow behaviors.
+const (
+	// OverflowQueue leaves excess connections in the kernel accept queue
+	// until the listener has capacity.
+	OverflowQueue = "queue"
+
+	// OverflowReject accepts and immediately closes excess connections.
+	OverflowReject = "reject"
+)
+
+// acceptLimiter is a token bucket that limits the rate of new connections.
+type acceptLimiter struct {
+	sync.Mutex
+	rate   float64 // Tokens added per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptLimiter(rate, burst int) *acceptLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &acceptLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (a *acceptLimiter) refill(now time.Time) {
+	if a.tokens += now.Sub(a.last).Seconds() * a.rate; a.tokens > a.burst {
+		a.tokens = a.burst
+	}
+	a.last = now
+}
+
+// Reserve takes a token, returning how long the caller must wait before the
+// token is available.
+func (a *acceptLimiter) Reserve(now time.Time) time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	a.refill(now)
+	if a.tokens--; a.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-a.tokens / a.rate * float64(time.Second))
+}
+
+// Allow takes a token if one is available.
+func (a *acceptLimiter) Allow(now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+	a.refill(now)
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// LimitListener restricts the number and rate of connections accepted by the
+// underlying listener, and sets a keep-alive timer on accepted TCP
+// connections. Based on tcpKeepAliveListener from package net/http,
+// copyright 2009, The Go Authors.
 type LimitListener struct {
-	*net.TCPListener
+	net.Listener
 	maxConns        int
 	conns           int32
 	keepAlivePeriod time.Duration
+	limiter         *acceptLimiter // nil if the accept rate is unlimited.
+	reject          bool
+	rejectReply     []byte // Written to rejected connections, if set.
+	metrics         Statistician
+	metricPrefix    string
 }
 
 func (l *LimitListener) addConn()    { atomic.AddInt32(&l.conns, 1) }
@@ -100,64 +185,204 @@ func (l *LimitListener) removeConn() { atomic.AddInt32(&l.conns, -1) }
 // ConnCount returns the number of active connections.
 func (l *LimitListener) ConnCount() int { return int(atomic.LoadInt32(&l.conns)) }
 
-// Accept implements net.Listener.Addr.
+// SetAcceptRate limits the listener to rate new connections per second,
+// allowing bursts of up to burst connections. A rate of 0 removes the limit.
+func (l *LimitListener) SetAcceptRate(rate, burst int) {
+	if rate <= 0 {
+		l.limiter = nil
+		return
+	}
+	l.limiter = newAcceptLimiter(rate, burst)
+}
+
+// SetOverflow sets the overflow behavior. Rejected connections are sent
+// reply, if given, before they are closed.
+func (l *LimitListener) SetOverflow(overflow string, reply []byte) {
+	l.reject = overflow == OverflowReject
+	l.rejectReply = reply
+}
+
+// SetMetrics records rejected and throttled connections under the given
+// listener name.
+func (l *LimitListener) SetMetrics(metrics Statistician, name string) {
+	l.metrics = metrics
+	l.metricPrefix = "listener." + name + "."
+}
+
+func (l *LimitListener) increment(metric string) {
+	if l.metrics != nil {
+		l.metrics.Increment(l.metricPrefix + metric)
+	}
+}
+
+// Accept implements net.Listener.Accept.
 func (l *LimitListener) Accept() (conn net.Conn, err error) {
-	if l.ConnCount() >= l.maxConns {
-		return nil, errTooBusy
+	for {
+		if !l.reject {
+			if l.ConnCount() >= l.maxConns {
+				l.increment("busy")
+				return nil, errTooBusy
+			}
+			if l.limiter != nil {
+				if delay := l.limiter.Reserve(time.Now()); delay > 0 {
+					l.increment("throttled")
+					time.Sleep(delay)
+				}
+			}
+		}
+		socket, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.reject && (l.ConnCount() >= l.maxConns ||
+			l.limiter != nil && !l.limiter.Allow(time.Now())) {
+
+			l.rejectConn(socket)
+			continue
+		}
+		if tcpConn, ok := socket.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(l.keepAlivePeriod)
+		}
+		l.addConn()
+		return &LimitConn{Conn: socket, removeConn: l.removeConn}, nil
+	}
+}
+
+// rejectConn closes a connection that exceeds the listener limits, freeing
+// its file descriptor immediately.
+func (l *LimitListener) rejectConn(socket net.Conn) {
+	if len(l.rejectReply) > 0 {
+		socket.SetWriteDeadline(time.Now().Add(time.Second))
+		socket.Write(l.rejectReply)
 	}
-	socket, err := l.AcceptTCP()
+	socket.Close()
+	l.increment("rejected")
+}
+
+// ServiceUnavailableReply returns a raw HTTP 503 response sent to rejected
+// connections on plaintext HTTP listeners.
+func ServiceUnavailableReply(retryAfter time.Duration) []byte {
+	body := "Too many connections\n"
+	return []byte(fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\n"+
+		"Retry-After: %d\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s",
+		int64(retryAfter/time.Second), len(body), body))
+}
+
+// UnixAddrPrefix marks listener addresses that name a Unix domain socket,
+// e.g., "unix:/var/run/pushgo.sock".
+const UnixAddrPrefix = "unix:"
+
+// DefaultSocketMode is the file mode of Unix domain sockets created by
+// Listen and ListenTLS.
+const DefaultSocketMode os.FileMode = 0660
+
+// IsUnixAddr indicates whether addr names a Unix domain socket.
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixAddrPrefix)
+}
+
+// listenSocket opens a TCP listener, or a Unix domain socket listener if
+// addr begins with "unix:". A stale socket file left behind by a previous
+// process is removed before binding, and the new socket file is removed
+// when the listener is closed. Sockets passed by a process upgrading to this
+// one are reused instead. Addresses beginning with "systemd:" select sockets
+// passed by systemd socket activation.
+func listenSocket(addr string, mode os.FileMode) (net.Listener, error) {
+	ln, err := inheritedListener(addr)
+	if err != nil || ln != nil {
+		return trackListener(addr, ln), err
+	}
+	if IsSystemdAddr(addr) {
+		return nil, fmt.Errorf("No socket '%s' passed by systemd",
+			addr[len(SystemdAddrPrefix):])
+	}
+	if ln, err = bindSocket(addr, mode); err != nil {
+		return nil, err
+	}
+	return trackListener(addr, ln), nil
+}
+
+func bindSocket(addr string, mode os.FileMode) (net.Listener, error) {
+	if !IsUnixAddr(addr) {
+		return net.Listen("tcp", addr)
+	}
+	path := addr[len(UnixAddrPrefix):]
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Missing socket path in '%s'", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Refusing to replace non-socket file '%s'", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
 	if err != nil {
 		return nil, err
 	}
-	socket.SetKeepAlive(true)
-	socket.SetKeepAlivePeriod(l.keepAlivePeriod)
-	l.addConn()
-	return &LimitConn{Conn: socket, removeConn: l.removeConn}, nil
+	if err = os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
 // Listen returns an active HTTP listener. This is identical to ListenAndServe
-// from package net/http, but listens on a random port if addr is omitted, and
-// does not call http.Server.Serve. Copyright 2009, The Go Authors.
+// from package net/http, but listens on a random port if addr is omitted,
+// accepts Unix domain socket addresses, and does not call
+// http.Server.Serve. Copyright 2009, The Go Authors.
 func Listen(addr string, maxConns int, keepAlivePeriod time.Duration) (net.Listener, error) {
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listenMode(addr, DefaultSocketMode, maxConns, keepAlivePeriod)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+func listenMode(addr string, mode os.FileMode, maxConns int,
+	keepAlivePeriod time.Duration) (*LimitListener, error) {
+
+	ln, err := listenSocket(addr, mode)
 	if err != nil {
 		return nil, err
 	}
-	return &LimitListener{ln.(*net.TCPListener), maxConns, 0,
-		keepAlivePeriod}, nil
+	return &LimitListener{
+		Listener:        ln,
+		maxConns:        maxConns,
+		keepAlivePeriod: keepAlivePeriod,
+	}, nil
 }
 
-// ListenTLS returns an active HTTPS listener. Based on ListenAndServeTLS from
-// package net/http, copyright 2009, The Go Authors.
-func ListenTLS(addr, certFile, keyFile string, maxConns int, keepAlivePeriod time.Duration) (net.Listener, error) {
-	ln, err := net.Listen("tcp", addr)
+// ListenTLS returns an active HTTPS listener. nextProtos lists the protocols
+// advertised via ALPN, defaulting to HTTP/1.1. Based on ListenAndServeTLS
+// from package net/http, copyright 2009, The Go Authors.
+func ListenTLS(addr, certFile, keyFile string, maxConns int,
+	keepAlivePeriod time.Duration, nextProtos ...string) (net.Listener, error) {
+
+	certs, err := NewCertStore([]CertPair{{CertFile: certFile, KeyFile: keyFile}})
 	if err != nil {
 		return nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return ListenTLSConfig(addr, NewTLSConfig(certs, nextProtos...), maxConns,
+		keepAlivePeriod)
+}
+
+// ListenTLSConfig returns an active HTTPS listener using the given TLS
+// config.
+func ListenTLSConfig(addr string, config *tls.Config, maxConns int,
+	keepAlivePeriod time.Duration) (net.Listener, error) {
+
+	ln, err := Listen(addr, maxConns, keepAlivePeriod)
 	if err != nil {
 		return nil, err
 	}
-	config := &tls.Config{
-		NextProtos:   []string{"http/1.1"},
-		Certificates: []tls.Certificate{cert},
-		// The following are Mozilla required TLS settings.
-		MinVersion:               tls.VersionTLS10,
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA},
-	}
-	return tls.NewListener(&LimitListener{ln.(*net.TCPListener), maxConns,
-		0, keepAlivePeriod}, config), nil
+	return tls.NewListener(ln, config), nil
 }
 
 // TimeoutDialer returns a dialer function suitable for use with an
@@ -173,3 +398,99 @@ func TimeoutDialer(cTimeout, rwTimeout time.Duration) func(net, addr string) (c
 		return c, nil
 	}
 }
+
+// TrustedProxies lists the networks of the load balancers and proxies in
+// front of the server. Only these hops may set the client address with
+// X-Forwarded-For; otherwise, any client could choose the address used for
+// rate limits and bans.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDR blocks or IP addresses.
+func ParseTrustedProxies(specs []string) (proxies TrustedProxies, err error) {
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if strings.IndexByte(spec, '/') < 0 {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid proxy address: %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Trusts indicates whether addr belongs to a trusted proxy.
+func (p TrustedProxies) Trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the IP address of the client that sent req. Starting
+// with the peer address, X-Forwarded-For entries are followed from right to
+// left while the previous hop is a trusted proxy; the first untrusted hop is
+// the client. Entries left of that hop were supplied by the client.
+func (p TrustedProxies) ClientAddr(req *http.Request) string {
+	return p.AddrChain(req)[0]
+}
+
+// AddrChain returns the verified hops of req, from the client to the peer.
+// Unlike the raw X-Forwarded-For header, the chain only includes entries
+// added by trusted proxies.
+func (p TrustedProxies) AddrChain(req *http.Request) []string {
+	addr := hostOnly(req.RemoteAddr)
+	chain := []string{addr}
+	if !p.Trusts(addr) {
+		return chain
+	}
+	forwardedFor := req.Header[http.CanonicalHeaderKey("X-Forwarded-For")]
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hops := strings.Split(forwardedFor[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := strings.TrimSpace(hops[j])
+			if net.ParseIP(hop) == nil {
+				return chain
+			}
+			chain = append([]string{hop}, chain...)
+			if !p.Trusts(hop) {
+				return chain
+			}
+		}
+	}
+	return chain
+}
+
+// Handler sets the remote address of each request to the client address
+// before calling h, so that handlers can use the remote address without
+// consulting X-Forwarded-For.
+func (p TrustedProxies) Handler(h http.Handler) http.Handler {
+	if len(p) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if addr := p.ClientAddr(req); addr != hostOnly(req.RemoteAddr) {
+			// Shallow copy, since the request belongs to the caller.
+			req = req.WithContext(req.Context())
+			req.RemoteAddr = net.JoinHostPort(addr, "0")
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,228 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-sockets")
+	if err != nil {
+		t.Fatalf("Error creating socket directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pushgo.sock")
+
+	// Leave a stale socket file behind, as a crashed process would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error creating stale socket: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	conf := &ListenerConfig{
+		Addr:            UnixAddrPrefix + path,
+		MaxConns:        10,
+		KeepAlivePeriod: "3m",
+		SocketMode:      "0600",
+	}
+	ln, err := conf.Listen()
+	if err != nil {
+		t.Fatalf("Error listening on Unix socket: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error checking socket file: %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Wrong socket mode: got %o; want %o", mode, 0600)
+	}
+
+	go http.Serve(ln, http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.Write([]byte("ok"))
+	}))
+	transport := &http.Transport{Dial: func(_, _ string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get("http://push/")
+	if err != nil {
+		t.Fatalf("Error sending request over Unix socket: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("Wrong response body: %q", body)
+	}
+
+	ln.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed on close: %v", err)
+	}
+
+	// Regular files are never replaced.
+	if err = ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("Error creating regular file: %s", err)
+	}
+	if _, err = conf.Listen(); err == nil {
+		t.Error("Expected error listening over a regular file")
+	}
+	conf.SocketMode = "999"
+	if _, err = conf.Listen(); err == nil {
+		t.Error("Expected error for invalid socket mode")
+	}
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	limiter := newAcceptLimiter(10, 2)
+	now := limiter.last
+	if !limiter.Allow(now) || !limiter.Allow(now) {
+		t.Fatal("Expected burst connections to be allowed")
+	}
+	if limiter.Allow(now) {
+		t.Error("Expected connection over burst to be refused")
+	}
+	if delay := limiter.Reserve(now); delay != 100*time.Millisecond {
+		t.Errorf("Wrong delay: got %s; want 100ms", delay)
+	}
+	now = now.Add(time.Second)
+	if !limiter.Allow(now) {
+		t.Error("Expected connection to be allowed after refill")
+	}
+}
+
+func TestLimitListenerReject(t *testing.T) {
+	conf := &ListenerConfig{
+		Addr:            "127.0.0.1:0",
+		MaxConns:        1,
+		KeepAlivePeriod: "3m",
+		Overflow:        OverflowReject,
+		RetryAfter:      "30s",
+	}
+	ln, err := conf.Listen()
+	if err != nil {
+		t.Fatalf("Error starting listener: %s", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing listener: %s", err)
+	}
+	defer first.Close()
+	conn := <-accepted
+	defer conn.Close()
+
+	// The listener is full; new connections are rejected with a 503.
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing full listener: %s", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil {
+		t.Fatalf("Error reading rejection: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: got %d; want %d", resp.StatusCode,
+			http.StatusServiceUnavailable)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Wrong Retry-After header: got %q; want 30", retryAfter)
+	}
+
+	conf.Overflow = "drop"
+	if _, err = conf.Listen(); err == nil {
+		t.Error("Expected error for unknown overflow behavior")
+	}
+}
+
+func TestAllowedHTTPSURL(t *testing.T) {
+	domains := []string{"notify.windows.com", "example.org"}
+	for rawURL, allowed := range map[string]bool{
+		"https://notify.windows.com/x":            true,
+		"https://db5.notify.windows.com/?token=1": true,
+		"https://EXAMPLE.org:8443/hook":           true,
+		"http://example.org/hook":                 false,
+		"https://evilnotify.windows.com/x":        false,
+		"https://example.org.evil.com/hook":       false,
+		"https://user@example.com/@example.org/":  false,
+		"not a url":                               false,
+	} {
+		if ok := AllowedHTTPSURL(rawURL, domains); ok != allowed {
+			t.Errorf("Wrong result for %q: got %v; want %v", rawURL, ok, allowed)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Error parsing trusted proxies: %s", err)
+	}
+	if _, err = ParseTrustedProxies([]string{"proxy"}); err == nil {
+		t.Errorf("Invalid proxy address accepted")
+	}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		clientAddr   string
+	}{
+		{"Untrusted peer", "198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"Trusted peer", "10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"Spoofed hops", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.1, 10.0.0.2"}, "203.0.113.1"},
+		{"Multiple headers", "192.0.2.1:1234", []string{"1.2.3.4", "203.0.113.1"}, "203.0.113.1"},
+		{"Invalid hop", "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1"},
+		{"Only proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+	}
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: make(http.Header)}
+		for _, hops := range test.forwardedFor {
+			req.Header.Add("X-Forwarded-For", hops)
+		}
+		if addr := proxies.ClientAddr(req); addr != test.clientAddr {
+			t.Errorf("%s: got %q; want %q", test.name, addr, test.clientAddr)
+		}
+		var handled string
+		proxies.Handler(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			handled = requestRemoteAddr(req)
+		})).ServeHTTP(nil, req)
+		if handled != test.clientAddr {
+			t.Errorf("%s: wrong handler address: got %q; want %q",
+				test.name, handled, test.clientAddr)
+		}
+	}
+
+	// Logged chains omit hops supplied by the client.
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{
+		"X-Forwarded-For": {"1.2.3.4, 203.0.113.1, 10.0.0.2"}}}
+	chain := proxies.AddrChain(req)
+	if strings.Join(chain, ",") != "203.0.113.1,10.0.0.2,10.0.0.1" {
+		t.Errorf("Wrong address chain: got %#v", chain)
+	}
+}
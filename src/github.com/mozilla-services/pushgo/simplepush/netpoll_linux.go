@@ -0,0 +1,276 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io"
+	"sync"
+	"syscall"
+)
+
+// pollEvents are the events watched for client connections. Connections are
+// registered one-shot, so that only one reader handles a connection at a
+// time; readers re-arm the connection once they finish.
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// netPoller reads from client connections once data arrives, with a fixed
+// set of reader goroutines, so that idle connections do not park a goroutine
+// in a blocking read.
+//
+// Events are keyed by a registration ID rather than the file descriptor,
+// since descriptors are reused once connections close. The descriptor
+// itself is only accessed through syscall.RawConn.Control, which holds it
+// open for the duration of the call.
+type netPoller struct {
+	epfd        int
+	wake        [2]int // Pipe that wakes the event loop on close.
+	lock        sync.Mutex
+	sockets     map[int32]*PollSocket // Keyed by registration ID.
+	lastID      int32
+	ready       chan *PollSocket
+	isClosed    bool
+	closeSignal chan bool
+}
+
+func newNetPoller(readers int) (p *netPoller, err error) {
+	p = &netPoller{
+		sockets:     make(map[int32]*PollSocket),
+		ready:       make(chan *PollSocket, readers),
+		closeSignal: make(chan bool),
+	}
+	if p.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	}
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(p.epfd)
+		return nil, err
+	}
+	// The wake pipe is registration 0.
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, p.wake[0],
+		&syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}); err != nil {
+
+		p.closeFds()
+		return nil, err
+	}
+	go p.wait()
+	for i := 0; i < readers; i++ {
+		go p.read()
+	}
+	return p, nil
+}
+
+// Add starts polling s, calling handle with each message from the client,
+// and done once the connection closes. Messages for a connection are
+// handled in order, one at a time; handle returns false to stop reading
+// and close the connection. Returns false if s cannot be polled, in which
+// case neither function is called.
+func (p *netPoller) Add(s *PollSocket, handle func([]byte) bool,
+	done func(error)) bool {
+
+	if !s.Pollable() {
+		return false
+	}
+	p.lock.Lock()
+	if p.lastID++; p.lastID <= 0 {
+		p.lastID = 1
+	}
+	id := p.lastID
+	p.sockets[id] = s
+	p.lock.Unlock()
+
+	s.stateLock.Lock()
+	s.poller, s.pollID = p, id
+	s.onMessage, s.onClose = handle, done
+	closed := s.closed
+	s.stateLock.Unlock()
+
+	// Frames sent with the handshake are already buffered, and a failed
+	// registration must still call done, so both are left to a reader. The
+	// buffer is checked first, since a reader may take it once registered.
+	buffered := s.w > 0
+	if closed || p.ctl(s, syscall.EPOLL_CTL_ADD) != nil || buffered {
+		p.dispatch(s)
+	}
+	return true
+}
+
+// ctl adds, re-arms, or removes the registration for s.
+func (p *netPoller) ctl(s *PollSocket, op int) error {
+	var ctlErr error
+	err := s.raw.Control(func(fd uintptr) {
+		ctlErr = syscall.EpollCtl(p.epfd, op, int(fd),
+			&syscall.EpollEvent{Events: pollEvents, Fd: int32(fd), Pad: s.pollID})
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// dispatch hands s to a reader without blocking the caller, which may be a
+// reader itself.
+func (p *netPoller) dispatch(s *PollSocket) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.isClosed {
+		select {
+		case p.ready <- s:
+			return
+		default:
+		}
+	}
+	go p.serve(s)
+}
+
+// wait hands connections to the readers as data arrives.
+func (p *netPoller) wait() {
+	defer p.closeFds()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			id := events[i].Pad
+			if id == 0 {
+				// Woken by Close.
+				return
+			}
+			p.lock.Lock()
+			s := p.sockets[id]
+			p.lock.Unlock()
+			if s == nil {
+				continue
+			}
+			select {
+			case p.ready <- s:
+			case <-p.closeSignal:
+				return
+			}
+		}
+	}
+}
+
+func (p *netPoller) read() {
+	for {
+		select {
+		case s := <-p.ready:
+			p.serve(s)
+		case <-p.closeSignal:
+			// Finish connections dispatched before the poller closed.
+			for {
+				select {
+				case s := <-p.ready:
+					p.serve(s)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// serve reads from s once, handles any complete messages, and re-arms s.
+// Finishes s if the connection closed or the worker stopped.
+func (p *netPoller) serve(s *PollSocket) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	if s.finished {
+		return
+	}
+	if s.isClosed() {
+		p.finish(s, nil)
+		return
+	}
+	err := s.fill(s.readNow)
+	for err == nil {
+		data, ok, parseErr := s.nextMessage()
+		if err = parseErr; err != nil || !ok {
+			break
+		}
+		if !s.onMessage(data) {
+			p.finish(s, nil)
+			return
+		}
+	}
+	if err == nil {
+		s.release()
+		err = p.ctl(s, syscall.EPOLL_CTL_MOD)
+	}
+	if err != nil {
+		if s.isClosed() {
+			// Closed while the messages were handled.
+			err = nil
+		}
+		p.finish(s, err)
+	}
+}
+
+// finish removes s from the poller, closes the connection, and calls the
+// done function passed to Add. The caller must hold the read lock of s.
+func (p *netPoller) finish(s *PollSocket, err error) {
+	s.finished = true
+	p.ctl(s, syscall.EPOLL_CTL_DEL)
+	p.lock.Lock()
+	delete(p.sockets, s.pollID)
+	p.lock.Unlock()
+	s.stateLock.Lock()
+	s.closed = true
+	s.stateLock.Unlock()
+	s.conn.Close()
+	s.release()
+	s.onClose(err)
+}
+
+// readNow reads from the connection without waiting for data. Reads that
+// would block return no data, and leave the connection to be re-armed.
+func (s *PollSocket) readNow(buf []byte) (n int, err error) {
+	var readErr error
+	if err = s.raw.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), buf)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	switch readErr {
+	case nil:
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	case syscall.EAGAIN, syscall.EINTR:
+		return 0, nil
+	}
+	return 0, readErr
+}
+
+func (p *netPoller) closeFds() {
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	syscall.Close(p.epfd)
+}
+
+// Close stops the event loop and the readers. Connections closed later are
+// finished on their own goroutines.
+func (p *netPoller) Close() error {
+	p.lock.Lock()
+	if p.isClosed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.isClosed = true
+	p.lock.Unlock()
+	// The event loop closes the pipe on exit, so wake it before signaling.
+	syscall.Write(p.wake[1], []byte{0})
+	close(p.closeSignal)
+	return nil
+}
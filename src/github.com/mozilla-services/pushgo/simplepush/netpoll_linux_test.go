@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNetPoller(t *testing.T) {
+	poller, err := newNetPoller(2)
+	if err != nil {
+		t.Fatalf("Error starting poller: %s", err)
+	}
+	defer poller.Close()
+	sockets := make(chan *PollSocket, 2)
+	done := make(chan error, 2)
+	server := httptest.NewServer(PollTransport{}.Handler(func(ws Socket) {
+		sock := ws.(*PollSocket)
+		if !poller.Add(sock, func(data []byte) bool {
+			sock.WriteMessage(data)
+			return true
+		}, func(err error) { done <- err }) {
+			t.Errorf("Could not poll connection")
+		}
+		// The handler returns without waiting for the connection to close.
+		sockets <- sock
+	}, nil))
+	defer server.Close()
+
+	conn, r := dialPollTransport(t, server, maskedFrame(opText, true, []byte("early")))
+	defer conn.Close()
+	<-sockets
+	if _, data := readTestFrame(t, r); string(data) != "early" {
+		t.Errorf("Wrong echo for early frame: %q", data)
+	}
+	conn.Write(maskedFrame(opText, true, []byte("later")))
+	if _, data := readTestFrame(t, r); string(data) != "later" {
+		t.Errorf("Wrong echo for message: %q", data)
+	}
+	conn.Write(maskedFrame(opClose, true, closePayload(CloseNormal, "")))
+	if opcode, _ := readTestFrame(t, r); opcode != opClose {
+		t.Errorf("Wrong reply to close frame: %d", opcode)
+	}
+	if err := <-done; err != io.EOF {
+		t.Errorf("Wrong error after client close: %v", err)
+	}
+
+	// Connections closed by the server are finished without an event.
+	conn, r = dialPollTransport(t, server, nil)
+	defer conn.Close()
+	(<-sockets).Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wrong error after server close: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for closed connection")
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Connection still open after close: %v", err)
+	}
+}
+
+func TestWorkerPollSlowClient(t *testing.T) {
+	handler, app := newTestHandler(t)
+	app.writeTimeout = 100 * time.Millisecond
+	// A single reader handles every command, so a reply blocked on a client
+	// that stops reading would stall all other connections.
+	pool := NewWorkerPool()
+	conf := pool.ConfigStruct().(*WorkerPoolConfig)
+	conf.Poll, conf.Readers = true, 1
+	if err := pool.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing worker pool: %s", err)
+	}
+	defer pool.Close()
+	app.Server().workers.Close()
+	app.Server().workers = pool
+	server := httptest.NewServer(pool.Transport().Handler(handler.PushSocketHandler, nil))
+	defer server.Close()
+
+	hello := maskedFrame(opText, true,
+		[]byte(`{"messageType":"hello","uaid":"","channelIDs":[]}`))
+	slow, r := dialPollTransport(t, server, hello)
+	defer slow.Close()
+	readTestFrame(t, r)
+	// Send commands until the server stops reading, without reading the
+	// replies.
+	go func() {
+		whoami := maskedFrame(opText, true, []byte(`{"messageType":"whoami"}`))
+		for {
+			if _, err := slow.Write(whoami); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "evicted client", func() bool { return app.ClientCount() == 0 })
+	if n := app.Metrics().(*TestMetrics).Counters["worker.write.timeout"]; n < 1 {
+		t.Errorf("Eviction not counted")
+	}
+
+	// The reader is free to handle other connections.
+	fast, r := dialPollTransport(t, server, hello)
+	defer fast.Close()
+	_, data := readTestFrame(t, r)
+	reply := new(HelloReply)
+	if err := json.Unmarshal(data, reply); err != nil || reply.Status != 200 {
+		t.Errorf("Wrong handshake reply after eviction: %q", data)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+)
+
+// errNoPoller is returned by newNetPoller on platforms without epoll.
+var errNoPoller = errors.New("Readiness-based reads require Linux")
+
+// netPoller is only implemented on Linux.
+type netPoller struct{}
+
+func newNetPoller(readers int) (*netPoller, error) {
+	return nil, errNoPoller
+}
+
+// Add always returns false; connections are read with blocking reads.
+func (p *netPoller) Add(s *PollSocket, handle func([]byte) bool,
+	done func(error)) bool {
+
+	return false
+}
+
+func (p *netPoller) dispatch(s *PollSocket) {}
+
+func (p *netPoller) Close() error {
+	return nil
+}
@@ -0,0 +1,123 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pingCryptVersion marks encrypted proprietary ping blobs. Unencrypted blobs
+// are JSON objects, so they never start with a zero byte.
+const pingCryptVersion = 0
+
+var (
+	ErrInvalidPingBlob = errors.New("Invalid encrypted proprietary ping blob")
+	ErrUnknownPingKey  = errors.New("Unknown proprietary ping key ID")
+)
+
+// PingCipher encrypts proprietary ping blobs (e.g., GCM registration IDs and
+// APNs tokens) before they are stored, so that they cannot be read by anyone
+// with storage access. Each blob is encrypted with AES-GCM under a key
+// derived from a server key and the device ID, so blobs cannot be moved
+// between devices. Encrypted blobs have the form
+// version (1 byte) | key ID (1 byte) | nonce | ciphertext.
+//
+// A nil PingCipher stores blobs unencrypted.
+type PingCipher struct {
+	keys    map[byte][]byte
+	current byte
+}
+
+// NewPingCipher returns a cipher for the given keys, each of the form
+// "id:base64key", that encrypts new blobs with the key currentID.
+func NewPingCipher(specs []string, currentID int) (*PingCipher, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	c := &PingCipher{keys: make(map[byte][]byte, len(specs))}
+	for _, spec := range specs {
+		keyID, key, err := ParseTokenKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("Proprietary ping key %d is too short", keyID)
+		}
+		c.keys[keyID] = key
+	}
+	if currentID < 0 || currentID > 255 {
+		return nil, fmt.Errorf("Invalid proprietary ping key ID: %d", currentID)
+	}
+	if _, ok := c.keys[byte(currentID)]; !ok {
+		return nil, ErrUnknownPingKey
+	}
+	c.current = byte(currentID)
+	return c, nil
+}
+
+// aead returns the cipher for a device, derived from the given server key.
+func (c *PingCipher) aead(keyID byte, uaid string) (cipher.AEAD, error) {
+	key, ok := c.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownPingKey
+	}
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, uaid)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts a ping blob for a device.
+func (c *PingCipher) Seal(uaid string, pingData []byte) ([]byte, error) {
+	if c == nil || len(pingData) == 0 {
+		return pingData, nil
+	}
+	aead, err := c.aead(c.current, uaid)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{pingCryptVersion, c.current}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, pingData, header), nil
+}
+
+// Open decrypts a ping blob stored for a device. Blobs stored before
+// encryption was enabled are returned as-is.
+func (c *PingCipher) Open(uaid string, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 || sealed[0] != pingCryptVersion {
+		return sealed, nil
+	}
+	if c == nil || len(sealed) < 2 {
+		return nil, ErrInvalidPingBlob
+	}
+	aead, err := c.aead(sealed[1], uaid)
+	if err != nil {
+		return nil, err
+	}
+	header, rest := sealed[:2], sealed[2:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrInvalidPingBlob
+	}
+	pingData, err := aead.Open(nil, rest[:aead.NonceSize()],
+		rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrInvalidPingBlob
+	}
+	return pingData, nil
+}
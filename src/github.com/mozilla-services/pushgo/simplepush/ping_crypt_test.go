@@ -0,0 +1,62 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPingCipher(t *testing.T) {
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+	pingData := []byte(`{"regid":"APA91bHun4MxP5egoKMwt2KZFBaFUH"}`)
+
+	c, err := NewPingCipher([]string{"1:MDEyMzQ1Njc4OWFiY2RlZg=="}, 1)
+	if err != nil {
+		t.Fatalf("Error creating ping cipher: %s", err)
+	}
+	sealed, err := c.Seal(uaid, pingData)
+	if err != nil {
+		t.Fatalf("Error encrypting ping: %s", err)
+	}
+	if bytes.Contains(sealed, []byte("regid")) {
+		t.Errorf("Encrypted ping contains plaintext: %q", sealed)
+	}
+	opened, err := c.Open(uaid, sealed)
+	if err != nil {
+		t.Fatalf("Error decrypting ping: %s", err)
+	}
+	if !bytes.Equal(opened, pingData) {
+		t.Errorf("Mismatched ping: got %q; want %q", opened, pingData)
+	}
+	if _, err = c.Open("a0c3ec5e4c7f4bd58a8bd7a9dc2dd8fe", sealed); err != ErrInvalidPingBlob {
+		t.Errorf("Ping decrypted for another device: %v", err)
+	}
+
+	// Pings stored before encryption was enabled are returned as-is.
+	if opened, err = c.Open(uaid, pingData); err != nil || !bytes.Equal(opened, pingData) {
+		t.Errorf("Unencrypted ping changed: %q, %v", opened, err)
+	}
+
+	// Rotated keys still decrypt pings sealed with older keys.
+	rotated, err := NewPingCipher([]string{
+		"1:MDEyMzQ1Njc4OWFiY2RlZg==", "2:ZmVkY2JhOTg3NjU0MzIxMA=="}, 2)
+	if err != nil {
+		t.Fatalf("Error creating rotated ping cipher: %s", err)
+	}
+	if opened, err = rotated.Open(uaid, sealed); err != nil || !bytes.Equal(opened, pingData) {
+		t.Errorf("Rotated cipher could not decrypt ping: %q, %v", opened, err)
+	}
+	if resealed, _ := rotated.Seal(uaid, pingData); resealed[1] != 2 {
+		t.Errorf("Wrong key ID for new ping: %d", resealed[1])
+	}
+	if _, err = (*PingCipher)(nil).Open(uaid, sealed); err != ErrInvalidPingBlob {
+		t.Errorf("Encrypted ping opened without keys: %v", err)
+	}
+
+	if _, err = NewPingCipher([]string{"1:MDEyMzQ1Njc4OWFiY2RlZg=="}, 2); err != ErrUnknownPingKey {
+		t.Errorf("Unknown current key accepted: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Proprietary ping delivery results, as recorded in PingOutcome.Result.
+const (
+	// PingAccepted indicates that the bridge accepted the wakeup.
+	PingAccepted = "accepted"
+
+	// PingInvalid indicates that the bridge rejected the device's token,
+	// channel, or callback. The registration is removed.
+	PingInvalid = "invalid"
+
+	// PingThrottled indicates that the bridge was still throttled or
+	// unavailable after retrying.
+	PingThrottled = "throttled"
+
+	// PingFailed indicates any other delivery error.
+	PingFailed = "failed"
+)
+
+// pingFeedbackWindow is the length of the window used to compute bridge
+// failure rates. Rates cover the current and previous windows.
+const pingFeedbackWindow = time.Minute
+
+// PingOutcome is the result of the last proprietary ping sent to a device.
+type PingOutcome struct {
+	Backend string `json:"backend"`
+	Result  string `json:"result"`
+	Time    int64  `json:"time"`
+}
+
+// PingOutcomeStore is implemented by storage adapters that can record the
+// result of the last proprietary ping sent to each device. Adapters that do
+// not implement it only report outcomes as metrics.
+type PingOutcomeStore interface {
+	// PutPingOutcome records the result of the last ping sent to the device.
+	PutPingOutcome(suaid string, outcome *PingOutcome) error
+
+	// FetchPingOutcome returns the result of the last ping sent to the
+	// device, or nil if no outcome was recorded.
+	FetchPingOutcome(suaid string) (*PingOutcome, error)
+}
+
+// PingFeedback feeds the delivery results reported by a bridge back into
+// storage. Outcomes are recorded per device if the store supports it, and
+// registrations rejected by the bridge are dropped, so that dead "connect"
+// data is not retried on every update. The failure rate of the bridge is
+// reported as the "ping.<backend>.failure_rate" gauge, as a percentage of
+// pings that were throttled or failed; invalid registrations do not count
+// as bridge failures. Results are also reported to the bridge's guard.
+type PingFeedback struct {
+	backend string
+	logger  *SimpleLogger
+	metrics Statistician
+	store   Store
+	guard   *BridgeGuard
+
+	lock        sync.Mutex
+	windowStart time.Time
+	sent        int64 // Pings sent in the current window.
+	failed      int64
+	lastSent    int64 // Pings sent in the previous window.
+	lastFailed  int64
+}
+
+// NewPingFeedback returns feedback for the named bridge backend. Pingers
+// should create it in Init, after the application's store is set. The
+// guard may be nil.
+func NewPingFeedback(app *Application, backend string,
+	guard *BridgeGuard) *PingFeedback {
+
+	return &PingFeedback{
+		backend: backend,
+		logger:  app.Logger(),
+		metrics: app.Metrics(),
+		store:   app.Store(),
+		guard:   guard,
+	}
+}
+
+// Accepted records a ping accepted by the bridge.
+func (f *PingFeedback) Accepted(uaid string) {
+	f.record(uaid, PingAccepted, time.Now())
+}
+
+// Invalid records a registration rejected by the bridge, and removes it
+// from storage.
+func (f *PingFeedback) Invalid(uaid string) {
+	f.record(uaid, PingInvalid, time.Now())
+	if err := f.store.DropPing(uaid); err != nil && f.logger.ShouldLog(WARNING) {
+		f.logger.Warn("propping", "Could not remove invalid registration",
+			LogFields{"error": err.Error(), "uaid": uaid, "backend": f.backend})
+	}
+}
+
+// Failed records a ping that could not be delivered. Temporary pinger
+// errors remaining after retries indicate a throttled or unavailable
+// bridge.
+func (f *PingFeedback) Failed(uaid string, err error) {
+	result := PingFailed
+	if pingErr, ok := err.(*PingerError); ok && pingErr.Temporary {
+		result = PingThrottled
+	}
+	f.record(uaid, result, time.Now())
+}
+
+// Simulated records a wake that was logged instead of sent, because the
+// backend is in simulation mode. Simulated wakes are not recorded as
+// outcomes, and do not affect the failure rate or the bridge's guard.
+func (f *PingFeedback) Simulated(uaid string, vers int64) {
+	f.metrics.Increment("ping." + f.backend + ".simulated")
+	if f.logger.ShouldLog(INFO) {
+		f.logger.Info("propping", "Simulated wake",
+			LogFields{"uaid": uaid, "backend": f.backend,
+				"version": strconv.FormatInt(vers, 10)})
+	}
+}
+
+// FailureRate returns the percentage of pings sent over the current and
+// previous windows that were throttled or failed.
+func (f *PingFeedback) FailureRate() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.advance(time.Now())
+	return f.failureRate()
+}
+
+func (f *PingFeedback) record(uaid, result string, now time.Time) {
+	f.metrics.Increment("ping." + f.backend + ".outcome." + result)
+
+	failed := result == PingThrottled || result == PingFailed
+	if failed {
+		f.guard.Failure()
+	} else {
+		f.guard.Success()
+	}
+
+	f.lock.Lock()
+	f.advance(now)
+	f.sent++
+	if failed {
+		f.failed++
+	}
+	rate := f.failureRate()
+	f.lock.Unlock()
+	f.metrics.Gauge("ping."+f.backend+".failure_rate", rate)
+
+	outcomes, ok := f.store.(PingOutcomeStore)
+	if !ok {
+		return
+	}
+	err := outcomes.PutPingOutcome(uaid, &PingOutcome{
+		Backend: f.backend,
+		Result:  result,
+		Time:    now.Unix(),
+	})
+	if err != nil && f.logger.ShouldLog(WARNING) {
+		f.logger.Warn("propping", "Could not record ping outcome",
+			LogFields{"error": err.Error(), "uaid": uaid, "backend": f.backend})
+	}
+}
+
+// advance rotates the failure rate windows. The caller must hold f.lock.
+func (f *PingFeedback) advance(now time.Time) {
+	elapsed := now.Sub(f.windowStart)
+	if elapsed < pingFeedbackWindow {
+		return
+	}
+	if elapsed < 2*pingFeedbackWindow {
+		f.lastSent, f.lastFailed = f.sent, f.failed
+	} else {
+		f.lastSent, f.lastFailed = 0, 0
+	}
+	f.sent, f.failed = 0, 0
+	f.windowStart = now.Truncate(pingFeedbackWindow)
+}
+
+// failureRate returns the failure percentage. The caller must hold f.lock.
+func (f *PingFeedback) failureRate() int64 {
+	sent := f.sent + f.lastSent
+	if sent == 0 {
+		return 0
+	}
+	return (f.failed + f.lastFailed) * 100 / sent
+}
@@ -0,0 +1,87 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type outcomeTestStore struct {
+	*testPingStore
+	outcomes map[string]*PingOutcome
+}
+
+func (s *outcomeTestStore) PutPingOutcome(uaid string, outcome *PingOutcome) error {
+	s.Lock()
+	defer s.Unlock()
+	s.outcomes[uaid] = outcome
+	return nil
+}
+
+func (s *outcomeTestStore) FetchPingOutcome(uaid string) (*PingOutcome, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.outcomes[uaid], nil
+}
+
+func Test_PingFeedback(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := &outcomeTestStore{
+		testPingStore: &testPingStore{
+			NoStore: app.Store().(*NoStore),
+			pings:   make(map[string][]byte),
+		},
+		outcomes: make(map[string]*PingOutcome),
+	}
+	app.SetStore(store)
+	for _, uaid := range []string{"uaid1", "uaid2", "uaid3", "uaid4"} {
+		store.PutPing(uaid, []byte(`{"type":"fcm"}`))
+	}
+	feedback := NewPingFeedback(app, "fcm", nil)
+	feedback.Accepted("uaid1")
+	feedback.Invalid("uaid2")
+	feedback.Failed("uaid3", &PingerError{"Retrying after receiving status code: 503", true})
+	feedback.Failed("uaid4", errors.New("connection refused"))
+
+	for uaid, result := range map[string]string{
+		"uaid1": PingAccepted,
+		"uaid2": PingInvalid,
+		"uaid3": PingThrottled,
+		"uaid4": PingFailed,
+	} {
+		outcome, _ := store.FetchPingOutcome(uaid)
+		if outcome == nil || outcome.Backend != "fcm" || outcome.Result != result {
+			t.Errorf("Wrong outcome for %s: got %+v; want %s", uaid, outcome, result)
+		}
+	}
+	// Only registrations rejected by the bridge are dropped.
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Invalid registration not removed: %s", data)
+	}
+	if data, _ := store.FetchPing("uaid3"); data == nil {
+		t.Errorf("Throttled registration removed")
+	}
+
+	mx := app.Metrics().(*TestMetrics)
+	if rate := mx.Gauges["ping.fcm.failure_rate"]; rate != 50 {
+		t.Errorf("Wrong failure rate gauge: got %d; want 50", rate)
+	}
+	if n := mx.Counters["ping.fcm.outcome.throttled"]; n != 1 {
+		t.Errorf("Wrong throttled count: got %d; want 1", n)
+	}
+
+	// Failures age out after two windows.
+	now := time.Now()
+	feedback.record("uaid1", PingAccepted, now.Add(pingFeedbackWindow))
+	if rate := feedback.failureRate(); rate != 40 {
+		t.Errorf("Wrong failure rate after one window: got %d; want 40", rate)
+	}
+	feedback.record("uaid1", PingAccepted, now.Add(3*pingFeedbackWindow))
+	if rate := feedback.failureRate(); rate != 0 {
+		t.Errorf("Wrong failure rate after two windows: got %d; want 0", rate)
+	}
+}
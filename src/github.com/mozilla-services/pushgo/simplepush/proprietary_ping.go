@@ -18,15 +18,48 @@ import (
 	"github.com/mozilla-services/pushgo/retry"
 )
 
+// PropPinger is implemented by proprietary pingers, which wake devices or
+// deliver updates over a carrier or platform notification service.
 type PropPinger interface {
 	HasConfigStruct
+
+	// Register stores the "connect" data sent by the device in the
+	// handshake. It returns UnsupportedProtocolErr if the data is not
+	// meant for this pinger.
 	Register(uaid string, pingData []byte) error
+
+	// Send pings the device, returning true if the pinger accepted the
+	// update.
 	Send(uaid string, vers int64, data string) (ok bool, err error)
+
+	// CanBypassWebsocket indicates whether an accepted ping delivers the
+	// update, so that it need not be stored or sent over the WebSocket.
 	CanBypassWebsocket() bool
+
 	Status() (bool, error)
 	Close() error
 }
 
+// ChannelPinger is implemented by pingers that coalesce wakes for the same
+// channel, and so need the channel ID of each update.
+type ChannelPinger interface {
+	PropPinger
+
+	// SendChannel is like Send, for an update to the given channel.
+	SendChannel(uaid, chid string, vers int64, data string) (ok bool, err error)
+}
+
+// SendPing pings the device with the channel ID of the update, if the pinger
+// uses it.
+func SendPing(pinger PropPinger, uaid, chid string, vers int64, data string) (
+	ok bool, err error) {
+
+	if channels, ok := pinger.(ChannelPinger); ok {
+		return channels.SendChannel(uaid, chid, vers, data)
+	}
+	return pinger.Send(uaid, vers, data)
+}
+
 var (
 	UnsupportedProtocolErr = errors.New("Unsupported Ping Request")
 	ConfigurationErr       = errors.New("Configuration Error")
@@ -34,12 +67,13 @@ var (
 	PingerClosedErr        = &PingerError{"Pinger closed", false}
 )
 
+// AvailablePings maps the "type" of the propping config section to pinger
+// factories.
 var AvailablePings = make(AvailableExtensions)
 
 func init() {
 	AvailablePings["noop"] = func() HasConfigStruct { return new(NoopPing) }
-	AvailablePings["udp"] = func() HasConfigStruct { return new(UDPPing) }
-	AvailablePings["gcm"] = func() HasConfigStruct { return new(GCMPing) }
+	AvailablePings["gcm"] = func() HasConfigStruct { return NewGCMPing() }
 	AvailablePings.SetDefault("noop")
 }
 
@@ -102,65 +136,6 @@ func (r *NoopPing) Close() error {
 	return nil
 }
 
-//===
-// "UDP" ping uses remote Carrier provided URL to establish a UDP
-// based "ping" to the device. This UDP ping is contained within
-// the carrier's network.
-type UDPPing struct {
-	config *UDPPingConfig
-	app    *Application
-}
-
-type UDPPingConfig struct {
-	URL string `toml:"url" env:"url"` //carrier UDP Proxy URL
-	// Additional Carrier required elements here.
-}
-
-func (ml *UDPPing) ConfigStruct() interface{} {
-	return &UDPPingConfig{
-		URL: "https://example.com",
-	}
-}
-
-func (r *UDPPing) Init(app *Application, config interface{}) error {
-	r.app = app
-	r.config = config.(*UDPPingConfig)
-	return nil
-}
-
-func (r *UDPPing) Register(uaid string, pingData []byte) (err error) {
-	if err = r.app.Store().PutPing(uaid, pingData); err != nil {
-		r.app.Logger().Error("propping", "Could not store connect",
-			LogFields{"error": err.Error()})
-	}
-	return nil
-}
-
-func (r *UDPPing) CanBypassWebsocket() bool {
-	// If the Ping does not require communication to the client via
-	// websocket, return true. If the ping should still attempt to
-	// try using the client's websocket connection, return false.
-	return false
-}
-
-// Send the version info to the Proprietary ping URL provided
-// by the carrier.
-func (r *UDPPing) Send(string, int64, string) (bool, error) {
-	// Obviously, this needs to be filled out with the appropriate
-	// setup and calls to communicate to the remote server.
-	// Since UDP is not actually defined, we're returning this
-	// error.
-	return false, UnsupportedProtocolErr
-}
-
-func (r *UDPPing) Status() (bool, error) {
-	return false, UnsupportedProtocolErr
-}
-
-func (r *UDPPing) Close() error {
-	return nil
-}
-
 // ===
 // Google Cloud Messaging Proprietary Ping interface
 // NOTE: This is still experimental.
@@ -180,6 +155,9 @@ type GCMPing struct {
 	dryRun      bool
 	apiKey      string
 	ttl         uint64
+	feedback    *PingFeedback
+	guard       *BridgeGuard
+	simulate    bool
 	rh          *retry.Helper
 	closeLock   sync.Mutex
 	closeSignal chan bool
@@ -193,9 +171,13 @@ type GCMPingConfig struct {
 	TTL         string
 	URL         string //GCM URL
 	Retry       retry.Config
+	Simulate    bool `env:"simulate"` // Log wakes instead of sending them
+	Guard       BridgeGuardConfig
 }
 
 type GCMRequest struct {
+	// google docs lie. You MUST send the regid as an array, even if it's one
+	// element.
 	Regs        [1]string `json:"registration_ids"`
 	CollapseKey string    `json:"collapse_key"`
 	TTL         uint64    `json:"time_to_live"`
@@ -224,6 +206,7 @@ func (r *GCMPing) ConfigStruct() interface{} {
 			MaxDelay:  "5s",
 			MaxJitter: "400ms",
 		},
+		Guard: DefaultBridgeGuard(),
 	}
 }
 
@@ -232,6 +215,13 @@ func (r *GCMPing) Init(app *Application, config interface{}) (err error) {
 	r.metrics = app.Metrics()
 	r.store = app.Store()
 	conf := config.(*GCMPingConfig)
+	if r.guard, err = conf.Guard.NewGuard("gcm", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "gcm", r.guard)
+	r.simulate = conf.Simulate
 
 	r.url = conf.URL
 	r.collapseKey = conf.CollapseKey
@@ -325,8 +315,6 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 		return false, nil
 	}
 	request := &GCMRequest{
-		// google docs lie. You MUST send the regid as an array, even if it's one
-		// element.
 		Regs:        [1]string{ping.RegID},
 		CollapseKey: r.collapseKey,
 		TTL:         r.ttl,
@@ -335,6 +323,13 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 			Msg: data,
 		},
 	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
 	body, err := json.Marshal(request)
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
@@ -379,8 +374,10 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 				LogFields{"error": err.Error(), "uaid": uaid})
 		}
 		r.metrics.Increment("ping.gcm.error")
+		r.feedback.Failed(uaid, err)
 		return false, err
 	}
+	r.feedback.Accepted(uaid)
 	r.metrics.Increment("ping.gcm.success")
 	return true, nil
 }
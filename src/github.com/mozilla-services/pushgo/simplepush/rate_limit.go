@@ -0,0 +1,197 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateBudget is a token bucket size and refill rate. A rate of 0 disables
+// the limit.
+type RateBudget struct {
+	// Rate is the sustained number of requests allowed per second.
+	Rate float64 `env:"rate"`
+
+	// Burst is the number of requests allowed at once. Defaults to the
+	// rate, or 1 if the rate is lower.
+	Burst int `env:"burst"`
+}
+
+// RateBudgets are the per-device and per-address budgets for a kind of
+// request.
+type RateBudgets struct {
+	UAID RateBudget `toml:"uaid" env:"uaid"`
+	IP   RateBudget `toml:"ip" env:"ip"`
+}
+
+type RateLimitConfig struct {
+	// Commands lists the WebSocket commands subject to the client budgets.
+	// Defaults to "hello", "register", "registermany", and "ping".
+	Commands []string `env:"commands"`
+
+	// Client limits WebSocket commands.
+	Client RateBudgets `toml:"client" env:"client"`
+
+	// Endpoint limits app server updates.
+	Endpoint RateBudgets `toml:"endpoint" env:"endpoint"`
+
+	// MaxSize is the maximum number of devices or addresses tracked for
+	// each budget. Defaults to 100000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// tokenBuckets tracks a token bucket per key. Buckets that have not been
+// used for long enough to refill are discarded, since a new bucket starts
+// full.
+type tokenBuckets struct {
+	rate     float64
+	burst    float64
+	refill   time.Duration
+	maxSize  int
+	lock     sync.Mutex
+	current  map[string]*tokenBucket
+	previous map[string]*tokenBucket
+	rotated  time.Time
+}
+
+func newTokenBuckets(budget RateBudget, maxSize int) *tokenBuckets {
+	if budget.Rate <= 0 {
+		return nil
+	}
+	burst := float64(budget.Burst)
+	if burst < 1 {
+		burst = budget.Rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBuckets{
+		rate:     budget.Rate,
+		burst:    burst,
+		refill:   time.Duration(burst / budget.Rate * float64(time.Second)),
+		maxSize:  maxSize,
+		current:  make(map[string]*tokenBucket),
+		previous: make(map[string]*tokenBucket),
+		rotated:  time.Now(),
+	}
+}
+
+// Allow takes a token from the key's bucket, if one is available.
+func (b *tokenBuckets) Allow(key string, now time.Time) bool {
+	if b == nil || len(key) == 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if now.Sub(b.rotated) >= b.refill || len(b.current) >= b.maxSize/2 {
+		b.previous = b.current
+		b.current = make(map[string]*tokenBucket, len(b.previous))
+		b.rotated = now
+	}
+	bucket, ok := b.current[key]
+	if !ok {
+		if bucket, ok = b.previous[key]; ok {
+			delete(b.previous, key)
+		} else {
+			bucket = &tokenBucket{b.burst, now}
+		}
+		b.current[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		if bucket.tokens += elapsed * b.rate; bucket.tokens > b.burst {
+			bucket.tokens = b.burst
+		}
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RateLimiter enforces per-device and per-address token bucket budgets on
+// WebSocket commands and app server updates.
+type RateLimiter struct {
+	logger       *SimpleLogger
+	metrics      Statistician
+	commands     map[string]bool
+	clientUAID   *tokenBuckets
+	clientIP     *tokenBuckets
+	endpointUAID *tokenBuckets
+	endpointIP   *tokenBuckets
+}
+
+func NewRateLimiter() *RateLimiter {
+	return new(RateLimiter)
+}
+
+func (*RateLimiter) ConfigStruct() interface{} {
+	return &RateLimitConfig{
+		Commands: []string{"hello", "register", "registermany", "ping"},
+		MaxSize:  100000,
+	}
+}
+
+func (r *RateLimiter) Init(app *Application, config interface{}) error {
+	conf := config.(*RateLimitConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.commands = make(map[string]bool, len(conf.Commands))
+	for _, command := range conf.Commands {
+		r.commands[strings.ToLower(strings.TrimSpace(command))] = true
+	}
+	r.clientUAID = newTokenBuckets(conf.Client.UAID, conf.MaxSize)
+	r.clientIP = newTokenBuckets(conf.Client.IP, conf.MaxSize)
+	r.endpointUAID = newTokenBuckets(conf.Endpoint.UAID, conf.MaxSize)
+	r.endpointIP = newTokenBuckets(conf.Endpoint.IP, conf.MaxSize)
+	return nil
+}
+
+// AllowCommand indicates whether a client may run a WebSocket command.
+// The device ID is empty before the handshake.
+func (r *RateLimiter) AllowCommand(command, uaid, remoteAddr string) bool {
+	if r == nil || !r.commands[command] {
+		return true
+	}
+	return r.allow("client", r.clientUAID, r.clientIP, uaid, remoteAddr)
+}
+
+// AllowUpdate indicates whether an app server may send an update. The
+// device ID is empty if the update has not been resolved to a device yet.
+func (r *RateLimiter) AllowUpdate(uaid, remoteAddr string) bool {
+	if r == nil {
+		return true
+	}
+	return r.allow("endpoint", r.endpointUAID, r.endpointIP, uaid, remoteAddr)
+}
+
+func (r *RateLimiter) allow(scope string, uaidBuckets, ipBuckets *tokenBuckets,
+	uaid, remoteAddr string) bool {
+
+	now := time.Now()
+	limit := ""
+	if !ipBuckets.Allow(remoteAddr, now) {
+		limit = "ip"
+	} else if !uaidBuckets.Allow(uaid, now) {
+		limit = "uaid"
+	}
+	if len(limit) == 0 {
+		return true
+	}
+	r.metrics.Increment("ratelimit." + scope + "." + limit)
+	if r.logger.ShouldLog(INFO) {
+		r.logger.Info("ratelimit", "Request rate limited", LogFields{
+			"scope": scope, "limit": limit, "uaid": uaid, "remoteAddr": remoteAddr})
+	}
+	return false
+}
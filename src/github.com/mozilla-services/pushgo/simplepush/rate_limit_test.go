@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	buckets := newTokenBuckets(RateBudget{Rate: 2, Burst: 3}, 100)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !buckets.Allow("a", now) {
+			t.Fatalf("Request %d within burst was limited", i)
+		}
+	}
+	if buckets.Allow("a", now) {
+		t.Errorf("Request over burst was allowed")
+	}
+	if !buckets.Allow("b", now) {
+		t.Errorf("Request for another key was limited")
+	}
+	// Tokens refill at the configured rate.
+	if !buckets.Allow("a", now.Add(500*time.Millisecond)) {
+		t.Errorf("Request after refill was limited")
+	}
+	if buckets.Allow("a", now.Add(500*time.Millisecond)) {
+		t.Errorf("Request over refilled budget was allowed")
+	}
+	// Disabled budgets allow everything.
+	if disabled := newTokenBuckets(RateBudget{}, 100); !disabled.Allow("a", now) {
+		t.Errorf("Disabled budget limited a request")
+	}
+}
+
+func Test_WorkerRateLimit(t *testing.T) {
+	_, app := newTestHandler(t)
+	limiter := NewRateLimiter()
+	conf := limiter.ConfigStruct().(*RateLimitConfig)
+	conf.Client.IP = RateBudget{Rate: 0.001, Burst: 1}
+	if err := limiter.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing rate limiter: %s", err)
+	}
+	app.Server().rateLimiter = limiter
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	helo := map[string]interface{}{"messageType": "hello", "uaid": "", "channelIDs": []string{}}
+	for i, expected := range []float64{200, 429} {
+		if err := websocket.JSON.Send(socket, helo); err != nil {
+			t.Fatalf("Error writing handshake request: %s", err)
+		}
+		reply := make(map[string]interface{})
+		if err := websocket.JSON.Receive(socket, &reply); err != nil {
+			t.Fatalf("Error reading handshake reply %d: %s", i, err)
+		}
+		if reply["status"] != expected {
+			t.Errorf("Wrong status for handshake %d: got %v; want %v", i,
+				reply["status"], expected)
+		}
+	}
+	// The connection stays open after a rate-limited command.
+	if err := websocket.Message.Send(socket, `{"messageType":"whoami"}`); err != nil {
+		t.Fatalf("Error sending whoami: %s", err)
+	}
+	reply := new(WhoamiReply)
+	if err := websocket.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error reading whoami reply: %s", err)
+	}
+	if reply.Status != 200 {
+		t.Errorf("Wrong whoami status: got %d; want 200", reply.Status)
+	}
+	metrics := app.Metrics().(*TestMetrics)
+	metrics.RLock()
+	defer metrics.RUnlock()
+	if n := metrics.Counters["ratelimit.client.ip"]; n != 1 {
+		t.Errorf("Wrong rate limited count: got %d; want 1", n)
+	}
+}
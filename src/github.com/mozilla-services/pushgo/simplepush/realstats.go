@@ -0,0 +1,210 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidInterval = errors.New("Real-time stats interval must be positive")
+
+type RealStatsConfig struct {
+	// Tokens lists the bearer tokens accepted by the real-time stats stream.
+	// The stream is disabled if no tokens are set.
+	Tokens []string `env:"tokens"`
+
+	// Interval is the time between snapshots. Defaults to 5 seconds.
+	Interval string `env:"interval"`
+}
+
+// RealStatsSnapshot is a point-in-time summary of this node's activity,
+// streamed to operations dashboards.
+type RealStatsSnapshot struct {
+	Time              int64        `json:"time"`
+	Clients           int          `json:"clients"`
+	ConnectsPerSec    float64      `json:"connectsPerSec"`
+	DisconnectsPerSec float64      `json:"disconnectsPerSec"`
+	UpdatesPerSec     float64      `json:"updatesPerSec"`
+	DeliveriesPerSec  float64      `json:"deliveriesPerSec"`
+	Store             PluginStatus `json:"store"`
+}
+
+// RealStats counts connections and updates between snapshots, and fans
+// snapshots out to stream subscribers.
+type RealStats struct {
+	app         *Application
+	logger      *SimpleLogger
+	metrics     Statistician
+	tokens      [][]byte
+	interval    time.Duration
+	connects    int64
+	disconnects int64
+	updates     int64
+	deliveries  int64
+	lastTick    time.Time
+	lock        sync.Mutex
+	subscribers map[chan *RealStatsSnapshot]bool
+	closeSignal chan bool
+	closeLock   sync.Mutex
+	isClosed    bool
+}
+
+func NewRealStats() *RealStats {
+	return &RealStats{
+		subscribers: make(map[chan *RealStatsSnapshot]bool),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*RealStats) ConfigStruct() interface{} {
+	return &RealStatsConfig{
+		Interval: "5s",
+	}
+}
+
+func (r *RealStats) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*RealStatsConfig)
+	r.app = app
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	for _, token := range conf.Tokens {
+		if token = strings.TrimSpace(token); len(token) > 0 {
+			r.tokens = append(r.tokens, []byte(token))
+		}
+	}
+	if !r.Enabled() {
+		return nil
+	}
+	if r.interval, err = time.ParseDuration(conf.Interval); err != nil || r.interval <= 0 {
+		if err == nil {
+			err = ErrInvalidInterval
+		}
+		r.logger.Panic("realstats", "Could not parse snapshot interval",
+			LogFields{"error": err.Error(), "interval": conf.Interval})
+		return err
+	}
+
+	events := app.Events()
+	events.Subscribe(EventClientConnected, func(*Event) { atomic.AddInt64(&r.connects, 1) })
+	events.Subscribe(EventClientDisconnected, func(*Event) { atomic.AddInt64(&r.disconnects, 1) })
+	events.Subscribe(EventUpdateAccepted, func(*Event) { atomic.AddInt64(&r.updates, 1) })
+	events.Subscribe(EventUpdateDelivered, func(*Event) { atomic.AddInt64(&r.deliveries, 1) })
+
+	r.lastTick = time.Now()
+	go r.run()
+	return nil
+}
+
+// Enabled indicates whether the stream accepts subscribers.
+func (r *RealStats) Enabled() bool {
+	return r != nil && len(r.tokens) > 0
+}
+
+// Authorized indicates whether token is one of the configured bearer
+// tokens.
+func (r *RealStats) Authorized(token string) bool {
+	if !r.Enabled() || len(token) == 0 {
+		return false
+	}
+	var ok int
+	for _, expected := range r.tokens {
+		ok |= subtle.ConstantTimeCompare([]byte(token), expected)
+	}
+	return ok == 1
+}
+
+// CloseNotify returns a channel that is closed when the stream shuts down.
+func (r *RealStats) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+// Snapshot returns the current activity summary, with rates averaged over
+// the time since the last snapshot, and resets the counters.
+func (r *RealStats) Snapshot() *RealStatsSnapshot {
+	now := time.Now()
+	r.lock.Lock()
+	elapsed := now.Sub(r.lastTick).Seconds()
+	r.lastTick = now
+	r.lock.Unlock()
+	rate := func(counter *int64) float64 {
+		n := atomic.SwapInt64(counter, 0)
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(n) / elapsed
+	}
+	snapshot := &RealStatsSnapshot{
+		Time:              now.UTC().Unix(),
+		Clients:           r.app.ClientCount(),
+		ConnectsPerSec:    rate(&r.connects),
+		DisconnectsPerSec: rate(&r.disconnects),
+		UpdatesPerSec:     rate(&r.updates),
+		DeliveriesPerSec:  rate(&r.deliveries),
+	}
+	snapshot.Store.Healthy, snapshot.Store.Error = r.app.Store().Status()
+	return snapshot
+}
+
+// Subscribe returns a channel of snapshots. The caller must call
+// Unsubscribe when finished.
+func (r *RealStats) Subscribe() chan *RealStatsSnapshot {
+	snapshots := make(chan *RealStatsSnapshot, 1)
+	r.lock.Lock()
+	r.subscribers[snapshots] = true
+	r.lock.Unlock()
+	r.metrics.Increment("realstats.subscribe")
+	return snapshots
+}
+
+// Unsubscribe removes a subscription created by Subscribe.
+func (r *RealStats) Unsubscribe(snapshots chan *RealStatsSnapshot) {
+	r.lock.Lock()
+	delete(r.subscribers, snapshots)
+	r.lock.Unlock()
+}
+
+// publish takes a snapshot and sends it to all subscribers. Slow
+// subscribers miss snapshots rather than blocking the others.
+func (r *RealStats) publish() {
+	snapshot := r.Snapshot()
+	r.lock.Lock()
+	for subscriber := range r.subscribers {
+		select {
+		case subscriber <- snapshot:
+		default:
+			r.metrics.Increment("realstats.dropped")
+		}
+	}
+	r.lock.Unlock()
+}
+
+func (r *RealStats) run() {
+	ticker := time.NewTicker(r.interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-r.closeSignal:
+		case <-ticker.C:
+			r.publish()
+		}
+	}
+	ticker.Stop()
+}
+
+// Close stops taking snapshots and disconnects all stream subscribers.
+func (r *RealStats) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	return nil
+}
@@ -0,0 +1,222 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+// Receipt types.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptExpired   = "expired"
+	ReceiptFailed    = "failed"
+)
+
+// Receipt describes the outcome of an app server's submission.
+type Receipt struct {
+	Type    string `json:"type"`
+	Version int64  `json:"version,omitempty"`
+	Code    int    `json:"code,omitempty"`
+	Time    int64  `json:"time"`
+}
+
+type ReceiptsConfig struct {
+	// MaxRecent is the number of receipts retained per endpoint, and replayed
+	// to new stream subscribers. Defaults to 10.
+	MaxRecent int `toml:"max_recent" env:"max_recent"`
+
+	// Retain is the amount of time to retain receipts for endpoints without
+	// subscribers. Defaults to 5 minutes.
+	Retain string `toml:"retain" env:"retain"`
+
+	// KeepAlive is the interval between SSE keep-alive comments. Defaults to
+	// 30 seconds.
+	KeepAlive string `toml:"keep_alive" env:"keep_alive"`
+}
+
+type receiptLog struct {
+	recent      []Receipt
+	subscribers map[chan Receipt]bool
+	lastUpdate  time.Time
+}
+
+// ReceiptHub records delivery, expiry, and failure receipts for recent
+// submissions, keyed by primary key, and fans them out to stream
+// subscribers.
+type ReceiptHub struct {
+	metrics     Statistician
+	maxRecent   int
+	retain      time.Duration
+	keepAlive   time.Duration
+	lock        sync.Mutex
+	logs        map[string]*receiptLog
+	closeSignal chan bool
+	closeLock   sync.Mutex
+	isClosed    bool
+}
+
+func NewReceiptHub() *ReceiptHub {
+	return &ReceiptHub{
+		logs:        make(map[string]*receiptLog),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*ReceiptHub) ConfigStruct() interface{} {
+	return &ReceiptsConfig{
+		MaxRecent: 10,
+		Retain:    "5m",
+		KeepAlive: "30s",
+	}
+}
+
+func (h *ReceiptHub) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*ReceiptsConfig)
+	logger := app.Logger()
+	h.metrics = app.Metrics()
+	h.maxRecent = conf.MaxRecent
+
+	if h.retain, err = time.ParseDuration(conf.Retain); err != nil {
+		logger.Panic("receipts", "Could not parse receipt retention period",
+			LogFields{"error": err.Error(), "retain": conf.Retain})
+		return err
+	}
+	if h.keepAlive, err = time.ParseDuration(conf.KeepAlive); err != nil {
+		logger.Panic("receipts", "Could not parse keep-alive interval",
+			LogFields{"error": err.Error(), "keepAlive": conf.KeepAlive})
+		return err
+	}
+	if h.retain > 0 {
+		go h.pruneLoop()
+	}
+
+	// Updates are only delivered once the device acknowledges them; writing
+	// an update to a socket or routing it to another node does not mean the
+	// device received it.
+	app.Events().Subscribe(EventUpdateAcked, func(event *Event) {
+		if pk, ok := app.Store().IDsToKey(event.UAID, event.ChannelID); ok {
+			h.Publish(pk, Receipt{Type: ReceiptDelivered, Version: event.Version})
+		}
+	})
+	return nil
+}
+
+// KeepAlive returns the interval between stream keep-alive comments.
+func (h *ReceiptHub) KeepAlive() time.Duration {
+	return h.keepAlive
+}
+
+// CloseNotify returns a channel that is closed when the hub shuts down.
+func (h *ReceiptHub) CloseNotify() <-chan bool {
+	return h.closeSignal
+}
+
+// Publish records a receipt for the given primary key and sends it to all
+// current subscribers. Slow subscribers miss receipts rather than blocking
+// the caller.
+func (h *ReceiptHub) Publish(pk string, receipt Receipt) {
+	if len(pk) == 0 {
+		return
+	}
+	if receipt.Time == 0 {
+		receipt.Time = time.Now().UTC().Unix()
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry, ok := h.logs[pk]
+	if !ok {
+		if h.retain <= 0 {
+			return
+		}
+		entry = &receiptLog{subscribers: make(map[chan Receipt]bool)}
+		h.logs[pk] = entry
+	}
+	entry.lastUpdate = time.Now()
+	if h.maxRecent > 0 {
+		if len(entry.recent) >= h.maxRecent {
+			copy(entry.recent, entry.recent[1:])
+			entry.recent = entry.recent[:len(entry.recent)-1]
+		}
+		entry.recent = append(entry.recent, receipt)
+	}
+	for subscriber := range entry.subscribers {
+		select {
+		case subscriber <- receipt:
+		default:
+			h.metrics.Increment("receipts.dropped")
+		}
+	}
+	h.metrics.Increment("receipts." + receipt.Type)
+}
+
+// Subscribe returns a channel of receipts for the given primary key, along
+// with any recently recorded receipts. The caller must call Unsubscribe
+// when finished.
+func (h *ReceiptHub) Subscribe(pk string) (receipts chan Receipt, recent []Receipt) {
+	receipts = make(chan Receipt, 32)
+	h.lock.Lock()
+	entry, ok := h.logs[pk]
+	if !ok {
+		entry = &receiptLog{subscribers: make(map[chan Receipt]bool)}
+		h.logs[pk] = entry
+	}
+	entry.subscribers[receipts] = true
+	entry.lastUpdate = time.Now()
+	recent = make([]Receipt, len(entry.recent))
+	copy(recent, entry.recent)
+	h.lock.Unlock()
+	h.metrics.Increment("receipts.stream.subscribe")
+	return receipts, recent
+}
+
+// Unsubscribe removes a subscription created by Subscribe.
+func (h *ReceiptHub) Unsubscribe(pk string, receipts chan Receipt) {
+	h.lock.Lock()
+	if entry, ok := h.logs[pk]; ok {
+		delete(entry.subscribers, receipts)
+		if len(entry.subscribers) == 0 && (h.retain <= 0 || len(entry.recent) == 0) {
+			delete(h.logs, pk)
+		}
+	}
+	h.lock.Unlock()
+}
+
+// prune removes retained receipts that are older than the retention period.
+func (h *ReceiptHub) prune() {
+	cutoff := time.Now().Add(-h.retain)
+	h.lock.Lock()
+	for pk, entry := range h.logs {
+		if len(entry.subscribers) == 0 && entry.lastUpdate.Before(cutoff) {
+			delete(h.logs, pk)
+		}
+	}
+	h.lock.Unlock()
+}
+
+func (h *ReceiptHub) pruneLoop() {
+	ticker := time.NewTicker(h.retain)
+	for ok := true; ok; {
+		select {
+		case ok = <-h.closeSignal:
+		case <-ticker.C:
+			h.prune()
+		}
+	}
+	ticker.Stop()
+}
+
+// Close stops the prune loop and disconnects all stream subscribers.
+func (h *ReceiptHub) Close() error {
+	h.closeLock.Lock()
+	defer h.closeLock.Unlock()
+	if h.isClosed {
+		return nil
+	}
+	h.isClosed = true
+	close(h.closeSignal)
+	return nil
+}
@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ReceiptHub(t *testing.T) {
+	pk := "deadbeef000000000000000000000000.decafbad000000000000000000000000"
+	tlogger, _ := NewLogger(&TestLogger{DEBUG, t})
+	mx := &TestMetrics{}
+	mx.Init(nil, nil)
+	app := &Application{metrics: mx}
+	app.SetLogger(tlogger)
+
+	hub := NewReceiptHub()
+	conf := hub.ConfigStruct().(*ReceiptsConfig)
+	conf.MaxRecent = 2
+	if err := hub.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing receipt hub: %s", err)
+	}
+	defer hub.Close()
+
+	for version := int64(1); version <= 3; version++ {
+		hub.Publish(pk, Receipt{Type: ReceiptDelivered, Version: version})
+	}
+	receipts, recent := hub.Subscribe(pk)
+	defer hub.Unsubscribe(pk, receipts)
+	if len(recent) != 2 {
+		t.Fatalf("Wrong number of recent receipts: got %d; want 2", len(recent))
+	}
+	if recent[0].Version != 2 || recent[1].Version != 3 {
+		t.Errorf("Wrong recent receipts: %#v", recent)
+	}
+
+	hub.Publish(pk, Receipt{Type: ReceiptFailed, Version: 4, Code: 1})
+	select {
+	case receipt := <-receipts:
+		if receipt.Type != ReceiptFailed || receipt.Version != 4 {
+			t.Errorf("Wrong receipt: %#v", receipt)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("Timed out waiting for receipt")
+	}
+}
+
+func Test_ReceiptHubDeliveredOnAck(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+	_, app := newTestHandler(t)
+	hub := NewReceiptHub()
+	if err := hub.Init(app, hub.ConfigStruct()); err != nil {
+		t.Fatalf("Error initializing receipt hub: %s", err)
+	}
+	defer hub.Close()
+	pk, _ := app.Store().IDsToKey(uaid, chid)
+	receipts, _ := hub.Subscribe(pk)
+	defer hub.Unsubscribe(pk, receipts)
+
+	// Writing an update to the socket is not a delivery.
+	app.Events().Publish(&Event{Type: EventUpdateDelivered, UAID: uaid,
+		ChannelID: chid, Version: 1})
+	select {
+	case receipt := <-receipts:
+		t.Fatalf("Unexpected receipt before acknowledgement: %#v", receipt)
+	default:
+	}
+
+	app.Events().Publish(&Event{Type: EventUpdateAcked, UAID: uaid,
+		ChannelID: chid, Version: 1})
+	select {
+	case receipt := <-receipts:
+		if receipt.Type != ReceiptDelivered || receipt.Version != 1 {
+			t.Errorf("Wrong receipt: %#v", receipt)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("Timed out waiting for receipt")
+	}
+}
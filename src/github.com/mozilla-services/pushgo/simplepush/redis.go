@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var errRedisProtocol = errors.New("Malformed Redis reply")
+
+// RedisError is an error reply from a Redis server.
+type RedisError string
+
+func (err RedisError) Error() string { return string(err) }
+
+// redisConn is a minimal Redis client connection, speaking the RESP
+// protocol. It supports the commands used by the Redis broker; replies are
+// returned as strings, []byte bulk strings, int64 integers, nil, or
+// []interface{} arrays.
+type redisConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+// dialRedis connects to a Redis server, authenticating if a password is
+// given.
+func dialRedis(addr, password string, timeout time.Duration) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+	if len(password) > 0 {
+		if _, err = c.Do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and waits for the reply.
+func (c *redisConn) Do(args ...interface{}) (reply interface{}, err error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err = c.Send(args...); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// Send writes a command without waiting for the reply.
+func (c *redisConn) Send(args ...interface{}) (err error) {
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch arg := arg.(type) {
+		case string:
+			b = []byte(arg)
+		case []byte:
+			b = arg
+		default:
+			b = []byte(fmt.Sprint(arg))
+		}
+		fmt.Fprintf(c.writer, "$%d\r\n", len(b))
+		c.writer.Write(b)
+		c.writer.WriteString("\r\n")
+	}
+	return c.writer.Flush()
+}
+
+// Receive reads a reply. Error replies are returned as RedisErrors.
+func (c *redisConn) Receive() (reply interface{}, err error) {
+	if reply, err = c.readReply(); err != nil {
+		return nil, err
+	}
+	if err, ok := reply.(RedisError); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return RedisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,281 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type RedisBrokerConfig struct {
+	// Server is the address of the Redis server. Defaults to
+	// "127.0.0.1:6379".
+	Server string `env:"server"`
+
+	// Password authenticates with the server, if set.
+	Password string `env:"password"`
+
+	// Prefix is prepended to channel names. Defaults to "pushgo:".
+	Prefix string `env:"prefix"`
+
+	// PrefixLen is the number of leading device ID characters used to name
+	// channels. Devices that share a prefix share a channel, which bounds
+	// the number of subscriptions per node. Defaults to 2.
+	PrefixLen int `toml:"prefix_len" env:"prefix_len"`
+
+	// Timeout is the maximum amount of time to wait for a command.
+	Timeout string `env:"timeout"`
+
+	// ReconnectDelay is the amount of time to wait before reconnecting a
+	// dropped subscription.
+	ReconnectDelay string `toml:"reconnect_delay" env:"reconnect_delay"`
+}
+
+// RedisBroker routes updates through Redis pub/sub channels keyed by device
+// ID prefix. Each node subscribes to the channels of its connected devices;
+// nodes that receive an update for a device connected elsewhere ignore it.
+// This avoids node discovery entirely, at the cost of fan-out on shared
+// channels, so it suits small clusters.
+type RedisBroker struct {
+	logger         *SimpleLogger
+	metrics        Statistician
+	server         string
+	password       string
+	prefix         string
+	prefixLen      int
+	timeout        time.Duration
+	reconnectDelay time.Duration
+	deliver        func([]byte) bool
+
+	pubLock sync.Mutex
+	pub     *redisConn
+
+	subLock  sync.Mutex // Guards sub and channels.
+	sub      *redisConn
+	channels map[string]int // Subscribed devices per channel.
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewRedisBroker() *RedisBroker {
+	return &RedisBroker{
+		channels:    make(map[string]int),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*RedisBroker) ConfigStruct() interface{} {
+	return &RedisBrokerConfig{
+		Server:         "127.0.0.1:6379",
+		Prefix:         "pushgo:",
+		PrefixLen:      2,
+		Timeout:        "3s",
+		ReconnectDelay: "1s",
+	}
+}
+
+// Init connects to Redis. Updates received on subscribed channels are passed
+// to deliver.
+func (b *RedisBroker) Init(app *Application, config interface{},
+	deliver func([]byte) bool) (err error) {
+
+	conf := config.(*RedisBrokerConfig)
+	b.logger = app.Logger()
+	b.metrics = app.Metrics()
+	b.server = conf.Server
+	b.password = conf.Password
+	b.prefix = conf.Prefix
+	b.prefixLen = conf.PrefixLen
+	b.deliver = deliver
+
+	if b.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		b.logger.Panic("redis", "Could not parse timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	if b.reconnectDelay, err = time.ParseDuration(conf.ReconnectDelay); err != nil {
+		b.logger.Panic("redis", "Could not parse reconnect delay",
+			LogFields{"error": err.Error(), "delay": conf.ReconnectDelay})
+		return err
+	}
+	if b.sub, err = dialRedis(b.server, b.password, b.timeout); err != nil {
+		b.logger.Panic("redis", "Could not connect to Redis",
+			LogFields{"error": err.Error(), "server": b.server})
+		return err
+	}
+	b.closeWait.Add(1)
+	go b.receiveLoop(b.sub)
+	return nil
+}
+
+// channel returns the name of the device's channel.
+func (b *RedisBroker) channel(uaid string) string {
+	if b.prefixLen > 0 && len(uaid) > b.prefixLen {
+		uaid = uaid[:b.prefixLen]
+	}
+	return b.prefix + uaid
+}
+
+// Publish implements Broker.Publish.
+func (b *RedisBroker) Publish(uaid string, payload []byte) (received bool, err error) {
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	if b.pub == nil {
+		if b.pub, err = dialRedis(b.server, b.password, b.timeout); err != nil {
+			b.metrics.Increment("router.redis.error")
+			return false, err
+		}
+	}
+	reply, err := b.pub.Do("PUBLISH", b.channel(uaid), payload)
+	if err != nil {
+		if _, ok := err.(RedisError); !ok {
+			// Reconnect on the next publish.
+			b.pub.Close()
+			b.pub = nil
+		}
+		b.metrics.Increment("router.redis.error")
+		return false, err
+	}
+	receivers, _ := reply.(int64)
+	b.metrics.Increment("router.redis.published")
+	return receivers > 0, nil
+}
+
+// Subscribe implements Broker.Subscribe.
+func (b *RedisBroker) Subscribe(uaid string) error {
+	channel := b.channel(uaid)
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	b.channels[channel]++
+	if b.channels[channel] > 1 || b.sub == nil {
+		// Already subscribed, or the channel will be subscribed on reconnect.
+		return nil
+	}
+	return b.sub.Send("SUBSCRIBE", channel)
+}
+
+// Unsubscribe implements Broker.Unsubscribe.
+func (b *RedisBroker) Unsubscribe(uaid string) error {
+	channel := b.channel(uaid)
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	if b.channels[channel] > 1 {
+		b.channels[channel]--
+		return nil
+	}
+	delete(b.channels, channel)
+	if b.sub == nil {
+		return nil
+	}
+	return b.sub.Send("UNSUBSCRIBE", channel)
+}
+
+// Status implements Broker.Status.
+func (b *RedisBroker) Status() (bool, error) {
+	conn, err := dialRedis(b.server, b.password, b.timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Do("PING"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Close implements Broker.Close.
+func (b *RedisBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closeSignal)
+		b.subLock.Lock()
+		if b.sub != nil {
+			b.sub.Close()
+		}
+		b.subLock.Unlock()
+		b.closeWait.Wait()
+		b.pubLock.Lock()
+		if b.pub != nil {
+			b.pub.Close()
+			b.pub = nil
+		}
+		b.pubLock.Unlock()
+	})
+	return nil
+}
+
+// receiveLoop reads messages from the subscription connection,
+// reconnecting and resubscribing if the connection drops.
+func (b *RedisBroker) receiveLoop(conn *redisConn) {
+	defer b.closeWait.Done()
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			if conn = b.reconnect(err); conn == nil {
+				return
+			}
+			continue
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			// Subscription confirmations.
+			continue
+		}
+		if payload, ok := items[2].([]byte); ok {
+			b.metrics.Increment("router.redis.received")
+			b.deliver(payload)
+		}
+	}
+}
+
+// reconnect replaces a dropped subscription connection. Returns nil if the
+// broker is closing.
+func (b *RedisBroker) reconnect(cause error) *redisConn {
+	b.subLock.Lock()
+	b.sub = nil
+	b.subLock.Unlock()
+	for {
+		select {
+		case <-b.closeSignal:
+			return nil
+		default:
+		}
+		if b.logger.ShouldLog(WARNING) {
+			b.logger.Warn("redis", "Subscription dropped; reconnecting",
+				LogFields{"error": cause.Error()})
+		}
+		b.metrics.Increment("router.redis.reconnect")
+		select {
+		case <-b.closeSignal:
+			return nil
+		case <-time.After(b.reconnectDelay):
+		}
+		conn, err := dialRedis(b.server, b.password, b.timeout)
+		if err != nil {
+			cause = err
+			continue
+		}
+		b.subLock.Lock()
+		for channel := range b.channels {
+			if err = conn.Send("SUBSCRIBE", channel); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			b.sub = conn
+		}
+		b.subLock.Unlock()
+		if err != nil {
+			conn.Close()
+			cause = err
+			continue
+		}
+		return conn
+	}
+}
@@ -0,0 +1,245 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+// testRedisServer implements the pub/sub subset of the Redis protocol.
+type testRedisServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	subs     map[string]map[*redisConn]bool
+}
+
+func newTestRedisServer(t *testing.T) *testRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting test Redis server: %s", err)
+	}
+	s := &testRedisServer{
+		listener: listener,
+		subs:     make(map[string]map[*redisConn]bool),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testRedisServer) Addr() string { return s.listener.Addr().String() }
+func (s *testRedisServer) Close()       { s.listener.Close() }
+
+func (s *testRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &redisConn{conn: conn, reader: bufio.NewReader(conn),
+			writer: bufio.NewWriter(conn)}
+		go s.handle(c)
+	}
+}
+
+func (s *testRedisServer) handle(c *redisConn) {
+	defer c.Close()
+	for {
+		reply, err := c.Receive()
+		if err != nil {
+			s.lock.Lock()
+			for _, conns := range s.subs {
+				delete(conns, c)
+			}
+			s.lock.Unlock()
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		cmd, _ := args[0].([]byte)
+		s.lock.Lock()
+		switch string(cmd) {
+		case "PING":
+			c.writer.WriteString("+PONG\r\n")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			channel := string(args[1].([]byte))
+			if string(cmd) == "SUBSCRIBE" {
+				if s.subs[channel] == nil {
+					s.subs[channel] = make(map[*redisConn]bool)
+				}
+				s.subs[channel][c] = true
+			} else {
+				delete(s.subs[channel], c)
+			}
+			c.Send(strings.ToLower(string(cmd)), channel, 1)
+		case "PUBLISH":
+			channel, payload := string(args[1].([]byte)), args[2].([]byte)
+			for sub := range s.subs[channel] {
+				sub.Send("message", channel, payload)
+			}
+			c.writer.WriteString(":" + strconv.Itoa(len(s.subs[channel])) + "\r\n")
+		default:
+			c.writer.WriteString("-ERR unknown command\r\n")
+		}
+		c.writer.Flush()
+		s.lock.Unlock()
+	}
+}
+
+func TestBrokerMessage(t *testing.T) {
+	segment := capn.NewBuffer(nil)
+	routable := NewRootRoutable(segment)
+	routable.SetChannelID("chid")
+	routable.SetVersion(5)
+	message, err := encodeBrokerMessage("uaid", segment)
+	if err != nil {
+		t.Fatalf("Error encoding message: %s", err)
+	}
+	uaid, decoded, err := decodeBrokerMessage(message)
+	if err != nil {
+		t.Fatalf("Error decoding message: %s", err)
+	}
+	routable = ReadRootRoutable(decoded)
+	if uaid != "uaid" || routable.ChannelID() != "chid" || routable.Version() != 5 {
+		t.Errorf("Wrong message: uaid %q, chid %q, version %d", uaid,
+			routable.ChannelID(), routable.Version())
+	}
+	if _, _, err = decodeBrokerMessage([]byte("garbage")); err == nil {
+		t.Errorf("Expected error decoding malformed message")
+	}
+}
+
+func TestRedisBroker(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	other := "de000000000000000000000000000000"
+
+	server := newTestRedisServer(t)
+	defer server.Close()
+	_, app := newTestHandler(t)
+
+	received := make(chan []byte, 10)
+	subscriber := NewRedisBroker()
+	conf := subscriber.ConfigStruct().(*RedisBrokerConfig)
+	conf.Server = server.Addr()
+	if err := subscriber.Init(app, conf, func(m []byte) bool { received <- m; return true }); err != nil {
+		t.Fatalf("Error initializing subscriber: %s", err)
+	}
+	defer subscriber.Close()
+	publisher := NewRedisBroker()
+	if err := publisher.Init(app, conf, func([]byte) bool { return false }); err != nil {
+		t.Fatalf("Error initializing publisher: %s", err)
+	}
+	defer publisher.Close()
+
+	if ok, err := publisher.Status(); !ok {
+		t.Errorf("Expected broker to be healthy: %s", err)
+	}
+	if ok, _ := publisher.Publish(uaid, []byte("early")); ok {
+		t.Errorf("Expected publish without subscribers to be unreceived")
+	}
+
+	// Devices sharing a prefix share a channel.
+	subscriber.Subscribe(uaid)
+	subscriber.Subscribe(other)
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		ok, _ = publisher.Publish(uaid, []byte("hello"))
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !ok {
+		t.Fatalf("Expected publish to reach subscriber")
+	}
+	select {
+	case m := <-received:
+		if string(m) != "hello" {
+			t.Errorf("Wrong message: %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	// The channel stays subscribed until the last device leaves.
+	subscriber.Unsubscribe(uaid)
+	if ok, _ := publisher.Publish(other, []byte("still")); !ok {
+		t.Errorf("Expected shared channel to remain subscribed")
+	}
+	subscriber.Unsubscribe(other)
+	for i := 0; i < 100 && ok; i++ {
+		ok, _ = publisher.Publish(other, []byte("gone"))
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ok {
+		t.Errorf("Expected channel to be unsubscribed")
+	}
+}
+
+// recordingBroker records subscription changes.
+type recordingBroker struct {
+	lock sync.Mutex
+	ops  []string
+}
+
+func (b *recordingBroker) Publish(string, []byte) (bool, error) { return false, nil }
+func (b *recordingBroker) Status() (bool, error)                { return true, nil }
+func (b *recordingBroker) Close() error                         { return nil }
+
+func (b *recordingBroker) Subscribe(uaid string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ops = append(b.ops, "+"+uaid)
+	return nil
+}
+
+func (b *recordingBroker) Unsubscribe(uaid string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ops = append(b.ops, "-"+uaid)
+	return nil
+}
+
+func Test_RouterSubscriptionOrder(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	_, app := newTestHandler(t)
+	broker := new(recordingBroker)
+	router := NewRouter()
+	router.logger = app.Logger()
+	router.broker = broker
+	router.watchClients(app)
+	defer func() {
+		close(router.closeSignal)
+		router.closeWait.Wait()
+	}()
+
+	// Reconnects must not leave the device unsubscribed.
+	const reconnects = 100
+	for i := 0; i < reconnects; i++ {
+		app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
+		app.Events().Publish(&Event{Type: EventClientDisconnected, UAID: uaid})
+	}
+	app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
+	waitFor(t, "subscriptions", func() bool {
+		broker.lock.Lock()
+		defer broker.lock.Unlock()
+		return len(broker.ops) == 2*reconnects+1
+	})
+	for i, op := range broker.ops {
+		expected := "+" + uaid
+		if i%2 == 1 {
+			expected = "-" + uaid
+		}
+		if op != expected {
+			t.Fatalf("Wrong subscription change %d: got %q; want %q", i, op, expected)
+		}
+	}
+}
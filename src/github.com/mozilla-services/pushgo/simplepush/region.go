@@ -0,0 +1,316 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+// HeaderRelay names the region that relayed an update to a gateway.
+const HeaderRelay = "X-Pushgo-Relay"
+
+type RegionConfig struct {
+	// Name is the region of the current node. Region awareness is disabled
+	// if no name is set.
+	Name string `env:"name"`
+
+	// Zone is the availability zone of the current node. Peers in the same
+	// zone are tried first.
+	Zone string `env:"zone"`
+
+	// Gateway indicates whether the current node accepts updates relayed from
+	// other regions.
+	Gateway bool `env:"gateway"`
+
+	// Gateways lists the routing URLs of gateway nodes in other regions, as
+	// "region=url" pairs. Gateways for the same region are tried in order.
+	Gateways []string `env:"gateways"`
+
+	// Compress gzips relayed updates. Defaults to true.
+	Compress bool `env:"compress"`
+
+	// RefreshInterval is the amount of time to wait between fetching the
+	// region tags of the locator's contacts. Defaults to 1 minute.
+	RefreshInterval string `toml:"refresh_interval" env:"refresh_interval"`
+}
+
+// PeerTag describes the location of a node. Returned by the region
+// endpoint of the routing listener.
+type PeerTag struct {
+	Region  string `json:"region"`
+	Zone    string `json:"zone,omitempty"`
+	Gateway bool   `json:"gateway,omitempty"`
+}
+
+// Regions tags peers with their region and zone, so that routers prefer
+// peers in the same zone and region, and only reach other regions through
+// designated gateway nodes. Peers that have not reported a tag are assumed
+// to be in the current region.
+type Regions struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	router   *Router
+	local    PeerTag
+	regions  []string            // Remote regions, in sorted order.
+	gateways map[string][]string // Gateway URLs by remote region.
+	compress bool
+	interval time.Duration
+	client   *http.Client
+
+	lock sync.RWMutex
+	tags map[string]PeerTag // Peer tags by routing URL.
+}
+
+func NewRegions() *Regions {
+	return &Regions{
+		gateways: make(map[string][]string),
+		tags:     make(map[string]PeerTag),
+	}
+}
+
+func (*Regions) ConfigStruct() interface{} {
+	return &RegionConfig{
+		Compress:        true,
+		RefreshInterval: "1m",
+	}
+}
+
+// Init configures region awareness for the given router.
+func (g *Regions) Init(app *Application, config interface{}, router *Router) (err error) {
+	conf := config.(*RegionConfig)
+	g.logger = app.Logger()
+	g.metrics = app.Metrics()
+	g.router = router
+	g.local = PeerTag{Region: conf.Name, Zone: conf.Zone, Gateway: conf.Gateway}
+	g.compress = conf.Compress
+	if !g.Enabled() {
+		return nil
+	}
+	for _, pair := range conf.Gateways {
+		i := strings.Index(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			err = fmt.Errorf("Malformed region gateway: %q", pair)
+			g.logger.Panic("router", "Could not configure regions",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		region, gateway := pair[:i], strings.TrimRight(pair[i+1:], "/")
+		if region == g.local.Region {
+			continue
+		}
+		if _, ok := g.gateways[region]; !ok {
+			g.regions = append(g.regions, region)
+		}
+		g.gateways[region] = append(g.gateways[region], gateway)
+	}
+	sort.Strings(g.regions)
+	if g.interval, err = time.ParseDuration(conf.RefreshInterval); err != nil {
+		g.logger.Panic("router", "Could not parse region refresh interval",
+			LogFields{"error": err.Error(), "interval": conf.RefreshInterval})
+		return err
+	}
+	g.client = router.HTTPClient(router.rwtimeout)
+	return nil
+}
+
+// Enabled indicates whether region awareness is enabled.
+func (g *Regions) Enabled() bool {
+	return g != nil && len(g.local.Region) > 0
+}
+
+// Local returns the tag of the current node.
+func (g *Regions) Local() PeerTag {
+	if g == nil {
+		return PeerTag{}
+	}
+	return g.local
+}
+
+// IsGateway indicates whether the current node accepts relayed updates.
+func (g *Regions) IsGateway() bool {
+	return g.Enabled() && g.local.Gateway
+}
+
+// SetTag records a peer's tag.
+func (g *Regions) SetTag(contact string, tag PeerTag) {
+	g.lock.Lock()
+	g.tags[contact] = tag
+	g.lock.Unlock()
+}
+
+// Tag returns a peer's tag, if known.
+func (g *Regions) Tag(contact string) (tag PeerTag, ok bool) {
+	g.lock.RLock()
+	tag, ok = g.tags[contact]
+	g.lock.RUnlock()
+	return
+}
+
+// Nearby indicates whether a peer may be contacted directly: that is, if
+// region awareness is disabled, or the peer is not known to be in another
+// region.
+func (g *Regions) Nearby(contact string) bool {
+	if !g.Enabled() {
+		return true
+	}
+	tag, ok := g.Tag(contact)
+	return !ok || len(tag.Region) == 0 || tag.Region == g.local.Region
+}
+
+// Sort removes contacts in other regions, and orders the rest by proximity:
+// peers in the same zone, then the same region, then untagged peers.
+func (g *Regions) Sort(contacts []string) []string {
+	if !g.Enabled() {
+		return contacts
+	}
+	sorted := make([]string, 0, len(contacts))
+	var region, untagged []string
+	g.lock.RLock()
+	for _, contact := range contacts {
+		tag, ok := g.tags[contact]
+		switch {
+		case !ok || len(tag.Region) == 0:
+			untagged = append(untagged, contact)
+		case tag.Region != g.local.Region:
+			// Reached through a gateway.
+		case len(g.local.Zone) > 0 && tag.Zone == g.local.Zone:
+			sorted = append(sorted, contact)
+		default:
+			region = append(region, contact)
+		}
+	}
+	g.lock.RUnlock()
+	sorted = append(sorted, region...)
+	return append(sorted, untagged...)
+}
+
+// Relay offers an update to the gateways of each remote region, stopping
+// at the first gateway that accepts it. Returns the accepting gateway.
+func (g *Regions) Relay(uaid string, segment *capn.Segment, logID string) (
+	accepted string) {
+
+	if !g.Enabled() || len(g.regions) == 0 {
+		return ""
+	}
+	body := new(bytes.Buffer)
+	if g.compress {
+		writer := gzip.NewWriter(body)
+		segment.WriteTo(writer)
+		writer.Close()
+	} else {
+		segment.WriteTo(body)
+	}
+	for _, region := range g.regions {
+		for _, gateway := range g.gateways[region] {
+			if g.relayTo(gateway, uaid, body.Bytes(), logID) {
+				g.metrics.Increment("router.region.relay.hit")
+				return gateway
+			}
+		}
+	}
+	g.metrics.Increment("router.region.relay.miss")
+	return ""
+}
+
+func (g *Regions) relayTo(gateway, uaid string, body []byte,
+	logID string) (ok bool) {
+
+	req, err := g.router.NewPeerRequest("PUT", gateway+"/relay/"+uaid, body)
+	if err != nil {
+		return false
+	}
+	req.Header.Set(HeaderID, logID)
+	req.Header.Set(HeaderRelay, g.local.Region)
+	if g.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		if g.logger.ShouldLog(WARNING) {
+			g.logger.Warn("router", "Could not relay update to gateway",
+				LogFields{"rid": logID, "gateway": gateway, "error": err.Error()})
+		}
+		g.metrics.Increment("router.region.relay.error")
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Refresh fetches the tags of the locator's contacts, and forgets peers
+// that are no longer listed.
+func (g *Regions) Refresh() {
+	locator := g.router.Locator()
+	if locator == nil {
+		return
+	}
+	contacts, err := locator.Contacts("")
+	if err != nil {
+		if g.logger.ShouldLog(WARNING) {
+			g.logger.Warn("router", "Could not refresh region tags",
+				LogFields{"error": err.Error()})
+		}
+		g.metrics.Increment("router.region.refresh.error")
+		return
+	}
+	tags := make(map[string]PeerTag, len(contacts))
+	for _, contact := range contacts {
+		tag, err := g.fetchTag(contact)
+		if err != nil {
+			// Keep the last known tag.
+			if tag, ok := g.Tag(contact); ok {
+				tags[contact] = tag
+			}
+			g.metrics.Increment("router.region.refresh.error")
+			continue
+		}
+		tags[contact] = tag
+	}
+	g.lock.Lock()
+	g.tags = tags
+	g.lock.Unlock()
+	g.metrics.Gauge("router.region.peers", int64(len(tags)))
+}
+
+func (g *Regions) fetchTag(contact string) (tag PeerTag, err error) {
+	req, err := g.router.NewPeerRequest("GET", contact+"/region", nil)
+	if err != nil {
+		return tag, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return tag, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tag, fmt.Errorf("Unexpected region response: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tag)
+	return tag, err
+}
+
+func (g *Regions) refreshLoop(closeSignal <-chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	g.Refresh()
+	ticker := time.NewTicker(g.interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-closeSignal:
+		case <-ticker.C:
+			g.Refresh()
+		}
+	}
+	ticker.Stop()
+}
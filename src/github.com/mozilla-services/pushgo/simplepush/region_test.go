@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+func TestRegionsSort(t *testing.T) {
+	_, app := newTestHandler(t)
+	regions := NewRegions()
+	conf := regions.ConfigStruct().(*RegionConfig)
+	conf.Name = "us-east"
+	conf.Zone = "us-east-1a"
+	conf.Gateways = []string{"us-west=http://gw-west:3000/", "us-east=http://gw-east:3000"}
+	if err := regions.Init(app, conf, &Router{rwtimeout: time.Second}); err != nil {
+		t.Fatalf("Error initializing regions: %s", err)
+	}
+	regions.SetTag("http://a:3000", PeerTag{Region: "us-east", Zone: "us-east-1b"})
+	regions.SetTag("http://b:3000", PeerTag{Region: "us-west", Zone: "us-west-1a"})
+	regions.SetTag("http://c:3000", PeerTag{Region: "us-east", Zone: "us-east-1a"})
+
+	contacts := []string{"http://a:3000", "http://b:3000", "http://c:3000", "http://d:3000"}
+	expected := []string{"http://c:3000", "http://a:3000", "http://d:3000"}
+	if sorted := regions.Sort(contacts); !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("Wrong contact order: got %v; want %v", sorted, expected)
+	}
+	if regions.Nearby("http://b:3000") {
+		t.Errorf("Expected peer in another region to be remote")
+	}
+	if !regions.Nearby("http://d:3000") {
+		t.Errorf("Expected untagged peer to be nearby")
+	}
+	if !reflect.DeepEqual(regions.gateways, map[string][]string{
+		"us-west": {"http://gw-west:3000"}}) {
+		t.Errorf("Wrong gateways: %v", regions.gateways)
+	}
+}
+
+func Test_RouterRegionRelay(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	tags := []PeerTag{{Region: "us-east"}, {Region: "us-west"}}
+	var requests [2]int32
+	contacts := make([]string, 2)
+	for i := range tags {
+		i := i
+		peer := httptest.NewServer(http.HandlerFunc(
+			func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/region" {
+					json.NewEncoder(resp).Encode(tags[i])
+					return
+				}
+				atomic.AddInt32(&requests[i], 1)
+				http.NotFound(resp, req)
+			}))
+		defer peer.Close()
+		contacts[i] = peer.URL
+	}
+	relayed := make(chan string, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/relay/"+uaid || req.Header.Get(HeaderRelay) != "us-east" ||
+				req.Header.Get("Content-Encoding") != "gzip" {
+				http.Error(resp, "Bad relay", http.StatusBadRequest)
+				return
+			}
+			reader, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(resp, "Bad body", http.StatusBadRequest)
+				return
+			}
+			segment, err := capn.ReadFromStream(reader, nil)
+			if err != nil {
+				http.Error(resp, "Bad body", http.StatusBadRequest)
+				return
+			}
+			relayed <- ReadRootRoutable(segment).ChannelID()
+		}))
+	defer gateway.Close()
+
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.Region.Name = "us-east"
+	conf.Region.Gateways = []string{"us-west=" + gateway.URL}
+	if err := router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&StaticLocator{contacts: contacts})
+	router.Regions().Refresh()
+
+	err := router.Route(nil, uaid, chid, 1, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	select {
+	case relayedID := <-relayed:
+		if relayedID != chid {
+			t.Errorf("Wrong relayed channel ID: %q", relayedID)
+		}
+	default:
+		t.Fatalf("Expected update to be relayed to gateway")
+	}
+	if n := atomic.LoadInt32(&requests[0]); n != 1 {
+		t.Errorf("Wrong number of requests to local peer: got %d; want 1", n)
+	}
+	if n := atomic.LoadInt32(&requests[1]); n != 0 {
+		t.Errorf("Expected remote peer to be skipped; got %d requests", n)
+	}
+}
@@ -0,0 +1,395 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// Client registry types.
+const (
+	RegistryStore = "store"
+	RegistryEtcd  = "etcd"
+	RegistryHTTP  = "http"
+	RegistryNone  = "none"
+)
+
+// ClientRegistry records which node holds each live device connection, so
+// that updates can be routed directly to that node instead of broadcast to
+// every peer.
+type ClientRegistry interface {
+	// Register records the routing URL of the node connected to the device.
+	Register(uaid, node string) error
+
+	// Unregister removes the device's entry if it still points to node.
+	Unregister(uaid, node string) error
+
+	// Lookup returns the routing URL of the node connected to the device, or
+	// an empty string if the device is not registered.
+	Lookup(uaid string) (node string, err error)
+
+	// Close releases the registry's resources.
+	Close() error
+}
+
+// RegistryEntry is the body of the registry lookup endpoint.
+type RegistryEntry struct {
+	UAID string `json:"uaid"`
+	Node string `json:"node"`
+}
+
+type RegistryConfig struct {
+	// Type is one of "store", to record connections with the storage adapter,
+	// if supported; "etcd", to record connections as etcd keys that expire
+	// unless refreshed; "http", to query another node's registry endpoint; or
+	// "none", to only use routes learned by this node. Defaults to "store".
+	Type string `env:"type"`
+
+	// URL is the routing URL of the node whose registry endpoint is queried,
+	// used if Type is "http".
+	URL string `env:"url"`
+
+	// Etcd configures the etcd registry, used if Type is "etcd".
+	Etcd EtcdRegistryConfig
+}
+
+type EtcdRegistryConfig struct {
+	// Servers is a list of etcd servers.
+	Servers []string `env:"servers"`
+
+	// Dir is the etcd key prefix for device entries. Defaults to
+	// "push_clients".
+	Dir string `env:"dir"`
+
+	// TTL is the lease time of each entry. Entries for connected devices are
+	// refreshed at half this interval, so entries for devices held by a node
+	// that exits without unregistering expire. Defaults to 10 minutes.
+	TTL string `env:"ttl"`
+
+	// Refreshers is the number of leases refreshed concurrently. Defaults
+	// to 16.
+	Refreshers int `env:"refreshers"`
+}
+
+// newClientRegistry returns the registry selected by the configuration, or
+// nil if routes should not be shared. client is used to query other nodes.
+func newClientRegistry(app *Application, conf *RegistryConfig,
+	client *http.Client) (registry ClientRegistry, err error) {
+
+	switch strings.ToLower(conf.Type) {
+	case "", RegistryStore:
+		if store, ok := app.Store().(RouteStore); ok {
+			return &StoreRegistry{store}, nil
+		}
+		if app.Logger().ShouldLog(WARNING) {
+			app.Logger().Warn("router", "Storage adapter does not record routes; "+
+				"updates are sent to every contact", nil)
+		}
+		return nil, nil
+	case RegistryNone:
+		return nil, nil
+	case RegistryHTTP:
+		if len(conf.URL) == 0 {
+			err = fmt.Errorf("Missing registry URL")
+			break
+		}
+		return &HTTPRegistry{url: strings.TrimRight(conf.URL, "/"),
+			app: app, client: client}, nil
+	case RegistryEtcd:
+		etcdRegistry := NewEtcdRegistry()
+		if err = etcdRegistry.Init(app, &conf.Etcd); err != nil {
+			return nil, err
+		}
+		return etcdRegistry, nil
+	default:
+		err = fmt.Errorf("Unknown registry type: %q", conf.Type)
+	}
+	app.Logger().Panic("router", "Could not configure client registry",
+		LogFields{"error": err.Error()})
+	return nil, err
+}
+
+// StoreRegistry records connections with a storage adapter that implements
+// RouteStore.
+type StoreRegistry struct {
+	store RouteStore
+}
+
+func (r *StoreRegistry) Register(uaid, node string) error {
+	return r.store.PutRoute(uaid, node)
+}
+
+func (r *StoreRegistry) Unregister(uaid, node string) error {
+	return r.store.DropRoute(uaid, node)
+}
+
+func (r *StoreRegistry) Lookup(uaid string) (string, error) {
+	return r.store.FetchRoute(uaid)
+}
+
+func (r *StoreRegistry) Close() error {
+	return nil
+}
+
+// HTTPRegistry uses the registry endpoint of another node's routing
+// listener. Useful for nodes without access to the shared registry.
+type HTTPRegistry struct {
+	url    string
+	app    *Application
+	client *http.Client
+}
+
+func (r *HTTPRegistry) do(method, uaid string, entry *RegistryEntry) (
+	resp *http.Response, err error) {
+
+	var body []byte
+	if entry != nil {
+		if body, err = json.Marshal(entry); err != nil {
+			return nil, err
+		}
+	}
+	req, err := r.app.Router().NewPeerRequest(method,
+		r.url+"/registry/"+url.QueryEscape(uaid), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return r.client.Do(req)
+}
+
+func (r *HTTPRegistry) Register(uaid, node string) error {
+	resp, err := r.do("PUT", uaid, &RegistryEntry{UAID: uaid, Node: node})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected registry response: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *HTTPRegistry) Unregister(uaid, node string) error {
+	resp, err := r.do("DELETE", uaid, &RegistryEntry{UAID: uaid, Node: node})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Unexpected registry response: %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *HTTPRegistry) Lookup(uaid string) (node string, err error) {
+	resp, err := r.do("GET", uaid, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected registry response: %s", resp.Status)
+	}
+	entry := new(RegistryEntry)
+	if err = json.NewDecoder(resp.Body).Decode(entry); err != nil {
+		return "", err
+	}
+	return entry.Node, nil
+}
+
+func (r *HTTPRegistry) Close() error {
+	return nil
+}
+
+// EtcdRegistry records connections as etcd keys with a TTL. Keys for devices
+// registered by this node are refreshed until they are unregistered.
+type EtcdRegistry struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	client     *etcd.Client
+	dir        string
+	ttl        time.Duration
+	refreshers int
+
+	lock  sync.Mutex
+	local map[string]string // Nodes of devices registered by this process.
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewEtcdRegistry() *EtcdRegistry {
+	return &EtcdRegistry{
+		local:       make(map[string]string),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*EtcdRegistry) ConfigStruct() interface{} {
+	return &EtcdRegistryConfig{
+		Servers:    []string{"http://localhost:4001"},
+		Dir:        "push_clients",
+		TTL:        "10m",
+		Refreshers: 16,
+	}
+}
+
+func (r *EtcdRegistry) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*EtcdRegistryConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.dir = path.Clean(conf.Dir)
+
+	if r.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		r.logger.Panic("etcd", "Could not parse registry TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	if r.ttl < minTTL {
+		r.logger.Panic("etcd", "Registry TTL too short",
+			LogFields{"ttl": conf.TTL})
+		return ErrMinTTL
+	}
+	if r.refreshers = conf.Refreshers; r.refreshers < 1 {
+		r.refreshers = 1
+	}
+	etcd.SetLogger(log.New(&LogWriter{r.logger, "etcd", DEBUG}, "", 0))
+	r.client = etcd.NewClient(conf.Servers)
+	if _, err = r.client.CreateDir(r.dir, 0); err != nil && !IsEtcdKeyExist(err) {
+		r.logger.Panic("etcd", "Could not create registry directory",
+			LogFields{"error": err.Error(), "dir": r.dir})
+		return err
+	}
+	r.closeWait.Add(1)
+	go r.refreshLoop()
+	return nil
+}
+
+func (r *EtcdRegistry) key(uaid string) string {
+	return path.Join(r.dir, uaid)
+}
+
+func (r *EtcdRegistry) Register(uaid, node string) error {
+	r.lock.Lock()
+	r.local[uaid] = node
+	r.lock.Unlock()
+	_, err := r.client.Set(r.key(uaid), node, uint64(r.ttl/time.Second))
+	return err
+}
+
+func (r *EtcdRegistry) Unregister(uaid, node string) error {
+	r.lock.Lock()
+	if r.local[uaid] == node {
+		delete(r.local, uaid)
+	}
+	r.lock.Unlock()
+	_, err := r.client.CompareAndDelete(r.key(uaid), node, 0)
+	if clientErr, ok := err.(*etcd.EtcdError); ok &&
+		(clientErr.ErrorCode == 100 || clientErr.ErrorCode == 101) {
+		// The key expired, or another node registered the device.
+		return nil
+	}
+	return err
+}
+
+func (r *EtcdRegistry) Lookup(uaid string) (node string, err error) {
+	resp, err := r.client.Get(r.key(uaid), false, false)
+	if clientErr, ok := err.(*etcd.EtcdError); ok && clientErr.ErrorCode == 100 {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+// registryEntry is a device registered by this process.
+type registryEntry struct {
+	uaid, node string
+}
+
+// refresh renews the leases of devices registered by this process, using
+// up to r.refreshers concurrent requests.
+func (r *EtcdRegistry) refresh() {
+	r.lock.Lock()
+	local := make([]registryEntry, 0, len(r.local))
+	for uaid, node := range r.local {
+		local = append(local, registryEntry{uaid, node})
+	}
+	r.lock.Unlock()
+	startTime := time.Now()
+	entries := make(chan registryEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < r.refreshers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				r.refreshEntry(entry)
+			}
+		}()
+	}
+	func() {
+		defer close(entries)
+		for _, entry := range local {
+			select {
+			case entries <- entry:
+			case <-r.closeSignal:
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	r.metrics.Gauge("router.registry.local", int64(len(local)))
+	r.metrics.Timer("router.registry.refresh", time.Since(startTime))
+}
+
+func (r *EtcdRegistry) refreshEntry(entry registryEntry) {
+	_, err := r.client.Set(r.key(entry.uaid), entry.node, uint64(r.ttl/time.Second))
+	if err == nil {
+		return
+	}
+	if r.logger.ShouldLog(WARNING) {
+		r.logger.Warn("etcd", "Could not refresh registry entry",
+			LogFields{"uaid": entry.uaid, "error": err.Error()})
+	}
+	r.metrics.Increment("router.registry.refresh.error")
+}
+
+func (r *EtcdRegistry) refreshLoop() {
+	defer r.closeWait.Done()
+	ticker := time.NewTicker(r.ttl / 2)
+	for ok := true; ok; {
+		select {
+		case ok = <-r.closeSignal:
+		case <-ticker.C:
+			r.refresh()
+		}
+	}
+	ticker.Stop()
+}
+
+// Close stops refreshing leases. Entries expire once their TTL elapses.
+func (r *EtcdRegistry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeSignal)
+		r.closeWait.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNewClientRegistry(t *testing.T) {
+	_, app := newTestHandler(t)
+	conf := &RegistryConfig{Type: RegistryStore}
+	if registry, _ := newClientRegistry(app, conf, http.DefaultClient); registry != nil {
+		t.Errorf("Expected no registry for store without routes; got %#v", registry)
+	}
+	newTestRouteStore(app)
+	if registry, _ := newClientRegistry(app, conf, http.DefaultClient); registry == nil {
+		t.Errorf("Expected store registry")
+	} else if _, ok := registry.(*StoreRegistry); !ok {
+		t.Errorf("Wrong registry type: %T", registry)
+	}
+	conf.Type = RegistryNone
+	if registry, _ := newClientRegistry(app, conf, http.DefaultClient); registry != nil {
+		t.Errorf("Expected no registry; got %#v", registry)
+	}
+	conf.Type = RegistryHTTP
+	conf.URL = "http://hub:3000/"
+	registry, err := newClientRegistry(app, conf, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Error creating HTTP registry: %s", err)
+	}
+	if httpRegistry, ok := registry.(*HTTPRegistry); !ok {
+		t.Errorf("Wrong registry type: %T", registry)
+	} else if httpRegistry.url != "http://hub:3000" {
+		t.Errorf("Wrong registry URL: %q", httpRegistry.url)
+	}
+}
+
+func TestHTTPRegistry(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	node := "http://node:3000"
+
+	handler, app := newTestHandler(t)
+	store := newTestRouteStore(app)
+	handler.router.Routes().SetRegistry(&StoreRegistry{store})
+	hubMux := mux.NewRouter()
+	hubMux.HandleFunc("/registry/{uaid}", handler.RegistryHandler)
+	hub := httptest.NewServer(hubMux)
+	defer hub.Close()
+
+	registry, err := newClientRegistry(app, &RegistryConfig{
+		Type: RegistryHTTP, URL: hub.URL}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Error creating HTTP registry: %s", err)
+	}
+	defer registry.Close()
+
+	if contact, err := registry.Lookup(uaid); err != nil || contact != "" {
+		t.Errorf("Expected unregistered device; got %q, %v", contact, err)
+	}
+	if err = registry.Register(uaid, node); err != nil {
+		t.Fatalf("Error registering device: %s", err)
+	}
+	if contact, _ := store.FetchRoute(uaid); contact != node {
+		t.Errorf("Expected hub to record node; got %q", contact)
+	}
+	if contact, err := registry.Lookup(uaid); err != nil || contact != node {
+		t.Errorf("Wrong node: got %q, %v; want %q", contact, err, node)
+	}
+	// Unregistering another node's entry leaves the entry in place.
+	if err = registry.Unregister(uaid, "http://other:3000"); err != nil {
+		t.Errorf("Error unregistering stale entry: %s", err)
+	}
+	if contact, _ := registry.Lookup(uaid); contact != node {
+		t.Errorf("Expected stale unregister to be ignored; got %q", contact)
+	}
+	if err = registry.Unregister(uaid, node); err != nil {
+		t.Errorf("Error unregistering device: %s", err)
+	}
+	if contact, _ := registry.Lookup(uaid); contact != "" {
+		t.Errorf("Expected device to be unregistered; got %q", contact)
+	}
+	if _, err = registry.Lookup("invalid"); err == nil {
+		t.Errorf("Expected error looking up invalid UAID")
+	}
+}
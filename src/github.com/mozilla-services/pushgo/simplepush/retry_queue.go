@@ -0,0 +1,264 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+type RetryQueueConfig struct {
+	// MaxSize is the maximum number of updates waiting to be retried. Updates
+	// that fail while the queue is full are left in storage until the device
+	// reconnects. Set to 0 to disable retries. Defaults to 1000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// Retries is the maximum number of times to retry each update. Defaults
+	// to 3.
+	Retries int `env:"retries"`
+
+	// Delay is the amount of time to wait before the first retry. The delay
+	// doubles for each subsequent retry. Defaults to 1 second.
+	Delay string `env:"delay"`
+
+	// MaxDelay is the maximum amount of time to wait between retries.
+	// Defaults to 30 seconds.
+	MaxDelay string `toml:"max_delay" env:"max_delay"`
+
+	// MaxJitter is the maximum randomized delay added to each retry.
+	// Defaults to 500ms.
+	MaxJitter string `toml:"max_jitter" env:"max_jitter"`
+}
+
+// routeRetry is an update waiting to be retried.
+type routeRetry struct {
+	uaid     string
+	segment  *capn.Segment
+	logID    string
+	priority RoutePriority
+	attempt  int
+	readyAt  time.Time
+}
+
+// retryHeap orders pending retries by the time they become ready.
+type retryHeap []*routeRetry
+
+func (h retryHeap) Len() int            { return len(h) }
+func (h retryHeap) Less(i, j int) bool  { return h[i].readyAt.Before(h[j].readyAt) }
+func (h retryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *retryHeap) Push(x interface{}) { *h = append(*h, x.(*routeRetry)) }
+
+func (h *retryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// RetryQueue holds updates that no node accepted because a node could not be
+// reached or failed with a server error, and routes them again with
+// exponential backoff and jitter. This covers transient peer failures
+// without waiting for the device to reconnect and fetch the update from
+// storage. The queue is bounded; retries in progress count toward its size.
+type RetryQueue struct {
+	logger  *SimpleLogger
+	metrics Statistician
+	rh      *retry.Helper
+	maxSize int
+	route   func(*routeRetry) (ok, retry bool)
+
+	lock     sync.Mutex // Guards the fields below.
+	pending  retryHeap
+	inFlight int
+	isClosed bool
+
+	wake        chan bool
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+}
+
+func NewRetryQueue() *RetryQueue {
+	return &RetryQueue{
+		wake:        make(chan bool, 1),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*RetryQueue) ConfigStruct() interface{} {
+	return &RetryQueueConfig{
+		MaxSize:   1000,
+		Retries:   3,
+		Delay:     "1s",
+		MaxDelay:  "30s",
+		MaxJitter: "500ms",
+	}
+}
+
+// Init configures the queue. route is called to retry each update, and
+// returns true if a node accepted it, or false and whether the update may
+// be accepted by a later attempt.
+func (q *RetryQueue) Init(app *Application, config interface{},
+	route func(*routeRetry) (ok, retry bool)) (err error) {
+
+	conf := config.(*RetryQueueConfig)
+	q.logger = app.Logger()
+	q.metrics = app.Metrics()
+	q.maxSize = conf.MaxSize
+	q.route = route
+	if !q.Enabled() {
+		return nil
+	}
+	retryConf := &retry.Config{
+		Retries:   conf.Retries,
+		Delay:     conf.Delay,
+		MaxDelay:  conf.MaxDelay,
+		MaxJitter: conf.MaxJitter,
+	}
+	if q.rh, err = retryConf.NewHelper(); err != nil {
+		q.logger.Panic("router", "Error configuring retry queue",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	q.closeWait.Add(1)
+	go q.runLoop()
+	return nil
+}
+
+// Enabled indicates whether failed updates are retried.
+func (q *RetryQueue) Enabled() bool {
+	return q != nil && q.maxSize > 0
+}
+
+// Len returns the number of updates waiting to be retried, including
+// retries in progress.
+func (q *RetryQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending) + q.inFlight
+}
+
+// Push schedules the first retry of an update. Returns false if retries are
+// disabled, or the queue is full.
+func (q *RetryQueue) Push(uaid string, segment *capn.Segment, logID string,
+	priority RoutePriority) bool {
+
+	if !q.Enabled() || q.rh.Retries < 1 {
+		return false
+	}
+	q.lock.Lock()
+	if q.isClosed || len(q.pending)+q.inFlight >= q.maxSize {
+		q.lock.Unlock()
+		q.metrics.Increment("router.retry.full")
+		return false
+	}
+	q.schedule(&routeRetry{
+		uaid:     uaid,
+		segment:  segment,
+		logID:    logID,
+		priority: priority,
+	})
+	q.lock.Unlock()
+	q.metrics.Increment("router.retry.queued")
+	return true
+}
+
+// schedule adds a retry for the next attempt. The caller must hold the lock.
+func (q *RetryQueue) schedule(item *routeRetry) {
+	item.attempt++
+	item.readyAt = time.Now().Add(q.rh.AttemptDelay(item.attempt))
+	heap.Push(&q.pending, item)
+	q.metrics.Gauge("router.retry.depth", int64(len(q.pending)+q.inFlight))
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// runLoop starts each retry when it becomes ready.
+func (q *RetryQueue) runLoop() {
+	defer q.closeWait.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		q.lock.Lock()
+		var wait time.Duration = -1
+		now := time.Now()
+		for len(q.pending) > 0 {
+			if wait = q.pending[0].readyAt.Sub(now); wait > 0 {
+				break
+			}
+			item := heap.Pop(&q.pending).(*routeRetry)
+			q.inFlight++
+			q.closeWait.Add(1)
+			go q.attempt(item)
+		}
+		q.lock.Unlock()
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-q.closeSignal:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// attempt routes an update, rescheduling it if a node was unavailable and it
+// has attempts remaining. Updates that every node declined are not
+// retried, as the device is not connected.
+func (q *RetryQueue) attempt(item *routeRetry) {
+	defer q.closeWait.Done()
+	q.metrics.Increment("router.retry.attempt")
+	accepted, retry := q.route(item)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.inFlight--
+	switch {
+	case accepted:
+		q.metrics.Increment("router.retry.hit")
+	case retry && item.attempt < q.rh.Retries && !q.isClosed:
+		q.schedule(item)
+		return
+	default:
+		if q.logger.ShouldLog(INFO) {
+			q.logger.Info("router", "Giving up retrying update; leaving in storage",
+				LogFields{"rid": item.logID, "uaid": item.uaid})
+		}
+		q.metrics.Increment("router.retry.exhausted")
+	}
+	q.metrics.Gauge("router.retry.depth", int64(len(q.pending)+q.inFlight))
+}
+
+// Close discards pending retries, and waits for retries in progress to
+// finish.
+func (q *RetryQueue) Close() error {
+	if !q.Enabled() {
+		return nil
+	}
+	q.lock.Lock()
+	if q.isClosed {
+		q.lock.Unlock()
+		return nil
+	}
+	q.isClosed = true
+	q.pending = nil
+	q.lock.Unlock()
+	close(q.closeSignal)
+	q.closeWait.Wait()
+	return nil
+}
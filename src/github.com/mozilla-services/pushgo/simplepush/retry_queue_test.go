@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryQueue(t *testing.T) {
+	_, app := newTestHandler(t)
+
+	var attempts int32
+	done := make(chan bool, 10)
+	queue := NewRetryQueue()
+	conf := queue.ConfigStruct().(*RetryQueueConfig)
+	conf.MaxSize = 1
+	conf.Retries = 3
+	conf.Delay = "1ms"
+	conf.MaxDelay = "5ms"
+	conf.MaxJitter = "1ms"
+	err := queue.Init(app, conf, func(item *routeRetry) (bool, bool) {
+		n := atomic.AddInt32(&attempts, 1)
+		if int(n) != item.attempt {
+			t.Errorf("Wrong attempt number: got %d; want %d", item.attempt, n)
+		}
+		ok := item.uaid == "accept" && n == 2
+		if ok || n == 3 {
+			done <- ok
+		}
+		return ok, true
+	})
+	if err != nil {
+		t.Fatalf("Error initializing retry queue: %s", err)
+	}
+	defer queue.Close()
+
+	// Succeeds on the second attempt.
+	if !queue.Push("accept", nil, "test", PriorityNormal) {
+		t.Fatalf("Expected update to be queued")
+	}
+	if queue.Push("full", nil, "test", PriorityNormal) {
+		t.Errorf("Expected full queue to reject update")
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Expected retry to be accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for retry")
+	}
+	waitFor(t, "empty retry queue", func() bool { return queue.Len() == 0 })
+
+	// Gives up after the maximum number of retries.
+	atomic.StoreInt32(&attempts, 0)
+	if !queue.Push("decline", nil, "test", PriorityNormal) {
+		t.Fatalf("Expected update to be queued")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for retries")
+	}
+	waitFor(t, "empty retry queue", func() bool { return queue.Len() == 0 })
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Wrong number of attempts: got %d; want 3", n)
+	}
+}
+
+func Test_RouterRetry(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	// The peer fails the first request, as if restarting.
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				http.Error(resp, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			resp.Write([]byte("Ok"))
+		}))
+	defer peer.Close()
+
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.RetryQueue.Delay = "10ms"
+	conf.RetryQueue.MaxJitter = "1ms"
+	if err := router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&StaticLocator{contacts: []string{peer.URL}})
+
+	err := router.Route(nil, uaid, chid, 1, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	waitFor(t, "retried update", func() bool {
+		return atomic.LoadInt32(&requests) == 2 && router.Retries().Len() == 0
+	})
+	if route := router.Routes().Lookup(uaid); route != peer.URL {
+		t.Errorf("Expected retry to learn route; got %q", route)
+	}
+}
+
+func Test_RouterNoRetryOnMiss(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	// The peer does not have the device connected.
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(resp, "UID Not Found", http.StatusNotFound)
+		}))
+	defer peer.Close()
+
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.RetryQueue.Delay = "1ms"
+	conf.RetryQueue.MaxJitter = "1ms"
+	if err := router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&StaticLocator{contacts: []string{peer.URL}})
+
+	accepted, err := router.RouteUpdate(nil, uaid, chid, 1, time.Now(), "test", "",
+		PriorityNormal, SpanContext{})
+	if accepted || err != nil {
+		t.Fatalf("Wrong result for offline device: accepted=%v, err=%v", accepted, err)
+	}
+	if n := router.Retries().Len(); n != 0 {
+		t.Errorf("Update for offline device queued for retry: %d pending", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Wrong request count: got %d; want 1", n)
+	}
+}
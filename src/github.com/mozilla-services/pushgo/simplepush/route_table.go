@@ -0,0 +1,277 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// RouteStore is implemented by storage adapters that can record which node
+// maintains each device's connection. Routers contact that node directly,
+// instead of probing every contact returned by the locator. Adapters that do
+// not implement it only share routes learned by each node's router, unless
+// another ClientRegistry is configured.
+type RouteStore interface {
+	// PutRoute records the routing URL of the node connected to the device.
+	PutRoute(suaid, routeURL string) error
+
+	// FetchRoute returns the routing URL of the node connected to the
+	// device, or an empty string if the route is unknown.
+	FetchRoute(suaid string) (routeURL string, err error)
+
+	// DropRoute removes the device's route if it still points to routeURL.
+	DropRoute(suaid, routeURL string) error
+}
+
+type RouteTableConfig struct {
+	// MaxSize is the maximum number of routes cached in memory. Defaults to
+	// 100000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+
+	// TTL is the amount of time to cache a route before querying the store
+	// again. Defaults to 5 minutes.
+	TTL string
+}
+
+type routeEntry struct {
+	contact string
+	expires time.Time
+}
+
+// RouteTable maps device IDs to the routing URLs of the nodes that maintain
+// their connections. Routes for local clients are written to the client
+// registry as clients connect and disconnect; routes for remote clients are
+// cached from the registry and from successful broadcasts.
+type RouteTable struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	registry ClientRegistry
+	self     string
+	ttl      time.Duration
+	maxSize  int
+	lock     sync.RWMutex
+	routes   map[string]routeEntry
+	ops      []chan routeOp
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes:      make(map[string]routeEntry),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*RouteTable) ConfigStruct() interface{} {
+	return &RouteTableConfig{
+		MaxSize: 100000,
+		TTL:     "5m",
+	}
+}
+
+// Init initializes the route table. self is the routing URL of this node.
+func (t *RouteTable) Init(app *Application, config interface{}, self string) (err error) {
+	conf := config.(*RouteTableConfig)
+	t.logger = app.Logger()
+	t.metrics = app.Metrics()
+	if store, ok := app.Store().(RouteStore); ok {
+		t.registry = &StoreRegistry{store}
+	}
+	t.self = self
+	t.maxSize = conf.MaxSize
+
+	if t.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		t.logger.Panic("router", "Could not parse route TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+
+	// Registry writes happen off the event goroutine, on a fixed set of
+	// workers. Each device is assigned to one worker, so that a reconnect
+	// can't record its route before the previous disconnect drops it.
+	t.ops = make([]chan routeOp, routeWorkers)
+	for i := range t.ops {
+		t.ops[i] = make(chan routeOp, routeQueueSize)
+		t.closeWait.Add(1)
+		go t.updateRoutes(t.ops[i])
+	}
+	app.Events().Subscribe(EventClientConnected, func(event *Event) {
+		t.queueRoute(event.UAID, true)
+	})
+	app.Events().Subscribe(EventClientDisconnected, func(event *Event) {
+		t.queueRoute(event.UAID, false)
+	})
+	return nil
+}
+
+const (
+	// routeWorkers is the number of goroutines that record the routes of
+	// local clients.
+	routeWorkers = 8
+
+	// routeQueueSize is the number of pending route changes per worker.
+	// Changes are dropped once the queue is full: devices without a route
+	// are found by probing every contact, and stale routes are forgotten
+	// once the node rejects an update.
+	routeQueueSize = 1000
+)
+
+// routeOp is a pending change to the route of a local client.
+type routeOp struct {
+	uaid      string
+	connected bool
+}
+
+// SetRegistry replaces the client registry. Set to nil to only use routes
+// learned by this node.
+func (t *RouteTable) SetRegistry(registry ClientRegistry) {
+	t.registry = registry
+}
+
+// Registry returns the client registry, or nil if routes are not shared.
+func (t *RouteTable) Registry() ClientRegistry {
+	return t.registry
+}
+
+// Lookup returns the routing URL of the node connected to the device, or an
+// empty string if the route is unknown.
+func (t *RouteTable) Lookup(uaid string) (contact string) {
+	now := time.Now()
+	t.lock.RLock()
+	entry, ok := t.routes[uaid]
+	t.lock.RUnlock()
+	if ok && now.Before(entry.expires) {
+		t.metrics.Increment("router.table.hit")
+		return entry.contact
+	}
+	if t.registry == nil {
+		t.metrics.Increment("router.table.miss")
+		return ""
+	}
+	contact, err := t.registry.Lookup(uaid)
+	if err != nil {
+		if t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("router", "Could not fetch route",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		t.metrics.Increment("router.table.error")
+		return ""
+	}
+	if len(contact) == 0 {
+		t.metrics.Increment("router.table.miss")
+		return ""
+	}
+	t.metrics.Increment("router.table.fetched")
+	t.Learn(uaid, contact)
+	return contact
+}
+
+// Learn caches the routing URL of the node that accepted an update for the
+// device.
+func (t *RouteTable) Learn(uaid, contact string) {
+	expires := time.Now().Add(t.ttl)
+	t.lock.Lock()
+	if _, ok := t.routes[uaid]; !ok && t.maxSize > 0 && len(t.routes) >= t.maxSize {
+		// Evict an arbitrary route to make room.
+		for key := range t.routes {
+			delete(t.routes, key)
+			break
+		}
+	}
+	t.routes[uaid] = routeEntry{contact, expires}
+	t.lock.Unlock()
+}
+
+// Forget removes a route that no longer reaches the device, because the
+// node is unreachable or the device disconnected.
+func (t *RouteTable) Forget(uaid, contact string) {
+	t.lock.Lock()
+	if entry, ok := t.routes[uaid]; ok && entry.contact == contact {
+		delete(t.routes, uaid)
+	}
+	t.lock.Unlock()
+	if t.registry != nil {
+		if err := t.registry.Unregister(uaid, contact); err != nil && t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("router", "Could not drop stale route", LogFields{
+				"uaid": uaid, "contact": contact, "error": err.Error()})
+		}
+	}
+	t.metrics.Increment("router.table.forget")
+}
+
+// Size returns the number of cached routes.
+func (t *RouteTable) Size() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.routes)
+}
+
+// Close stops recording the routes of local clients. Pending changes are
+// discarded.
+func (t *RouteTable) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closeSignal)
+		t.closeWait.Wait()
+	})
+	return nil
+}
+
+// queueRoute hands a route change to the device's worker, without blocking
+// the event goroutine.
+func (t *RouteTable) queueRoute(uaid string, connected bool) {
+	if len(uaid) == 0 {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uaid))
+	select {
+	case t.ops[h.Sum32()%uint32(len(t.ops))] <- routeOp{uaid, connected}:
+	case <-t.closeSignal:
+	default:
+		t.metrics.Increment("router.table.dropped")
+	}
+}
+
+// updateRoutes applies route changes in order until the table is closed.
+func (t *RouteTable) updateRoutes(ops chan routeOp) {
+	defer t.closeWait.Done()
+	for {
+		select {
+		case <-t.closeSignal:
+			return
+		case op := <-ops:
+			if op.connected {
+				t.putLocal(op.uaid)
+			} else {
+				t.dropLocal(op.uaid)
+			}
+		}
+	}
+}
+
+func (t *RouteTable) putLocal(uaid string) {
+	if t.registry == nil {
+		return
+	}
+	if err := t.registry.Register(uaid, t.self); err != nil && t.logger.ShouldLog(WARNING) {
+		t.logger.Warn("router", "Could not store route",
+			LogFields{"uaid": uaid, "error": err.Error()})
+	}
+}
+
+func (t *RouteTable) dropLocal(uaid string) {
+	if t.registry == nil {
+		return
+	}
+	if err := t.registry.Unregister(uaid, t.self); err != nil && t.logger.ShouldLog(WARNING) {
+		t.logger.Warn("router", "Could not drop route",
+			LogFields{"uaid": uaid, "error": err.Error()})
+	}
+}
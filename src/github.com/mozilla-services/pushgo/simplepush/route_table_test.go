@@ -0,0 +1,235 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// testRouteStore records device routes in memory. If hold is set, writes
+// block until it is closed.
+type testRouteStore struct {
+	*NoStore
+	lock   sync.Mutex
+	routes map[string]string
+	writes int
+	hold   chan bool
+}
+
+func (s *testRouteStore) PutRoute(uaid, routeURL string) error {
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.lock.Lock()
+	s.routes[uaid] = routeURL
+	s.writes++
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *testRouteStore) FetchRoute(uaid string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.routes[uaid], nil
+}
+
+func (s *testRouteStore) DropRoute(uaid, routeURL string) error {
+	s.lock.Lock()
+	if s.routes[uaid] == routeURL {
+		delete(s.routes, uaid)
+	}
+	s.writes++
+	s.lock.Unlock()
+	return nil
+}
+
+// Writes returns the number of route changes applied.
+func (s *testRouteStore) Writes() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writes
+}
+
+func newTestRouteStore(app *Application) *testRouteStore {
+	store := &testRouteStore{
+		NoStore: app.Store().(*NoStore),
+		routes:  make(map[string]string),
+	}
+	app.SetStore(store)
+	return store
+}
+
+func Test_RouteTableQueue(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := newTestRouteStore(app)
+	table := NewRouteTable()
+	if err := table.Init(app, table.ConfigStruct(), "http://self:3000"); err != nil {
+		t.Fatalf("Error initializing route table: %s", err)
+	}
+	defer table.Close()
+	table.SetRegistry(&StoreRegistry{store})
+
+	// Every device connects and disconnects; odd devices then reconnect.
+	// Changes for each device apply in order, so that only the odd devices
+	// keep their routes.
+	uaids := make([]string, 64)
+	for i := range uaids {
+		uaids[i] = fmt.Sprintf("%032x", i)
+		app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaids[i]})
+		app.Events().Publish(&Event{Type: EventClientDisconnected, UAID: uaids[i]})
+		if i%2 == 1 {
+			app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaids[i]})
+		}
+	}
+	waitFor(t, "route changes", func() bool { return store.Writes() == 160 })
+	for i, uaid := range uaids {
+		var want string
+		if i%2 == 1 {
+			want = "http://self:3000"
+		}
+		if route, _ := store.FetchRoute(uaid); route != want {
+			t.Errorf("Wrong route for device %d: got %q; want %q", i, route, want)
+		}
+	}
+
+	// Changes are dropped, not queued without bound, while the registry is
+	// slow to respond.
+	mx := &TestMetrics{}
+	mx.Init(nil, nil)
+	table.metrics = mx
+	store.hold = make(chan bool)
+	defer close(store.hold)
+	for i := 0; i < routeQueueSize+10; i++ {
+		table.queueRoute(uaids[0], true)
+	}
+	if n := mx.Counters["router.table.dropped"]; n < 9 || n > 10 {
+		t.Errorf("Wrong number of dropped route changes: got %d; want 9-10", n)
+	}
+}
+
+func Test_RouterRoutesToPeer(t *testing.T) {
+	chid := "decafbad000000000000000000000000"
+	store := &testRouteStore{routes: make(map[string]string)}
+
+	// The device connects to node B, which records its route.
+	handlerB, appB := newTestHandler(t)
+	appB.flushQueueDepth = 10
+	routerB := appB.Router()
+	defer routerB.Close()
+	routerB.Routes().SetRegistry(&StoreRegistry{store})
+	peerMux := mux.NewRouter()
+	peerMux.HandleFunc("/route/{uaid}", handlerB.RouteHandler)
+	go http.Serve(routerB.Listener(), peerMux)
+	server, workers := newTestWorkerServer(appB)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	uaid := helloTestWorker(t, socket)
+	waitFor(t, "recorded route", func() bool {
+		route, _ := store.FetchRoute(uaid)
+		return route == routerB.URL()
+	})
+
+	// Node A finds the route in the store, and sends the update to B.
+	_, appA := newTestHandler(t)
+	routerA := appA.Router()
+	defer routerA.Close()
+	routerA.Routes().SetRegistry(&StoreRegistry{store})
+	err := routerA.Route(nil, uaid, chid, 1, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	reply := new(FlushReply)
+	if err = websocket.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error reading notification: %s", err)
+	}
+	if len(reply.Updates) != 1 || reply.Updates[0].ChannelID != chid ||
+		reply.Updates[0].Version != 1 {
+		t.Errorf("Wrong routed update: %#v", reply)
+	}
+
+	// B drops the route once the device disconnects, and rejects updates
+	// that A sends with its cached route. A then forgets the route.
+	socket.Close()
+	waitFor(t, "dropped route", func() bool {
+		route, _ := store.FetchRoute(uaid)
+		return route == ""
+	})
+	err = routerA.Route(nil, uaid, chid, 2, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	if n := routerA.Routes().Size(); n != 0 {
+		t.Errorf("Expected stale route to be forgotten; got %d routes", n)
+	}
+}
+
+func Test_RouterDirect(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+
+	_, app := newTestHandler(t)
+	store := newTestRouteStore(app)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.Retry.Delay = "1ms"
+	if err := router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&NoLocator{logger: app.Logger()})
+
+	var requests, accept int32 = 0, 1
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if !strings.HasSuffix(req.URL.Path, "/route/"+uaid) {
+				t.Errorf("Wrong route path: %s", req.URL.Path)
+			}
+			if atomic.LoadInt32(&accept) == 0 {
+				http.Error(resp, "UID Not Found", http.StatusNotFound)
+				return
+			}
+			resp.Write([]byte("{}"))
+		}))
+	defer peer.Close()
+	store.PutRoute(uaid, peer.URL)
+
+	// Known routes bypass the locator.
+	err := router.Route(nil, uaid, chid, 1, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Wrong number of requests to peer: got %d; want 1", n)
+	}
+
+	// Routes that no longer reach the device are retried, then dropped.
+	atomic.StoreInt32(&accept, 0)
+	err = router.Route(nil, uaid, chid, 2, time.Now(), "test", "", PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Wrong number of requests to peer: got %d; want 3", n)
+	}
+	if route, _ := store.FetchRoute(uaid); route != "" {
+		t.Errorf("Expected stale route to be dropped; got %q", route)
+	}
+}
@@ -17,9 +17,11 @@
 package simplepush
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"net/http"
@@ -29,6 +31,8 @@ import (
 	"time"
 
 	capn "github.com/glycerine/go-capnproto"
+
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 var (
@@ -36,7 +40,19 @@ var (
 	ErrInvalidRoutable = errors.New("Malformed routable")
 )
 
+// errRouteMiss indicates that a contact did not accept a routed update.
+var errRouteMiss = errors.New("Update not accepted")
+
+// errPeerUnavailable indicates that a contact could not be reached, or
+// failed with a server error.
+var errPeerUnavailable = errors.New("Peer unavailable")
+
 type RouterConfig struct {
+	// Type selects how updates are routed between nodes: "http" for direct
+	// requests between routers, "redis" for Redis pub/sub, or "nats" for
+	// NATS. Defaults to "http".
+	Type string `env:"type"`
+
 	// BucketSize is the maximum number of contacts to probe at once. The router
 	// will defer requests until all nodes in a bucket have responded. Defaults
 	// to 10 contacts.
@@ -61,13 +77,63 @@ type RouterConfig struct {
 	// Listener specifies the address and port, maximum connections, TCP
 	// keep-alive period, and certificate information for the routing listener.
 	Listener ListenerConfig
+
+	// TLS configures mutual TLS between routers. Requires a listener
+	// certificate.
+	TLS RouterTLSConfig
+
+	// Queue specifies the priority weights and aging period for pending
+	// routing requests.
+	Queue RouterQueueConfig
+
+	// Routes configures the table of known device locations. Updates for
+	// devices with a known route are sent directly to that node, falling
+	// back to probing all contacts if the node does not accept the update.
+	Routes RouteTableConfig
+
+	// Registry selects the shared record of which node holds each device's
+	// connection, used to fill the route table.
+	Registry RegistryConfig
+
+	// Retry configures retries for updates sent directly to a known node.
+	Retry retry.Config
+
+	// RetryQueue configures background retries for updates that no node
+	// accepted, before leaving them in storage.
+	RetryQueue RetryQueueConfig `toml:"retry_queue" env:"retry_queue"`
+
+	// Affinity assigns devices to nodes with a consistent hash ring. Updates
+	// for devices without a known route are sent to the owning node before
+	// falling back to probing all contacts.
+	Affinity AffinityConfig
+
+	// Region tags the current node with a region and zone. Routers prefer
+	// peers in the same zone and region, and relay updates to other regions
+	// through gateway nodes.
+	Region RegionConfig
+
+	// InFlight keeps updates that disconnected devices did not acknowledge,
+	// and hands them off to the node that the device reconnects to.
+	InFlight InFlightConfig `toml:"inflight" env:"inflight"`
+
+	// Redis configures the Redis pub/sub broker, used if Type is "redis".
+	Redis RedisBrokerConfig
+
+	// NATS configures the NATS broker, used if Type is "nats".
+	NATS NATSBrokerConfig
 }
 
 // Router proxies incoming updates to the Simple Push server ("contact") that
 // currently maintains a WebSocket connection to the target device.
 type Router struct {
+	app         *Application
 	locator     Locator
+	broker      Broker
+	brokerOps   []chan brokerOp
 	listener    net.Listener
+	certs       *CertStore
+	peerTLS     *PeerTLS
+	transport   *http.Transport
 	logger      *SimpleLogger
 	metrics     Statistician
 	ctimeout    time.Duration
@@ -75,7 +141,13 @@ type Router struct {
 	bucketSize  int
 	poolSize    int
 	url         string
-	runs        chan func()
+	queue       *routeQueue
+	routes      *RouteTable
+	affinity    *Affinity
+	regions     *Regions
+	inflight    *InFlight
+	rh          *retry.Helper
+	retries     *RetryQueue
 	rclient     *http.Client
 	closeWait   sync.WaitGroup
 	isClosed    bool
@@ -86,13 +158,13 @@ type Router struct {
 
 func NewRouter() *Router {
 	return &Router{
-		runs:        make(chan func()),
 		closeSignal: make(chan bool),
 	}
 }
 
 func (*Router) ConfigStruct() interface{} {
 	return &RouterConfig{
+		Type:       RouterTypeHTTP,
 		BucketSize: 10,
 		PoolSize:   30,
 		Ctimeout:   "3s",
@@ -102,11 +174,72 @@ func (*Router) ConfigStruct() interface{} {
 			MaxConns:        1000,
 			KeepAlivePeriod: "3m",
 		},
+		Queue: RouterQueueConfig{
+			HighWeight:   8,
+			NormalWeight: 4,
+			LowWeight:    1,
+			Aging:        "500ms",
+			MaxSize:      10000,
+		},
+		Routes: RouteTableConfig{
+			MaxSize: 100000,
+			TTL:     "5m",
+		},
+		Retry: retry.Config{
+			Retries:   1,
+			Delay:     "100ms",
+			MaxDelay:  "1s",
+			MaxJitter: "100ms",
+		},
+		Affinity: AffinityConfig{
+			Mode:            AffinityOff,
+			Replicas:        100,
+			RefreshInterval: "10s",
+		},
+		Registry: RegistryConfig{
+			Type: RegistryStore,
+			Etcd: EtcdRegistryConfig{
+				Servers: []string{"http://localhost:4001"},
+				Dir:     "push_clients",
+				TTL:     "10m",
+			},
+		},
+		RetryQueue: RetryQueueConfig{
+			MaxSize:   1000,
+			Retries:   3,
+			Delay:     "1s",
+			MaxDelay:  "30s",
+			MaxJitter: "500ms",
+		},
+		Region: RegionConfig{
+			Compress:        true,
+			RefreshInterval: "1m",
+		},
+		InFlight: InFlightConfig{
+			MaxSize: 10000,
+			TTL:     "2m",
+		},
+		Redis: RedisBrokerConfig{
+			Server:         "127.0.0.1:6379",
+			Prefix:         "pushgo:",
+			PrefixLen:      2,
+			Timeout:        "3s",
+			ReconnectDelay: "1s",
+		},
+		NATS: NATSBrokerConfig{
+			Server:         "127.0.0.1:4222",
+			UpdateSubject:  "push.update.",
+			EventSubject:   "push.client.",
+			AckTimeout:     "1s",
+			Timeout:        "3s",
+			ReconnectDelay: "1s",
+		},
 	}
 }
 
 func (r *Router) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*RouterConfig)
+	r.app = app
 	r.logger = app.Logger()
 	r.metrics = app.Metrics()
 
@@ -123,7 +256,37 @@ func (r *Router) Init(app *Application, config interface{}) (err error) {
 		return err
 	}
 
-	if r.listener, err = conf.Listener.Listen(); err != nil {
+	aging, err := time.ParseDuration(conf.Queue.Aging)
+	if err != nil {
+		r.logger.Panic("router", "Could not parse queue aging period",
+			LogFields{"error": err.Error(),
+				"aging": conf.Queue.Aging})
+		return err
+	}
+	r.queue = newRouteQueue([priorityCount]int{
+		PriorityHigh:   conf.Queue.HighWeight,
+		PriorityNormal: conf.Queue.NormalWeight,
+		PriorityLow:    conf.Queue.LowWeight,
+	}, aging, conf.Queue.MaxSize)
+
+	if conf.Listener.IsUnix() {
+		// Peers route updates over the network.
+		err = fmt.Errorf("Router listener must be a TCP address: %s",
+			conf.Listener.Addr)
+		r.logger.Panic("router", "Could not attach listener",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.peerTLS = NewPeerTLS()
+	if err = r.peerTLS.Init(app, &conf.TLS, r, &conf.Listener); err != nil {
+		return err
+	}
+	var configureTLS func(*tls.Config)
+	if r.peerTLS.Enabled() {
+		configureTLS = r.peerTLS.ConfigureServer
+	}
+	if r.listener, r.certs, err = conf.Listener.ListenConfigured("router",
+		r.metrics, configureTLS); err != nil {
 		r.logger.Panic("router", "Could not attach listener",
 			LogFields{"error": err.Error()})
 		return err
@@ -147,12 +310,54 @@ func (r *Router) Init(app *Application, config interface{}) (err error) {
 	r.bucketSize = conf.BucketSize
 	r.poolSize = conf.PoolSize
 
-	r.rclient = &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(r.ctimeout, r.rwtimeout),
-			ResponseHeaderTimeout: r.rwtimeout,
-			TLSClientConfig:       new(tls.Config),
-		},
+	clientTLS := new(tls.Config)
+	if r.peerTLS.Enabled() {
+		clientTLS = r.peerTLS.ClientConfig()
+	}
+	r.transport = &http.Transport{
+		Dial:                  TimeoutDialer(r.ctimeout, r.rwtimeout),
+		ResponseHeaderTimeout: r.rwtimeout,
+		TLSClientConfig:       clientTLS,
+	}
+	r.rclient = &http.Client{Transport: r.transport}
+
+	r.routes = NewRouteTable()
+	if err = r.routes.Init(app, &conf.Routes, r.url); err != nil {
+		return err
+	}
+	registry, err := newClientRegistry(app, &conf.Registry,
+		r.HTTPClient(5*time.Second))
+	if err != nil {
+		return err
+	}
+	r.routes.SetRegistry(registry)
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("router", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = func(err error) bool { return err == errRouteMiss }
+	r.retries = NewRetryQueue()
+	if err = r.retries.Init(app, &conf.RetryQueue, r.retry); err != nil {
+		return err
+	}
+
+	if err = r.initBroker(app, conf); err != nil {
+		return err
+	}
+
+	r.affinity = NewAffinity()
+	if err = r.affinity.Init(app, &conf.Affinity, r); err != nil {
+		return err
+	}
+	r.regions = NewRegions()
+	if err = r.regions.Init(app, &conf.Region, r); err != nil {
+		return err
+	}
+	r.inflight = NewInFlight()
+	if err = r.inflight.Init(app, &conf.InFlight, r); err != nil {
+		return err
 	}
 
 	r.closeWait.Add(r.poolSize)
@@ -163,8 +368,124 @@ func (r *Router) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+// initBroker connects to the message bus selected by the router type, and
+// subscribes to updates for devices as they connect.
+func (r *Router) initBroker(app *Application, conf *RouterConfig) (err error) {
+	switch conf.Type {
+	case "", RouterTypeHTTP:
+		return nil
+	case RouterTypeRedis:
+		broker := NewRedisBroker()
+		if err = broker.Init(app, &conf.Redis, r.deliver); err != nil {
+			return err
+		}
+		r.broker = broker
+	case RouterTypeNATS:
+		broker := NewNATSBroker()
+		if err = broker.Init(app, &conf.NATS, r.deliver); err != nil {
+			return err
+		}
+		r.broker = broker
+	default:
+		err = fmt.Errorf("Unknown router type: %q", conf.Type)
+		r.logger.Panic("router", "Could not configure router",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.watchClients(app)
+	return nil
+}
+
+// watchClients subscribes to updates for devices as they connect, and
+// unsubscribes as they disconnect. Subscriptions happen off the event
+// goroutine, on a fixed set of workers. Each device is assigned to one
+// worker, so that a reconnect can't apply its subscribe before the previous
+// unsubscribe.
+func (r *Router) watchClients(app *Application) {
+	r.brokerOps = make([]chan brokerOp, brokerWorkers)
+	for i := range r.brokerOps {
+		r.brokerOps[i] = make(chan brokerOp, brokerQueueSize)
+		r.closeWait.Add(1)
+		go r.updateSubscriptions(r.brokerOps[i])
+	}
+	app.Events().Subscribe(EventClientConnected, func(event *Event) {
+		r.queueSubscription(event.UAID, true)
+	})
+	app.Events().Subscribe(EventClientDisconnected, func(event *Event) {
+		r.queueSubscription(event.UAID, false)
+	})
+}
+
+const (
+	// brokerWorkers is the number of goroutines that update broker
+	// subscriptions.
+	brokerWorkers = 8
+
+	// brokerQueueSize is the number of pending subscription changes per
+	// worker. Connection events block once the queue is full.
+	brokerQueueSize = 1000
+)
+
+// brokerOp is a pending change to the broker subscription for a device.
+type brokerOp struct {
+	uaid      string
+	subscribe bool
+}
+
+// queueSubscription hands a subscription change to the device's worker.
+func (r *Router) queueSubscription(uaid string, subscribe bool) {
+	if len(uaid) == 0 {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uaid))
+	select {
+	case r.brokerOps[h.Sum32()%uint32(len(r.brokerOps))] <- brokerOp{uaid, subscribe}:
+	case <-r.closeSignal:
+	}
+}
+
+// updateSubscriptions applies subscription changes in order until the
+// router is closed.
+func (r *Router) updateSubscriptions(ops chan brokerOp) {
+	defer r.closeWait.Done()
+	for {
+		select {
+		case <-r.closeSignal:
+			return
+		case op := <-ops:
+			var err error
+			if op.subscribe {
+				err = r.broker.Subscribe(op.uaid)
+			} else {
+				err = r.broker.Unsubscribe(op.uaid)
+			}
+			if err != nil && r.logger.ShouldLog(WARNING) {
+				r.logger.Warn("router", "Could not update broker subscription",
+					LogFields{"uaid": op.uaid, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// Broker returns the message bus used to route updates, or nil if updates
+// are routed with direct requests.
+func (r *Router) Broker() Broker {
+	return r.broker
+}
+
 func (r *Router) SetLocator(locator Locator) error {
+	hadLocator := r.locator != nil
 	r.locator = locator
+	if !hadLocator && r.affinity.Enabled() {
+		// The hash ring is built from the locator's contacts.
+		r.closeWait.Add(1)
+		go r.affinity.refreshLoop(r.closeSignal, &r.closeWait)
+	}
+	if !hadLocator && r.regions.Enabled() {
+		r.closeWait.Add(1)
+		go r.regions.refreshLoop(r.closeSignal, &r.closeWait)
+	}
 	return nil
 }
 
@@ -180,6 +501,77 @@ func (r *Router) URL() string {
 	return r.url
 }
 
+// HTTPClient returns a client for requests to peers' routing listeners.
+// Clients share the router's connection pool and TLS settings.
+func (r *Router) HTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: r.transport, Timeout: timeout}
+}
+
+// NewPeerRequest returns a request to a peer's routing listener, signed with
+// the node's key so that the peer can authenticate it.
+func (r *Router) NewPeerRequest(method, url string, body []byte) (
+	*http.Request, error) {
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.signer().SignRequest(req, body)
+	return req, nil
+}
+
+// PeerTLS returns the mutual TLS settings for connections between routers.
+func (r *Router) PeerTLS() *PeerTLS {
+	return r.peerTLS
+}
+
+// ReloadCerts re-reads the routing listener's certificates, and the client
+// certificate and CAs used for mutual TLS. The current certificates are
+// retained if any cannot be loaded.
+func (r *Router) ReloadCerts() (err error) {
+	if r.certs != nil {
+		if err = r.certs.Reload(); err != nil {
+			return err
+		}
+	}
+	if err = r.peerTLS.Reload(); err != nil {
+		return err
+	}
+	r.metrics.Increment("router.certs.reload")
+	return nil
+}
+
+// Routes returns the table of known device locations.
+func (r *Router) Routes() *RouteTable {
+	return r.routes
+}
+
+// Affinity returns the consistent hash ring of device owners.
+func (r *Router) Affinity() *Affinity {
+	return r.affinity
+}
+
+// Regions returns the region tags of peers.
+func (r *Router) Regions() *Regions {
+	return r.regions
+}
+
+// InFlight returns the cache of updates unacknowledged by disconnected
+// devices.
+func (r *Router) InFlight() *InFlight {
+	return r.inflight
+}
+
+// Retries returns the queue of updates waiting to be retried.
+func (r *Router) Retries() *RetryQueue {
+	return r.retries
+}
+
+// CloseNotify implements retry.CloseNotifier.
+func (r *Router) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
 func (r *Router) Close() (err error) {
 	r.closeLock.Lock()
 	err = r.lastErr
@@ -189,9 +581,22 @@ func (r *Router) Close() (err error) {
 	}
 	r.isClosed = true
 	close(r.closeSignal)
+	r.queue.Close()
+	r.retries.Close()
 	if locator := r.Locator(); locator != nil {
 		r.lastErr = locator.Close()
 	}
+	if r.broker != nil {
+		if err := r.broker.Close(); err != nil {
+			r.lastErr = err
+		}
+	}
+	r.routes.Close()
+	if registry := r.routes.Registry(); registry != nil {
+		if err := registry.Close(); err != nil {
+			r.lastErr = err
+		}
+	}
 	if err := r.listener.Close(); err != nil {
 		r.lastErr = err
 	}
@@ -200,37 +605,52 @@ func (r *Router) Close() (err error) {
 	return err
 }
 
-// Route routes an update packet to the correct server.
-func (r *Router) Route(cancelSignal <-chan bool, uaid, chid string, version int64, sentAt time.Time, logID string, data string) (err error) {
-	startTime := time.Now()
-	locator := r.Locator()
-	if locator == nil {
-		if r.logger.ShouldLog(ERROR) {
-			r.logger.Error("router", "No discovery service set; unable to route message",
-				LogFields{"rid": logID, "uaid": uaid, "chid": chid})
+// Drain waits for queued routing requests and background retries to finish,
+// or for the timeout to elapse. Returns false if requests were still pending
+// at the timeout.
+func (r *Router) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for r.queue.Pending() > 0 || r.retries.Len() > 0 {
+		if !time.Now().Before(deadline) {
+			return false
 		}
-		r.metrics.Increment("router.broadcast.error")
-		return ErrNoLocator
+		time.Sleep(drainPollInterval)
 	}
+	return true
+}
+
+// Route routes an update packet to the correct server. If the route table
+// knows which node maintains the device's connection, the update is sent
+// directly to that node; otherwise, or if that node is unreachable, the update
+// is offered to every contact returned by the locator. Updates that no node
+// accepts remain in storage until the device reconnects. If a message bus is
+// configured, the update is published instead. If regions are configured,
+// only peers in the current region are contacted directly, and updates that
+// no local node accepts are relayed to gateways in other regions. Updates
+// that are not accepted are retried in the background with backoff. Requests
+// are queued
+// by priority, so that high-priority targeted updates are not delayed by
+// low-priority traffic. The trace context is carried with the update, so
+// that spans recorded by other nodes join the caller's trace.
+func (r *Router) Route(cancelSignal <-chan bool, uaid, chid string, version int64, sentAt time.Time, logID string, data string, priority RoutePriority, trace SpanContext) (err error) {
+	_, err = r.RouteUpdate(cancelSignal, uaid, chid, version, sentAt, logID,
+		data, priority, trace)
+	return err
+}
+
+// RouteUpdate routes an update like Route, and indicates whether a node
+// accepted it.
+func (r *Router) RouteUpdate(cancelSignal <-chan bool, uaid, chid string, version int64, sentAt time.Time, logID string, data string, priority RoutePriority, trace SpanContext) (accepted bool, err error) {
+	startTime := time.Now()
+	span := r.app.Tracer().StartSpan("router.route", SpanInternal, trace)
+	defer func() { span.End(err) }()
 	segment := capn.NewBuffer(nil)
 	routable := NewRootRoutable(segment)
 	routable.SetChannelID(chid)
 	routable.SetVersion(version)
 	routable.SetTime(sentAt.UnixNano())
 	routable.SetData(data)
-	contacts, err := locator.Contacts(uaid)
-	if err != nil {
-		if r.logger.ShouldLog(CRITICAL) {
-			r.logger.Critical("router", "Could not query discovery service for contacts",
-				LogFields{"rid": logID, "error": err.Error()})
-		}
-		r.metrics.Increment("router.broadcast.error")
-		return err
-	}
-	if r.logger.ShouldLog(DEBUG) {
-		r.logger.Debug("router", "Fetched contact list from discovery service",
-			LogFields{"rid": logID, "servers": strings.Join(contacts, ", ")})
-	}
+	routable.SetTraceParent(span.Context().String())
 	if r.logger.ShouldLog(INFO) {
 		r.logger.Info("router", "Sending push...", LogFields{
 			"rid":     logID,
@@ -240,101 +660,377 @@ func (r *Router) Route(cancelSignal <-chan bool, uaid, chid string, version int6
 			"data":    data,
 			"time":    strconv.FormatInt(sentAt.UnixNano(), 10)})
 	}
-	ok, err := r.notifyAll(cancelSignal, contacts, uaid, segment, logID)
-	endTime := time.Now()
+	// Updates are only retried if a node may have missed them: if every
+	// contact declined, the device is offline, and retrying cannot succeed.
+	contact, unavailable, err := r.routeLocal(cancelSignal, uaid, segment,
+		logID, priority)
 	if err != nil {
-		if r.logger.ShouldLog(WARNING) {
-			r.logger.Warn("router", "Could not post to server",
-				LogFields{"rid": logID, "error": err.Error()})
+		if unavailable {
+			r.retries.Push(uaid, segment, logID, priority)
+		}
+		return false, r.routeFailed(logID, err)
+	}
+	if len(contact) == 0 {
+		contact = r.regions.Relay(uaid, segment, logID)
+	}
+	if len(contact) == 0 && unavailable &&
+		r.retries.Push(uaid, segment, logID, priority) {
+
+		if r.logger.ShouldLog(DEBUG) {
+			r.logger.Debug("router", "No contact accepted update; retrying",
+				LogFields{"rid": logID, "uaid": uaid, "chid": chid})
 		}
-		r.metrics.Increment("router.broadcast.error")
-		return err
 	}
+	endTime := time.Now()
 	var counterName, timerName string
-	if ok {
+	if len(contact) > 0 {
+		span.SetAttribute("accepted", contact)
 		counterName = "router.broadcast.hit"
 		timerName = "updates.routed.hits"
 	} else {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("router", "No contact accepted update; leaving in storage",
+				LogFields{"rid": logID, "uaid": uaid, "chid": chid})
+		}
 		counterName = "router.broadcast.miss"
 		timerName = "updates.routed.misses"
 	}
 	r.metrics.Increment(counterName)
 	r.metrics.Timer(timerName, endTime.Sub(sentAt))
 	r.metrics.Timer("router.handled", endTime.Sub(startTime))
-	return nil
+	return len(contact) > 0, nil
+}
+
+// routeLocal sends an update to a node in the current region, either through
+// the message bus or with direct requests. Returns the contact that accepted
+// the update. unavailable is true if the update was not accepted, and the
+// message bus or a contact could not be reached or failed with a server
+// error.
+func (r *Router) routeLocal(cancelSignal <-chan bool, uaid string,
+	segment *capn.Segment, logID string, priority RoutePriority) (
+	accepted string, unavailable bool, err error) {
+
+	if r.broker == nil {
+		return r.routeHTTP(cancelSignal, uaid, segment, logID, priority)
+	}
+	received, err := r.publish(uaid, segment, logID)
+	if err != nil {
+		return "", true, err
+	}
+	if !received {
+		return "", false, nil
+	}
+	return "broker", false, nil
+}
+
+// retry routes an update from the retry queue. Returns true if a node
+// accepted the update, or false and whether the update should be retried
+// again.
+func (r *Router) retry(item *routeRetry) (ok, unavailable bool) {
+	accepted, unavailable, err := r.routeLocal(r.closeSignal, item.uaid,
+		item.segment, item.logID, item.priority)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not retry update",
+				LogFields{"rid": item.logID, "uaid": item.uaid,
+					"attempt": strconv.Itoa(item.attempt), "error": err.Error()})
+		}
+		return false, unavailable
+	}
+	if len(accepted) == 0 {
+		accepted = r.regions.Relay(item.uaid, item.segment, item.logID)
+	}
+	return len(accepted) > 0, unavailable
+}
+
+// RouteRelay delivers an update relayed from another region to a device
+// connected to the current node or another node in the current region.
+// Relayed updates are never relayed again. Returns the contact that
+// accepted the update.
+func (r *Router) RouteRelay(cancelSignal <-chan bool, uaid string,
+	segment *capn.Segment, logID string) (accepted string, err error) {
+
+	r.metrics.Increment("router.region.relay.incoming")
+	if r.app.ClientExists(uaid) {
+		if !r.deliverSegment(uaid, segment) {
+			return "", nil
+		}
+		return r.url, nil
+	}
+	accepted, _, err = r.routeLocal(cancelSignal, uaid, segment, logID,
+		PriorityNormal)
+	return accepted, err
+}
+
+// routeHTTP sends an update with direct requests between routers, trying the
+// device's known node and owner before probing every contact. Returns the
+// contact that accepted the update, and whether any contact was unavailable.
+func (r *Router) routeHTTP(cancelSignal <-chan bool, uaid string,
+	segment *capn.Segment, logID string, priority RoutePriority) (
+	accepted string, unavailable bool, err error) {
+
+	var known string
+	if r.routes != nil {
+		known = r.routes.Lookup(uaid)
+	}
+	if len(known) > 0 && !r.regions.Nearby(known) {
+		// The device moved to another region; its gateways are tried last.
+		r.routes.Forget(uaid, known)
+	} else if len(known) > 0 && known != r.url && !r.peerAlive(known) {
+		// The peer stopped responding to gossip; skip straight to broadcast.
+		r.routes.Forget(uaid, known)
+		r.metrics.Increment("router.direct.dead")
+	} else if len(known) > 0 && known != r.url {
+		if accepted, unavailable, err = r.routeDirect(cancelSignal, known, uaid,
+			segment, logID, priority); err != nil {
+			return "", unavailable, err
+		}
+		if len(accepted) == 0 {
+			// The node is unreachable, or the device moved.
+			r.routes.Forget(uaid, known)
+			r.metrics.Increment("router.direct.miss")
+		} else {
+			r.metrics.Increment("router.direct.hit")
+		}
+	}
+	skip := []string{known}
+	if owner := r.affinity.Owner(uaid); len(accepted) == 0 && len(owner) > 0 &&
+		owner != r.url && owner != known && r.peerAlive(owner) &&
+		r.regions.Nearby(owner) {
+
+		// Try the owning node once before probing every contact.
+		var ownerUnavailable bool
+		if accepted, ownerUnavailable, err = r.notifyBucket(cancelSignal,
+			[]string{owner}, uaid, segment, logID, priority); err != nil {
+			return "", unavailable, err
+		}
+		unavailable = unavailable || ownerUnavailable
+		if len(accepted) > 0 {
+			r.metrics.Increment("router.affinity.hit")
+			if r.routes != nil {
+				r.routes.Learn(uaid, accepted)
+			}
+		} else {
+			r.metrics.Increment("router.affinity.miss")
+			skip = append(skip, owner)
+		}
+	}
+	if len(accepted) == 0 {
+		var broadcastUnavailable bool
+		if accepted, broadcastUnavailable, err = r.broadcast(cancelSignal, skip,
+			uaid, segment, logID, priority); err != nil {
+			return "", unavailable, err
+		}
+		unavailable = unavailable || broadcastUnavailable
+		if len(accepted) > 0 && r.routes != nil {
+			r.routes.Learn(uaid, accepted)
+		}
+	}
+	if len(accepted) > 0 {
+		unavailable = false
+	}
+	return accepted, unavailable, nil
+}
+
+func (r *Router) routeFailed(logID string, err error) error {
+	if r.logger.ShouldLog(WARNING) {
+		r.logger.Warn("router", "Could not post to server",
+			LogFields{"rid": logID, "error": err.Error()})
+	}
+	r.metrics.Increment("router.broadcast.error")
+	return err
+}
+
+// peerAlive indicates whether the locator considers a peer alive. Locators
+// that do not track liveness consider all peers alive.
+func (r *Router) peerAlive(contact string) bool {
+	checker, ok := r.Locator().(MemberChecker)
+	return !ok || checker.Alive(contact)
+}
+
+// routeDirect sends an update to the node that maintains the device's
+// connection, retrying if the node does not accept the update. Returns the
+// contact if the update was accepted, or whether the node was unavailable.
+func (r *Router) routeDirect(cancelSignal <-chan bool, contact, uaid string,
+	segment *capn.Segment, logID string, priority RoutePriority) (
+	accepted string, unavailable bool, err error) {
+
+	retries, err := r.rh.RetryFunc(func() (err error) {
+		accepted, unavailable, err = r.notifyBucket(cancelSignal,
+			[]string{contact}, uaid, segment, logID, priority)
+		if err == nil && len(accepted) == 0 {
+			err = errRouteMiss
+		}
+		return err
+	})
+	r.metrics.IncrementBy("router.direct.retry", int64(retries))
+	if err == errRouteMiss {
+		return "", unavailable, nil
+	}
+	return accepted, unavailable, err
+}
+
+// broadcast offers an update to every contact returned by the locator,
+// except the given contacts, which have already declined it.
+func (r *Router) broadcast(cancelSignal <-chan bool, skip []string, uaid string,
+	segment *capn.Segment, logID string, priority RoutePriority) (
+	accepted string, unavailable bool, err error) {
+
+	locator := r.Locator()
+	if locator == nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("router", "No discovery service set; unable to route message",
+				LogFields{"rid": logID, "uaid": uaid})
+		}
+		r.metrics.Increment("router.broadcast.error")
+		return "", false, ErrNoLocator
+	}
+	contacts, err := locator.Contacts(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(CRITICAL) {
+			r.logger.Critical("router", "Could not query discovery service for contacts",
+				LogFields{"rid": logID, "error": err.Error()})
+		}
+		r.metrics.Increment("router.broadcast.error")
+		return "", true, err
+	}
+	filtered := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		if !containsString(skip, contact) {
+			filtered = append(filtered, contact)
+		}
+	}
+	contacts = r.regions.Sort(filtered)
+	if r.logger.ShouldLog(DEBUG) {
+		r.logger.Debug("router", "Fetched contact list from discovery service",
+			LogFields{"rid": logID, "servers": strings.Join(contacts, ", ")})
+	}
+	return r.notifyAll(cancelSignal, contacts, uaid, segment, logID, priority)
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
 }
 
 // notifyAll partitions a slice of contacts into buckets, then broadcasts an
-// update to each bucket.
+// update to each bucket. Returns the contact that accepted the update, and
+// whether any contact was unavailable.
 func (r *Router) notifyAll(cancelSignal <-chan bool, contacts []string,
-	uaid string, segment *capn.Segment, logID string) (ok bool, err error) {
+	uaid string, segment *capn.Segment, logID string, priority RoutePriority) (accepted string, unavailable bool, err error) {
 
-	for fromIndex := 0; !ok && fromIndex < len(contacts); {
+	for fromIndex := 0; len(accepted) == 0 && fromIndex < len(contacts); {
 		toIndex := fromIndex + r.bucketSize
 		if toIndex > len(contacts) {
 			toIndex = len(contacts)
 		}
-		if ok, err = r.notifyBucket(cancelSignal, contacts[fromIndex:toIndex],
-			uaid, segment, logID); err != nil {
+		var bucketUnavailable bool
+		accepted, bucketUnavailable, err = r.notifyBucket(cancelSignal,
+			contacts[fromIndex:toIndex], uaid, segment, logID, priority)
+		unavailable = unavailable || bucketUnavailable
+		if err != nil {
 			break
 		}
-		fromIndex += toIndex
+		fromIndex = toIndex
 	}
 	return
 }
 
 // notifyBucket routes a message to all contacts in a bucket, returning as soon
-// as a contact accepts the update.
+// as a contact accepts the update. If no contact accepts the update,
+// unavailable indicates whether any contact was unreachable, failed with a
+// server error, or did not reply in time.
 func (r *Router) notifyBucket(cancelSignal <-chan bool, contacts []string,
-	uaid string, segment *capn.Segment, logID string) (ok bool, err error) {
+	uaid string, segment *capn.Segment, logID string, priority RoutePriority) (accepted string, unavailable bool, err error) {
 
-	result, stop := make(chan bool), make(chan struct{})
+	type notifyResult struct {
+		contact string
+		err     error
+	}
+	result, stop := make(chan notifyResult), make(chan struct{})
 	defer close(stop)
 	timeout := r.ctimeout + r.rwtimeout + 1*time.Second
 	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for _, contact := range contacts {
+		contact := contact
 		url := fmt.Sprintf("%s/route/%s", contact, uaid)
 		notify := func() {
-			r.notifyContact(result, stop, url, segment, logID)
+			select {
+			case <-stop:
+				// Another contact accepted the update, or the request timed out
+				// while queued.
+				return
+			default:
+			}
+			ok, err := r.notifyContact(url, segment, logID)
+			reply := notifyResult{err: err}
+			if ok {
+				reply.contact = contact
+			}
+			select {
+			case <-stop:
+			case result <- reply:
+			case <-time.After(1 * time.Second):
+			}
 		}
+		if err = r.queue.Push(priority, notify); err != nil {
+			r.metrics.Increment("router.queue.full")
+			return "", false, err
+		}
+	}
+	// Wait until a contact accepts the update, or all contacts decline.
+	for pending := len(contacts); pending > 0 && len(accepted) == 0; pending-- {
 		select {
 		case <-r.closeSignal:
-			return false, io.EOF
+			return "", false, io.EOF
 		case <-cancelSignal:
-			return false, nil
-		case ok = <-result:
-			return ok, nil
+			return "", false, nil
+		case reply := <-result:
+			accepted = reply.contact
+			unavailable = unavailable || reply.err != nil
 		case <-timer.C:
-			return false, nil
-		case r.runs <- notify:
+			return "", true, nil
 		}
 	}
-	timer.Reset(timeout)
-	select {
-	case ok = <-r.closeSignal:
-		return false, io.EOF
-	case <-cancelSignal:
-	case ok = <-result:
-	case <-timer.C:
+	if len(accepted) > 0 {
+		return accepted, false, nil
 	}
-	return ok, nil
+	return "", unavailable, nil
 }
 
-// notifyContact routes a message to a single contact.
-func (r *Router) notifyContact(result chan<- bool, stop <-chan struct{},
-	url string, segment *capn.Segment, logID string) {
+// notifyContact routes a message to a single contact, returning true if the
+// contact accepted the update. Returns an error if the contact could not be
+// reached, or failed with a server error.
+func (r *Router) notifyContact(url string, segment *capn.Segment,
+	logID string) (ok bool, err error) {
 
-	reader, writer := io.Pipe()
-	go pipeTo(writer, segment)
-	req, err := http.NewRequest("PUT", url, reader)
+	span := r.app.Tracer().StartSpan("router.notify", SpanClient,
+		ParseTraceParent(ReadRootRoutable(segment).TraceParent()))
+	span.SetAttribute("url", url)
+	defer func() {
+		span.SetAttribute("accepted", strconv.FormatBool(ok))
+		span.End(nil)
+	}()
+	// Updates are buffered, as the signature covers the body.
+	body := new(bytes.Buffer)
+	segment.WriteTo(body)
+	req, err := r.NewPeerRequest("PUT", url, body.Bytes())
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("router", "Router request failed",
 				LogFields{"rid": logID, "error": err.Error()})
 		}
-		return
+		return false, nil
 	}
 	req.Header.Set(HeaderID, logID)
+	if trace := span.Context(); trace.Valid() {
+		req.Header.Set(HeaderTraceParent, trace.String())
+	}
 	if r.logger.ShouldLog(DEBUG) {
 		r.logger.Debug("router", "Sending request",
 			LogFields{"rid": logID, "url": url})
@@ -346,7 +1042,7 @@ func (r *Router) notifyContact(result chan<- bool, stop <-chan struct{},
 			r.logger.Error("router", "Router send failed",
 				LogFields{"rid": logID, "error": err.Error()})
 		}
-		return
+		return false, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -354,33 +1050,35 @@ func (r *Router) notifyContact(result chan<- bool, stop <-chan struct{},
 			r.logger.Debug("router", "Denied",
 				LogFields{"rid": logID, "url": url})
 		}
-		return
+		if resp.StatusCode >= 500 {
+			return false, errPeerUnavailable
+		}
+		return false, nil
 	}
 	if r.logger.ShouldLog(INFO) {
 		r.logger.Info("router", "Server accepted",
 			LogFields{"rid": logID, "url": url})
 	}
-	select {
-	case <-stop:
-	case result <- true:
-	case <-time.After(1 * time.Second):
+	return true, nil
+}
+
+// signer returns the node's signer for routed updates.
+func (r *Router) signer() *Signer {
+	if server := r.app.Server(); server != nil {
+		return server.Signer()
 	}
+	return nil
 }
 
 func (r *Router) runLoop() {
 	defer r.closeWait.Done()
-	for ok := true; ok; {
-		select {
-		case ok = <-r.closeSignal:
-		case run := <-r.runs:
-			run()
+	for {
+		task, ok := r.queue.Pop()
+		if !ok {
+			return
 		}
+		r.metrics.Timer("router.queue.delay."+task.priority.String(),
+			time.Since(task.enqueuedAt))
+		task.run()
 	}
 }
-
-func pipeTo(dest *io.PipeWriter, src io.WriterTo) (err error) {
-	if _, err = src.WriteTo(dest); err != nil {
-		return dest.CloseWithError(err)
-	}
-	return dest.Close()
-}
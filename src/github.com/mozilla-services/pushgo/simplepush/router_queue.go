@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("Routing queue full")
+
+// RoutePriority is the priority of a routed update. Lower values are
+// dequeued first.
+type RoutePriority int
+
+const (
+	PriorityHigh RoutePriority = iota
+	PriorityNormal
+	PriorityLow
+	priorityCount
+)
+
+var priorityLabels = map[RoutePriority]string{
+	PriorityHigh:   "high",
+	PriorityNormal: "normal",
+	PriorityLow:    "low",
+}
+
+func (p RoutePriority) String() string {
+	return priorityLabels[p]
+}
+
+// ParseRoutePriority converts a priority name into a RoutePriority.
+func ParseRoutePriority(name string) (p RoutePriority, ok bool) {
+	name = strings.ToLower(name)
+	for p = PriorityHigh; p < priorityCount; p++ {
+		if priorityLabels[p] == name {
+			return p, true
+		}
+	}
+	return PriorityNormal, false
+}
+
+type RouterQueueConfig struct {
+	// HighWeight, NormalWeight, and LowWeight are the relative number of
+	// requests dequeued from each priority per round. Defaults to 8, 4, and 1.
+	HighWeight   int `toml:"high_weight" env:"high_weight"`
+	NormalWeight int `toml:"normal_weight" env:"normal_weight"`
+	LowWeight    int `toml:"low_weight" env:"low_weight"`
+
+	// Aging is the maximum time a request may wait at the head of a queue
+	// before it is promoted to the next higher priority. Defaults to 500ms.
+	Aging string
+
+	// MaxSize is the maximum number of pending requests per priority. Set to
+	// 0 for no limit. Defaults to 10000.
+	MaxSize int `toml:"max_size" env:"max_size"`
+}
+
+type routeTask struct {
+	run        func()
+	priority   RoutePriority
+	enqueuedAt time.Time
+	readyAt    time.Time
+}
+
+// routeQueue is a set of per-priority FIFO queues. Requests are dequeued in
+// weighted round-robin order, and requests that wait too long are promoted
+// so that a flood of low-priority traffic cannot starve them indefinitely.
+type routeQueue struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queues   [priorityCount][]*routeTask
+	weights  [priorityCount]int
+	served   [priorityCount]int
+	aging    time.Duration
+	maxSize  int
+	isClosed bool
+}
+
+func newRouteQueue(weights [priorityCount]int, aging time.Duration, maxSize int) *routeQueue {
+	q := &routeQueue{weights: weights, aging: aging, maxSize: maxSize}
+	for p, weight := range q.weights {
+		if weight < 1 {
+			q.weights[p] = 1
+		}
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push enqueues a function at the given priority.
+func (q *routeQueue) Push(priority RoutePriority, run func()) error {
+	if priority < PriorityHigh || priority >= priorityCount {
+		priority = PriorityNormal
+	}
+	now := time.Now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.isClosed {
+		return ErrQueueFull
+	}
+	if q.maxSize > 0 && len(q.queues[priority]) >= q.maxSize {
+		return ErrQueueFull
+	}
+	q.queues[priority] = append(q.queues[priority],
+		&routeTask{run, priority, now, now})
+	q.cond.Signal()
+	return nil
+}
+
+// Pop blocks until a task is available or the queue is closed.
+func (q *routeQueue) Pop() (task *routeTask, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if q.isClosed {
+			return nil, false
+		}
+		if task = q.next(time.Now()); task != nil {
+			return task, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// next promotes aged tasks, then selects the next task by weight. Must be
+// called with the lock held.
+func (q *routeQueue) next(now time.Time) *routeTask {
+	if q.aging > 0 {
+		for p := PriorityHigh + 1; p < priorityCount; p++ {
+			for len(q.queues[p]) > 0 && now.Sub(q.queues[p][0].readyAt) >= q.aging {
+				task := q.queues[p][0]
+				q.queues[p] = q.queues[p][1:]
+				task.readyAt = now
+				q.queues[p-1] = append(q.queues[p-1], task)
+			}
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		for p := PriorityHigh; p < priorityCount; p++ {
+			if len(q.queues[p]) == 0 || q.served[p] >= q.weights[p] {
+				continue
+			}
+			task := q.queues[p][0]
+			q.queues[p][0] = nil
+			q.queues[p] = q.queues[p][1:]
+			q.served[p]++
+			return task
+		}
+		// Every non-empty queue has used its share; start a new round.
+		q.served = [priorityCount]int{}
+	}
+	return nil
+}
+
+// Len returns the number of pending tasks at the given priority.
+func (q *routeQueue) Len(priority RoutePriority) (n int) {
+	q.lock.Lock()
+	n = len(q.queues[priority])
+	q.lock.Unlock()
+	return
+}
+
+// Pending returns the number of pending tasks at all priorities.
+func (q *routeQueue) Pending() (n int) {
+	q.lock.Lock()
+	for _, queue := range q.queues {
+		n += len(queue)
+	}
+	q.lock.Unlock()
+	return
+}
+
+// Close unblocks all pending Pop calls. Pending tasks are discarded.
+func (q *routeQueue) Close() {
+	q.lock.Lock()
+	q.isClosed = true
+	q.cond.Broadcast()
+	q.lock.Unlock()
+}
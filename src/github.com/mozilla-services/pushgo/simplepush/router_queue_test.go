@@ -0,0 +1,67 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteQueueWeights(t *testing.T) {
+	q := newRouteQueue([priorityCount]int{2, 1, 1}, 0, 0)
+	defer q.Close()
+	for i := 0; i < 3; i++ {
+		for p := PriorityHigh; p < priorityCount; p++ {
+			q.Push(p, nil)
+		}
+	}
+	expected := []RoutePriority{
+		PriorityHigh, PriorityHigh, PriorityNormal, PriorityLow,
+		PriorityHigh, PriorityNormal, PriorityLow,
+		PriorityNormal, PriorityLow,
+	}
+	for i, priority := range expected {
+		task, ok := q.Pop()
+		if !ok {
+			t.Fatalf("Queue closed at task %d", i)
+		}
+		if task.priority != priority {
+			t.Errorf("Wrong priority for task %d: got %s; want %s",
+				i, task.priority, priority)
+		}
+	}
+}
+
+func TestRouteQueueAging(t *testing.T) {
+	q := newRouteQueue([priorityCount]int{8, 4, 1}, 1*time.Millisecond, 0)
+	defer q.Close()
+	q.Push(PriorityLow, nil)
+	time.Sleep(5 * time.Millisecond)
+	if task := q.next(time.Now()); task == nil || task.priority != PriorityLow {
+		t.Fatalf("Expected low-priority task; got %#v", task)
+	}
+	q.Push(PriorityLow, nil)
+	q.Push(PriorityHigh, nil)
+	if task := q.next(time.Now().Add(2 * time.Millisecond)); task == nil || task.priority != PriorityHigh {
+		t.Fatalf("Expected high-priority task; got %#v", task)
+	}
+	if n := q.Len(PriorityLow); n != 0 {
+		t.Errorf("Aged task not promoted: %d low-priority tasks pending", n)
+	}
+	if n := q.Len(PriorityNormal); n != 1 {
+		t.Errorf("Wrong number of normal-priority tasks: got %d; want 1", n)
+	}
+}
+
+func TestRouteQueueFull(t *testing.T) {
+	q := newRouteQueue([priorityCount]int{1, 1, 1}, 0, 1)
+	defer q.Close()
+	if err := q.Push(PriorityHigh, nil); err != nil {
+		t.Fatalf("Error enqueuing task: %s", err)
+	}
+	if err := q.Push(PriorityHigh, nil); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull; got %#v", err)
+	}
+}
@@ -0,0 +1,247 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"sync"
+)
+
+var (
+	ErrNoPeerCert     = errors.New("Peer did not present a certificate")
+	ErrUnknownPeer    = errors.New("Peer certificate does not match a known node")
+	ErrPeerTLSNeedsLn = errors.New("Router TLS requires a listener certificate")
+	ErrPeerTLSNeedsCA = errors.New("Router TLS listener requires a CA file for peer certificates")
+)
+
+type RouterTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs that sign node certificates. Setting
+	// it enables mutual TLS between routers: the routing listener requires
+	// a client certificate signed by one of these CAs, and the router only
+	// trusts peer certificates signed by them. Defaults to the routing
+	// listener's client CA file; TLS routing listeners require one or the
+	// other, so that peers are always authenticated.
+	CAFile string `toml:"ca_file" env:"ca_file"`
+
+	// CertFile and KeyFile name the client certificate presented to peers.
+	// Default to the routing listener's certificate.
+	CertFile string `toml:"cert_file" env:"cert"`
+	KeyFile  string `toml:"key_file" env:"key"`
+
+	// VerifyPeers rejects connections from peers whose certificates are not
+	// valid for the host of a contact listed by the discovery service.
+	VerifyPeers bool `toml:"verify_peers" env:"verify_peers"`
+}
+
+// PeerTLS authenticates routers to each other with certificates signed by a
+// shared CA. Certificates and CAs are re-read by Reload, so that they can be
+// rotated without restarting the node.
+type PeerTLS struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	router      *Router
+	caFile      string
+	certs       *CertStore
+	verifyPeers bool
+
+	lock  sync.RWMutex
+	roots *x509.CertPool
+}
+
+func NewPeerTLS() *PeerTLS {
+	return new(PeerTLS)
+}
+
+func (*PeerTLS) ConfigStruct() interface{} {
+	return new(RouterTLSConfig)
+}
+
+// Init loads the CAs and client certificate for the given router. listener
+// supplies the default client certificate and CAs.
+func (p *PeerTLS) Init(app *Application, config interface{}, router *Router,
+	listener *ListenerConfig) (err error) {
+
+	conf := config.(*RouterTLSConfig)
+	p.logger = app.Logger()
+	p.metrics = app.Metrics()
+	p.router = router
+	p.caFile = conf.CAFile
+	if len(p.caFile) == 0 {
+		p.caFile = listener.ClientCAFile
+	}
+	p.verifyPeers = conf.VerifyPeers
+	if !p.Enabled() {
+		if listener.UseTLS() {
+			// Never accept unauthenticated peers on a TLS routing listener.
+			p.logger.Panic("router", "Could not configure router TLS",
+				LogFields{"error": ErrPeerTLSNeedsCA.Error()})
+			return ErrPeerTLSNeedsCA
+		}
+		return nil
+	}
+	certFile, keyFile := conf.CertFile, conf.KeyFile
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		certFile, keyFile = listener.CertFile, listener.KeyFile
+	}
+	if !listener.UseTLS() || len(certFile) == 0 || len(keyFile) == 0 {
+		p.logger.Panic("router", "Could not configure router TLS",
+			LogFields{"error": ErrPeerTLSNeedsLn.Error()})
+		return ErrPeerTLSNeedsLn
+	}
+	if p.certs, err = NewCertStore([]CertPair{{CertFile: certFile,
+		KeyFile: keyFile}}); err != nil {
+		p.logger.Panic("router", "Could not load router client certificate",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	if err = p.loadRoots(); err != nil {
+		p.logger.Panic("router", "Could not load router CAs",
+			LogFields{"error": err.Error(), "file": p.caFile})
+		return err
+	}
+	return nil
+}
+
+// Enabled indicates whether mutual TLS is enabled.
+func (p *PeerTLS) Enabled() bool {
+	return p != nil && len(p.caFile) > 0
+}
+
+func (p *PeerTLS) loadRoots() error {
+	roots, err := loadClientCAs(p.caFile)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.roots = roots
+	p.lock.Unlock()
+	return nil
+}
+
+// Reload re-reads the client certificate and CAs. The current ones are
+// retained if either cannot be loaded.
+func (p *PeerTLS) Reload() error {
+	if !p.Enabled() {
+		return nil
+	}
+	if err := p.certs.Reload(); err != nil {
+		return err
+	}
+	return p.loadRoots()
+}
+
+// ConfigureServer requires and verifies client certificates on the routing
+// listener.
+func (p *PeerTLS) ConfigureServer(config *tls.Config) {
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyConnection = p.verifyClient
+}
+
+// ClientConfig returns the TLS config for requests to peers.
+func (p *PeerTLS) ClientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: p.clientCertificate,
+		// Peer certificates are verified by verifyServer against the
+		// reloadable CA pool.
+		InsecureSkipVerify: true,
+		VerifyConnection:   p.verifyServer,
+	}
+}
+
+func (p *PeerTLS) clientCertificate(*tls.CertificateRequestInfo) (
+	*tls.Certificate, error) {
+
+	return p.certs.GetCertificate(&tls.ClientHelloInfo{})
+}
+
+// verify checks the peer's certificate chain against the current CAs.
+func (p *PeerTLS) verify(cs tls.ConnectionState, usage x509.ExtKeyUsage,
+	serverName string) (*x509.Certificate, error) {
+
+	if len(cs.PeerCertificates) == 0 {
+		return nil, ErrNoPeerCert
+	}
+	p.lock.RLock()
+	roots := p.roots
+	p.lock.RUnlock()
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	leaf := cs.PeerCertificates[0]
+	if _, err := leaf.Verify(opts); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func (p *PeerTLS) verifyClient(cs tls.ConnectionState) error {
+	leaf, err := p.verify(cs, x509.ExtKeyUsageClientAuth, "")
+	if err == nil && p.verifyPeers && !p.knownPeer(leaf) {
+		err = ErrUnknownPeer
+	}
+	if err != nil {
+		if p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("router", "Rejected peer certificate",
+				LogFields{"error": err.Error(), "subject": certSubject(leaf, cs)})
+		}
+		p.metrics.Increment("router.tls.rejected")
+	}
+	return err
+}
+
+func (p *PeerTLS) verifyServer(cs tls.ConnectionState) error {
+	_, err := p.verify(cs, x509.ExtKeyUsageServerAuth, cs.ServerName)
+	if err != nil {
+		if p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("router", "Could not verify peer certificate",
+				LogFields{"error": err.Error(), "server": cs.ServerName})
+		}
+		p.metrics.Increment("router.tls.untrusted")
+	}
+	return err
+}
+
+// knownPeer indicates whether the certificate is valid for the current
+// node, or for a contact listed by the discovery service.
+func (p *PeerTLS) knownPeer(cert *x509.Certificate) bool {
+	contacts := []string{p.router.URL()}
+	if locator := p.router.Locator(); locator != nil {
+		peers, err := locator.Contacts("")
+		if err != nil && p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("router", "Could not fetch contacts to verify peer",
+				LogFields{"error": err.Error()})
+		}
+		contacts = append(contacts, peers...)
+	}
+	for _, contact := range contacts {
+		contactURL, err := url.Parse(contact)
+		if err != nil {
+			continue
+		}
+		if cert.VerifyHostname(contactURL.Hostname()) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func certSubject(leaf *x509.Certificate, cs tls.ConnectionState) string {
+	if leaf == nil && len(cs.PeerCertificates) > 0 {
+		leaf = cs.PeerCertificates[0]
+	}
+	if leaf == nil {
+		return ""
+	}
+	return leaf.Subject.String()
+}
@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs node certificates for mutual TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) (ca *testCA, caFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating CA key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	caFile = filepath.Join(dir, "ca.crt")
+	if err = ioutil.WriteFile(caFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Error writing CA certificate: %s", err)
+	}
+	return &testCA{cert, key}, caFile
+}
+
+// issue writes a certificate for the given host, valid for both server and
+// client authentication.
+func (ca *testCA) issue(t *testing.T, dir, name, host string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert,
+		&key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Error writing certificate: %s", err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Error writing key: %s", err)
+	}
+	return
+}
+
+func Test_RouterMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-router-tls")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caFile := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "node", "127.0.0.1")
+
+	_, app := newTestHandler(t)
+	router := NewRouter()
+	conf := router.ConfigStruct().(*RouterConfig)
+	conf.DefaultHost = "127.0.0.1"
+	conf.Listener.Addr = "127.0.0.1:0"
+	conf.Listener.CertFile = certFile
+	conf.Listener.KeyFile = keyFile
+
+	// TLS routing listeners never accept unauthenticated peers.
+	if err = NewRouter().Init(app, conf); err != ErrPeerTLSNeedsCA {
+		t.Errorf("Wrong error for TLS listener without CAs: got %v; want %v",
+			err, ErrPeerTLSNeedsCA)
+	}
+
+	conf.TLS.CAFile = caFile
+	conf.TLS.VerifyPeers = true
+	if err = router.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing router: %s", err)
+	}
+	defer router.Close()
+	router.SetLocator(&StaticLocator{contacts: []string{"https://127.0.0.1:1"}})
+	go http.Serve(router.Listener(), http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte("ok"))
+		}))
+
+	// Nodes with certificates from the shared CA may connect.
+	resp, err := router.HTTPClient(5 * time.Second).Get(router.URL() + "/status/")
+	if err != nil {
+		t.Fatalf("Error connecting with node certificate: %s", err)
+	}
+	resp.Body.Close()
+
+	// Clients without a certificate are rejected.
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	anonymous := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err = anonymous.Get(router.URL() + "/status/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected connection without client certificate to fail")
+	}
+
+	// Certificates for hosts not listed by the discovery service are rejected.
+	otherCert, otherKey := ca.issue(t, dir, "other", "other.example.com")
+	cert, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %s", err)
+	}
+	unknown := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots,
+			Certificates: []tls.Certificate{cert}}}}
+	if resp, err = unknown.Get(router.URL() + "/status/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected connection from unknown peer to fail")
+	}
+
+	// Rotated certificates are picked up on reload.
+	if err = router.ReloadCerts(); err != nil {
+		t.Errorf("Error reloading certificates: %s", err)
+	}
+}
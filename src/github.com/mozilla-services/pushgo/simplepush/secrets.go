@@ -0,0 +1,412 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+var (
+	ErrNoVault         = errors.New("Vault secret referenced, but no Vault address is configured")
+	ErrInvalidVaultRef = errors.New(`Vault secrets must be of the form "path#field"`)
+)
+
+// secretRefRegex matches secret references of the form "${scheme:name}".
+var secretRefRegex = regexp.MustCompile(`^\$\{(env|file|vault):([^}]+)\}$`)
+
+// isSecretRef indicates whether a setting value references a secret.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, "${") && secretRefRegex.MatchString(value)
+}
+
+// SecretsConfig configures how secret references in other sections are
+// resolved. Any string setting may reference a secret instead of holding it:
+//
+//	"${env:NAME}" reads the environment variable NAME.
+//	"${file:/path}" reads a file, such as a mounted Kubernetes secret.
+//	"${vault:path#field}" reads a field of a Vault secret.
+//
+// Secrets referenced in list settings are split into one entry per line.
+type SecretsConfig struct {
+	// VaultAddr is the address of the Vault server. Defaults to the
+	// VAULT_ADDR environment variable.
+	VaultAddr string `toml:"vault_addr" env:"vault_addr"`
+
+	// VaultToken authenticates with Vault, and may itself reference an
+	// environment variable or file. Defaults to the VAULT_TOKEN environment
+	// variable.
+	VaultToken string `toml:"vault_token" env:"vault_token"`
+
+	// Timeout bounds each Vault request. Defaults to 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Refresh is how often referenced secrets are re-read. Token keys, API
+	// keys, and Hawk credentials are updated in place; other secrets take
+	// effect on the next restart. Defaults to 0 (disabled).
+	Refresh string `env:"refresh"`
+}
+
+// secretSetting is a setting that references one or more secrets.
+type secretSetting struct {
+	refs   []string // As configured.
+	values []string // As last resolved.
+	list   bool     // Whether the setting is a list.
+}
+
+// Secrets resolves secret references in config settings, and periodically
+// re-reads them so that rotated secrets can be applied without a restart.
+type Secrets struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	vaultAddr   string
+	vaultToken  string
+	client      *http.Client
+	refresh     time.Duration
+	lock        sync.Mutex
+	settings    map[string]*secretSetting // Keyed by section and setting name.
+	watchers    map[string][]func(values []string) error
+	closeOnce   sync.Once
+	closeSignal chan bool
+}
+
+func NewSecrets() *Secrets {
+	return &Secrets{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		settings:    make(map[string]*secretSetting),
+		watchers:    make(map[string][]func([]string) error),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*Secrets) ConfigStruct() interface{} {
+	return &SecretsConfig{
+		VaultAddr:  os.Getenv("VAULT_ADDR"),
+		VaultToken: os.Getenv("VAULT_TOKEN"),
+		Timeout:    "10s",
+		Refresh:    "0",
+	}
+}
+
+// Init configures the resolver. Unlike other plugins, secrets are loaded
+// before the logger and metrics, which are set by Start.
+func (s *Secrets) Init(_ *Application, config interface{}) (err error) {
+	conf := config.(*SecretsConfig)
+	if s.client.Timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		return fmt.Errorf("Unable to parse secrets 'timeout': %s", err)
+	}
+	if s.refresh, err = time.ParseDuration(conf.Refresh); err != nil {
+		return fmt.Errorf("Unable to parse secrets 'refresh': %s", err)
+	}
+	s.vaultAddr = strings.TrimRight(conf.VaultAddr, "/")
+	s.vaultToken = conf.VaultToken
+	if isSecretRef(s.vaultToken) {
+		if strings.HasPrefix(s.vaultToken, "${vault:") {
+			return fmt.Errorf("The Vault token cannot be read from Vault")
+		}
+		if s.vaultToken, err = s.lookup(s.vaultToken); err != nil {
+			return fmt.Errorf("Unable to read the Vault token: %s", err)
+		}
+	}
+	return nil
+}
+
+// LoadSecrets configures a resolver from the optional "secrets" section.
+func LoadSecrets(configFile ConfigFile, env envconf.Environment) (*Secrets, error) {
+	s := NewSecrets()
+	conf := s.ConfigStruct()
+	if section, ok := configFile["secrets"]; ok {
+		if err := toml.PrimitiveDecode(section, conf); err != nil {
+			return nil, fmt.Errorf("Unable to decode config for section 'secrets': %s", err)
+		}
+	}
+	if err := env.Decode(toEnvName("secrets"), EnvSep, conf); err != nil {
+		return nil, fmt.Errorf("Invalid environment variable for section 'secrets': %s", err)
+	}
+	if err := s.Init(nil, conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Resolve replaces secret references in a decoded config struct.
+func (s *Secrets) Resolve(sectionName string, config interface{}) error {
+	v := reflect.ValueOf(config)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return s.resolveStruct(sectionName, v.Elem())
+}
+
+func (s *Secrets) resolveStruct(prefix string, v reflect.Value) (err error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue // Unexported.
+		}
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + "." + name
+		value := v.Field(i)
+		switch value.Kind() {
+		case reflect.Struct:
+			if err = s.resolveStruct(key, value); err != nil {
+				return err
+			}
+
+		case reflect.String:
+			if !isSecretRef(value.String()) {
+				continue
+			}
+			setting := &secretSetting{refs: []string{value.String()}}
+			if setting.values, err = s.resolveSetting(setting); err != nil {
+				return fmt.Errorf("Unable to resolve '%s': %s", key, err)
+			}
+			value.SetString(setting.values[0])
+			s.addSetting(key, setting)
+
+		case reflect.Slice:
+			refs, ok := value.Interface().([]string)
+			if !ok || !hasSecretRef(refs) {
+				continue
+			}
+			setting := &secretSetting{refs: refs, list: true}
+			if setting.values, err = s.resolveSetting(setting); err != nil {
+				return fmt.Errorf("Unable to resolve '%s': %s", key, err)
+			}
+			value.Set(reflect.ValueOf(setting.values))
+			s.addSetting(key, setting)
+		}
+	}
+	return nil
+}
+
+func hasSecretRef(values []string) bool {
+	for _, value := range values {
+		if isSecretRef(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Secrets) addSetting(key string, setting *secretSetting) {
+	s.lock.Lock()
+	s.settings[key] = setting
+	s.lock.Unlock()
+}
+
+// resolveSetting resolves the references in a setting. Secrets referenced
+// from list settings are split into one entry per non-empty line.
+func (s *Secrets) resolveSetting(setting *secretSetting) (values []string, err error) {
+	if !setting.list {
+		value, err := s.lookup(setting.refs[0])
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	values = make([]string, 0, len(setting.refs))
+	for _, ref := range setting.refs {
+		if !isSecretRef(ref) {
+			values = append(values, ref)
+			continue
+		}
+		value, err := s.lookup(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				values = append(values, line)
+			}
+		}
+	}
+	return values, nil
+}
+
+// lookup reads the secret named by a reference. Trailing newlines are
+// trimmed from secrets read from files.
+func (s *Secrets) lookup(ref string) (string, error) {
+	matches := secretRefRegex.FindStringSubmatch(ref)
+	if len(matches) != 3 {
+		return ref, nil
+	}
+	scheme, name := matches[1], matches[2]
+	switch scheme {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return value, nil
+
+	case "file":
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return s.readVault(name)
+}
+
+// readVault reads a field of a Vault secret. Both versions of the key-value
+// secrets engine are supported.
+func (s *Secrets) readVault(ref string) (string, error) {
+	if len(s.vaultAddr) == 0 {
+		return "", ErrNoVault
+	}
+	hash := strings.LastIndex(ref, "#")
+	if hash < 1 || hash == len(ref)-1 {
+		return "", ErrInvalidVaultRef
+	}
+	path, field := strings.TrimLeft(ref[:hash], "/"), ref[hash+1:]
+	req, err := http.NewRequest("GET", s.vaultAddr+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", s.vaultToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("Vault returned status %d for %s", resp.StatusCode, path)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&secret); err != nil {
+		return "", fmt.Errorf("Unable to decode Vault secret %s: %s", path, err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			// Version 2 of the key-value engine nests the secret.
+			data = nested
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %q", path, field)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// OnChange registers a function that applies new values of a setting, named
+// by its section and key (e.g., "default.token_keys"), when the secrets it
+// references change.
+func (s *Secrets) OnChange(key string, apply func(values []string) error) {
+	s.lock.Lock()
+	s.watchers[key] = append(s.watchers[key], apply)
+	s.lock.Unlock()
+}
+
+// Start re-reads secrets periodically if a refresh interval is configured.
+func (s *Secrets) Start(app *Application) {
+	s.logger = app.Logger()
+	s.metrics = app.Metrics()
+	if s.refresh > 0 {
+		go s.run()
+	}
+}
+
+func (s *Secrets) run() {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for ok := true; ok; {
+		select {
+		case ok = <-s.closeSignal:
+		case <-ticker.C:
+			s.Refresh()
+		}
+	}
+}
+
+// Refresh re-reads all referenced secrets, applies changed settings, and
+// returns the number of settings that changed. Settings that cannot be
+// resolved keep their current values.
+func (s *Secrets) Refresh() (changed int) {
+	s.lock.Lock()
+	keys := make([]string, 0, len(s.settings))
+	for key := range s.settings {
+		keys = append(keys, key)
+	}
+	s.lock.Unlock()
+	for _, key := range keys {
+		s.lock.Lock()
+		setting := s.settings[key]
+		s.lock.Unlock()
+		values, err := s.resolveSetting(setting)
+		if err != nil {
+			s.metrics.Increment("secrets.error")
+			if s.logger.ShouldLog(ERROR) {
+				s.logger.Error("secrets", "Could not refresh secret",
+					LogFields{"key": key, "error": err.Error()})
+			}
+			continue
+		}
+		s.lock.Lock()
+		if reflect.DeepEqual(values, setting.values) {
+			s.lock.Unlock()
+			continue
+		}
+		setting.values = values
+		watchers := s.watchers[key]
+		s.lock.Unlock()
+		changed++
+		s.metrics.Increment("secrets.changed")
+		if len(watchers) == 0 {
+			if s.logger.ShouldLog(WARNING) {
+				s.logger.Warn("secrets", "Secret changed; restart to apply",
+					LogFields{"key": key})
+			}
+			continue
+		}
+		for _, apply := range watchers {
+			if err = apply(values); err != nil {
+				s.metrics.Increment("secrets.error")
+				if s.logger.ShouldLog(ERROR) {
+					s.logger.Error("secrets", "Could not apply changed secret",
+						LogFields{"key": key, "error": err.Error()})
+				}
+			}
+		}
+		if s.logger.ShouldLog(NOTICE) {
+			s.logger.Notice("secrets", "Applied changed secret", LogFields{"key": key})
+		}
+	}
+	return changed
+}
+
+// Close stops refreshing secrets.
+func (s *Secrets) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeSignal)
+	})
+	return nil
+}
@@ -0,0 +1,140 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type secretsTestConfig struct {
+	Token   string   `toml:"token"`
+	Keys    []string `toml:"keys"`
+	Plain   string
+	Backend struct {
+		Password string
+	} `toml:"backend"`
+}
+
+func newTestSecrets(t *testing.T, vaultAddr string) *Secrets {
+	s := NewSecrets()
+	conf := s.ConfigStruct().(*SecretsConfig)
+	conf.VaultAddr = vaultAddr
+	conf.VaultToken = "root"
+	if err := s.Init(nil, conf); err != nil {
+		t.Fatalf("Error initializing secrets: %s", err)
+	}
+	return s
+}
+
+func TestSecretsResolve(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root" {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.URL.Path != "/v1/secret/data/pushgo" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write([]byte(`{"data":{"data":{"password":"hunter2"},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+
+	dir, err := ioutil.TempDir("", "pushgo-secrets")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "keys")
+	if err = ioutil.WriteFile(keysFile, []byte("a:one\nb:two\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret file: %s", err)
+	}
+	os.Setenv("PUSHGO_TEST_SECRET_TOKEN", "s3cret")
+	defer os.Unsetenv("PUSHGO_TEST_SECRET_TOKEN")
+
+	conf := &secretsTestConfig{
+		Token: "${env:PUSHGO_TEST_SECRET_TOKEN}",
+		Keys:  []string{"c:three", "${file:" + keysFile + "}"},
+		Plain: "${not a reference}",
+	}
+	conf.Backend.Password = "${vault:secret/data/pushgo#password}"
+	s := newTestSecrets(t, vault.URL)
+	if err = s.Resolve("test", conf); err != nil {
+		t.Fatalf("Error resolving secrets: %s", err)
+	}
+	if conf.Token != "s3cret" {
+		t.Errorf("Wrong environment secret: %q", conf.Token)
+	}
+	if keys := []string{"c:three", "a:one", "b:two"}; !reflect.DeepEqual(conf.Keys, keys) {
+		t.Errorf("Wrong file secrets: got %#v; want %#v", conf.Keys, keys)
+	}
+	if conf.Plain != "${not a reference}" {
+		t.Errorf("Plain setting changed: %q", conf.Plain)
+	}
+	if conf.Backend.Password != "hunter2" {
+		t.Errorf("Wrong Vault secret: %q", conf.Backend.Password)
+	}
+
+	missing := &secretsTestConfig{Token: "${vault:secret/data/missing#password}"}
+	if err = s.Resolve("test", missing); err == nil {
+		t.Error("Missing Vault secret resolved")
+	}
+	noVault := &secretsTestConfig{Token: "${vault:secret/data/pushgo#password}"}
+	if err = NewSecrets().Resolve("test", noVault); err == nil {
+		t.Error("Vault secret resolved without a Vault address")
+	}
+}
+
+func TestSecretsRefresh(t *testing.T) {
+	_, app := newTestHandler(t)
+	dir, err := ioutil.TempDir("", "pushgo-secrets")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "keys")
+	if err = ioutil.WriteFile(keysFile, []byte("a:one\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret file: %s", err)
+	}
+
+	s := newTestSecrets(t, "")
+	conf := &secretsTestConfig{Keys: []string{"${file:" + keysFile + "}"}}
+	if err = s.Resolve("test", conf); err != nil {
+		t.Fatalf("Error resolving secrets: %s", err)
+	}
+	var applied []string
+	s.OnChange("test.keys", func(values []string) error {
+		applied = values
+		return nil
+	})
+	s.Start(app)
+	defer s.Close()
+
+	if changed := s.Refresh(); changed != 0 || applied != nil {
+		t.Errorf("Unchanged secret applied: %d, %#v", changed, applied)
+	}
+	if err = ioutil.WriteFile(keysFile, []byte("a:one\nb:two\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret file: %s", err)
+	}
+	if changed := s.Refresh(); changed != 1 {
+		t.Errorf("Wrong number of changed secrets: %d", changed)
+	}
+	if keys := []string{"a:one", "b:two"}; !reflect.DeepEqual(applied, keys) {
+		t.Errorf("Wrong refreshed secrets: got %#v; want %#v", applied, keys)
+	}
+
+	// Unreadable secrets keep their current values.
+	os.Remove(keysFile)
+	applied = nil
+	if changed := s.Refresh(); changed != 0 || applied != nil {
+		t.Errorf("Unreadable secret applied: %d, %#v", changed, applied)
+	}
+}
@@ -6,14 +6,23 @@ package simplepush
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // -- SERVER this handles REST requests and coordinates between connected
@@ -32,29 +41,335 @@ type ServerConfig struct {
 	PushEndpoint string         `toml:"push_endpoint_template" env:"push_url_template"`
 	Client       ListenerConfig `toml:"websocket" env:"ws"`
 	Endpoint     ListenerConfig
+	Access       AccessTrackerConfig `toml:"access" env:"access"`
+
+	// Churn configures connection lifetime and reconnect metrics.
+	Churn ChurnConfig `toml:"churn" env:"churn"`
+
+	// HTTP2 configures HTTP/2 support for the update listener.
+	HTTP2 HTTP2Config `toml:"http2" env:"http2"`
+
+	// GRPC configures the listener for the gRPC push service. The service is
+	// disabled if no address is set.
+	GRPC ListenerConfig `toml:"grpc" env:"grpc"`
+
+	// MQTT configures the MQTT 3.1.1 listener for devices that cannot keep a
+	// WebSocket open. The listener is disabled if no address is set.
+	MQTT ListenerConfig `toml:"mqtt" env:"mqtt"`
+
+	// Admin configures the authenticated listener for operational
+	// endpoints. The listener is disabled if no address is set.
+	Admin AdminConfig `toml:"admin" env:"admin"`
+
+	// Features configures gradual rollouts of new behaviors.
+	Features FeaturesConfig `toml:"features" env:"features"`
+
+	// Maintenance configures maintenance mode, in which clients and app
+	// servers are asked to retry later.
+	Maintenance MaintenanceConfig `toml:"maintenance" env:"maintenance"`
+
+	// Registration configures self-registration with external load
+	// balancers.
+	Registration RegistrationConfig `toml:"registration" env:"registration"`
+
+	// Handshake limits concurrent WebSocket upgrades.
+	Handshake HandshakeConfig `toml:"handshake" env:"handshake"`
+
+	// Receipts configures the delivery receipt stream for app servers.
+	Receipts ReceiptsConfig `toml:"receipts" env:"receipts"`
+
+	// RealStats configures the real-time stats stream for dashboards.
+	RealStats RealStatsConfig `toml:"realstats" env:"realstats"`
+
+	// Kafka configures the analytics event sink. The sink is disabled if no
+	// brokers are set.
+	Kafka KafkaConfig `toml:"kafka" env:"kafka"`
+
+	// Digest configures out-of-band digests for long-offline devices with
+	// pending updates. Digests are disabled if no sink is set.
+	Digest DigestConfig `toml:"digest" env:"digest"`
+
+	// Sentry configures error reporting. Reporting is disabled if no DSN is
+	// set.
+	Sentry SentryConfig `toml:"sentry" env:"sentry"`
+
+	// Audit configures the registration audit log. The log is disabled if
+	// no path is set.
+	Audit AuditConfig `toml:"audit" env:"audit"`
+
+	// SlowLog configures latency thresholds for logging slow storage calls
+	// and client flushes.
+	SlowLog SlowLogConfig `toml:"slowlog" env:"slowlog"`
+
+	// RateLimit configures per-device and per-address request budgets.
+	RateLimit RateLimitConfig `toml:"ratelimit" env:"ratelimit"`
+
+	// TrustedProxies lists the CIDR blocks of load balancers allowed to set
+	// the client address with X-Forwarded-For. The header is ignored if
+	// empty.
+	TrustedProxies []string `toml:"trusted_proxies" env:"trusted_proxies"`
+
+	// APIKeys configures the API keys app servers use to send updates.
+	APIKeys APIKeyConfig `toml:"apikeys" env:"apikeys"`
+
+	// ClientCerts maps endpoint client certificates to app server identities.
+	ClientCerts ClientCertConfig `toml:"clientcerts" env:"clientcerts"`
+
+	// Hawk configures Hawk request signature verification for updates.
+	Hawk HawkConfig `toml:"hawk" env:"hawk"`
+
+	// Abuse configures violation scoring and temporary client bans.
+	Abuse AbuseConfig `toml:"abuse" env:"abuse"`
+
+	// IDs configures how client-supplied device and channel IDs are
+	// validated.
+	IDs IDPolicyConfig `toml:"ids" env:"ids"`
+
+	// Tenants configures the products hosted by the server, each with its
+	// own device ID namespace and quotas.
+	Tenants TenantsConfig `toml:"tenants" env:"tenants"`
+
+	// Workers configures the goroutines shared by client connections, and
+	// the memory budget for client connections.
+	Workers WorkerPoolConfig `toml:"workers" env:"workers"`
+
+	// Coalesce configures batching of channel version updates.
+	Coalesce WriteCoalescerConfig `toml:"coalesce" env:"coalesce"`
+
+	// Challenge configures proof-of-work handshake challenges for new
+	// devices during handshake floods.
+	Challenge ChallengeConfig `toml:"challenge" env:"challenge"`
+
+	// Signing configures signatures for update responses and routed
+	// updates.
+	Signing SigningConfig `toml:"signing" env:"signing"`
+
+	// EvictChannels makes room for registrations beyond the storage
+	// adapter's channel limit by dropping the device's least recently updated
+	// channels. If not set, such registrations are rejected.
+	EvictChannels bool `toml:"evict_channels" env:"evict_channels"`
+
+	// NackURL is an optional URL that receives a JSON POST whenever a client
+	// rejects an update with a "nack" command.
+	NackURL string `toml:"nack_notify_url" env:"nack_url"`
+
+	// NackTimeout is the maximum time to wait for the nack notification URL
+	// to respond. Defaults to 5 seconds.
+	NackTimeout string `toml:"nack_notify_timeout" env:"nack_timeout"`
+
+	// NackQueueSize is the maximum number of pending nack notifications.
+	// Notifications for nacks received while the queue is full are dropped.
+	// Defaults to 1000.
+	NackQueueSize int `toml:"nack_notify_queue" env:"nack_queue"`
+}
+
+// HTTP2Config enables HTTP/2 for the update listener, so that app servers
+// can multiplex many small requests over a single connection.
+type HTTP2Config struct {
+	// Enabled negotiates HTTP/2 via ALPN on TLS listeners.
+	Enabled bool
+
+	// Cleartext accepts HTTP/2 with prior knowledge (h2c) on plain TCP
+	// listeners, for use behind TLS-terminating load balancers.
+	Cleartext bool `toml:"h2c" env:"h2c"`
+
+	// MaxConcurrentStreams is the maximum number of requests multiplexed over
+	// a single connection.
+	MaxConcurrentStreams int `toml:"max_concurrent_streams" env:"max_streams"`
+
+	// IdleTimeout is the time after which idle HTTP/2 connections are
+	// closed.
+	IdleTimeout string `toml:"idle_timeout" env:"idle_timeout"`
 }
 
 type ListenerConfig struct {
+	// Addr is a TCP address, a Unix domain socket path prefixed with
+	// "unix:", or the name of a socket passed by systemd socket activation
+	// prefixed with "systemd:".
 	Addr            string
 	MaxConns        int    `toml:"max_connections" env:"max_conns"`
 	KeepAlivePeriod string `toml:"tcp_keep_alive" env:"keep_alive"`
 	CertFile        string `toml:"cert_file" env:"cert"`
 	KeyFile         string `toml:"key_file" env:"key"`
+
+	// SNICerts lists per-hostname certificates as "hostname:cert_file:key_file"
+	// entries, selected by the server name requested by the client.
+	SNICerts []string `toml:"sni_certs" env:"sni_certs"`
+
+	// ClientCAFile is a PEM bundle of CAs used to verify client certificates.
+	// Clients that present a certificate must present a valid one.
+	ClientCAFile string `toml:"client_ca_file" env:"client_ca"`
+
+	// RequireClientCert rejects clients that do not present a certificate.
+	RequireClientCert bool `toml:"require_client_cert" env:"require_client_cert"`
+
+	// SocketMode is the octal file mode of Unix domain sockets. Defaults to
+	// 0660, so that only the owner and group (e.g., a local proxy) may
+	// connect.
+	SocketMode string `toml:"socket_mode" env:"socket_mode"`
+
+	// AcceptRate is the maximum number of new connections accepted per
+	// second. Defaults to 0 (unlimited).
+	AcceptRate int `toml:"accept_rate" env:"accept_rate"`
+
+	// AcceptBurst is the number of connections that may be accepted at once
+	// before AcceptRate applies. Defaults to 1.
+	AcceptBurst int `toml:"accept_burst" env:"accept_burst"`
+
+	// Overflow controls what happens to connections that exceed MaxConns or
+	// AcceptRate: "queue" (the default) leaves them in the kernel backlog;
+	// "reject" closes them immediately, replying with a 503 on plaintext
+	// HTTP listeners.
+	Overflow string `toml:"overflow" env:"overflow"`
+
+	// RetryAfter is the Retry-After interval sent with 503 replies. Defaults
+	// to 5 seconds.
+	RetryAfter string `toml:"retry_after" env:"retry_after"`
+}
+
+// IsUnix indicates whether the listener binds a Unix domain socket.
+func (conf *ListenerConfig) IsUnix() bool {
+	return IsUnixAddr(conf.Addr)
+}
+
+func (conf *ListenerConfig) socketMode() (os.FileMode, error) {
+	if len(conf.SocketMode) == 0 {
+		return DefaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(conf.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid socket mode '%s'", conf.SocketMode)
+	}
+	return os.FileMode(mode), nil
 }
 
 func (conf *ListenerConfig) UseTLS() bool {
-	return len(conf.CertFile) > 0 && len(conf.KeyFile) > 0
+	return len(conf.CertFile) > 0 && len(conf.KeyFile) > 0 ||
+		len(conf.SNICerts) > 0
+}
+
+// Listen returns an active listener. nextProtos lists the protocols that TLS
+// listeners advertise via ALPN.
+func (conf *ListenerConfig) Listen(nextProtos ...string) (ln net.Listener, err error) {
+	ln, _, err = conf.ListenWithCerts(nextProtos...)
+	return
+}
+
+// ListenWithCerts returns an active listener and, for TLS listeners, the
+// certificate store used to reload its certificates.
+func (conf *ListenerConfig) ListenWithCerts(nextProtos ...string) (
+	ln net.Listener, certs *CertStore, err error) {
+
+	return conf.ListenMetered("", nil, nextProtos...)
 }
 
-func (conf *ListenerConfig) Listen() (ln net.Listener, err error) {
+// ListenMetered is like ListenWithCerts, but records rejected and throttled
+// connections under "listener.{name}".
+func (conf *ListenerConfig) ListenMetered(name string, metrics Statistician,
+	nextProtos ...string) (ln net.Listener, certs *CertStore, err error) {
+
+	return conf.ListenConfigured(name, metrics, nil, nextProtos...)
+}
+
+// ListenConfigured is like ListenMetered, but calls configure to adjust the
+// TLS config of TLS listeners before accepting connections.
+func (conf *ListenerConfig) ListenConfigured(name string, metrics Statistician,
+	configure func(*tls.Config), nextProtos ...string) (
+	ln net.Listener, certs *CertStore, err error) {
+
 	keepAlivePeriod, err := time.ParseDuration(conf.KeepAlivePeriod)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	mode, err := conf.socketMode()
+	if err != nil {
+		return nil, nil, err
 	}
+	var config *tls.Config
 	if conf.UseTLS() {
-		return ListenTLS(conf.Addr, conf.CertFile, conf.KeyFile, conf.MaxConns, keepAlivePeriod)
+		if config, certs, err = conf.TLSConfig(nextProtos...); err != nil {
+			return nil, nil, err
+		}
+		if configure != nil {
+			configure(config)
+		}
+	}
+	var overflowReply []byte
+	switch conf.Overflow {
+	case "", OverflowQueue:
+	case OverflowReject:
+		// Only plaintext HTTP/1.x clients understand a raw 503 reply.
+		if config == nil && speaksHTTP1(nextProtos) {
+			retryAfter := 5 * time.Second
+			if len(conf.RetryAfter) > 0 {
+				if retryAfter, err = time.ParseDuration(conf.RetryAfter); err != nil {
+					return nil, nil, err
+				}
+			}
+			overflowReply = ServiceUnavailableReply(retryAfter)
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unknown overflow behavior '%s'", conf.Overflow)
+	}
+	limitLn, err := listenMode(conf.Addr, mode, conf.MaxConns, keepAlivePeriod)
+	if err != nil {
+		return nil, nil, err
+	}
+	limitLn.SetAcceptRate(conf.AcceptRate, conf.AcceptBurst)
+	limitLn.SetOverflow(conf.Overflow, overflowReply)
+	if metrics != nil {
+		limitLn.SetMetrics(metrics, name)
+	}
+	if ln = limitLn; config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	return ln, certs, nil
+}
+
+func speaksHTTP1(nextProtos []string) bool {
+	if len(nextProtos) == 0 {
+		return true
 	}
-	return Listen(conf.Addr, conf.MaxConns, keepAlivePeriod)
+	for _, proto := range nextProtos {
+		if proto == "http/1.1" {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig loads the listener certificates and client CAs.
+func (conf *ListenerConfig) TLSConfig(nextProtos ...string) (
+	config *tls.Config, certs *CertStore, err error) {
+
+	var pairs []CertPair
+	if len(conf.CertFile) > 0 && len(conf.KeyFile) > 0 {
+		pairs = append(pairs, CertPair{CertFile: conf.CertFile, KeyFile: conf.KeyFile})
+	}
+	for _, spec := range conf.SNICerts {
+		pair, err := ParseCertPair(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	if certs, err = NewCertStore(pairs); err != nil {
+		return nil, nil, err
+	}
+	config = NewTLSConfig(certs, nextProtos...)
+	if len(conf.ClientCAFile) > 0 {
+		if config.ClientCAs, err = loadClientCAs(conf.ClientCAFile); err != nil {
+			return nil, nil, fmt.Errorf("Error loading client CAs: %s", err)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if conf.RequireClientCert {
+		if config.ClientCAs == nil {
+			return nil, nil, fmt.Errorf("require_client_cert needs client_ca_file")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, certs, nil
 }
 
 func NewServer() *Serv {
@@ -68,17 +383,58 @@ type Serv struct {
 	logger           *SimpleLogger
 	hostname         string
 	clientLn         net.Listener
+	clientCerts      *CertStore
 	clientURL        string
 	maxClientConns   int
 	endpointLn       net.Listener
+	endpointCerts    *CertStore
 	endpointURL      string
 	maxEndpointConns int
+	endpointHTTP2    *http2.Server
+	endpointH2C      bool
+	grpcLn           net.Listener
+	grpcCerts        *CertStore
+	grpcStreams      int
+	mqttLn           net.Listener
+	mqttCerts        *CertStore
+	adminLn          net.Listener
+	adminCerts       *CertStore
+	admin            *AdminAuth
+	features         *Features
+	maintenance      *Maintenance
+	registration     *Registration
 	metrics          Statistician
 	store            Store
-	key              []byte
 	template         *template.Template
 	prop             PropPinger
+	access           *AccessTracker
+	churn            *ChurnTracker
+	handshakes       *HandshakeLimiter
+	receipts         *ReceiptHub
+	realStats        *RealStats
+	kafka            *KafkaSink
+	digest           *OfflineDigest
+	sentry           *Sentry
+	audit            *AuditLog
+	slowLog          *SlowLog
+	rateLimiter      *RateLimiter
+	trustedProxies   TrustedProxies
+	apiKeys          *APIKeyAuth
+	certAuth         *ClientCertAuth
+	hawk             *HawkVerifier
+	abuse            *AbuseTracker
+	challenger       *HelloChallenger
+	ids              *IDPolicy
+	tenants          *Tenants
+	workers          *WorkerPool
+	writes           *WriteCoalescer
+	signer           *Signer
+	evictChannels    bool
+	nackURL          string
+	nackClient       *http.Client
+	nackQueue        chan *NackNotification
 	isClosing        bool
+	isDraining       bool
 	closeSignal      chan bool
 	closeLock        sync.Mutex
 }
@@ -96,6 +452,105 @@ func (self *Serv) ConfigStruct() interface{} {
 			MaxConns:        1000,
 			KeepAlivePeriod: "3m",
 		},
+		GRPC: ListenerConfig{
+			MaxConns:        1000,
+			KeepAlivePeriod: "3m",
+		},
+		MQTT: ListenerConfig{
+			MaxConns:        1000,
+			KeepAlivePeriod: "3m",
+		},
+		Admin:        *NewAdminAuth().ConfigStruct().(*AdminConfig),
+		Features:     *NewFeatures().ConfigStruct().(*FeaturesConfig),
+		Maintenance:  *NewMaintenance().ConfigStruct().(*MaintenanceConfig),
+		Registration: *NewRegistration().ConfigStruct().(*RegistrationConfig),
+		Workers:      *NewWorkerPool().ConfigStruct().(*WorkerPoolConfig),
+		Coalesce:     *NewWriteCoalescer().ConfigStruct().(*WriteCoalescerConfig),
+		HTTP2: HTTP2Config{
+			MaxConcurrentStreams: 250,
+			IdleTimeout:          "5m",
+		},
+		Access: AccessTrackerConfig{
+			FlushInterval: "1m",
+			MaxPending:    10000,
+			Debounce:      "10m",
+		},
+		Churn: ChurnConfig{
+			Window:          "5m",
+			MaxSize:         100000,
+			MaxReconnects:   5,
+			LifespanBuckets: []string{"30s", "1m", "2m", "5m", "10m", "30m", "1h"},
+		},
+		Handshake: HandshakeConfig{
+			QueueSize:    100,
+			QueueTimeout: "5s",
+		},
+		Receipts: ReceiptsConfig{
+			MaxRecent: 10,
+			Retain:    "5m",
+			KeepAlive: "30s",
+		},
+		RealStats: RealStatsConfig{
+			Interval: "5s",
+		},
+		Kafka: KafkaConfig{
+			ClientID:      "pushgo",
+			UpdateTopic:   "push.updates",
+			ClientTopic:   "push.clients",
+			BatchSize:     100,
+			BatchInterval: "1s",
+			MaxPending:    10000,
+			RequiredAcks:  1,
+			Timeout:       "5s",
+		},
+		Digest: DigestConfig{
+			Threshold: "24h",
+			Interval:  "5m",
+			MaxSize:   100000,
+			Timeout:   "10s",
+		},
+		Sentry: SentryConfig{
+			Level:      "error",
+			MaxPending: 100,
+			Timeout:    "5s",
+		},
+		SlowLog: SlowLogConfig{
+			Storage: "500ms",
+			Flush:   "2s",
+		},
+		RateLimit: RateLimitConfig{
+			Commands: []string{"hello", "register", "registermany", "ping"},
+			MaxSize:  100000,
+		},
+		APIKeys: APIKeyConfig{
+			Header:   "X-API-Key",
+			CacheTTL: "1m",
+		},
+		Hawk: HawkConfig{
+			Skew:      "1m",
+			MaxNonces: 100000,
+		},
+		Abuse: AbuseConfig{
+			HalfLife:       "5m",
+			BanDuration:    "1m",
+			MaxBanDuration: "24h",
+			Scores: AbuseScores{
+				Malformed:   2,
+				Pings:       5,
+				RateLimited: 1,
+			},
+			MaxSize: 100000,
+		},
+		IDs: IDPolicyConfig{
+			Mode:      IDModeUUID,
+			MinLength: 1,
+			MaxLength: 64,
+		},
+		Challenge: ChallengeConfig{
+			Difficulty: 16,
+		},
+		NackTimeout:   "5s",
+		NackQueueSize: 1000,
 	}
 }
 
@@ -107,7 +562,6 @@ func (self *Serv) Init(app *Application, config interface{}) (err error) {
 	self.metrics = app.Metrics()
 	self.store = app.Store()
 	self.prop = app.PropPinger()
-	self.key = app.TokenKey()
 	self.hostname = app.Hostname()
 
 	if self.template, err = template.New("Push").Parse(conf.PushEndpoint); err != nil {
@@ -116,35 +570,239 @@ func (self *Serv) Init(app *Application, config interface{}) (err error) {
 		return err
 	}
 
-	if self.clientLn, err = conf.Client.Listen(); err != nil {
+	if self.clientLn, self.clientCerts, err = conf.Client.ListenMetered("websocket",
+		self.metrics); err != nil {
 		self.logger.Panic("server", "Could not attach WebSocket listener",
 			LogFields{"error": err.Error()})
 		return err
 	}
 	var scheme string
-	if conf.Client.UseTLS() {
+	if conf.Client.UseTLS() || conf.Client.IsUnix() {
 		scheme = "wss"
 	} else {
 		scheme = "ws"
 	}
-	host, port := self.hostPort(self.clientLn)
+	host, port := self.hostPort(self.clientLn, scheme)
 	self.clientURL = CanonicalURL(scheme, host, port)
 	self.maxClientConns = conf.Client.MaxConns
 
-	if self.endpointLn, err = conf.Endpoint.Listen(); err != nil {
+	if err = self.initHTTP2(&conf.HTTP2); err != nil {
+		return err
+	}
+	var nextProtos []string
+	if conf.HTTP2.Enabled {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	if self.endpointLn, self.endpointCerts, err = conf.Endpoint.ListenMetered("endpoint",
+		self.metrics, nextProtos...); err != nil {
 		self.logger.Panic("server", "Could not attach update listener",
 			LogFields{"error": err.Error()})
 		return err
 	}
-	if conf.Endpoint.UseTLS() {
+	if conf.Endpoint.UseTLS() || conf.Endpoint.IsUnix() {
 		scheme = "https"
 	} else {
 		scheme = "http"
 	}
-	host, port = self.hostPort(self.endpointLn)
+	host, port = self.hostPort(self.endpointLn, scheme)
 	self.endpointURL = CanonicalURL(scheme, host, port)
 	self.maxEndpointConns = conf.Endpoint.MaxConns
 
+	if len(conf.GRPC.Addr) > 0 {
+		if self.grpcLn, self.grpcCerts, err = conf.GRPC.ListenMetered("grpc",
+			self.metrics, "h2"); err != nil {
+			self.logger.Panic("server", "Could not attach gRPC listener",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		self.grpcStreams = conf.HTTP2.MaxConcurrentStreams
+	}
+
+	if len(conf.MQTT.Addr) > 0 {
+		if self.mqttLn, self.mqttCerts, err = conf.MQTT.ListenMetered("mqtt",
+			self.metrics, "mqtt"); err != nil {
+			self.logger.Panic("server", "Could not attach MQTT listener",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+
+	self.admin = NewAdminAuth()
+	if err = self.admin.Init(app, &conf.Admin); err != nil {
+		return err
+	}
+	if len(conf.Admin.Listener.Addr) > 0 {
+		if self.adminLn, self.adminCerts, err = conf.Admin.Listener.ListenMetered("admin",
+			self.metrics); err != nil {
+			self.logger.Panic("server", "Could not attach admin listener",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+
+	self.features = NewFeatures()
+	if err = self.features.Init(app, &conf.Features); err != nil {
+		return err
+	}
+
+	self.maintenance = NewMaintenance()
+	if err = self.maintenance.Init(app, &conf.Maintenance); err != nil {
+		return err
+	}
+
+	self.registration = NewRegistration()
+	if err = self.registration.Init(app, &conf.Registration); err != nil {
+		return err
+	}
+
+	self.access = NewAccessTracker()
+	if err = self.access.Init(app, &conf.Access); err != nil {
+		return err
+	}
+
+	self.churn = NewChurnTracker()
+	if err = self.churn.Init(app, &conf.Churn); err != nil {
+		return err
+	}
+
+	self.handshakes = new(HandshakeLimiter)
+	if err = self.handshakes.Init(app, &conf.Handshake); err != nil {
+		return err
+	}
+
+	events := app.Events()
+	for t := range eventLabels {
+		metric := "events." + t.String()
+		events.Subscribe(t, func(*Event) { self.metrics.Increment(metric) })
+	}
+
+	self.receipts = NewReceiptHub()
+	if err = self.receipts.Init(app, &conf.Receipts); err != nil {
+		return err
+	}
+
+	self.realStats = NewRealStats()
+	if err = self.realStats.Init(app, &conf.RealStats); err != nil {
+		return err
+	}
+
+	self.kafka = NewKafkaSink()
+	if err = self.kafka.Init(app, &conf.Kafka); err != nil {
+		return err
+	}
+
+	self.digest = NewOfflineDigest()
+	if err = self.digest.Init(app, &conf.Digest); err != nil {
+		return err
+	}
+
+	self.sentry = NewSentry()
+	if err = self.sentry.Init(app, &conf.Sentry); err != nil {
+		return err
+	}
+
+	self.audit = NewAuditLog()
+	if err = self.audit.Init(app, &conf.Audit); err != nil {
+		return err
+	}
+
+	self.slowLog = NewSlowLog(self.audit)
+	if err = self.slowLog.Init(app, &conf.SlowLog); err != nil {
+		return err
+	}
+
+	self.rateLimiter = NewRateLimiter()
+	if err = self.rateLimiter.Init(app, &conf.RateLimit); err != nil {
+		return err
+	}
+
+	if self.trustedProxies, err = ParseTrustedProxies(conf.TrustedProxies); err != nil {
+		self.logger.Panic("server", "Invalid trusted proxies",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	self.apiKeys = NewAPIKeyAuth()
+	if err = self.apiKeys.Init(app, &conf.APIKeys); err != nil {
+		return err
+	}
+
+	self.certAuth = NewClientCertAuth()
+	if err = self.certAuth.Init(app, &conf.ClientCerts); err != nil {
+		return err
+	}
+
+	self.hawk = NewHawkVerifier()
+	if err = self.hawk.Init(app, &conf.Hawk); err != nil {
+		return err
+	}
+
+	self.abuse = NewAbuseTracker(self.trustedProxies)
+	if err = self.abuse.Init(app, &conf.Abuse); err != nil {
+		return err
+	}
+	if self.abuse.Enabled() {
+		// Close connections from banned addresses before the handshake.
+		self.clientLn = NewBanListener(self.clientLn, self.abuse, self.metrics)
+		if self.mqttLn != nil {
+			self.mqttLn = NewBanListener(self.mqttLn, self.abuse, self.metrics)
+		}
+	}
+
+	self.ids = NewIDPolicy()
+	if err = self.ids.Init(app, &conf.IDs); err != nil {
+		return err
+	}
+
+	// Tenant namespaces are embedded in server-issued UUIDs.
+	if mode := conf.IDs.Mode; len(conf.Tenants.Tenants) > 0 &&
+		len(mode) > 0 && mode != IDModeUUID {
+
+		self.logger.Panic("server", "Tenants require UUID device IDs",
+			LogFields{"mode": mode})
+		return ConfigurationErr
+	}
+	self.tenants = NewTenants()
+	if err = self.tenants.Init(app, &conf.Tenants); err != nil {
+		return err
+	}
+
+	self.workers = NewWorkerPool()
+	if err = self.workers.Init(app, &conf.Workers); err != nil {
+		return err
+	}
+
+	self.writes = NewWriteCoalescer()
+	if err = self.writes.Init(app, &conf.Coalesce); err != nil {
+		return err
+	}
+
+	self.challenger = NewHelloChallenger()
+	if err = self.challenger.Init(app, &conf.Challenge); err != nil {
+		return err
+	}
+
+	self.signer = NewSigner()
+	if err = self.signer.Init(app, &conf.Signing); err != nil {
+		return err
+	}
+
+	self.evictChannels = conf.EvictChannels
+	self.nackURL = conf.NackURL
+	nackTimeout, err := time.ParseDuration(conf.NackTimeout)
+	if err != nil {
+		self.logger.Panic("server", "Could not parse nack notification timeout",
+			LogFields{"error": err.Error(), "timeout": conf.NackTimeout})
+		return err
+	}
+	self.nackClient = &http.Client{Timeout: nackTimeout}
+	if len(self.nackURL) > 0 {
+		self.nackQueue = make(chan *NackNotification, conf.NackQueueSize)
+		for i := 0; i < nackWorkers; i++ {
+			go self.notifyNacks()
+		}
+	}
+
 	go self.sendClientCount()
 	return nil
 }
@@ -173,8 +831,217 @@ func (self *Serv) MaxEndpointConns() int {
 	return self.maxEndpointConns
 }
 
-func (self *Serv) hostPort(ln net.Listener) (host string, port int) {
-	addr := ln.Addr().(*net.TCPAddr)
+// GRPCListener returns the listener for the gRPC push service, or nil if the
+// service is disabled.
+func (self *Serv) GRPCListener() net.Listener {
+	return self.grpcLn
+}
+
+// MQTTListener returns the listener for MQTT clients, or nil if the bridge
+// is disabled.
+func (self *Serv) MQTTListener() net.Listener {
+	return self.mqttLn
+}
+
+// AdminListener returns the listener for the admin API, or nil if the API
+// is disabled.
+func (self *Serv) AdminListener() net.Listener {
+	return self.adminLn
+}
+
+// Admin returns the admin request authenticator.
+func (self *Serv) Admin() *AdminAuth {
+	return self.admin
+}
+
+// ConfigureGRPC configures an HTTP server for the gRPC push service, which
+// only speaks HTTP/2. Plain TCP listeners accept HTTP/2 with prior knowledge.
+// Must be called after the server's handler is set.
+func (self *Serv) ConfigureGRPC(srv *http.Server) {
+	h2s := &http2.Server{MaxConcurrentStreams: uint32(self.grpcStreams)}
+	http2.ConfigureServer(srv, h2s)
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+}
+
+// Access returns the tracker used to batch device last-access times.
+func (self *Serv) Access() *AccessTracker {
+	return self.access
+}
+
+// Churn returns the connection lifetime and reconnect tracker.
+func (self *Serv) Churn() *ChurnTracker {
+	return self.churn
+}
+
+// initHTTP2 parses the HTTP/2 options for the update listener.
+func (self *Serv) initHTTP2(conf *HTTP2Config) (err error) {
+	if !conf.Enabled && !conf.Cleartext {
+		return nil
+	}
+	self.endpointHTTP2 = &http2.Server{
+		MaxConcurrentStreams: uint32(conf.MaxConcurrentStreams),
+	}
+	if len(conf.IdleTimeout) > 0 {
+		if self.endpointHTTP2.IdleTimeout, err = time.ParseDuration(conf.IdleTimeout); err != nil {
+			self.logger.Panic("server", "Could not parse HTTP/2 idle timeout",
+				LogFields{"error": err.Error(), "timeout": conf.IdleTimeout})
+			return err
+		}
+	}
+	self.endpointH2C = conf.Cleartext
+	return nil
+}
+
+// ConfigureEndpoint enables HTTP/2 on the update server, if configured. The
+// idle timeout applies to HTTP/2 connections only; HTTP/1 connections keep
+// the server defaults. Must be called after the server's handler is set.
+func (self *Serv) ConfigureEndpoint(srv *http.Server) {
+	if self.endpointHTTP2 == nil {
+		return
+	}
+	http2.ConfigureServer(srv, self.endpointHTTP2)
+	if self.endpointH2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, self.endpointHTTP2)
+	}
+}
+
+// ReloadCerts re-reads the TLS certificates for the WebSocket, update, gRPC,
+// MQTT, and admin listeners. Established connections are unaffected; new connections use the
+// reloaded certificates. If a certificate cannot be loaded, the listener
+// continues to use its current certificates.
+func (self *Serv) ReloadCerts() (err error) {
+	for _, certs := range []*CertStore{self.clientCerts, self.endpointCerts,
+		self.grpcCerts, self.mqttCerts, self.adminCerts} {
+		if certs == nil {
+			continue
+		}
+		if rerr := certs.Reload(); rerr != nil {
+			if self.logger.ShouldLog(ERROR) {
+				self.logger.Error("server", "Could not reload TLS certificates",
+					LogFields{"error": rerr.Error()})
+			}
+			err = rerr
+			continue
+		}
+		self.metrics.Increment("server.certs.reload")
+	}
+	return err
+}
+
+// Handshakes returns the WebSocket handshake limiter.
+func (self *Serv) Handshakes() *HandshakeLimiter {
+	return self.handshakes
+}
+
+// Receipts returns the hub used to publish delivery receipts.
+func (self *Serv) Receipts() *ReceiptHub {
+	return self.receipts
+}
+
+// Audit returns the registration audit log.
+func (self *Serv) Audit() *AuditLog {
+	return self.audit
+}
+
+// Features returns the feature flags.
+func (self *Serv) Features() *Features {
+	return self.features
+}
+
+// Maintenance returns the maintenance mode state.
+func (self *Serv) Maintenance() *Maintenance {
+	return self.maintenance
+}
+
+// Registration returns the load balancer registration.
+func (self *Serv) Registration() *Registration {
+	return self.registration
+}
+
+// SlowLog returns the slow storage call and flush log.
+func (self *Serv) SlowLog() *SlowLog {
+	return self.slowLog
+}
+
+// RateLimiter returns the client and app server request rate limiter.
+func (self *Serv) RateLimiter() *RateLimiter {
+	return self.rateLimiter
+}
+
+// TrustedProxies returns the load balancers allowed to forward client
+// addresses.
+func (self *Serv) TrustedProxies() TrustedProxies {
+	return self.trustedProxies
+}
+
+// APIKeys returns the app server API key authenticator.
+func (self *Serv) APIKeys() *APIKeyAuth {
+	return self.apiKeys
+}
+
+// ClientCerts returns the app server client certificate authenticator.
+func (self *Serv) ClientCerts() *ClientCertAuth {
+	return self.certAuth
+}
+
+// Hawk returns the app server request signature verifier.
+func (self *Serv) Hawk() *HawkVerifier {
+	return self.hawk
+}
+
+// Abuse returns the tracker used to score violations and ban clients.
+func (self *Serv) Abuse() *AbuseTracker {
+	return self.abuse
+}
+
+// IDs returns the policy used to validate client-supplied IDs.
+func (self *Serv) IDs() *IDPolicy {
+	return self.ids
+}
+
+// Tenants returns the hosted tenants.
+func (self *Serv) Tenants() *Tenants {
+	return self.tenants
+}
+
+// Workers returns the pool that services client connections.
+func (self *Serv) Workers() *WorkerPool {
+	return self.workers
+}
+
+// Writes returns the coalescer used to store channel version updates.
+func (self *Serv) Writes() *WriteCoalescer {
+	return self.writes
+}
+
+// Challenger returns the proof-of-work challenger for new devices.
+func (self *Serv) Challenger() *HelloChallenger {
+	return self.challenger
+}
+
+// Signer returns the signer for update responses and routed updates.
+func (self *Serv) Signer() *Signer {
+	return self.signer
+}
+
+// EvictChannels indicates whether registrations beyond the channel limit
+// evict the least recently updated channels.
+func (self *Serv) EvictChannels() bool {
+	return self.evictChannels
+}
+
+// RealStats returns the real-time stats stream.
+func (self *Serv) RealStats() *RealStats {
+	return self.realStats
+}
+
+func (self *Serv) hostPort(ln net.Listener, scheme string) (host string, port int) {
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		// Unix domain sockets sit behind a local proxy, which serves the
+		// default port for the scheme.
+		return self.hostname, defaultPorts[scheme]
+	}
 	if host = self.hostname; len(host) == 0 {
 		host = addr.IP.String()
 	}
@@ -182,27 +1049,50 @@ func (self *Serv) hostPort(ln net.Listener) (host string, port int) {
 }
 
 // A client connects!
-func (self *Serv) Hello(worker Worker, cmd PushCommand, sock *PushWS) (result int, arguments JsMap) {
+func (self *Serv) Hello(worker Worker, cmd PushCommand, sock *PushWS) (result int, arguments *CommandArgs) {
 
 	args := cmd.Arguments
-	uaid := args["uaid"].(string)
+	uaid := args.UAID
 
 	if self.logger.ShouldLog(INFO) {
-		chidss := ""
-		if chids, ok := args["channelIDs"]; ok {
-			chidss = "[" + strings.Join(chids.([]string), ", ") + "]"
+		chids := make([]string, len(args.ChannelIDs))
+		for i, chid := range args.ChannelIDs {
+			chids[i] = IStr(chid)
 		}
 		self.logger.Info("server", "handling 'hello'",
 			LogFields{"uaid": uaid,
-				"channelIDs": chidss})
+				"channelIDs": "[" + strings.Join(chids, ", ") + "]"})
 	}
 
-	// TODO: If the client needs to connect to a different server,
-	// Look up the appropriate server (based on UAID)
-	// return a response that looks like:
+	// If the device is owned by a different node, either redirect it with a
+	// response that looks like:
 	// { uaid: UAIDValue, status: 302, redirect: NewWS_URL }
+	// or accept it and ask the owner to release it.
+	if owner := self.affinityOwner(uaid); len(owner) > 0 {
+		affinity := self.app.Router().Affinity()
+		if affinity.Mode() == AffinityRedirect && args.CanRedirect {
+			redirect, err := affinity.RedirectURL(owner, self.ClientURL())
+			if err == nil {
+				if self.logger.ShouldLog(INFO) {
+					self.logger.Info("server", "Redirecting client to owning node",
+						LogFields{"uaid": uaid, "redirect": redirect})
+				}
+				self.metrics.Increment("client.redirect")
+				args.Redirect = redirect
+				return 302, args
+			}
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("server", "Could not build redirect URL",
+					LogFields{"uaid": uaid, "owner": owner, "error": err.Error()})
+			}
+		} else if affinity.Mode() == AffinityHandoff {
+			// Release the owner's connection before registering this one, so
+			// that the owner's cleanup does not race the new registration.
+			self.handoff(worker, sock, uaid, owner)
+		}
+	}
 
-	if connect, _ := args["connect"].([]byte); len(connect) > 0 && self.prop != nil {
+	if connect := args.Connect; len(connect) > 0 && self.prop != nil {
 		if err := self.prop.Register(uaid, connect); err != nil {
 			if self.logger.ShouldLog(WARNING) {
 				self.logger.Warn("server", "Could not set proprietary info",
@@ -220,6 +1110,7 @@ func (self *Serv) Hello(worker Worker, cmd PushCommand, sock *PushWS) (result in
 		UAID:   uaid,
 	}
 	self.app.AddClient(uaid, client)
+	self.app.Events().Publish(&Event{Type: EventClientConnected, UAID: uaid})
 	self.logger.Info("dash", "Client registered", nil)
 
 	// We don't register the list of known ChannelIDs since we echo
@@ -229,6 +1120,42 @@ func (self *Serv) Hello(worker Worker, cmd PushCommand, sock *PushWS) (result in
 	return result, arguments
 }
 
+// affinityOwner returns the routing URL of the node that owns the device, if
+// client affinity is enabled and the device is owned by a different node.
+func (self *Serv) affinityOwner(uaid string) string {
+	router := self.app.Router()
+	if router == nil || !router.Affinity().Enabled() {
+		return ""
+	}
+	owner := router.Affinity().Owner(uaid)
+	if owner == router.URL() || !router.peerAlive(owner) {
+		return ""
+	}
+	return owner
+}
+
+// handoff asks the owning node to release a device that connected to this
+// node, and restores the updates that the device did not acknowledge on the
+// owner's connection.
+func (self *Serv) handoff(worker Worker, sock *PushWS, uaid, owner string) {
+	reply, err := self.app.Router().Affinity().Handoff(uaid, owner)
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("server", "Could not hand off client",
+				LogFields{"uaid": uaid, "owner": owner, "error": err.Error()})
+		}
+		return
+	}
+	if self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("server", "Handed off client", LogFields{"uaid": uaid,
+			"owner": owner, "released": strconv.FormatBool(reply.Released),
+			"updates": strconv.Itoa(len(reply.Updates))})
+	}
+	if w, ok := worker.(*WorkerWS); ok {
+		w.restoreInFlight(sock, uaid, reply.Updates)
+	}
+}
+
 func (self *Serv) Bye(sock *PushWS) {
 	// Remove the UAID as a registered listener.
 	// NOTE: in instances where proprietary wake-ups are issued, you may
@@ -252,46 +1179,72 @@ func (self *Serv) Bye(sock *PushWS) {
 	}
 	if !sock.IsClosed() {
 		self.app.RemoveClient(uaid)
+		if len(uaid) > 0 {
+			self.app.Events().Publish(&Event{Type: EventClientDisconnected,
+				UAID: uaid})
+		}
 	}
 	sock.Close()
 }
 
-func (self *Serv) Unreg(cmd PushCommand, sock *PushWS) (result int, arguments JsMap) {
+func (self *Serv) Unreg(cmd PushCommand, sock *PushWS) (result int, arguments *CommandArgs) {
 	// This is effectively a no-op, since we don't hold client session info
-	args := cmd.Arguments
-	args["status"] = 200
-	return 200, args
+	return 200, cmd.Arguments
 }
 
-func (self *Serv) Regis(cmd PushCommand, sock *PushWS) (result int, arguments JsMap) {
+func (self *Serv) Regis(cmd PushCommand, sock *PushWS) (result int, arguments *CommandArgs) {
 	// A semi-no-op, since we don't care about the appid, but we do want
 	// to create a valid endpoint.
-	var err error
 	args := cmd.Arguments
-	args["status"] = 200
 	// Generate the call back URL
 	uaid := sock.UAID()
-	chid, _ := args["channelID"].(string)
-	token, ok := self.store.IDsToKey(uaid, chid)
-	if !ok {
+	chid := args.ChannelID
+	token, endpoint, err := self.genEndpoint(uaid, chid, args.Shared, args.Bridge)
+	if err != nil {
 		return 500, nil
 	}
+	args.Endpoint = endpoint
+	if self.logger.ShouldLog(INFO) {
+		self.logger.Info("server",
+			"Generated Push Endpoint",
+			LogFields{"uaid": uaid,
+				"channelID": chid,
+				"token":     token,
+				"endpoint":  endpoint})
+	}
+	return 200, args
+}
+
+// genEndpoint returns the push endpoint URL for the given device and
+// channel, encrypting the token if a key is configured. Endpoints for shared
+// channels identify only the channel, and are the same for every device.
+// Endpoints for bridge-preferred channels carry a marker in the key.
+func (self *Serv) genEndpoint(uaid, chid string, shared, bridge bool) (token, endpoint string, err error) {
+	var pk string
+	if shared {
+		pk = GroupKey(chid)
+	} else {
+		var ok bool
+		if pk, ok = self.store.IDsToKey(uaid, chid); !ok {
+			return "", "", ErrInvalidKey
+		}
+		if bridge {
+			pk = BridgeKey(pk)
+		}
+	}
 	// if there is a key, encrypt the token
-	if len(self.key) != 0 {
-		btoken := []byte(token)
-		if token, err = Encode(self.key, btoken); err != nil {
-			if self.logger.ShouldLog(ERROR) {
-				self.logger.Error("server", "Token Encoding error",
-					LogFields{"uaid": uaid,
-						"channelID": chid})
-			}
-			return 500, nil
+	if token, err = self.app.Tokens().Encode(pk); err != nil {
+		if self.logger.ShouldLog(ERROR) {
+			self.logger.Error("server", "Token Encoding error",
+				LogFields{"uaid": uaid,
+					"channelID": chid})
 		}
+		return "", "", err
 	}
 
 	// cheezy variable replacement.
-	endpoint := new(bytes.Buffer)
-	if err = self.template.Execute(endpoint, struct {
+	buf := new(bytes.Buffer)
+	if err = self.template.Execute(buf, struct {
 		Token       string
 		CurrentHost string
 	}{
@@ -303,21 +1256,102 @@ func (self *Serv) Regis(cmd PushCommand, sock *PushWS) (result int, arguments Js
 				"Could not generate Push Endpoint",
 				LogFields{"error": err.Error()})
 		}
-		return 500, nil
+		return "", "", err
 	}
-	args["push.endpoint"] = endpoint.String()
-	if self.logger.ShouldLog(INFO) {
-		self.logger.Info("server",
-			"Generated Push Endpoint",
-			LogFields{"uaid": uaid,
-				"channelID": chid,
-				"token":     token,
-				"endpoint":  args["push.endpoint"].(string)})
+	return token, buf.String(), nil
+}
+
+// Nack records updates that the client could not process. If a notification
+// URL is configured, the failure is forwarded along with the push endpoint,
+// so that the app server can stop sending to the affected channel.
+func (self *Serv) Nack(cmd PushCommand, sock *PushWS) (result int, arguments *CommandArgs) {
+	args := cmd.Arguments
+	uaid := sock.UAID()
+	code := args.Code
+	for _, update := range args.Updates {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("server", "Client could not process update",
+				LogFields{"uaid": uaid,
+					"chid":    update.ChannelID,
+					"version": strconv.FormatUint(update.Version, 10),
+					"code":    strconv.Itoa(code)})
+		}
+		self.metrics.Increment("updates.rejected")
+		if pk, ok := self.store.IDsToKey(uaid, update.ChannelID); ok {
+			self.receipts.Publish(pk, Receipt{
+				Type:    ReceiptFailed,
+				Version: int64(update.Version),
+				Code:    code})
+		}
+		if len(self.nackURL) == 0 {
+			continue
+		}
+		_, endpoint, err := self.genEndpoint(uaid, update.ChannelID, false, false)
+		if err != nil {
+			continue
+		}
+		select {
+		case self.nackQueue <- &NackNotification{endpoint, update.Version, code}:
+		default:
+			self.metrics.Increment("updates.rejected.notify.dropped")
+		}
 	}
 	return 200, args
 }
 
-func (self *Serv) RequestFlush(client *Client, channel string, version int64, data string) (err error) {
+// nackWorkers is the number of nack notifications sent concurrently.
+const nackWorkers = 4
+
+// NackNotification is the request body sent to the nack notification URL.
+type NackNotification struct {
+	Endpoint string `json:"endpoint"`
+	Version  uint64 `json:"version"`
+	Code     int    `json:"code"`
+}
+
+// notifyNacks sends queued nack notifications until the server is closed.
+func (self *Serv) notifyNacks() {
+	for {
+		select {
+		case <-self.closeSignal:
+			return
+		case notification := <-self.nackQueue:
+			self.notifyNack(notification)
+		}
+	}
+}
+
+func (self *Serv) notifyNack(notification *NackNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	resp, err := self.nackClient.Post(self.nackURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("server", "Could not send nack notification",
+				LogFields{"error": err.Error(), "endpoint": notification.Endpoint})
+		}
+		self.metrics.Increment("updates.rejected.notify.error")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("server", "Nack notification rejected",
+				LogFields{"status": strconv.Itoa(resp.StatusCode),
+					"endpoint": notification.Endpoint})
+		}
+		self.metrics.Increment("updates.rejected.notify.error")
+		return
+	}
+	self.metrics.Increment("updates.rejected.notify")
+}
+
+// RequestFlush sends an update to a connected client. trace is the context of
+// the span that delivered the update, if any.
+func (self *Serv) RequestFlush(client *Client, channel string, version int64, data string, trace SpanContext) (err error) {
 	defer func(client *Client, version int64) {
 		if r := recover(); r != nil {
 			var uaid string
@@ -334,7 +1368,7 @@ func (self *Serv) RequestFlush(client *Client, channel string, version int64, da
 						"stack": string(stack[:n])})
 			}
 			if len(uaid) > 0 && self.prop != nil {
-				self.prop.Send(uaid, version, data)
+				SendPing(self.prop, uaid, channel, version, data)
 			}
 		}
 		return
@@ -352,18 +1386,25 @@ func (self *Serv) RequestFlush(client *Client, channel string, version int64, da
 		}
 
 		// Attempt to send the command
-		client.Worker.Flush(client.PushWS, 0, channel, version, data)
+		span := self.app.Tracer().StartSpan("client.flush", SpanProducer, trace)
+		span.SetAttribute("uaid", client.UAID)
+		span.SetAttribute("chid", channel)
+		// The worker publishes the delivery event once the update is written.
+		span.End(client.Worker.Flush(client.PushWS, 0, channel, version, data))
 	}
 	return nil
 }
 
-func (self *Serv) Purge(cmd PushCommand, sock *PushWS) (result int, arguments JsMap) {
+func (self *Serv) Purge(cmd PushCommand, sock *PushWS) (result int, arguments *CommandArgs) {
 	result = 200
 	return
 }
 
-func (self *Serv) Update(chid, uid string, vers int64, time time.Time, data string) (err error) {
-	var pk string
+func (self *Serv) Update(chid, uid string, vers int64, time time.Time, data string, trace SpanContext) (err error) {
+	var (
+		pk   string
+		span *Span
+	)
 	updateErr := errors.New("Update Error")
 	reason := "Unknown UID"
 
@@ -379,12 +1420,20 @@ func (self *Serv) Update(chid, uid string, vers int64, time time.Time, data stri
 		goto updateError
 	}
 
-	if err = self.store.Update(pk, vers); err != nil {
+	span = self.app.Tracer().StartSpan("store.update", SpanClient, trace)
+	err = self.writes.Update(pk, vers)
+	span.End(err)
+	if err != nil {
 		reason = "Failed to update channel"
 		goto updateError
 	}
+	self.app.Events().Publish(&Event{
+		Type:      EventUpdateAccepted,
+		UAID:      uid,
+		ChannelID: chid,
+		Version:   vers})
 
-	if err = self.RequestFlush(client, chid, vers, data); err == nil {
+	if err = self.RequestFlush(client, chid, vers, data, trace); err == nil {
 		return
 	}
 	reason = "Failed to flush"
@@ -399,31 +1448,33 @@ updateError:
 	return err
 }
 
-func (self *Serv) HandleCommand(cmd PushCommand, sock *PushWS) (result int, args JsMap) {
-	var ret JsMap
-	if cmd.Arguments != nil {
-		args = cmd.Arguments
-	} else {
-		args = make(JsMap)
+func (self *Serv) HandleCommand(cmd PushCommand, sock *PushWS) (result int, args *CommandArgs) {
+	if cmd.Arguments == nil {
+		cmd.Arguments = new(CommandArgs)
 	}
+	args = cmd.Arguments
 
 	switch cmd.Command {
 	case HELLO:
 		if self.logger.ShouldLog(DEBUG) {
 			self.logger.Debug("server", "Handling HELLO event", nil)
 		}
-		worker := args["worker"].(Worker)
-		result, ret = self.Hello(worker, cmd, sock)
+		result, _ = self.Hello(args.Worker, cmd, sock)
 	case UNREG:
 		if self.logger.ShouldLog(DEBUG) {
 			self.logger.Debug("server", "Handling UNREG event", nil)
 		}
-		result, ret = self.Unreg(cmd, sock)
+		result, _ = self.Unreg(cmd, sock)
 	case REGIS:
 		if self.logger.ShouldLog(DEBUG) {
 			self.logger.Debug("server", "Handling REGIS event", nil)
 		}
-		result, ret = self.Regis(cmd, sock)
+		result, _ = self.Regis(cmd, sock)
+	case NACK:
+		if self.logger.ShouldLog(DEBUG) {
+			self.logger.Debug("server", "Handling NACK event", nil)
+		}
+		result, _ = self.Nack(cmd, sock)
 	case DIE:
 		if self.logger.ShouldLog(DEBUG) {
 			self.logger.Debug("server", "Cleanup", nil)
@@ -437,7 +1488,6 @@ func (self *Serv) HandleCommand(cmd PushCommand, sock *PushWS) (result int, args
 		self.Purge(cmd, sock)
 	}
 
-	args["uaid"] = ret["uaid"]
 	return result, args
 }
 
@@ -449,11 +1499,133 @@ func (self *Serv) Close() error {
 	}
 	self.isClosing = true
 	close(self.closeSignal)
+	// Deregister before closing the listeners, so that load balancers stop
+	// sending traffic first.
+	self.registration.Close()
 	self.clientLn.Close()
 	self.endpointLn.Close()
+	if self.grpcLn != nil {
+		self.grpcLn.Close()
+	}
+	if self.mqttLn != nil {
+		self.mqttLn.Close()
+	}
+	if self.adminLn != nil {
+		self.adminLn.Close()
+	}
+	// Tell connected clients to reconnect elsewhere.
+	for _, client := range self.app.Clients() {
+		client.PushWS.Bye(CloseGoingAway)
+	}
+	self.workers.Close()
+	self.writes.Close()
+	self.access.Close()
+	self.features.Close()
+	self.maintenance.Close()
+	self.receipts.Close()
+	self.realStats.Close()
+	self.kafka.Close()
+	self.digest.Close()
+	self.sentry.Close()
+	self.audit.Close()
 	return nil
 }
 
+// byeWorkers is the number of clients sent "bye" messages concurrently
+// while draining or rebalancing, so that slow clients do not hold up the
+// rest.
+const byeWorkers = 16
+
+// Drain stops accepting client connections, and asks connected clients to
+// reconnect to another node. Each client is told to wait a random number of
+// seconds, up to retryAfter, before reconnecting, so that reconnections are
+// spread across the remaining nodes. The endpoint listener stays open, so
+// that updates are delivered to clients that have not yet disconnected.
+func (self *Serv) Drain(retryAfter time.Duration) {
+	self.closeLock.Lock()
+	if self.isClosing || self.isDraining {
+		self.closeLock.Unlock()
+		return
+	}
+	self.isDraining = true
+	self.clientLn.Close()
+	if self.mqttLn != nil {
+		self.mqttLn.Close()
+	}
+	self.closeLock.Unlock()
+
+	clients := self.app.Clients()
+	if self.logger.ShouldLog(NOTICE) {
+		self.logger.Notice("server", "Draining client connections",
+			LogFields{"clients": strconv.Itoa(len(clients)),
+				"retryAfter": retryAfter.String()})
+	}
+	self.metrics.IncrementBy("server.drain.clients", int64(len(clients)))
+	self.byeClients(clients, retryAfter, nil)
+}
+
+// Rebalance asks a random percentage of connected clients to reconnect, so
+// that traffic can be shifted off a busy node without restarting it. If
+// hosts is given, clients are redirected to those client URLs; otherwise,
+// they reconnect through the load balancer. Returns the number of clients
+// asked to reconnect.
+func (self *Serv) Rebalance(percent int, hosts []string,
+	retryAfter time.Duration) int {
+
+	clients := self.app.Clients()
+	count := (len(clients)*percent + 99) / 100
+	if count > len(clients) {
+		count = len(clients)
+	}
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(clients)-i)
+		clients[i], clients[j] = clients[j], clients[i]
+	}
+	clients = clients[:count]
+	if self.logger.ShouldLog(NOTICE) {
+		self.logger.Notice("server", "Rebalancing client connections",
+			LogFields{"clients": strconv.Itoa(count),
+				"percent": strconv.Itoa(percent),
+				"hosts":   strings.Join(hosts, ",")})
+	}
+	self.metrics.IncrementBy("server.rebalance.clients", int64(count))
+	self.byeClients(clients, retryAfter, hosts)
+	return count
+}
+
+// byeClients closes the given client connections. Each client is told to
+// wait a random number of seconds, up to retryAfter, before reconnecting,
+// and redirected to hosts if given.
+func (self *Serv) byeClients(clients []*Client, retryAfter time.Duration,
+	hosts []string) {
+
+	maxSeconds := int64(retryAfter / time.Second)
+	pending := make(chan *Client)
+	var wg sync.WaitGroup
+	for i := 0; i < byeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range pending {
+				var delay time.Duration
+				if maxSeconds > 0 {
+					delay = time.Duration(1+rand.Int63n(maxSeconds)) * time.Second
+				}
+				if len(hosts) > 0 {
+					client.PushWS.ByeRedirect(hosts, delay)
+				} else {
+					client.PushWS.ByeAfter(CloseGoingAway, delay)
+				}
+			}
+		}()
+	}
+	for _, client := range clients {
+		pending <- client
+	}
+	close(pending)
+	wg.Wait()
+}
+
 func (self *Serv) sendClientCount() {
 	ticker := time.NewTicker(1 * time.Second)
 	for ok := true; ok; {
@@ -461,6 +1633,7 @@ func (self *Serv) sendClientCount() {
 		case ok = <-self.closeSignal:
 		case <-ticker.C:
 			self.metrics.Gauge("update.client.connections", int64(self.app.ClientCount()))
+			self.metrics.Gauge("client.connections.live", int64(self.app.ConnectionCount()))
 		}
 	}
 	ticker.Stop()
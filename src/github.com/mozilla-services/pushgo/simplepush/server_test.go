@@ -79,8 +79,8 @@ func (t *TestServer) load() (*Application, error) {
 			return logger, nil
 		},
 		PluginPinger: func(app *Application) (HasConfigStruct, error) {
-			pinger := new(NoopPing)
-			pingerConf := pinger.ConfigStruct().(*NoopPingConfig)
+			pinger := new(LoopbackPing)
+			pingerConf := pinger.ConfigStruct().(*LoopbackPingConfig)
 			if err := pinger.Init(app, pingerConf); err != nil {
 				return nil, fmt.Errorf("Error initializing proprietary pinger: %#v", err)
 			}
@@ -0,0 +1,525 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderSignature carries the signature of a response or routed update,
+	// of the form "keyid=...,ts=...,sig=...".
+	HeaderSignature = "X-Pushgo-Signature"
+
+	// HeaderSigner carries the routing URL of the node that signed a routed
+	// update.
+	HeaderSigner = "X-Pushgo-Signer"
+
+	// SigningKeysPath serves the node's public signing keys.
+	SigningKeysPath = "/signing/keys"
+)
+
+var (
+	ErrExpiredSignature = errors.New("Signature timestamp out of range")
+	ErrUnknownSigner    = errors.New("Signer is not a known node")
+	ErrUnknownSignKey   = errors.New("Unknown signing key")
+	ErrUnauthorizedPeer = errors.New("Request is not signed or sent over router TLS")
+	ErrPeerBodyTooLarge = errors.New("Signed request body too large")
+)
+
+// maxPeerBody is the largest request body accepted on the internal routes
+// of the routing listener. Signed bodies are read into memory to verify
+// them.
+const maxPeerBody = 4 << 20
+
+type SigningConfig struct {
+	// Enabled signs update responses and routed updates with the node's
+	// Ed25519 key, so that proxies, app servers, and peers can detect
+	// tampering. Public keys are served from /signing/keys on the endpoint
+	// and routing listeners.
+	Enabled bool `env:"enabled"`
+
+	// Key is the base64-encoded 32-byte Ed25519 seed. If not set, a key is
+	// generated at startup; peers fetch it through the discovery service.
+	Key string `env:"key"`
+
+	// VerifyRoutes accepts internal requests from other nodes (routed
+	// updates, relays, handoffs, in-flight recovery, and registry calls)
+	// that are signed by a node listed by the discovery service. If not set,
+	// internal requests are only accepted from peers authenticated by router
+	// mutual TLS. Requests are always signed. Defaults to true.
+	VerifyRoutes bool `toml:"verify_routes" env:"verify_routes"`
+
+	// MaxSkew is the maximum age of an internal request signature. Defaults
+	// to 5 minutes.
+	MaxSkew string `toml:"max_skew" env:"max_skew"`
+
+	// MaxNonces is the maximum number of request nonces remembered to reject
+	// replayed requests. Defaults to 100000.
+	MaxNonces int `toml:"max_nonces" env:"max_nonces"`
+
+	// KeyTTL is how long peer keys are cached before they are fetched again.
+	// Defaults to 10 minutes.
+	KeyTTL string `toml:"key_ttl" env:"key_ttl"`
+}
+
+// SigningKey is a public signing key, as served from /signing/keys.
+type SigningKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// SigningKeys is the response body for /signing/keys.
+type SigningKeys struct {
+	Node string       `json:"node"`
+	Keys []SigningKey `json:"keys"`
+}
+
+// peerKeys caches the signing keys fetched from a peer.
+type peerKeys struct {
+	keys    map[string]ed25519.PublicKey
+	fetched time.Time
+}
+
+// Signer signs update responses and routed updates with the node's key,
+// and verifies routed updates with keys fetched from peers.
+type Signer struct {
+	app          *Application
+	logger       *SimpleLogger
+	metrics      Statistician
+	enabled      bool
+	verifyRoutes bool
+	key          ed25519.PrivateKey
+	keyID        string
+	maxSkew      time.Duration
+	keyTTL       time.Duration
+	nonces       *nonceCache
+
+	lock  sync.Mutex
+	peers map[string]*peerKeys // Keyed by routing URL.
+}
+
+func NewSigner() *Signer {
+	return &Signer{peers: make(map[string]*peerKeys)}
+}
+
+func (*Signer) ConfigStruct() interface{} {
+	return &SigningConfig{
+		VerifyRoutes: true,
+		MaxSkew:      "5m",
+		KeyTTL:       "10m",
+		MaxNonces:    100000,
+	}
+}
+
+func (s *Signer) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*SigningConfig)
+	s.app = app
+	s.logger = app.Logger()
+	s.metrics = app.Metrics()
+	s.enabled = conf.Enabled
+	s.verifyRoutes = conf.VerifyRoutes
+	if s.maxSkew, err = time.ParseDuration(conf.MaxSkew); err != nil {
+		s.logger.Panic("signing", "Could not parse maximum signature skew",
+			LogFields{"error": err.Error(), "skew": conf.MaxSkew})
+		return err
+	}
+	if s.keyTTL, err = time.ParseDuration(conf.KeyTTL); err != nil {
+		s.logger.Panic("signing", "Could not parse peer key TTL",
+			LogFields{"error": err.Error(), "ttl": conf.KeyTTL})
+		return err
+	}
+	if len(conf.Key) == 0 {
+		_, s.key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		var seed []byte
+		if seed, err = base64.StdEncoding.DecodeString(conf.Key); err == nil {
+			if len(seed) != ed25519.SeedSize {
+				err = fmt.Errorf("Signing key must be %d bytes", ed25519.SeedSize)
+			} else {
+				s.key = ed25519.NewKeyFromSeed(seed)
+			}
+		}
+	}
+	if err != nil {
+		s.logger.Panic("signing", "Could not load signing key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	s.keyID = signingKeyID(s.key.Public().(ed25519.PublicKey))
+	s.nonces = newNonceCache(s.maxSkew, conf.MaxNonces)
+	return nil
+}
+
+// signingKeyID derives a short key ID from a public key.
+func signingKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Enabled indicates whether responses and routed updates are signed.
+func (s *Signer) Enabled() bool {
+	return s != nil && s.enabled
+}
+
+// VerifiesRoutes indicates whether routed updates must be signed.
+func (s *Signer) VerifiesRoutes() bool {
+	return s != nil && s.verifyRoutes
+}
+
+// Keys returns the node's public signing keys.
+func (s *Signer) Keys() *SigningKeys {
+	keys := &SigningKeys{Keys: []SigningKey{}}
+	if router := s.app.Router(); router != nil {
+		keys.Node = router.URL()
+	}
+	if s.key != nil {
+		keys.Keys = append(keys.Keys, SigningKey{
+			ID:  s.keyID,
+			Key: base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+		})
+	}
+	return keys
+}
+
+// signedContent returns the content covered by a signature. Requests are
+// signed with status 0.
+func signedContent(ts int64, method, path string, status int, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("pushgo-sig-v1\n%d\n%s\n%s\n%d\n%x",
+		ts, method, path, status, sum))
+}
+
+// requestContent returns the content covered by the signature of an
+// internal request. The nonce is remembered by the receiving node, so that
+// the request cannot be replayed.
+func requestContent(ts int64, nonce, method, uri string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("pushgo-req-v1\n%d\n%s\n%s\n%s\n%x",
+		ts, nonce, method, uri, sum))
+}
+
+// sign returns a signature header value for a response.
+func (s *Signer) sign(method, path string, status int, body []byte) string {
+	ts := time.Now().Unix()
+	sig := ed25519.Sign(s.key, signedContent(ts, method, path, status, body))
+	return fmt.Sprintf("keyid=%s,ts=%d,sig=%s", s.keyID, ts,
+		base64.RawURLEncoding.EncodeToString(sig))
+}
+
+// signature holds the parameters of a signature header value.
+type signature struct {
+	keyID string
+	ts    int64
+	nonce string
+	sig   []byte
+}
+
+// parseSignature splits a signature header value into its key ID,
+// timestamp, nonce (for requests), and signature.
+func parseSignature(value string) (parsed *signature, err error) {
+	if len(value) == 0 {
+		return nil, ErrMissingSignature
+	}
+	parsed = new(signature)
+	for _, param := range strings.Split(value, ",") {
+		pair := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(pair) < 2 {
+			return nil, ErrInvalidSignature
+		}
+		switch pair[0] {
+		case "keyid":
+			parsed.keyID = pair[1]
+		case "ts":
+			if parsed.ts, err = strconv.ParseInt(pair[1], 10, 64); err != nil {
+				return nil, ErrInvalidSignature
+			}
+		case "nonce":
+			parsed.nonce = pair[1]
+		case "sig":
+			if parsed.sig, err = base64.RawURLEncoding.DecodeString(pair[1]); err != nil {
+				return nil, ErrInvalidSignature
+			}
+		}
+	}
+	if len(parsed.keyID) == 0 || parsed.ts == 0 ||
+		len(parsed.sig) != ed25519.SignatureSize {
+		return nil, ErrInvalidSignature
+	}
+	return parsed, nil
+}
+
+// VerifySignature checks a signature header value against a public key.
+// App servers and proxies can use it to verify signed update responses.
+func VerifySignature(key ed25519.PublicKey, value, method, path string,
+	status int, body []byte) error {
+
+	parsed, err := parseSignature(value)
+	if err != nil {
+		return err
+	}
+	content := signedContent(parsed.ts, method, path, status, body)
+	if !ed25519.Verify(key, content, parsed.sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signingWriter buffers a response so that it can be signed.
+type signingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *signingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+// Handler signs the responses of the given handler. Streaming handlers must
+// not be wrapped, as the response is buffered until the handler returns.
+func (s *Signer) Handler(h http.HandlerFunc) http.HandlerFunc {
+	if !s.Enabled() {
+		return h
+	}
+	return func(resp http.ResponseWriter, req *http.Request) {
+		writer := &signingWriter{ResponseWriter: resp}
+		h(writer, req)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		resp.Header().Set(HeaderSignature, s.sign(req.Method, req.URL.Path,
+			writer.status, writer.body.Bytes()))
+		resp.WriteHeader(writer.status)
+		resp.Write(writer.body.Bytes())
+		s.metrics.Increment("signing.responses")
+	}
+}
+
+// SignRequest signs an internal request to another node's routing
+// listener. body must hold the full request body.
+func (s *Signer) SignRequest(req *http.Request, body []byte) {
+	if s == nil || s.key == nil {
+		return
+	}
+	if router := s.app.Router(); router != nil {
+		req.Header.Set(HeaderSigner, router.URL())
+	}
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	encodedNonce := base64.RawURLEncoding.EncodeToString(nonce)
+	ts := time.Now().Unix()
+	sig := ed25519.Sign(s.key, requestContent(ts, encodedNonce, req.Method,
+		req.URL.RequestURI(), body))
+	req.Header.Set(HeaderSignature, fmt.Sprintf("keyid=%s,ts=%d,nonce=%s,sig=%s",
+		s.keyID, ts, encodedNonce, base64.RawURLEncoding.EncodeToString(sig)))
+}
+
+// VerifyRequest checks the signature of an internal request against the
+// keys of the node that sent it. The node must be listed by the discovery
+// service, and each signature is only accepted once.
+func (s *Signer) VerifyRequest(req *http.Request, body []byte) (err error) {
+	defer func() {
+		if err != nil {
+			s.metrics.Increment("signing.routes.rejected")
+		}
+	}()
+	parsed, err := parseSignature(req.Header.Get(HeaderSignature))
+	if err != nil {
+		return err
+	}
+	if len(parsed.nonce) == 0 {
+		return ErrInvalidSignature
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(parsed.ts, 0)); skew > s.maxSkew || skew < -s.maxSkew {
+		return ErrExpiredSignature
+	}
+	signer := req.Header.Get(HeaderSigner)
+	if !s.knownNode(signer) {
+		return ErrUnknownSigner
+	}
+	key, err := s.peerKey(signer, parsed.keyID)
+	if err != nil {
+		return err
+	}
+	content := requestContent(parsed.ts, parsed.nonce, req.Method,
+		req.URL.RequestURI(), body)
+	if !ed25519.Verify(key, content, parsed.sig) {
+		return ErrInvalidSignature
+	}
+	// Check the nonce last, so that invalid requests cannot fill the cache.
+	if !s.nonces.Add(parsed.keyID+":"+parsed.nonce, now) {
+		s.metrics.Increment("signing.routes.replayed")
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// PeerHandler authenticates internal requests before passing them to the
+// given handler. Requests are accepted from peers authenticated by router
+// mutual TLS, or, if routes are verified, with a valid signature from a
+// known node. Signed bodies are buffered, up to maxPeerBody bytes.
+func (s *Signer) PeerHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if err := s.authenticatePeer(req); err != nil {
+			if s.logger.ShouldLog(WARNING) {
+				s.logger.Warn("signing", "Rejected internal request", LogFields{
+					"rid":   req.Header.Get(HeaderID),
+					"path":  req.URL.Path,
+					"error": err.Error()})
+			}
+			if err == ErrPeerBodyTooLarge {
+				http.Error(resp, "Request Entity Too Large",
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(resp, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		h(resp, req)
+	}
+}
+
+// authenticatePeer checks that an internal request came from another node.
+func (s *Signer) authenticatePeer(req *http.Request) error {
+	if router := s.app.Router(); router != nil && router.PeerTLS().Enabled() &&
+		req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return nil
+	}
+	if !s.VerifiesRoutes() {
+		s.metrics.Increment("signing.routes.rejected")
+		return ErrUnauthorizedPeer
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxPeerBody+1)); err != nil {
+			return err
+		}
+		if len(body) > maxPeerBody {
+			return ErrPeerBodyTooLarge
+		}
+	}
+	if err := s.VerifyRequest(req, body); err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// knownNode indicates whether a routing URL belongs to the current node or
+// to a contact listed by the discovery service.
+func (s *Signer) knownNode(contact string) bool {
+	if len(contact) == 0 {
+		return false
+	}
+	router := s.app.Router()
+	if router == nil {
+		return false
+	}
+	if contact == router.URL() {
+		return true
+	}
+	locator := router.Locator()
+	if locator == nil {
+		return false
+	}
+	contacts, err := locator.Contacts("")
+	if err != nil && s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("signing", "Could not fetch contacts to verify signer",
+			LogFields{"error": err.Error()})
+	}
+	return containsString(contacts, contact)
+}
+
+// peerKey returns a peer's public key, fetching the peer's keys if they
+// are not cached, have expired, or do not include the key ID.
+func (s *Signer) peerKey(contact, keyID string) (ed25519.PublicKey, error) {
+	router := s.app.Router()
+	if contact == router.URL() {
+		if keyID != s.keyID || s.key == nil {
+			return nil, ErrUnknownSignKey
+		}
+		return s.key.Public().(ed25519.PublicKey), nil
+	}
+	s.lock.Lock()
+	cached := s.peers[contact]
+	s.lock.Unlock()
+	if cached != nil && time.Since(cached.fetched) < s.keyTTL {
+		if key, ok := cached.keys[keyID]; ok {
+			return key, nil
+		}
+	}
+	fetched, err := s.fetchKeys(router, contact)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.peers[contact] = fetched
+	s.lock.Unlock()
+	key, ok := fetched.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownSignKey
+	}
+	return key, nil
+}
+
+// fetchKeys fetches a peer's signing keys from its routing listener.
+func (s *Signer) fetchKeys(router *Router, contact string) (*peerKeys, error) {
+	s.metrics.Increment("signing.keys.fetch")
+	resp, err := router.HTTPClient(5 * time.Second).Get(contact + SigningKeysPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status fetching signing keys: %d",
+			resp.StatusCode)
+	}
+	reply := new(SigningKeys)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	fetched := &peerKeys{
+		keys:    make(map[string]ed25519.PublicKey, len(reply.Keys)),
+		fetched: time.Now(),
+	}
+	for _, key := range reply.Keys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		// Key IDs are derived from the keys; skip mismatched entries.
+		if pub := ed25519.PublicKey(raw); signingKeyID(pub) == key.ID {
+			fetched.keys[key.ID] = pub
+		}
+	}
+	return fetched, nil
+}
@@ -0,0 +1,190 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, app *Application, enabled, verifyRoutes bool) *Signer {
+	signer := NewSigner()
+	conf := signer.ConfigStruct().(*SigningConfig)
+	conf.Enabled = enabled
+	conf.VerifyRoutes = verifyRoutes
+	if err := signer.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing signer: %s", err)
+	}
+	app.Server().signer = signer
+	return signer
+}
+
+func signingPublicKey(t *testing.T, signer *Signer) ed25519.PublicKey {
+	keys := signer.Keys().Keys
+	if len(keys) != 1 {
+		t.Fatalf("Wrong number of signing keys: %#v", keys)
+	}
+	key, err := base64.StdEncoding.DecodeString(keys[0].Key)
+	if err != nil {
+		t.Fatalf("Error decoding signing key: %s", err)
+	}
+	return ed25519.PublicKey(key)
+}
+
+func TestSignerResponses(t *testing.T) {
+	_, app := newTestHandler(t)
+	signer := newTestSigner(t, app, true, false)
+	handler := signer.Handler(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusAccepted)
+		resp.Write([]byte("{}"))
+	})
+	req, _ := http.NewRequest("PUT", "http://push.example.com/update/token", nil)
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusAccepted || resp.Body.String() != "{}" {
+		t.Errorf("Wrong signed response: %d %q", resp.Code, resp.Body.String())
+	}
+	key := signingPublicKey(t, signer)
+	value := resp.Header().Get(HeaderSignature)
+	if err := VerifySignature(key, value, "PUT", "/update/token",
+		http.StatusAccepted, []byte("{}")); err != nil {
+		t.Errorf("Error verifying response signature %q: %s", value, err)
+	}
+	if err := VerifySignature(key, value, "PUT", "/update/token",
+		http.StatusOK, []byte("{}")); err != ErrInvalidSignature {
+		t.Errorf("Wrong error for tampered status: %v", err)
+	}
+	if err := VerifySignature(key, "", "PUT", "/update/token",
+		http.StatusAccepted, []byte("{}")); err != ErrMissingSignature {
+		t.Errorf("Wrong error for missing signature: %v", err)
+	}
+
+	var nilSigner *Signer
+	if nilSigner.Enabled() || nilSigner.VerifiesRoutes() {
+		t.Error("Nil signer enabled")
+	}
+}
+
+func TestSignerRoutes(t *testing.T) {
+	senderHandler, senderApp := newTestHandler(t)
+	sender := newTestSigner(t, senderApp, true, false)
+	senderApp.Router().url = "http://" + senderApp.Router().Listener().Addr().String()
+	keysServer := &http.Server{Handler: http.HandlerFunc(senderHandler.SigningKeysHandler)}
+	go keysServer.Serve(senderApp.Router().Listener())
+	defer keysServer.Close()
+
+	_, receiverApp := newTestHandler(t)
+	receiver := newTestSigner(t, receiverApp, false, true)
+	receiverApp.Router().SetLocator(&StaticLocator{
+		contacts: []string{senderApp.Router().URL()}})
+
+	var (
+		lock     sync.Mutex
+		routeErr error
+		signed   bool
+	)
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			lock.Lock()
+			defer lock.Unlock()
+			signed = req.Header.Get(HeaderSigner) == senderApp.Router().URL()
+			if routeErr = receiver.VerifyRequest(req, body); routeErr != nil {
+				http.Error(resp, routeErr.Error(), http.StatusUnauthorized)
+				return
+			}
+			resp.Write([]byte("Ok"))
+		}))
+	defer peer.Close()
+	senderApp.Router().SetLocator(&StaticLocator{contacts: []string{peer.URL}})
+
+	err := senderApp.Router().Route(nil, "deadbeef000000000000000000000000",
+		"decafbad000000000000000000000000", 1, time.Now(), "test", "data",
+		PriorityNormal, SpanContext{})
+	if err != nil {
+		t.Fatalf("Error routing signed update: %s", err)
+	}
+	lock.Lock()
+	if !signed || routeErr != nil {
+		t.Errorf("Routed update not verified: signed %t, error %v", signed, routeErr)
+	}
+	lock.Unlock()
+
+	body := []byte("update")
+	req, _ := http.NewRequest("PUT", peer.URL+"/route/uaid", strings.NewReader("update"))
+	sender.SignRequest(req, body)
+	if err = receiver.VerifyRequest(req, []byte("tampered")); err != ErrInvalidSignature {
+		t.Errorf("Wrong error for tampered update: %v", err)
+	}
+	req.Header.Set(HeaderSigner, "http://unknown.example.com:3000")
+	if err = receiver.VerifyRequest(req, body); err != ErrUnknownSigner {
+		t.Errorf("Wrong error for unknown signer: %v", err)
+	}
+	req.Header.Del(HeaderSignature)
+	if err = receiver.VerifyRequest(req, body); err != ErrMissingSignature {
+		t.Errorf("Wrong error for unsigned update: %v", err)
+	}
+
+	req, _ = http.NewRequest("PUT", peer.URL+"/route/uaid", strings.NewReader("update"))
+	sender.SignRequest(req, body)
+	if err = receiver.VerifyRequest(req, body); err != nil {
+		t.Errorf("Error verifying signed update: %s", err)
+	}
+	if err = receiver.VerifyRequest(req, body); err != ErrReplayedNonce {
+		t.Errorf("Wrong error for replayed update: %v", err)
+	}
+}
+
+func TestSignerPeerHandler(t *testing.T) {
+	_, app := newTestHandler(t)
+	signer := newTestSigner(t, app, false, true)
+	app.Router().url = "http://" + app.Router().Listener().Addr().String()
+	handler := signer.PeerHandler(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		resp.Write(body)
+	})
+
+	req, _ := http.NewRequest("PUT", "http://peer.example.com/relay/uaid",
+		strings.NewReader("update"))
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status for unsigned request: %d", resp.Code)
+	}
+
+	// Requests signed by the current node are accepted once.
+	req, _ = app.Router().NewPeerRequest("PUT", "http://peer.example.com/relay/uaid",
+		[]byte("update"))
+	resp = httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusOK || resp.Body.String() != "update" {
+		t.Errorf("Wrong response for signed request: %d %q", resp.Code,
+			resp.Body.String())
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader("update"))
+	resp = httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status for replayed request: %d", resp.Code)
+	}
+
+	// Without route verification, only router TLS peers are accepted.
+	signer = newTestSigner(t, app, false, false)
+	handler = signer.PeerHandler(func(resp http.ResponseWriter, req *http.Request) {})
+	req, _ = app.Router().NewPeerRequest("PUT", "http://peer.example.com/relay/uaid",
+		[]byte("update"))
+	resp = httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status for signed request without verification: %d", resp.Code)
+	}
+}
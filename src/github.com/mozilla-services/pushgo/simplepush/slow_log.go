@@ -0,0 +1,107 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SlowLogConfig struct {
+	// Storage is the latency above which storage calls are logged and
+	// counted as "store.<op>.slow". Set to "0" to disable. Defaults to
+	// 500 milliseconds.
+	Storage string `env:"storage"`
+
+	// Flush is the latency above which client flushes are logged and
+	// counted as "client.flush.slow". Set to "0" to disable. Defaults to
+	// 2 seconds.
+	Flush string `env:"flush"`
+}
+
+// SlowLog logs storage calls and client flushes that exceed latency
+// thresholds, for tail latency investigations. Device IDs are hashed with
+// the audit log key, so that slow calls can be matched to audit records.
+type SlowLog struct {
+	logger  *SimpleLogger
+	metrics Statistician
+	hasher  *AuditLog
+	storage time.Duration
+	flush   time.Duration
+}
+
+func NewSlowLog(hasher *AuditLog) *SlowLog {
+	return &SlowLog{hasher: hasher}
+}
+
+func (*SlowLog) ConfigStruct() interface{} {
+	return &SlowLogConfig{
+		Storage: "500ms",
+		Flush:   "2s",
+	}
+}
+
+func (s *SlowLog) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*SlowLogConfig)
+	s.logger = app.Logger()
+	s.metrics = app.Metrics()
+	if s.storage, err = time.ParseDuration(conf.Storage); err != nil {
+		s.logger.Panic("slowlog", "Could not parse slow storage threshold",
+			LogFields{"error": err.Error(), "storage": conf.Storage})
+		return err
+	}
+	if s.flush, err = time.ParseDuration(conf.Flush); err != nil {
+		s.logger.Panic("slowlog", "Could not parse slow flush threshold",
+			LogFields{"error": err.Error(), "flush": conf.Flush})
+		return err
+	}
+	return nil
+}
+
+// Storage records a storage call, e.g. "fetch" or "register", if it took
+// longer than the threshold.
+func (s *SlowLog) Storage(op, requestID, uaid string, store Store,
+	elapsed time.Duration) {
+
+	if s == nil || s.storage <= 0 || elapsed < s.storage {
+		return
+	}
+	s.metrics.Increment("store." + op + ".slow")
+	if s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("slowlog", "Slow storage call", LogFields{
+			"rid":      requestID,
+			"op":       op,
+			"backend":  storeName(store),
+			"uaidHash": s.hasher.HashUAID(uaid),
+			"duration": strconv.FormatInt(int64(elapsed/time.Millisecond), 10)})
+	}
+}
+
+// Flush records a client flush over the given listener, e.g. "socket" or
+// "mqtt", if it took longer than the threshold.
+func (s *SlowLog) Flush(listener, requestID, uaid string, store Store,
+	elapsed time.Duration) {
+
+	if s == nil || s.flush <= 0 || elapsed < s.flush {
+		return
+	}
+	s.metrics.Increment("client.flush.slow")
+	if s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("slowlog", "Slow client flush", LogFields{
+			"rid":      requestID,
+			"listener": listener,
+			"backend":  storeName(store),
+			"uaidHash": s.hasher.HashUAID(uaid),
+			"duration": strconv.FormatInt(int64(elapsed/time.Millisecond), 10)})
+	}
+}
+
+// storeName returns the type name of a storage adapter, e.g. "EmceeStore".
+func storeName(store Store) string {
+	name := fmt.Sprintf("%T", store)
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,42 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	_, app := newTestHandler(t)
+	metrics := app.metrics.(*TestMetrics)
+	slowLog := NewSlowLog(nil)
+	conf := slowLog.ConfigStruct().(*SlowLogConfig)
+	conf.Storage = "100ms"
+	conf.Flush = "0"
+	if err := slowLog.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing slow log: %s", err)
+	}
+	uaid := "deadbeef000000000000000000000000"
+	slowLog.Storage("fetch", "rid", uaid, app.Store(), 50*time.Millisecond)
+	slowLog.Storage("fetch", "rid", uaid, app.Store(), 150*time.Millisecond)
+	slowLog.Storage("register", "rid", uaid, app.Store(), time.Second)
+	slowLog.Flush("socket", "rid", uaid, app.Store(), time.Hour)
+
+	metrics.RLock()
+	defer metrics.RUnlock()
+	for name, expected := range map[string]int64{
+		"store.fetch.slow":    1,
+		"store.register.slow": 1,
+		"client.flush.slow":   0,
+	} {
+		if actual := metrics.Counters[name]; actual != expected {
+			t.Errorf("Wrong value for %q: got %d; want %d", name, actual, expected)
+		}
+	}
+	if name := storeName(app.Store()); name != "NoStore" {
+		t.Errorf("Wrong store name: got %q; want NoStore", name)
+	}
+}
@@ -0,0 +1,432 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+const snsAPIVersion = "2010-03-31"
+
+func init() {
+	AvailablePings["sns"] = func() HasConfigStruct { return NewSNSPing() }
+}
+
+type SNSPingConfig struct {
+	// Applications lists the ARNs of the SNS platform applications whose
+	// endpoints devices may register, e.g.
+	// "arn:aws:sns:us-east-1:123456789012:app/GCM/example".
+	Applications []string `env:"applications"`
+
+	// Endpoint overrides the SNS API endpoint,
+	// "https://sns.<region>.amazonaws.com". By default, each wake is
+	// published in the region of the device's platform endpoint.
+	Endpoint string `env:"endpoint"`
+
+	// TTL is how long the underlying push services hold wakes for offline
+	// devices. Defaults to 72 hours.
+	TTL string `env:"ttl"`
+
+	// Timeout is the maximum time to wait for an SNS response. Defaults to
+	// 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Retry configures retries for throttled and unavailable responses.
+	Retry retry.Config
+
+	// Simulate logs and counts wakes instead of sending them to SNS, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// SNSPingData is the "connect" data sent by devices registered with an SNS
+// platform application in the handshake.
+type SNSPingData struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// snsError is the body of an SNS error response.
+type snsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// snsCredentialsTTL is the amount of time to cache AWS credentials.
+// Instance role credentials are rotated well before they expire.
+const snsCredentialsTTL = 5 * time.Minute
+
+// SNSPing wakes disconnected devices by publishing to their Amazon SNS
+// platform endpoints, which fan out to FCM and APNs. Deployments that
+// already manage devices with SNS do not need vendor credentials; requests
+// are signed with AWS credentials from the environment or the instance's
+// IAM role.
+type SNSPing struct {
+	logger       *SimpleLogger
+	metrics      Statistician
+	store        Store
+	client       *http.Client
+	applications map[string]bool
+	endpoint     string
+	ttl          time.Duration
+	feedback     *PingFeedback
+	guard        *BridgeGuard
+	simulate     bool
+	rh           *retry.Helper
+	credsLock    sync.Mutex
+	creds        *AWSCredentials
+	credsExpires time.Time
+	closeLock    sync.Mutex
+	closeSignal  chan bool
+	isClosed     bool
+
+	// credentials returns AWS credentials; overridden by tests.
+	credentials func() (*AWSCredentials, error)
+}
+
+func NewSNSPing() *SNSPing {
+	return &SNSPing{closeSignal: make(chan bool)}
+}
+
+func (*SNSPing) ConfigStruct() interface{} {
+	return &SNSPingConfig{
+		TTL:     "72h",
+		Timeout: "10s",
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+		Guard: DefaultBridgeGuard(),
+	}
+}
+
+func (r *SNSPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*SNSPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("sns", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "sns", r.guard)
+	r.simulate = conf.Simulate
+	if r.credentials == nil {
+		r.credentials = GetAWSCredentials
+	}
+
+	r.applications = make(map[string]bool, len(conf.Applications))
+	for _, arn := range conf.Applications {
+		if arn = strings.TrimSpace(arn); len(arn) > 0 {
+			r.applications[arn] = true
+		}
+	}
+	if len(r.applications) == 0 {
+		r.logger.Panic("propping", "No SNS platform applications configured", nil)
+		return ConfigurationErr
+	}
+	r.endpoint = strings.TrimRight(conf.Endpoint, "/")
+
+	if r.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		r.logger.Panic("propping", "Could not parse TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse SNS timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	r.client = &http.Client{Timeout: timeout}
+
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+	return nil
+}
+
+// snsApplicationARN returns the platform application ARN and region of a
+// platform endpoint ARN, of the form
+// "arn:aws:sns:<region>:<account>:endpoint/<platform>/<app>/<id>".
+func snsApplicationARN(endpointARN string) (appARN, region string, ok bool) {
+	parts := strings.Split(endpointARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" ||
+		len(parts[3]) == 0 {
+		return "", "", false
+	}
+	resource := strings.Split(parts[5], "/")
+	if len(resource) != 4 || resource[0] != "endpoint" {
+		return "", "", false
+	}
+	for _, name := range resource[1:] {
+		if len(name) == 0 {
+			return "", "", false
+		}
+	}
+	appARN = strings.Join(parts[:5], ":") + ":app/" + resource[1] + "/" + resource[2]
+	return appARN, parts[3], true
+}
+
+// endpointRegion returns the region of a platform endpoint, or false if the
+// endpoint does not belong to a configured application.
+func (r *SNSPing) endpointRegion(endpointARN string) (region string, ok bool) {
+	appARN, region, ok := snsApplicationARN(endpointARN)
+	if !ok || !r.applications[appARN] {
+		return "", false
+	}
+	return region, true
+}
+
+// awsCredentials returns cached AWS credentials, fetching new ones if the
+// cached credentials are stale or were rejected.
+func (r *SNSPing) awsCredentials(refresh bool) (*AWSCredentials, error) {
+	r.credsLock.Lock()
+	defer r.credsLock.Unlock()
+	if !refresh && r.creds != nil && time.Now().Before(r.credsExpires) {
+		return r.creds, nil
+	}
+	creds, err := r.credentials()
+	if err != nil {
+		return nil, &PingerError{"Could not get AWS credentials: " + err.Error(), true}
+	}
+	r.creds = creds
+	r.credsExpires = time.Now().Add(snsCredentialsTTL)
+	return creds, nil
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and SNS is only used to wake disconnected devices.
+func (r *SNSPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *SNSPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's SNS platform endpoint ARN.
+func (r *SNSPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(SNSPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil {
+		return UnsupportedProtocolErr
+	}
+	if _, ok := r.endpointRegion(ping.Endpoint); !ok {
+		r.metrics.Increment("ping.sns.rejected")
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store SNS endpoint",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// snsMessage returns the per-platform message structure for a wake. FCM
+// devices receive a data message, and iOS devices a silent background
+// push, each with the version and data.
+func snsMessage(vers int64, data string) (string, error) {
+	version := strconv.FormatInt(vers, 10)
+	gcm, err := json.Marshal(map[string]interface{}{
+		"priority": "high",
+		"data": map[string]string{
+			"version": version,
+			"msg":     data,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := new(apnsPayload)
+	payload.APS.ContentAvailable = 1
+	payload.Version = version
+	payload.Msg = data
+	apns, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	message, err := json.Marshal(map[string]string{
+		"default":      version,
+		"GCM":          string(gcm),
+		"APNS":         string(apns),
+		"APNS_SANDBOX": string(apns),
+	})
+	return string(message), err
+}
+
+// Send publishes a wake to the device's platform endpoint. It returns false
+// without an error if the device did not register an endpoint, or if SNS
+// reports that the endpoint is disabled or missing; such endpoints are
+// removed from storage.
+func (r *SNSPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch SNS endpoint",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(SNSPingData)
+	err = json.Unmarshal(pingData, ping)
+	region, ok := r.endpointRegion(ping.Endpoint)
+	if err != nil || !ok {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid SNS registration data",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	message, err := snsMessage(vers, data)
+	if err != nil {
+		return false, err
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	var disabled bool
+	sendOnce := func() (err error) {
+		disabled, err = r.publish(region, ping.Endpoint, message)
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.sns.retry", int64(retries))
+	if disabled {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Removing disabled SNS endpoint",
+				LogFields{"uaid": uaid})
+		}
+		r.metrics.Increment("ping.sns.unregistered")
+		r.feedback.Invalid(uaid)
+		return false, nil
+	}
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to publish SNS wake",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.sns.error")
+		r.feedback.Failed(uaid, err)
+		return false, err
+	}
+	r.metrics.Increment("ping.sns.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// publish sends a message to a platform endpoint, returning true if the
+// endpoint is disabled or missing. Rejected credentials, throttled, and
+// unavailable responses are temporary errors.
+func (r *SNSPing) publish(region, endpointARN, message string) (disabled bool, err error) {
+	creds, err := r.awsCredentials(false)
+	if err != nil {
+		return false, err
+	}
+	ttl := strconv.FormatInt(int64(r.ttl/time.Second), 10)
+	query := url.Values{
+		"Action":           {"Publish"},
+		"Version":          {snsAPIVersion},
+		"TargetArn":        {endpointARN},
+		"MessageStructure": {"json"},
+		"Message":          {message},
+	}
+	attrs := [][2]string{
+		{"AWS.SNS.MOBILE.GCM.TTL", ttl},
+		{"AWS.SNS.MOBILE.APNS.TTL", ttl},
+		{"AWS.SNS.MOBILE.APNS_SANDBOX.TTL", ttl},
+		{"AWS.SNS.MOBILE.APNS.PUSH_TYPE", "background"},
+		{"AWS.SNS.MOBILE.APNS.PRIORITY", "5"},
+	}
+	for i, attr := range attrs {
+		prefix := fmt.Sprintf("MessageAttributes.entry.%d.", i+1)
+		query.Set(prefix+"Name", attr[0])
+		query.Set(prefix+"Value.DataType", "String")
+		query.Set(prefix+"Value.StringValue", attr[1])
+	}
+	endpoint := r.endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com", region)
+	}
+	req, err := http.NewRequest("GET", endpoint+"/?"+awsCanonicalQuery(query), nil)
+	if err != nil {
+		return false, err
+	}
+	SignAWSRequest(req, creds, region, "sns", time.Now())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	snsErr := new(snsError)
+	xml.NewDecoder(resp.Body).Decode(snsErr)
+	switch {
+	case snsErr.Code == "EndpointDisabled" || snsErr.Code == "NotFound":
+		return true, &PingerError{"SNS endpoint disabled: " + snsErr.Code, false}
+	case snsErr.Code == "ExpiredToken" || snsErr.Code == "InvalidClientTokenId":
+		r.awsCredentials(true)
+		return false, &PingerError{"AWS credentials rejected: " + snsErr.Code, true}
+	case snsErr.Code == "Throttled" || snsErr.Code == "Throttling" ||
+		resp.StatusCode >= 500:
+		return false, &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode), true}
+	}
+	return false, &PingerError{fmt.Sprintf("SNS error: %d %s %s",
+		resp.StatusCode, snsErr.Code, snsErr.Message), false}
+}
+
+func (r *SNSPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *SNSPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *SNSPing) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	return nil
+}
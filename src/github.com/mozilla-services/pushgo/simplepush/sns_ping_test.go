@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_SNSPingSend(t *testing.T) {
+	const app = "arn:aws:sns:us-west-2:123456789012:app/GCM/example"
+	const endpoint = "arn:aws:sns:us-west-2:123456789012:endpoint/GCM/example/"
+	var (
+		lock     sync.Mutex
+		messages []map[string]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth,
+			"AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/sns/") {
+			t.Errorf("Wrong authorization: %q", auth)
+		}
+		query := req.URL.Query()
+		if query.Get("Action") != "Publish" || query.Get("MessageStructure") != "json" {
+			t.Errorf("Wrong publish request: %s", req.URL.RawQuery)
+		}
+		message := make(map[string]string)
+		if err := json.Unmarshal([]byte(query.Get("Message")), &message); err != nil {
+			t.Errorf("Error decoding message: %s", err)
+		}
+		messages = append(messages, message)
+		switch query.Get("TargetArn") {
+		case endpoint + "flaky":
+			if len(messages) == 1 {
+				resp.WriteHeader(http.StatusBadRequest)
+				resp.Write([]byte(`<ErrorResponse><Error><Code>Throttled</Code></Error></ErrorResponse>`))
+				return
+			}
+		case endpoint + "disabled":
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(`<ErrorResponse><Error><Code>EndpointDisabled</Code></Error></ErrorResponse>`))
+			return
+		}
+		resp.Write([]byte(`<PublishResponse/>`))
+	}))
+	defer srv.Close()
+
+	_, testApp := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: testApp.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	testApp.SetStore(store)
+	pinger := NewSNSPing()
+	pinger.credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	}
+	conf := pinger.ConfigStruct().(*SNSPingConfig)
+	conf.Applications = []string{app}
+	conf.Endpoint = srv.URL
+	conf.Retry.Delay = "1ms"
+	conf.Retry.MaxDelay = "1ms"
+	conf.Retry.MaxJitter = "0"
+	if err := pinger.Init(testApp, conf); err != nil {
+		t.Fatalf("Error initializing SNS pinger: %s", err)
+	}
+	defer pinger.Close()
+
+	for _, rejected := range []string{
+		`{"endpoint":"arn:aws:sns:us-west-2:123456789012:endpoint/GCM/other/1"}`,
+		`{"endpoint":"arn:aws:sns:us-west-2:123456789012:app/GCM/example"}`,
+		`{"token":"abc"}`,
+	} {
+		if err := pinger.Register("uaid0", []byte(rejected)); err != UnsupportedProtocolErr {
+			t.Errorf("Wrong error for %s: %v", rejected, err)
+		}
+	}
+	for uaid, id := range map[string]string{
+		"uaid1": "flaky",
+		"uaid2": "disabled",
+	} {
+		pingData, _ := json.Marshal(&SNSPingData{Endpoint: endpoint + id})
+		if err := pinger.Register(uaid, pingData); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	// Throttled publishes are retried.
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	lock.Lock()
+	if len(messages) != 2 {
+		t.Errorf("Wrong publish count: got %d; want 2", len(messages))
+	} else if m := messages[1]; m["default"] != "5" ||
+		!strings.Contains(m["GCM"], `"version":"5"`) ||
+		!strings.Contains(m["APNS"], `"content-available":1`) {
+		t.Errorf("Wrong message: %#v", m)
+	}
+	lock.Unlock()
+
+	// Disabled endpoints are removed.
+	if ok, err := pinger.Send("uaid2", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for disabled endpoint: ok=%v, err=%v", ok, err)
+	}
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Disabled endpoint not removed: %s", data)
+	}
+}
@@ -5,30 +5,62 @@
 package simplepush
 
 type StaticLocatorConf struct {
+	DiscoveryConf
 	Contacts []string `env:"contacts"`
 }
 
+// StaticLocator returns a fixed seed list of peers. If probing is enabled,
+// unhealthy peers are excluded until they recover.
 type StaticLocator struct {
 	logger   *SimpleLogger
 	metrics  Statistician
 	contacts []string
+	pool     *contactPool
 }
 
 func (*StaticLocator) ConfigStruct() interface{} {
-	return new(StaticLocatorConf)
+	return &StaticLocatorConf{
+		DiscoveryConf: DiscoveryConf{
+			ProbeInterval: "0",
+			ProbeTimeout:  "2s",
+			MaxFailures:   3,
+		},
+	}
 }
 
-func (l *StaticLocator) Init(app *Application, config interface{}) error {
+func (l *StaticLocator) Init(app *Application, config interface{}) (err error) {
 	conf := config.(*StaticLocatorConf)
 	l.logger = app.Logger()
 	l.metrics = app.Metrics()
 	l.contacts = conf.Contacts
+	if len(conf.ProbeInterval) == 0 || conf.ProbeInterval == "0" ||
+		len(l.contacts) == 0 {
+		return nil
+	}
+	// The list never changes, so only the probe loop runs.
+	conf.RefreshInterval = ""
+	fetch := func() ([]string, error) { return l.contacts, nil }
+	if l.pool, err = newContactPool(app, "static", &conf.DiscoveryConf, fetch); err != nil {
+		return err
+	}
+	return l.pool.Start()
+}
+
+func (l *StaticLocator) Close() error {
+	if l.pool != nil {
+		return l.pool.Close()
+	}
 	return nil
 }
 
-func (l *StaticLocator) Close() error                      { return nil }
-func (l *StaticLocator) Contacts(string) ([]string, error) { return l.contacts, nil }
-func (l *StaticLocator) Status() (bool, error)             { return true, nil }
+func (l *StaticLocator) Contacts(string) ([]string, error) {
+	if l.pool != nil {
+		return l.pool.Contacts()
+	}
+	return l.contacts, nil
+}
+
+func (l *StaticLocator) Status() (bool, error) { return true, nil }
 
 func init() {
 	AvailableLocators["static"] = func() HasConfigStruct { return new(StaticLocator) }
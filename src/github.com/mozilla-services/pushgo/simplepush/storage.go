@@ -82,6 +82,38 @@ type DbConf struct {
 	// PingPrefix is the key prefix for proprietary (GCM, etc.) pings. Defaults to
 	// "_pc-".
 	PingPrefix string `toml:"prop_prefix" env:"prop_prefix"`
+
+	// PingKeys lists the keys used to encrypt proprietary pings, each of the
+	// form "id:base64key". If empty, pings are stored unencrypted.
+	PingKeys []string `toml:"prop_keys" env:"prop_keys"`
+
+	// PingKeyID selects the key used to encrypt new proprietary pings. Older
+	// keys are kept to decrypt existing pings.
+	PingKeyID int `toml:"prop_key_id" env:"prop_key_id"`
+
+	// AccessPrefix is the key prefix for device last-access times. Defaults to
+	// "_la-".
+	AccessPrefix string `toml:"access_prefix" env:"access_prefix"`
+
+	// GroupPrefix is the key prefix for shared channel membership lists.
+	// Defaults to "_gm-".
+	GroupPrefix string `toml:"group_prefix" env:"group_prefix"`
+
+	// RoutePrefix is the key prefix for the routing URLs of connected
+	// devices. Defaults to "_rt-".
+	RoutePrefix string `toml:"route_prefix" env:"route_prefix"`
+
+	// APIKeyPrefix is the key prefix for app server API keys. Defaults to
+	// "_ak-".
+	APIKeyPrefix string `toml:"apikey_prefix" env:"apikey_prefix"`
+
+	// OutcomePrefix is the key prefix for the result of the last proprietary
+	// ping sent to each device. Defaults to "_po-".
+	OutcomePrefix string `toml:"outcome_prefix" env:"outcome_prefix"`
+
+	// NoncePrefix is the key prefix for Hawk nonces, which are shared so
+	// that each can be used once across all nodes. Defaults to "_hn-".
+	NoncePrefix string `toml:"nonce_prefix" env:"nonce_prefix"`
 }
 
 // Store describes a storage adapter.
@@ -139,3 +171,37 @@ type Store interface {
 	// DropPing removes all proprietary ping info for the given device.
 	DropPing(suaid string) error
 }
+
+// BatchStore is implemented by storage adapters that can register or
+// unregister several channels as a single unit. If any channel cannot be
+// stored, the adapter restores the records it changed before returning the
+// error. Stores without transactions restore on a best-effort basis, and log
+// records that could not be restored. Adapters that do not implement it are
+// updated one channel at a time.
+type BatchStore interface {
+	// RegisterMany creates channel records for all the given channel IDs.
+	RegisterMany(suaid string, schids []string, version int64) error
+
+	// UnregisterMany marks all the given channel records as inactive.
+	UnregisterMany(suaid string, schids []string) error
+}
+
+// RegisteredChannel describes a channel registered to a device.
+type RegisteredChannel struct {
+	ChannelID   string
+	LastTouched time.Time
+}
+
+// ChannelLister is implemented by storage adapters that can list a device's
+// registered channels. The server uses it to enforce the channel limit at
+// registration time; registrations are not limited for adapters that do not
+// implement it.
+type ChannelLister interface {
+	// ChannelIDs returns the device's channel ID list, without fetching the
+	// channel records. The list may include unregistered channels.
+	ChannelIDs(suaid string) ([]string, error)
+
+	// Channels returns the channels registered to a device, in no particular
+	// order.
+	Channels(suaid string) ([]RegisteredChannel, error)
+}
@@ -5,10 +5,11 @@
 package simplepush
 
 import (
+	"io"
+	"net"
+	"net/http"
 	"sync"
 	"time"
-
-	"golang.org/x/net/websocket"
 )
 
 type CommandType int
@@ -22,6 +23,7 @@ const (
 	RETRN
 	DIE
 	PURGE
+	NACK
 )
 
 var cmdLabels = map[CommandType]string{
@@ -32,24 +34,46 @@ var cmdLabels = map[CommandType]string{
 	FLUSH: "Flush",
 	RETRN: "Return",
 	DIE:   "Die",
-	PURGE: "Purge"}
+	PURGE: "Purge",
+	NACK:  "NACK"}
 
 type PushCommand struct {
 	// Use mutable int value
-	Command   CommandType //command type (UNREG, REGIS, ACK, etc)
-	Arguments JsMap       //command arguments
+	Command   CommandType  //command type (UNREG, REGIS, ACK, etc)
+	Arguments *CommandArgs //command arguments
+}
+
+// CommandArgs holds the arguments of a command sent to the server, and the
+// results filled in by the server.
+type CommandArgs struct {
+	Worker      Worker        // HELLO: the worker for the connection.
+	UAID        string        // HELLO: the device ID.
+	ChannelIDs  []interface{} // HELLO: the channels known to the client.
+	Connect     []byte        // HELLO: proprietary ping data.
+	CanRedirect bool          // HELLO: whether the client follows redirects.
+	ChannelID   string        // REGIS: the channel to register.
+	Shared      bool          // REGIS: whether the channel is shared.
+	Bridge      bool          // REGIS: whether the channel is bridge-preferred.
+	Updates     []Update      // NACK: the rejected updates.
+	Code        int           // NACK: the client's error code.
+
+	Redirect string // HELLO: the URL of the owning node, if any.
+	Endpoint string // REGIS: the generated push endpoint.
 }
 
 type PushWS struct {
 	uaidLock sync.RWMutex
-	uaid     string          // Hex-encoded client ID; not normalized
-	Socket   *websocket.Conn // Remote connection
+	uaid     string    // Hex-encoded client ID; not normalized
+	Socket   Socket    // Remote connection
+	Conn     io.Closer // Remote connection for non-WebSocket clients
 	Store
+	Tenant    *Tenant // Tenant of the connected host; nil if untenanted
 	Logger    *SimpleLogger
 	Metrics   *Metrics
 	Born      time.Time
 	closeLock sync.RWMutex
 	closed    bool
+	writeLock sync.Mutex // Serializes writes and their deadlines.
 }
 
 func (ws *PushWS) UAID() (uaid string) {
@@ -72,19 +96,43 @@ func (ws *PushWS) IsClosed() (closed bool) {
 	return
 }
 
-func (ws *PushWS) Close() error {
-	if ws == nil {
-		return nil
-	}
+// markClosed marks the connection as closed. Returns false if it was
+// already closed.
+func (ws *PushWS) markClosed() bool {
 	ws.closeLock.Lock()
+	defer ws.closeLock.Unlock()
 	if ws.closed {
-		ws.closeLock.Unlock()
-		return nil
+		return false
 	}
 	ws.closed = true
-	ws.closeLock.Unlock()
+	return true
+}
+
+// writeTimed calls write with the write deadline set to timeout from now,
+// and clears the deadline once write returns. A timeout of 0 leaves the
+// deadline unset. Writes are serialized, so that one write cannot pick up or
+// clear the deadline of another.
+func (ws *PushWS) writeTimed(timeout time.Duration, write func() error) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if timeout <= 0 {
+		return write()
+	}
+	ws.Socket.SetWriteDeadline(time.Now().Add(timeout))
+	err := write()
+	ws.Socket.SetWriteDeadline(time.Time{})
+	return err
+}
+
+func (ws *PushWS) Close() error {
+	if ws == nil || !ws.markClosed() {
+		return nil
+	}
 	socket := ws.Socket
 	if socket == nil {
+		if ws.Conn != nil {
+			return ws.Conn.Close()
+		}
 		return nil
 	}
 	return socket.Close()
@@ -98,16 +146,45 @@ func (ws *PushWS) Origin() string {
 	if ws.Socket == nil {
 		return "No Socket"
 	}
-	conf := ws.Socket.Config()
-	if conf == nil {
-		return "No Socket Config"
-	}
-	origin := conf.Origin
+	origin, _ := requestOrigin(ws.Socket.Request())
 	if origin == nil {
 		return "No Socket Origin"
 	}
 	return origin.String()
 }
 
+// RemoteAddr returns the client's IP address. For WebSocket clients behind
+// a trusted proxy, this is the address forwarded by the proxy.
+func (ws *PushWS) RemoteAddr() string {
+	if ws == nil {
+		return ""
+	}
+	if ws.Socket != nil {
+		return requestRemoteAddr(ws.Socket.Request())
+	}
+	if conn, ok := ws.Conn.(net.Conn); ok {
+		return hostOnly(conn.RemoteAddr().String())
+	}
+	return ""
+}
+
+// requestRemoteAddr returns the IP address of the client that sent an HTTP
+// request. X-Forwarded-For is not consulted here: requests from trusted
+// proxies are given the client address by TrustedProxies.Handler.
+func requestRemoteAddr(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	return hostOnly(req.RemoteAddr)
+}
+
+// hostOnly strips the port from an address, if any.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 // o4fs
 // vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
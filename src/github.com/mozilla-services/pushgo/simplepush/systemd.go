@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SystemdAddrPrefix selects a listening socket passed by systemd socket
+// activation, instead of binding one. "systemd:websocket" selects the socket
+// named by FileDescriptorName=websocket in the socket unit. Sockets without
+// a name are selected by their position among the unit's sockets, starting
+// at 0; e.g., "systemd:0".
+const SystemdAddrPrefix = "systemd:"
+
+// Environment variables set by systemd for socket-activated services.
+const (
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+)
+
+// listenFDsStart is the first descriptor passed by systemd; overridden by
+// tests.
+var listenFDsStart = 3
+
+// IsSystemdAddr indicates whether addr names a socket passed by systemd.
+func IsSystemdAddr(addr string) bool {
+	return strings.HasPrefix(addr, SystemdAddrPrefix)
+}
+
+// systemdListenFDs returns the listening sockets passed by systemd, keyed by
+// address. The variables are removed from the environment, so that they are
+// not passed to child processes, including those started by Upgrade. Sockets
+// claimed by listeners are passed on to upgraded processes in the same way
+// as bound sockets.
+func systemdListenFDs() map[string]*os.File {
+	pid, err := strconv.Atoi(os.Getenv(listenPIDEnv))
+	count, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	os.Unsetenv(listenPIDEnv)
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(listenFDNamesEnv)
+	if err != nil || pid != os.Getpid() || count <= 0 {
+		return nil
+	}
+	files := make(map[string]*os.File, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := strconv.Itoa(i)
+		if i < len(names) && len(names[i]) > 0 && names[i] != "unknown" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		files[SystemdAddrPrefix+name] = os.NewFile(uintptr(fd), name)
+	}
+	return files
+}
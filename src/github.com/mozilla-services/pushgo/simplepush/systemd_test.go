@@ -0,0 +1,65 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListener(t *testing.T) {
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	addr := activated.Addr().String()
+	file, err := activated.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error duplicating listener: %s", err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	activated.Close()
+	if err != nil {
+		t.Fatalf("Error duplicating listener: %s", err)
+	}
+
+	// Simulate the environment of a socket-activated service.
+	defer func(start int) { listenFDsStart = start }(listenFDsStart)
+	listenFDsStart = fd
+	os.Setenv(listenPIDEnv, strconv.Itoa(os.Getpid()))
+	os.Setenv(listenFDsEnv, "1")
+	os.Setenv(listenFDNamesEnv, "websocket")
+	listeners.Lock()
+	listeners.loaded = false
+	listeners.inherited = nil
+	listeners.Unlock()
+
+	if _, err = listenSocket(SystemdAddrPrefix+"endpoint", DefaultSocketMode); err == nil {
+		t.Errorf("Missing systemd socket accepted")
+	}
+	ln, err := listenSocket(SystemdAddrPrefix+"websocket", DefaultSocketMode)
+	if err != nil {
+		t.Fatalf("Error accepting systemd socket: %s", err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != addr {
+		t.Errorf("Wrong address: got %s; want %s", ln.Addr(), addr)
+	}
+	if len(os.Getenv(listenFDsEnv)) > 0 {
+		t.Errorf("Systemd environment not cleared")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to systemd socket: %s", err)
+	}
+	conn.Close()
+	if _, err = ln.Accept(); err != nil {
+		t.Errorf("Error accepting on systemd socket: %s", err)
+	}
+}
@@ -0,0 +1,553 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+var (
+	ErrInvalidTenantSpec = errors.New(`Tenants must be of the form "name[:max_clients[:rate[:burst]]]"`)
+	ErrInvalidTenantName = errors.New("Tenant names may only contain a-z, 0-9, '_', and '-'")
+	ErrUnknownTenant     = errors.New("Unknown tenant")
+	ErrMissingTenantKey  = errors.New("Each tenant requires a key")
+	ErrShortTenantKey    = errors.New("Tenant keys must be at least 16 bytes")
+)
+
+// tenantTagLen is the number of bytes of a device ID that identify its
+// tenant. The tag ends before the UUID version byte, leaving 74 random
+// bits.
+const tenantTagLen = 6
+
+// minTenantKeyLen is the minimum length of a tenant's secret key.
+const minTenantKeyLen = 16
+
+type TenantsConfig struct {
+	// Tenants lists each tenant as "name[:max_clients[:rate[:burst]]]",
+	// where max_clients limits the tenant's connections to each node, and
+	// rate is the number of updates per second the tenant's app servers may
+	// send to each node. Limits of 0 mean unlimited.
+	Tenants []string `env:"tenants"`
+
+	// Keys assigns a secret key to each tenant, as "tenant=key" entries.
+	// Keys sign the tag embedded in the tenant's device IDs, so changing a
+	// tenant's key orphans its existing devices. Keys may reference
+	// secrets; see SecretsConfig.
+	Keys []string `env:"keys"`
+
+	// Hosts assigns host names to tenants, as "tenant=host" entries. Clients
+	// belong to the tenant of the host they connect to. Updates are not
+	// resolved by host, since app servers choose the Host header.
+	Hosts []string `env:"hosts"`
+
+	// APIKeys assigns app servers to tenants by API key or client
+	// certificate name, as "tenant=name" entries.
+	APIKeys []string `toml:"api_keys" env:"api_keys"`
+
+	// VapidKeys assigns app servers to tenants by VAPID public key, as
+	// "tenant=key" entries. Keys are only trusted once the update's VAPID
+	// JWT verifies.
+	VapidKeys []string `toml:"vapid_keys" env:"vapid_keys"`
+
+	// Default is the tenant of clients and updates that match no host or
+	// key. If empty, they belong to no tenant.
+	Default string `env:"default"`
+}
+
+// Tenant is a product hosted by the server. Each tenant's devices are
+// issued IDs in a separate namespace: the ID embeds a tag signed with the
+// tenant's secret key, so IDs cannot be forged for another tenant, and app
+// servers cannot reach devices of another tenant. Storage keys are also
+// prefixed with the tenant's name.
+type Tenant struct {
+	name       string
+	maxClients int
+	rate       float64
+	burst      int
+	metrics    Statistician
+	key        []byte
+	quota      *tokenBuckets
+	clients    int32
+	updates    int64
+	rejected   int64
+	denied     int64
+}
+
+func newTenant(name string, metrics Statistician) *Tenant {
+	return &Tenant{name: name, metrics: metrics}
+}
+
+// tag returns the tag identifying the tenant's device IDs.
+func (t *Tenant) tag(suffix []byte) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write(suffix)
+	return mac.Sum(nil)[:tenantTagLen]
+}
+
+// owns indicates whether the device ID was issued to the tenant.
+func (t *Tenant) owns(uaid string) bool {
+	b, err := hex.DecodeString(strings.Replace(uaid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	return hmac.Equal(b[:tenantTagLen], t.tag(b[tenantTagLen:]))
+}
+
+// NewDeviceID generates a device ID in the tenant's namespace, or a random
+// ID if t is nil.
+func (t *Tenant) NewDeviceID() (string, error) {
+	b, err := id.GenerateBytes()
+	if err != nil || t == nil {
+		return hex.EncodeToString(b), err
+	}
+	copy(b, t.tag(b[tenantTagLen:]))
+	return hex.EncodeToString(b), nil
+}
+
+// KeyPrefix returns the prefix of the tenant's storage keys, or "" if t is
+// nil.
+func (t *Tenant) KeyPrefix() string {
+	if t == nil {
+		return ""
+	}
+	return "_t-" + t.name + "-"
+}
+
+// tenantKeyPrefix returns the storage key prefix for a device ID, for use
+// by storage adapters. The tenants are not known until the server is
+// initialized; no device IDs are stored before then.
+func tenantKeyPrefix(app *Application, uaid string) string {
+	if app == nil || app.Server() == nil {
+		return ""
+	}
+	return app.Server().Tenants().Of(uaid).KeyPrefix()
+}
+
+// Name returns the tenant's name, or "" if t is nil.
+func (t *Tenant) Name() string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
+
+// Increment increments the tenant's copy of a metric, named
+// "tenant.<name>.<metric>". Untenanted metrics are not copied.
+func (t *Tenant) Increment(metric string) {
+	if t == nil {
+		return
+	}
+	t.metrics.Increment("tenant." + t.name + "." + metric)
+}
+
+// Connect counts a new client connection. Returns false if the tenant is
+// at its connection limit, in which case the client should be closed.
+func (t *Tenant) Connect() bool {
+	if t == nil {
+		return true
+	}
+	clients := atomic.AddInt32(&t.clients, 1)
+	if t.maxClients > 0 && int(clients) > t.maxClients {
+		atomic.AddInt32(&t.clients, -1)
+		t.Increment("client.rejected")
+		return false
+	}
+	t.metrics.Gauge("tenant."+t.name+".client.connections", int64(clients))
+	return true
+}
+
+// Disconnect counts a closed client connection accepted by Connect.
+func (t *Tenant) Disconnect() {
+	if t == nil {
+		return
+	}
+	clients := atomic.AddInt32(&t.clients, -1)
+	t.metrics.Gauge("tenant."+t.name+".client.connections", int64(clients))
+}
+
+// AllowUpdate takes one update from the tenant's quota.
+func (t *Tenant) AllowUpdate() bool {
+	if t == nil {
+		return true
+	}
+	if !t.quota.Allow(t.name, time.Now()) {
+		atomic.AddInt64(&t.rejected, 1)
+		t.Increment("updates.ratelimited")
+		return false
+	}
+	atomic.AddInt64(&t.updates, 1)
+	t.Increment("updates.received")
+	return true
+}
+
+// Deny counts an update rejected because the device belongs to another
+// tenant.
+func (t *Tenant) Deny() {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.denied, 1)
+	t.Increment("updates.denied")
+}
+
+// Tenants resolves the tenant of each client connection and update.
+type Tenants struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	tenants   map[string]*Tenant
+	hosts     map[string]*Tenant
+	apiKeys   map[string]*Tenant
+	vapidKeys map[string]*Tenant
+	def       *Tenant
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{
+		tenants:   make(map[string]*Tenant),
+		hosts:     make(map[string]*Tenant),
+		apiKeys:   make(map[string]*Tenant),
+		vapidKeys: make(map[string]*Tenant),
+	}
+}
+
+func (*Tenants) ConfigStruct() interface{} {
+	return &TenantsConfig{}
+}
+
+func (ts *Tenants) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*TenantsConfig)
+	ts.logger = app.Logger()
+	ts.metrics = app.Metrics()
+
+	for _, spec := range conf.Tenants {
+		tenant, err := ts.parseTenant(spec)
+		if err != nil {
+			ts.logger.Panic("tenants", "Invalid tenant",
+				LogFields{"error": err.Error(), "tenant": spec})
+			return err
+		}
+		ts.tenants[tenant.name] = tenant
+	}
+	for _, spec := range conf.Keys {
+		tenant, key, err := ts.parseAssignment(spec)
+		if err == nil && len(key) < minTenantKeyLen {
+			err = ErrShortTenantKey
+		}
+		if err != nil {
+			ts.logger.Panic("tenants", "Invalid tenant key",
+				LogFields{"error": err.Error(), "tenant": tenant.Name()})
+			return err
+		}
+		tenant.key = []byte(key)
+	}
+	for _, tenant := range ts.tenants {
+		if len(tenant.key) == 0 {
+			ts.logger.Panic("tenants", "Missing tenant key",
+				LogFields{"tenant": tenant.name})
+			return ErrMissingTenantKey
+		}
+	}
+	for _, assignment := range []struct {
+		specs  []string
+		values map[string]*Tenant
+		fold   bool
+	}{
+		{conf.Hosts, ts.hosts, true},
+		{conf.APIKeys, ts.apiKeys, false},
+		{conf.VapidKeys, ts.vapidKeys, false},
+	} {
+		for _, spec := range assignment.specs {
+			tenant, value, err := ts.parseAssignment(spec)
+			if err != nil {
+				ts.logger.Panic("tenants", "Invalid tenant assignment",
+					LogFields{"error": err.Error(), "assignment": spec})
+				return err
+			}
+			if assignment.fold {
+				value = strings.ToLower(value)
+			}
+			assignment.values[value] = tenant
+		}
+	}
+	if len(conf.Default) > 0 {
+		if ts.def = ts.tenants[conf.Default]; ts.def == nil {
+			ts.logger.Panic("tenants", "Unknown default tenant",
+				LogFields{"tenant": conf.Default})
+			return ErrUnknownTenant
+		}
+	}
+	return nil
+}
+
+// parseTenant parses a "name[:max_clients[:rate[:burst]]]" tenant.
+func (ts *Tenants) parseTenant(spec string) (tenant *Tenant, err error) {
+	fields := strings.Split(strings.TrimSpace(spec), ":")
+	if len(fields) > 4 {
+		return nil, ErrInvalidTenantSpec
+	}
+	if !validTenantName(fields[0]) {
+		return nil, ErrInvalidTenantName
+	}
+	tenant = newTenant(fields[0], ts.metrics)
+	if len(fields) > 1 {
+		if tenant.maxClients, err = strconv.Atoi(fields[1]); err != nil || tenant.maxClients < 0 {
+			return nil, ErrInvalidTenantSpec
+		}
+	}
+	if len(fields) > 2 {
+		if tenant.rate, err = strconv.ParseFloat(fields[2], 64); err != nil || tenant.rate < 0 {
+			return nil, ErrInvalidTenantSpec
+		}
+	}
+	if len(fields) > 3 {
+		if tenant.burst, err = strconv.Atoi(fields[3]); err != nil || tenant.burst < 0 {
+			return nil, ErrInvalidTenantSpec
+		}
+	}
+	tenant.quota = newTokenBuckets(RateBudget{Rate: tenant.rate, Burst: tenant.burst}, 2)
+	return tenant, nil
+}
+
+// parseAssignment parses a "tenant=value" entry.
+func (ts *Tenants) parseAssignment(spec string) (tenant *Tenant, value string, err error) {
+	i := strings.Index(spec, "=")
+	if i < 1 || i == len(spec)-1 {
+		return nil, "", fmt.Errorf(`Tenant assignments must be of the form "tenant=value"`)
+	}
+	if tenant = ts.tenants[strings.TrimSpace(spec[:i])]; tenant == nil {
+		return nil, "", ErrUnknownTenant
+	}
+	return tenant, strings.TrimSpace(spec[i+1:]), nil
+}
+
+func validTenantName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if (b < 'a' || b > 'z') && (b < '0' || b > '9') && b != '_' && b != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the named tenant, or nil if there is no such tenant.
+func (ts *Tenants) Get(name string) *Tenant {
+	if ts == nil {
+		return nil
+	}
+	return ts.tenants[name]
+}
+
+// ForHost returns the tenant of a client connecting to the given host, or
+// the default tenant.
+func (ts *Tenants) ForHost(host string) *Tenant {
+	if ts == nil || len(ts.tenants) == 0 {
+		return nil
+	}
+	if tenant, ok := ts.hosts[strings.ToLower(hostOnly(host))]; ok {
+		return tenant
+	}
+	return ts.def
+}
+
+// ForUpdate returns the tenant of an update request, resolved by the
+// authenticated app server's name, then by the public key of a VAPID JWT
+// that verifies. Other updates belong to the default tenant: the Host
+// header and unverified VAPID keys are chosen by the sender.
+func (ts *Tenants) ForUpdate(req *http.Request, appServer string) *Tenant {
+	if ts == nil || len(ts.tenants) == 0 {
+		return nil
+	}
+	if tenant, ok := ts.apiKeys[appServer]; ok && len(appServer) > 0 {
+		return tenant
+	}
+	if len(ts.vapidKeys) > 0 {
+		if key := verifiedVapidKey(req, time.Now()); len(key) > 0 {
+			if tenant, ok := ts.vapidKeys[key]; ok {
+				return tenant
+			}
+		}
+	}
+	return ts.def
+}
+
+// Of returns the tenant that issued a device ID, or nil if the ID belongs
+// to no tenant.
+func (ts *Tenants) Of(uaid string) *Tenant {
+	if ts == nil {
+		return nil
+	}
+	for _, tenant := range ts.tenants {
+		if tenant.owns(uaid) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// Owns indicates whether a device ID belongs to the given tenant. Devices
+// without a tenant belong to the nil tenant.
+func (ts *Tenants) Owns(tenant *Tenant, uaid string) bool {
+	return ts.Of(uaid) == tenant
+}
+
+// Filter returns the device IDs that belong to the given tenant.
+func (ts *Tenants) Filter(tenant *Tenant, uaids []string) []string {
+	if ts == nil || len(ts.tenants) == 0 {
+		return uaids
+	}
+	owned := make([]string, 0, len(uaids))
+	for _, uaid := range uaids {
+		if ts.Owns(tenant, uaid) {
+			owned = append(owned, uaid)
+		}
+	}
+	return owned
+}
+
+// verifiedVapidKey returns the VAPID public key sent with an update, from
+// either an "Authorization: vapid t=..., k=..." header, or an
+// "Authorization: WebPush <JWT>" header and the p256ecdsa parameter of the
+// Crypto-Key header. The key is only returned if the JWT is signed with
+// it, is unexpired, and is addressed to the request host.
+func verifiedVapidKey(req *http.Request, now time.Time) string {
+	var jwt, key string
+	auth := req.Header.Get("Authorization")
+	switch {
+	case len(auth) > 6 && strings.EqualFold(auth[:6], "vapid "):
+		for _, param := range strings.Split(auth[6:], ",") {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "t=") {
+				jwt = param[2:]
+			} else if strings.HasPrefix(param, "k=") {
+				key = param[2:]
+			}
+		}
+	case len(auth) > 8 && strings.EqualFold(auth[:8], "WebPush "):
+		jwt = strings.TrimSpace(auth[8:])
+		for _, param := range strings.FieldsFunc(req.Header.Get("Crypto-Key"), func(r rune) bool {
+			return r == ';' || r == ','
+		}) {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "p256ecdsa=") {
+				key = strings.Trim(param[len("p256ecdsa="):], `"`)
+			}
+		}
+	}
+	if len(jwt) == 0 || len(key) == 0 {
+		return ""
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	claims := new(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	})
+	if err := decodeJWTSegment(parts[1], claims); err != nil {
+		return ""
+	}
+	expiry := time.Unix(claims.Exp, 0)
+	if !expiry.After(now) || expiry.Sub(now) > maxVapidExpiry {
+		return ""
+	}
+	aud, err := url.Parse(claims.Aud)
+	if err != nil || !strings.EqualFold(aud.Host, req.Host) {
+		return ""
+	}
+	if verifyES256(parts[0]+"."+parts[1], parts[2], key) != nil {
+		return ""
+	}
+	return strings.TrimRight(key, "=")
+}
+
+// TenantStatus reports a tenant's limits and usage on this node.
+type TenantStatus struct {
+	Name       string   `json:"name"`
+	Default    bool     `json:"default,omitempty"`
+	Hosts      []string `json:"hosts,omitempty"`
+	MaxClients int      `json:"maxClients,omitempty"`
+	Rate       float64  `json:"rate,omitempty"`
+	Burst      int      `json:"burst,omitempty"`
+	Clients    int      `json:"clients"`
+	Updates    int64    `json:"updates"`
+	Rejected   int64    `json:"rejected"`
+	Denied     int64    `json:"denied"`
+}
+
+// Status returns the status of each tenant, ordered by name.
+func (ts *Tenants) Status() []*TenantStatus {
+	statuses := make([]*TenantStatus, 0, len(ts.tenants))
+	for _, tenant := range ts.tenants {
+		status := &TenantStatus{
+			Name:       tenant.name,
+			Default:    tenant == ts.def,
+			MaxClients: tenant.maxClients,
+			Rate:       tenant.rate,
+			Burst:      tenant.burst,
+			Clients:    int(atomic.LoadInt32(&tenant.clients)),
+			Updates:    atomic.LoadInt64(&tenant.updates),
+			Rejected:   atomic.LoadInt64(&tenant.rejected),
+			Denied:     atomic.LoadInt64(&tenant.denied),
+		}
+		for host, hostTenant := range ts.hosts {
+			if hostTenant == tenant {
+				status.Hosts = append(status.Hosts, host)
+			}
+		}
+		sort.Strings(status.Hosts)
+		statuses = append(statuses, status)
+	}
+	sort.Sort(tenantStatuses(statuses))
+	return statuses
+}
+
+type tenantStatuses []*TenantStatus
+
+func (s tenantStatuses) Len() int           { return len(s) }
+func (s tenantStatuses) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s tenantStatuses) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// writeTenantDenied rejects an update for a device outside the app server's
+// tenant, as if the endpoint did not exist.
+func (self *Handler) writeTenantDenied(resp http.ResponseWriter, requestID string,
+	tenant *Tenant, uaid string) {
+
+	if self.logger.ShouldLog(WARNING) {
+		self.logger.Warn("update", "Update for device of another tenant",
+			LogFields{"rid": requestID, "uaid": uaid, "tenant": tenant.Name()})
+	}
+	tenant.Deny()
+	http.Error(resp, "Invalid Token", http.StatusNotFound)
+	self.metrics.Increment("updates.appserver.invalid")
+}
+
+// TenantsHandler lists the configured tenants, with their limits and usage
+// on this node.
+func (self *Handler) TenantsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(self.app.Server().Tenants().Status())
+}
@@ -0,0 +1,193 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+func newTestTenants(t *testing.T) *Tenants {
+	_, app := newTestHandler(t)
+	tenants := NewTenants()
+	conf := tenants.ConfigStruct().(*TenantsConfig)
+	conf.Tenants = []string{"firefox", "devices:1:1:1"}
+	conf.Keys = []string{"firefox=firefox-tenant-key", "devices=devices-tenant-key"}
+	conf.Hosts = []string{"firefox=push.example.com", "devices=Push.Devices.Example.com"}
+	conf.APIKeys = []string{"devices=fleet"}
+	conf.VapidKeys = []string{"firefox=BKey"}
+	conf.Default = "firefox"
+	if err := tenants.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing tenants: %s", err)
+	}
+	return tenants
+}
+
+func TestTenantDeviceIDs(t *testing.T) {
+	tenants := newTestTenants(t)
+	firefox, devices := tenants.Get("firefox"), tenants.Get("devices")
+	uaid, err := firefox.NewDeviceID()
+	if err != nil {
+		t.Fatalf("Error generating device ID: %s", err)
+	}
+	if !id.Valid(uaid) {
+		t.Errorf("Invalid device ID: %q", uaid)
+	}
+	if owner := tenants.Of(uaid); owner != firefox {
+		t.Errorf("Wrong owner for %q: got %q", uaid, owner.Name())
+	}
+	if tenants.Owns(devices, uaid) || tenants.Owns(nil, uaid) {
+		t.Errorf("Device ID %q owned by another tenant", uaid)
+	}
+	b, _ := hex.DecodeString(uaid)
+	hyphenated, _ := id.Encode(b)
+	if !tenants.Owns(firefox, hyphenated) {
+		t.Errorf("Hyphenated device ID %q not owned by tenant", hyphenated)
+	}
+
+	// Random IDs belong to no tenant.
+	random, _ := id.Generate()
+	if owner := tenants.Of(random); owner != nil {
+		t.Errorf("Random device ID owned by %q", owner.Name())
+	}
+	other, _ := devices.NewDeviceID()
+	owned := tenants.Filter(devices, []string{uaid, random, other})
+	if len(owned) != 1 || owned[0] != other {
+		t.Errorf("Wrong filtered devices: %v", owned)
+	}
+}
+
+func TestTenantResolution(t *testing.T) {
+	tenants := newTestTenants(t)
+	devices := tenants.Get("devices")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating VAPID key: %s", err)
+	}
+	publicKey := base64.RawURLEncoding.EncodeToString(
+		elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	tenants.vapidKeys[publicKey] = devices
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	jwt := signTestJWT(t, key, `{"aud":"https://push.example.com","exp":`+exp+`}`)
+	expired := signTestJWT(t, key, `{"aud":"https://push.example.com","exp":1}`)
+	otherAud := signTestJWT(t, key, `{"aud":"https://other.example.com","exp":`+exp+`}`)
+
+	tests := []struct {
+		name      string
+		host      string
+		appServer string
+		header    string
+		value     string
+		tenant    string
+	}{
+		{"Host", "push.devices.example.com:443", "", "", "", "firefox"},
+		{"Default", "unknown.example.com", "", "", "", "firefox"},
+		{"API key", "push.example.com", "fleet", "", "", "devices"},
+		{"VAPID auth", "push.example.com", "", "Authorization",
+			"vapid t=" + jwt + ", k=" + publicKey, "devices"},
+		{"WebPush auth", "push.example.com", "", "Authorization",
+			"WebPush " + jwt, "devices"},
+		{"Unsigned VAPID key", "push.example.com", "", "Authorization",
+			"vapid t=a.b.c, k=" + publicKey, "firefox"},
+		{"Expired JWT", "push.example.com", "", "Authorization",
+			"vapid t=" + expired + ", k=" + publicKey, "firefox"},
+		{"Wrong audience", "push.example.com", "", "Authorization",
+			"vapid t=" + otherAud + ", k=" + publicKey, "firefox"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "https://"+test.host+"/update/abc", nil)
+		if len(test.header) > 0 {
+			req.Header.Set(test.header, test.value)
+		}
+		req.Header.Set("Crypto-Key", `dh=abc; p256ecdsa="`+publicKey+`"`)
+		if tenant := tenants.ForUpdate(req, test.appServer); tenant.Name() != test.tenant {
+			t.Errorf("%s: wrong tenant: got %q; want %q", test.name, tenant.Name(),
+				test.tenant)
+		}
+	}
+	if tenant := tenants.ForHost("PUSH.DEVICES.EXAMPLE.COM"); tenant != devices {
+		t.Errorf("Wrong tenant for host: got %q", tenant.Name())
+	}
+}
+
+func TestTenantKeyPrefix(t *testing.T) {
+	tenants := newTestTenants(t)
+	firefox, devices := tenants.Get("firefox"), tenants.Get("devices")
+	if firefox.KeyPrefix() == devices.KeyPrefix() {
+		t.Errorf("Tenants share a key prefix: %q", firefox.KeyPrefix())
+	}
+	var untenanted *Tenant
+	if prefix := untenanted.KeyPrefix(); prefix != "" {
+		t.Errorf("Untenanted devices have a key prefix: %q", prefix)
+	}
+	// Device IDs are signed with the tenant's key, not its name.
+	renamed := newTenant("firefox", firefox.metrics)
+	renamed.key = []byte("another-tenant-key")
+	uaid, _ := firefox.NewDeviceID()
+	if renamed.owns(uaid) {
+		t.Errorf("Device ID owned by a tenant with another key")
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	tenants := newTestTenants(t)
+	devices := tenants.Get("devices")
+	if !devices.Connect() {
+		t.Fatalf("Connection rejected below limit")
+	}
+	if devices.Connect() {
+		t.Errorf("Connection accepted over limit")
+	}
+	devices.Disconnect()
+	if !devices.Connect() {
+		t.Errorf("Connection rejected after disconnect")
+	}
+	if !devices.AllowUpdate() {
+		t.Fatalf("Update rejected within quota")
+	}
+	if devices.AllowUpdate() {
+		t.Errorf("Update accepted over quota")
+	}
+	for _, status := range tenants.Status() {
+		if status.Name != "devices" {
+			continue
+		}
+		if status.Clients != 1 || status.Updates != 1 || status.Rejected != 1 {
+			t.Errorf("Wrong status: %#v", status)
+		}
+	}
+	var untenanted *Tenant
+	if !untenanted.Connect() || !untenanted.AllowUpdate() {
+		t.Errorf("Untenanted client limited")
+	}
+}
+
+func TestTenantsConfig(t *testing.T) {
+	_, app := newTestHandler(t)
+	for _, conf := range []*TenantsConfig{
+		{Tenants: []string{"Firefox"}},
+		{Tenants: []string{"firefox:many"}},
+		{Tenants: []string{"firefox"}},
+		{Tenants: []string{"firefox"}, Keys: []string{"firefox=short"}},
+		{Tenants: []string{"firefox"}, Keys: []string{"other=firefox-tenant-key"}},
+		{Tenants: []string{"firefox"}, Keys: []string{"firefox=firefox-tenant-key"},
+			Hosts: []string{"other=push.example.com"}},
+		{Tenants: []string{"firefox"}, Keys: []string{"firefox=firefox-tenant-key"},
+			Default: "other"},
+	} {
+		if err := NewTenants().Init(app, conf); err == nil {
+			t.Errorf("Invalid config accepted: %#v", conf)
+		}
+	}
+}
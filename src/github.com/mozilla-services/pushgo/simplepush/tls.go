@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var ErrNoCertificate = errors.New("No certificate configured")
+
+// CertPair names a certificate and private key file. Host is empty for the
+// default certificate.
+type CertPair struct {
+	Host     string
+	CertFile string
+	KeyFile  string
+}
+
+// ParseCertPair parses an SNI certificate spec of the form
+// "hostname:cert_file:key_file". The hostname may begin with "*." to match
+// any subdomain.
+func ParseCertPair(spec string) (pair CertPair, err error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 ||
+		len(parts[2]) == 0 {
+		return pair, fmt.Errorf("Malformed SNI certificate '%s'; want host:cert_file:key_file",
+			spec)
+	}
+	return CertPair{strings.ToLower(parts[0]), parts[1], parts[2]}, nil
+}
+
+// CertStore selects certificates by server name, and reloads them from disk
+// without interrupting established connections.
+type CertStore struct {
+	pairs    []CertPair
+	lock     sync.RWMutex
+	defCert  *tls.Certificate
+	hostCert map[string]*tls.Certificate
+}
+
+// NewCertStore loads the given certificates. The first pair without a host
+// is the default; if there is none, the first pair is used.
+func NewCertStore(pairs []CertPair) (*CertStore, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificate
+	}
+	s := &CertStore{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads all certificates. The current certificates are retained if
+// any file cannot be loaded.
+func (s *CertStore) Reload() error {
+	var defCert *tls.Certificate
+	hostCert := make(map[string]*tls.Certificate)
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Error loading certificate '%s': %s", pair.CertFile, err)
+		}
+		if len(pair.Host) == 0 {
+			if defCert == nil {
+				defCert = &cert
+			}
+			continue
+		}
+		hostCert[pair.Host] = &cert
+	}
+	if defCert == nil {
+		defCert = hostCert[s.pairs[0].Host]
+	}
+	s.lock.Lock()
+	s.defCert, s.hostCert = defCert, hostCert
+	s.lock.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, matching the
+// requested server name exactly, then against wildcard hosts.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if cert, ok := s.hostCert[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.hostCert["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.defCert, nil
+}
+
+// loadClientCAs reads a PEM bundle of CA certificates used to verify client
+// certificates.
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in '%s'", filename)
+	}
+	return pool, nil
+}
+
+// NewTLSConfig returns a TLS config that selects certificates from the
+// store. nextProtos lists the protocols advertised via ALPN, defaulting to
+// HTTP/1.1.
+func NewTLSConfig(certs *CertStore, nextProtos ...string) *tls.Config {
+	if len(nextProtos) == 0 {
+		nextProtos = []string{"http/1.1"}
+	}
+	return &tls.Config{
+		NextProtos:     nextProtos,
+		GetCertificate: certs.GetCertificate,
+		// The following are Mozilla required TLS settings.
+		MinVersion:               tls.VersionTLS10,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA},
+	}
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self-signed certificate for the given common
+// name, writing the certificate and key to dir.
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Error writing certificate: %s", err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Error writing key: %s", err)
+	}
+	return
+}
+
+func certName(t *testing.T, certs *CertStore, serverName string) string {
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("Error selecting certificate for %q: %s", serverName, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Error parsing certificate for %q: %s", serverName, err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestParseCertPair(t *testing.T) {
+	pair, err := ParseCertPair("Push.Example.com:a.crt:a.key")
+	if err != nil {
+		t.Fatalf("Error parsing cert pair: %s", err)
+	}
+	if pair != (CertPair{"push.example.com", "a.crt", "a.key"}) {
+		t.Errorf("Wrong cert pair: %#v", pair)
+	}
+	for _, spec := range []string{"", "host", "host:a.crt", ":a.crt:a.key",
+		"host::a.key"} {
+		if _, err := ParseCertPair(spec); err == nil {
+			t.Errorf("Expected error parsing %q", spec)
+		}
+	}
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-certs")
+	if err != nil {
+		t.Fatalf("Error creating cert directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defCert, defKey := writeTestCert(t, dir, "default")
+	pushCert, pushKey := writeTestCert(t, dir, "push")
+	wildCert, wildKey := writeTestCert(t, dir, "wildcard")
+	certs, err := NewCertStore([]CertPair{
+		{"push.example.com", pushCert, pushKey},
+		{"", defCert, defKey},
+		{"*.example.org", wildCert, wildKey},
+	})
+	if err != nil {
+		t.Fatalf("Error loading certificates: %s", err)
+	}
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"push.example.com", "push"},
+		{"PUSH.example.com.", "push"},
+		{"updates.example.org", "wildcard"},
+		{"example.org", "default"},
+		{"other.example.com", "default"},
+		{"", "default"},
+	}
+	for _, test := range tests {
+		if name := certName(t, certs, test.serverName); name != test.expected {
+			t.Errorf("Wrong certificate for %q: got %q; want %q",
+				test.serverName, name, test.expected)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-certs")
+	if err != nil {
+		t.Fatalf("Error creating cert directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "old")
+	certs, err := NewCertStore([]CertPair{{CertFile: certFile, KeyFile: keyFile}})
+	if err != nil {
+		t.Fatalf("Error loading certificates: %s", err)
+	}
+
+	// Renew the certificate in place.
+	newCert, newKey := writeTestCert(t, dir, "new")
+	if err = os.Rename(newCert, certFile); err != nil {
+		t.Fatalf("Error replacing certificate: %s", err)
+	}
+	if err = os.Rename(newKey, keyFile); err != nil {
+		t.Fatalf("Error replacing key: %s", err)
+	}
+	if err = certs.Reload(); err != nil {
+		t.Fatalf("Error reloading certificates: %s", err)
+	}
+	if name := certName(t, certs, ""); name != "new" {
+		t.Errorf("Wrong certificate after reload: got %q; want %q", name, "new")
+	}
+
+	// A failed reload keeps the current certificate.
+	if err = ioutil.WriteFile(certFile, []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Error corrupting certificate: %s", err)
+	}
+	if err = certs.Reload(); err == nil {
+		t.Fatal("Expected error reloading corrupt certificate")
+	}
+	if name := certName(t, certs, ""); name != "new" {
+		t.Errorf("Wrong certificate after failed reload: got %q; want %q",
+			name, "new")
+	}
+}
@@ -0,0 +1,309 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+ * Versioned endpoint tokens bind the primary key (UAID and channel ID) to the
+ * ID of the key that minted them, and are authenticated with AES-GCM. Keys
+ * can be rotated without invalidating existing endpoints: new tokens are
+ * minted under the current key, while tokens minted under any key still in
+ * the keyring continue to decode. Revoking a key invalidates every endpoint
+ * minted under it.
+ *
+ * Tokens also record when they were minted and, if a token TTL is set, when
+ * they expire. Updates sent to expired endpoints are rejected with 410 Gone,
+ * so that stale endpoints age out without storage lookups.
+ *
+ * Token layout (before base64 encoding):
+ *   version (1 byte) | key ID (1 byte) | created (4 bytes) |
+ *   expires (4 bytes) | nonce (12 bytes) | sealed primary key
+ *
+ * Times are big-endian Unix timestamps; an expiry of 0 means the token does
+ * not expire. The header before the nonce is authenticated along with the
+ * primary key. Version 1 tokens omit both times, and do not expire.
+ */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenVersion   = 2
+	tokenVersionV1 = 1
+)
+
+var (
+	ErrInvalidToken   = errors.New("Invalid endpoint token")
+	ErrUnknownTokenID = errors.New("Unknown token key ID")
+	ErrRevokeCurrent  = errors.New("Cannot revoke the current token key")
+	ErrExpiredToken   = errors.New("Expired endpoint token")
+)
+
+// TokenKeyring mints and decodes endpoint tokens. If no versioned keys are
+// configured, the keyring falls back to the legacy unauthenticated format
+// (or plain primary keys if no legacy key is set either).
+type TokenKeyring struct {
+	lock       sync.RWMutex
+	legacy     []byte
+	keys       map[byte]cipher.AEAD
+	current    byte
+	hasCurrent bool
+	ttl        time.Duration
+}
+
+func NewTokenKeyring(legacy []byte) *TokenKeyring {
+	return &TokenKeyring{
+		legacy: legacy,
+		keys:   make(map[byte]cipher.AEAD),
+	}
+}
+
+// ParseTokenKey parses a key specification of the form "id:base64key".
+func ParseTokenKey(spec string) (id byte, key []byte, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("Malformed token key %q", spec)
+	}
+	keyID, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid token key ID %q: %s", parts[0], err)
+	}
+	if key, err = base64.URLEncoding.DecodeString(parts[1]); err != nil {
+		return 0, nil, fmt.Errorf("Malformed token key %d: %s", keyID, err)
+	}
+	return byte(keyID), key, nil
+}
+
+// ParseTokenKeys parses a list of key specifications. An ID prefixed with
+// "*" (e.g., "*2:base64key") marks the key used to mint new tokens; current
+// is -1 if no key is marked.
+func ParseTokenKeys(specs []string) (keys map[byte][]byte, current int, err error) {
+	keys = make(map[byte][]byte, len(specs))
+	current = -1
+	for _, spec := range specs {
+		marked := strings.HasPrefix(spec, "*")
+		id, key, err := ParseTokenKey(strings.TrimPrefix(spec, "*"))
+		if err != nil {
+			return nil, -1, err
+		}
+		if marked {
+			if current >= 0 {
+				return nil, -1, fmt.Errorf("Token keys %d and %d are both marked current",
+					current, id)
+			}
+			current = int(id)
+		}
+		keys[id] = key
+	}
+	return keys, current, nil
+}
+
+// AddKey adds or replaces a versioned key. Keys must be 16, 24, or 32 bytes.
+func (k *TokenKeyring) AddKey(id byte, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	k.keys[id] = aead
+	k.lock.Unlock()
+	return nil
+}
+
+// Sync replaces the keyring's keys with the given set, and selects the
+// current key if one is given (current >= 0). Keys missing from the set are
+// revoked. The keyring is unchanged if any key is invalid, or if the current
+// key would be removed without selecting another.
+func (k *TokenKeyring) Sync(keys map[byte][]byte, current int) error {
+	aeads := make(map[byte]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("Invalid token key %d: %s", id, err)
+		}
+		if aeads[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("Invalid token key %d: %s", id, err)
+		}
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if current >= 0 {
+		if _, ok := aeads[byte(current)]; !ok {
+			return ErrUnknownTokenID
+		}
+		k.current, k.hasCurrent = byte(current), true
+	} else if _, ok := aeads[k.current]; k.hasCurrent && !ok {
+		return ErrRevokeCurrent
+	}
+	k.keys = aeads
+	return nil
+}
+
+// SetCurrent selects the key used to mint new tokens.
+func (k *TokenKeyring) SetCurrent(id byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrUnknownTokenID
+	}
+	k.current, k.hasCurrent = id, true
+	return nil
+}
+
+// SetTTL sets the lifetime of new tokens. Tokens minted with a TTL of 0 do
+// not expire.
+func (k *TokenKeyring) SetTTL(ttl time.Duration) {
+	k.lock.Lock()
+	k.ttl = ttl
+	k.lock.Unlock()
+}
+
+// Current returns the ID of the key used to mint new tokens.
+func (k *TokenKeyring) Current() (id byte, ok bool) {
+	k.lock.RLock()
+	id, ok = k.current, k.hasCurrent
+	k.lock.RUnlock()
+	return
+}
+
+// Revoke removes a key, invalidating all tokens minted under it.
+func (k *TokenKeyring) Revoke(id byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return ErrUnknownTokenID
+	}
+	if k.hasCurrent && k.current == id {
+		return ErrRevokeCurrent
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// Sealed indicates whether new tokens are encrypted. Otherwise, tokens are
+// primary keys in the clear.
+func (k *TokenKeyring) Sealed() bool {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.hasCurrent || len(k.legacy) > 0
+}
+
+// IDs returns the sorted IDs of all keys in the keyring.
+func (k *TokenKeyring) IDs() []int {
+	k.lock.RLock()
+	ids := make([]int, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, int(id))
+	}
+	k.lock.RUnlock()
+	sort.Ints(ids)
+	return ids
+}
+
+// Encode mints a token for the given primary key.
+func (k *TokenKeyring) Encode(pk string) (string, error) {
+	k.lock.RLock()
+	id, hasCurrent, ttl := k.current, k.hasCurrent, k.ttl
+	aead := k.keys[id]
+	k.lock.RUnlock()
+	if !hasCurrent {
+		if len(k.legacy) == 0 {
+			return pk, nil
+		}
+		return Encode(k.legacy, []byte(pk))
+	}
+	now := time.Now()
+	header := make([]byte, 10)
+	header[0], header[1] = tokenVersion, id
+	binary.BigEndian.PutUint32(header[2:6], uint32(now.Unix()))
+	if ttl > 0 {
+		binary.BigEndian.PutUint32(header[6:10], uint32(now.Add(ttl).Unix()))
+	}
+	nonce, err := genKey(aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	token := append(header, nonce...)
+	token = aead.Seal(token, nonce, []byte(pk), header)
+	return base64.URLEncoding.EncodeToString(token), nil
+}
+
+// Decode returns the primary key for a token minted by any key in the
+// keyring, or by the legacy key.
+func (k *TokenKeyring) Decode(token string) (pk []byte, err error) {
+	k.lock.RLock()
+	hasKeys := len(k.keys) > 0
+	k.lock.RUnlock()
+	if hasKeys {
+		if pk, err = k.open(token); err == nil || err == ErrExpiredToken {
+			return pk, err
+		}
+		if len(k.legacy) == 0 {
+			return nil, err
+		}
+	}
+	if len(k.legacy) == 0 {
+		return []byte(token), nil
+	}
+	if pk, err = Decode(k.legacy, token); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(pk), nil
+}
+
+func (k *TokenKeyring) open(token string) ([]byte, error) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(raw) < 2 {
+		return nil, ErrInvalidToken
+	}
+	var headerLen int
+	switch raw[0] {
+	case tokenVersion:
+		headerLen = 10
+	case tokenVersionV1:
+		headerLen = 2
+	default:
+		return nil, ErrInvalidToken
+	}
+	k.lock.RLock()
+	aead, ok := k.keys[raw[1]]
+	k.lock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownTokenID
+	}
+	if len(raw) < headerLen+aead.NonceSize() {
+		return nil, ErrInvalidToken
+	}
+	header, rest := raw[:headerLen], raw[headerLen:]
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	pk, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// Only check the expiry of authenticated tokens, so that forged tokens
+	// are reported as invalid.
+	if headerLen > 2 {
+		expires := binary.BigEndian.Uint32(header[6:10])
+		if expires > 0 && time.Now().Unix() >= int64(expires) {
+			return nil, ErrExpiredToken
+		}
+	}
+	return pk, nil
+}
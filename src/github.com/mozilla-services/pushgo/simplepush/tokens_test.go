@@ -0,0 +1,229 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const testPK = "deadbeefdeadbeefdeadbeefdeadbeef.decafbaddecafbaddecafbaddecafbad"
+
+func TestTokenKeyringRotate(t *testing.T) {
+	keyring := NewTokenKeyring(nil)
+	if err := keyring.AddKey(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Error adding key 1: %s", err)
+	}
+	if err := keyring.SetCurrent(1); err != nil {
+		t.Fatalf("Error selecting key 1: %s", err)
+	}
+	oldToken, err := keyring.Encode(testPK)
+	if err != nil {
+		t.Fatalf("Error encoding token: %s", err)
+	}
+	if strings.Contains(oldToken, "deadbeef") {
+		t.Errorf("Token exposes primary key: %q", oldToken)
+	}
+	if err = keyring.AddKey(2, []byte("fedcba9876543210")); err != nil {
+		t.Fatalf("Error adding key 2: %s", err)
+	}
+	if err = keyring.SetCurrent(2); err != nil {
+		t.Fatalf("Error selecting key 2: %s", err)
+	}
+	newToken, err := keyring.Encode(testPK)
+	if err != nil {
+		t.Fatalf("Error encoding token: %s", err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		pk, err := keyring.Decode(token)
+		if err != nil {
+			t.Errorf("Error decoding token %q: %s", token, err)
+		} else if string(pk) != testPK {
+			t.Errorf("Wrong primary key: got %q; want %q", pk, testPK)
+		}
+	}
+	if err = keyring.Revoke(2); err != ErrRevokeCurrent {
+		t.Errorf("Expected ErrRevokeCurrent; got %#v", err)
+	}
+	if err = keyring.Revoke(1); err != nil {
+		t.Fatalf("Error revoking key 1: %s", err)
+	}
+	if _, err = keyring.Decode(oldToken); err != ErrUnknownTokenID {
+		t.Errorf("Expected ErrUnknownTokenID for revoked key; got %#v", err)
+	}
+	if _, err = keyring.Decode(newToken); err != nil {
+		t.Errorf("Error decoding current token: %s", err)
+	}
+}
+
+func TestTokenKeyringTampered(t *testing.T) {
+	keyring := NewTokenKeyring(nil)
+	keyring.AddKey(0, []byte("0123456789abcdef"))
+	keyring.SetCurrent(0)
+	token, err := keyring.Encode(testPK)
+	if err != nil {
+		t.Fatalf("Error encoding token: %s", err)
+	}
+	raw := []byte(token)
+	if raw[20] == 'A' {
+		raw[20] = 'B'
+	} else {
+		raw[20] = 'A'
+	}
+	if _, err = keyring.Decode(string(raw)); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for tampered token; got %#v", err)
+	}
+}
+
+// sealTestToken mints a token with the given header under a keyring key.
+func sealTestToken(keyring *TokenKeyring, header []byte) string {
+	aead := keyring.keys[header[1]]
+	nonce := make([]byte, aead.NonceSize())
+	token := aead.Seal(append(header, nonce...), nonce, []byte(testPK), header)
+	return base64.URLEncoding.EncodeToString(token)
+}
+
+func TestTokenKeyringExpiry(t *testing.T) {
+	keyring := NewTokenKeyring(nil)
+	keyring.AddKey(1, []byte("0123456789abcdef"))
+	keyring.SetCurrent(1)
+	keyring.SetTTL(time.Hour)
+	token, err := keyring.Encode(testPK)
+	if err != nil {
+		t.Fatalf("Error encoding token: %s", err)
+	}
+	if pk, err := keyring.Decode(token); err != nil || string(pk) != testPK {
+		t.Errorf("Error decoding unexpired token: %q, %v", pk, err)
+	}
+
+	now := time.Now().Unix()
+	expired := make([]byte, 10)
+	expired[0], expired[1] = tokenVersion, 1
+	binary.BigEndian.PutUint32(expired[2:6], uint32(now-7200))
+	binary.BigEndian.PutUint32(expired[6:10], uint32(now-3600))
+	if _, err = keyring.Decode(sealTestToken(keyring, expired)); err != ErrExpiredToken {
+		t.Errorf("Expected ErrExpiredToken for expired token; got %#v", err)
+	}
+
+	// Version 1 tokens do not expire.
+	v1Token := sealTestToken(keyring, []byte{tokenVersionV1, 1})
+	if pk, err := keyring.Decode(v1Token); err != nil || string(pk) != testPK {
+		t.Errorf("Error decoding version 1 token: %q, %v", pk, err)
+	}
+}
+
+func Test_UpdateHandlerExpiredToken(t *testing.T) {
+	handler, app := newTestHandler(t)
+	keyring := app.Tokens()
+	keyring.AddKey(1, []byte("0123456789abcdef"))
+	keyring.SetCurrent(1)
+	now := time.Now().Unix()
+	header := make([]byte, 10)
+	header[0], header[1] = tokenVersion, 1
+	binary.BigEndian.PutUint32(header[2:6], uint32(now-7200))
+	binary.BigEndian.PutUint32(header[6:10], uint32(now-3600))
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("http://test/update/%s",
+		sealTestToken(keyring, header)), nil)
+	tmux := mux.NewRouter()
+	tmux.HandleFunc("/update/{key}", handler.UpdateHandler)
+	tmux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusGone {
+		t.Errorf("Wrong status for expired token: got %d; want %d",
+			resp.Code, http.StatusGone)
+	}
+}
+
+func TestTokenKeyringLegacy(t *testing.T) {
+	legacy := []byte("0123456789abcdef")
+	legacyToken, err := Encode(legacy, []byte(testPK))
+	if err != nil {
+		t.Fatalf("Error encoding legacy token: %s", err)
+	}
+	keyring := NewTokenKeyring(legacy)
+	keyring.AddKey(1, []byte("fedcba9876543210"))
+	keyring.SetCurrent(1)
+	pk, err := keyring.Decode(legacyToken)
+	if err != nil {
+		t.Fatalf("Error decoding legacy token: %s", err)
+	}
+	if string(pk) != testPK {
+		t.Errorf("Wrong primary key: got %q; want %q", pk, testPK)
+	}
+}
+
+func TestRotateKeysHandler(t *testing.T) {
+	handler, app := newTestHandler(t)
+	dir, err := ioutil.TempDir("", "pushgo-tokens")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "token_keys")
+	key1 := "1:MDEyMzQ1Njc4OWFiY2RlZg=="
+	key2 := "2:ZmVkY2JhOTg3NjU0MzIxMA=="
+	if err = ioutil.WriteFile(keysFile, []byte("*"+key1), 0600); err != nil {
+		t.Fatalf("Error writing secret file: %s", err)
+	}
+	conf := &ApplicationConfig{
+		TokenKeys: []string{"${file:" + keysFile + "}"},
+		TokenTTL:  "0",
+	}
+	if err = app.Secrets().Resolve("default", conf); err != nil {
+		t.Fatalf("Error resolving secrets: %s", err)
+	}
+	if _, app.tokens, err = conf.TokenKeyring(); err != nil {
+		t.Fatalf("Error loading token keys: %s", err)
+	}
+	app.Secrets().OnChange("default.token_keys", app.syncTokenKeys)
+	app.Secrets().Start(app)
+	defer app.Secrets().Close()
+
+	tests := []struct {
+		secret  string
+		current int
+		keys    []int
+	}{
+		// New keys are accepted before they are used to mint endpoints.
+		{"*" + key1 + "\n" + key2, 1, []int{1, 2}},
+		{key1 + "\n*" + key2, 2, []int{1, 2}},
+		// Keys removed from the secret are revoked.
+		{"*" + key2, 2, []int{2}},
+		// The current key is kept unless another is selected.
+		{key1, 2, []int{2}},
+	}
+	for i, test := range tests {
+		if err = ioutil.WriteFile(keysFile, []byte(test.secret), 0600); err != nil {
+			t.Fatalf("Error writing secret file: %s", err)
+		}
+		req, _ := http.NewRequest("POST", "/admin/rotate-keys", nil)
+		resp := httptest.NewRecorder()
+		handler.RotateKeysHandler(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("On test %d, unexpected status: got %d; want 200", i, resp.Code)
+		}
+		reply := new(RotateKeysReply)
+		if err := json.Unmarshal(resp.Body.Bytes(), reply); err != nil {
+			t.Fatalf("On test %d, error decoding reply: %s", i, err)
+		}
+		if reply.Current != test.current || !reflect.DeepEqual(reply.Keys, test.keys) {
+			t.Errorf("On test %d, unexpected reply: %#v", i, reply)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderTraceParent carries the W3C trace context of a request.
+const HeaderTraceParent = "traceparent"
+
+var ErrInvalidSampleRate = errors.New("Trace sample rate must be in [0, 1]")
+
+// Span kinds, as defined by OpenTelemetry.
+type SpanKind int
+
+const (
+	SpanInternal SpanKind = iota + 1
+	SpanServer
+	SpanClient
+	SpanProducer
+	SpanConsumer
+)
+
+// SpanContext identifies a span within a trace. The zero value is not part
+// of any trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid indicates whether the context identifies a span.
+func (c SpanContext) Valid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// String encodes the context as a W3C traceparent header value, or returns
+// an empty string if the context is not valid.
+func (c SpanContext) String() string {
+	if !c.Valid() {
+		return ""
+	}
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" +
+		hex.EncodeToString(c.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceParent decodes a W3C traceparent header value. Invalid values
+// yield the zero context.
+func ParseTraceParent(value string) (c SpanContext) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}
+	}
+	if _, err = hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err = hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	if !c.Valid() {
+		return SpanContext{}
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c
+}
+
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of a collector, such as
+	// Jaeger or the OpenTelemetry Collector. Tracing is disabled if empty.
+	Endpoint string `env:"endpoint"`
+
+	// ServiceName identifies this service in exported traces. Defaults to
+	// "pushgo".
+	ServiceName string `toml:"service_name" env:"service_name"`
+
+	// SampleRate is the fraction of traces started by this node that are
+	// exported. Traces started by app servers or other nodes follow the
+	// caller's sampling decision. Defaults to 0.1.
+	SampleRate float64 `toml:"sample_rate" env:"sample_rate"`
+
+	// BatchSize is the maximum number of spans per export request. Defaults
+	// to 512.
+	BatchSize int `toml:"batch_size" env:"batch_size"`
+
+	// MaxQueue is the maximum number of ended spans waiting for export.
+	// Further spans are dropped. Defaults to 4096.
+	MaxQueue int `toml:"max_queue" env:"max_queue"`
+
+	// FlushInterval is the maximum time a span waits for export. Defaults
+	// to 5 seconds.
+	FlushInterval string `toml:"flush_interval" env:"flush_interval"`
+}
+
+// Tracer records spans for updates as they move from the endpoint handler
+// through storage and the router to the device's connection, and exports
+// sampled spans to a collector with the OTLP/HTTP JSON protocol. A nil
+// Tracer records nothing.
+type Tracer struct {
+	logger        *SimpleLogger
+	metrics       Statistician
+	endpoint      string
+	serviceName   string
+	sampleRate    float64
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+	spans         chan *Span
+
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{closeSignal: make(chan bool)}
+}
+
+func (*Tracer) ConfigStruct() interface{} {
+	return &TracingConfig{
+		ServiceName:   "pushgo",
+		SampleRate:    0.1,
+		BatchSize:     512,
+		MaxQueue:      4096,
+		FlushInterval: "5s",
+	}
+}
+
+// Init configures the tracer. Tracing is configured with metrics, so the
+// metrics instance is passed explicitly.
+func (t *Tracer) Init(app *Application, config interface{},
+	metrics Statistician) (err error) {
+
+	conf := config.(*TracingConfig)
+	t.logger = app.Logger()
+	t.metrics = metrics
+	if t.endpoint = conf.Endpoint; len(t.endpoint) == 0 {
+		return nil
+	}
+	if conf.SampleRate < 0 || conf.SampleRate > 1 {
+		t.logger.Panic("tracing", "Invalid trace sample rate",
+			LogFields{"rate": strconv.FormatFloat(conf.SampleRate, 'f', -1, 64)})
+		return ErrInvalidSampleRate
+	}
+	if t.flushInterval, err = time.ParseDuration(conf.FlushInterval); err != nil {
+		t.logger.Panic("tracing", "Could not parse trace flush interval",
+			LogFields{"error": err.Error(), "interval": conf.FlushInterval})
+		return err
+	}
+	t.serviceName = conf.ServiceName
+	t.sampleRate = conf.SampleRate
+	if t.batchSize = conf.BatchSize; t.batchSize < 1 {
+		t.batchSize = 1
+	}
+	t.client = &http.Client{Timeout: t.flushInterval}
+	t.spans = make(chan *Span, conf.MaxQueue)
+	t.closeWait.Add(1)
+	go t.exportLoop()
+	return nil
+}
+
+// Enabled indicates whether spans are recorded.
+func (t *Tracer) Enabled() bool {
+	return t != nil && len(t.endpoint) > 0
+}
+
+// StartSpan starts a span. If parent is valid, the span joins the parent's
+// trace and follows its sampling decision; otherwise, the span starts a new
+// trace. Returns nil if tracing is disabled.
+func (t *Tracer) StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	if !t.Enabled() {
+		return nil
+	}
+	s := &Span{
+		tracer:    t,
+		name:      name,
+		kind:      kind,
+		startTime: time.Now(),
+	}
+	if parent.Valid() {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Sampled = mrand.Float64() < t.sampleRate
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+// Close exports pending spans and stops the exporter.
+func (t *Tracer) Close() error {
+	if !t.Enabled() {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		close(t.closeSignal)
+		t.closeWait.Wait()
+	})
+	return nil
+}
+
+func (t *Tracer) finish(s *Span) {
+	if !s.context.Sampled {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.metrics.Increment("tracing.dropped")
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer t.closeWait.Done()
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.batchSize)
+	for {
+		select {
+		case <-t.closeSignal:
+			for len(t.spans) > 0 {
+				if batch = append(batch, <-t.spans); len(batch) >= t.batchSize {
+					batch = t.export(batch)
+				}
+			}
+			t.export(batch)
+			return
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= t.batchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		}
+	}
+}
+
+// export sends a batch of spans to the collector, returning the emptied
+// batch. Spans that cannot be exported are dropped.
+func (t *Tracer) export(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	err := t.post(batch)
+	if err != nil {
+		if t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("tracing", "Could not export spans", LogFields{
+				"error": err.Error(), "spans": strconv.Itoa(len(batch))})
+		}
+		t.metrics.IncrementBy("tracing.export.error", int64(len(batch)))
+	} else {
+		t.metrics.IncrementBy("tracing.exported", int64(len(batch)))
+	}
+	for i := range batch {
+		batch[i] = nil
+	}
+	return batch[:0]
+}
+
+func (t *Tracer) post(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(&otlpRequest{[]otlpResourceSpans{{
+		Resource: otlpResource{[]otlpAttribute{
+			{"service.name", otlpValue{t.serviceName}}}},
+		ScopeSpans: []otlpScopeSpans{{otlpScope{"pushgo"}, spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected collector response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Span records a timed operation within a trace. Methods on a nil Span do
+// nothing, so that callers need not check whether tracing is enabled.
+type Span struct {
+	tracer    *Tracer
+	name      string
+	kind      SpanKind
+	context   SpanContext
+	parentID  [8]byte
+	startTime time.Time
+	endTime   time.Time
+	err       error
+
+	lock       sync.Mutex
+	attributes []otlpAttribute
+}
+
+// Context returns the span's context, for propagation to child spans. Nil
+// spans return the zero context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute annotates the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.lock.Lock()
+	s.attributes = append(s.attributes, otlpAttribute{key, otlpValue{value}})
+	s.lock.Unlock()
+}
+
+// End finishes the span, marking it as failed if err is non-nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.endTime = time.Now()
+	s.err = err
+	s.tracer.finish(s)
+}
+
+func (s *Span) otlp() (span otlpSpan) {
+	span = otlpSpan{
+		TraceID:   hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:    hex.EncodeToString(s.context.SpanID[:]),
+		Name:      s.name,
+		Kind:      s.kind,
+		StartTime: unixNanoString(s.startTime),
+		EndTime:   unixNanoString(s.endTime),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	s.lock.Lock()
+	span.Attributes = s.attributes
+	s.lock.Unlock()
+	if s.err != nil {
+		span.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return span
+}
+
+func unixNanoString(t time.Time) string {
+	return strconv.FormatUint(uint64(t.UnixNano()), 10)
+}
+
+// OTLP/HTTP JSON request bodies. Trace and span IDs are hex-encoded, and
+// timestamps are decimal strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         SpanKind        `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
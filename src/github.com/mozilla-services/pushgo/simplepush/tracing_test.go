@@ -0,0 +1,187 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c := ParseTraceParent(value)
+	if !c.Valid() || !c.Sampled {
+		t.Fatalf("Expected valid sampled context for %q; got %#v", value, c)
+	}
+	if s := c.String(); s != value {
+		t.Errorf("Wrong traceparent: got %q; want %q", s, value)
+	}
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if c := ParseTraceParent(value); c.Valid() {
+			t.Errorf("Expected invalid context for %q; got %#v", value, c)
+		}
+	}
+	// Future versions may append fields.
+	if c := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !c.Valid() || c.Sampled {
+		t.Errorf("Expected valid unsampled context; got %#v", c)
+	}
+}
+
+// testCollector records spans exported with OTLP/HTTP JSON.
+type testCollector struct {
+	sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *testCollector) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	request := new(otlpRequest)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	c.Unlock()
+}
+
+func (c *testCollector) Span(name string) (span otlpSpan, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	for _, span = range c.spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return span, false
+}
+
+func Test_RouterTracing(t *testing.T) {
+	uaid := "deadbeef000000000000000000000000"
+	chid := "decafbad000000000000000000000000"
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parent := ParseTraceParent("00-" + traceID + "-00f067aa0ba902b7-01")
+
+	collector := new(testCollector)
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	// The peer receives the trace context in the header and the update.
+	var lock sync.Mutex
+	var header, carried string
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			segment, err := capn.ReadFromStream(req.Body, nil)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusBadRequest)
+				return
+			}
+			lock.Lock()
+			header = req.Header.Get(HeaderTraceParent)
+			carried = ReadRootRoutable(segment).TraceParent()
+			lock.Unlock()
+			resp.Write([]byte("Ok"))
+		}))
+	defer peer.Close()
+
+	handler, app := newTestHandler(t)
+	tracer := NewTracer()
+	conf := tracer.ConfigStruct().(*TracingConfig)
+	conf.Endpoint = collectorServer.URL + "/v1/traces"
+	conf.SampleRate = 0
+	conf.FlushInterval = "10ms"
+	if err := tracer.Init(app, conf, app.Metrics()); err != nil {
+		t.Fatalf("Error initializing tracer: %s", err)
+	}
+	app.tracer = tracer
+	handler.router.SetLocator(&StaticLocator{contacts: []string{peer.URL}})
+
+	err := handler.router.Route(nil, uaid, chid, 1, time.Now(), "test", "",
+		PriorityNormal, parent)
+	if err != nil {
+		t.Fatalf("Error routing update: %s", err)
+	}
+	tracer.Close()
+
+	route, ok := collector.Span("router.route")
+	if !ok {
+		t.Fatalf("Missing routing span: %#v", collector.spans)
+	}
+	if route.TraceID != traceID || route.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected routing span to join caller's trace; got %#v", route)
+	}
+	notify, ok := collector.Span("router.notify")
+	if !ok {
+		t.Fatalf("Missing notification span: %#v", collector.spans)
+	}
+	if notify.TraceID != traceID || notify.ParentSpanID != route.SpanID {
+		t.Errorf("Expected notification span to be a child of the routing span; got %#v", notify)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !strings.Contains(header, traceID) || !strings.Contains(header, notify.SpanID) {
+		t.Errorf("Wrong traceparent header: got %q; want notification span", header)
+	}
+	if !strings.Contains(carried, route.SpanID) {
+		t.Errorf("Wrong carried trace context: got %q; want routing span", carried)
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	_, app := newTestHandler(t)
+	tracer := NewTracer()
+	conf := tracer.ConfigStruct().(*TracingConfig)
+	conf.Endpoint = "http://127.0.0.1:1/v1/traces"
+	conf.SampleRate = 0
+	if err := tracer.Init(app, conf, app.Metrics()); err != nil {
+		t.Fatalf("Error initializing tracer: %s", err)
+	}
+	defer tracer.Close()
+
+	// New traces are sampled at the configured rate.
+	root := tracer.StartSpan("root", SpanServer, SpanContext{})
+	if c := root.Context(); !c.Valid() || c.Sampled {
+		t.Errorf("Expected valid unsampled root span; got %#v", c)
+	}
+	// Child spans follow the parent's decision.
+	parent := root.Context()
+	parent.Sampled = true
+	child := tracer.StartSpan("child", SpanInternal, parent)
+	if c := child.Context(); c.TraceID != parent.TraceID || !c.Sampled {
+		t.Errorf("Expected sampled child span in parent's trace; got %#v", c)
+	}
+
+	// Disabled tracers return nil spans, which are safe to use.
+	var disabled *Tracer
+	span := disabled.StartSpan("noop", SpanInternal, parent)
+	span.SetAttribute("key", "value")
+	span.End(nil)
+	if span.Context().Valid() {
+		t.Errorf("Expected nil span to have an invalid context")
+	}
+
+	conf.SampleRate = 2
+	if err := NewTracer().Init(app, conf, app.Metrics()); err != ErrInvalidSampleRate {
+		t.Errorf("Expected invalid sample rate error; got %v", err)
+	}
+}
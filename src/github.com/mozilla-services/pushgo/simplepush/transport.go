@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMessageTooLarge is returned by Socket.ReadMessage if a client sends a
+// message larger than the read limit.
+var ErrMessageTooLarge = errors.New("WebSocket message exceeds maximum size")
+
+// DefaultTransport is the WebSocket implementation used by the client
+// listener. NetTransport remains available while clients are migrated.
+var DefaultTransport Transport = GorillaTransport{}
+
+// Socket is a WebSocket connection that exchanges text messages. Workers talk
+// to clients through a Socket, so that the underlying WebSocket library can
+// be replaced without changing the protocol handlers.
+type Socket interface {
+	// ReadMessage returns the payload of the next data message. Pings are
+	// answered and close frames echoed by the Socket; ReadMessage returns
+	// io.EOF once the client closes the connection.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage sends a text message.
+	WriteMessage(data []byte) error
+
+	// WriteJSON encodes v as JSON and sends it as a text message. Messages
+	// are encoded into pooled buffers; see writeJSON.
+	WriteJSON(v interface{}) error
+
+	// WriteClose sends a close frame with the given status code and reason,
+	// without closing the connection. Once a close frame is sent or echoed,
+	// later calls do nothing.
+	WriteClose(code CloseCode, reason string) error
+
+	// SetReadLimit sets the maximum size of a message read from the client.
+	SetReadLimit(limit int64)
+
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
+	// Request returns the HTTP upgrade request.
+	Request() *http.Request
+
+	// Close closes the underlying connection.
+	Close() error
+}
+
+// UpgradeCheck validates a WebSocket upgrade request before the handshake,
+// and returns the subprotocol to select, or an empty string to select none.
+// Rejected requests receive a 403 response.
+type UpgradeCheck func(req *http.Request) (subprotocol string, err error)
+
+// Transport upgrades HTTP requests to WebSocket connections.
+type Transport interface {
+	// Handler returns an http.Handler that upgrades requests accepted by
+	// check, and calls serve with the upgraded connection. check may be nil.
+	Handler(serve func(Socket), check UpgradeCheck) http.Handler
+}
+
+// requestOrigin parses the Origin header of a WebSocket upgrade request.
+// Returns a nil URL if the header is missing.
+func requestOrigin(req *http.Request) (*url.URL, error) {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 {
+		return nil, nil
+	}
+	return url.ParseRequestURI(origin)
+}
+
+// requestSubprotocols returns the subprotocols offered in the
+// Sec-WebSocket-Protocol header of a WebSocket upgrade request.
+func requestSubprotocols(req *http.Request) (protocols []string) {
+	for _, header := range req.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// maxPooledEncoderSize caps the buffers of pooled JSON encoders, so that a
+// single large reply does not pin memory.
+const maxPooledEncoderSize = 64 << 10
+
+// jsonEncoder is a reusable JSON encoder and its output buffer.
+type jsonEncoder struct {
+	buf     bytes.Buffer
+	encoder *json.Encoder
+}
+
+// jsonEncoders holds the encoders used to write replies to clients, so that
+// connect storms do not allocate an encoder and buffer per message.
+var jsonEncoders = sync.Pool{New: func() interface{} {
+	e := new(jsonEncoder)
+	e.encoder = json.NewEncoder(&e.buf)
+	return e
+}}
+
+// writeJSON encodes v with a pooled encoder, and calls write with the
+// encoded message. The message is only valid until write returns.
+func writeJSON(v interface{}, write func([]byte) error) (err error) {
+	e := jsonEncoders.Get().(*jsonEncoder)
+	e.buf.Reset()
+	if err = e.encoder.Encode(v); err == nil {
+		// Trim the newline appended by Encode.
+		err = write(e.buf.Bytes()[:e.buf.Len()-1])
+	}
+	if e.buf.Cap() <= maxPooledEncoderSize {
+		jsonEncoders.Put(e)
+	}
+	return err
+}
+
+// closePayload encodes a close frame payload. Control frame payloads are
+// limited to 125 bytes.
+func closePayload(code CloseCode, reason string) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	payload[0], payload[1] = byte(code>>8), byte(code)
+	return append(payload, reason...)
+}
@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeWriteTimeout bounds the time spent writing close frames.
+const closeWriteTimeout = 5 * time.Second
+
+// GorillaTransport serves WebSocket connections with the gorilla/websocket
+// package, which enforces read limits while reading, handles unsolicited
+// pongs, and completes the close handshake.
+type GorillaTransport struct{}
+
+// Handler implements Transport.Handler.
+func (GorillaTransport) Handler(serve func(Socket), check UpgradeCheck) http.Handler {
+	upgrader := &websocket.Upgrader{
+		// Origins are checked before the upgrade, so that rejected
+		// handshakes receive a 403, as with NetTransport.
+		CheckOrigin: func(*http.Request) bool { return true },
+		// Share write buffers between connections, instead of holding one
+		// per idle connection.
+		WriteBufferPool: new(sync.Pool),
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var header http.Header
+		if check != nil {
+			protocol, err := check(req)
+			if err != nil {
+				http.Error(resp, http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+			if len(protocol) > 0 {
+				// Upgrade selects this subprotocol, since the upgrader does
+				// not list any.
+				header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+			}
+		}
+		ws, err := upgrader.Upgrade(resp, req, header)
+		if err != nil {
+			// Upgrade replies with an HTTP error.
+			return
+		}
+		serve(&GorillaSocket{Conn: ws, request: req})
+	})
+}
+
+// GorillaSocket adapts a gorilla/websocket connection to the Socket
+// interface. Workers write from multiple goroutines, but gorilla/websocket
+// supports only one concurrent writer, so writes are serialized.
+type GorillaSocket struct {
+	*websocket.Conn
+	request   *http.Request
+	writeLock sync.Mutex
+	closeSent int32 // Accessed atomically.
+}
+
+// ReadMessage implements Socket.ReadMessage.
+func (s *GorillaSocket) ReadMessage() ([]byte, error) {
+	_, data, err := s.Conn.ReadMessage()
+	if err == nil {
+		return data, nil
+	}
+	if err == websocket.ErrReadLimit {
+		// The connection has already sent a 1009 close frame.
+		atomic.StoreInt32(&s.closeSent, 1)
+		return nil, ErrMessageTooLarge
+	}
+	if _, ok := err.(*websocket.CloseError); ok {
+		// The default close handler echoes the client's close frame.
+		atomic.StoreInt32(&s.closeSent, 1)
+		return nil, io.EOF
+	}
+	return nil, err
+}
+
+// WriteMessage implements Socket.WriteMessage.
+func (s *GorillaSocket) WriteMessage(data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// WriteJSON implements Socket.WriteJSON.
+func (s *GorillaSocket) WriteJSON(v interface{}) error {
+	return writeJSON(v, s.WriteMessage)
+}
+
+// WriteClose implements Socket.WriteClose. Only the first close frame is
+// sent.
+func (s *GorillaSocket) WriteClose(code CloseCode, reason string) error {
+	if !atomic.CompareAndSwapInt32(&s.closeSent, 0, 1) {
+		return nil
+	}
+	return s.Conn.WriteControl(websocket.CloseMessage, closePayload(code, reason),
+		time.Now().Add(closeWriteTimeout))
+}
+
+// Request implements Socket.Request.
+func (s *GorillaSocket) Request() *http.Request {
+	return s.request
+}
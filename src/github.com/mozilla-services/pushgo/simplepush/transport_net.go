@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// NetTransport serves WebSocket connections with the golang.org/x/net
+// websocket package. The package answers pings, but fails the connection if
+// a client sends an unsolicited pong. Superseded by GorillaTransport.
+type NetTransport struct{}
+
+// Handler implements Transport.Handler.
+func (NetTransport) Handler(serve func(Socket), check UpgradeCheck) http.Handler {
+	return websocket.Server{
+		Handler: func(ws *websocket.Conn) { serve(NewNetSocket(ws)) },
+		// The websocket package rejects handshakes that offer several
+		// subprotocols unless one is selected here.
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			config.Protocol = nil
+			if check == nil {
+				return nil
+			}
+			protocol, err := check(req)
+			if err != nil {
+				return err
+			}
+			if len(protocol) > 0 {
+				config.Protocol = []string{protocol}
+			}
+			return nil
+		},
+	}
+}
+
+// NetSocket adapts a golang.org/x/net websocket connection to the Socket
+// interface.
+type NetSocket struct {
+	*websocket.Conn
+	closeSent int32 // Accessed atomically.
+}
+
+// NewNetSocket wraps an established WebSocket connection.
+func NewNetSocket(ws *websocket.Conn) *NetSocket {
+	return &NetSocket{Conn: ws}
+}
+
+// ReadMessage implements Socket.ReadMessage. Frames over the read limit are
+// rejected before their payload is read, and the connection closed with
+// status 1009.
+func (s *NetSocket) ReadMessage() (data []byte, err error) {
+	if err = websocket.Message.Receive(s.Conn, &data); err != nil {
+		switch err {
+		case io.EOF:
+			// The websocket package does not echo close frames.
+			s.WriteClose(CloseNormal, "")
+		case websocket.ErrFrameTooLarge:
+			s.WriteClose(CloseMessageTooBig, CloseMessageTooBig.Reason())
+			err = ErrMessageTooLarge
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteMessage implements Socket.WriteMessage.
+func (s *NetSocket) WriteMessage(data []byte) error {
+	return websocket.Message.Send(s.Conn, string(data))
+}
+
+// WriteJSON implements Socket.WriteJSON.
+func (s *NetSocket) WriteJSON(v interface{}) error {
+	return writeJSON(v, s.WriteMessage)
+}
+
+// WriteClose implements Socket.WriteClose. The websocket package only sends
+// its default status on Close, so the frame is written directly. Only the
+// first close frame is sent.
+func (s *NetSocket) WriteClose(code CloseCode, reason string) error {
+	if !atomic.CompareAndSwapInt32(&s.closeSent, 0, 1) {
+		return nil
+	}
+	codec := websocket.Codec{Marshal: func(interface{}) ([]byte, byte, error) {
+		return closePayload(code, reason), websocket.CloseFrame, nil
+	}}
+	return codec.Send(s.Conn, nil)
+}
+
+// SetReadLimit implements Socket.SetReadLimit. It must be called before the
+// first read.
+func (s *NetSocket) SetReadLimit(limit int64) {
+	s.Conn.MaxPayloadBytes = int(limit)
+}
+
+// Close implements Socket.Close. The websocket package writes a close frame
+// before closing the connection; if one was already sent, the write is
+// abandoned by expiring the write deadline.
+func (s *NetSocket) Close() error {
+	if atomic.LoadInt32(&s.closeSent) == 1 {
+		s.Conn.SetWriteDeadline(time.Now())
+	}
+	return s.Conn.Close()
+}
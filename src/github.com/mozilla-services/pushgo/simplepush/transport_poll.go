@@ -0,0 +1,421 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WebSocket frame opcodes (RFC 6455, section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// websocketGUID is appended to the client's key to compute the
+// Sec-WebSocket-Accept header.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// pollHandshakeTimeout bounds the time spent writing the handshake response.
+const pollHandshakeTimeout = 10 * time.Second
+
+// pollBufferSize is the size of the pooled buffers that hold incoming
+// frames. Buffers grow to fit larger frames, but only buffers of this size
+// are returned to the pool.
+const pollBufferSize = 4096
+
+var (
+	// errFrameProtocol is returned by PollSocket.ReadMessage if the client
+	// sends a malformed frame.
+	errFrameProtocol = errors.New("Malformed WebSocket frame")
+
+	// errCloseSent is returned when writing a message after the close frame.
+	errCloseSent = errors.New("WebSocket close frame already sent")
+)
+
+// pollBuffers holds the read buffers of PollSockets, which are only held
+// while a frame is partially read.
+var pollBuffers = sync.Pool{New: func() interface{} {
+	return make([]byte, pollBufferSize)
+}}
+
+// PollTransport serves WebSocket connections with a built-in frame codec.
+// Unlike the other transports, its sockets can be read as data arrives, so
+// that idle connections do not park a goroutine in a blocking read; see
+// WorkerPoolConfig.Poll. Sockets that cannot be polled, e.g., TLS
+// connections, fall back to blocking reads.
+type PollTransport struct{}
+
+// Handler implements Transport.Handler.
+func (PollTransport) Handler(serve func(Socket), check UpgradeCheck) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Sec-Websocket-Key")
+		if req.Method != "GET" || len(key) == 0 ||
+			!headerHasToken(req.Header, "Connection", "upgrade") ||
+			!headerHasToken(req.Header, "Upgrade", "websocket") {
+
+			http.Error(resp, http.StatusText(http.StatusBadRequest),
+				http.StatusBadRequest)
+			return
+		}
+		if req.Header.Get("Sec-Websocket-Version") != "13" {
+			resp.Header().Set("Sec-Websocket-Version", "13")
+			http.Error(resp, http.StatusText(http.StatusBadRequest),
+				http.StatusBadRequest)
+			return
+		}
+		var protocol string
+		if check != nil {
+			var err error
+			if protocol, err = check(req); err != nil {
+				http.Error(resp, http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+		}
+		hijacker, ok := resp.(http.Hijacker)
+		if !ok {
+			http.Error(resp, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		accept := sha1.Sum([]byte(key + websocketGUID))
+		reply := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+		if len(protocol) > 0 {
+			reply += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+		}
+		conn.SetWriteDeadline(time.Now().Add(pollHandshakeTimeout))
+		if _, err = io.WriteString(conn, reply+"\r\n"); err != nil {
+			conn.Close()
+			return
+		}
+		// Clear the deadlines set by the HTTP server.
+		conn.SetDeadline(time.Time{})
+		sock := newPollSocket(conn, req)
+		if n := brw.Reader.Buffered(); n > 0 {
+			// The client sent frames along with the handshake.
+			buffered, _ := brw.Reader.Peek(n)
+			sock.rbuf = append(make([]byte, 0, pollBufferSize), buffered...)
+			sock.rbuf = sock.rbuf[:cap(sock.rbuf)]
+			sock.w = n
+		}
+		serve(sock)
+	})
+}
+
+// headerHasToken indicates whether the comma-separated values of the named
+// header include token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PollSocket is a WebSocket connection served by PollTransport. Messages are
+// read with blocking ReadMessage calls, or by a netPoller once data arrives.
+type PollSocket struct {
+	conn      net.Conn
+	raw       syscall.RawConn // nil if the connection cannot be polled.
+	request   *http.Request
+	readLimit int64 // Accessed atomically.
+
+	// The read lock guards the frame parser state, and serializes reads.
+	readLock   sync.Mutex
+	rbuf       []byte // Unparsed frames are in rbuf[r:w]; nil if empty.
+	r, w       int
+	message    []byte // Payload of a fragmented message.
+	fragmented bool
+	finished   bool // The poller has stopped reading.
+
+	writeLock sync.Mutex
+	closeSent bool
+
+	stateLock sync.Mutex
+	closed    bool
+	poller    *netPoller // nil unless registered with a poller.
+	pollID    int32
+	onMessage func([]byte) bool
+	onClose   func(error)
+}
+
+func newPollSocket(conn net.Conn, req *http.Request) *PollSocket {
+	s := &PollSocket{conn: conn, request: req}
+	if sc, ok := conn.(syscall.Conn); ok {
+		s.raw, _ = sc.SyscallConn()
+	}
+	return s
+}
+
+// Pollable indicates whether the socket can be read by a netPoller.
+func (s *PollSocket) Pollable() bool {
+	return s.raw != nil
+}
+
+// ReadMessage implements Socket.ReadMessage. Messages over the read limit
+// are rejected before they are buffered, and the connection closed with
+// status 1009.
+func (s *PollSocket) ReadMessage() ([]byte, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	for {
+		data, ok, err := s.nextMessage()
+		if err == nil && !ok {
+			err = s.fill(s.conn.Read)
+		}
+		if err != nil || ok {
+			s.release()
+			return data, err
+		}
+	}
+}
+
+// fill reads from the connection into the read buffer, growing the buffer
+// if it holds a partial frame. The caller must hold the read lock.
+func (s *PollSocket) fill(read func([]byte) (int, error)) error {
+	if s.rbuf == nil {
+		s.rbuf = pollBuffers.Get().([]byte)
+	}
+	if s.r > 0 {
+		copy(s.rbuf, s.rbuf[s.r:s.w])
+		s.r, s.w = 0, s.w-s.r
+	}
+	if s.w == len(s.rbuf) {
+		rbuf := make([]byte, 2*len(s.rbuf))
+		copy(rbuf, s.rbuf[:s.w])
+		s.rbuf = rbuf
+	}
+	n, err := read(s.rbuf[s.w:])
+	if n > 0 {
+		s.w += n
+	}
+	return err
+}
+
+// release returns the read buffer to the pool once it is empty, so that
+// idle connections do not hold one. The caller must hold the read lock.
+func (s *PollSocket) release() {
+	if s.rbuf == nil || s.r < s.w && !s.finished {
+		return
+	}
+	if len(s.rbuf) == pollBufferSize {
+		pollBuffers.Put(s.rbuf)
+	}
+	s.rbuf, s.r, s.w = nil, 0, 0
+}
+
+// nextMessage parses the next data message from the read buffer, answering
+// pings and echoing close frames along the way. ok is false if more data
+// is needed. The returned message is a copy. The caller must hold the read
+// lock.
+func (s *PollSocket) nextMessage() (data []byte, ok bool, err error) {
+	for {
+		frame := s.rbuf[s.r:s.w]
+		if len(frame) < 2 {
+			return nil, false, nil
+		}
+		if frame[0]&0x70 != 0 || frame[1]&0x80 == 0 {
+			// Reserved bits are set, or the client did not mask the frame.
+			return nil, false, s.failFrame(CloseProtocolError)
+		}
+		fin, opcode := frame[0]&0x80 != 0, frame[0]&0x0f
+		headerLen, length := 2, int64(frame[1]&0x7f)
+		switch length {
+		case 126:
+			if headerLen = 4; len(frame) < headerLen {
+				return nil, false, nil
+			}
+			length = int64(binary.BigEndian.Uint16(frame[2:]))
+		case 127:
+			if headerLen = 10; len(frame) < headerLen {
+				return nil, false, nil
+			}
+			if length = int64(binary.BigEndian.Uint64(frame[2:])); length < 0 {
+				return nil, false, s.failFrame(CloseProtocolError)
+			}
+		}
+		if opcode&0x8 != 0 {
+			if !fin || length > 125 {
+				return nil, false, s.failFrame(CloseProtocolError)
+			}
+		} else if limit := atomic.LoadInt64(&s.readLimit); limit > 0 &&
+			int64(len(s.message))+length > limit {
+
+			return nil, false, s.failFrame(CloseMessageTooBig)
+		}
+		size := int64(headerLen+4) + length
+		if int64(len(frame)) < size {
+			return nil, false, nil
+		}
+		mask := frame[headerLen : headerLen+4]
+		payload := frame[headerLen+4 : size]
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+		s.r += int(size)
+		switch opcode {
+		case opContinuation:
+			if !s.fragmented {
+				return nil, false, s.failFrame(CloseProtocolError)
+			}
+			s.message = append(s.message, payload...)
+			if fin {
+				data, s.message, s.fragmented = s.message, nil, false
+				return data, true, nil
+			}
+		case opText, opBinary:
+			if s.fragmented {
+				return nil, false, s.failFrame(CloseProtocolError)
+			}
+			if fin {
+				return append([]byte(nil), payload...), true, nil
+			}
+			s.message, s.fragmented = append([]byte(nil), payload...), true
+		case opClose:
+			if len(payload) == 1 {
+				return nil, false, s.failFrame(CloseProtocolError)
+			}
+			if len(payload) > 2 {
+				// Echo the status code only.
+				payload = payload[:2]
+			}
+			s.writeFrame(opClose, payload)
+			return nil, false, io.EOF
+		case opPing:
+			s.writeFrame(opPong, payload)
+		case opPong:
+		default:
+			return nil, false, s.failFrame(CloseProtocolError)
+		}
+	}
+}
+
+// failFrame sends a close frame for a frame that cannot be read, and
+// returns the error for ReadMessage.
+func (s *PollSocket) failFrame(code CloseCode) error {
+	s.WriteClose(code, code.Reason())
+	if code == CloseMessageTooBig {
+		return ErrMessageTooLarge
+	}
+	return errFrameProtocol
+}
+
+// writeFrame writes an unmasked, unfragmented frame. Messages cannot be
+// written after the close frame, which is only sent once.
+func (s *PollSocket) writeFrame(opcode byte, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.closeSent {
+		if opcode == opClose || opcode == opPong {
+			return nil
+		}
+		return errCloseSent
+	}
+	if opcode == opClose {
+		s.closeSent = true
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	buffers := net.Buffers{header, payload}
+	_, err := buffers.WriteTo(s.conn)
+	return err
+}
+
+// WriteMessage implements Socket.WriteMessage.
+func (s *PollSocket) WriteMessage(data []byte) error {
+	return s.writeFrame(opText, data)
+}
+
+// WriteJSON implements Socket.WriteJSON.
+func (s *PollSocket) WriteJSON(v interface{}) error {
+	return writeJSON(v, s.WriteMessage)
+}
+
+// WriteClose implements Socket.WriteClose.
+func (s *PollSocket) WriteClose(code CloseCode, reason string) error {
+	return s.writeFrame(opClose, closePayload(code, reason))
+}
+
+// SetReadLimit implements Socket.SetReadLimit.
+func (s *PollSocket) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&s.readLimit, limit)
+}
+
+// SetReadDeadline implements Socket.SetReadDeadline.
+func (s *PollSocket) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements Socket.SetWriteDeadline.
+func (s *PollSocket) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+// Request implements Socket.Request.
+func (s *PollSocket) Request() *http.Request {
+	return s.request
+}
+
+// isClosed indicates whether the connection was closed.
+func (s *PollSocket) isClosed() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.closed
+}
+
+// Close implements Socket.Close. Closing a polled connection removes it from
+// the poller without an event, so the poller is notified to finish it.
+func (s *PollSocket) Close() error {
+	s.stateLock.Lock()
+	if s.closed {
+		s.stateLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	poller := s.poller
+	s.stateLock.Unlock()
+	err := s.conn.Close()
+	if poller != nil {
+		poller.dispatch(s)
+	}
+	return err
+}
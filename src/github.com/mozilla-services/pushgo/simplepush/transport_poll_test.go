@@ -0,0 +1,170 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUpgradeRequest = "GET / HTTP/1.1\r\nHost: localhost\r\n" +
+	"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+// maskedFrame encodes a client frame.
+func maskedFrame(opcode byte, fin bool, payload []byte) []byte {
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+	if len(payload) > 125 {
+		frame[1] = 0x80 | 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+// readTestFrame reads an unmasked server frame.
+func readTestFrame(t *testing.T, r *bufio.Reader) (opcode byte, payload []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("Error reading frame: %s", err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		length = int(ext[0])<<8 | int(ext[1])
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Error reading frame payload: %s", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// dialPollTransport completes the handshake with a PollTransport server,
+// sending early along with the upgrade request.
+func dialPollTransport(t *testing.T, server *httptest.Server, early []byte) (
+	net.Conn, *bufio.Reader) {
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Error dialing test server: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(append([]byte(testUpgradeRequest), early...))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake failed: %#v, %v", resp, err)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Wrong accept header: %q", accept)
+	}
+	return conn, r
+}
+
+// newEchoServer echoes messages with blocking reads, and sends read errors
+// to errs.
+func newEchoServer(errs chan error) *httptest.Server {
+	return httptest.NewServer(PollTransport{}.Handler(func(ws Socket) {
+		ws.SetReadLimit(1024)
+		defer ws.Close()
+		for {
+			data, err := ws.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			ws.WriteMessage(data)
+		}
+	}, nil))
+}
+
+func TestPollTransportFrames(t *testing.T) {
+	errs := make(chan error, 1)
+	server := newEchoServer(errs)
+	defer server.Close()
+	conn, r := dialPollTransport(t, server, maskedFrame(opText, true, []byte("early")))
+	defer conn.Close()
+
+	if opcode, data := readTestFrame(t, r); opcode != opText || string(data) != "early" {
+		t.Errorf("Wrong echo for early frame: %d, %q", opcode, data)
+	}
+	conn.Write(maskedFrame(opPing, true, []byte("ping")))
+	if opcode, data := readTestFrame(t, r); opcode != opPong || string(data) != "ping" {
+		t.Errorf("Wrong reply to ping: %d, %q", opcode, data)
+	}
+	// Fragmented messages are joined, and frames may arrive in pieces.
+	long := bytes.Repeat([]byte("b"), 300)
+	frames := append(maskedFrame(opText, false, []byte("a")),
+		maskedFrame(opContinuation, true, long)...)
+	conn.Write(frames[:5])
+	time.Sleep(10 * time.Millisecond)
+	conn.Write(frames[5:])
+	if _, data := readTestFrame(t, r); string(data) != "a"+string(long) {
+		t.Errorf("Wrong echo for fragmented message: %q", data)
+	}
+	conn.Write(maskedFrame(opClose, true, closePayload(CloseNormal, "bye")))
+	if opcode, data := readTestFrame(t, r); opcode != opClose ||
+		!bytes.Equal(data, closePayload(CloseNormal, "")) {
+
+		t.Errorf("Wrong reply to close frame: %d, %v", opcode, data)
+	}
+	if err := <-errs; err != io.EOF {
+		t.Errorf("Wrong read error after close: %v", err)
+	}
+}
+
+func TestPollTransportReadLimit(t *testing.T) {
+	errs := make(chan error, 1)
+	server := newEchoServer(errs)
+	defer server.Close()
+	conn, r := dialPollTransport(t, server, nil)
+	defer conn.Close()
+
+	// Rejected once the header is read, before the payload is buffered.
+	conn.Write(maskedFrame(opText, true, make([]byte, 2048))[:8])
+	if opcode, data := readTestFrame(t, r); opcode != opClose ||
+		!bytes.Equal(data[:2], closePayload(CloseMessageTooBig, "")) {
+
+		t.Errorf("Wrong close frame for large message: %d, %v", opcode, data)
+	}
+	if err := <-errs; err != ErrMessageTooLarge {
+		t.Errorf("Wrong read error for large message: %v", err)
+	}
+}
+
+func TestPollTransportUnmasked(t *testing.T) {
+	errs := make(chan error, 1)
+	server := newEchoServer(errs)
+	defer server.Close()
+	conn, r := dialPollTransport(t, server, nil)
+	defer conn.Close()
+
+	conn.Write([]byte{0x80 | opText, 2, 'h', 'i'})
+	if opcode, data := readTestFrame(t, r); opcode != opClose ||
+		!bytes.Equal(data[:2], closePayload(CloseProtocolError, "")) {
+
+		t.Errorf("Wrong close frame for unmasked frame: %d, %v", opcode, data)
+	}
+	if err := <-errs; err != errFrameProtocol {
+		t.Errorf("Wrong read error for unmasked frame: %v", err)
+	}
+}
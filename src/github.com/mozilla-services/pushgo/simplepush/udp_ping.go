@@ -0,0 +1,250 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	AvailablePings["udp"] = func() HasConfigStruct { return new(UDPPing) }
+}
+
+type UDPPingConfig struct {
+	// Networks lists the mobile networks that support UDP wakeup, as
+	// "mcc-mnc=cidr" pairs; e.g., ["214-07=10.0.0.0/8"]. Wakeup addresses
+	// must fall within one of the ranges configured for the device's
+	// network. A network may be listed more than once.
+	Networks []string `env:"networks"`
+
+	// Repeat is the number of datagrams sent for each wakeup, since UDP
+	// delivery is unreliable. Defaults to 1.
+	Repeat int `env:"repeat"`
+
+	// Timeout is the maximum time to wait for a datagram to be written.
+	// Defaults to 1 second.
+	Timeout string `env:"timeout"`
+
+	// Simulate logs and counts wakes instead of sending them as datagrams, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// UDPPingData is the "connect" data sent by devices on carrier networks
+// that support the SimplePush UDP wakeup extension.
+type UDPPingData struct {
+	WakeupHostPort struct {
+		IP   string `json:"ip"`
+		Port int    `json:"port"`
+	} `json:"wakeup_hostport"`
+	MobileNetwork struct {
+		MCC string `json:"mcc"`
+		MNC string `json:"mnc"`
+	} `json:"mobilenetwork"`
+}
+
+// network returns the "mcc-mnc" key of the device's mobile network.
+func (d *UDPPingData) network() string {
+	return d.MobileNetwork.MCC + "-" + d.MobileNetwork.MNC
+}
+
+// UDPPing wakes disconnected devices by sending a UDP datagram to the
+// wakeup address provided in the handshake. The address is only reachable
+// from within the carrier's network, so the pinger is restricted to the
+// ranges configured for each carrier.
+type UDPPing struct {
+	logger   *SimpleLogger
+	metrics  Statistician
+	store    Store
+	feedback *PingFeedback
+	guard    *BridgeGuard
+	simulate bool
+	networks map[string][]*net.IPNet
+	repeat   int
+	timeout  time.Duration
+}
+
+func (*UDPPing) ConfigStruct() interface{} {
+	return &UDPPingConfig{
+		Repeat:  1,
+		Timeout: "1s",
+		Guard:   DefaultBridgeGuard(),
+	}
+}
+
+func (r *UDPPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*UDPPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("udp", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "udp", r.guard)
+	r.simulate = conf.Simulate
+
+	if r.networks, err = parseUDPNetworks(conf.Networks); err != nil {
+		r.logger.Panic("propping", "Could not parse UDP wakeup networks",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	if r.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		r.logger.Panic("propping", "Could not parse UDP wakeup timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	r.repeat = conf.Repeat
+	if r.repeat < 1 {
+		r.repeat = 1
+	}
+	return nil
+}
+
+// parseUDPNetworks parses a list of "mcc-mnc=cidr" pairs into a map of
+// allowed ranges for each network.
+func parseUDPNetworks(pairs []string) (map[string][]*net.IPNet, error) {
+	networks := make(map[string][]*net.IPNet)
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid UDP wakeup network: %q", pair)
+		}
+		key, cidr := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if strings.Count(key, "-") != 1 {
+			return nil, fmt.Errorf("Invalid mobile network code: %q", key)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks[key] = append(networks[key], ipNet)
+	}
+	return networks, nil
+}
+
+// wakeupAddr returns the device's wakeup address, or nil if the address is
+// invalid or outside the ranges allowed for the device's network.
+func (r *UDPPing) wakeupAddr(ping *UDPPingData) *net.UDPAddr {
+	ip := net.ParseIP(ping.WakeupHostPort.IP)
+	port := ping.WakeupHostPort.Port
+	if ip == nil || port <= 0 || port > 65535 {
+		return nil
+	}
+	for _, ipNet := range r.networks[ping.network()] {
+		if ipNet.Contains(ip) {
+			return &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	return nil
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and UDP is only used to wake disconnected devices.
+func (r *UDPPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *UDPPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's wakeup address. Addresses on unsupported
+// networks or outside the allowed ranges are rejected.
+func (r *UDPPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(UDPPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil || r.wakeupAddr(ping) == nil {
+		r.metrics.Increment("ping.udp.rejected")
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store UDP wakeup address",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// Send wakes a device by sending the version to its wakeup address. Devices
+// reconnect on receipt and fetch pending updates over the WebSocket, so the
+// datagram contents are informational only. It returns false without an
+// error if the device did not register a usable address.
+func (r *UDPPing) Send(uaid string, vers int64, _ string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch UDP wakeup address",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(UDPPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil {
+		return false, nil
+	}
+	// Re-check the address, in case the allowed ranges have changed since
+	// the device registered.
+	addr := r.wakeupAddr(ping)
+	if addr == nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "UDP wakeup address no longer allowed",
+				LogFields{"uaid": uaid, "network": ping.network()})
+		}
+		return false, nil
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		r.metrics.Increment("ping.udp.error")
+		r.feedback.Failed(uaid, err)
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(r.timeout))
+	msg := []byte(strconv.FormatInt(vers, 10))
+	for i := 0; i < r.repeat; i++ {
+		if _, err = conn.Write(msg); err != nil {
+			if r.logger.ShouldLog(ERROR) {
+				r.logger.Error("propping", "Failed to send UDP wakeup",
+					LogFields{"error": err.Error(), "uaid": uaid})
+			}
+			r.metrics.Increment("ping.udp.error")
+			r.feedback.Failed(uaid, err)
+			return false, err
+		}
+	}
+	r.metrics.Increment("ping.udp.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+func (r *UDPPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *UDPPing) Close() error {
+	return nil
+}
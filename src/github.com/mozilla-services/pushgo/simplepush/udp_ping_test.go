@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_UDPPingSend(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening for wakeups: %s", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := new(UDPPing)
+	conf := pinger.ConfigStruct().(*UDPPingConfig)
+	conf.Networks = []string{"001-01=127.0.0.0/8", "001-01=10.0.0.0/8"}
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing UDP pinger: %s", err)
+	}
+	defer pinger.Close()
+
+	pingData := `{"wakeup_hostport":{"ip":%q,"port":%d},"mobilenetwork":{"mcc":%q,"mnc":"01"}}`
+	for _, rejected := range []string{
+		`{"type":"udp"}`,
+		fmt.Sprintf(pingData, "127.0.0.1", port, "002"),
+		fmt.Sprintf(pingData, "192.168.1.1", port, "001"),
+		fmt.Sprintf(pingData, "127.0.0.1", 0, "001"),
+	} {
+		if err := pinger.Register("uaid0", []byte(rejected)); err != UnsupportedProtocolErr {
+			t.Errorf("Wrong error for %s: %v", rejected, err)
+		}
+	}
+	if err := pinger.Register("uaid1", []byte(fmt.Sprintf(pingData, "127.0.0.1", port, "001"))); err != nil {
+		t.Fatalf("Error registering uaid1: %s", err)
+	}
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Error reading wakeup: %s", err)
+	}
+	if string(buf[:n]) != "5" {
+		t.Errorf("Wrong wakeup datagram: got %q; want 5", buf[:n])
+	}
+	if ok, err := pinger.Send("uaid2", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for device without address: ok=%v, err=%v", ok, err)
+	}
+}
+
+func Test_UDPPingNetworks(t *testing.T) {
+	for _, networks := range [][]string{
+		{"001-01"},
+		{"00101=10.0.0.0/8"},
+		{"001-01=10.0.0.0"},
+	} {
+		if _, err := parseUDPNetworks(networks); err == nil {
+			t.Errorf("Expected error parsing %q", networks)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BatchUpdate is a single entry in a batch update request. Version defaults
+// to the current time if omitted.
+type BatchUpdate struct {
+	Token   string `json:"token"`
+	Version int64  `json:"version,omitempty"`
+	Data    string `json:"data,omitempty"`
+}
+
+// BatchUpdateResult describes the outcome of a single batch entry. Status
+// is the HTTP status code that a standalone update would have returned.
+type BatchUpdateResult struct {
+	Token  string       `json:"token"`
+	Status int          `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	FanOut *FanOutReply `json:"fanout,omitempty"`
+}
+
+// BatchUpdateReply is the response body for batch update requests. Results
+// are in the same order as the request entries.
+type BatchUpdateReply struct {
+	Results []*BatchUpdateResult `json:"results"`
+}
+
+// BatchUpdateHandler accepts a JSON array of updates and processes them
+// concurrently, returning a per-item status.
+func (self *Handler) BatchUpdateHandler(resp http.ResponseWriter, req *http.Request) {
+	timer := time.Now()
+	requestID := req.Header.Get(HeaderID)
+	span := self.app.Tracer().StartSpan("update.batch", SpanServer,
+		ParseTraceParent(req.Header.Get(HeaderTraceParent)))
+	defer span.End(nil)
+	if req.Method != "POST" {
+		http.Error(resp, "", http.StatusMethodNotAllowed)
+		self.metrics.Increment("updates.batch.invalid")
+		return
+	}
+	// Allow some slack for the token and version fields of each entry.
+	maxBody := int64(self.maxBatch) * int64(self.maxDataLen+1024)
+	server, authorized := self.checkAppServer(resp, req, maxBody)
+	if !authorized {
+		return
+	}
+	var appServer string
+	if server != nil {
+		appServer = server.Name
+	}
+	span.SetAttribute("appServer", appServer)
+	tenant := self.app.Server().Tenants().ForUpdate(req, appServer)
+	if self.app.Server().Maintenance().Enabled() {
+		self.writeMaintenance(resp, "updates.batch")
+		return
+	}
+	body := http.MaxBytesReader(resp, req.Body, maxBody)
+	var updates []*BatchUpdate
+	if err := json.NewDecoder(body).Decode(&updates); err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("update", "Could not parse batch request body",
+				LogFields{"rid": requestID, "error": err.Error()})
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		if isBodyTooLarge(err) {
+			resp.WriteHeader(http.StatusRequestEntityTooLarge)
+			resp.Write([]byte(`"Too Many Updates"`))
+			self.metrics.Increment("updates.batch.toolong")
+			return
+		}
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`"Invalid Request"`))
+		self.metrics.Increment("updates.batch.invalid")
+		return
+	}
+	if len(updates) > self.maxBatch {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		resp.Write([]byte(`"Too Many Updates"`))
+		self.metrics.Increment("updates.batch.toolong")
+		return
+	}
+	if self.logger.ShouldLog(INFO) {
+		self.logger.Info("update", "Handling batch update", LogFields{
+			"rid":       requestID,
+			"appServer": appServer,
+			"count":     strconv.Itoa(len(updates))})
+	}
+
+	var cancelSignal <-chan bool
+	if cn, ok := resp.(http.CloseNotifier); ok {
+		cancelSignal = cn.CloseNotify()
+	}
+
+	remoteAddr := requestRemoteAddr(req)
+	reply := &BatchUpdateReply{make([]*BatchUpdateResult, len(updates))}
+	indices := make(chan int)
+	procs := self.batchProcs
+	if procs > len(updates) {
+		procs = len(updates)
+	}
+	var wg sync.WaitGroup
+	wg.Add(procs)
+	for i := 0; i < procs; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				result := self.sendUpdate(requestID, server, tenant, remoteAddr,
+					updates[i], span.Context(), cancelSignal)
+				if result.Status != http.StatusOK {
+					self.metrics.Increment("updates.batch.failed")
+				}
+				reply.Results[i] = result
+			}
+		}()
+	}
+	for i := range updates {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	self.metrics.IncrementBy("updates.batch.items", int64(len(updates)))
+	self.metrics.Timer("updates.batch.handled", time.Since(timer))
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// sendUpdate validates and delivers a single update on behalf of the batch
+// and gRPC interfaces. Each update is taken from the app server's and the
+// tenant's quotas, and from the per-address and per-device rate limits, as
+// standalone updates are.
+func (self *Handler) sendUpdate(requestID string, appServer *AppServer,
+	tenant *Tenant, remoteAddr string, update *BatchUpdate, trace SpanContext,
+	cancelSignal <-chan bool) (result *BatchUpdateResult) {
+
+	result = new(BatchUpdateResult)
+	fail := func(status int, message string) *BatchUpdateResult {
+		result.Status, result.Error = status, message
+		return result
+	}
+	if update == nil {
+		return fail(http.StatusBadRequest, "Invalid Request")
+	}
+	if result.Token = update.Token; len(update.Token) == 0 {
+		return fail(http.StatusNotFound, "Token not found")
+	}
+	version := update.Version
+	if version < 0 {
+		return fail(http.StatusBadRequest, "Invalid Version")
+	} else if version == 0 {
+		version = time.Now().UTC().Unix()
+	}
+	if len(update.Data) > self.maxDataLen {
+		status, message := ErrToStatus(ErrDataTooLarge)
+		return fail(status, message)
+	}
+	if !self.allowAppServer(appServer) || !tenant.AllowUpdate() {
+		self.metrics.Increment("updates.appserver.ratelimited")
+		return fail(http.StatusTooManyRequests, "Too Many Requests")
+	}
+	pk, err := self.decodePK(requestID, update.Token)
+	if err == ErrExpiredToken {
+		return fail(http.StatusGone, "Expired Token")
+	}
+	if err != nil {
+		return fail(http.StatusNotFound, "Invalid Token")
+	}
+	pk, bridge := BridgeKeyToKey(pk)
+
+	if chid, ok := GroupKeyToID(pk); ok {
+		if !self.app.Server().RateLimiter().AllowUpdate("", remoteAddr) {
+			return fail(http.StatusTooManyRequests, "Too Many Requests")
+		}
+		reply, err := self.deliverShared(requestID, tenant, chid, version,
+			update.Data, PriorityNormal, trace, cancelSignal)
+		result.FanOut = reply
+		switch {
+		case reply == nil && err == ErrNonexistentChannel:
+			return fail(http.StatusNotFound, "Invalid Token")
+		case reply == nil:
+			status, _ := ErrToStatus(err)
+			return fail(status, "Could not update channel version")
+		case err != nil:
+			return fail(http.StatusNotFound, "Could not deliver update")
+		}
+		result.Status = http.StatusOK
+		return result
+	}
+
+	uaid, chid, ok := self.store.KeyToIDs(pk)
+	if !ok || len(chid) == 0 {
+		self.metrics.Increment("updates.appserver.invalid")
+		return fail(http.StatusNotFound, "Invalid Token")
+	}
+	if !self.app.Server().Tenants().Owns(tenant, uaid) {
+		tenant.Deny()
+		self.metrics.Increment("updates.appserver.invalid")
+		return fail(http.StatusNotFound, "Invalid Token")
+	}
+	if !self.app.Server().RateLimiter().AllowUpdate(uaid, remoteAddr) {
+		return fail(http.StatusTooManyRequests, "Too Many Requests")
+	}
+	self.metrics.Increment("updates.appserver.incoming")
+	stored, err := self.deliverUpdate(uaid, chid, pk, version, update.Data,
+		requestID, PriorityNormal, bridge, trace, cancelSignal)
+	if err != nil {
+		if !stored {
+			status, _ := ErrToStatus(err)
+			return fail(status, "Could not update channel version")
+		}
+		return fail(http.StatusNotFound, "Could not deliver update")
+	}
+	result.Status = http.StatusOK
+	return result
+}
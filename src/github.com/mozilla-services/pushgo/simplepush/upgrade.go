@@ -0,0 +1,276 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables set for a process started by Upgrade.
+const (
+	// InheritFDsEnv lists the inherited listening sockets, as "addr=fd"
+	// pairs separated by commas. addr is the configured listener address.
+	InheritFDsEnv = "PUSHGO_INHERIT_FDS"
+
+	// ReadyFDEnv is the descriptor the new process writes to once it is
+	// serving, so that the old process can begin draining.
+	ReadyFDEnv = "PUSHGO_READY_FD"
+)
+
+var (
+	ErrUpgradeExited  = errors.New("New process exited before it was ready")
+	ErrUpgradeTimeout = errors.New("Timed out waiting for the new process")
+)
+
+// listeners tracks the listening sockets opened by this process, keyed by
+// configured address, so that they can be passed to a new process.
+var listeners = struct {
+	sync.Mutex
+	active    map[string]net.Listener
+	inherited map[string]*os.File
+	loaded    bool
+}{active: make(map[string]net.Listener)}
+
+// trackedListener removes a listening socket from the registry when closed.
+type trackedListener struct {
+	net.Listener
+	addr string
+}
+
+func (l *trackedListener) Close() error {
+	listeners.Lock()
+	if listeners.active[l.addr] == l.Listener {
+		delete(listeners.active, l.addr)
+	}
+	listeners.Unlock()
+	return l.Listener.Close()
+}
+
+// trackListener registers a listening socket. Sockets bound to a random
+// port cannot be matched to a new process's config, and are not tracked.
+func trackListener(addr string, ln net.Listener) net.Listener {
+	if len(addr) == 0 || strings.HasSuffix(addr, ":0") {
+		return ln
+	}
+	listeners.Lock()
+	listeners.active[addr] = ln
+	listeners.Unlock()
+	return &trackedListener{ln, addr}
+}
+
+// inheritedListener returns the listening socket for addr passed by the
+// parent process or by systemd, or nil if there is none.
+func inheritedListener(addr string) (net.Listener, error) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if !listeners.loaded {
+		listeners.loaded = true
+		listeners.inherited = parseInheritedFDs(os.Getenv(InheritFDsEnv))
+		os.Unsetenv(InheritFDsEnv)
+		for addr, file := range systemdListenFDs() {
+			if _, ok := listeners.inherited[addr]; ok {
+				// A socket passed by Upgrade takes precedence.
+				file.Close()
+				continue
+			}
+			listeners.inherited[addr] = file
+		}
+	}
+	file, ok := listeners.inherited[addr]
+	if !ok {
+		return nil, nil
+	}
+	delete(listeners.inherited, addr)
+	defer file.Close()
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to inherit listener '%s': %s", addr, err)
+	}
+	return ln, nil
+}
+
+func parseInheritedFDs(spec string) map[string]*os.File {
+	files := make(map[string]*os.File)
+	for _, pair := range strings.Split(spec, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 1 {
+			continue
+		}
+		fd, err := strconv.Atoi(pair[i+1:])
+		if err != nil || fd < 3 {
+			continue
+		}
+		addr := pair[:i]
+		syscall.CloseOnExec(fd)
+		files[addr] = os.NewFile(uintptr(fd), addr)
+	}
+	return files
+}
+
+// Upgrade starts a new instance of the running binary, with the same
+// arguments, that inherits this process's listening sockets, and waits up
+// to timeout for it to start serving. The caller should then drain and
+// exit: both processes accept connections until the old one closes its
+// listeners. If the new process fails to start, it is killed, and this
+// process keeps serving.
+func Upgrade(timeout time.Duration) (*os.Process, error) {
+	// Resolve the binary by name, rather than by the running executable,
+	// which refers to the old binary once a new one is installed.
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	files, spec, err := listenerFiles()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(upgradeEnv(),
+		InheritFDsEnv+"="+spec,
+		ReadyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Reap the new process if it exits before this one.
+	go cmd.Wait()
+	ready := make(chan error, 1)
+	go func() {
+		// The pipe closes without data if the new process exits.
+		data, err := ioutil.ReadAll(readyReader)
+		if err == nil && len(data) == 0 {
+			err = ErrUpgradeExited
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = ErrUpgradeTimeout
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	keepUnixSockets()
+	return cmd.Process, nil
+}
+
+// NotifyReady tells the process that started this one via Upgrade that this
+// process is serving. It does nothing if this process was not upgraded.
+// Inherited sockets that no listener claimed, because their addresses were
+// removed from the config, are closed.
+func NotifyReady() error {
+	listeners.Lock()
+	for addr, file := range listeners.inherited {
+		file.Close()
+		delete(listeners.inherited, addr)
+	}
+	listeners.Unlock()
+	spec := os.Getenv(ReadyFDEnv)
+	if len(spec) == 0 {
+		return nil
+	}
+	os.Unsetenv(ReadyFDEnv)
+	fd, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %s", ReadyFDEnv, spec)
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	_, err = file.Write([]byte("ready\n"))
+	return err
+}
+
+// listenerFiles duplicates the tracked listening sockets for a new process.
+func listenerFiles() (files []*os.File, spec string, err error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	listeners.Lock()
+	defer listeners.Unlock()
+	pairs := make([]string, 0, len(listeners.active))
+	for addr, ln := range listeners.active {
+		f, ok := ln.(filer)
+		if !ok {
+			continue
+		}
+		file, err := f.File()
+		if err != nil {
+			return files, "", fmt.Errorf("Unable to pass listener '%s': %s", addr, err)
+		}
+		pairs = append(pairs, addr+"="+strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+	return files, strings.Join(pairs, ","), nil
+}
+
+// keepUnixSockets leaves Unix socket files in place when this process closes
+// its listeners, since a new process is serving them.
+func keepUnixSockets() {
+	listeners.Lock()
+	defer listeners.Unlock()
+	for _, ln := range listeners.active {
+		if unixLn, ok := ln.(*net.UnixListener); ok {
+			unixLn.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// upgradeEnv returns the environment of this process, without the
+// variables set by a previous upgrade.
+func upgradeEnv() []string {
+	env := os.Environ()
+	filtered := env[:0]
+	for _, pair := range env {
+		if strings.HasPrefix(pair, InheritFDsEnv+"=") ||
+			strings.HasPrefix(pair, ReadyFDEnv+"=") {
+			continue
+		}
+		filtered = append(filtered, pair)
+	}
+	return filtered
+}
+
+// WritePidFile writes the process ID to a file.
+func WritePidFile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// RemovePidFile removes the pidfile, unless another process, such as one
+// started by Upgrade, has since replaced it.
+func RemovePidFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if pid, _ := strconv.Atoi(strings.TrimSpace(string(data))); pid != os.Getpid() {
+		return nil
+	}
+	return os.Remove(path)
+}
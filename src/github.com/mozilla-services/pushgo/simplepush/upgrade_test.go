@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestInheritListener(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	addr := parent.Addr().String()
+	file, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error duplicating listener: %s", err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	parent.Close()
+	if err != nil {
+		t.Fatalf("Error duplicating listener: %s", err)
+	}
+
+	// Simulate the environment of a process started by Upgrade.
+	listeners.Lock()
+	listeners.loaded = true
+	listeners.inherited = parseInheritedFDs(fmt.Sprintf("%s=%d", addr, fd))
+	listeners.Unlock()
+
+	ln, err := listenSocket(addr, DefaultSocketMode)
+	if err != nil {
+		t.Fatalf("Error inheriting listener: %s", err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != addr {
+		t.Errorf("Wrong inherited address: got %s; want %s", ln.Addr(), addr)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to inherited listener: %s", err)
+	}
+	conn.Close()
+	if _, err = ln.Accept(); err != nil {
+		t.Errorf("Error accepting on inherited listener: %s", err)
+	}
+
+	// The inherited listener can be passed on to the next process.
+	files, spec, err := listenerFiles()
+	for _, file := range files {
+		file.Close()
+	}
+	if err != nil {
+		t.Fatalf("Error passing listeners: %s", err)
+	}
+	if !strings.Contains(spec, addr+"=") {
+		t.Errorf("Listener not passed: %s", spec)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-pid")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pushgo.pid")
+	if err = WritePidFile(path); err != nil {
+		t.Fatalf("Error writing pidfile: %s", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if pid := strings.TrimSpace(string(data)); pid != fmt.Sprint(os.Getpid()) {
+		t.Errorf("Wrong pid: got %s; want %d", pid, os.Getpid())
+	}
+
+	// Pidfiles replaced by an upgraded process are left in place.
+	ioutil.WriteFile(path, []byte("1\n"), 0644)
+	if err = RemovePidFile(path); err != nil {
+		t.Fatalf("Error removing pidfile: %s", err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("Replaced pidfile removed: %s", err)
+	}
+	WritePidFile(path)
+	RemovePidFile(path)
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Pidfile not removed: %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+// maxVapidExpiry is the maximum lifetime of a VAPID JWT, per the spec.
+const maxVapidExpiry = 24 * time.Hour
+
+// ValidateRequest is the request body for the subscription lint endpoint.
+// Only Endpoint is required.
+type ValidateRequest struct {
+	Endpoint  string `json:"endpoint"`
+	Vapid     string `json:"vapid,omitempty"`
+	PublicKey string `json:"publicKey,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+}
+
+// ValidationCheck is the outcome of a single lint check.
+type ValidationCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ValidationReport lists the checks performed on a ValidateRequest. Valid is
+// true if every check passed.
+type ValidationReport struct {
+	Valid  bool               `json:"valid"`
+	Checks []*ValidationCheck `json:"checks"`
+}
+
+func (r *ValidationReport) pass(name string) {
+	r.Checks = append(r.Checks, &ValidationCheck{Name: name, OK: true})
+}
+
+func (r *ValidationReport) fail(name string, format string, args ...interface{}) {
+	r.Valid = false
+	r.Checks = append(r.Checks, &ValidationCheck{
+		Name:  name,
+		Error: fmt.Sprintf(format, args...),
+	})
+}
+
+// Validator performs the checks that an update would be subject to, without
+// storing or delivering anything.
+type Validator struct {
+	app        *Application
+	store      Store
+	maxDataLen int
+}
+
+// Validate returns a report describing what would fail for the request.
+func (v *Validator) Validate(req *ValidateRequest) *ValidationReport {
+	report := &ValidationReport{Valid: true}
+	endpoint, token, ok := v.checkEndpoint(report, req.Endpoint)
+	if ok {
+		v.checkToken(report, token)
+	}
+	if len(req.Vapid) > 0 {
+		v.checkVapid(report, endpoint, req.Vapid, req.PublicKey)
+	}
+	if len(req.Payload) > 0 {
+		v.checkPayload(report, req.Payload)
+	}
+	return report
+}
+
+func (v *Validator) checkEndpoint(report *ValidationReport,
+	endpoint string) (u *url.URL, token string, ok bool) {
+
+	if len(endpoint) == 0 {
+		report.fail("endpoint", "Missing endpoint URL")
+		return nil, "", false
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || !u.IsAbs() {
+		report.fail("endpoint", "Malformed endpoint URL")
+		return nil, "", false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		report.fail("endpoint", "Unsupported endpoint scheme %q", u.Scheme)
+		return nil, "", false
+	}
+	i := strings.LastIndex(u.Path, "/update/")
+	if i < 0 || len(u.Path[i+len("/update/"):]) == 0 {
+		report.fail("endpoint", "Endpoint path does not contain a token")
+		return u, "", false
+	}
+	report.pass("endpoint")
+	return u, u.Path[i+len("/update/"):], true
+}
+
+func (v *Validator) checkToken(report *ValidationReport, token string) {
+	bpk, err := v.app.Tokens().Decode(token)
+	switch err {
+	case nil:
+	case ErrUnknownTokenID:
+		report.fail("token", "Token was minted under a revoked or unknown key")
+		return
+	case ErrExpiredToken:
+		report.fail("token", "Token has expired")
+		return
+	default:
+		report.fail("token", "Malformed or tampered token")
+		return
+	}
+	pk, _ := BridgeKeyToKey(string(bpk))
+	if chid, ok := GroupKeyToID(pk); ok {
+		if _, ok = v.store.(GroupStore); !ok || !id.Valid(chid) {
+			report.fail("token", "Token does not identify a shared channel")
+			return
+		}
+		report.pass("token")
+		return
+	}
+	if !validPK(pk) {
+		report.fail("token", "Token does not contain a valid primary key")
+		return
+	}
+	uaid, chid, ok := v.store.KeyToIDs(pk)
+	if !ok || len(uaid) == 0 || len(chid) == 0 {
+		report.fail("token", "Token does not identify a device and channel")
+		return
+	}
+	report.pass("token")
+}
+
+func (v *Validator) checkVapid(report *ValidationReport, endpoint *url.URL,
+	jwt, publicKey string) {
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		report.fail("vapid.format", "JWT must have 3 segments; got %d", len(parts))
+		return
+	}
+	header := new(struct {
+		Alg string `json:"alg"`
+	})
+	if err := decodeJWTSegment(parts[0], header); err != nil {
+		report.fail("vapid.format", "Malformed JWT header: %s", err)
+		return
+	}
+	claims := new(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	})
+	if err := decodeJWTSegment(parts[1], claims); err != nil {
+		report.fail("vapid.format", "Malformed JWT claims: %s", err)
+		return
+	}
+	if header.Alg != "ES256" {
+		report.fail("vapid.format", "Unsupported JWT algorithm %q; want ES256",
+			header.Alg)
+	} else {
+		report.pass("vapid.format")
+	}
+
+	if endpoint != nil {
+		origin := endpoint.Scheme + "://" + endpoint.Host
+		if claims.Aud != origin {
+			report.fail("vapid.aud", "Audience %q does not match endpoint origin %q",
+				claims.Aud, origin)
+		} else {
+			report.pass("vapid.aud")
+		}
+	}
+	now := time.Now()
+	expiry := time.Unix(claims.Exp, 0)
+	switch {
+	case claims.Exp == 0:
+		report.fail("vapid.exp", "Missing expiry claim")
+	case expiry.Before(now):
+		report.fail("vapid.exp", "JWT expired at %s", expiry.UTC().Format(time.RFC3339))
+	case expiry.Sub(now) > maxVapidExpiry:
+		report.fail("vapid.exp", "JWT expiry exceeds %s", maxVapidExpiry)
+	default:
+		report.pass("vapid.exp")
+	}
+	if !strings.HasPrefix(claims.Sub, "mailto:") &&
+		!strings.HasPrefix(claims.Sub, "https:") {
+		report.fail("vapid.sub", "Subject must be a mailto: or https: URL")
+	} else {
+		report.pass("vapid.sub")
+	}
+
+	if len(publicKey) == 0 {
+		return
+	}
+	if err := verifyES256(parts[0]+"."+parts[1], parts[2], publicKey); err != nil {
+		report.fail("vapid.key", "%s", err)
+		return
+	}
+	report.pass("vapid.key")
+}
+
+func (v *Validator) checkPayload(report *ValidationReport, payload string) {
+	data, err := decodeBase64URL(payload)
+	if err != nil {
+		report.fail("payload.encoding", "Payload is not valid base64url")
+		return
+	}
+	report.pass("payload.encoding")
+	if len(data) > v.maxDataLen {
+		report.fail("payload.size", "Payload is %d bytes; maximum is %d",
+			len(data), v.maxDataLen)
+		return
+	}
+	report.pass("payload.size")
+}
+
+// decodeBase64URL decodes base64url data with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := decodeBase64URL(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyES256 verifies a JWT signature against an uncompressed P-256 public
+// key.
+func verifyES256(signed, signature, publicKey string) error {
+	keyData, err := decodeBase64URL(publicKey)
+	if err != nil {
+		return fmt.Errorf("Public key is not valid base64url")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), keyData)
+	if x == nil {
+		return fmt.Errorf("Public key is not an uncompressed P-256 point")
+	}
+	sig, err := decodeBase64URL(signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("Malformed JWT signature")
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	digest := sha256.Sum256([]byte(signed))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return fmt.Errorf("JWT signature does not match public key")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, key *ecdsa.PrivateKey, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) +
+		"." + enc.EncodeToString([]byte(claims))
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Error signing JWT: %s", err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func validateTest(t *testing.T, handler *Handler, request *ValidateRequest) *ValidationReport {
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest("POST", "/v1/validate", strings.NewReader(string(body)))
+	resp := httptest.NewRecorder()
+	handler.ValidateHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: got %d; want 200", resp.Code)
+	}
+	report := new(ValidationReport)
+	if err := json.Unmarshal(resp.Body.Bytes(), report); err != nil {
+		t.Fatalf("Error decoding report: %s", err)
+	}
+	return report
+}
+
+func failedChecks(report *ValidationReport) (names []string) {
+	for _, check := range report.Checks {
+		if !check.OK {
+			names = append(names, check.Name)
+		}
+	}
+	return
+}
+
+func TestValidateHandler(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	publicKey := base64.RawURLEncoding.EncodeToString(
+		elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	claims := fmt.Sprintf(`{"aud":"https://push.example.com","exp":%d,"sub":"mailto:dev@example.com"}`,
+		time.Now().Add(1*time.Hour).Unix())
+	request := &ValidateRequest{
+		Endpoint:  "https://push.example.com/update/" + testPK,
+		Vapid:     signTestJWT(t, key, claims),
+		PublicKey: publicKey,
+		Payload:   base64.RawURLEncoding.EncodeToString([]byte("hello")),
+	}
+	if report := validateTest(t, handler, request); !report.Valid {
+		t.Errorf("Expected valid report; failed checks: %v", failedChecks(report))
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	request.Vapid = signTestJWT(t, otherKey, claims)
+	request.Payload = base64.RawURLEncoding.EncodeToString(make([]byte, 200))
+	request.Endpoint = "https://push.example.com/update/not%20a%20key"
+	report := validateTest(t, handler, request)
+	if report.Valid {
+		t.Fatalf("Expected invalid report")
+	}
+	failed := strings.Join(failedChecks(report), ",")
+	if failed != "token,vapid.key,payload.size" {
+		t.Errorf("Wrong failed checks: got %q", failed)
+	}
+}
@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// watch starts a watchdog for a potentially slow operation (a Flush, or a
+// command handled by the server) on the given connection. If the returned
+// function is not called before the watchdog timeout, the watchdog logs the
+// stalled call, removes the client, cancels the worker, and force-closes the
+// connection. A stuck store call or blocked socket write cannot then hold the
+// session open indefinitely.
+func (self *WorkerWS) watch(sock *PushWS, op string) (stop func()) {
+	if self.watchdogTimeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(self.watchdogTimeout, func() {
+		uaid := sock.UAID()
+		if self.logger.ShouldLog(ERROR) {
+			fields := LogFields{
+				"rid":      self.id,
+				"uaid":     uaid,
+				"op":       op,
+				"deadline": self.watchdogTimeout.String()}
+			if stacks := self.app.dumpStacks(self.watchdogTimeout); stacks != nil {
+				fields["stacks"] = string(stacks)
+			}
+			self.logger.Error("worker", "Stalled call; closing connection", fields)
+		}
+		self.metrics.Increment("worker.watchdog.stalled")
+		if client, ok := self.app.GetClient(uaid); ok && client.PushWS == sock {
+			self.app.RemoveClient(uaid)
+		}
+		self.cancel()
+		sock.Socket.Close()
+	})
+	return func() { timer.Stop() }
+}
+
+// handleCommand sends a command to the server under the watchdog.
+func (self *WorkerWS) handleCommand(cmd PushCommand, sock *PushWS) (int, *CommandArgs) {
+	defer self.watch(sock, cmdLabels[cmd.Command])()
+	return self.app.Server().HandleCommand(cmd, sock)
+}
+
+// dumpStacks returns the stacks of all goroutines, at most once per interval.
+// A hung store usually stalls many connections at once, and a single dump
+// shows all of them. Returns nil if the stacks were dumped recently.
+func (a *Application) dumpStacks(interval time.Duration) []byte {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&a.lastStackDump)
+	if now-last < int64(interval) ||
+		!atomic.CompareAndSwapInt64(&a.lastStackDump, last, now) {
+
+		return nil
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
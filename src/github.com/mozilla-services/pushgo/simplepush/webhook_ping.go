@@ -0,0 +1,370 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+// HeaderWebhookSignature carries the HMAC signature of a webhook wakeup
+// event, of the form "ts=...,sig=...".
+const HeaderWebhookSignature = "X-Pushgo-Webhook-Signature"
+
+func init() {
+	AvailablePings["webhook"] = func() HasConfigStruct { return NewWebhookPing() }
+}
+
+type WebhookPingConfig struct {
+	// Secret is the shared secret used to sign wakeup events. Receivers
+	// verify events with VerifyWebhookSignature.
+	Secret string `env:"secret"`
+
+	// Hosts lists the domains of valid callback URLs. Devices may only
+	// register HTTPS callbacks on these hosts or their subdomains.
+	Hosts []string `env:"hosts"`
+
+	// Timeout is the maximum time to wait for a callback response. Defaults
+	// to 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Retry configures retries for throttled and unavailable responses.
+	Retry retry.Config
+
+	// Simulate logs and counts wakes instead of sending them to callbacks, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// WebhookPingData is the "connect" data sent by devices managed by a
+// third-party system in the handshake. Device is an opaque identifier
+// echoed in each event.
+type WebhookPingData struct {
+	Callback string `json:"callback"`
+	Device   string `json:"device,omitempty"`
+}
+
+// WebhookEvent is the body of a wakeup event.
+type WebhookEvent struct {
+	Type      string `json:"type"`
+	DeviceID  string `json:"uaid"`
+	Device    string `json:"device,omitempty"`
+	Version   int64  `json:"version"`
+	Data      string `json:"data,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// WebhookPing wakes disconnected devices by posting a signed wakeup event
+// to the callback URL registered by the device, so that device-management
+// systems can wake the device through their own channel.
+type WebhookPing struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	store       Store
+	client      *http.Client
+	secret      []byte
+	hosts       []string
+	feedback    *PingFeedback
+	guard       *BridgeGuard
+	simulate    bool
+	rh          *retry.Helper
+	closeLock   sync.Mutex
+	closeSignal chan bool
+	isClosed    bool
+}
+
+func NewWebhookPing() *WebhookPing {
+	return &WebhookPing{closeSignal: make(chan bool)}
+}
+
+func (*WebhookPing) ConfigStruct() interface{} {
+	return &WebhookPingConfig{
+		Timeout: "10s",
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+		Guard: DefaultBridgeGuard(),
+	}
+}
+
+func (r *WebhookPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*WebhookPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("webhook", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "webhook", r.guard)
+	r.simulate = conf.Simulate
+
+	if len(conf.Secret) == 0 {
+		r.logger.Panic("propping", "Missing webhook signing secret", nil)
+		return ConfigurationErr
+	}
+	r.secret = []byte(conf.Secret)
+	r.hosts = make([]string, 0, len(conf.Hosts))
+	for _, host := range conf.Hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); len(host) > 0 {
+			r.hosts = append(r.hosts, host)
+		}
+	}
+	if len(r.hosts) == 0 {
+		r.logger.Panic("propping", "No webhook callback hosts configured", nil)
+		return ConfigurationErr
+	}
+
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse webhook timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	r.client = &http.Client{Timeout: timeout}
+
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+	return nil
+}
+
+// webhookMAC returns the HMAC of a wakeup event posted to path at ts.
+func webhookMAC(secret []byte, ts int64, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signedContent(ts, "POST", path, 0, body))
+	return mac.Sum(nil)
+}
+
+// VerifyWebhookSignature checks the signature header of a wakeup event
+// received at path. Receivers should also reject stale timestamps.
+func VerifyWebhookSignature(secret []byte, value, path string,
+	body []byte) (ts int64, err error) {
+
+	if len(value) == 0 {
+		return 0, ErrMissingSignature
+	}
+	var sig []byte
+	for _, param := range strings.Split(value, ",") {
+		pair := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(pair) < 2 {
+			return 0, ErrInvalidSignature
+		}
+		switch pair[0] {
+		case "ts":
+			if ts, err = strconv.ParseInt(pair[1], 10, 64); err != nil {
+				return 0, ErrInvalidSignature
+			}
+		case "sig":
+			if sig, err = base64.RawURLEncoding.DecodeString(pair[1]); err != nil {
+				return 0, ErrInvalidSignature
+			}
+		}
+	}
+	if ts == 0 || len(sig) == 0 {
+		return 0, ErrInvalidSignature
+	}
+	if !hmac.Equal(sig, webhookMAC(secret, ts, path, body)) {
+		return 0, ErrInvalidSignature
+	}
+	return ts, nil
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and webhooks are only used to wake disconnected devices.
+func (r *WebhookPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *WebhookPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's callback URL.
+func (r *WebhookPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(WebhookPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil ||
+		!AllowedHTTPSURL(ping.Callback, r.hosts) {
+		r.metrics.Increment("ping.webhook.rejected")
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store webhook callback",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// Send posts a wakeup event to the device's callback. It returns false
+// without an error if the device did not register a callback, or if the
+// callback replies with 410 Gone; such callbacks are removed from storage.
+func (r *WebhookPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch webhook callback",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(WebhookPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil ||
+		!AllowedHTTPSURL(ping.Callback, r.hosts) {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid webhook registration data",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	body, err := json.Marshal(&WebhookEvent{
+		Type:      "wakeup",
+		DeviceID:  uaid,
+		Device:    ping.Device,
+		Version:   vers,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return false, err
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	var gone bool
+	sendOnce := func() (err error) {
+		gone, err = r.send(ping.Callback, body)
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.webhook.retry", int64(retries))
+	if gone {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Removing unregistered webhook callback",
+				LogFields{"uaid": uaid})
+		}
+		r.metrics.Increment("ping.webhook.unregistered")
+		r.feedback.Invalid(uaid)
+		return false, nil
+	}
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send webhook wakeup",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.webhook.error")
+		r.feedback.Failed(uaid, err)
+		return false, err
+	}
+	r.metrics.Increment("ping.webhook.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// send posts a signed event to a callback, returning true if the callback
+// replied with 410 Gone. Throttled and unavailable responses are temporary
+// errors.
+func (r *WebhookPing) send(callback string, body []byte) (gone bool, err error) {
+	uri, err := url.Parse(callback)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookSignature, fmt.Sprintf("ts=%d,sig=%s", ts,
+		base64.RawURLEncoding.EncodeToString(webhookMAC(r.secret, ts,
+			uri.EscapedPath(), body))))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusGone:
+		return true, &PingerError{"Webhook callback gone", false}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if !r.retryAfter(resp.Header.Get("Retry-After")) {
+			return false, PingerClosedErr
+		}
+		return false, &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode), true}
+	}
+	return false, &PingerError{fmt.Sprintf(
+		"Unexpected status code: %d", resp.StatusCode), false}
+}
+
+func (r *WebhookPing) retryAfter(header string) (ok bool) {
+	d, ok := ParseRetryAfter(header)
+	if !ok {
+		return true
+	}
+	select {
+	case <-r.closeSignal:
+		return false
+	case <-time.After(d):
+	}
+	return true
+}
+
+func (r *WebhookPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *WebhookPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *WebhookPing) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	return nil
+}
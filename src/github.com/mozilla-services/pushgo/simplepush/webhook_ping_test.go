@@ -0,0 +1,118 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func Test_WebhookPingSend(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		events []*WebhookEvent
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if _, err := VerifyWebhookSignature([]byte("secret"),
+			req.Header.Get(HeaderWebhookSignature), req.URL.EscapedPath(), body); err != nil {
+			t.Errorf("Error verifying webhook signature: %s", err)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		event := new(WebhookEvent)
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Errorf("Error decoding webhook event: %s", err)
+		}
+		events = append(events, event)
+		switch req.URL.Path {
+		case "/flaky":
+			if len(events) == 1 {
+				resp.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/gone":
+			resp.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := NewWebhookPing()
+	conf := pinger.ConfigStruct().(*WebhookPingConfig)
+	conf.Secret = "secret"
+	conf.Hosts = []string{"127.0.0.1"}
+	conf.Retry.Delay = "1ms"
+	conf.Retry.MaxDelay = "1ms"
+	conf.Retry.MaxJitter = "0"
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing webhook pinger: %s", err)
+	}
+	defer pinger.Close()
+	pinger.client.Transport = srv.Client().Transport
+
+	if err := pinger.Register("uaid0", []byte(`{"callback":"https://example.com/hook"}`)); err != UnsupportedProtocolErr {
+		t.Errorf("Wrong error for disallowed callback: %v", err)
+	}
+	for uaid, path := range map[string]string{
+		"uaid1": "/flaky",
+		"uaid2": "/gone",
+	} {
+		pingData, _ := json.Marshal(&WebhookPingData{Callback: srv.URL + path, Device: uaid})
+		if err := pinger.Register(uaid, pingData); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	// Unavailable callbacks are retried.
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	lock.Lock()
+	if len(events) != 2 {
+		t.Errorf("Wrong event count: got %d; want 2", len(events))
+	} else if e := events[1]; e.DeviceID != "uaid1" || e.Device != "uaid1" ||
+		e.Version != 5 || e.Data != "hi" {
+		t.Errorf("Wrong webhook event: %+v", e)
+	}
+	lock.Unlock()
+
+	// Callbacks that reply with 410 are removed.
+	if ok, err := pinger.Send("uaid2", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for gone callback: ok=%v, err=%v", ok, err)
+	}
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Gone callback not removed: %s", data)
+	}
+}
+
+func Test_VerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"wakeup"}`)
+	sig := "ts=1,sig=" + base64.RawURLEncoding.EncodeToString(
+		webhookMAC([]byte("secret"), 1, "/hook", body))
+	if ts, err := VerifyWebhookSignature([]byte("secret"), sig, "/hook", body); ts != 1 || err != nil {
+		t.Errorf("Error verifying signature: ts=%d, err=%v", ts, err)
+	}
+	if _, err := VerifyWebhookSignature([]byte("other"), sig, "/hook", body); err != ErrInvalidSignature {
+		t.Errorf("Wrong error for wrong secret: %v", err)
+	}
+	if _, err := VerifyWebhookSignature([]byte("secret"), sig, "/other", body); err != ErrInvalidSignature {
+		t.Errorf("Wrong error for wrong path: %v", err)
+	}
+	if _, err := VerifyWebhookSignature([]byte("secret"), "", "/hook", body); err != ErrMissingSignature {
+		t.Errorf("Wrong error for missing signature: %v", err)
+	}
+}
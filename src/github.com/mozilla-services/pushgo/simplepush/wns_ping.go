@@ -0,0 +1,387 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+func init() {
+	AvailablePings["wns"] = func() HasConfigStruct { return NewWNSPing() }
+}
+
+type WNSPingConfig struct {
+	// ClientID and ClientSecret are the package SID and secret of the app,
+	// used to obtain access tokens.
+	ClientID     string `toml:"client_id" env:"client_id"`
+	ClientSecret string `toml:"client_secret" env:"client_secret"`
+
+	// TokenURL is the OAuth token endpoint.
+	TokenURL string `toml:"token_url" env:"token_url"`
+
+	// Hosts lists the domains of valid channel URIs. Devices may only
+	// register channels on these hosts or their subdomains. Defaults to
+	// "notify.windows.com".
+	Hosts []string `env:"hosts"`
+
+	// TTL is how long WNS holds wakes for offline devices. Defaults to 72
+	// hours.
+	TTL string `env:"ttl"`
+
+	// Timeout is the maximum time to wait for a WNS response. Defaults to
+	// 10 seconds.
+	Timeout string `env:"timeout"`
+
+	// Retry configures retries for throttled and unavailable responses.
+	Retry retry.Config
+
+	// Simulate logs and counts wakes instead of sending them to WNS, so
+	// that staging environments do not use real quota.
+	Simulate bool `env:"simulate"`
+
+	// Guard configures the outbound rate limit and circuit breaker.
+	Guard BridgeGuardConfig
+}
+
+// WNSPingData is the "connect" data sent by Windows devices in the
+// handshake.
+type WNSPingData struct {
+	Channel string `json:"channel"`
+}
+
+// wnsToken is an OAuth access token response.
+type wnsToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// wnsPayload is the body of a raw notification.
+type wnsPayload struct {
+	Version string `json:"version"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// WNSPing wakes disconnected Windows devices with raw notifications, posted
+// to the channel URI registered by the device.
+type WNSPing struct {
+	logger       *SimpleLogger
+	metrics      Statistician
+	store        Store
+	client       *http.Client
+	clientID     string
+	clientSecret string
+	tokenURL     string
+	hosts        []string
+	ttl          time.Duration
+	feedback     *PingFeedback
+	guard        *BridgeGuard
+	simulate     bool
+	rh           *retry.Helper
+	tokenLock    sync.Mutex
+	token        string
+	tokenExpires time.Time
+	closeLock    sync.Mutex
+	closeSignal  chan bool
+	isClosed     bool
+}
+
+func NewWNSPing() *WNSPing {
+	return &WNSPing{closeSignal: make(chan bool)}
+}
+
+func (*WNSPing) ConfigStruct() interface{} {
+	return &WNSPingConfig{
+		TokenURL: "https://login.live.com/accesstoken.srf",
+		Hosts:    []string{"notify.windows.com"},
+		TTL:      "72h",
+		Timeout:  "10s",
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+		Guard: DefaultBridgeGuard(),
+	}
+}
+
+func (r *WNSPing) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*WNSPingConfig)
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	if r.guard, err = conf.Guard.NewGuard("wns", r.metrics); err != nil {
+		r.logger.Panic("propping", "Error configuring bridge guard",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.feedback = NewPingFeedback(app, "wns", r.guard)
+	r.simulate = conf.Simulate
+
+	if len(conf.ClientID) == 0 || len(conf.ClientSecret) == 0 {
+		r.logger.Panic("propping", "WNS requires a client ID and secret", nil)
+		return ConfigurationErr
+	}
+	r.clientID, r.clientSecret = conf.ClientID, conf.ClientSecret
+	r.tokenURL = conf.TokenURL
+	r.hosts = make([]string, 0, len(conf.Hosts))
+	for _, host := range conf.Hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); len(host) > 0 {
+			r.hosts = append(r.hosts, host)
+		}
+	}
+	if len(r.hosts) == 0 {
+		r.logger.Panic("propping", "No WNS channel hosts configured", nil)
+		return ConfigurationErr
+	}
+
+	if r.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		r.logger.Panic("propping", "Could not parse TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse WNS timeout",
+			LogFields{"error": err.Error(), "timeout": conf.Timeout})
+		return err
+	}
+	r.client = &http.Client{Timeout: timeout}
+
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+	return nil
+}
+
+// accessToken returns the current access token, requesting a new one if
+// the current token has expired or was rejected.
+func (r *WNSPing) accessToken(refresh bool) (string, error) {
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if !refresh && len(r.token) > 0 && time.Now().Before(r.tokenExpires) {
+		return r.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {r.clientID},
+		"client_secret": {r.clientSecret},
+		"scope":         {"notify.windows.com"},
+	}
+	resp, err := r.client.PostForm(r.tokenURL, form)
+	if err != nil {
+		return "", &PingerError{"WNS token request failed: " + err.Error(), true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", &PingerError{fmt.Sprintf(
+			"WNS token request failed with status code: %d", resp.StatusCode),
+			resp.StatusCode >= 500}
+	}
+	token := new(wnsToken)
+	if err = json.NewDecoder(resp.Body).Decode(token); err != nil ||
+		len(token.AccessToken) == 0 {
+		return "", &PingerError{"Invalid WNS token response", false}
+	}
+	// Refresh tokens a minute early, so that in-flight wakes do not race
+	// expiry.
+	expiresIn := time.Duration(token.ExpiresIn)*time.Second - time.Minute
+	r.token = token.AccessToken
+	r.tokenExpires = time.Now().Add(expiresIn)
+	r.metrics.Increment("ping.wns.token.refresh")
+	return r.token, nil
+}
+
+// CanBypassWebsocket returns false: connected devices receive updates over
+// their WebSocket, and WNS is only used to wake disconnected devices.
+func (r *WNSPing) CanBypassWebsocket() bool {
+	return false
+}
+
+// OnlyOffline implements OfflinePinger.OnlyOffline().
+func (r *WNSPing) OnlyOffline() bool {
+	return true
+}
+
+// Register stores the device's WNS channel URI.
+func (r *WNSPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(WNSPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil ||
+		!AllowedHTTPSURL(ping.Channel, r.hosts) {
+
+		return UnsupportedProtocolErr
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store WNS channel",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return err
+	}
+	return nil
+}
+
+// Send wakes a device with a raw notification. It returns false without an
+// error if the device did not register a channel, or if WNS reports that
+// the channel has expired; expired channels are removed from storage.
+func (r *WNSPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch WNS channel",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	ping := new(WNSPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil ||
+		!AllowedHTTPSURL(ping.Channel, r.hosts) {
+
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid WNS registration data",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	body, err := json.Marshal(&wnsPayload{
+		Version: strconv.FormatInt(vers, 10),
+		Msg:     data,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err = r.guard.Allow(); err != nil {
+		return false, err
+	}
+	if r.simulate {
+		r.feedback.Simulated(uaid, vers)
+		return true, nil
+	}
+	var expired bool
+	sendOnce := func() (err error) {
+		expired, err = r.send(ping.Channel, body)
+		return err
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.wns.retry", int64(retries))
+	if expired {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Removing expired WNS channel",
+				LogFields{"uaid": uaid})
+		}
+		r.metrics.Increment("ping.wns.unregistered")
+		r.feedback.Invalid(uaid)
+		return false, nil
+	}
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send WNS notification",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.wns.error")
+		r.feedback.Failed(uaid, err)
+		return false, err
+	}
+	r.metrics.Increment("ping.wns.success")
+	r.feedback.Accepted(uaid)
+	return true, nil
+}
+
+// send posts a raw notification to a channel, returning true if the channel
+// has expired. Rejected access tokens, throttled, and unavailable responses
+// are temporary errors.
+func (r *WNSPing) send(channel string, body []byte) (expired bool, err error) {
+	token, err := r.accessToken(false)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", channel, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-WNS-Type", "wns/raw")
+	req.Header.Set("X-WNS-Cache-Policy", "cache")
+	req.Header.Set("X-WNS-TTL", strconv.FormatInt(int64(r.ttl/time.Second), 10))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		r.accessToken(true)
+		return false, &PingerError{"WNS access token rejected", true}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return true, &PingerError{fmt.Sprintf(
+			"WNS channel expired: %d", resp.StatusCode), false}
+	case resp.StatusCode == http.StatusNotAcceptable || resp.StatusCode >= 500:
+		if !r.retryAfter(resp.Header.Get("Retry-After")) {
+			return false, PingerClosedErr
+		}
+		return false, &PingerError{fmt.Sprintf(
+			"Retrying after receiving status code: %d", resp.StatusCode), true}
+	}
+	return false, &PingerError{fmt.Sprintf(
+		"WNS error: %d %s", resp.StatusCode,
+		resp.Header.Get("X-WNS-Error-Description")), false}
+}
+
+func (r *WNSPing) retryAfter(header string) (ok bool) {
+	d, ok := ParseRetryAfter(header)
+	if !ok {
+		return true
+	}
+	select {
+	case <-r.closeSignal:
+		return false
+	case <-time.After(d):
+	}
+	return true
+}
+
+func (r *WNSPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *WNSPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *WNSPing) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.isClosed {
+		return nil
+	}
+	r.isClosed = true
+	close(r.closeSignal)
+	return nil
+}
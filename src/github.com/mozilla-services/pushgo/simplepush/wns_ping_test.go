@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_WNSPingSend(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		tokens   int
+		requests []string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if req.URL.Path == "/token" {
+			if req.FormValue("client_secret") != "secret" {
+				resp.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokens++
+			json.NewEncoder(resp).Encode(&wnsToken{
+				AccessToken: "token" + strconv.Itoa(tokens),
+				TokenType:   "bearer",
+				ExpiresIn:   86400,
+			})
+			return
+		}
+		requests = append(requests, req.URL.Path)
+		if req.Header.Get("X-WNS-Type") != "wns/raw" {
+			t.Errorf("Wrong notification type: %q", req.Header.Get("X-WNS-Type"))
+		}
+		switch req.URL.Path {
+		case "/expired-token":
+			if req.Header.Get("Authorization") == "Bearer token1" {
+				resp.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/gone":
+			resp.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	_, app := newTestHandler(t)
+	store := &testPingStore{
+		NoStore: app.Store().(*NoStore),
+		pings:   make(map[string][]byte),
+	}
+	app.SetStore(store)
+	pinger := NewWNSPing()
+	conf := pinger.ConfigStruct().(*WNSPingConfig)
+	conf.ClientID = "ms-app://test"
+	conf.ClientSecret = "secret"
+	conf.TokenURL = srv.URL + "/token"
+	conf.Hosts = []string{"127.0.0.1"}
+	conf.Retry.Delay = "1ms"
+	conf.Retry.MaxDelay = "1ms"
+	conf.Retry.MaxJitter = "0"
+	if err := pinger.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing WNS pinger: %s", err)
+	}
+	defer pinger.Close()
+	pinger.client.Transport = srv.Client().Transport
+
+	for _, rejected := range []string{
+		`{"type":"wns"}`,
+		`{"channel":"https://example.com/ok"}`,
+		`{"channel":"http://127.0.0.1/ok"}`,
+	} {
+		if err := pinger.Register("uaid0", []byte(rejected)); err != UnsupportedProtocolErr {
+			t.Errorf("Wrong error for %s: %v", rejected, err)
+		}
+	}
+	for uaid, path := range map[string]string{
+		"uaid1": "/expired-token",
+		"uaid2": "/gone",
+	} {
+		pingData, _ := json.Marshal(&WNSPingData{Channel: srv.URL + path})
+		if err := pinger.Register(uaid, pingData); err != nil {
+			t.Fatalf("Error registering %s: %s", uaid, err)
+		}
+	}
+
+	// Rejected access tokens are refreshed and the notification is retried.
+	if ok, err := pinger.Send("uaid1", 5, "hi"); !ok || err != nil {
+		t.Fatalf("Error sending to uaid1: ok=%v, err=%v", ok, err)
+	}
+	lock.Lock()
+	if tokens != 2 || len(requests) != 2 {
+		t.Errorf("Wrong request counts: got %d tokens, %d notifications; want 2, 2",
+			tokens, len(requests))
+	}
+	lock.Unlock()
+
+	// Expired channels are removed.
+	if ok, err := pinger.Send("uaid2", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for expired channel: ok=%v, err=%v", ok, err)
+	}
+	if data, _ := store.FetchPing("uaid2"); data != nil {
+		t.Errorf("Expired channel not removed: %s", data)
+	}
+	if ok, err := pinger.Send("uaid3", 1, ""); ok || err != nil {
+		t.Errorf("Wrong result for device without channel: ok=%v, err=%v", ok, err)
+	}
+}
@@ -6,17 +6,18 @@ package simplepush
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"golang.org/x/net/websocket"
-
-	"github.com/mozilla-services/pushgo/id"
 )
 
 //    -- Workers
@@ -32,11 +33,31 @@ type WorkerWS struct {
 	logger       *SimpleLogger
 	id           string
 	state        WorkerState
-	stopped      bool
+	ctx          context.Context
+	cancel       context.CancelFunc
 	lastPing     time.Time
 	pingInt      time.Duration
 	metrics      Statistician
 	helloTimeout time.Duration
+	serverPing   time.Duration
+	maxMissed    int32
+	missedPongs  int32 // Accessed atomically.
+	lastRecv     int64 // Accessed atomically.
+	connectedAt  time.Time
+	resumed      bool
+	hasConnect   bool
+	challenge    *HelloChallenge // Outstanding handshake challenge.
+
+	watchdogTimeout time.Duration
+	writeTimeout    time.Duration
+	helloTimer      *time.Timer // Closes the connection if "hello" is late.
+	flushes         *flushQueue // nil if flushes are written synchronously.
+
+	inFlightLock sync.Mutex
+	inFlight     map[string]Update // Sent, but not yet acknowledged.
+	recovered    []Update          // Taken from a previous connection.
+	flushedOnce  bool              // Recovered updates were taken by a flush.
+	firstFlush   sync.Once
 }
 
 type WorkerState int
@@ -54,10 +75,60 @@ type HelloRequest struct {
 	DeviceID   string          `json:"uaid"`
 	ChannelIDs []interface{}   `json:"channelIDs"`
 	PingData   json.RawMessage `json:"connect"`
+
+	// Resume is the cursor from the last notification received by the client.
+	// If set, only records updated since the cursor are flushed.
+	Resume int64 `json:"resume"`
+
+	// Solution solves the challenge sent in reply to an earlier handshake.
+	Solution *ChallengeSolution `json:"pow"`
 }
 
 type RegisterRequest struct {
 	ChannelID string `json:"channelID"`
+
+	// Shared registers the device for a channel that may be shared with
+	// other devices. Updates sent to a shared channel's endpoint are
+	// delivered to every registered device.
+	Shared bool `json:"shared"`
+
+	// Token is the endpoint token of a shared channel, which a device must
+	// present to join a channel that already has members. The device that
+	// creates the channel receives the token as its endpoint.
+	Token string `json:"token,omitempty"`
+
+	// Bridge registers a bridge-preferred channel. Updates are sent through
+	// the device's proprietary pinger even while the device is connected,
+	// for apps that want the OS to display them. Shared channels cannot be
+	// bridge-preferred.
+	Bridge bool `json:"bridge"`
+}
+
+// HelloReply is the handshake response.
+type HelloReply struct {
+	Type     string `json:"messageType"`
+	Status   int    `json:"status"`
+	DeviceID string `json:"uaid"`
+}
+
+// RedirectReply is sent in response to a "hello" from a device that belongs
+// to another node.
+type RedirectReply struct {
+	Type     string `json:"messageType"`
+	Status   int    `json:"status"`
+	DeviceID string `json:"uaid"`
+	Redirect string `json:"redirect"`
+}
+
+// ErrorReply is sent in response to a failed request.
+type ErrorReply struct {
+	Type       string          `json:"messageType,omitempty"`
+	DeviceID   string          `json:"uaid,omitempty"`
+	ChannelID  string          `json:"channelID,omitempty"`
+	ChannelIDs json.RawMessage `json:"channelIDs,omitempty"`
+	Status     int             `json:"status"`
+	Error      string          `json:"error"`
+	RID        string          `json:"rid,omitempty"`
 }
 
 type RegisterReply struct {
@@ -78,10 +149,35 @@ type UnregisterReply struct {
 	ChannelID string `json:"channelID"`
 }
 
+// RegisterManyRequest registers or unregisters several channels at once.
+type RegisterManyRequest struct {
+	ChannelIDs []string `json:"channelIDs"`
+}
+
+// ChannelResult is the outcome of registering or unregistering a single
+// channel in a batch.
+type ChannelResult struct {
+	ChannelID string `json:"channelID"`
+	Status    int    `json:"status"`
+	Endpoint  string `json:"pushEndpoint,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type RegisterManyReply struct {
+	Type     string           `json:"messageType"`
+	DeviceID string           `json:"uaid"`
+	Status   int              `json:"status"`
+	Channels []*ChannelResult `json:"channels"`
+}
+
 type FlushReply struct {
 	Type    string   `json:"messageType"`
 	Updates []Update `json:"updates,omitempty"`
 	Expired []string `json:"expired,omitempty"`
+
+	// Cursor is the time, in seconds, at which the updates were collected.
+	// Clients may send it as the "resume" field of their next handshake.
+	Cursor int64 `json:"cursor,omitempty"`
 }
 
 type ACKRequest struct {
@@ -89,6 +185,35 @@ type ACKRequest struct {
 	Expired []string `json:"expired"`
 }
 
+// NACKRequest reports updates that the client could not process. Code is
+// an optional client-defined failure reason (e.g., a decryption error).
+type NACKRequest struct {
+	Updates []Update `json:"updates"`
+	Code    int      `json:"code"`
+}
+
+// ResetReply notifies the client that its device ID was discarded during the
+// handshake. The client should re-register the listed channels.
+type ResetReply struct {
+	Type       string   `json:"messageType"`
+	DeviceID   string   `json:"uaid"`
+	ChannelIDs []string `json:"channelIDs"`
+}
+
+// WhoamiReply describes the server's view of the session, for inclusion in
+// client bug reports.
+type WhoamiReply struct {
+	Type         string   `json:"messageType"`
+	Status       int      `json:"status"`
+	DeviceID     string   `json:"uaid"`
+	NodeID       string   `json:"nodeID"`
+	ConnectedAt  int64    `json:"connectedAt"`
+	Capabilities []string `json:"capabilities"`
+	Pending      int      `json:"pending"`
+	PingInterval int64    `json:"pingInterval"`
+	ServerPing   int64    `json:"serverPingInterval,omitempty"`
+}
+
 type PingReply struct {
 	Type   string `json:"messageType"`
 	Status int    `json:"status"`
@@ -101,171 +226,419 @@ type FlushData struct {
 	Data         string `json:"data"`
 }
 
+// NewWorker returns a worker for a new connection. The worker's context is
+// derived from the application's, so that it is cancelled on shutdown.
 func NewWorker(app *Application, id string) *WorkerWS {
-	return &WorkerWS{
+	ctx, cancel := context.WithCancel(app.Context())
+	worker := &WorkerWS{
 		app:          app,
 		logger:       app.Logger(),
 		metrics:      app.Metrics(),
 		id:           id,
 		state:        WorkerActive,
-		stopped:      false,
+		ctx:          ctx,
+		cancel:       cancel,
 		pingInt:      app.clientMinPing,
 		helloTimeout: app.clientHelloTimeout,
+		serverPing:   app.serverPing,
+		maxMissed:    int32(app.maxMissedPongs),
+
+		watchdogTimeout: app.watchdogTimeout,
+		writeTimeout:    app.writeTimeout,
+	}
+	if app.flushQueueDepth > 0 {
+		worker.flushes = newFlushQueue(app.flushQueueDepth)
 	}
+	return worker
 }
 
+// compactBuffers holds the buffers used to compact incoming messages, so
+// that idle connections do not each retain one.
+var compactBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
 func (self *WorkerWS) sniffer(sock *PushWS) {
 	// Sniff the websocket for incoming data.
 	// Reading from the websocket is a blocking operation, and we also
 	// need to write out when an even occurs. This isolates the incoming
 	// reads to a separate go process.
+	for self.ctx.Err() == nil {
+		raw, err := sock.Socket.ReadMessage()
+		if err != nil {
+			self.readError(err)
+			return
+		}
+		self.receive(sock, raw)
+	}
+}
+
+// readError stops the worker after a failed read. err is nil if the
+// connection was closed by the server.
+func (self *WorkerWS) readError(err error) {
+	self.cancel()
+	if err == ErrMessageTooLarge {
+		self.metrics.Increment("socket.message.tooLarge")
+	} else if err != nil && err != io.EOF && self.logger.ShouldLog(ERROR) {
+		self.logger.Error("worker", "Websocket Error",
+			LogFields{"rid": self.id, "error": ErrStr(err)})
+	}
+}
+
+// receive handles a message from the client. Errors that end the session
+// cancel the worker.
+func (self *WorkerWS) receive(sock *PushWS, raw []byte) {
 	logWarning := self.logger.ShouldLog(WARNING)
+	atomic.StoreInt64(&self.lastRecv, time.Now().UnixNano())
+	if len(raw) <= 0 {
+		return
+	}
 	var (
-		buf = new(bytes.Buffer)
+		msg []byte
+		err error
 	)
-
-	for {
+	if isPingBody(raw) {
+		// Fast case: empty object literal; no whitespace.
+		msg = raw
+	} else {
+		// Slower case: validate and remove insignificant whitespace from the
+		// incoming slice.
+		buf := compactBuffers.Get().(*bytes.Buffer)
+		defer compactBuffers.Put(buf)
 		buf.Reset()
-		var (
-			raw []byte
-			err error
-		)
-
-		// Were we told to shut down?
-		if self.stopped {
-			return
-		}
-		if err = websocket.Message.Receive(sock.Socket, &raw); err != nil {
-			self.stopped = true
-			if err != io.EOF && self.logger.ShouldLog(ERROR) {
-				self.logger.Error("worker", "Websocket Error",
-					LogFields{"rid": self.id, "error": ErrStr(err)})
-			}
-			continue
-		}
-		if len(raw) <= 0 {
-			continue
-		}
-		var msg []byte
-		if isPingBody(raw) {
-			// Fast case: empty object literal; no whitespace.
-			msg = raw
-		} else if err = json.Compact(buf, raw); err != nil {
-			// Slower case: validate and remove insignificant whitespace from the
-			// incoming slice.
+		if err = json.Compact(buf, raw); err != nil {
 			if logWarning {
 				if syntaxErr, ok := err.(*json.SyntaxError); ok {
 					self.logger.Warn("worker", "Malformed request payload", LogFields{
 						"rid":      self.id,
-						"expected": string(msg[:syntaxErr.Offset]),
+						"expected": string(raw[:syntaxErr.Offset]),
 						"error":    syntaxErr.Error()})
 				} else {
 					self.logger.Warn("worker", "Error validating request payload",
 						LogFields{"rid": self.id, "error": ErrStr(err)})
 				}
 			}
-			self.stopped = true
-			continue
-		} else {
-			msg = buf.Bytes()
+			self.app.Server().Abuse().Violation(ViolationMalformed,
+				sock.UAID(), sock.RemoteAddr())
+			self.cancel()
+			return
 		}
+		msg = buf.Bytes()
+	}
 
-		//ignore {} pings for logging purposes.
-		if len(msg) > 5 && self.logger.ShouldLog(DEBUG) {
-			self.logger.Debug("worker", "Socket receive",
-				LogFields{"rid": self.id, "raw": string(msg)})
-		}
-		header := new(RequestHeader)
-		if isPingBody(msg) {
-			header.Type = "ping"
-		} else if err = json.Unmarshal(msg, header); err != nil {
-			if logWarning {
-				if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
-					self.logger.Warn("worker", "Mismatched header field types", LogFields{
-						"rid":      self.id,
-						"expected": typeErr.Type.String(),
-						"actual":   typeErr.Value})
-				} else {
-					self.logger.Warn("worker", "Error parsing request payload",
-						LogFields{"rid": self.id, "error": ErrStr(err)})
-				}
+	//ignore {} pings for logging purposes.
+	if len(msg) > 5 && self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("worker", "Socket receive",
+			LogFields{"rid": self.id, "raw": string(msg)})
+	}
+	header := new(RequestHeader)
+	if isPingBody(msg) {
+		header.Type = "ping"
+	} else if err = json.Unmarshal(msg, header); err != nil {
+		if logWarning {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				self.logger.Warn("worker", "Mismatched header field types", LogFields{
+					"rid":      self.id,
+					"expected": typeErr.Type.String(),
+					"actual":   typeErr.Value})
+			} else {
+				self.logger.Warn("worker", "Error parsing request payload",
+					LogFields{"rid": self.id, "error": ErrStr(err)})
 			}
-			self.handleError(sock, msg, ErrUnknownCommand)
-			self.stopped = true
-			continue
 		}
-		switch strings.ToLower(header.Type) {
-		case "ping":
-			err = self.Ping(sock, header, msg)
-		case "hello":
-			err = self.Hello(sock, header, msg)
-		case "ack":
-			err = self.Ack(sock, header, msg)
-		case "register":
-			err = self.Register(sock, header, msg)
-		case "unregister":
-			err = self.Unregister(sock, header, msg)
-		case "purge":
-			err = self.Purge(sock, header, msg)
-		default:
-			if logWarning {
-				self.logger.Warn("worker", "Bad command",
-					LogFields{"rid": self.id, "cmd": header.Type})
-			}
-			err = ErrUnknownCommand
+		self.handleError(sock, msg, ErrUnknownCommand)
+		self.app.Server().Abuse().Violation(ViolationMalformed,
+			sock.UAID(), sock.RemoteAddr())
+		self.cancel()
+		return
+	}
+	startTime := time.Now()
+	command := strings.ToLower(header.Type)
+	// Replies to server-initiated pings are not rate limited.
+	isPong := command == "ping" && atomic.LoadInt32(&self.missedPongs) > 0
+	if !isPong && !self.app.Server().RateLimiter().AllowCommand(command,
+		sock.UAID(), sock.RemoteAddr()) {
+
+		// Unlike other errors, rate limiting doesn't close the
+		// connection, so that well-behaved clients can back off.
+		recordCommand(self.metrics, command, startTime, ErrTooManyRequests)
+		abuse := self.app.Server().Abuse()
+		abuse.Violation(ViolationRateLimited, sock.UAID(), sock.RemoteAddr())
+		if abuse.Banned(BanIP, sock.RemoteAddr()) || abuse.Banned(BanUAID, sock.UAID()) {
+			self.handleError(sock, msg, ErrBanned)
+			sock.Bye(CloseBanned)
+			self.cancel()
+			return
 		}
-		if err != nil {
-			if self.logger.ShouldLog(DEBUG) {
-				self.logger.Debug("worker", "Run returned error",
-					LogFields{"rid": self.id, "cmd": header.Type, "error": ErrStr(err)})
-			}
-			self.handleError(sock, msg, err)
-			self.stopped = true
-			continue
+		self.handleError(sock, msg, ErrTooManyRequests)
+		return
+	}
+	switch command {
+	case "ping":
+		err = self.Ping(sock, header, msg)
+	case "hello":
+		err = self.Hello(sock, header, msg)
+	case "ack":
+		err = self.Ack(sock, header, msg)
+	case "nack":
+		err = self.Nack(sock, header, msg)
+	case "register":
+		err = self.Register(sock, header, msg)
+	case "unregister":
+		err = self.Unregister(sock, header, msg)
+	case "registermany":
+		err = self.RegisterMany(sock, header, msg)
+	case "unregistermany":
+		err = self.UnregisterMany(sock, header, msg)
+	case "purge":
+		err = self.Purge(sock, header, msg)
+	case "whoami":
+		err = self.Whoami(sock, header, msg)
+	default:
+		if logWarning {
+			self.logger.Warn("worker", "Bad command",
+				LogFields{"rid": self.id, "cmd": header.Type})
+		}
+		command = "unknown"
+		err = ErrUnknownCommand
+		self.app.Server().Abuse().Violation(ViolationMalformed,
+			sock.UAID(), sock.RemoteAddr())
+	}
+	recordCommand(self.metrics, command, startTime, err)
+	if err != nil {
+		if self.logger.ShouldLog(DEBUG) {
+			self.logger.Debug("worker", "Run returned error",
+				LogFields{"rid": self.id, "cmd": header.Type, "error": ErrStr(err)})
+		}
+		self.handleError(sock, msg, err)
+		if code, ok := errToCloseCode[err]; ok {
+			sock.Bye(code)
 		}
+		self.cancel()
 	}
 }
 
+// recordCommand records the duration and outcome of a client command.
+// Failures are counted by error class, e.g.,
+// "client.command.register.error.invalid_params".
+func recordCommand(metrics Statistician, command string, startTime time.Time,
+	err error) {
+
+	prefix := "client.command." + command
+	metrics.Timer(prefix, time.Since(startTime))
+	if err != nil {
+		metrics.Increment(prefix + ".error." + ErrorClass(err))
+		return
+	}
+	metrics.Increment(prefix + ".ok")
+}
+
 // standardize the error reporting back to the client.
 func (self *WorkerWS) handleError(sock *PushWS, message []byte, err error) (ret error) {
-	reply := make(map[string]interface{})
-	if ret = json.Unmarshal(message, &reply); ret != nil {
+	reply, ret := errorReply(message, err)
+	if ret != nil {
 		return
 	}
-	reply["status"], reply["error"] = ErrToStatus(err)
-	return websocket.JSON.Send(sock.Socket, reply)
+	// Include the connection ID, which is attached to all log messages for
+	// this connection, so that users can quote it when reporting errors.
+	reply.RID = self.id
+	return self.send(sock, reply)
+}
+
+// Context returns the connection's context, which is cancelled when the
+// worker stops, after a fatal error, or when the application shuts down.
+// Work on behalf of the connection should not start once it is cancelled.
+func (self *WorkerWS) Context() context.Context {
+	return self.ctx
+}
+
+// storeCall makes a storage call on behalf of the connection. The store API
+// does not take a context, so the call runs in its own goroutine; if the
+// connection's context is cancelled first, storeCall returns the context's
+// error without waiting, and the call finishes in the background. Results
+// assigned by call must only be read if storeCall returns nil.
+func (self *WorkerWS) storeCall(call func() error) error {
+	if err := self.ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- call() }()
+	select {
+	case err := <-done:
+		return err
+	case <-self.ctx.Done():
+		return self.ctx.Err()
+	}
+}
+
+// send writes a message to the client. If the client does not read the
+// message within the write timeout (e.g., because its TCP receive window
+// stays closed), the client is evicted and the connection closed, so that a
+// stalled reader cannot block the worker indefinitely.
+func (self *WorkerWS) send(sock *PushWS, message interface{}) error {
+	return self.write(sock, func() error {
+		return sock.Socket.WriteJSON(message)
+	})
+}
+
+// sendMessage is like send, but writes an encoded message.
+func (self *WorkerWS) sendMessage(sock *PushWS, message []byte) error {
+	return self.write(sock, func() error {
+		return sock.Socket.WriteMessage(message)
+	})
 }
 
-// General workhorse loop for the websocket handler.
+// write calls write with the write timeout set, evicting the client if the
+// write times out.
+func (self *WorkerWS) write(sock *PushWS, write func() error) (err error) {
+	if err = self.ctx.Err(); err != nil {
+		return err
+	}
+	if err = sock.writeTimed(self.writeTimeout, write); err == nil {
+		return nil
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return err
+	}
+	uaid := sock.UAID()
+	if self.logger.ShouldLog(WARNING) {
+		self.logger.Warn("worker", "Write timed out; evicting slow client",
+			LogFields{"rid": self.id, "uaid": uaid,
+				"deadline": self.writeTimeout.String()})
+	}
+	self.metrics.Increment("worker.write.timeout")
+	if client, ok := self.app.GetClient(uaid); ok && client.PushWS == sock {
+		self.app.RemoveClient(uaid)
+	}
+	sock.Socket.Close()
+	return err
+}
+
+// errorReply echoes the message type and identifiers of the failed request,
+// along with the status code and message for the error. Fields of the wrong
+// type are omitted.
+func errorReply(message []byte, err error) (reply *ErrorReply, ret error) {
+	reply = new(ErrorReply)
+	if ret = json.Unmarshal(message, reply); ret != nil {
+		if typeErr, ok := ret.(*json.UnmarshalTypeError); !ok || len(typeErr.Field) == 0 {
+			return nil, ret
+		}
+	}
+	reply.Status, reply.Error = ErrToStatus(err)
+	return reply, nil
+}
+
+// helloReply returns the handshake response.
+func helloReply(messageType string, status int, uaid string) HelloReply {
+	return HelloReply{messageType, status, uaid}
+}
+
+func redirectReply(messageType string, uaid, redirect string) RedirectReply {
+	return RedirectReply{messageType, 302, uaid, redirect}
+}
+
+// General workhorse loop for the websocket handler. Run parks the calling
+// goroutine in a blocking read until the connection closes; see Serve.
 func (self *WorkerWS) Run(sock *PushWS) {
-	time.AfterFunc(self.helloTimeout,
+	if !self.start(sock) {
+		return
+	}
+	defer self.stop(sock)
+	defer self.recoverConn(sock)
+
+	// Close the socket to unblock the sniffer if the worker is stopped from
+	// another goroutine.
+	go func() {
+		<-self.ctx.Done()
+		sock.Socket.Close()
+	}()
+	self.sniffer(sock)
+}
+
+// Serve handles messages from sock until the connection closes, then calls
+// done. If the worker pool polls connections, and sock can be polled, Serve
+// returns immediately, and messages are handled by the pool's readers as
+// they arrive. Otherwise, Serve calls Run, and blocks.
+func (self *WorkerWS) Serve(sock *PushWS, done func()) {
+	poller := self.app.Server().Workers().poller
+	socket, ok := sock.Socket.(*PollSocket)
+	if poller == nil || !ok || !socket.Pollable() {
+		self.Run(sock)
+		done()
+		return
+	}
+	// No goroutine waits on the context, so stopping the worker closes the
+	// socket directly.
+	cancel := self.cancel
+	self.cancel = func() {
+		cancel()
+		socket.Close()
+	}
+	if !self.start(sock) {
+		done()
+		return
+	}
+	poller.Add(socket, func(raw []byte) bool {
+		defer self.recoverConn(sock)
+		self.receive(sock, raw)
+		return self.ctx.Err() == nil
+	}, func(err error) {
+		self.readError(err)
+		self.stop(sock)
+		done()
+	})
+}
+
+// start registers the worker with the pool, and starts the handshake timer.
+// Returns false if the connection was rejected over the memory budget.
+func (self *WorkerWS) start(sock *PushWS) bool {
+	pool := self.app.Server().Workers()
+	// Keep-alive checks start from the time of the connection.
+	atomic.StoreInt64(&self.lastRecv, time.Now().UnixNano())
+	if !pool.Add(self, sock) {
+		sock.ByeAfter(CloseTryAgainLater, pool.RetryAfter())
+		self.cancel()
+		return false
+	}
+	self.app.ConnectionOpened()
+	self.helloTimer = time.AfterFunc(self.helloTimeout,
 		func() {
 			if sock.UAID() == "" {
 				if self.logger.ShouldLog(DEBUG) {
 					self.logger.Debug("dash", "Worker Idle connection. Closing socket",
 						LogFields{"rid": self.id})
 				}
-				sock.Socket.Close()
+				sock.Bye(CloseHelloTimeout)
 			}
 		})
+	return true
+}
 
-	defer func(sock *PushWS) {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				self.logger.Error("worker", "Unhandled connection error", LogFields{
-					"rid":   self.id,
-					"error": ErrStr(err),
-					"stack": string(stack[:n])})
-			}
-			sock.Socket.Close()
+// recoverConn closes the socket after a panic in a command handler.
+func (self *WorkerWS) recoverConn(sock *PushWS) {
+	if r := recover(); r != nil {
+		if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
+			stack := make([]byte, 1<<16)
+			n := runtime.Stack(stack, false)
+			self.logger.Error("worker", "Unhandled connection error", LogFields{
+				"rid":   self.id,
+				"error": ErrStr(err),
+				"stack": string(stack[:n])})
 		}
-		return
-	}(sock)
+		self.cancel()
+		sock.Socket.Close()
+	}
+}
 
-	self.sniffer(sock)
+// stop releases the connection once the worker has stopped reading, and
+// stashes unacknowledged updates for the client's next connection.
+func (self *WorkerWS) stop(sock *PushWS) {
+	self.helloTimer.Stop()
+	self.cancel()
 	sock.Socket.Close()
+	if router := self.app.Router(); router != nil {
+		router.InFlight().Stash(sock.UAID(), self.TakeInFlight())
+	}
+	self.app.ConnectionClosed()
+	self.app.Server().Workers().Remove(self)
 
 	if self.logger.ShouldLog(INFO) {
 		self.logger.Info("dash", "Run has completed a shut-down",
@@ -277,6 +650,7 @@ func (self *WorkerWS) Run(sock *PushWS) {
 // may be pending for the connection)
 func (self *WorkerWS) Hello(sock *PushWS, header *RequestHeader, message []byte) (err error) {
 	logWarning := self.logger.ShouldLog(WARNING)
+	startTime := time.Now()
 	// register the UAID
 	defer func() {
 		if r := recover(); r != nil {
@@ -291,14 +665,35 @@ func (self *WorkerWS) Hello(sock *PushWS, header *RequestHeader, message []byte)
 	}()
 
 	request := new(HelloRequest)
-	if err = json.Unmarshal(message, request); err != nil {
+	if err = json.Unmarshal(message, request); err != nil || request.Resume < 0 {
 		return ErrInvalidParams
 	}
-	uaid, _, err := self.handshake(sock, request)
+	if maintenance := self.app.Server().Maintenance(); maintenance.Enabled() {
+		// Spread out reconnections once maintenance ends.
+		retryAfter := maintenance.RetryAfter()
+		self.metrics.Increment("client.maintenance")
+		err = self.send(sock, maintenanceReply(header.Type, retryAfter))
+		sock.ByeAfter(CloseMaintenance, retryAfter)
+		self.cancel()
+		return err
+	}
+	if challenged, err := self.challengeHello(sock, header, request); challenged || err != nil {
+		return err
+	}
+	uaid, canRedirect, err := self.handshake(sock, request)
 	if err != nil {
 		return err
 	}
+	if self.app.Server().Abuse().Banned(BanUAID, uaid) {
+		self.metrics.Increment("abuse.rejected.hello")
+		return ErrBanned
+	}
 	sock.SetUAID(uaid)
+	if uaid == request.DeviceID {
+		// Fetching updates from the previous node may be slow; don't hold up
+		// the handshake.
+		go self.recoverInFlight(sock, uaid)
+	}
 
 	// register any proprietary connection requirements
 	// alert the master of the new UAID.
@@ -306,26 +701,29 @@ func (self *WorkerWS) Hello(sock *PushWS, header *RequestHeader, message []byte)
 	// known args through to the server.
 	cmd := PushCommand{
 		Command: HELLO,
-		Arguments: JsMap{
-			"worker":  self,
-			"uaid":    uaid,
-			"chids":   request.ChannelIDs,
-			"connect": []byte(request.PingData),
+		Arguments: &CommandArgs{
+			Worker:      self,
+			UAID:        uaid,
+			ChannelIDs:  request.ChannelIDs,
+			Connect:     []byte(request.PingData),
+			CanRedirect: canRedirect,
 		},
 	}
 	// blocking call back to the boss.
-	status, _ := self.app.Server().HandleCommand(cmd, sock)
+	status, args := self.handleCommand(cmd, sock)
+	if status == 302 && len(args.Redirect) > 0 {
+		// The device belongs to another node; send it there.
+		err = self.send(sock, redirectReply(header.Type, uaid, args.Redirect))
+		sock.Bye(CloseRedirect)
+		self.cancel()
+		return err
+	}
 
 	if self.logger.ShouldLog(DEBUG) {
 		self.logger.Debug("worker", "sending response",
 			LogFields{"rid": self.id, "cmd": "hello", "uaid": uaid})
 	}
-	// websocket.JSON.Send(sock.Socket, JsMap{
-	// 	"messageType": header.Type,
-	// 	"status":      status,
-	// 	"uaid":        uaid})
-	_, err = fmt.Fprintf(sock.Socket, `{"messageType":"%s","status":%d,"uaid":"%s"}`,
-		header.Type, status, uaid)
+	err = self.send(sock, helloReply(header.Type, status, uaid))
 	if err != nil {
 		if logWarning {
 			self.logger.Warn("dash", "Error writing client handshake", LogFields{
@@ -333,19 +731,79 @@ func (self *WorkerWS) Hello(sock *PushWS, header *RequestHeader, message []byte)
 		}
 		return err
 	}
-	self.metrics.Increment("updates.client.hello")
+	self.metrics.Timer("client.hello", time.Since(startTime))
+	if len(request.DeviceID) > 0 && uaid != request.DeviceID {
+		if err = self.sendReset(sock, uaid, request.ChannelIDs); err != nil {
+			return err
+		}
+	}
 	if self.logger.ShouldLog(INFO) {
 		self.logger.Info("dash", "Client successfully connected",
 			LogFields{"rid": self.id})
 	}
 	self.state = WorkerActive
+	self.connectedAt = time.Now()
+	self.hasConnect = len(request.PingData) > 0
 	if err == nil {
-		// Get the lastAccessed time from wherever
-		return self.Flush(sock, 0, "", 0, "")
+		return self.Flush(sock, self.resumeCursor(request, uaid), "", 0, "")
 	}
 	return err
 }
 
+// challengeHello sends a proof-of-work challenge in reply to a handshake if
+// the node is under a handshake flood, unless the handshake solves an
+// outstanding challenge. Devices that accessed this node recently are not
+// challenged. The challenge is issued before any storage access, so that a
+// flood of handshakes with made-up device IDs cannot reach the store.
+func (self *WorkerWS) challengeHello(sock *PushWS, header *RequestHeader,
+	request *HelloRequest) (challenged bool, err error) {
+
+	challenger := self.app.Server().Challenger()
+	if !challenger.Observe() {
+		self.challenge = nil
+		return false, nil
+	}
+	if len(sock.UAID()) > 0 || (len(request.DeviceID) > 0 &&
+		self.app.Server().Access().Known(request.DeviceID)) {
+		return false, nil
+	}
+	if self.challenge != nil && challenger.Verify(self.challenge, request.Solution) {
+		self.challenge = nil
+		return false, nil
+	}
+	if self.challenge, err = challenger.New(); err != nil {
+		return true, err
+	}
+	if self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("worker", "Sending handshake challenge",
+			LogFields{"rid": self.id, "difficulty": strconv.Itoa(self.challenge.Difficulty)})
+	}
+	// The hello timeout still applies, so clients that do not solve the
+	// challenge are disconnected.
+	return true, self.send(sock, ChallengeReply{header.Type, 401, self.challenge})
+}
+
+// resumeCursor returns the time from which to flush pending records. Cursors
+// are ignored if the device ID changed, or if they lie in the future.
+func (self *WorkerWS) resumeCursor(request *HelloRequest, uaid string) int64 {
+	if request.Resume == 0 {
+		return 0
+	}
+	if uaid != request.DeviceID || request.Resume > time.Now().Unix() {
+		if self.logger.ShouldLog(DEBUG) {
+			self.logger.Debug("worker", "Ignoring resume cursor", LogFields{
+				"rid":    self.id,
+				"uaid":   uaid,
+				"resume": strconv.FormatInt(request.Resume, 10)})
+		}
+		self.metrics.Increment("updates.client.resume.ignored")
+		return 0
+	}
+	self.metrics.Increment("updates.client.resume")
+	self.resumed = true
+	return request.Resume
+}
+
 func (self *WorkerWS) handshake(sock *PushWS, request *HelloRequest) (
 	deviceID string, canRedirect bool, err error) {
 
@@ -389,12 +847,23 @@ func (self *WorkerWS) handshake(sock *PushWS, request *HelloRequest) (
 		}
 		goto forceReset
 	}
-	if !id.Valid(request.DeviceID) {
+	if err = self.app.Server().IDs().DeviceID(request.DeviceID); err != nil {
 		if logWarning {
-			self.logger.Warn("worker", "Invalid character in UAID",
-				LogFields{"rid": self.id})
+			self.logger.Warn("worker", "Invalid UAID",
+				LogFields{"rid": self.id, "error": err.Error()})
+		}
+		return "", false, err
+	}
+	if !self.app.Server().Tenants().Owns(sock.Tenant, request.DeviceID) {
+		// Devices of another tenant are issued an ID in this tenant's
+		// namespace, rather than reading or claiming the other's records.
+		if logWarning {
+			self.logger.Warn("worker", "UAID belongs to another tenant; resetting",
+				LogFields{"rid": self.id, "uaid": request.DeviceID,
+					"tenant": sock.Tenant.Name()})
 		}
-		return "", false, ErrInvalidID
+		sock.Tenant.Increment("client.reset")
+		goto forceReset
 	}
 	if !sock.Store.CanStore(len(request.ChannelIDs)) {
 		// are there a suspicious number of channels?
@@ -405,7 +874,8 @@ func (self *WorkerWS) handshake(sock *PushWS, request *HelloRequest) (
 					"uaid":     request.DeviceID,
 					"channels": strconv.Itoa(len(request.ChannelIDs))})
 		}
-		sock.Store.DropAll(request.DeviceID)
+		self.storeCall(func() error { return sock.Store.DropAll(request.DeviceID) })
+		self.app.Server().Access().Forget(request.DeviceID)
 		goto forceReset
 	}
 	client, clientConnected = self.app.GetClient(request.DeviceID)
@@ -414,9 +884,10 @@ func (self *WorkerWS) handshake(sock *PushWS, request *HelloRequest) (
 			self.logger.Info("worker", "UAID collision; disconnecting previous client",
 				LogFields{"rid": self.id, "uaid": request.DeviceID})
 		}
+		client.PushWS.Bye(CloseUAIDConflict)
 		self.app.Server().HandleCommand(PushCommand{DIE, nil}, client.PushWS)
 	}
-	if len(request.ChannelIDs) > 0 && !sock.Store.Exists(request.DeviceID) {
+	if len(request.ChannelIDs) > 0 && !self.knownDevice(sock, request.DeviceID) {
 		if logWarning {
 			self.logger.Warn("worker",
 				"Channel IDs specified in handshake for nonexistent UAID",
@@ -427,12 +898,58 @@ func (self *WorkerWS) handshake(sock *PushWS, request *HelloRequest) (
 	return request.DeviceID, true, nil
 
 forceReset:
-	if deviceID, err = id.Generate(); err != nil {
+	if len(request.DeviceID) > 0 {
+		self.app.Events().Publish(&Event{Type: EventUAIDReset,
+			UAID: request.DeviceID, RemoteAddr: sock.RemoteAddr()})
+	}
+	if deviceID, err = sock.Tenant.NewDeviceID(); err != nil {
 		return "", false, err
 	}
 	return deviceID, true, nil
 }
 
+// sendReset tells the client which channels were invalidated when its
+// device ID was reset, so that it can re-register them under the new ID.
+func (self *WorkerWS) sendReset(sock *PushWS, uaid string, channelIDs []interface{}) (err error) {
+	reply := ResetReply{"reset", uaid, make([]string, 0, len(channelIDs))}
+	for _, channelID := range channelIDs {
+		if s, ok := channelID.(string); ok {
+			reply.ChannelIDs = append(reply.ChannelIDs, s)
+		}
+	}
+	if self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("worker", "sending response", LogFields{
+			"rid":      self.id,
+			"cmd":      "reset",
+			"uaid":     uaid,
+			"channels": strconv.Itoa(len(reply.ChannelIDs))})
+	}
+	if err = self.send(sock, reply); err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("dash", "Error writing reset message", LogFields{
+				"rid": self.id, "error": err.Error()})
+		}
+		return err
+	}
+	self.metrics.Increment("updates.client.reset")
+	return nil
+}
+
+// knownDevice indicates whether the device has previously registered with
+// the server. Devices that accessed this node recently are assumed to exist,
+// avoiding a storage lookup for every reconnect.
+func (self *WorkerWS) knownDevice(sock *PushWS, uaid string) bool {
+	if self.app.Server().Access().Known(uaid) {
+		return true
+	}
+	var exists bool
+	err := self.storeCall(func() error {
+		exists = sock.Store.Exists(uaid)
+		return nil
+	})
+	return err == nil && exists
+}
+
 // Clear the data that the client stated it received, then re-flush any
 // records (including new data)
 func (self *WorkerWS) Ack(sock *PushWS, header *RequestHeader, message []byte) (err error) {
@@ -458,16 +975,30 @@ func (self *WorkerWS) Ack(sock *PushWS, header *RequestHeader, message []byte) (
 	if len(request.Updates) == 0 {
 		return ErrNoParams
 	}
-	self.metrics.Increment("updates.client.ack")
+	self.app.Server().Access().Touch(uaid)
 	for _, update := range request.Updates {
-		if err = sock.Store.Drop(uaid, update.ChannelID); err != nil {
+		update := update
+		self.acked(update.ChannelID, update.Version)
+		if err = self.storeCall(func() error {
+			return sock.Store.Drop(uaid, update.ChannelID)
+		}); err != nil {
 			goto logError
 		}
+		self.app.Events().Publish(&Event{Type: EventUpdateAcked, UAID: uaid,
+			ChannelID: update.ChannelID, Version: int64(update.Version)})
 	}
 	for _, channelID := range request.Expired {
-		if err = sock.Store.Drop(uaid, channelID); err != nil {
+		channelID := channelID
+		self.acked(channelID, 0)
+		if err = self.storeCall(func() error {
+			return sock.Store.Drop(uaid, channelID)
+		}); err != nil {
 			goto logError
 		}
+		if pk, ok := sock.Store.IDsToKey(uaid, channelID); ok {
+			self.app.Server().Receipts().Publish(pk,
+				Receipt{Type: ReceiptExpired})
+		}
 	}
 	if self.logger.ShouldLog(DEBUG) {
 		self.logger.Debug("worker", "sending response",
@@ -483,6 +1014,57 @@ logError:
 	return err
 }
 
+// Nack drops updates that the client reports as undeliverable, so that they
+// are not re-flushed on every reconnect, and notifies the server of the
+// failure.
+func (self *WorkerWS) Nack(sock *PushWS, header *RequestHeader, message []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
+				stack := make([]byte, 1<<16)
+				n := runtime.Stack(stack, false)
+				self.logger.Error("worker", "Unhandled error", LogFields{"rid": self.id,
+					"cmd": "nack", "error": ErrStr(err), "stack": string(stack[:n])})
+			}
+			err = ErrInvalidParams
+		}
+	}()
+	uaid := sock.UAID()
+	if uaid == "" {
+		return ErrInvalidCommand
+	}
+	request := new(NACKRequest)
+	if err = json.Unmarshal(message, request); err != nil {
+		return ErrInvalidParams
+	}
+	if len(request.Updates) == 0 {
+		return ErrNoParams
+	}
+	self.app.Server().Access().Touch(uaid)
+	for _, update := range request.Updates {
+		update := update
+		self.acked(update.ChannelID, update.Version)
+		if err = self.storeCall(func() error {
+			return sock.Store.Drop(uaid, update.ChannelID)
+		}); err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("worker", "sending response",
+					LogFields{"rid": self.id, "cmd": "nack", "error": ErrStr(err)})
+			}
+			return err
+		}
+	}
+	cmd := PushCommand{
+		Command: NACK,
+		Arguments: &CommandArgs{
+			Updates: request.Updates,
+			Code:    request.Code,
+		},
+	}
+	self.handleCommand(cmd, sock)
+	return nil
+}
+
 // Register a new ChannelID. Optionally, encrypt the endpoint.
 func (self *WorkerWS) Register(sock *PushWS, header *RequestHeader, message []byte) (err error) {
 	defer func() {
@@ -502,31 +1084,73 @@ func (self *WorkerWS) Register(sock *PushWS, header *RequestHeader, message []by
 		return ErrInvalidCommand
 	}
 	request := new(RegisterRequest)
-	if err = json.Unmarshal(message, request); err != nil || !id.Valid(request.ChannelID) {
+	if err = json.Unmarshal(message, request); err != nil {
 		return ErrInvalidParams
 	}
-	if err = sock.Store.Register(uaid, request.ChannelID, 0); err != nil {
+	if err = self.app.Server().IDs().ChannelID(request.ChannelID); err != nil {
+		return err
+	}
+	groups, canShare := sock.Store.(GroupStore)
+	if request.Shared && (!canShare || request.Bridge) {
+		return ErrInvalidParams
+	}
+	evict, err := self.checkChannelLimit(sock, uaid, []string{request.ChannelID})
+	if err != nil {
+		return err
+	}
+	if request.Shared {
+		// Join before registering, so that denied devices are not left with
+		// a registration for the channel. Members left without one are
+		// pruned when the next update is fanned out.
+		join := self.canJoin(request.ChannelID, request.Token)
+		if err = groups.AddMember(request.ChannelID, uaid, join); err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("worker", "Register failed, error updating shared channel",
+					LogFields{"rid": self.id, "cmd": "register", "error": ErrStr(err)})
+			}
+			return err
+		}
+	}
+	startTime := time.Now()
+	err = self.storeCall(func() error {
+		return sock.Store.Register(uaid, request.ChannelID, 0)
+	})
+	elapsed := time.Since(startTime)
+	self.metrics.Timer("store.register", elapsed)
+	self.app.Server().SlowLog().Storage("register", self.id, uaid, sock.Store, elapsed)
+	if err != nil {
 		if self.logger.ShouldLog(WARNING) {
 			self.logger.Warn("worker", "Register failed, error updating backing store",
 				LogFields{"rid": self.id, "cmd": "register", "error": ErrStr(err)})
 		}
 		return err
 	}
+	self.evictChannels(sock, uaid, evict)
+	if request.Shared {
+		self.metrics.Increment("updates.client.register.shared")
+	}
+	if request.Bridge {
+		self.metrics.Increment("updates.client.register.bridge")
+	}
 	// have the server generate the callback URL.
 	cmd := PushCommand{
-		Command:   REGIS,
-		Arguments: JsMap{"channelID": request.ChannelID},
+		Command: REGIS,
+		Arguments: &CommandArgs{
+			ChannelID: request.ChannelID,
+			Shared:    request.Shared,
+			Bridge:    request.Bridge,
+		},
 	}
-	status, args := self.app.Server().HandleCommand(cmd, sock)
+	status, args := self.handleCommand(cmd, sock)
 	if self.logger.ShouldLog(DEBUG) {
 		self.logger.Debug("worker", "Server returned", LogFields{
 			"rid":  self.id,
 			"cmd":  "register",
 			"code": strconv.FormatInt(int64(status), 10),
-			"chid": IStr(args["channelID"]),
-			"uaid": IStr(args["uaid"])})
+			"chid": args.ChannelID,
+			"uaid": uaid})
 	}
-	endpoint, _ := args["push.endpoint"].(string)
+	endpoint := args.Endpoint
 	// return the info back to the socket
 	statusCode := 200
 	if self.logger.ShouldLog(DEBUG) {
@@ -538,11 +1162,26 @@ func (self *WorkerWS) Register(sock *PushWS, header *RequestHeader, message []by
 			"channelID":    request.ChannelID,
 			"pushEndpoint": endpoint})
 	}
-	websocket.JSON.Send(sock.Socket, RegisterReply{header.Type, uaid, statusCode, request.ChannelID, endpoint})
-	self.metrics.Increment("updates.client.register")
+	self.send(sock, RegisterReply{header.Type, uaid, statusCode, request.ChannelID, endpoint})
+	self.metrics.Increment("client.channels.registered")
+	self.app.Events().Publish(&Event{Type: EventChannelRegistered, UAID: uaid,
+		ChannelID: request.ChannelID, RemoteAddr: sock.RemoteAddr()})
 	return err
 }
 
+// canJoin indicates whether token is the endpoint token of the shared
+// channel, which entitles a device to join it. Tokens that are not sealed
+// are primary keys in the clear, which anyone can forge, so they never
+// entitle a device to join.
+func (self *WorkerWS) canJoin(chid, token string) bool {
+	tokens := self.app.Tokens()
+	if len(token) == 0 || !tokens.Sealed() {
+		return false
+	}
+	pk, err := tokens.Decode(token)
+	return err == nil && string(pk) == GroupKey(chid)
+}
+
 // Unregister a ChannelID.
 func (self *WorkerWS) Unregister(sock *PushWS, header *RequestHeader, message []byte) (err error) {
 	logWarning := self.logger.ShouldLog(WARNING)
@@ -576,8 +1215,16 @@ func (self *WorkerWS) Unregister(sock *PushWS, header *RequestHeader, message []
 		}
 		return ErrNoParams
 	}
+	if groups, ok := sock.Store.(GroupStore); ok {
+		if err = groups.RemoveMember(request.ChannelID, uaid); err != nil && logWarning {
+			self.logger.Warn("worker", "Unregister failed, error updating shared channel",
+				LogFields{"rid": self.id, "error": ErrStr(err)})
+		}
+	}
 	// Always return success for an UNREG.
-	if err = sock.Store.Unregister(uaid, request.ChannelID); err != nil {
+	if err = self.storeCall(func() error {
+		return sock.Store.Unregister(uaid, request.ChannelID)
+	}); err != nil {
 		if logWarning {
 			self.logger.Warn("worker", "Unregister failed, error updating backing store",
 				LogFields{"rid": self.id, "error": ErrStr(err)})
@@ -586,15 +1233,359 @@ func (self *WorkerWS) Unregister(sock *PushWS, header *RequestHeader, message []
 		self.logger.Debug("worker", "sending response",
 			LogFields{"rid": self.id, "cmd": "unregister"})
 	}
-	websocket.JSON.Send(sock.Socket, UnregisterReply{header.Type, 200, request.ChannelID})
-	self.metrics.Increment("updates.client.unregister")
+	self.send(sock, UnregisterReply{header.Type, 200, request.ChannelID})
+	self.metrics.Increment("client.channels.unregistered")
+	self.app.Events().Publish(&Event{Type: EventChannelUnregistered, UAID: uaid,
+		ChannelID: request.ChannelID, RemoteAddr: sock.RemoteAddr()})
 	return nil
 }
 
-// Dump any records associated with the UAID.
+// parseRegisterMany validates a batch registration request. The request is
+// rejected if any channel ID is invalid.
+func (self *WorkerWS) parseRegisterMany(sock *PushWS, message []byte) (
+	uaid string, chids []string, err error) {
+
+	if uaid = sock.UAID(); uaid == "" {
+		return "", nil, ErrInvalidCommand
+	}
+	request := new(RegisterManyRequest)
+	if err = json.Unmarshal(message, request); err != nil {
+		return "", nil, ErrInvalidParams
+	}
+	if len(request.ChannelIDs) == 0 {
+		return "", nil, ErrNoParams
+	}
+	ids := self.app.Server().IDs()
+	for _, chid := range request.ChannelIDs {
+		if err = ids.ChannelID(chid); err != nil {
+			return "", nil, err
+		}
+	}
+	return uaid, request.ChannelIDs, nil
+}
+
+// checkChannelLimit checks new registrations against the storage adapter's
+// channel limit. If the device would exceed the limit, it returns the least
+// recently updated channels to evict, or ErrChannelLimit if eviction is
+// disabled. Registrations are not limited if the store cannot list channels.
+func (self *WorkerWS) checkChannelLimit(sock *PushWS, uaid string,
+	chids []string) (evict []string, err error) {
+
+	lister, ok := sock.Store.(ChannelLister)
+	if !ok {
+		// Without a channel list, only the new channels can be counted.
+		if !sock.Store.CanStore(len(chids)) {
+			return nil, ErrTooManyChannels
+		}
+		return nil, nil
+	}
+	// Check the channel ID list first, so that registrations well under the
+	// limit don't fetch every channel record.
+	var ids []string
+	if err = self.storeCall(func() (err error) {
+		ids, err = lister.ChannelIDs(uaid)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	added := make(map[string]bool, len(chids))
+	for _, chid := range chids {
+		added[chid] = true
+	}
+	total := len(ids)
+	for chid := range added {
+		if !containsString(ids, chid) {
+			total++
+		}
+	}
+	if sock.Store.CanStore(total) {
+		return nil, nil
+	}
+	// The list may include unregistered channels; count the live records,
+	// and find eviction candidates.
+	var channels []RegisteredChannel
+	if err = self.storeCall(func() (err error) {
+		channels, err = lister.Channels(uaid)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	// Channels that are registered again count against the limit once, and
+	// are never evicted.
+	candidates := make([]RegisteredChannel, 0, len(channels))
+	for _, channel := range channels {
+		if added[channel.ChannelID] {
+			delete(added, channel.ChannelID)
+			continue
+		}
+		candidates = append(candidates, channel)
+	}
+	total = len(channels) + len(added)
+	if sock.Store.CanStore(total) {
+		return nil, nil
+	}
+	if self.app.Server().EvictChannels() {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].LastTouched.Before(candidates[j].LastTouched)
+		})
+		for _, channel := range candidates {
+			evict = append(evict, channel.ChannelID)
+			if sock.Store.CanStore(total - len(evict)) {
+				return evict, nil
+			}
+		}
+	}
+	if self.logger.ShouldLog(WARNING) {
+		self.logger.Warn("worker", "Channel limit reached", LogFields{
+			"rid":      self.id,
+			"uaid":     uaid,
+			"channels": strconv.Itoa(len(channels)),
+			"adding":   strconv.Itoa(len(added))})
+	}
+	self.metrics.Increment("client.channels.limit")
+	return nil, ErrChannelLimit
+}
+
+// evictChannels unregisters channels evicted to make room for new
+// registrations.
+func (self *WorkerWS) evictChannels(sock *PushWS, uaid string, chids []string) {
+	remoteAddr := sock.RemoteAddr()
+	for _, chid := range chids {
+		chid := chid
+		if err := self.storeCall(func() error {
+			return sock.Store.Unregister(uaid, chid)
+		}); err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("worker", "Could not evict channel", LogFields{
+					"rid": self.id, "channelID": chid, "error": ErrStr(err)})
+			}
+			continue
+		}
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("worker", "Evicted least recently updated channel",
+				LogFields{"rid": self.id, "uaid": uaid, "channelID": chid})
+		}
+		self.metrics.Increment("client.channels.evicted")
+		self.app.Events().Publish(&Event{Type: EventChannelUnregistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: remoteAddr})
+	}
+}
+
+// RegisterMany registers a list of channel IDs. If the store supports
+// batches, either all channels are registered or the command fails;
+// otherwise, each channel is registered separately, and the reply includes
+// the status of each.
+func (self *WorkerWS) RegisterMany(sock *PushWS, header *RequestHeader, message []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
+				stack := make([]byte, 1<<16)
+				n := runtime.Stack(stack, false)
+				self.logger.Error("worker", "Unhandled error", LogFields{"rid": self.id,
+					"cmd": "registerMany", "error": ErrStr(err), "stack": string(stack[:n])})
+			}
+			err = ErrInvalidParams
+		}
+	}()
+	uaid, chids, err := self.parseRegisterMany(sock, message)
+	if err != nil {
+		return err
+	}
+	evict, err := self.checkChannelLimit(sock, uaid, chids)
+	if err != nil {
+		return err
+	}
+	results := make([]*ChannelResult, len(chids))
+	remoteAddr := sock.RemoteAddr()
+	batch, isBatch := sock.Store.(BatchStore)
+	if isBatch {
+		if err = self.storeCall(func() error {
+			return batch.RegisterMany(uaid, chids, 0)
+		}); err != nil {
+			if self.logger.ShouldLog(WARNING) {
+				self.logger.Warn("worker", "RegisterMany failed, error updating backing store",
+					LogFields{"rid": self.id, "cmd": "registerMany", "error": ErrStr(err)})
+			}
+			return err
+		}
+	}
+	for i, chid := range chids {
+		result := &ChannelResult{ChannelID: chid, Status: 200}
+		results[i] = result
+		chid := chid
+		if !isBatch {
+			if err := self.storeCall(func() error {
+				return sock.Store.Register(uaid, chid, 0)
+			}); err != nil {
+				result.Status, result.Error = ErrToStatus(err)
+				// Keep the newest channels that the failed registration
+				// would have displaced.
+				if len(evict) > 0 {
+					evict = evict[:len(evict)-1]
+				}
+				continue
+			}
+		}
+		cmd := PushCommand{
+			Command:   REGIS,
+			Arguments: &CommandArgs{ChannelID: chid},
+		}
+		status, args := self.handleCommand(cmd, sock)
+		if status != 200 {
+			result.Status, result.Error = ErrToStatus(ErrServerError)
+			continue
+		}
+		result.Endpoint = args.Endpoint
+		self.metrics.Increment("client.channels.registered")
+		self.app.Events().Publish(&Event{Type: EventChannelRegistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: remoteAddr})
+	}
+	self.evictChannels(sock, uaid, evict)
+	if self.logger.ShouldLog(DEBUG) {
+		self.logger.Debug("worker", "sending response", LogFields{
+			"rid":      self.id,
+			"cmd":      "registerMany",
+			"uaid":     uaid,
+			"channels": strconv.Itoa(len(chids))})
+	}
+	return self.send(sock, RegisterManyReply{header.Type, uaid, 200, results})
+}
+
+// UnregisterMany unregisters a list of channel IDs. Like Unregister, each
+// channel is reported as removed even if the store could not be updated.
+func (self *WorkerWS) UnregisterMany(sock *PushWS, header *RequestHeader, message []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
+				stack := make([]byte, 1<<16)
+				n := runtime.Stack(stack, false)
+				self.logger.Error("worker", "Unhandled error", LogFields{"rid": self.id,
+					"cmd": "unregisterMany", "error": ErrStr(err), "stack": string(stack[:n])})
+			}
+			err = ErrInvalidParams
+		}
+	}()
+	uaid, chids, err := self.parseRegisterMany(sock, message)
+	if err != nil {
+		return err
+	}
+	logWarning := self.logger.ShouldLog(WARNING)
+	batch, isBatch := sock.Store.(BatchStore)
+	if isBatch {
+		err = self.storeCall(func() error {
+			return batch.UnregisterMany(uaid, chids)
+		})
+		if err != nil && logWarning {
+			self.logger.Warn("worker", "UnregisterMany failed, error updating backing store",
+				LogFields{"rid": self.id, "error": ErrStr(err)})
+		}
+	}
+	// Fall back to unregistering channels individually if the batch failed.
+	if !isBatch || err != nil {
+		for _, chid := range chids {
+			chid := chid
+			if err := self.storeCall(func() error {
+				return sock.Store.Unregister(uaid, chid)
+			}); err != nil && logWarning {
+				self.logger.Warn("worker", "Unregister failed, error updating backing store",
+					LogFields{"rid": self.id, "channelID": chid, "error": ErrStr(err)})
+			}
+		}
+	}
+	results := make([]*ChannelResult, len(chids))
+	remoteAddr := sock.RemoteAddr()
+	for i, chid := range chids {
+		results[i] = &ChannelResult{ChannelID: chid, Status: 200}
+		self.app.Events().Publish(&Event{Type: EventChannelUnregistered, UAID: uaid,
+			ChannelID: chid, RemoteAddr: remoteAddr})
+	}
+	self.metrics.IncrementBy("client.channels.unregistered", int64(len(chids)))
+	return self.send(sock, RegisterManyReply{header.Type, uaid, 200, results})
+}
+
+// Dump any records associated with the UAID: all stored updates since
+// lastAccessed if channel is empty, or the given update. With a flush queue,
+// the flush is queued and written by another goroutine; errors are logged
+// instead of returned. Delivery events for direct updates are published
+// once the update is written.
 func (self *WorkerWS) Flush(sock *PushWS, lastAccessed int64, channel string, version int64, data string) (err error) {
+	if self.flushes == nil {
+		var updates []Update
+		if len(channel) > 0 {
+			updates = []Update{Update{channel, uint64(version), data}}
+		}
+		return self.flush(sock, len(channel) == 0, lastAccessed, updates)
+	}
+	drain, dropped := self.flushes.Push(lastAccessed, channel, version, data)
+	if dropped {
+		self.metrics.Increment("client.flush.dropped")
+	}
+	if drain {
+		go self.drainFlushes(sock)
+	}
+	return nil
+}
+
+// drainFlushes writes queued flushes until the queue is empty. If a flush
+// panics, the connection is closed, and queued direct updates are sent
+// through the proprietary pinger instead, as with synchronous flushes (see
+// Serv.RequestFlush).
+func (self *WorkerWS) drainFlushes(sock *PushWS) {
+	var direct []Update
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ := r.(error); err != nil && self.logger.ShouldLog(ERROR) {
+				stack := make([]byte, 1<<16)
+				n := runtime.Stack(stack, false)
+				self.logger.Error("worker", "Unhandled flush error", LogFields{
+					"rid":   self.id,
+					"error": ErrStr(err),
+					"stack": string(stack[:n])})
+			}
+			self.cancel()
+			sock.Socket.Close()
+			for ok := true; ok; _, _, direct, ok = self.flushes.Take() {
+				self.wakeDevice(sock.UAID(), direct)
+			}
+		}
+	}()
+	for {
+		var (
+			full  bool
+			since int64
+			ok    bool
+		)
+		if full, since, direct, ok = self.flushes.Take(); !ok {
+			return
+		}
+		err := self.flush(sock, full, since, direct)
+		if err != nil && err != self.ctx.Err() && self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("worker", "Error writing queued flush",
+				LogFields{"rid": self.id, "uaid": sock.UAID(), "error": err.Error()})
+		}
+	}
+}
+
+// wakeDevice sends updates that could not be written to the client through
+// the proprietary pinger, if any.
+func (self *WorkerWS) wakeDevice(uaid string, updates []Update) {
+	pinger := self.app.PropPinger()
+	if len(uaid) == 0 || pinger == nil {
+		return
+	}
+	for _, update := range updates {
+		SendPing(pinger, uaid, update.ChannelID, int64(update.Version), update.Data)
+	}
+}
+
+// flush sends updates to the client. If full is set, all stored updates
+// since lastAccessed are fetched, and sent along with the given updates.
+func (self *WorkerWS) flush(sock *PushWS, full bool, lastAccessed int64,
+	direct []Update) (err error) {
+
 	// flush pending data back to Client
 	timer := time.Now()
+	defer self.watch(sock, "Flush")()
 	logWarning := self.logger.ShouldLog(WARNING)
 	messageType := "notification"
 	uaid := sock.UAID()
@@ -607,6 +1598,13 @@ func (self *WorkerWS) Flush(sock *PushWS, lastAccessed int64, channel string, ve
 					"uaid": uaid})
 		}
 		self.metrics.Timer("client.flush", now.Sub(timer))
+		self.app.Server().SlowLog().Flush("socket", self.id, uaid, sock.Store, now.Sub(timer))
+		if len(uaid) > 0 {
+			// Time from connecting to receiving pending updates.
+			self.firstFlush.Do(func() {
+				self.metrics.Timer("client.first_flush", now.Sub(sock.Born))
+			})
+		}
 	}(timer, sock)
 	if uaid == "" {
 		if logWarning {
@@ -615,39 +1613,60 @@ func (self *WorkerWS) Flush(sock *PushWS, lastAccessed int64, channel string, ve
 		}
 		// Have the server clean up records associated with this UAID.
 		// (Probably "none", but still good for housekeeping)
-		self.stopped = true
+		self.cancel()
 		return nil
 	}
+	// Skip the storage call if the connection is closing. Updates remain
+	// stored for the next connection.
+	if err = self.ctx.Err(); err != nil {
+		return err
+	}
 	// Fetch the pending updates from #storage
 	var (
 		updates []Update
 		reply   *FlushReply
 	)
 	mod := false
-	// if we have a channel, don't flush. we can get them later in the ACK
-	if len(channel) == 0 {
+	cursor := time.Now().Unix()
+	// Direct updates are sent without fetching; stored updates are fetched
+	// later, on the next full flush (e.g., after an ACK).
+	if full {
 		var expired []string
-		if updates, expired, err = sock.Store.FetchAll(uaid, time.Unix(lastAccessed, 0)); err != nil {
+		startTime := time.Now()
+		err = self.storeCall(func() (err error) {
+			updates, expired, err = sock.Store.FetchAll(uaid, time.Unix(lastAccessed, 0))
+			return err
+		})
+		elapsed := time.Since(startTime)
+		self.metrics.Timer("store.fetch", elapsed)
+		self.app.Server().SlowLog().Storage("fetch", self.id, uaid, sock.Store, elapsed)
+		if err != nil {
 			if logWarning {
 				self.logger.Warn("worker", "Failed to flush Update to client.",
 					LogFields{"rid": self.id, "uaid": uaid, "error": err.Error()})
 			}
 			return err
 		}
+		updates = MergeUpdates(updates, self.takeRecovered())
+		updates = MergeUpdates(updates, direct)
 		if len(updates) > 0 || len(expired) > 0 {
-			reply = &FlushReply{messageType, updates, expired}
+			reply = &FlushReply{messageType, updates, expired, cursor}
 		}
-	} else {
+	} else if len(direct) > 0 {
 		// hand craft a notification update to the client.
-		// TODO: allow bulk updates.
-		updates = []Update{Update{channel, uint64(version), data}}
-		reply = &FlushReply{messageType, updates, nil}
+		updates = direct
+		reply = &FlushReply{messageType, updates, nil, cursor}
 	}
 	if reply == nil {
 		return nil
 	}
+	if !self.app.Server().Features().Enabled(FeatureData, uaid) {
+		for i := range reply.Updates {
+			reply.Updates[i].Data = ""
+		}
+	}
 	var logStrings []string
-	if len(channel) > 0 {
+	if !full {
 		logStrings := make([]string, len(updates))
 		prefix := ">>"
 		if !mod {
@@ -664,29 +1683,236 @@ func (self *WorkerWS) Flush(sock *PushWS, lastAccessed int64, channel string, ve
 			"rid":     self.id,
 			"updates": fmt.Sprintf("[%s]", strings.Join(logStrings, ", "))})
 	}
-	websocket.JSON.Send(sock.Socket, reply)
+	// Record the updates before writing them, so that an acknowledgement
+	// cannot arrive before they are recorded.
+	self.sent(reply.Updates)
+	if err = self.send(sock, reply); err != nil {
+		return err
+	}
+	for _, update := range direct {
+		self.app.Events().Publish(&Event{
+			Type:      EventUpdateDelivered,
+			UAID:      uaid,
+			ChannelID: update.ChannelID,
+			Version:   int64(update.Version)})
+	}
 	return nil
 }
 
+// sent records updates delivered to the client, so that they can be handed
+// off if the client disconnects before acknowledging them.
+func (self *WorkerWS) sent(updates []Update) {
+	if len(updates) == 0 {
+		return
+	}
+	if router := self.app.Router(); router == nil || !router.InFlight().Enabled() {
+		return
+	}
+	self.inFlightLock.Lock()
+	if self.inFlight == nil {
+		self.inFlight = make(map[string]Update)
+	}
+	for _, update := range updates {
+		self.inFlight[update.ChannelID] = update
+	}
+	self.inFlightLock.Unlock()
+}
+
+// acked removes an update acknowledged by the client, unless a newer version
+// has since been sent. A version of 0 removes any version.
+func (self *WorkerWS) acked(channelID string, version uint64) {
+	self.inFlightLock.Lock()
+	if update, ok := self.inFlight[channelID]; ok &&
+		(version == 0 || update.Version <= version) {
+		delete(self.inFlight, channelID)
+	}
+	self.inFlightLock.Unlock()
+}
+
+// TakeInFlight removes and returns the updates that the client has not
+// acknowledged.
+func (self *WorkerWS) TakeInFlight() (updates []Update) {
+	self.inFlightLock.Lock()
+	for _, update := range self.inFlight {
+		updates = append(updates, update)
+	}
+	self.inFlight = nil
+	self.inFlightLock.Unlock()
+	return MergeUpdates(nil, updates)
+}
+
+// recoverInFlight takes the updates that a reconnecting device did not
+// acknowledge on its previous connection, from this node or the node that
+// held the connection.
+func (self *WorkerWS) recoverInFlight(sock *PushWS, uaid string) {
+	router := self.app.Router()
+	if router == nil || !router.InFlight().Enabled() {
+		return
+	}
+	self.restoreInFlight(sock, uaid,
+		router.InFlight().Recover(uaid, router.Routes().Lookup(uaid)))
+}
+
+// restoreInFlight merges recovered updates into the first full flush or, if
+// that flush has already started, sends them directly, skipping channels
+// that were since sent a newer version. If the connection closes first, the
+// updates are stashed for the next one.
+func (self *WorkerWS) restoreInFlight(sock *PushWS, uaid string, updates []Update) {
+	if len(updates) == 0 {
+		return
+	}
+	router := self.app.Router()
+	if self.ctx.Err() != nil {
+		if router != nil {
+			router.InFlight().Stash(uaid, updates)
+		}
+		return
+	}
+	if self.logger.ShouldLog(INFO) {
+		self.logger.Info("worker", "Recovered in-flight updates", LogFields{
+			"rid": self.id, "uaid": uaid, "updates": strconv.Itoa(len(updates))})
+	}
+	self.metrics.IncrementBy("updates.client.recovered", int64(len(updates)))
+	self.inFlightLock.Lock()
+	if !self.flushedOnce {
+		self.recovered = MergeUpdates(self.recovered, updates)
+		self.inFlightLock.Unlock()
+		return
+	}
+	late := updates[:0]
+	for _, update := range updates {
+		if sent, ok := self.inFlight[update.ChannelID]; !ok || sent.Version < update.Version {
+			late = append(late, update)
+		}
+	}
+	self.inFlightLock.Unlock()
+	for _, update := range late {
+		if err := self.Flush(sock, 0, update.ChannelID, int64(update.Version),
+			update.Data); err != nil {
+			break
+		}
+	}
+}
+
+// takeRecovered returns the updates recovered from the previous connection.
+// Updates recovered later are sent directly.
+func (self *WorkerWS) takeRecovered() (updates []Update) {
+	self.inFlightLock.Lock()
+	updates, self.recovered = self.recovered, nil
+	self.flushedOnce = true
+	self.inFlightLock.Unlock()
+	return updates
+}
+
+// keepAlive sends a ping to the client if the connection has been idle for
+// the server ping interval, and closes the connection if the client misses
+// too many consecutive pings. Called by the worker pool once per interval;
+// returns false once the connection should no longer be checked.
+func (self *WorkerWS) keepAlive(sock *PushWS, now time.Time) bool {
+	if self.ctx.Err() != nil {
+		return false
+	}
+	lastRecv := time.Unix(0, atomic.LoadInt64(&self.lastRecv))
+	if now.Sub(lastRecv) < self.serverPing {
+		// The client is active; forget any missed pings.
+		atomic.StoreInt32(&self.missedPongs, 0)
+		return true
+	}
+	if atomic.LoadInt32(&self.missedPongs) >= self.maxMissed {
+		if self.logger.ShouldLog(INFO) {
+			self.logger.Info("worker", "Client missed pings; closing socket",
+				LogFields{"rid": self.id, "uaid": sock.UAID()})
+		}
+		self.metrics.Increment("updates.server.pong_timeout")
+		self.cancel()
+		sock.Bye(CloseMissedPongs)
+		return false
+	}
+	atomic.AddInt32(&self.missedPongs, 1)
+	// The write deadline keeps a stalled client from holding up the pool.
+	if err := self.sendMessage(sock, []byte("{}")); err != nil {
+		if self.logger.ShouldLog(DEBUG) {
+			self.logger.Debug("worker", "Error sending server ping",
+				LogFields{"rid": self.id, "error": err.Error()})
+		}
+		self.cancel()
+		return false
+	}
+	self.metrics.Increment("updates.server.ping")
+	return true
+}
+
 func (self *WorkerWS) Ping(sock *PushWS, header *RequestHeader, _ []byte) (err error) {
+	if atomic.SwapInt32(&self.missedPongs, 0) > 0 {
+		// Reply to a server-initiated ping. Not subject to rate limiting.
+		self.app.Server().Access().Touch(sock.UAID())
+		self.metrics.Increment("updates.client.pong")
+		return nil
+	}
 	now := time.Now()
 	if self.pingInt > 0 && !self.lastPing.IsZero() && now.Sub(self.lastPing) < self.pingInt {
 		if self.logger.ShouldLog(WARNING) {
 			self.logger.Warn("dash", "Client sending too many pings",
 				LogFields{"rid": self.id, "source": sock.Origin()})
 		}
-		self.stopped = true
-		self.metrics.Increment("updates.client.too_many_pings")
+		self.app.Server().Abuse().Violation(ViolationPings,
+			sock.UAID(), sock.RemoteAddr())
+		self.cancel()
 		return ErrTooManyPings
 	}
 	self.lastPing = now
+	self.app.Server().Access().Touch(sock.UAID())
 	if self.app.pushLongPongs {
-		websocket.JSON.Send(sock.Socket, PingReply{header.Type, 200})
-	} else {
-		websocket.Message.Send(sock.Socket, "{}")
+		return self.send(sock, PingReply{header.Type, 200})
 	}
-	self.metrics.Increment("updates.client.ping")
-	return nil
+	return self.sendMessage(sock, []byte("{}"))
+}
+
+// Whoami returns the server's view of the session.
+func (self *WorkerWS) Whoami(sock *PushWS, header *RequestHeader, _ []byte) (err error) {
+	uaid := sock.UAID()
+	if uaid == "" {
+		return ErrInvalidCommand
+	}
+	capabilities := []string{"nack", "registerMany"}
+	if self.app.Server().Features().Enabled(FeatureData, uaid) {
+		capabilities = append(capabilities, "data")
+	}
+	if self.resumed {
+		capabilities = append(capabilities, "resume")
+	}
+	if self.hasConnect {
+		capabilities = append(capabilities, "connect")
+	}
+	if self.app.pushLongPongs {
+		capabilities = append(capabilities, "longPongs")
+	}
+	if self.serverPing > 0 {
+		capabilities = append(capabilities, "serverPing")
+	}
+	var updates []Update
+	if err = self.storeCall(func() (err error) {
+		updates, _, err = sock.Store.FetchAll(uaid, time.Unix(0, 0))
+		return err
+	}); err != nil {
+		if self.logger.ShouldLog(WARNING) {
+			self.logger.Warn("worker", "Could not count pending updates",
+				LogFields{"rid": self.id, "uaid": uaid, "error": ErrStr(err)})
+		}
+		return err
+	}
+	reply := WhoamiReply{
+		Type:         header.Type,
+		Status:       200,
+		DeviceID:     uaid,
+		NodeID:       self.app.Router().URL(),
+		ConnectedAt:  self.connectedAt.Unix(),
+		Capabilities: capabilities,
+		Pending:      len(updates),
+		PingInterval: int64(self.pingInt / time.Second),
+		ServerPing:   int64(self.serverPing / time.Second),
+	}
+	return self.send(sock, reply)
 }
 
 // TESTING func, purge associated records for this UAID
@@ -694,11 +1920,10 @@ func (self *WorkerWS) Purge(sock *PushWS, _ *RequestHeader, _ []byte) (err error
 	/*
 	   // If needed...
 	   sock.Scmd <- PushCommand{Command: PURGE,
-	       Arguments:JsMap{"uaid": sock.UAID()}}
+	       Arguments: &CommandArgs{UAID: sock.UAID()}}
 	   result := <-sock.Scmd
 	*/
-	websocket.Message.Send(sock.Socket, "{}")
-	return nil
+	return self.sendMessage(sock, []byte("{}"))
 }
 
 func isPingBody(raw []byte) bool {
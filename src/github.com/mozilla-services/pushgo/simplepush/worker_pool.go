@@ -0,0 +1,343 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/heap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type WorkerPoolConfig struct {
+	// Size is the number of goroutines that send server pings and evict
+	// clients that miss them, shared by all connections. Defaults to 64.
+	Size int `env:"size"`
+
+	// MemoryBudget is the approximate memory, in bytes, available to client
+	// connections. Connections over the budget are closed with a "try again
+	// later" status. Defaults to 0 (unlimited).
+	MemoryBudget int64 `toml:"memory_budget" env:"memory_budget"`
+
+	// ConnectionMemory is the estimated memory used by an idle connection,
+	// in bytes. Defaults to 8192.
+	ConnectionMemory int64 `toml:"connection_memory" env:"connection_memory"`
+
+	// RetryAfter is the interval that connections rejected over the budget
+	// should wait before reconnecting. Defaults to 30 seconds.
+	RetryAfter string `toml:"retry_after" env:"retry_after"`
+
+	// Poll reads from client connections once data arrives, with a shared
+	// set of reader goroutines, instead of parking a goroutine per
+	// connection in a blocking read. Requires Linux; TLS connections are
+	// still read with blocking reads. Defaults to false.
+	Poll bool `env:"poll"`
+
+	// Readers is the number of goroutines that read and handle client
+	// messages if Poll is set, and so bounds the number of commands handled
+	// at once. Replies are written with the worker write timeout, so a
+	// client that stops reading is evicted instead of holding a reader.
+	// Defaults to 256.
+	Readers int `env:"readers"`
+}
+
+type poolEntry struct {
+	worker *WorkerWS
+	sock   *PushWS
+	due    time.Time
+	index  int // Position in the ping queue; -1 if not queued.
+}
+
+// pingQueue is a min-heap of connections ordered by their next keep-alive
+// check.
+type pingQueue []*poolEntry
+
+func (q pingQueue) Len() int           { return len(q) }
+func (q pingQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q pingQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *pingQueue) Push(x interface{}) {
+	entry := x.(*poolEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *pingQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// WorkerPool tracks connected workers, and services their keep-alive checks
+// with a fixed set of goroutines, instead of a ticker goroutine per
+// connection. Unless polling is enabled, each connection still parks one
+// goroutine in a blocking read, but nothing else; buffers are pooled while
+// the connection is idle. With polling, idle connections hold no goroutine.
+// The pool also enforces the memory budget for client connections, and
+// closes all connections when the application context is cancelled.
+type WorkerPool struct {
+	logger      *SimpleLogger
+	poller      *netPoller // nil unless polling is enabled.
+	metrics     Statistician
+	maxConns    int // 0 if unlimited.
+	retryAfter  time.Duration
+	lock        sync.Mutex
+	entries     map[*WorkerWS]*poolEntry
+	queue       pingQueue
+	due         chan *poolEntry
+	wake        chan bool
+	closeSignal chan bool
+	closeOnce   sync.Once
+}
+
+func NewWorkerPool() *WorkerPool {
+	return &WorkerPool{
+		entries:     make(map[*WorkerWS]*poolEntry),
+		wake:        make(chan bool, 1),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (*WorkerPool) ConfigStruct() interface{} {
+	return &WorkerPoolConfig{
+		Size:             64,
+		ConnectionMemory: 8192,
+		RetryAfter:       "30s",
+		Readers:          256,
+	}
+}
+
+func (p *WorkerPool) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*WorkerPoolConfig)
+	p.logger = app.Logger()
+	p.metrics = app.Metrics()
+	if conf.Size < 1 || conf.ConnectionMemory < 1 || conf.MemoryBudget < 0 ||
+		conf.Poll && conf.Readers < 1 {
+
+		p.logger.Panic("workers", "Invalid worker pool settings", LogFields{
+			"size":             strconv.Itoa(conf.Size),
+			"connectionMemory": strconv.FormatInt(conf.ConnectionMemory, 10),
+			"memoryBudget":     strconv.FormatInt(conf.MemoryBudget, 10),
+			"readers":          strconv.Itoa(conf.Readers)})
+		return ConfigurationErr
+	}
+	if p.retryAfter, err = time.ParseDuration(conf.RetryAfter); err != nil {
+		p.logger.Panic("workers", "Could not parse retry interval",
+			LogFields{"error": err.Error(), "retryAfter": conf.RetryAfter})
+		return err
+	}
+	if conf.MemoryBudget > 0 {
+		if p.maxConns = int(conf.MemoryBudget / conf.ConnectionMemory); p.maxConns < 1 {
+			p.maxConns = 1
+		}
+	}
+	if conf.Poll {
+		if p.poller, err = newNetPoller(conf.Readers); err != nil {
+			p.logger.Panic("workers", "Could not start connection poller",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	p.due = make(chan *poolEntry, conf.Size)
+	for i := 0; i < conf.Size; i++ {
+		go p.run()
+	}
+	go p.schedule()
+	go func(done <-chan struct{}) {
+		select {
+		case <-done:
+			p.closeAll()
+		case <-p.closeSignal:
+		}
+	}(app.Context().Done())
+	return nil
+}
+
+// MaxConns returns the number of connections allowed by the memory budget,
+// or 0 if unlimited.
+func (p *WorkerPool) MaxConns() int {
+	return p.maxConns
+}
+
+// RetryAfter returns the interval that connections rejected over the budget
+// should wait before reconnecting.
+func (p *WorkerPool) RetryAfter() time.Duration {
+	return p.retryAfter
+}
+
+// Transport returns the WebSocket transport for client connections:
+// PollTransport if polling is enabled, or DefaultTransport otherwise.
+func (p *WorkerPool) Transport() Transport {
+	if p.poller != nil {
+		return PollTransport{}
+	}
+	return DefaultTransport
+}
+
+// Len returns the number of connected workers.
+func (p *WorkerPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.entries)
+}
+
+// Add registers a connected worker, and schedules its first keep-alive check
+// if server pings are enabled. Returns false if the connection would exceed
+// the memory budget, or the pool is closed.
+func (p *WorkerPool) Add(worker *WorkerWS, sock *PushWS) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isClosed() {
+		return false
+	}
+	if p.maxConns > 0 && len(p.entries) >= p.maxConns {
+		p.metrics.Increment("socket.pool.rejected")
+		return false
+	}
+	entry := &poolEntry{worker: worker, sock: sock, index: -1}
+	p.entries[worker] = entry
+	if worker.serverPing > 0 {
+		entry.due = time.Now().Add(worker.serverPing)
+		p.enqueue(entry)
+	}
+	return true
+}
+
+// Remove unregisters a worker once its connection closes.
+func (p *WorkerPool) Remove(worker *WorkerWS) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry, ok := p.entries[worker]
+	if !ok {
+		return
+	}
+	delete(p.entries, worker)
+	if entry.index >= 0 {
+		heap.Remove(&p.queue, entry.index)
+	}
+}
+
+// enqueue adds an entry to the ping queue, waking the scheduler if the entry
+// is now the next due. The caller must hold the lock.
+func (p *WorkerPool) enqueue(entry *poolEntry) {
+	heap.Push(&p.queue, entry)
+	if entry.index > 0 {
+		return
+	}
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+// schedule hands connections to the pool goroutines as their keep-alive
+// checks come due.
+func (p *WorkerPool) schedule() {
+	var ready []*poolEntry
+	for {
+		p.lock.Lock()
+		now := time.Now()
+		for len(p.queue) > 0 && !p.queue[0].due.After(now) {
+			ready = append(ready, heap.Pop(&p.queue).(*poolEntry))
+		}
+		wait := time.Hour
+		if len(p.queue) > 0 {
+			wait = p.queue[0].due.Sub(now)
+		}
+		p.lock.Unlock()
+		for i, entry := range ready {
+			select {
+			case p.due <- entry:
+			case <-p.closeSignal:
+				return
+			}
+			ready[i] = nil
+		}
+		ready = ready[:0]
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+		case <-p.closeSignal:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (p *WorkerPool) run() {
+	for {
+		select {
+		case entry := <-p.due:
+			if entry.worker.keepAlive(entry.sock, time.Now()) {
+				p.reschedule(entry)
+			}
+		case <-p.closeSignal:
+			return
+		}
+	}
+}
+
+// reschedule queues the next keep-alive check for a connection, unless it
+// was removed while the check ran.
+func (p *WorkerPool) reschedule(entry *poolEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.entries[entry.worker] != entry || entry.index >= 0 {
+		return
+	}
+	now := time.Now()
+	if entry.due = entry.due.Add(entry.worker.serverPing); entry.due.Before(now) {
+		// The check ran late; don't try to catch up.
+		entry.due = now.Add(entry.worker.serverPing)
+	}
+	p.enqueue(entry)
+}
+
+// closeAll stops all connected workers, and closes their sockets to unblock
+// pending reads.
+func (p *WorkerPool) closeAll() {
+	p.lock.Lock()
+	entries := make([]*poolEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		entries = append(entries, entry)
+	}
+	p.lock.Unlock()
+	for _, entry := range entries {
+		entry.worker.cancel()
+		entry.sock.Close()
+	}
+}
+
+func (p *WorkerPool) isClosed() bool {
+	select {
+	case <-p.closeSignal:
+		return true
+	default:
+	}
+	return false
+}
+
+// Close stops the pool goroutines, and closes all remaining connections.
+func (p *WorkerPool) Close() error {
+	p.closeOnce.Do(func() {
+		p.lock.Lock()
+		close(p.closeSignal)
+		p.lock.Unlock()
+		p.closeAll()
+		if p.poller != nil {
+			p.poller.Close()
+		}
+	})
+	return nil
+}
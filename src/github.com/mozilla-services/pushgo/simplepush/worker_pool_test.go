@@ -0,0 +1,67 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBudget(t *testing.T) {
+	_, app := newTestHandler(t)
+	pool := NewWorkerPool()
+	conf := pool.ConfigStruct().(*WorkerPoolConfig)
+	conf.Size = 1
+	conf.MemoryBudget = 2 * conf.ConnectionMemory
+	if err := pool.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing worker pool: %s", err)
+	}
+	defer pool.Close()
+	if pool.MaxConns() != 2 {
+		t.Errorf("Wrong connection limit: got %d; want 2", pool.MaxConns())
+	}
+
+	first, second := NewWorker(app, "first"), NewWorker(app, "second")
+	first.serverPing = time.Hour
+	if !pool.Add(first, new(PushWS)) || !pool.Add(second, new(PushWS)) {
+		t.Fatalf("Connection rejected within budget")
+	}
+	if pool.Add(NewWorker(app, "third"), new(PushWS)) {
+		t.Errorf("Connection accepted over budget")
+	}
+	pool.lock.Lock()
+	queued := len(pool.queue)
+	pool.lock.Unlock()
+	if queued != 1 {
+		t.Errorf("Wrong number of queued keep-alive checks: got %d; want 1", queued)
+	}
+
+	pool.Remove(first)
+	pool.lock.Lock()
+	queued = len(pool.queue)
+	pool.lock.Unlock()
+	if queued != 0 {
+		t.Errorf("Removed worker still queued")
+	}
+	if !pool.Add(NewWorker(app, "third"), new(PushWS)) {
+		t.Errorf("Connection rejected after removal")
+	}
+	if pool.Len() != 2 {
+		t.Errorf("Wrong number of workers: got %d; want 2", pool.Len())
+	}
+}
+
+func TestWorkerPoolConfig(t *testing.T) {
+	_, app := newTestHandler(t)
+	for _, conf := range []*WorkerPoolConfig{
+		{Size: 0, ConnectionMemory: 8192, RetryAfter: "30s"},
+		{Size: 1, ConnectionMemory: 0, RetryAfter: "30s"},
+		{Size: 1, ConnectionMemory: 8192, RetryAfter: "soon"},
+	} {
+		if err := NewWorkerPool().Init(app, conf); err == nil {
+			t.Errorf("Invalid config accepted: %#v", conf)
+		}
+	}
+}
@@ -0,0 +1,747 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// newTestWorkerServer runs a worker for each WebSocket connection. The
+// returned WaitGroup completes once all workers have stopped.
+func newTestWorkerServer(app *Application) (*httptest.Server, *sync.WaitGroup) {
+	workers := new(sync.WaitGroup)
+	server := httptest.NewServer(DefaultTransport.Handler(func(ws Socket) {
+		workers.Add(1)
+		defer workers.Done()
+		ws.SetReadLimit(app.maxMessageSize)
+		sock := &PushWS{Socket: ws,
+			Store:  app.Store(),
+			Logger: app.Logger(),
+			Born:   time.Now()}
+		NewWorker(app, "test").Run(sock)
+	}, nil))
+	return server, workers
+}
+
+// helloTestWorker completes the handshake for a new device, and returns the
+// assigned device ID.
+func helloTestWorker(t *testing.T, socket *websocket.Conn) string {
+	helo := map[string]interface{}{"messageType": "hello", "uaid": "", "channelIDs": []string{}}
+	if err := websocket.JSON.Send(socket, helo); err != nil {
+		t.Fatalf("Error writing handshake request: %s", err)
+	}
+	reply := new(HelloReply)
+	if err := websocket.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error reading handshake reply: %s", err)
+	}
+	return reply.DeviceID
+}
+
+func dialTestWorker(t *testing.T, server *httptest.Server) *websocket.Conn {
+	origin := "ws" + strings.TrimPrefix(server.URL, "http")
+	socket, err := websocket.Dial(origin, "", server.URL)
+	if err != nil {
+		t.Fatalf("Error dialing test worker: %s", err)
+	}
+	return socket
+}
+
+func Test_WorkerServerPingTimeout(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.serverPing = 20 * time.Millisecond
+	app.maxMissedPongs = 2
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pings := 0
+	for {
+		var msg string
+		if err := websocket.Message.Receive(socket, &msg); err != nil {
+			t.Fatalf("Connection closed without bye message: %s", err)
+		}
+		if msg != "{}" {
+			bye := new(ByeMessage)
+			if err := json.Unmarshal([]byte(msg), bye); err != nil || bye.Code != int(CloseMissedPongs) {
+				t.Errorf("Unexpected message: %q", msg)
+			}
+			break
+		}
+		pings++
+	}
+	if pings != 2 {
+		t.Errorf("Wrong number of server pings: got %d; want 2", pings)
+	}
+}
+
+func Test_WorkerServerPingPong(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.serverPing = 20 * time.Millisecond
+	app.maxMissedPongs = 1
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 5; i++ {
+		var msg string
+		if err := websocket.Message.Receive(socket, &msg); err != nil {
+			t.Fatalf("Connection closed after %d pongs: %s", i, err)
+		}
+		if err := websocket.Message.Send(socket, "{}"); err != nil {
+			t.Fatalf("Error sending pong: %s", err)
+		}
+	}
+}
+
+func Test_WorkerContextCancel(t *testing.T) {
+	_, app := newTestHandler(t)
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Send(socket, "{}"); err != nil {
+		t.Fatalf("Error sending ping: %s", err)
+	}
+	if err := websocket.JSON.Receive(socket, new(PingReply)); err != nil {
+		t.Fatalf("Error reading ping reply: %s", err)
+	}
+	// The worker is now blocked reading from the socket. Cancelling the
+	// application context should close the connection and stop the worker.
+	app.Context()
+	app.cancel()
+	var msg string
+	if err := websocket.Message.Receive(socket, &msg); err == nil {
+		t.Errorf("Unexpected message after cancellation: %q", msg)
+	}
+	stopped := make(chan bool)
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Worker still running after cancellation")
+	}
+}
+
+func Test_WorkerByeTooManyPings(t *testing.T) {
+	_, app := newTestHandler(t)
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		if err := websocket.Message.Send(socket, "{}"); err != nil {
+			t.Fatalf("Error sending ping %d: %s", i, err)
+		}
+		reply := new(PingReply)
+		if err := websocket.JSON.Receive(socket, reply); err != nil {
+			t.Fatalf("Error reading ping reply %d: %s", i, err)
+		}
+		if i == 0 && reply.Status != 200 || i == 1 && reply.Status != 401 {
+			t.Errorf("Unexpected status for ping %d: %d", i, reply.Status)
+		}
+	}
+	bye := new(ByeMessage)
+	if err := websocket.JSON.Receive(socket, bye); err != nil {
+		t.Fatalf("Error reading bye message: %s", err)
+	}
+	if bye.Type != "bye" || bye.Code != int(CloseTooManyPings) {
+		t.Errorf("Unexpected bye message: %#v", bye)
+	}
+	var msg string
+	if err := websocket.Message.Receive(socket, &msg); err == nil {
+		t.Errorf("Expected closed connection; got %q", msg)
+	}
+}
+
+// closeCountingSocket counts the messages and close frames written to it.
+type closeCountingSocket struct {
+	Socket
+	lock     sync.Mutex
+	messages int
+	closes   int
+}
+
+func (s *closeCountingSocket) WriteJSON(interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages++
+	return nil
+}
+
+func (s *closeCountingSocket) WriteClose(CloseCode, string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closes++
+	return nil
+}
+
+func (s *closeCountingSocket) Close() error { return nil }
+
+func TestPushWSByeOnce(t *testing.T) {
+	socket := new(closeCountingSocket)
+	ws := &PushWS{Socket: socket}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.Bye(CloseGoingAway)
+		}()
+	}
+	wg.Wait()
+	ws.Close()
+	if socket.messages != 1 || socket.closes != 1 {
+		t.Errorf("Wrong bye: got %d messages, %d close frames; want 1 each",
+			socket.messages, socket.closes)
+	}
+}
+
+func Test_WorkerCommandMetrics(t *testing.T) {
+	_, app := newTestHandler(t)
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Send(socket, "{}"); err != nil {
+		t.Fatalf("Error sending ping: %s", err)
+	}
+	if err := websocket.JSON.Receive(socket, new(PingReply)); err != nil {
+		t.Fatalf("Error reading ping reply: %s", err)
+	}
+	// Registering before the handshake closes the connection.
+	if err := websocket.Message.Send(socket, `{"messageType":"register","channelID":"x"}`); err != nil {
+		t.Fatalf("Error sending register: %s", err)
+	}
+	var msg string
+	for websocket.Message.Receive(socket, &msg) == nil {
+	}
+	socket.Close()
+	workers.Wait()
+
+	metrics := app.Metrics().(*TestMetrics)
+	metrics.RLock()
+	defer metrics.RUnlock()
+	for name, expected := range map[string]int64{
+		"client.command.ping.ok":                        1,
+		"client.command.register.error.invalid_command": 1,
+	} {
+		if actual := metrics.Counters[name]; actual != expected {
+			t.Errorf("Wrong value for %q: got %d; want %d", name, actual, expected)
+		}
+	}
+}
+
+func Test_WorkerErrorRequestID(t *testing.T) {
+	_, app := newTestHandler(t)
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Send(socket, `{"messageType":"register","channelID":"x"}`); err != nil {
+		t.Fatalf("Error sending register: %s", err)
+	}
+	reply := make(map[string]interface{})
+	if err := websocket.JSON.Receive(socket, &reply); err != nil {
+		t.Fatalf("Error reading error reply: %s", err)
+	}
+	if reply["rid"] != "test" {
+		t.Errorf("Wrong request ID in error reply: got %#v; want %q", reply["rid"], "test")
+	}
+}
+
+func Test_ErrorReply(t *testing.T) {
+	tests := []struct {
+		message string
+		reply   string
+	}{
+		{`{"messageType":"register","channelID":"x"}`,
+			`{"messageType":"register","channelID":"x","status":401,"error":"Invalid Command"}`},
+		{`{"messageType":"hello","uaid":"abc","channelIDs":["a",1]}`,
+			`{"messageType":"hello","uaid":"abc","channelIDs":["a",1],"status":401,"error":"Invalid Command"}`},
+		// Fields of the wrong type are omitted.
+		{`{"messageType":"hello","uaid":123}`,
+			`{"messageType":"hello","status":401,"error":"Invalid Command"}`},
+	}
+	for i, test := range tests {
+		reply, err := errorReply([]byte(test.message), ErrInvalidCommand)
+		if err != nil {
+			t.Errorf("On test %d, error building reply: %s", i, err)
+			continue
+		}
+		data, _ := json.Marshal(reply)
+		if string(data) != test.reply {
+			t.Errorf("On test %d, wrong reply: got %s; want %s", i, data, test.reply)
+		}
+	}
+	for _, message := range []string{`{"messageType":`, `["register"]`} {
+		if _, err := errorReply([]byte(message), ErrInvalidCommand); err == nil {
+			t.Errorf("Expected error for malformed request %s", message)
+		}
+	}
+}
+
+// hangingStore blocks FetchAll calls until the release channel is closed.
+type hangingStore struct {
+	*NoStore
+	release chan bool
+}
+
+func (s *hangingStore) FetchAll(uaid string, since time.Time) ([]Update, []string, error) {
+	<-s.release
+	return nil, nil, nil
+}
+
+func Test_WorkerWatchdog(t *testing.T) {
+	_, app := newTestHandler(t)
+	store := &hangingStore{app.Store().(*NoStore), make(chan bool)}
+	app.store = store
+	app.watchdogTimeout = 20 * time.Millisecond
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer close(store.release)
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	uaid := helloTestWorker(t, socket)
+	var msg string
+	if err := websocket.Message.Receive(socket, &msg); err == nil {
+		t.Errorf("Expected stalled connection to be closed; got %q", msg)
+	}
+	if app.ClientExists(uaid) {
+		t.Errorf("Stalled client %q not removed", uaid)
+	}
+}
+
+func Test_WorkerHelloReset(t *testing.T) {
+	// Not used by other tests, which may add store hooks for their IDs.
+	uaid := "5e1f3b0c9a7d4e2f8b6a1c3d5e7f9a0b"
+	tooMany := make([]interface{}, 11)
+	for i := range tooMany {
+		tooMany[i] = strings.Repeat(string('a'+i), 4)
+	}
+	tests := []struct {
+		name     string
+		uaid     string
+		exists   bool
+		chids    []interface{}
+		reset    bool
+		resetIDs []string
+	}{
+		{"unknown device", uaid, false, []interface{}{"aaaa", "bbbb", 1}, true,
+			[]string{"aaaa", "bbbb"}},
+		{"too many channels", uaid, true, tooMany, true,
+			[]string{"aaaa", "bbbb", "cccc", "dddd", "eeee", "ffff", "gggg",
+				"hhhh", "iiii", "jjjj", "kkkk"}},
+		{"known device", uaid, true, []interface{}{"aaaa"}, false, nil},
+		{"new device", "", false, []interface{}{}, false, nil},
+	}
+	for _, test := range tests {
+		func() {
+			_, app := newTestHandler(t)
+			app.Store().(*NoStore).UAIDExists = test.exists
+			server, workers := newTestWorkerServer(app)
+			defer server.Close()
+
+			socket := dialTestWorker(t, server)
+			defer workers.Wait()
+			defer socket.Close()
+			socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+			helo := map[string]interface{}{"messageType": "hello",
+				"uaid": test.uaid, "channelIDs": test.chids}
+			if err := websocket.JSON.Send(socket, helo); err != nil {
+				t.Fatalf("%s: error writing handshake request: %s", test.name, err)
+			}
+			heloReply := new(HelloReply)
+			if err := websocket.JSON.Receive(socket, heloReply); err != nil {
+				t.Fatalf("%s: error reading handshake reply: %s", test.name, err)
+			}
+			if !test.reset {
+				// The next message should be the reply to a ping.
+				if len(test.uaid) > 0 && heloReply.DeviceID != test.uaid {
+					t.Errorf("%s: device ID changed: got %q", test.name, heloReply.DeviceID)
+				}
+				if err := websocket.Message.Send(socket, "{}"); err != nil {
+					t.Fatalf("%s: error sending ping: %s", test.name, err)
+				}
+				reply := new(PingReply)
+				if err := websocket.JSON.Receive(socket, reply); err != nil || reply.Status != 200 {
+					t.Errorf("%s: expected ping reply; got %#v (%v)", test.name, reply, err)
+				}
+				return
+			}
+			reset := new(ResetReply)
+			if err := websocket.JSON.Receive(socket, reset); err != nil {
+				t.Fatalf("%s: error reading reset message: %s", test.name, err)
+			}
+			if reset.Type != "reset" || reset.DeviceID != heloReply.DeviceID ||
+				reset.DeviceID == test.uaid {
+
+				t.Errorf("%s: wrong reset message: %#v; handshake reply: %#v",
+					test.name, reset, heloReply)
+			}
+			if !reflect.DeepEqual(reset.ChannelIDs, test.resetIDs) {
+				t.Errorf("%s: wrong reset channels: got %v; want %v",
+					test.name, reset.ChannelIDs, test.resetIDs)
+			}
+		}()
+	}
+}
+
+func Test_WorkerStoreCallCancel(t *testing.T) {
+	_, app := newTestHandler(t)
+	worker := NewWorker(app, "test")
+	release := make(chan bool)
+	defer close(release)
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.storeCall(func() error {
+			<-release
+			return nil
+		})
+	}()
+	worker.cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Wrong error for cancelled store call: got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Store call still blocked after cancellation")
+	}
+	if err := worker.storeCall(func() error {
+		t.Errorf("Store called after cancellation")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Wrong error after cancellation: got %v", err)
+	}
+}
+
+func Test_WorkerMessageTooLarge(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.maxMessageSize = 64
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	helo := map[string]interface{}{"messageType": "hello", "uaid": "",
+		"channelIDs": []string{strings.Repeat("a", 64)}}
+	if err := websocket.JSON.Send(socket, helo); err != nil {
+		t.Fatalf("Error writing oversized handshake request: %s", err)
+	}
+	var msg string
+	if err := websocket.Message.Receive(socket, &msg); err == nil {
+		t.Errorf("Expected connection to be closed; got %q", msg)
+	}
+}
+
+func Test_DumpStacks(t *testing.T) {
+	_, app := newTestHandler(t)
+	stacks := app.dumpStacks(time.Minute)
+	if !bytes.Contains(stacks, []byte("Test_DumpStacks")) {
+		t.Errorf("Stacks do not include the calling goroutine: %s", stacks)
+	}
+	if stacks = app.dumpStacks(time.Minute); stacks != nil {
+		t.Errorf("Stacks dumped twice in one interval")
+	}
+}
+
+func Test_WorkerWriteTimeout(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.writeTimeout = 50 * time.Millisecond
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	uaid := helloTestWorker(t, socket)
+	client, ok := app.GetClient(uaid)
+	if !ok {
+		t.Fatalf("Client %q not registered", uaid)
+	}
+
+	// Stop reading, so that flushes fill the socket buffers and time out.
+	data := strings.Repeat("x", 1<<18)
+	for i := 0; i < 256 && app.ClientExists(uaid); i++ {
+		app.Server().RequestFlush(client, "decafbad", int64(i), data, SpanContext{})
+	}
+	if app.ClientExists(uaid) {
+		t.Errorf("Slow client %q not evicted", uaid)
+	}
+}
+
+func Test_ApplicationDrain(t *testing.T) {
+	handler, app := newTestHandler(t)
+	app.drainTimeout = 5 * time.Second
+	app.drainRetryAfter = 10 * time.Second
+	server := httptest.NewServer(DefaultTransport.Handler(
+		handler.PushSocketHandler, nil))
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	helloTestWorker(t, socket)
+
+	drained := make(chan bool)
+	go func() {
+		app.Drain()
+		close(drained)
+	}()
+	bye := new(ByeMessage)
+	if err := websocket.JSON.Receive(socket, bye); err != nil {
+		t.Fatalf("Error reading bye message: %s", err)
+	}
+	if bye.Code != int(CloseGoingAway) || bye.RetryAfter < 1 || bye.RetryAfter > 10 {
+		t.Errorf("Unexpected bye message: %#v", bye)
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for drain")
+	}
+	if !app.Draining() {
+		t.Errorf("Expected application to report draining")
+	}
+	if n := app.ClientCount(); n != 0 {
+		t.Errorf("Expected all clients to disconnect; %d remaining", n)
+	}
+	if _, err := net.Dial("tcp", app.Server().ClientListener().Addr().String()); err == nil {
+		t.Errorf("Expected client listener to be closed")
+	}
+}
+
+// channelLimitStore lists a fixed set of registered channels.
+type channelLimitStore struct {
+	*NoStore
+	ids          []string
+	channels     []RegisteredChannel
+	fetches      int
+	unregistered []string
+}
+
+func (s *channelLimitStore) ChannelIDs(uaid string) ([]string, error) {
+	return s.ids, nil
+}
+
+func (s *channelLimitStore) Channels(uaid string) ([]RegisteredChannel, error) {
+	s.fetches++
+	return s.channels, nil
+}
+
+func (s *channelLimitStore) Unregister(uaid, chid string) error {
+	s.unregistered = append(s.unregistered, chid)
+	return nil
+}
+
+func Test_WorkerChannelLimit(t *testing.T) {
+	_, app := newTestHandler(t)
+	now := time.Now()
+	store := &channelLimitStore{
+		NoStore: app.Store().(*NoStore),
+		channels: []RegisteredChannel{
+			{"b", now.Add(-1 * time.Minute)},
+			{"a", now.Add(-2 * time.Minute)},
+			{"c", now},
+		},
+		ids: []string{"b", "a", "c"},
+	}
+	store.maxChannels = 3
+	sock := &PushWS{Store: store}
+	worker := NewWorker(app, "test")
+
+	if evict, err := worker.checkChannelLimit(sock, "uaid", []string{"c"}); err != nil || evict != nil {
+		t.Errorf("Re-registering a channel: got %#v, %v", evict, err)
+	}
+	if store.fetches != 0 {
+		t.Errorf("Channel records fetched for a registration under the limit")
+	}
+	// Unregistered channels in the ID list don't count against the limit.
+	store.ids = append(store.ids, "z")
+	if evict, err := worker.checkChannelLimit(sock, "uaid", []string{"c"}); err != nil || evict != nil {
+		t.Errorf("Re-registering with an unregistered channel: got %#v, %v", evict, err)
+	}
+	if store.fetches != 1 {
+		t.Errorf("Channel records not fetched for a list over the limit")
+	}
+	if _, err := worker.checkChannelLimit(sock, "uaid", []string{"d"}); err != ErrChannelLimit {
+		t.Errorf("Wrong error for registration beyond limit: %v", err)
+	}
+
+	app.Server().evictChannels = true
+	evict, err := worker.checkChannelLimit(sock, "uaid", []string{"c", "d", "e"})
+	if err != nil {
+		t.Fatalf("Error checking registrations with eviction: %s", err)
+	}
+	if len(evict) != 2 || evict[0] != "a" || evict[1] != "b" {
+		t.Errorf("Wrong evicted channels: %#v", evict)
+	}
+	worker.evictChannels(sock, "uaid", evict)
+	if len(store.unregistered) != 2 {
+		t.Errorf("Evicted channels not unregistered: %#v", store.unregistered)
+	}
+	if _, err = worker.checkChannelLimit(sock, "uaid", []string{"d", "e", "f", "g"}); err != ErrChannelLimit {
+		t.Errorf("Wrong error for batch larger than limit: %v", err)
+	}
+
+	metrics := app.Metrics().(*TestMetrics)
+	metrics.RLock()
+	defer metrics.RUnlock()
+	for name, expected := range map[string]int64{
+		"client.channels.limit":   2,
+		"client.channels.evicted": 2,
+	} {
+		if actual := metrics.Counters[name]; actual != expected {
+			t.Errorf("Wrong value for %q: got %d; want %d", name, actual, expected)
+		}
+	}
+}
+
+func Test_WorkerQueuedFlushDelivered(t *testing.T) {
+	_, app := newTestHandler(t)
+	app.flushQueueDepth = 10
+	delivered := make(chan *Event, 1)
+	app.Events().Subscribe(EventUpdateDelivered, func(event *Event) {
+		delivered <- event
+	})
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	uaid := helloTestWorker(t, socket)
+	client, ok := app.GetClient(uaid)
+	if !ok {
+		t.Fatalf("Client %q not registered", uaid)
+	}
+
+	app.Server().RequestFlush(client, "decafbad", 1, "", SpanContext{})
+	reply := new(FlushReply)
+	if err := websocket.JSON.Receive(socket, reply); err != nil {
+		t.Fatalf("Error reading notification: %s", err)
+	}
+	select {
+	case event := <-delivered:
+		if event.ChannelID != "decafbad" || event.Version != 1 {
+			t.Errorf("Wrong delivery event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Delivery event not published after the update was written")
+	}
+}
+
+func Test_WorkerNack(t *testing.T) {
+	notifications := make(chan *NackNotification, 1)
+	nackServer := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		notification := new(NackNotification)
+		if err := json.NewDecoder(req.Body).Decode(notification); err != nil {
+			t.Errorf("Error decoding nack notification: %s", err)
+		}
+		notifications <- notification
+	}))
+	defer nackServer.Close()
+
+	_, app := newTestHandler(t)
+	srv := app.Server()
+	srv.nackURL = nackServer.URL
+	srv.nackQueue = make(chan *NackNotification, 10)
+	go srv.notifyNacks()
+	server, workers := newTestWorkerServer(app)
+	defer server.Close()
+
+	socket := dialTestWorker(t, server)
+	defer workers.Wait()
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	uaid := helloTestWorker(t, socket)
+	chid := "decafbad000000000000000000000000"
+	pk, _ := app.Store().IDsToKey(uaid, chid)
+	receipts, _ := srv.Receipts().Subscribe(pk)
+	defer srv.Receipts().Unsubscribe(pk, receipts)
+
+	nack := map[string]interface{}{"messageType": "nack", "code": 2,
+		"updates": []Update{{chid, 5, "Garbled"}}}
+	if err := websocket.JSON.Send(socket, nack); err != nil {
+		t.Fatalf("Error writing nack: %s", err)
+	}
+	select {
+	case receipt := <-receipts:
+		if receipt.Type != ReceiptFailed || receipt.Version != 5 || receipt.Code != 2 {
+			t.Errorf("Wrong receipt: %#v", receipt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for failure receipt")
+	}
+	select {
+	case notification := <-notifications:
+		if notification.Version != 5 || notification.Code != 2 ||
+			len(notification.Endpoint) == 0 {
+			t.Errorf("Wrong nack notification: %#v", notification)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for nack notification")
+	}
+}
+
+func Test_ServNackQueueFull(t *testing.T) {
+	_, app := newTestHandler(t)
+	srv := app.Server()
+	srv.nackURL = "http://127.0.0.1:1"
+	srv.nackQueue = make(chan *NackNotification, 1)
+	sock := new(PushWS)
+	sock.SetUAID("deadbeef000000000000000000000000")
+
+	// Notifications beyond the queue size are dropped instead of spawning a
+	// request for each nack.
+	updates := []Update{{"chid1", 1, ""}, {"chid2", 1, ""}, {"chid3", 1, ""}}
+	srv.Nack(PushCommand{NACK, &CommandArgs{Updates: updates, Code: 1}}, sock)
+	if len(srv.nackQueue) != 1 {
+		t.Errorf("Wrong queued notification count: got %d; want 1", len(srv.nackQueue))
+	}
+	metrics := app.Metrics().(*TestMetrics)
+	metrics.RLock()
+	defer metrics.RUnlock()
+	if dropped := metrics.Counters["updates.rejected.notify.dropped"]; dropped != 2 {
+		t.Errorf("Wrong dropped notification count: got %d; want 2", dropped)
+	}
+}
@@ -0,0 +1,212 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+type WriteCoalescerConfig struct {
+	// Interval is the time that channel version updates are held before
+	// they are written, so that successive updates for the same channel are
+	// written once, with the highest version. Defaults to "0" (disabled):
+	// updates are written immediately.
+	Interval string `env:"interval"`
+
+	// MaxPending is the number of channels with pending updates that
+	// triggers an early flush. Defaults to 1000.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// Writers is the number of concurrent storage writes used to flush
+	// pending updates. Defaults to 8.
+	Writers int `env:"writers"`
+}
+
+// pendingWrite is a coalesced channel version update. All callers that
+// update the channel before the next flush wait for the same write.
+type pendingWrite struct {
+	version int64
+	err     error
+	done    chan bool
+	prev    *pendingWrite // The channel's write from an earlier flush, if any.
+}
+
+// WriteCoalescer batches version updates for the same channel. Callers
+// block until the batch holding their update is written, so that updates
+// are stored before they are delivered, as with direct storage writes.
+type WriteCoalescer struct {
+	app        *Application
+	logger     *SimpleLogger
+	metrics    Statistician
+	interval   time.Duration
+	maxPending int
+	writers    int
+	lock       sync.Mutex
+	pending    map[string]*pendingWrite // Keyed by storage key.
+	writing    map[string]*pendingWrite // Last flushed write for each key.
+	timer      *time.Timer
+	isClosed   bool
+}
+
+func NewWriteCoalescer() *WriteCoalescer {
+	return &WriteCoalescer{
+		pending: make(map[string]*pendingWrite),
+		writing: make(map[string]*pendingWrite),
+	}
+}
+
+func (*WriteCoalescer) ConfigStruct() interface{} {
+	return &WriteCoalescerConfig{
+		Interval:   "0",
+		MaxPending: 1000,
+		Writers:    8,
+	}
+}
+
+func (c *WriteCoalescer) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*WriteCoalescerConfig)
+	c.app = app
+	c.logger = app.Logger()
+	c.metrics = app.Metrics()
+	if c.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		c.logger.Panic("coalesce", "Could not parse write interval",
+			LogFields{"error": err.Error(), "interval": conf.Interval})
+		return err
+	}
+	if conf.MaxPending < 1 || conf.Writers < 1 {
+		c.logger.Panic("coalesce", "Invalid write coalescing settings", LogFields{
+			"maxPending": strconv.Itoa(conf.MaxPending),
+			"writers":    strconv.Itoa(conf.Writers)})
+		return ConfigurationErr
+	}
+	c.maxPending = conf.MaxPending
+	c.writers = conf.Writers
+	return nil
+}
+
+// Enabled indicates whether updates are coalesced.
+func (c *WriteCoalescer) Enabled() bool {
+	return c.interval > 0
+}
+
+// Update sets the version of the channel record with the given storage key,
+// and blocks until the version is written. If another update for the same
+// channel is pending, the higher of the two versions is written once.
+func (c *WriteCoalescer) Update(key string, version int64) error {
+	if !c.Enabled() {
+		return c.app.Store().Update(key, version)
+	}
+	c.lock.Lock()
+	if c.isClosed {
+		prev := c.writing[key]
+		c.lock.Unlock()
+		if prev != nil {
+			<-prev.done
+		}
+		return c.app.Store().Update(key, version)
+	}
+	write, ok := c.pending[key]
+	if ok {
+		if version > write.version {
+			write.version = version
+		}
+		c.metrics.Increment("store.update.coalesced")
+	} else {
+		write = &pendingWrite{version: version, done: make(chan bool)}
+		c.pending[key] = write
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.interval, c.Flush)
+		}
+	}
+	full := len(c.pending) >= c.maxPending
+	c.lock.Unlock()
+	if full {
+		c.Flush()
+	}
+	<-write.done
+	return write.err
+}
+
+// Pending returns the number of channels with pending updates.
+func (c *WriteCoalescer) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
+
+// Flush writes all pending updates, and returns once they are written.
+// Flushes may overlap; a write waits for the channel's write from an earlier
+// flush, so that an older version cannot overwrite a newer one.
+func (c *WriteCoalescer) Flush() {
+	c.lock.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	batch := c.pending
+	if len(batch) == 0 {
+		c.lock.Unlock()
+		return
+	}
+	c.pending = make(map[string]*pendingWrite)
+	for key, write := range batch {
+		write.prev = c.writing[key]
+		c.writing[key] = write
+	}
+	c.lock.Unlock()
+
+	startTime := time.Now()
+	keys := make(chan string, len(batch))
+	for key := range batch {
+		keys <- key
+	}
+	close(keys)
+	writers := c.writers
+	if writers > len(batch) {
+		writers = len(batch)
+	}
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				write := batch[key]
+				if write.prev != nil {
+					<-write.prev.done
+					write.prev = nil
+				}
+				if write.err = c.app.Store().Update(key, write.version); write.err != nil &&
+					c.logger.ShouldLog(WARNING) {
+
+					c.logger.Warn("coalesce", "Could not write channel update", LogFields{
+						"key":     key,
+						"version": strconv.FormatInt(write.version, 10),
+						"error":   write.err.Error()})
+				}
+				close(write.done)
+				c.lock.Lock()
+				if c.writing[key] == write {
+					delete(c.writing, key)
+				}
+				c.lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	c.metrics.IncrementBy("store.update.flushed", int64(len(batch)))
+	c.metrics.Timer("store.update.flush", time.Since(startTime))
+}
+
+// Close writes any pending updates. Later updates are written immediately.
+func (c *WriteCoalescer) Close() error {
+	c.lock.Lock()
+	c.isClosed = true
+	c.lock.Unlock()
+	c.Flush()
+	return nil
+}
@@ -0,0 +1,138 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type coalescerTestStore struct {
+	*NoStore
+	lock     sync.Mutex
+	versions map[string][]int64
+	hold     chan bool // If set, writes of version 1 block until signalled.
+}
+
+func (s *coalescerTestStore) Update(key string, version int64) error {
+	if version == 1 && s.hold != nil {
+		s.hold <- true
+		<-s.hold
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.versions[key] = append(s.versions[key], version)
+	return nil
+}
+
+func newTestCoalescer(t *testing.T, interval string, maxPending int) (
+	*WriteCoalescer, *coalescerTestStore) {
+
+	_, app := newTestHandler(t)
+	store := &coalescerTestStore{
+		NoStore:  app.Store().(*NoStore),
+		versions: make(map[string][]int64),
+	}
+	app.SetStore(store)
+	writes := NewWriteCoalescer()
+	conf := writes.ConfigStruct().(*WriteCoalescerConfig)
+	conf.Interval = interval
+	conf.MaxPending = maxPending
+	if err := writes.Init(app, conf); err != nil {
+		t.Fatalf("Error initializing write coalescer: %s", err)
+	}
+	return writes, store
+}
+
+func TestWriteCoalescerUpdate(t *testing.T) {
+	writes, store := newTestCoalescer(t, "100ms", 100)
+	var wg sync.WaitGroup
+	for version := int64(1); version <= 10; version++ {
+		wg.Add(1)
+		go func(version int64) {
+			defer wg.Done()
+			if err := writes.Update("uaid.chid", version); err != nil {
+				t.Errorf("Error updating version %d: %s", version, err)
+			}
+		}(version)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		writes.Update("uaid.other", 1)
+	}()
+	wg.Wait()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if versions := store.versions["uaid.chid"]; len(versions) != 1 || versions[0] != 10 {
+		t.Errorf("Wrong writes for coalesced channel: got %v; want [10]", versions)
+	}
+	if versions := store.versions["uaid.other"]; len(versions) != 1 {
+		t.Errorf("Wrong writes for other channel: got %v", versions)
+	}
+}
+
+func TestWriteCoalescerMaxPending(t *testing.T) {
+	// Flushed early once two channels are pending, well before the interval.
+	writes, store := newTestCoalescer(t, "1h", 2)
+	done := make(chan bool)
+	go func() {
+		writes.Update("uaid.a", 1)
+		close(done)
+	}()
+	if err := writes.Update("uaid.b", 2); err != nil {
+		t.Fatalf("Error updating version: %s", err)
+	}
+	<-done
+	if writes.Pending() != 0 {
+		t.Errorf("Pending updates after flush: %d", writes.Pending())
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(store.versions) != 2 {
+		t.Errorf("Wrong number of written channels: got %d; want 2", len(store.versions))
+	}
+}
+
+func TestWriteCoalescerDisabled(t *testing.T) {
+	writes, store := newTestCoalescer(t, "0", 100)
+	writes.Update("uaid.chid", 1)
+	writes.Update("uaid.chid", 2)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if versions := store.versions["uaid.chid"]; len(versions) != 2 {
+		t.Errorf("Updates coalesced while disabled: got %v", versions)
+	}
+}
+
+func TestWriteCoalescerFlushOrder(t *testing.T) {
+	// Each update is flushed on its own, so the flushes overlap.
+	writes, store := newTestCoalescer(t, "1h", 1)
+	store.hold = make(chan bool)
+	done := make(chan bool)
+	go func() {
+		writes.Update("uaid.chid", 1)
+		done <- true
+	}()
+	<-store.hold
+	go func() {
+		writes.Update("uaid.chid", 2)
+		done <- true
+	}()
+	// The second write should wait for the first, rather than overtake it.
+	time.Sleep(50 * time.Millisecond)
+	store.hold <- true
+	<-done
+	<-done
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if versions := store.versions["uaid.chid"]; len(versions) != 2 ||
+		versions[0] != 1 || versions[1] != 2 {
+
+		t.Errorf("Wrong write order: got %v; want [1 2]", versions)
+	}
+}